@@ -6,7 +6,7 @@ WIFI_SSID = "xx"  # 替换为你的WiFi名称
 WIFI_PASSWORD = "xx"  # 替换为你的WiFi密码
 
 # 服务器配置
-SERVER_HOST = "192.168.1.11"  # 替换为你的服务器IP地址
+SERVER_HOST = "192.168.1.11"  # 替换为你的服务器IP地址；留空 "" 时通过mDNS自动发现（服务器需开启 -mdns）
 SERVER_PORT = 8080  # 服务器端口
 SERVER_PROTOCOL = "http"  # 协议类型
 
@@ -16,6 +16,7 @@ SERVER_PROTOCOL = "http"  # 协议类型
 # 轮询配置
 POLL_INTERVAL = 5  # 轮询间隔（秒）
 REQUEST_TIMEOUT = 125  # 请求超时时间（秒）
+POLL_MAX_MESSAGES = 0  # 每次轮询最多接收的消息数，0 表示不限制；内存紧张时设为 1-5，其余消息留在服务器上
 
 # WOL配置
 WOL_PORT = 9  # WOL魔术包端口
@@ -30,6 +31,41 @@ API_KEY = "esp32-wol-2024"  # API密钥
 # API端点
 API_POLL_ENDPOINT = "/api/wol/poll"  # 轮询端点
 API_REGISTER_ENDPOINT = "/api/devices/register"  # 设备注册端点
+API_ACK_ENDPOINT = "/api/wol/ack"  # 消息确认端点
+API_TIME_ENDPOINT = "/api/time"  # 校时端点
+API_PROVISION_ENDPOINT = "/api/provision"  # 配置下发端点
+API_FIRMWARE_ENDPOINT = "/api/firmware/manifest"  # 固件清单端点
+API_CRASH_ENDPOINT = "/api/devices/{id}/crash"  # 重启原因上报端点
+API_WIFI_SCAN_ENDPOINT = "/api/devices/{id}/wifi-scan"  # WiFi扫描结果上报端点
+API_NEIGHBORS_ENDPOINT = "/api/devices/{id}/neighbors"  # 邻居表上报端点
+
+# 固件更新：定期查询服务器的固件清单，有新版本时写入OTA分区并重启（需要带OTA分区的MicroPython固件）
+FIRMWARE_VERSION = "1.0"  # 当前固件版本，注册时上报，发布新固件时同步修改
+FIRMWARE_UPDATE = False  # 是否自动更新
+FIRMWARE_CHANNEL = "stable"  # 更新通道，管理员为设备指定的通道优先
+FIRMWARE_CHECK_INTERVAL = 24 * 3600  # 检查间隔（秒）
+
+# 配置下发：填写管理员创建的注册码后，首次启动时从服务器获取服务器地址、API密钥、
+# 轮询间隔和广播参数并保存到 PROVISION_FILE，之后不再使用注册码。
+# 删除 PROVISION_FILE 可重新获取（需要新的注册码）
+PROVISION_CODE = ""  # 例如 "K7QX-M2PD"，留空时使用本文件中的配置
+PROVISION_FILE = "provision.json"
+
+# 崩溃上报：启动时上报重启原因，未捕获异常的回溯保存在 CRASH_FILE 中，下次启动时一并上报
+CRASH_REPORT = True  # 是否上报
+CRASH_FILE = "crash.json"
+
+# 供电状态：电池供电的中继在注册和轮询时上报供电方式、电池电压和电量，服务器在电量低时告警
+POWER_MONITOR = False  # 是否上报
+BATTERY_ADC_PIN = 35  # 接电池分压电路的ADC引脚，None 表示不测电压
+BATTERY_DIVIDER = 2.0  # 分压比（电池电压 / 引脚电压）
+BATTERY_EMPTY_VOLTAGE = 3.3  # 电量0%时的电压
+BATTERY_FULL_VOLTAGE = 4.2  # 电量100%时的电压
+USB_SENSE_PIN = None  # 有外部供电时为高电平的引脚，None 表示始终视为电池供电
+
+# 校时配置：无法访问NTP时从服务器获取时间
+TIME_SYNC = True  # 是否从服务器校时
+TIME_SYNC_INTERVAL = 6 * 3600  # 重新校时间隔（秒）
 
 # 网络配置
 WIFI_CONNECT_TIMEOUT = 30  # WiFi连接超时时间（秒）
@@ -0,0 +1,62 @@
+# 崩溃上报模块
+# Saves uncaught exceptions before reset and reports the reset reason to the server on the next boot
+
+import sys
+import io
+import time
+import ujson
+import machine
+from config import FIRMWARE_VERSION, CRASH_FILE, API_CRASH_ENDPOINT, DEBUG
+
+# machine.reset_cause() 的返回值与服务器使用的名称
+RESET_REASONS = {
+    machine.PWRON_RESET: 'power_on',
+    machine.HARD_RESET: 'hard',
+    machine.WDT_RESET: 'watchdog',
+    machine.DEEPSLEEP_RESET: 'deepsleep',
+    machine.SOFT_RESET: 'soft'
+}
+
+def save(exc):
+    """保存未捕获异常的回溯，下次启动时上报"""
+    try:
+        buf = io.StringIO()
+        sys.print_exception(exc, buf)
+        with open(CRASH_FILE, 'w') as f:
+            ujson.dump({'dump': buf.getvalue(), 'uptime': time.ticks_ms() // 1000}, f)
+    except Exception as e:
+        if DEBUG:
+            print("Failed to save crash dump: " + str(e))
+
+def report(http_client):
+    """上报本次启动的重启原因和上次保存的回溯，成功后删除回溯文件"""
+    cause = machine.reset_cause()
+    report = {
+        'reset_reason': RESET_REASONS.get(cause, str(cause)),
+        'firmware_version': FIRMWARE_VERSION
+    }
+    saved = None
+    try:
+        with open(CRASH_FILE) as f:
+            saved = ujson.load(f)
+        report['dump'] = saved.get('dump', '')
+        report['uptime'] = saved.get('uptime', 0)
+    except OSError:
+        pass
+    except Exception as e:
+        if DEBUG:
+            print("Invalid crash file: " + str(e))
+
+    endpoint = API_CRASH_ENDPOINT.replace('{id}', http_client.device_id)
+    _, error = http_client._make_request('POST', endpoint, report)
+    if error:
+        if DEBUG:
+            print("Crash report failed: " + str(error))
+        return False
+    if saved is not None:
+        try:
+            import os
+            os.remove(CRASH_FILE)
+        except OSError:
+            pass
+    return True
@@ -6,8 +6,8 @@ import ujson
 import time
 from config import (
     SERVER_HOST, SERVER_PORT, SERVER_PROTOCOL,
-    API_POLL_ENDPOINT, API_REGISTER_ENDPOINT,
-    REQUEST_TIMEOUT, DEBUG, API_KEY
+    API_POLL_ENDPOINT, API_REGISTER_ENDPOINT, API_ACK_ENDPOINT, API_TIME_ENDPOINT, API_WIFI_SCAN_ENDPOINT, API_NEIGHBORS_ENDPOINT,
+    REQUEST_TIMEOUT, DEBUG, API_KEY, FIRMWARE_VERSION, POWER_MONITOR, POLL_MAX_MESSAGES
 )
 
 class HTTPClient:
@@ -17,12 +17,28 @@ class HTTPClient:
         self.server_protocol = SERVER_PROTOCOL
         # 使用MAC地址作为设备ID
         self.device_id = self._get_mac_address()
+        self.device_name = 'ESP32-' + self.device_id
         self.base_url = self.server_protocol + "://" + self.server_host + ":" + str(self.server_port)
         self.headers = {
             'Content-Type': 'application/json',
             'User-Agent': 'ESP32-WOL-Client/1.0',
             'X-API-Key': API_KEY
         }
+        # 服务器报告本机时钟偏差过大，主循环据此立即重新校时
+        self.clock_skewed = False
+        # 上次轮询后服务器上还留有的消息数（POLL_MAX_MESSAGES），主循环据此立即再次轮询
+        self.poll_remaining = 0
+    
+    def set_server(self, protocol, host, port, path=""):
+        """设置服务器地址（例如通过mDNS发现的地址）"""
+        self.server_protocol = protocol
+        self.server_host = host
+        self.server_port = port
+        self.base_url = protocol + "://" + host + ":" + str(port) + path
+    
+    def set_api_key(self, api_key):
+        """设置API密钥（例如配置下发的设备令牌）"""
+        self.headers['X-API-Key'] = api_key
     
     def _get_mac_address(self):
         """获取ESP32的MAC地址作为设备ID"""
@@ -60,6 +76,9 @@ class HTTPClient:
                 try:
                     response_data = response.json()
                     response.close()
+                    # 服务器对弃用的接口或字段返回 warnings
+                    if DEBUG and isinstance(response_data, dict) and response_data.get('warnings'):
+                        print("Server warnings: " + str(response_data['warnings']))
                     return response_data, None
                 except:
                     response_text = response.text
@@ -78,65 +97,74 @@ class HTTPClient:
     
     def poll_for_messages(self):
         """轮询服务器获取唤醒消息"""
+        self.poll_remaining = 0
         try:
             params = {
                 'device_id': self.device_id
             }
+            if POLL_MAX_MESSAGES:
+                params['max_messages'] = POLL_MAX_MESSAGES
+            if POWER_MONITOR:
+                import power
+                params.update(power.poll_params())
             
             response_data, error = self._make_request('GET', API_POLL_ENDPOINT, params=params)
             
             if error:
                 if DEBUG:
                     print("Poll request failed: " + str(error))
-                return None, error
+                return [], error
             
             # 解析响应 - 服务器返回PollResponse格式
             if isinstance(response_data, dict):
-                messages = response_data.get('messages', [])
-                total = response_data.get('total', 0)
-                
-                if total > 0 and len(messages) > 0:
-                    # 返回第一条消息
-                    first_message = messages[0]
-                    message = {
-                        'id': first_message.get('id', ''),
-                        'target_mac': first_message.get('target_mac', ''),
-                        'created_at': first_message.get('created_at', '')
-                    }
-                    if DEBUG:
-                        print("Received WOL message: " + str(message))
-                        print("Total messages: " + str(total))
-                    return message, None
-                else:
-                    if DEBUG:
+                self.poll_remaining = response_data.get('remaining', 0)
+                messages = []
+                for item in response_data.get('messages', []):
+                    messages.append({
+                        'id': item.get('id', ''),
+                        'type': item.get('type', ''),
+                        'target_mac': item.get('target_mac', ''),
+                        'destinations': item.get('destinations', []),
+                        'created_at': item.get('created_at', '')
+                    })
+                if DEBUG:
+                    if messages:
+                        print("Received " + str(len(messages)) + " message(s): " + str(messages))
+                    else:
                         print("No pending messages")
-                    return None, None
+                return messages, None
             else:
                 if DEBUG:
                     print("Invalid response format")
-                return None, "Invalid response format"
+                return [], "Invalid response format"
                 
         except Exception as e:
             error_msg = "Poll error: " + str(e)
             if DEBUG:
                 print(error_msg)
-            return None, error_msg
+            return [], error_msg
     
     def register_device(self, device_info=None):
         """向服务器注册设备"""
         try:
             # 构造注册请求数据，使用MAC地址作为设备ID
             data = {
-                'name': 'ESP32-' + self.device_id,
+                'name': self.device_name,
                 'mac_address': self.device_id,  # device_id就是MAC地址
                 'description': 'ESP32 WOL Device',
-                'version': '1.0'
+                'version': FIRMWARE_VERSION
             }
             
             # 如果提供了额外的设备信息，更新数据
             if device_info:
                 data.update(device_info)
             
+            if POWER_MONITOR:
+                import power
+                status = power.read()
+                if status:
+                    data['power'] = status
+            
             response_data, error = self._make_request('POST', API_REGISTER_ENDPOINT, data=data)
             
             if error:
@@ -153,4 +181,107 @@ class HTTPClient:
             error_msg = "Device registration error: " + str(e)
             if DEBUG:
                 print(error_msg)
-            return False, error_msg
\ No newline at end of file
+            return False, error_msg
+    
+    def sync_time(self):
+        """从服务器获取当前时间并设置RTC（UTC）"""
+        try:
+            response_data, error = self._make_request('GET', API_TIME_ENDPOINT)
+            if error:
+                if DEBUG:
+                    print("Time sync failed: " + str(error))
+                return False, error
+            if not isinstance(response_data, dict) or 'epoch' not in response_data:
+                return False, "Invalid response format"
+            
+            epoch = response_data['epoch']
+            # MicroPython 在部分端口上以2000-01-01为纪元
+            if time.gmtime(0)[0] == 2000:
+                epoch -= 946684800
+            t = time.gmtime(epoch)
+            from machine import RTC
+            # RTC.datetime 的顺序：年、月、日、星期、时、分、秒、亚秒
+            RTC().datetime((t[0], t[1], t[2], t[6], t[3], t[4], t[5], 0))
+            self.clock_skewed = False
+            
+            if DEBUG:
+                print("Clock set from server: %04d-%02d-%02d %02d:%02d:%02d UTC (server timezone %s)" % (
+                    t[0], t[1], t[2], t[3], t[4], t[5], response_data.get('timezone', '')))
+            return True, None
+            
+        except Exception as e:
+            error_msg = "Time sync error: " + str(e)
+            if DEBUG:
+                print(error_msg)
+            return False, error_msg
+    
+    def upload_wifi_scan(self, report, message_id=None):
+        """上传WiFi扫描结果"""
+        if message_id:
+            report['message_id'] = message_id
+        scanned_at = self.utc_now()
+        if scanned_at:
+            report['time'] = scanned_at
+        endpoint = API_WIFI_SCAN_ENDPOINT.replace('{id}', self.device_id)
+        _, err = self._make_request('POST', endpoint, data=report)
+        if err:
+            if DEBUG:
+                print("WiFi scan upload failed: " + str(err))
+            return False, err
+        return True, None
+    
+    def upload_neighbors(self, report, message_id=None):
+        """上传邻居表（所在网段中发现的主机）"""
+        if message_id:
+            report['message_id'] = message_id
+        scanned_at = self.utc_now()
+        if scanned_at:
+            report['time'] = scanned_at
+        endpoint = API_NEIGHBORS_ENDPOINT.replace('{id}', self.device_id)
+        _, err = self._make_request('POST', endpoint, data=report)
+        if err:
+            if DEBUG:
+                print("Neighbor table upload failed: " + str(err))
+            return False, err
+        return True, None
+    
+    def utc_now(self):
+        """当前UTC时间（RFC 3339），时钟未校准时返回None"""
+        t = time.gmtime()
+        if t[0] < 2024:
+            return None
+        return "%04d-%02d-%02dT%02d:%02d:%02dZ" % (t[0], t[1], t[2], t[3], t[4], t[5])
+    
+    def ack_message(self, message_id, success, error=None, handled_at=None):
+        """向服务器确认消息处理结果，handled_at 为处理消息的时间（utc_now() 的返回值）"""
+        try:
+            data = {
+                'device_id': self.device_id,
+                'message_id': message_id,
+                'success': success,
+                'error': error or ''
+            }
+            if handled_at:
+                data['handled_at'] = handled_at
+            
+            response_data, err = self._make_request('POST', API_ACK_ENDPOINT, data=data)
+            
+            if err:
+                if DEBUG:
+                    print("Ack request failed: " + str(err))
+                return False, err
+            
+            if isinstance(response_data, dict) and response_data.get('clock_skew'):
+                if DEBUG:
+                    print("Server reports clock skew, time will be resynced")
+                self.clock_skewed = True
+            
+            if DEBUG:
+                print("Message acknowledged: " + message_id)
+            return True, None
+            
+        except Exception as e:
+            error_msg = "Ack error: " + str(e)
+            if DEBUG:
+                print(error_msg)
+            return False, error_msg
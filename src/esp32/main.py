@@ -7,13 +7,22 @@ from machine import reset
 from wifi_manager import WiFiManager
 from wol_sender import WOLSender
 from http_client import HTTPClient
-from config import POLL_INTERVAL, DEBUG
+from mdns_discovery import discover_server
+import provisioning
+import ota
+import crash_report
+import neighbors
+from config import (
+    POLL_INTERVAL, DEBUG, TIME_SYNC, TIME_SYNC_INTERVAL, PROVISION_CODE,
+    FIRMWARE_UPDATE, FIRMWARE_CHECK_INTERVAL, CRASH_REPORT
+)
 
 class ESP32WOLSystem:
     def __init__(self):
         self.wifi_manager = WiFiManager()
         self.wol_sender = WOLSender()
         self.http_client = HTTPClient()
+        self.poll_interval = POLL_INTERVAL
         self.is_running = True
         
         if DEBUG:
@@ -31,6 +40,33 @@ class ESP32WOLSystem:
                     print("Failed to connect to WiFi")
                 return False
             
+            # 已获取过下发的配置时直接使用
+            provision = provisioning.load()
+            if provision:
+                self.apply_provision(provision)
+            
+            # 未配置服务器地址时通过mDNS查找
+            if not self.http_client.server_host:
+                server = discover_server()
+                if not server:
+                    if DEBUG:
+                        print("Server not found via mDNS, set SERVER_HOST in config.py")
+                    return False
+                self.http_client.set_server(server['protocol'], server['host'], server['port'], server['path'])
+            
+            # 首次启动时用注册码获取配置
+            if not provision and PROVISION_CODE:
+                provision, error = provisioning.fetch(self.http_client, PROVISION_CODE)
+                if error:
+                    if DEBUG:
+                        print("Provisioning failed: " + str(error))
+                    return False
+                self.apply_provision(provision)
+            
+            # 从服务器校时（受限网络中可能无法访问NTP）
+            if TIME_SYNC:
+                self.http_client.sync_time()
+            
             # 注册设备
             if DEBUG:
                 print("Registering device...")
@@ -45,6 +81,13 @@ class ESP32WOLSystem:
                 if DEBUG:
                     print("Device registration failed: " + str(error))
             
+            # 上报重启原因，服务器据此发现反复重启的中继
+            if CRASH_REPORT:
+                crash_report.report(self.http_client)
+            
+            # 能连上服务器说明新固件工作正常，取消回滚
+            ota.mark_valid()
+            
             if DEBUG:
                 print("System initialization completed")
             
@@ -55,6 +98,22 @@ class ESP32WOLSystem:
                 print("System initialization error: " + str(e))
             return False
     
+    def update_firmware(self):
+        """检查并安装固件更新，安装成功后重启"""
+        try:
+            manifest = ota.check(self.http_client)
+            if manifest and ota.install(self.http_client, manifest):
+                reset()
+        except Exception as e:
+            if DEBUG:
+                print("Firmware update error: " + str(e))
+    
+    def apply_provision(self, provision):
+        """应用服务器下发的配置"""
+        poll_interval = provisioning.apply(provision, self.http_client, self.wol_sender)
+        if poll_interval:
+            self.poll_interval = poll_interval
+    
     def process_wol_message(self, message):
         """处理WOL消息"""
         try:
@@ -68,8 +127,12 @@ class ESP32WOLSystem:
             if DEBUG:
                 print("Processing WOL message for MAC: " + target_mac)
             
-            # 发送WOL包
-            success = self.wol_sender.send_wol_packet(target_mac)
+            # 发送WOL包；消息带有发送地址时按顺序发送到每个地址
+            destinations = message.get('destinations')
+            if destinations:
+                success = self.wol_sender.send_to_destinations(target_mac, destinations)
+            else:
+                success = self.wol_sender.send_wol_packet(target_mac)
             
             if success:
                 if DEBUG:
@@ -85,6 +148,39 @@ class ESP32WOLSystem:
                 print("WOL message processing error: " + str(e))
             return False
     
+    def handle_message(self, message):
+        """处理一条消息并向服务器确认结果"""
+        # 重启命令：先确认再重启，重启后无法再确认
+        if message.get('type') == 'device_reboot':
+            if DEBUG:
+                print("Reboot requested by server")
+            self.http_client.ack_message(message['id'], True, handled_at=self.http_client.utc_now())
+            self.shutdown()
+            reset()
+        
+        # WiFi扫描命令：上传扫描结果后确认
+        if message.get('type') == 'wifi_scan':
+            success, error = self.http_client.upload_wifi_scan(self.wifi_manager.scan_report(), message['id'])
+            self.http_client.ack_message(message['id'], success, error, self.http_client.utc_now())
+            return success
+        
+        # 邻居表命令：扫描所在网段，上传发现的主机后确认
+        if message.get('type') == 'neighbor_scan':
+            try:
+                success, error = self.http_client.upload_neighbors(neighbors.scan_report(self.wifi_manager.wlan), message['id'])
+            except Exception as e:
+                success, error = False, "Neighbor scan error: " + str(e)
+            self.http_client.ack_message(message['id'], success, error, self.http_client.utc_now())
+            gc.collect()
+            return success
+        
+        success = self.process_wol_message(message)
+        handled_at = self.http_client.utc_now()
+        if message.get('id'):
+            error = None if success else "Failed to send WOL packet"
+            self.http_client.ack_message(message['id'], success, error, handled_at)
+        return success
+    
     def poll_server(self):
         """轮询服务器获取消息"""
         try:
@@ -95,18 +191,19 @@ class ESP32WOLSystem:
                 return False
             
             # 轮询消息
-            message, error = self.http_client.poll_for_messages()
+            messages, error = self.http_client.poll_for_messages()
             
             if error:
                 if DEBUG:
                     print("Poll error: " + str(error))
                 return False
             
-            # 处理消息
-            if message:
-                return self.process_wol_message(message)
-            
-            return True
+            # 逐条处理并确认；服务器收到确认前会保留消息，超时未确认时重新下发
+            success = True
+            for message in messages:
+                if not self.handle_message(message):
+                    success = False
+            return success
             
         except Exception as e:
             if DEBUG:
@@ -127,14 +224,32 @@ class ESP32WOLSystem:
             
             # 主循环
             last_poll_time = 0  # 初始化轮询时间
+            last_sync_time = time.time()
+            last_firmware_check = 0
             while self.is_running:
                 try:
                     current_time = time.time()
                     
+                    # 定期重新校时，服务器报告时钟偏差过大时立即校时；时钟可能跳变，校时后重新计时
+                    if TIME_SYNC and (self.http_client.clock_skewed or current_time - last_sync_time >= TIME_SYNC_INTERVAL):
+                        self.http_client.sync_time()
+                        current_time = last_sync_time = time.time()
+                        last_poll_time = 0
+                        if last_firmware_check:
+                            last_firmware_check = current_time
+                    
+                    # 定期检查固件更新
+                    if FIRMWARE_UPDATE and (not last_firmware_check or current_time - last_firmware_check >= FIRMWARE_CHECK_INTERVAL):
+                        self.update_firmware()
+                        last_firmware_check = time.time()
+                    
                     # 检查是否到了轮询时间
-                    if current_time - last_poll_time >= POLL_INTERVAL:
+                    if current_time - last_poll_time >= self.poll_interval:
                         self.poll_server()
                         last_poll_time = current_time
+                        # 服务器上还有因 POLL_MAX_MESSAGES 留下的消息时，下一轮立即接着取
+                        if self.http_client.poll_remaining:
+                            last_poll_time = 0
                     
                     # 内存清理
                     gc.collect()
@@ -155,6 +270,8 @@ class ESP32WOLSystem:
         except Exception as e:
             if DEBUG:
                 print("System error: " + str(e))
+            if CRASH_REPORT:
+                crash_report.save(e)
         finally:
             self.shutdown()
     
@@ -183,6 +300,8 @@ def main():
     except Exception as e:
         if DEBUG:
             print("Main function error: " + str(e))
+        if CRASH_REPORT:
+            crash_report.save(e)
         time.sleep(10)
         reset()
 
@@ -0,0 +1,124 @@
+# mDNS服务发现模块
+# Discover the WOL server via mDNS (_esp32wol._tcp.local)
+
+import socket
+import struct
+import time
+from config import DEBUG
+
+MDNS_ADDR = ("224.0.0.251", 5353)
+SERVICE = "_esp32wol._tcp.local"
+
+TYPE_A = 1
+TYPE_PTR = 12
+TYPE_TXT = 16
+TYPE_SRV = 33
+
+
+def _encode_name(name):
+    data = b""
+    for label in name.split("."):
+        data += bytes([len(label)]) + label.encode()
+    return data + b"\x00"
+
+
+def _read_name(msg, off):
+    """读取域名（支持压缩指针），返回 (名称, 名称之后的偏移)"""
+    labels = []
+    end = -1
+    jumps = 0
+    while True:
+        n = msg[off]
+        if n == 0:
+            if end < 0:
+                end = off + 1
+            return ".".join(labels), end
+        if n & 0xC0 == 0xC0:
+            if end < 0:
+                end = off + 2
+            off = ((n & 0x3F) << 8) | msg[off + 1]
+            jumps += 1
+            if jumps > 10:
+                raise ValueError("bad compression pointer")
+        else:
+            labels.append(msg[off + 1:off + 1 + n].decode())
+            off += 1 + n
+
+
+def _parse_response(msg, query_id):
+    """解析应答，返回服务器信息字典，未找到时返回None"""
+    msg_id, flags, qdcount, ancount, nscount, arcount = struct.unpack(">HHHHHH", msg[:12])
+    if msg_id != query_id or not flags & 0x8000:
+        return None
+
+    off = 12
+    for _ in range(qdcount):
+        _, off = _read_name(msg, off)
+        off += 4
+
+    srv = None
+    txt = {}
+    addrs = {}
+    for _ in range(ancount + nscount + arcount):
+        name, off = _read_name(msg, off)
+        rtype, _, _, rdlen = struct.unpack(">HHIH", msg[off:off + 10])
+        off += 10
+        rdata = msg[off:off + rdlen]
+        if rtype == TYPE_SRV:
+            port = struct.unpack(">H", rdata[4:6])[0]
+            target, _ = _read_name(msg, off + 6)
+            srv = (target, port)
+        elif rtype == TYPE_TXT:
+            i = 0
+            while i < len(rdata):
+                n = rdata[i]
+                entry = rdata[i + 1:i + 1 + n].decode()
+                if "=" in entry:
+                    k, v = entry.split("=", 1)
+                    txt[k] = v
+                i += 1 + n
+        elif rtype == TYPE_A and rdlen == 4:
+            addrs[name.lower()] = ".".join([str(b) for b in rdata])
+        off += rdlen
+
+    if not srv or srv[0].lower() not in addrs:
+        return None
+    return {
+        "protocol": txt.get("proto", "http"),
+        "host": addrs[srv[0].lower()],
+        "port": srv[1],
+        "path": txt.get("path", ""),
+    }
+
+
+def discover_server(timeout=3, attempts=3):
+    """在局域网中查找服务器，返回 {'protocol', 'host', 'port', 'path'}，未找到时返回None"""
+    sock = socket.socket(socket.AF_INET, socket.SOCK_DGRAM)
+    try:
+        sock.settimeout(timeout)
+        for attempt in range(attempts):
+            query_id = (time.ticks_ms() + attempt) & 0xFFFF
+            # 从普通端口发出查询，服务器会直接单播回复（RFC 6762 6.7）
+            query = struct.pack(">HHHHHH", query_id, 0, 1, 0, 0, 0) + _encode_name(SERVICE) + struct.pack(">HH", TYPE_PTR, 1)
+            if DEBUG:
+                print("Looking up " + SERVICE + " via mDNS (attempt " + str(attempt + 1) + "/" + str(attempts) + ")")
+            sock.sendto(query, MDNS_ADDR)
+            deadline = time.time() + timeout
+            while time.time() < deadline:
+                try:
+                    msg, _ = sock.recvfrom(1500)
+                except OSError:
+                    break
+                try:
+                    server = _parse_response(msg, query_id)
+                except Exception as e:
+                    if DEBUG:
+                        print("Invalid mDNS response: " + str(e))
+                    continue
+                if server:
+                    if DEBUG:
+                        print("Found server: " + server["protocol"] + "://" + server["host"] + ":" + str(server["port"]) + server["path"])
+                    return server
+    finally:
+        sock.close()
+    return None
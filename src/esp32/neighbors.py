@@ -0,0 +1,110 @@
+# 邻居发现模块
+# Discover hosts on the relay's subnet and report their MAC/IP pairs
+
+import socket
+import time
+from config import DEBUG
+
+# MicroPython 不提供读取 lwIP ARP 表的接口，改为向网段内每个地址发送
+# NetBIOS 节点状态查询（UDP 137）：Windows 和运行 Samba 的主机会在应答中附带网卡MAC地址和计算机名。
+# 不响应 NetBIOS 的主机（多数 Linux、macOS、打印机等）不会出现在结果中
+NBSTAT_PORT = 137
+SCAN_TIMEOUT = 3  # 发送完查询后等待应答的秒数
+MAX_HOSTS = 254  # 大于 /24 的网段只扫描中继所在的 /24
+
+
+def _nbstat_query(txid):
+    # 名称为 "*"，按 NetBIOS 规则编码为32字节；查询类型 NBSTAT(0x21)，类别 IN
+    name = b'CK' + b'A' * 30
+    return (bytes([txid >> 8, txid & 0xFF]) + b'\x00\x00\x00\x01\x00\x00\x00\x00\x00\x00'
+            + b'\x20' + name + b'\x00' + b'\x00\x21\x00\x01')
+
+
+def _parse_nbstat(data):
+    """解析节点状态应答，返回 (MAC地址, 计算机名)，格式不对时返回 (None, None)"""
+    # 头部12字节 + 名称34字节 + 类型、类别、TTL、长度共10字节
+    off = 56
+    if len(data) < off + 1:
+        return None, None
+    count = data[off]
+    off += 1
+    if len(data) < off + count * 18 + 6:
+        return None, None
+    hostname = None
+    for i in range(count):
+        entry = data[off + i * 18:off + i * 18 + 18]
+        flags = (entry[16] << 8) | entry[17]
+        # 后缀 0x00 的唯一名称（非组名）为计算机名
+        if entry[15] == 0 and not flags & 0x8000 and hostname is None:
+            hostname = entry[:15].decode().strip()
+    mac = data[off + count * 18:off + count * 18 + 6]
+    if mac == b'\x00' * 6:
+        return None, hostname
+    return ':'.join(['%02x' % b for b in mac]), hostname
+
+
+def _ip_to_int(ip):
+    parts = [int(p) for p in ip.split('.')]
+    return (parts[0] << 24) | (parts[1] << 16) | (parts[2] << 8) | parts[3]
+
+
+def _int_to_ip(n):
+    return '%d.%d.%d.%d' % ((n >> 24) & 0xFF, (n >> 16) & 0xFF, (n >> 8) & 0xFF, n & 0xFF)
+
+
+def _scan_range(ip, netmask):
+    """返回要扫描的地址范围 (起始, 结束)，不含网络地址、广播地址"""
+    addr = _ip_to_int(ip)
+    mask = _ip_to_int(netmask)
+    if (~mask & 0xFFFFFFFF) + 1 > MAX_HOSTS + 2:
+        mask = 0xFFFFFF00
+    network = addr & mask
+    broadcast = network | (~mask & 0xFFFFFFFF)
+    return network + 1, broadcast - 1
+
+
+def scan_report(wlan):
+    """扫描所在网段并整理成上报给服务器的格式"""
+    ip, netmask = wlan.ifconfig()[0], wlan.ifconfig()[1]
+    own = _ip_to_int(ip)
+    first, last = _scan_range(ip, netmask)
+    if DEBUG:
+        print("Scanning neighbors " + _int_to_ip(first) + " - " + _int_to_ip(last))
+
+    sock = socket.socket(socket.AF_INET, socket.SOCK_DGRAM)
+    sock.setblocking(False)
+    found = {}
+
+    def receive():
+        while True:
+            try:
+                data, addr = sock.recvfrom(512)
+            except OSError:
+                return
+            mac, hostname = _parse_nbstat(data)
+            if mac:
+                entry = {'mac_address': mac, 'ip': addr[0]}
+                if hostname:
+                    entry['name'] = hostname
+                found[mac] = entry
+
+    try:
+        for n in range(first, last + 1):
+            if n == own:
+                continue
+            try:
+                sock.sendto(_nbstat_query(n & 0xFFFF), (_int_to_ip(n), NBSTAT_PORT))
+            except OSError:
+                # 发送缓冲区已满（ENOMEM），先处理应答再继续
+                time.sleep_ms(20)
+            receive()
+        deadline = time.time() + SCAN_TIMEOUT
+        while time.time() < deadline:
+            receive()
+            time.sleep_ms(50)
+    finally:
+        sock.close()
+
+    if DEBUG:
+        print("Found " + str(len(found)) + " neighbors")
+    return {'neighbors': list(found.values())}
@@ -0,0 +1,86 @@
+# 固件更新模块
+# Checks the server's firmware manifest and writes updates to the next OTA partition
+
+import hashlib
+import binascii
+import urequests
+from config import FIRMWARE_VERSION, FIRMWARE_CHANNEL, API_FIRMWARE_ENDPOINT, REQUEST_TIMEOUT, DEBUG
+
+BLOCK_SIZE = 4096
+
+def mark_valid():
+    """新固件启动成功后调用，取消自动回滚"""
+    try:
+        from esp32 import Partition
+        Partition.mark_app_valid_cancel_rollback()
+    except Exception:
+        # 固件未启用回滚或不支持OTA分区
+        pass
+
+def check(http_client):
+    """查询清单，有可用更新时返回清单，否则返回None"""
+    params = {
+        'device_id': http_client.device_id,
+        'version': FIRMWARE_VERSION,
+        'channel': FIRMWARE_CHANNEL
+    }
+    manifest, error = http_client._make_request('GET', API_FIRMWARE_ENDPOINT, params=params)
+    if error:
+        if DEBUG:
+            print("Firmware check failed: " + str(error))
+        return None
+    if not isinstance(manifest, dict) or not manifest.get('update_available'):
+        return None
+    if DEBUG:
+        print("Firmware update available: " + str(manifest.get('version')) + " (" + str(manifest.get('size')) + " bytes)")
+    return manifest
+
+def install(http_client, manifest):
+    """下载固件写入下一个OTA分区，校验SHA-256后设为启动分区。成功时返回True，调用方负责重启"""
+    from esp32 import Partition
+    target = Partition(Partition.RUNNING).get_next_update()
+    size = manifest['size']
+    if size > target.ioctl(4, 0) * target.ioctl(5, 0):
+        if DEBUG:
+            print("Firmware does not fit in the OTA partition")
+        return False
+
+    response = urequests.get(manifest['url'], headers=http_client.headers, timeout=REQUEST_TIMEOUT)
+    try:
+        if response.status_code != 200:
+            if DEBUG:
+                print("Firmware download failed: HTTP " + str(response.status_code))
+            return False
+        digest = hashlib.sha256()
+        written = 0
+        block = 0
+        buf = bytearray(BLOCK_SIZE)
+        while written < size:
+            n = response.raw.readinto(buf)
+            if not n:
+                break
+            # 不足一块时读满再写，最后一块用0xFF补齐
+            while n < BLOCK_SIZE and written + n < size:
+                more = response.raw.readinto(memoryview(buf)[n:])
+                if not more:
+                    break
+                n += more
+            digest.update(memoryview(buf)[:n])
+            if n < BLOCK_SIZE:
+                for i in range(n, BLOCK_SIZE):
+                    buf[i] = 0xFF
+            target.writeblocks(block, buf)
+            block += 1
+            written += n
+    finally:
+        response.close()
+
+    checksum = binascii.hexlify(digest.digest()).decode()
+    if written != size or checksum != manifest['sha256']:
+        if DEBUG:
+            print("Firmware verification failed, keeping current firmware")
+        return False
+    target.set_boot()
+    if DEBUG:
+        print("Firmware " + str(manifest.get('version')) + " installed, rebooting")
+    return True
@@ -0,0 +1,55 @@
+# 供电状态模块
+# Reads the battery voltage through an ADC divider and whether external (USB) power is present
+
+from machine import ADC, Pin
+from config import (
+    BATTERY_ADC_PIN, BATTERY_DIVIDER, BATTERY_EMPTY_VOLTAGE, BATTERY_FULL_VOLTAGE,
+    USB_SENSE_PIN, DEBUG
+)
+
+SAMPLES = 8
+
+_adc = None
+_usb_sense = None
+
+def _init():
+    global _adc, _usb_sense
+    if _adc is None and BATTERY_ADC_PIN is not None:
+        _adc = ADC(Pin(BATTERY_ADC_PIN))
+        _adc.atten(ADC.ATTN_11DB)
+    if _usb_sense is None and USB_SENSE_PIN is not None:
+        _usb_sense = Pin(USB_SENSE_PIN, Pin.IN)
+
+def read():
+    """返回 {'source', 'voltage', 'percent'}，读取失败时返回None"""
+    try:
+        _init()
+        status = {'source': 'battery'}
+        if _usb_sense is not None and _usb_sense.value():
+            status['source'] = 'usb'
+        if _adc is not None:
+            # 多次采样取平均，减小ADC噪声
+            total = 0
+            for _ in range(SAMPLES):
+                total += _adc.read_uv()
+            voltage = total / SAMPLES / 1000000 * BATTERY_DIVIDER
+            status['voltage'] = round(voltage, 2)
+            percent = (voltage - BATTERY_EMPTY_VOLTAGE) / (BATTERY_FULL_VOLTAGE - BATTERY_EMPTY_VOLTAGE) * 100
+            # 服务器把0视为未知，电量耗尽时仍上报1%
+            status['percent'] = int(min(100, max(1, percent)))
+        return status
+    except Exception as e:
+        if DEBUG:
+            print("Power status error: " + str(e))
+        return None
+
+def poll_params():
+    """供电状态对应的轮询参数"""
+    status = read()
+    if not status:
+        return {}
+    params = {'power_source': status['source']}
+    if 'voltage' in status:
+        params['battery_voltage'] = status['voltage']
+        params['battery_percent'] = status['percent']
+    return params
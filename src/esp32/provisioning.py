@@ -0,0 +1,90 @@
+# 设备配置下发模块
+# Fetches and stores the provisioning document issued by the server for an enrollment code
+
+import ujson
+import hashlib
+import binascii
+from config import PROVISION_FILE, API_PROVISION_ENDPOINT, DEBUG
+
+def _hmac_sha256(key, msg):
+    """HMAC-SHA256（MicroPython 没有 hmac 模块）"""
+    block_size = 64
+    if len(key) > block_size:
+        key = hashlib.sha256(key).digest()
+    key = key + b'\x00' * (block_size - len(key))
+    inner = hashlib.sha256(bytes([b ^ 0x36 for b in key]) + msg).digest()
+    return hashlib.sha256(bytes([b ^ 0x5c for b in key]) + inner).digest()
+
+def _normalize_code(code):
+    """与服务器一致：忽略大小写、空格和连字符"""
+    return code.upper().replace('-', '').replace(' ', '')
+
+def load():
+    """读取已保存的配置，没有时返回None"""
+    try:
+        with open(PROVISION_FILE) as f:
+            return ujson.load(f)
+    except OSError:
+        return None
+    except Exception as e:
+        if DEBUG:
+            print("Invalid provisioning file: " + str(e))
+        return None
+
+def fetch(http_client, code):
+    """用注册码从服务器获取配置，校验签名后保存。注册码只能使用一次"""
+    params = {
+        'code': _normalize_code(code),
+        'device_id': http_client.device_id
+    }
+    response_data, error = http_client._make_request('GET', API_PROVISION_ENDPOINT, params=params)
+    if error:
+        return None, error
+    if not isinstance(response_data, dict) or 'payload' not in response_data:
+        return None, "Invalid response format"
+
+    payload = response_data['payload'].encode()
+    expected = binascii.hexlify(_hmac_sha256(_normalize_code(code).encode(), payload)).decode()
+    if expected != response_data.get('signature', ''):
+        return None, "Provisioning signature mismatch"
+
+    doc = ujson.loads(payload)
+    with open(PROVISION_FILE, 'w') as f:
+        ujson.dump(doc, f)
+    if DEBUG:
+        print("Provisioned by enrollment " + doc.get('enrollment_id', ''))
+    return doc, None
+
+def _parse_url(url):
+    """拆分 http(s)://host:port/path"""
+    protocol, rest = url.split('://', 1)
+    if '/' in rest:
+        hostport, path = rest.split('/', 1)
+        path = '/' + path.rstrip('/')
+    else:
+        hostport, path = rest, ''
+    if path == '/':
+        path = ''
+    if ':' in hostport:
+        host, port = hostport.rsplit(':', 1)
+        port = int(port)
+    else:
+        host = hostport
+        port = 443 if protocol == 'https' else 80
+    return protocol, host, port, path
+
+def apply(doc, http_client, wol_sender):
+    """应用配置，返回轮询间隔（未下发时为None）"""
+    if doc.get('server_url'):
+        protocol, host, port, path = _parse_url(doc['server_url'])
+        http_client.set_server(protocol, host, port, path)
+    if doc.get('api_key'):
+        http_client.set_api_key(doc['api_key'])
+    if doc.get('device_name'):
+        http_client.device_name = doc['device_name']
+    if doc.get('broadcast_ip'):
+        wol_sender.broadcast_ip = doc['broadcast_ip']
+    if doc.get('wol_port'):
+        wol_sender.wol_port = doc['wol_port']
+    # cert_fingerprints 仅保存，urequests 无法获取服务器证书进行校验
+    return doc.get('poll_interval')
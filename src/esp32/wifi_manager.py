@@ -5,6 +5,8 @@ import network
 import time
 from config import WIFI_SSID, WIFI_PASSWORD, WIFI_CONNECT_TIMEOUT, DEBUG, WIFI_RETRY_COUNT
 
+# wlan.scan() 返回的加密方式
+SECURITY_NAMES = ['open', 'wep', 'wpa-psk', 'wpa2-psk', 'wpa/wpa2-psk', 'wpa2-enterprise', 'wpa3-psk', 'wpa2/wpa3-psk']
 
 class WiFiManager:
     def __init__(self):
@@ -140,6 +142,27 @@ class WiFiManager:
                 print("Network scan error: " + str(e))
             return []
     
+    def scan_report(self):
+        """扫描WiFi并整理成上报给服务器的格式"""
+        networks = []
+        for net in self.scan_networks():
+            security = net[4]
+            networks.append({
+                'ssid': net[0].decode('utf-8'),
+                'bssid': ':'.join(['%02x' % b for b in net[1]]),
+                'channel': net[2],
+                'rssi': net[3],
+                'security': SECURITY_NAMES[security] if security < len(SECURITY_NAMES) else str(security),
+                'hidden': bool(net[5])
+            })
+        report = {'networks': networks}
+        if self.wlan.isconnected():
+            report['ssid'] = self.wlan.config('essid')
+            rssi = self.get_signal_strength()
+            if rssi is not None:
+                report['rssi'] = rssi
+        return report
+    
     def auto_reconnect(self):
         """自动重连WiFi"""
         if not self.check_connection():
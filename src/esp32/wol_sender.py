@@ -122,6 +122,25 @@ class WOLSender:
                 print("WOL packet sending error: " + str(e))
             return False
     
+    def send_to_destinations(self, mac_address, destinations):
+        """按顺序向每个地址发送WOL包，地址格式为 IP 或 IP:端口
+        魔术包没有回应，无法判断哪个地址有效，因此每个地址都发送；某个地址失败时继续下一个
+        """
+        sent = 0
+        for destination in destinations:
+            host, _, port = destination.partition(':')
+            try:
+                port = int(port) if port else None
+            except ValueError:
+                if DEBUG:
+                    print("Invalid destination: " + destination)
+                continue
+            if self.send_wol_packet(mac_address, host, port):
+                sent += 1
+        if DEBUG:
+            print("WOL sent to " + str(sent) + "/" + str(len(destinations)) + " destinations")
+        return sent > 0
+    
     def send_wol_to_subnet(self, mac_address, gateway_ip):
         """向子网广播发送WOL包
         计算子网广播地址并发送
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// 是否要求新设备经管理员批准后才能接收唤醒指令
+var requireApproval bool
+
+// 写入JSON响应
+// 写出结构化响应，按 Accept 选择 JSON、CBOR 或 MessagePack（见 encoding.go）；
+// 用到弃用接口或字段时响应体附带 warnings（见 deprecation.go）
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	if warnings := responseWarnings(w); len(warnings) > 0 {
+		v = withWarnings(v, warnings)
+	}
+	contentType, body, err := encodeResponse(w, v)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	addVary(w.Header(), "Accept")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// 解析子路径，例如 /api/admin/devices/<id>/approve 返回 ("<id>", "approve")
+func pathParams(r *http.Request, prefix string) (string, string) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, prefix), "/")
+	id, action, _ := strings.Cut(rest, "/")
+	return id, action
+}
+
+// 管理接口中的设备信息
+type AdminDevice struct {
+	Device
+	Pending int `json:"pending"` // 队列中待下发的消息数
+}
+
+// 设备列表（管理端）
+func adminDevicesHandler(w http.ResponseWriter, r *http.Request) {
+	p := requestPrincipal(r)
+	storage.mu.RLock()
+	devices := make([]AdminDevice, 0, len(storage.devices))
+	for id, device := range storage.devices {
+		if p.owns(device.Owner) {
+			devices = append(devices, AdminDevice{Device: *device, Pending: queues.len(id)})
+		}
+	}
+	storage.mu.RUnlock()
+	sort.Slice(devices, func(i, j int) bool { return devices[i].ID < devices[j].ID })
+
+	writeJSONCached(w, r, map[string]interface{}{
+		"success": true,
+		"devices": devices,
+		"total":   len(devices),
+	})
+}
+
+// 单个设备操作：PUT/DELETE /api/admin/devices/<id>，POST /api/admin/devices/<id>/approve，
+// PUT /api/admin/devices/<id>/owner。用户可以删除自己能看到的设备，或把它转给自己所属的组织；
+// 批准设备需要管理员
+func adminDeviceHandler(w http.ResponseWriter, r *http.Request) {
+	deviceID, action := pathParams(r, "/api/admin/devices/")
+	if deviceID == "" {
+		http.Error(w, "device id is required", http.StatusBadRequest)
+		return
+	}
+	p := requestPrincipal(r)
+	storage.mu.RLock()
+	_, exists := storage.devices[deviceID]
+	visible := exists && p.owns(deviceOwner(deviceID))
+	storage.mu.RUnlock()
+	if exists && !visible {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+	if (action == "approve" || action == "binding") && !p.admin() {
+		http.Error(w, "Forbidden: this action requires the server API key", http.StatusForbidden)
+		return
+	}
+
+	switch {
+	case action == "" && r.Method == http.MethodDelete:
+		deleteDevice(w, r, deviceID)
+	case action == "" && r.Method == http.MethodPut:
+		updateDevice(w, r, deviceID)
+	case action == "approve" && r.Method == http.MethodPost:
+		approveDevice(w, r, deviceID)
+	case action == "owner" && r.Method == http.MethodPut:
+		setDeviceOwner(w, r, deviceID)
+	case action == "reboot" && r.Method == http.MethodPost:
+		queueDeviceCommand(w, r, deviceID, messageTypeReboot)
+	case action == "wifi-scan" && r.Method == http.MethodPost:
+		queueDeviceCommand(w, r, deviceID, messageTypeWiFiScan)
+	case action == "neighbor-scan" && r.Method == http.MethodPost:
+		queueDeviceCommand(w, r, deviceID, messageTypeNeighborScan)
+	case action == "purge" && r.Method == http.MethodPost:
+		purgeDevice(w, r, deviceID)
+	case action == "release" && r.Method == http.MethodPost:
+		releaseLongPoll(w, r, deviceID)
+	case action == "binding" && r.Method == http.MethodDelete:
+		resetDeviceBinding(w, r, deviceID)
+	case action == "" || action == "approve" || action == "owner" || action == "reboot" || action == "wifi-scan" || action == "neighbor-scan" || action == "purge" || action == "release" || action == "binding":
+		methodNotAllowed(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func approveDevice(w http.ResponseWriter, r *http.Request, deviceID string) {
+	storage.mu.Lock()
+	device, exists := storage.devices[deviceID]
+	if !exists {
+		storage.mu.Unlock()
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+	changed := !device.Approved
+	device.Approved = true
+	replicateDevice(device)
+	storage.mu.Unlock()
+
+	if changed {
+		markDirty()
+		requestLogger(r).Info("device approved", "device_id", deviceID)
+		events.publish(Event{Type: eventDeviceApproved, DeviceID: deviceID})
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"message": "Device approved",
+	})
+}
+
+// 管理命令（重启、WiFi扫描、邻居表）经设备队列下发，可通过 /api/wol/messages/<id> 跟踪
+func queueDeviceCommand(w http.ResponseWriter, r *http.Request, deviceID, command string) {
+	storage.mu.RLock()
+	_, exists := storage.devices[deviceID]
+	storage.mu.RUnlock()
+	if !exists {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+	p := requestPrincipal(r)
+	source := "api"
+	if !p.admin() {
+		source = "user:" + p.user
+	}
+	message, err := queueWake(requestLogger(r), wakeRequest{Type: command, DeviceID: deviceID, Source: source})
+	if err != nil {
+		if writeBackpressure(w, err) {
+			return
+		}
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success":    true,
+		"message_id": message.ID,
+		"message":    "Command queued",
+	})
+}
+
+// 清空设备队列中尚未下发的消息，消息标记为已取消，逐条记录日志。
+// 用于清理失控的自动化一次排入的大量唤醒；已下发、等待确认的消息不受影响。调用方持有 storage.mu
+func purgeQueue(logger *slog.Logger, deviceID, by string) []string {
+	purged := queues.purge(deviceID)
+	ids := make([]string, 0, len(purged))
+	for _, msg := range purged {
+		if local, ok := storage.messages[msg.ID]; ok {
+			msg = local
+		}
+		msg.Status = messageCancelled
+		msg.Error = "purged by " + by
+		replicateMessage(msg)
+		ids = append(ids, msg.ID)
+		logger.Info("wol message purged", "device_id", deviceID, "message_id", msg.ID, "target_mac", msg.TargetMAC,
+			"target", msg.Target, "source", msg.Source, "created_at", msg.CreatedAt, "by", by)
+	}
+	if len(purged) == 0 {
+		return ids
+	}
+	countMessages(messageCancelled, len(purged))
+	logger.Warn("device queue purged", "device_id", deviceID, "purged", len(purged), "by", by)
+	events.publish(Event{Type: eventQueuePurged, DeviceID: deviceID, Data: map[string]any{"purged": len(purged), "by": by}})
+	return ids
+}
+
+// 操作者的标识，用于日志和事件
+func principalName(p principal) string {
+	if p.admin() && p.token != "" {
+		return "key:" + p.token
+	}
+	if p.admin() {
+		return "api"
+	}
+	return "user:" + p.user
+}
+
+// POST /api/admin/devices/{id}/purge
+func purgeDevice(w http.ResponseWriter, r *http.Request, deviceID string) {
+	storage.mu.Lock()
+	if _, exists := storage.devices[deviceID]; !exists {
+		storage.mu.Unlock()
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+	ids := purgeQueue(requestLogger(r), deviceID, principalName(requestPrincipal(r)))
+	storage.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success":     true,
+		"purged":      len(ids),
+		"message_ids": ids,
+		"message":     fmt.Sprintf("%d queued messages purged", len(ids)),
+	})
+}
+
+// POST /api/admin/purge 清空所有设备的队列（只允许服务器API密钥）
+func purgeAllHandler(w http.ResponseWriter, r *http.Request) {
+	logger := requestLogger(r)
+	by := principalName(requestPrincipal(r))
+	purged := map[string]int{}
+	total := 0
+	storage.mu.Lock()
+	for deviceID := range storage.devices {
+		if ids := purgeQueue(logger, deviceID, by); len(ids) > 0 {
+			purged[deviceID] = len(ids)
+			total += len(ids)
+		}
+	}
+	storage.mu.Unlock()
+
+	logger.Warn("all queues purged", "purged", total, "devices", len(purged), "by", by)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"purged":  total,
+		"devices": purged,
+		"message": fmt.Sprintf("%d queued messages purged from %d devices", total, len(purged)),
+	})
+}
+
+// 修改设备的标签和固件通道 {"tags": [...], "firmware_channel": "beta"}，省略的字段保持不变
+func updateDevice(w http.ResponseWriter, r *http.Request, deviceID string) {
+	var req struct {
+		Tags            *[]string `json:"tags"`
+		FirmwareChannel *string   `json:"firmware_channel"`
+	}
+	if !readJSON(w, r, &req) {
+		return
+	}
+	var tags []string
+	if req.Tags != nil {
+		for _, tag := range *req.Tags {
+			if !namePattern.MatchString(tag) {
+				http.Error(w, fmt.Sprintf("invalid tag %q", tag), http.StatusBadRequest)
+				return
+			}
+			if !slices.Contains(tags, tag) {
+				tags = append(tags, tag)
+			}
+		}
+		sort.Strings(tags)
+	}
+	if req.FirmwareChannel != nil && *req.FirmwareChannel != "" && !namePattern.MatchString(*req.FirmwareChannel) {
+		http.Error(w, "firmware_channel must be 1-64 letters, digits, '.', '_' or '-'", http.StatusBadRequest)
+		return
+	}
+
+	storage.mu.Lock()
+	device, exists := storage.devices[deviceID]
+	if !exists {
+		storage.mu.Unlock()
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+	if req.Tags != nil {
+		device.Tags = tags
+	}
+	if req.FirmwareChannel != nil {
+		device.FirmwareChannel = *req.FirmwareChannel
+	}
+	replicateDevice(device)
+	updated := AdminDevice{Device: *device, Pending: queues.len(deviceID)}
+	storage.mu.Unlock()
+
+	markDirty()
+	requestLogger(r).Info("device updated", "device_id", deviceID, "tags", updated.Tags, "firmware_channel", updated.FirmwareChannel)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"message": "Device updated",
+		"device":  updated,
+	})
+}
+
+// 转移设备所有者，owner 为空表示收回给管理员
+func setDeviceOwner(w http.ResponseWriter, r *http.Request, deviceID string) {
+	var req struct {
+		Owner string `json:"owner"`
+	}
+	if !readJSON(w, r, &req) {
+		return
+	}
+	storage.mu.Lock()
+	device, exists := storage.devices[deviceID]
+	if !exists {
+		storage.mu.Unlock()
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+	if err := checkOwner(req.Owner); err != nil {
+		storage.mu.Unlock()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// 用户只能把设备转给自己或自己所属的组织，转给自己时计入设备数量配额
+	p := requestPrincipal(r)
+	if !p.owns(req.Owner) {
+		storage.mu.Unlock()
+		http.Error(w, "owner must be yourself or one of your organizations", http.StatusForbidden)
+		return
+	}
+	if !p.admin() && req.Owner == p.user && device.Owner != p.user {
+		if err := checkCountQuota(p.user, quotaMaxDevices); err != nil {
+			storage.mu.Unlock()
+			writeQuotaError(w, err)
+			return
+		}
+	}
+	device.Owner = req.Owner
+	replicateDevice(device)
+	storage.mu.Unlock()
+
+	markDirty()
+	requestLogger(r).Info("device owner changed", "device_id", deviceID, "owner", req.Owner)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"message": "Device owner updated",
+	})
+}
+
+// 删除设备及其队列，队列中的消息标记为失败，返回丢弃的消息数。调用方持有 storage.mu
+func removeDevice(deviceID, reason string) int {
+	pending := queues.drop(deviceID)
+	for _, msg := range pending {
+		if local, ok := storage.messages[msg.ID]; ok {
+			msg = local
+		}
+		msg.Status = messageFailed
+		msg.Error = reason
+		replicateMessage(msg)
+	}
+	replicateDeviceDeleted(deviceID)
+	delete(storage.devices, deviceID)
+	crashes.forget(deviceID)
+	wifiScans.forget(deviceID)
+	neighbors.forget(deviceID)
+	return len(pending)
+}
+
+// 删除设备，尚未下发的消息标记为失败
+func deleteDevice(w http.ResponseWriter, r *http.Request, deviceID string) {
+	storage.mu.Lock()
+	if _, exists := storage.devices[deviceID]; !exists {
+		storage.mu.Unlock()
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+	dropped := removeDevice(deviceID, "device deleted")
+	storage.mu.Unlock()
+
+	markDirty()
+	requestLogger(r).Info("device deleted", "device_id", deviceID, "dropped_messages", dropped)
+	events.publish(Event{Type: eventDeviceDeleted, DeviceID: deviceID, Data: map[string]any{"dropped_messages": dropped}})
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"message": "Device deleted",
+	})
+}
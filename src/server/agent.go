@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 目标上的配套代理（wolctl agent）：在被唤醒的电脑上运行，定期上报用户的空闲时间，
+// 并在响应中领取待执行的睡眠或关机命令，使服务器不只负责开机。命令有三个来源：
+//   - 目标的 power_policy.idle_after：空闲超过该时间后按 power_policy.action 执行
+//   - action 为 suspend 或 shutdown 的定时任务（见 schedule.go）
+//   - 管理员手动 POST /api/admin/targets/{name}/suspend|shutdown
+//
+// 代理状态和尚未领取的命令只保存在内存中
+
+const (
+	agentActionSuspend  = "suspend"
+	agentActionShutdown = "shutdown"
+
+	agentReportInterval = time.Minute      // 代理的上报间隔，随响应下发
+	agentStaleAfter     = 3 * time.Minute  // 超过该时间未上报视为代理离线，不再为它创建命令
+	agentCommandTTL     = 10 * time.Minute // 命令超过该时间未被领取时作废，避免目标重新开机后立即被关掉
+)
+
+// 目标的自动睡眠策略，需要目标上运行代理
+type PowerPolicy struct {
+	Action    string    `json:"action,omitempty"`     // suspend（默认）或 shutdown
+	IdleAfter *Duration `json:"idle_after,omitempty"` // 空闲超过该时间后执行；省略时只执行定时任务和手动命令
+}
+
+func validAgentAction(action string) bool {
+	return action == agentActionSuspend || action == agentActionShutdown
+}
+
+func (pp *PowerPolicy) validate() error {
+	if pp.Action == "" {
+		pp.Action = agentActionSuspend
+	}
+	if !validAgentAction(pp.Action) {
+		return fmt.Errorf("power_policy.action must be %s or %s", agentActionSuspend, agentActionShutdown)
+	}
+	if pp.IdleAfter != nil && time.Duration(*pp.IdleAfter) < time.Minute {
+		return fmt.Errorf("power_policy.idle_after must be at least 1m")
+	}
+	return nil
+}
+
+type AgentCommand struct {
+	ID          string     `json:"id"`
+	Action      string     `json:"action"`
+	Reason      string     `json:"reason"` // idle、schedule:<id> 或操作者
+	CreatedAt   time.Time  `json:"created_at"`
+	DeliveredAt *time.Time `json:"delivered_at,omitempty"`
+}
+
+type AgentStatus struct {
+	Target      string        `json:"target"`
+	Hostname    string        `json:"hostname,omitempty"`
+	Platform    string        `json:"platform,omitempty"`
+	Version     string        `json:"version,omitempty"`
+	IdleSeconds int64         `json:"idle_seconds"`
+	ReportedAt  time.Time     `json:"reported_at"`
+	Online      bool          `json:"online"`
+	Pending     *AgentCommand `json:"pending,omitempty"`      // 等待代理领取的命令
+	LastCommand *AgentCommand `json:"last_command,omitempty"` // 最近一次领取的命令
+}
+
+var agents = struct {
+	mu     sync.Mutex
+	status map[string]*AgentStatus // 目标名称 -> 状态
+}{status: make(map[string]*AgentStatus)}
+
+// 代理上报的内容
+type agentReport struct {
+	Hostname    string `json:"hostname"`
+	Platform    string `json:"platform"`
+	Version     string `json:"version"`
+	IdleSeconds int64  `json:"idle_seconds"`
+}
+
+// 为目标创建命令，替换尚未领取的命令。代理不在线时返回错误
+func requestAgentCommand(target, action, reason string) (*AgentCommand, error) {
+	agents.mu.Lock()
+	defer agents.mu.Unlock()
+	status, ok := agents.status[target]
+	if !ok || time.Since(status.ReportedAt) > agentStaleAfter {
+		return nil, fmt.Errorf("no agent is reporting for target %s", target)
+	}
+	now := time.Now().UTC()
+	status.Pending = &AgentCommand{
+		ID:        fmt.Sprintf("cmd_%d", now.UnixNano()),
+		Action:    action,
+		Reason:    reason,
+		CreatedAt: now,
+	}
+	return status.Pending, nil
+}
+
+func forgetAgent(target string) {
+	agents.mu.Lock()
+	delete(agents.status, target)
+	agents.mu.Unlock()
+}
+
+// 空闲策略是否应当触发：空闲超过 idle_after，并且 idle_after 内没有唤醒过目标、也没有领取过命令
+// （刚唤醒的电脑可能还没有人开始使用，领取命令后电脑可能没能睡眠，不反复下发）
+func idleCommandDue(status *AgentStatus, policy *PowerPolicy, lastWake *TargetWake, now time.Time) bool {
+	if policy == nil || policy.IdleAfter == nil || status.Pending != nil {
+		return false
+	}
+	idleAfter := time.Duration(*policy.IdleAfter)
+	if time.Duration(status.IdleSeconds)*time.Second < idleAfter {
+		return false
+	}
+	if lastWake != nil && now.Sub(lastWake.Time) < idleAfter {
+		return false
+	}
+	last := status.LastCommand
+	return last == nil || last.DeliveredAt == nil || now.Sub(*last.DeliveredAt) >= idleAfter
+}
+
+// POST /api/agent/{target}：代理上报状态并领取命令，响应 {"report_interval", "command"}
+func agentReportHandler(w http.ResponseWriter, r *http.Request) {
+	name, action := pathParams(r, "/api/agent/")
+	if name == "" || action != "" {
+		http.NotFound(w, r)
+		return
+	}
+	var req agentReport
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if req.IdleSeconds < 0 {
+		http.Error(w, "idle_seconds must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	p := requestPrincipal(r)
+	storage.mu.RLock()
+	t, exists := storage.targets[name]
+	exists = exists && p.canWakeTarget(t)
+	var policy *PowerPolicy
+	var lastWake *TargetWake
+	probed := false
+	if exists {
+		policy, lastWake, probed = t.PowerPolicy, lastTargetWake(name), t.Probe != nil
+	}
+	storage.mu.RUnlock()
+	if !exists {
+		http.Error(w, "Target not found", http.StatusNotFound)
+		return
+	}
+
+	now := time.Now().UTC()
+	logger := requestLogger(r).With("target", name)
+	agents.mu.Lock()
+	status, ok := agents.status[name]
+	if !ok {
+		status = &AgentStatus{Target: name}
+		agents.status[name] = status
+		logger.Info("agent connected", "hostname", req.Hostname, "platform", req.Platform, "version", req.Version)
+	}
+	// 没有开机检测的目标，代理离线后重新上报说明目标已开机，用于计算唤醒延迟
+	reconnected := !probed && (!ok || now.Sub(status.ReportedAt) > agentStaleAfter)
+	status.Hostname, status.Platform, status.Version = req.Hostname, req.Platform, req.Version
+	status.IdleSeconds, status.ReportedAt = req.IdleSeconds, now
+	if status.Pending != nil && now.Sub(status.Pending.CreatedAt) > agentCommandTTL {
+		logger.Warn("agent command expired", "command_id", status.Pending.ID, "action", status.Pending.Action)
+		status.Pending = nil
+	}
+	if idleCommandDue(status, policy, lastWake, now) {
+		status.Pending = &AgentCommand{ID: fmt.Sprintf("cmd_%d", now.UnixNano()), Action: policy.Action, Reason: "idle", CreatedAt: now}
+	}
+	command := status.Pending
+	if command != nil {
+		command.DeliveredAt = &now
+		status.LastCommand, status.Pending = command, nil
+	}
+	agents.mu.Unlock()
+	if reconnected {
+		confirmAwake(name, now)
+	}
+
+	resp := map[string]interface{}{"success": true, "report_interval": int(agentReportInterval.Seconds())}
+	if command != nil {
+		logger.Info("agent command delivered", "command_id", command.ID, "action", command.Action, "reason", command.Reason, "idle_seconds", req.IdleSeconds)
+		events.publish(Event{Type: eventTargetPowerOff, Data: map[string]any{"target": name, "action": command.Action, "reason": command.Reason}})
+		resp["command"] = command
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// POST /api/admin/targets/{name}/suspend|shutdown
+func targetPowerCommand(w http.ResponseWriter, r *http.Request, name, action string) {
+	p := requestPrincipal(r)
+	storage.mu.RLock()
+	t, exists := storage.targets[name]
+	exists = exists && p.canWakeTarget(t)
+	storage.mu.RUnlock()
+	if !exists {
+		http.Error(w, "Target not found", http.StatusNotFound)
+		return
+	}
+	command, err := requestAgentCommand(name, action, principalName(p))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	requestLogger(r).Info("agent command queued", "target", name, "command_id", command.ID, "action", action)
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{
+		"success": true,
+		"command": command,
+		"message": fmt.Sprintf("%s command queued, the agent picks it up within %s", action, agentReportInterval),
+	})
+}
+
+// GET /api/admin/agents：用户能看到的目标上的代理
+func agentsHandler(w http.ResponseWriter, r *http.Request) {
+	p := requestPrincipal(r)
+	storage.mu.RLock()
+	visible := make(map[string]bool)
+	for name, t := range storage.targets {
+		visible[name] = p.targetAccess(t) != ""
+	}
+	storage.mu.RUnlock()
+
+	list := []AgentStatus{}
+	agents.mu.Lock()
+	for name, status := range agents.status {
+		if visible[name] {
+			view := *status
+			view.Online = time.Since(status.ReportedAt) <= agentStaleAfter
+			list = append(list, view)
+		}
+	}
+	agents.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Target < list[j].Target })
+	writeJSON(w, http.StatusOK, map[string]interface{}{"success": true, "agents": list, "total": len(list)})
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Prometheus Alertmanager webhook 接收器：按规则把告警映射为唤醒，
+// 例如备份目标离线的告警唤醒备份服务器。target / group 可以是模板，例如 {{.Labels.instance}}
+
+// Alertmanager 接收器配置
+type AlertmanagerConfig struct {
+	Rules []AlertRuleConfig `json:"rules"`
+}
+
+// 告警规则：match / match_re 的所有标签都匹配时触发
+type AlertRuleConfig struct {
+	Name     string            `json:"name"`
+	Match    map[string]string `json:"match"`    // 标签等于
+	MatchRE  map[string]string `json:"match_re"` // 标签匹配正则（整体匹配）
+	Target   string            `json:"target"`   // 目标名称或模板，与 group 二选一
+	Group    string            `json:"group"`
+	Allow    []string          `json:"allow"`    // 模板渲染结果允许的名称
+	Cooldown string            `json:"cooldown"` // 同一规则对同一名称的最短唤醒间隔，默认5m，避免告警重复发送时反复唤醒
+}
+
+type alertRule struct {
+	name     string
+	match    map[string]string
+	matchRE  map[string]*regexp.Regexp
+	tmpl     *template.Template
+	isGroup  bool
+	allow    map[string]bool
+	cooldown time.Duration
+}
+
+// Alertmanager webhook 请求体（只解析需要的字段）
+type alertmanagerPayload struct {
+	Alerts []alertmanagerAlert `json:"alerts"`
+}
+
+type alertmanagerAlert struct {
+	Status      string            `json:"status"`
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations"`
+	Fingerprint string            `json:"fingerprint"`
+}
+
+var (
+	alertRules []*alertRule
+
+	// 规则和名称 -> 上次唤醒时间
+	alertLastWakeMu sync.Mutex
+	alertLastWake   = map[string]time.Time{}
+)
+
+func buildAlertRules(cfg *AlertmanagerConfig) ([]*alertRule, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	var rules []*alertRule
+	for i, rc := range cfg.Rules {
+		label := rc.Name
+		if label == "" {
+			label = fmt.Sprintf("#%d", i+1)
+		}
+		if (rc.Target == "") == (rc.Group == "") {
+			return nil, fmt.Errorf("alertmanager rule %s: exactly one of target or group is required", label)
+		}
+		if len(rc.Match)+len(rc.MatchRE) == 0 {
+			return nil, fmt.Errorf("alertmanager rule %s: match or match_re is required", label)
+		}
+		spec := rc.Target + rc.Group
+		tmpl, err := template.New(label).Option("missingkey=zero").Parse(spec)
+		if err != nil {
+			return nil, fmt.Errorf("alertmanager rule %s: %v", label, err)
+		}
+		if strings.Contains(spec, "{{") && len(rc.Allow) == 0 {
+			return nil, fmt.Errorf("alertmanager rule %s: allow is required when target or group is a template", label)
+		}
+		rule := &alertRule{
+			name:     label,
+			match:    rc.Match,
+			matchRE:  make(map[string]*regexp.Regexp),
+			tmpl:     tmpl,
+			isGroup:  rc.Group != "",
+			allow:    make(map[string]bool),
+			cooldown: 5 * time.Minute,
+		}
+		for name, expr := range rc.MatchRE {
+			re, err := regexp.Compile("^(?:" + expr + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("alertmanager rule %s: match_re %s: %v", label, name, err)
+			}
+			rule.matchRE[name] = re
+		}
+		for _, name := range rc.Allow {
+			rule.allow[name] = true
+		}
+		if rc.Cooldown != "" {
+			if rule.cooldown, err = time.ParseDuration(rc.Cooldown); err != nil || rule.cooldown < 0 {
+				return nil, fmt.Errorf("alertmanager rule %s: invalid cooldown %q", label, rc.Cooldown)
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func (rule *alertRule) matches(labels map[string]string) bool {
+	for name, value := range rule.match {
+		if labels[name] != value {
+			return false
+		}
+	}
+	for name, re := range rule.matchRE {
+		if !re.MatchString(labels[name]) {
+			return false
+		}
+	}
+	return true
+}
+
+// 渲染目标或分组名称
+func (rule *alertRule) resolve(alert alertmanagerAlert) (string, error) {
+	var buf bytes.Buffer
+	if err := rule.tmpl.Execute(&buf, alert); err != nil {
+		return "", err
+	}
+	name := strings.TrimSpace(buf.String())
+	if name == "" || name == "<no value>" {
+		return "", fmt.Errorf("template produced an empty name")
+	}
+	if len(rule.allow) > 0 && !rule.allow[name] {
+		return "", fmt.Errorf("%q is not in the allow list", name)
+	}
+	return name, nil
+}
+
+// 检查并记录冷却时间，返回 true 表示可以唤醒
+func alertCooldownPassed(key string, cooldown time.Duration) bool {
+	alertLastWakeMu.Lock()
+	defer alertLastWakeMu.Unlock()
+	now := time.Now()
+	if last, ok := alertLastWake[key]; ok && now.Sub(last) < cooldown {
+		return false
+	}
+	alertLastWake[key] = now
+	return true
+}
+
+// 接收 Alertmanager webhook：POST /api/alertmanager。只处理 firing 状态的告警
+func alertmanagerHandler(w http.ResponseWriter, r *http.Request) {
+	var payload alertmanagerPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	messageIDs := []string{}
+	failures := map[string]string{}
+	skipped := 0
+	for _, alert := range payload.Alerts {
+		if alert.Status != "firing" {
+			continue
+		}
+		for _, rule := range alertRules {
+			if !rule.matches(alert.Labels) {
+				continue
+			}
+			logger := requestLogger(r).With("rule", rule.name, "alertname", alert.Labels["alertname"], "fingerprint", alert.Fingerprint)
+			name, err := rule.resolve(alert)
+			if err != nil {
+				logger.Warn("alert rule rejected", "error", err)
+				failures[rule.name] = err.Error()
+				continue
+			}
+			if !alertCooldownPassed(rule.name+"\n"+name, rule.cooldown) {
+				skipped++
+				continue
+			}
+			target, group := name, ""
+			if rule.isGroup {
+				target, group = "", name
+			}
+			reqs, err := resolveWake(target, group, "alertmanager:"+rule.name)
+			if err != nil {
+				logger.Warn("alert rule rejected", "error", err)
+				failures[name] = err.Error()
+				continue
+			}
+			for _, req := range reqs {
+				message, err := queueWake(logger, req)
+				if err != nil {
+					failures[req.Target] = err.Error()
+					continue
+				}
+				messageIDs = append(messageIDs, message.ID)
+			}
+			logger.Info("alert triggered wake", "target", target, "group", group)
+		}
+	}
+
+	// 返回 200 即可，非 2xx 会让 Alertmanager 重试，而规则错误重试也不会成功
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success":     len(failures) == 0,
+		"message_ids": messageIDs,
+		"errors":      failures,
+		"skipped":     skipped,
+		"message":     fmt.Sprintf("%d WOL messages queued, %d skipped by cooldown", len(messageIDs), skipped),
+	})
+}
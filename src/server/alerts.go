@@ -0,0 +1,63 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// 告警阈值
+var (
+	alertOfflineAfter     = 15 * time.Minute
+	alertFailureThreshold = 3
+	alertFailureWindow    = 30 * time.Minute
+)
+
+// 按目标MAC统计唤醒失败，时间窗口内失败次数达到阈值时发布告警（每个窗口只发布一次）
+type wakeFailureTracker struct {
+	mu      sync.Mutex
+	windows map[string]*wakeFailureWindow
+}
+
+type wakeFailureWindow struct {
+	start    time.Time
+	count    int
+	alerted  bool
+	lastErr  string
+	deviceID string
+}
+
+var wakeFailures = &wakeFailureTracker{windows: make(map[string]*wakeFailureWindow)}
+
+func (t *wakeFailureTracker) record(targetMAC, deviceID, errMsg string) {
+	if alertFailureThreshold <= 0 {
+		return
+	}
+
+	now := time.Now()
+	t.mu.Lock()
+	w, ok := t.windows[targetMAC]
+	if !ok || now.Sub(w.start) > alertFailureWindow {
+		w = &wakeFailureWindow{start: now}
+		t.windows[targetMAC] = w
+	}
+	w.count++
+	w.lastErr = errMsg
+	w.deviceID = deviceID
+	alert := w.count >= alertFailureThreshold && !w.alerted
+	if alert {
+		w.alerted = true
+	}
+	count := w.count
+	t.mu.Unlock()
+
+	if alert {
+		slog.Warn("repeated wake failures", "target_mac", targetMAC, "device_id", deviceID, "count", count)
+		events.publish(Event{Type: eventAlertRepeatedFailures, DeviceID: deviceID, Data: map[string]any{
+			"target_mac": targetMAC,
+			"count":      count,
+			"window":     alertFailureWindow.String(),
+			"error":      errMsg,
+		}})
+	}
+}
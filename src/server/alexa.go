@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Alexa 智能家居技能接口：技能的 Lambda 函数把指令原样转发到 POST /api/alexa（带 X-API-Key），
+// 并返回这里的响应。每个命名目标是一个 COMPUTER 类型的端点，支持 Alexa.PowerController：
+// 打开即唤醒；关闭会取消尚未下发的唤醒（WOL无法关机）。电源状态与 Home Assistant 开关一致，
+// 唤醒进行中为 ON
+
+// Alexa 指令（只解析需要的字段）
+type alexaRequest struct {
+	Directive struct {
+		Header   alexaHeader     `json:"header"`
+		Endpoint *alexaEndpoint  `json:"endpoint,omitempty"`
+		Payload  json.RawMessage `json:"payload"`
+	} `json:"directive"`
+}
+
+type alexaHeader struct {
+	Namespace        string `json:"namespace"`
+	Name             string `json:"name"`
+	PayloadVersion   string `json:"payloadVersion"`
+	MessageID        string `json:"messageId"`
+	CorrelationToken string `json:"correlationToken,omitempty"`
+}
+
+type alexaEndpoint struct {
+	EndpointID string          `json:"endpointId"`
+	Scope      json.RawMessage `json:"scope,omitempty"`
+}
+
+type alexaProperty struct {
+	Namespace                 string    `json:"namespace"`
+	Name                      string    `json:"name"`
+	Value                     any       `json:"value"`
+	TimeOfSample              time.Time `json:"timeOfSample"`
+	UncertaintyInMilliseconds int       `json:"uncertaintyInMilliseconds"`
+}
+
+// Alexa 事件响应
+type alexaResponse struct {
+	Context *alexaContext `json:"context,omitempty"`
+	Event   alexaEvent    `json:"event"`
+}
+
+type alexaContext struct {
+	Properties []alexaProperty `json:"properties"`
+}
+
+type alexaEvent struct {
+	Header   alexaHeader    `json:"header"`
+	Endpoint *alexaEndpoint `json:"endpoint,omitempty"`
+	Payload  any            `json:"payload"`
+}
+
+// Alexa 端点ID不允许包含 "."，用 ":" 代替（目标名称中不会出现 ":"）
+func alexaEndpointID(name string) string {
+	return strings.ReplaceAll(name, ".", ":")
+}
+
+// 目标名称转换为便于语音识别的名称，例如 office-pc -> office pc
+func alexaFriendlyName(name string) string {
+	return strings.NewReplacer("-", " ", "_", " ", ".", " ").Replace(name)
+}
+
+// 处理 Alexa 指令：POST /api/alexa
+func alexaHandler(w http.ResponseWriter, r *http.Request) {
+	var req alexaRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	d := req.Directive
+	header := alexaHeader{
+		Namespace:        "Alexa",
+		Name:             "Response",
+		PayloadVersion:   "3",
+		MessageID:        fmt.Sprintf("msg_%d", time.Now().UnixNano()),
+		CorrelationToken: d.Header.CorrelationToken,
+	}
+
+	switch d.Header.Namespace + "." + d.Header.Name {
+	case "Alexa.Discovery.Discover":
+		header.Namespace, header.Name = "Alexa.Discovery", "Discover.Response"
+		writeJSON(w, http.StatusOK, alexaResponse{Event: alexaEvent{
+			Header:  header,
+			Payload: map[string]any{"endpoints": alexaDiscover()},
+		}})
+
+	case "Alexa.Authorization.AcceptGrant":
+		// 不主动向 Alexa 推送状态，无需保存授权码
+		header.Namespace, header.Name = "Alexa.Authorization", "AcceptGrant.Response"
+		writeJSON(w, http.StatusOK, alexaResponse{Event: alexaEvent{Header: header, Payload: map[string]any{}}})
+
+	case "Alexa.ReportState", "Alexa.PowerController.TurnOn", "Alexa.PowerController.TurnOff":
+		if d.Endpoint == nil {
+			alexaError(w, header, nil, "INVALID_DIRECTIVE", "endpoint is required")
+			return
+		}
+		name, found := alexaTarget(d.Endpoint.EndpointID)
+		if !found {
+			alexaError(w, header, d.Endpoint, "NO_SUCH_ENDPOINT", "target not found")
+			return
+		}
+		logger := requestLogger(r).With("target", name)
+		switch d.Header.Name {
+		case "TurnOn":
+			reqs, err := resolveWake(name, "", "alexa")
+			if err == nil {
+				_, err = queueWake(logger, reqs[0])
+			}
+			if err != nil {
+				alexaError(w, header, d.Endpoint, "ENDPOINT_UNREACHABLE", err.Error())
+				return
+			}
+		case "TurnOff":
+			if err := cancelTargetWake(logger, name); err != nil {
+				alexaError(w, header, d.Endpoint, "NO_SUCH_ENDPOINT", err.Error())
+				return
+			}
+		case "ReportState":
+			header.Name = "StateReport"
+		}
+		writeJSON(w, http.StatusOK, alexaResponse{
+			Context: &alexaContext{Properties: alexaProperties(name)},
+			Event:   alexaEvent{Header: header, Endpoint: d.Endpoint, Payload: map[string]any{}},
+		})
+
+	default:
+		requestLogger(r).Warn("unsupported alexa directive", "namespace", d.Header.Namespace, "name", d.Header.Name)
+		alexaError(w, header, d.Endpoint, "INVALID_DIRECTIVE", "unsupported directive "+d.Header.Namespace+"."+d.Header.Name)
+	}
+}
+
+// 按端点ID查找目标名称
+func alexaTarget(endpointID string) (string, bool) {
+	storage.mu.RLock()
+	defer storage.mu.RUnlock()
+	for name := range storage.targets {
+		if alexaEndpointID(name) == endpointID {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// 发现响应中的端点列表
+func alexaDiscover() []map[string]any {
+	storage.mu.RLock()
+	targets := make([]Target, 0, len(storage.targets))
+	for _, t := range storage.targets {
+		targets = append(targets, *t)
+	}
+	storage.mu.RUnlock()
+	sort.Slice(targets, func(i, j int) bool { return targets[i].Name < targets[j].Name })
+
+	endpoints := make([]map[string]any, 0, len(targets))
+	for _, t := range targets {
+		description := t.Description
+		if description == "" {
+			description = "Wake-on-LAN " + t.MacAddress
+		}
+		endpoints = append(endpoints, map[string]any{
+			"endpointId":        alexaEndpointID(t.Name),
+			"manufacturerName":  "esp32-wol",
+			"friendlyName":      alexaFriendlyName(t.Name),
+			"description":       description,
+			"displayCategories": []string{"COMPUTER"},
+			"capabilities": []map[string]any{
+				{"type": "AlexaInterface", "interface": "Alexa", "version": "3"},
+				{
+					"type": "AlexaInterface", "interface": "Alexa.PowerController", "version": "3",
+					"properties": map[string]any{
+						"supported":           []map[string]string{{"name": "powerState"}},
+						"proactivelyReported": false,
+						"retrievable":         true,
+					},
+				},
+				{
+					"type": "AlexaInterface", "interface": "Alexa.EndpointHealth", "version": "3",
+					"properties": map[string]any{
+						"supported":           []map[string]string{{"name": "connectivity"}},
+						"proactivelyReported": false,
+						"retrievable":         true,
+					},
+				},
+			},
+		})
+	}
+	return endpoints
+}
+
+// 目标当前的电源状态和连接状态（中继在线即视为可达）
+func alexaProperties(name string) []alexaProperty {
+	storage.mu.RLock()
+	power, connectivity := "OFF", "UNREACHABLE"
+	if t, exists := storage.targets[name]; exists {
+		if targetIsOn(name) {
+			power = "ON"
+		}
+		if device, exists := storage.devices[t.DeviceID]; exists && device.Online && device.Approved {
+			connectivity = "OK"
+		}
+	}
+	storage.mu.RUnlock()
+
+	now := time.Now().UTC()
+	return []alexaProperty{
+		{Namespace: "Alexa.PowerController", Name: "powerState", Value: power, TimeOfSample: now, UncertaintyInMilliseconds: 500},
+		{Namespace: "Alexa.EndpointHealth", Name: "connectivity", Value: map[string]string{"value": connectivity}, TimeOfSample: now},
+	}
+}
+
+// Alexa 错误响应；按协议 HTTP 状态仍为 200
+func alexaError(w http.ResponseWriter, header alexaHeader, endpoint *alexaEndpoint, errType, message string) {
+	header.Namespace, header.Name = "Alexa", "ErrorResponse"
+	writeJSON(w, http.StatusOK, alexaResponse{Event: alexaEvent{
+		Header:   header,
+		Endpoint: endpoint,
+		Payload:  map[string]string{"type": errType, "message": message},
+	}})
+}
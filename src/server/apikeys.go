@@ -0,0 +1,238 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// 服务器API密钥管理：除了启动参数 -api-key，管理员可以在运行时创建多个带标签的密钥
+// （例如 Home Assistant、备份脚本、每个中继各一个），单独停用或删除，不用为了撤销一个集成而更换全部密钥。
+// 这些密钥与 -api-key 权限相同；只保存 SHA-256，密钥本身只在创建时返回。
+// 全部迁移到这些密钥后可以用 -api-key-auth=false 停止接受 -api-key，它仍用于派生唤醒链接和 OAuth 的签名密钥。
+//
+// 只读密钥（read_only）可以看到全部设备、目标、消息和统计，但只能读取标记了 View 的路由（GET/HEAD），
+// 不能唤醒、修改配置、作为中继轮询，也不能用于 OAuth 授权，适合放在公共场所的状态看板上
+
+type APIKey struct {
+	ID         string     `json:"id"`
+	Label      string     `json:"label"`
+	Hash       string     `json:"hash"`
+	Hint       string     `json:"hint"` // 密钥开头几位，便于辨认
+	Disabled   bool       `json:"disabled,omitempty"`
+	ReadOnly   bool       `json:"read_only,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+// 接口中的密钥信息，不包含摘要
+type APIKeyInfo struct {
+	ID         string     `json:"id"`
+	Label      string     `json:"label"`
+	Hint       string     `json:"hint"`
+	Disabled   bool       `json:"disabled"`
+	ReadOnly   bool       `json:"read_only"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+// 管理的API密钥前缀，便于在日志和密钥扫描中识别
+const apiKeyPrefix = "wolk_"
+
+const maxAPIKeys = 100
+
+// 是否接受启动参数 -api-key 作为请求的密钥（-api-key-auth）
+var apiKeyAuth = true
+
+func newAPIKey(label string) (string, *APIKey) {
+	key := apiKeyPrefix + randomHex(24)
+	return key, &APIKey{
+		ID:        "key_" + randomHex(8),
+		Label:     label,
+		Hash:      hashToken(key),
+		Hint:      key[:len(apiKeyPrefix)+6],
+		CreatedAt: time.Now(),
+	}
+}
+
+func (k *APIKey) info() APIKeyInfo {
+	info := APIKeyInfo{ID: k.ID, Label: k.Label, Hint: k.Hint, Disabled: k.Disabled, ReadOnly: k.ReadOnly, CreatedAt: k.CreatedAt}
+	if k.LastUsedAt != nil {
+		last := *k.LastUsedAt
+		info.LastUsedAt = &last
+	}
+	return info
+}
+
+// 检查服务器API密钥：-api-key（未关闭时）或未停用的管理密钥。
+// 返回管理密钥的ID（-api-key 的ID为空）和是否只读
+func lookupServerKey(key string) (string, bool, bool) {
+	if key == "" {
+		return "", false, false
+	}
+	if apiKeyAuth && subtle.ConstantTimeCompare([]byte(key), []byte(API_KEY)) == 1 {
+		return "", false, true
+	}
+	if !strings.HasPrefix(key, apiKeyPrefix) {
+		return "", false, false
+	}
+	hash := []byte(hashToken(key))
+	var found *APIKey
+	stale, readOnly := false, false
+	storage.mu.RLock()
+	for _, k := range storage.apiKeys {
+		if subtle.ConstantTimeCompare(hash, []byte(k.Hash)) == 1 && !k.Disabled {
+			found = k
+			stale = k.LastUsedAt == nil || time.Since(*k.LastUsedAt) >= tokenUsageInterval
+			readOnly = k.ReadOnly
+		}
+	}
+	storage.mu.RUnlock()
+	if found == nil {
+		return "", false, false
+	}
+	// 最近使用时间随下一次保存写入，不单独触发保存
+	if stale {
+		now := time.Now()
+		storage.mu.Lock()
+		found.LastUsedAt = &now
+		storage.mu.Unlock()
+	}
+	return found.ID, readOnly, true
+}
+
+// 是否有未停用、可以管理服务器的密钥（不计只读密钥）
+func haveEnabledAPIKeys() bool {
+	storage.mu.RLock()
+	defer storage.mu.RUnlock()
+	for _, k := range storage.apiKeys {
+		if !k.Disabled && !k.ReadOnly {
+			return true
+		}
+	}
+	return false
+}
+
+func validAPIKeyLabel(label string) bool {
+	return label != "" && len(label) <= 64
+}
+
+// GET/POST /api/admin/api-keys（仅服务器API密钥）
+func apiKeysHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		storage.mu.RLock()
+		keys := make([]APIKeyInfo, 0, len(storage.apiKeys))
+		for _, k := range storage.apiKeys {
+			keys = append(keys, k.info())
+		}
+		storage.mu.RUnlock()
+		sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.Before(keys[j].CreatedAt) })
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"success":      true,
+			"api_keys":     keys,
+			"total":        len(keys),
+			"api_key_auth": apiKeyAuth, // 是否仍接受 -api-key
+		})
+
+	case http.MethodPost:
+		var req struct {
+			Label    string `json:"label"`
+			ReadOnly bool   `json:"read_only"`
+		}
+		if !readJSON(w, r, &req) {
+			return
+		}
+		req.Label = strings.TrimSpace(req.Label)
+		if !validAPIKeyLabel(req.Label) {
+			http.Error(w, "label must be 1-64 characters", http.StatusBadRequest)
+			return
+		}
+		key, k := newAPIKey(req.Label)
+		k.ReadOnly = req.ReadOnly
+		storage.mu.Lock()
+		if len(storage.apiKeys) >= maxAPIKeys {
+			storage.mu.Unlock()
+			http.Error(w, "Too many API keys, delete one first", http.StatusConflict)
+			return
+		}
+		storage.apiKeys[k.ID] = k
+		storage.mu.Unlock()
+
+		markDirty()
+		requestLogger(r).Info("api key created", "key_id", k.ID, "label", k.Label, "read_only", k.ReadOnly, "by", principalName(requestPrincipal(r)))
+		writeJSON(w, http.StatusCreated, map[string]interface{}{
+			"success": true,
+			"message": "API key created",
+			"api_key": key,
+			"info":    k.info(),
+		})
+
+	default:
+		methodNotAllowed(w, r)
+	}
+}
+
+// 单个密钥：PUT /api/admin/api-keys/<id> 修改标签、停用或只读 {"label", "disabled", "read_only"}，DELETE 删除
+func apiKeyHandler(w http.ResponseWriter, r *http.Request) {
+	id, _ := pathParams(r, "/api/admin/api-keys/")
+	switch r.Method {
+	case http.MethodPut:
+		var req struct {
+			Label    *string `json:"label"`
+			Disabled *bool   `json:"disabled"`
+			ReadOnly *bool   `json:"read_only"`
+		}
+		if !readJSON(w, r, &req) {
+			return
+		}
+		if req.Label != nil {
+			*req.Label = strings.TrimSpace(*req.Label)
+			if !validAPIKeyLabel(*req.Label) {
+				http.Error(w, "label must be 1-64 characters", http.StatusBadRequest)
+				return
+			}
+		}
+		storage.mu.Lock()
+		k, exists := storage.apiKeys[id]
+		if !exists {
+			storage.mu.Unlock()
+			http.Error(w, "API key not found", http.StatusNotFound)
+			return
+		}
+		if req.Label != nil {
+			k.Label = *req.Label
+		}
+		if req.Disabled != nil {
+			k.Disabled = *req.Disabled
+		}
+		if req.ReadOnly != nil {
+			k.ReadOnly = *req.ReadOnly
+		}
+		info := k.info()
+		storage.mu.Unlock()
+
+		markDirty()
+		requestLogger(r).Info("api key updated", "key_id", id, "label", info.Label, "disabled", info.Disabled, "read_only", info.ReadOnly, "by", principalName(requestPrincipal(r)))
+		writeJSON(w, http.StatusOK, map[string]interface{}{"success": true, "info": info})
+
+	case http.MethodDelete:
+		storage.mu.Lock()
+		k, exists := storage.apiKeys[id]
+		delete(storage.apiKeys, id)
+		storage.mu.Unlock()
+		if !exists {
+			http.Error(w, "API key not found", http.StatusNotFound)
+			return
+		}
+
+		markDirty()
+		requestLogger(r).Info("api key deleted", "key_id", id, "label", k.Label, "by", principalName(requestPrincipal(r)))
+		writeJSON(w, http.StatusOK, map[string]interface{}{"success": true, "message": "API key deleted"})
+
+	default:
+		methodNotAllowed(w, r)
+	}
+}
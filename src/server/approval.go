@@ -0,0 +1,224 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// 受保护目标的双人审批：目标设置 protected 后（只有服务器API密钥可以设置），对它的唤醒请求不直接入队，
+// 而是以 pending_approval 状态等待另一位管理员批准（POST /api/wol/messages/<id>/approve）或拒绝
+// （POST /api/wol/messages/<id>/reject），适用于不应被随手开机的服务器。
+// 直接指定设备和MAC地址唤醒同一MAC地址同样需要审批。
+//
+// 批准者必须是服务器API密钥、管理的API密钥或 admin 角色的用户，并且不能是请求者本人
+// （按来源比较：api、key:<id>、user:<name>）。持有服务器API密钥的人可以随时创建新的密钥、用户和令牌，
+// 所以批准使用的凭据必须在请求之前就已存在；审批只能区分请求时已经存在的不同凭据，
+// 不能防止同一个人事先准备好两个凭据。超过 -approval-timeout 仍未处理的请求自动拒绝。
+// 等待批准的消息写入状态文件（approvals），重启后继续等待
+
+var approvalTimeout = time.Hour
+
+var (
+	errNotPendingApproval = errors.New("message is not awaiting approval")
+	errSelfApproval       = errors.New("a wake cannot be approved by the principal that requested it")
+	errApproverTooNew     = errors.New("a wake cannot be approved with a credential created after it was requested")
+)
+
+func checkApprovalSettings() error {
+	if approvalTimeout < time.Minute {
+		return errors.New("-approval-timeout must be at least 1m")
+	}
+	return nil
+}
+
+// 唤醒请求涉及的受保护目标名称，不需要审批时为空。调用方持有 storage.mu
+func protectedTarget(req wakeRequest) string {
+	for _, t := range wakeTargets(req) {
+		if t.Protected {
+			return t.Name
+		}
+	}
+	return ""
+}
+
+// 保存等待批准的消息并发布事件。调用方持有 storage.mu 写锁
+func requestApproval(logger *slog.Logger, message *WOLMessage, target string) {
+	message.Status = messagePendingApproval
+	if message.Target == "" {
+		message.Target = target
+	}
+	storage.messages[message.ID] = message
+	replicateMessage(message)
+	markDirty()
+	logger.Info("wol message awaiting approval", "device_id", message.DeviceID, "message_id", message.ID, "target", message.Target, "source", message.Source)
+	data := messageEventData(message, map[string]any{"source": message.Source, "target": message.Target})
+	events.publish(Event{Type: eventApprovalRequested, DeviceID: message.DeviceID, MessageID: message.ID, Data: data})
+}
+
+// 批准者使用的凭据（管理的API密钥、用户或用户令牌）是否在 t 之后创建，-api-key 视为一直存在。
+// 调用方持有 storage.mu
+func credentialCreatedAfter(p principal, t time.Time) bool {
+	if p.admin() {
+		k, exists := storage.apiKeys[p.token]
+		return exists && k.CreatedAt.After(t)
+	}
+	u, exists := storage.users[p.user]
+	if !exists || u.CreatedAt.After(t) {
+		return true
+	}
+	for _, token := range u.Tokens {
+		if token.ID == p.token {
+			return token.CreatedAt.After(t)
+		}
+	}
+	return false
+}
+
+// 批准等待中的唤醒并加入设备队列；维护模式、队列超限等错误时消息保持等待，可以稍后再批准
+func approveWake(logger *slog.Logger, messageID string, p principal) (WOLMessage, error) {
+	approver := principalName(p)
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	message, exists := storage.messages[messageID]
+	if !exists {
+		return WOLMessage{}, errMessageNotFound
+	}
+	if message.Status != messagePendingApproval {
+		return WOLMessage{}, fmt.Errorf("message is %s: %w", message.Status, errNotPendingApproval)
+	}
+	if message.Source == approver {
+		return WOLMessage{}, errSelfApproval
+	}
+	if credentialCreatedAfter(p, message.CreatedAt) {
+		return WOLMessage{}, errApproverTooNew
+	}
+	if storage.maintenance != nil {
+		return WOLMessage{}, errMaintenance
+	}
+	queued, err := enqueueMessage(logger, message)
+	if err != nil {
+		message.Status = messagePendingApproval
+		return WOLMessage{}, err
+	}
+	message.ApprovedBy = approver
+	queued.ApprovedBy = approver
+	replicateMessage(message)
+	markDirty()
+	logger.Info("wol message approved", "device_id", message.DeviceID, "message_id", messageID, "target", message.Target, "source", message.Source, "by", approver)
+	data := messageEventData(message, map[string]any{"source": message.Source, "target": message.Target, "by": approver})
+	events.publish(Event{Type: eventMessageApproved, DeviceID: message.DeviceID, MessageID: messageID, Data: data})
+	return queued, nil
+}
+
+// 拒绝等待中的唤醒，by 为空表示审批超时
+func rejectWake(logger *slog.Logger, messageID, by string) error {
+	storage.mu.Lock()
+	message, exists := storage.messages[messageID]
+	if !exists {
+		storage.mu.Unlock()
+		return errMessageNotFound
+	}
+	if message.Status != messagePendingApproval {
+		status := message.Status
+		storage.mu.Unlock()
+		return fmt.Errorf("message is %s: %w", status, errNotPendingApproval)
+	}
+	reason := "rejected by " + by
+	if by == "" {
+		reason = "approval timed out"
+	}
+	message.Status = messageCancelled
+	message.Error = reason
+	replicateMessage(message)
+	markDirty()
+	deviceID := message.DeviceID
+	data := messageEventData(message, map[string]any{"source": message.Source, "target": message.Target, "reason": reason})
+	if by != "" {
+		data["by"] = by
+	}
+	storage.mu.Unlock()
+
+	countMessages(messageCancelled, 1)
+	logger.Info("wol message rejected", "device_id", deviceID, "message_id", messageID, "reason", reason)
+	events.publish(Event{Type: eventMessageRejected, DeviceID: deviceID, MessageID: messageID, Data: data})
+	return nil
+}
+
+// 自动拒绝超过 -approval-timeout 的请求，只在主副本上运行
+func runApprovalExpiry() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-shutdownCh:
+			return
+		case <-ticker.C:
+		}
+		if !isLeader() {
+			continue
+		}
+		var expired []string
+		storage.mu.RLock()
+		for id, m := range storage.messages {
+			if m.Status == messagePendingApproval && time.Since(m.CreatedAt) > approvalTimeout {
+				expired = append(expired, id)
+			}
+		}
+		storage.mu.RUnlock()
+		for _, id := range expired {
+			rejectWake(slog.Default(), id, "")
+		}
+	}
+}
+
+// POST /api/wol/messages/{id}/approve 或 /reject
+func reviewMessage(w http.ResponseWriter, r *http.Request, messageID, action string) {
+	p := requestPrincipal(r)
+	storage.mu.RLock()
+	message, exists := storage.messages[messageID]
+	visible := exists && p.canSeeMessage(message)
+	storage.mu.RUnlock()
+	if !visible {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+	if !p.admin() && p.role < roleAdmin {
+		http.Error(w, "Only administrators can review protected wakes", http.StatusForbidden)
+		return
+	}
+	by := principalName(p)
+	logger := requestLogger(r)
+
+	if action == "reject" {
+		err := rejectWake(logger, messageID, by)
+		switch {
+		case errors.Is(err, errMessageNotFound):
+			http.Error(w, "Message not found", http.StatusNotFound)
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			writeJSON(w, http.StatusOK, map[string]interface{}{"success": true, "message": "Wake rejected"})
+		}
+		return
+	}
+
+	queued, err := approveWake(logger, messageID, p)
+	switch {
+	case errors.Is(err, errMessageNotFound):
+		http.Error(w, "Message not found", http.StatusNotFound)
+	case errors.Is(err, errSelfApproval), errors.Is(err, errApproverTooNew):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case writeMaintenance(w, err) || writeBackpressure(w, err) || writeCooldown(w, err):
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"success": true,
+			"status":  queued.Status,
+			"message": "Wake approved",
+		})
+	}
+}
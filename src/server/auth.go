@@ -0,0 +1,144 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// 身份验证中间件：服务器API密钥可以访问全部路由；用户令牌按角色访问，GET/HEAD 至少需要 read 角色，
+// 其他方法至少需要 write 角色，roleNone 表示用户令牌不能访问；只读密钥只能对 view 为 true 的路由发送 GET/HEAD
+func authMiddleware(handler http.HandlerFunc, read, write role, view bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// 从Header或Query参数获取API密钥
+		apiKey := r.Header.Get("X-API-Key")
+		if apiKey == "" {
+			apiKey = r.URL.Query().Get("api_key")
+		}
+
+		// 验证API密钥：-api-key 或管理的密钥
+		keyID, readOnly, ok := lookupServerKey(apiKey)
+		if !ok {
+			if p, ok := lookupUserToken(apiKey); ok {
+				need := requiredRole(r.Method, read, write)
+				if need == roleNone {
+					requestLogger(r).Warn("user token rejected on admin route", "user", p.user, "method", r.Method, "path", r.URL.Path)
+					writeJSON(w, http.StatusForbidden, map[string]string{
+						"error": "Forbidden: this endpoint requires the server API key",
+					})
+					return
+				}
+				if p.role < need {
+					requestLogger(r).Warn("user role insufficient", "user", p.user, "role", p.role.String(), "required", need.String(), "method", r.Method, "path", r.URL.Path)
+					writeJSON(w, http.StatusForbidden, map[string]string{
+						"error": "Forbidden: this action requires the " + need.String() + " role",
+					})
+					return
+				}
+				handler(w, withPrincipal(r, p))
+				return
+			}
+			ip := clientIP(r)
+			attrs := []any{"client_ip", ip, "method", r.Method, "path", r.URL.Path, "api_key", maskAPIKey(apiKey)}
+			requestLogger(r).Warn("authentication failed", append(attrs, lookupGeo(ip).attrs()...)...)
+			authFailures.record(ip, r.Method, r.URL.Path, authReasonAPIKey)
+			writeJSON(w, http.StatusUnauthorized, map[string]string{
+				"error": "Unauthorized: Invalid API key",
+			})
+			return
+		}
+
+		// 只读密钥只能读取看板所需的路由
+		if readOnly && (!view || (r.Method != http.MethodGet && r.Method != http.MethodHead)) {
+			requestLogger(r).Warn("read-only api key rejected", "key_id", keyID, "method", r.Method, "path", r.URL.Path)
+			writeJSON(w, http.StatusForbidden, map[string]string{
+				"error": "Forbidden: this API key is read-only",
+			})
+			return
+		}
+
+		// 认证通过，继续处理请求；使用管理的密钥时记录密钥ID，用于日志和设备身份绑定
+		if keyID != "" {
+			r = withPrincipal(r, principal{token: keyID})
+		}
+		handler(w, r)
+	}
+}
+
+// 掩码API密钥用于日志显示
+func maskAPIKey(key string) string {
+	if len(key) <= 8 {
+		return "****"
+	}
+	return key[:4] + "****" + key[len(key)-4:]
+}
+
+// 认证失败突发检测参数
+var (
+	authBurstThreshold = 5
+	authBurstWindow    = time.Minute
+)
+
+// 按客户端IP（IPv6 按 -ipv6-client-prefix 网段）统计认证失败次数，短时间内失败过多时发布事件（每个窗口只发布一次）
+type authFailureTracker struct {
+	mu      sync.Mutex
+	windows map[string]*authFailureWindow
+}
+
+type authFailureWindow struct {
+	start    time.Time
+	count    int
+	reported bool
+}
+
+var authFailures = &authFailureTracker{windows: make(map[string]*authFailureWindow)}
+
+// 记录一次认证失败，同时写入认证失败日志（-auth-log）
+func (t *authFailureTracker) record(ip, method, path, reason string) {
+	writeAuthLog(ip, method, path, reason)
+	if authBurstThreshold <= 0 {
+		return
+	}
+	ip = clientNetwork(ip)
+
+	now := time.Now()
+	t.mu.Lock()
+	// 顺带清理过期窗口，避免被大量不同IP撑大
+	for key, w := range t.windows {
+		if now.Sub(w.start) > authBurstWindow {
+			delete(t.windows, key)
+		}
+	}
+	w, ok := t.windows[ip]
+	if !ok {
+		w = &authFailureWindow{start: now}
+		t.windows[ip] = w
+	}
+	w.count++
+	burst := w.count >= authBurstThreshold && !w.reported
+	if burst {
+		w.reported = true
+	}
+	count := w.count
+	t.mu.Unlock()
+
+	if burst {
+		geo := lookupGeo(ip)
+		slog.Warn("authentication failure burst", append([]any{"client_ip", ip, "count", count, "window", authBurstWindow.String()}, geo.attrs()...)...)
+		data := map[string]any{
+			"client_ip": ip,
+			"count":     count,
+			"window":    authBurstWindow.String(),
+			"last_path": path,
+		}
+		if geo.Country != "" {
+			data["country"] = geo.Country
+		}
+		if geo.ASN != 0 {
+			data["asn"] = geo.ASN
+			data["as_org"] = geo.Org
+		}
+		events.publish(Event{Type: eventAuthFailureBurst, Data: data})
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 每个路由和方法对各种身份的预期结果：允许、403 或 401。
+// 路由表中的 Read、Write、View 是访问策略，修改它们或新增路由时需要同时更新这张表
+const (
+	ok     = http.StatusOK
+	deny   = http.StatusForbidden
+	unauth = http.StatusUnauthorized
+)
+
+type routeAuthCase struct {
+	pattern string
+	method  string
+	// 依次为 viewer、operator、admin 用户令牌，只读密钥，服务器API密钥，不带密钥
+	viewer, operator, admin, readOnly, server, none int
+}
+
+var routeAuthCases = []routeAuthCase{
+	{"/health", http.MethodGet, ok, ok, ok, ok, ok, ok},
+	{"/healthz", http.MethodGet, ok, ok, ok, ok, ok, ok},
+	{"/healthz", http.MethodHead, ok, ok, ok, ok, ok, ok},
+	{"/readyz", http.MethodGet, ok, ok, ok, ok, ok, ok},
+	{"/readyz", http.MethodHead, ok, ok, ok, ok, ok, ok},
+	{"/api/version", http.MethodGet, ok, ok, ok, ok, ok, unauth},
+	{"/api/version", http.MethodHead, ok, ok, ok, ok, ok, unauth},
+	{"/metrics", http.MethodGet, deny, deny, deny, ok, ok, unauth},
+	{"/api/devices/register", http.MethodPost, deny, ok, ok, deny, ok, unauth},
+	{"/api/wol/poll", http.MethodGet, deny, ok, ok, deny, ok, unauth},
+	{"/api/wol/ack", http.MethodPost, deny, ok, ok, deny, ok, unauth},
+	{"/api/devices/", http.MethodGet, ok, ok, ok, ok, ok, unauth},
+	{"/api/devices/", http.MethodPost, deny, ok, ok, deny, ok, unauth},
+	{"/api/agent/", http.MethodPost, deny, ok, ok, deny, ok, unauth},
+	{"/api/time", http.MethodGet, ok, ok, ok, deny, ok, unauth},
+	{"/api/time", http.MethodHead, ok, ok, ok, deny, ok, unauth},
+	{"/api/provision", http.MethodGet, ok, ok, ok, ok, ok, ok},
+	{"/api/firmware/manifest", http.MethodGet, deny, ok, ok, deny, ok, unauth},
+	{"/api/firmware/download/", http.MethodGet, deny, ok, ok, deny, ok, unauth},
+	{"/api/firmware/download/", http.MethodHead, deny, ok, ok, deny, ok, unauth},
+	{"/api/wol/send", http.MethodPost, deny, ok, ok, deny, ok, unauth},
+	{"/api/wol/bulk", http.MethodPost, deny, ok, ok, deny, ok, unauth},
+	{"/api/wol/bulk/", http.MethodGet, ok, ok, ok, ok, ok, unauth},
+	{"/api/wol/messages/", http.MethodGet, ok, ok, ok, ok, ok, unauth},
+	{"/api/wol/messages/", http.MethodPost, deny, ok, ok, deny, ok, unauth},
+	{"/api/wol/messages/", http.MethodDelete, deny, ok, ok, deny, ok, unauth},
+	{"/api/targets/power", http.MethodGet, deny, deny, deny, ok, ok, unauth},
+	{"/api/ha/targets", http.MethodGet, deny, deny, deny, ok, ok, unauth},
+	{"/api/ha/targets/", http.MethodGet, deny, deny, deny, ok, ok, unauth},
+	{"/api/ha/targets/", http.MethodPost, deny, deny, deny, deny, ok, unauth},
+	{"/api/alexa", http.MethodPost, deny, deny, deny, deny, ok, unauth},
+	{"/api/google/fulfillment", http.MethodPost, ok, ok, ok, ok, ok, ok},
+	{"/oauth/authorize", http.MethodGet, ok, ok, ok, ok, ok, ok},
+	{"/oauth/authorize", http.MethodPost, ok, ok, ok, ok, ok, ok},
+	{"/oauth/token", http.MethodPost, ok, ok, ok, ok, ok, ok},
+	{"/api/alertmanager", http.MethodPost, deny, deny, deny, deny, ok, unauth},
+	{"/hooks/", http.MethodPost, ok, ok, ok, ok, ok, ok},
+	{"/api/admin/events", http.MethodGet, deny, deny, deny, ok, ok, unauth},
+	{"/api/admin/ws", http.MethodGet, deny, deny, deny, ok, ok, unauth},
+	{"/api/stats", http.MethodGet, deny, deny, deny, ok, ok, unauth},
+	{"/api/stats/devices", http.MethodGet, ok, ok, ok, ok, ok, unauth},
+	{"/api/stats/history", http.MethodGet, ok, ok, ok, ok, ok, unauth},
+	{"/api/stats/wakes", http.MethodGet, ok, ok, ok, ok, ok, unauth},
+	{"/api/stats/energy", http.MethodGet, ok, ok, ok, ok, ok, unauth},
+	{"/api/stats/latency", http.MethodGet, ok, ok, ok, ok, ok, unauth},
+	{"/api/admin/devices", http.MethodGet, ok, ok, ok, ok, ok, unauth},
+	{"/api/admin/devices/", http.MethodPost, deny, deny, ok, deny, ok, unauth},
+	{"/api/admin/devices/", http.MethodPut, deny, deny, ok, deny, ok, unauth},
+	{"/api/admin/devices/", http.MethodDelete, deny, deny, ok, deny, ok, unauth},
+	{"/api/admin/neighbors", http.MethodGet, ok, ok, ok, ok, ok, unauth},
+	{"/api/admin/discovery", http.MethodGet, ok, ok, ok, ok, ok, unauth},
+	{"/api/admin/discovery", http.MethodPost, deny, deny, ok, deny, ok, unauth},
+	{"/api/admin/discovery/", http.MethodGet, ok, ok, ok, ok, ok, unauth},
+	{"/api/admin/discovery/", http.MethodPost, deny, deny, ok, deny, ok, unauth},
+	{"/api/admin/targets", http.MethodGet, ok, ok, ok, ok, ok, unauth},
+	{"/api/admin/targets", http.MethodPost, deny, deny, ok, deny, ok, unauth},
+	{"/api/admin/targets/", http.MethodGet, ok, ok, ok, ok, ok, unauth},
+	{"/api/admin/targets/", http.MethodPost, deny, deny, ok, deny, ok, unauth},
+	{"/api/admin/targets/", http.MethodPut, deny, deny, ok, deny, ok, unauth},
+	{"/api/admin/targets/", http.MethodDelete, deny, deny, ok, deny, ok, unauth},
+	{"/api/admin/agents", http.MethodGet, ok, ok, ok, ok, ok, unauth},
+	{"/api/admin/groups", http.MethodGet, deny, deny, deny, ok, ok, unauth},
+	{"/api/admin/groups", http.MethodPost, deny, deny, deny, deny, ok, unauth},
+	{"/api/admin/groups/", http.MethodGet, deny, deny, deny, ok, ok, unauth},
+	{"/api/admin/groups/", http.MethodPut, deny, deny, deny, deny, ok, unauth},
+	{"/api/admin/groups/", http.MethodDelete, deny, deny, deny, deny, ok, unauth},
+	{"/api/admin/schedules", http.MethodGet, ok, ok, ok, ok, ok, unauth},
+	{"/api/admin/schedules", http.MethodPost, deny, ok, ok, deny, ok, unauth},
+	{"/api/admin/schedules/", http.MethodGet, ok, ok, ok, ok, ok, unauth},
+	{"/api/admin/schedules/", http.MethodPut, deny, ok, ok, deny, ok, unauth},
+	{"/api/admin/schedules/", http.MethodDelete, deny, ok, ok, deny, ok, unauth},
+	{"/api/admin/wake-links", http.MethodGet, deny, deny, deny, deny, ok, unauth},
+	{"/api/admin/wake-links", http.MethodPost, deny, deny, deny, deny, ok, unauth},
+	{"/api/admin/wake-links/", http.MethodDelete, deny, deny, deny, deny, ok, unauth},
+	{"/api/admin/enrollments", http.MethodGet, deny, deny, deny, deny, ok, unauth},
+	{"/api/admin/enrollments", http.MethodPost, deny, deny, deny, deny, ok, unauth},
+	{"/api/admin/enrollments/", http.MethodDelete, deny, deny, deny, deny, ok, unauth},
+	{"/api/admin/firmware", http.MethodGet, deny, deny, deny, deny, ok, unauth},
+	{"/api/admin/firmware", http.MethodPost, deny, deny, deny, deny, ok, unauth},
+	{"/api/admin/firmware/", http.MethodGet, deny, deny, deny, deny, ok, unauth},
+	{"/api/admin/firmware/", http.MethodPut, deny, deny, deny, deny, ok, unauth},
+	{"/api/admin/firmware/", http.MethodDelete, deny, deny, deny, deny, ok, unauth},
+	{"/api/admin/oauth-grants", http.MethodGet, deny, deny, deny, deny, ok, unauth},
+	{"/api/admin/oauth-grants/", http.MethodDelete, deny, deny, deny, deny, ok, unauth},
+	{"/api/admin/users", http.MethodGet, deny, deny, deny, deny, ok, unauth},
+	{"/api/admin/users", http.MethodPost, deny, deny, deny, deny, ok, unauth},
+	{"/api/admin/users/", http.MethodGet, deny, deny, deny, deny, ok, unauth},
+	{"/api/admin/users/", http.MethodPost, deny, deny, deny, deny, ok, unauth},
+	{"/api/admin/users/", http.MethodPut, deny, deny, deny, deny, ok, unauth},
+	{"/api/admin/users/", http.MethodDelete, deny, deny, deny, deny, ok, unauth},
+	{"/api/admin/tokens", http.MethodGet, ok, ok, ok, deny, ok, unauth},
+	{"/api/admin/tokens", http.MethodPost, ok, ok, ok, deny, ok, unauth},
+	{"/api/admin/tokens/", http.MethodPut, ok, ok, ok, deny, ok, unauth},
+	{"/api/admin/tokens/", http.MethodDelete, ok, ok, ok, deny, ok, unauth},
+	{"/api/admin/long-polls", http.MethodGet, ok, ok, ok, ok, ok, unauth},
+	{"/api/admin/api-keys", http.MethodGet, deny, deny, deny, deny, ok, unauth},
+	{"/api/admin/api-keys", http.MethodPost, deny, deny, deny, deny, ok, unauth},
+	{"/api/admin/api-keys/", http.MethodPut, deny, deny, deny, deny, ok, unauth},
+	{"/api/admin/api-keys/", http.MethodDelete, deny, deny, deny, deny, ok, unauth},
+	{"/api/admin/purge", http.MethodPost, deny, deny, deny, deny, ok, unauth},
+	{"/api/admin/maintenance", http.MethodGet, ok, ok, ok, ok, ok, unauth},
+	{"/api/admin/maintenance", http.MethodPut, deny, deny, deny, deny, ok, unauth},
+	{"/api/admin/quota", http.MethodGet, ok, ok, ok, deny, ok, unauth},
+	{"/api/admin/orgs", http.MethodGet, ok, ok, ok, deny, ok, unauth},
+	{"/api/admin/orgs", http.MethodPost, deny, deny, deny, deny, ok, unauth},
+	{"/api/admin/orgs/", http.MethodGet, ok, ok, ok, deny, ok, unauth},
+	{"/api/admin/orgs/", http.MethodPut, deny, deny, deny, deny, ok, unauth},
+	{"/api/admin/orgs/", http.MethodDelete, deny, deny, deny, deny, ok, unauth},
+	{"/ui/", http.MethodGet, ok, ok, ok, ok, ok, ok},
+	{"/ui/", http.MethodHead, ok, ok, ok, ok, ok, ok},
+	{"/wake", http.MethodGet, ok, ok, ok, ok, ok, ok},
+}
+
+// 测试用的身份：三种角色的用户令牌、一个只读密钥和 -api-key
+var testCredentials = struct {
+	viewer, operator, admin, readOnly, server string
+}{
+	viewer:   "viewer-token-0001",
+	operator: "operator-token-0001",
+	admin:    "admin-token-0001",
+	readOnly: apiKeyPrefix + "readonly0001",
+	server:   "server-api-key-0001",
+}
+
+func setupAuthTest(t *testing.T) {
+	t.Helper()
+	oldStorage, oldKey, oldRoutes, oldLogger := storage, API_KEY, routes, slog.Default()
+	t.Cleanup(func() {
+		storage, API_KEY, routes = oldStorage, oldKey, oldRoutes
+		slog.SetDefault(oldLogger)
+	})
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	storage = NewSimpleStorage()
+	API_KEY = testCredentials.server
+	for name, token := range map[string]string{
+		"viewer":   testCredentials.viewer,
+		"operator": testCredentials.operator,
+		"admin":    testCredentials.admin,
+	} {
+		storage.users[name] = &User{
+			Name:      name,
+			Role:      name,
+			Tokens:    []*UserToken{{ID: "tok_" + name, Hash: hashToken(token), CreatedAt: time.Now()}},
+			CreatedAt: time.Now(),
+		}
+	}
+	storage.apiKeys["key_ro"] = &APIKey{ID: "key_ro", Label: "display", Hash: hashToken(testCredentials.readOnly), ReadOnly: true, CreatedAt: time.Now()}
+
+	// 只测试中间件，处理函数换成直接返回 200
+	routes = make([]route, len(oldRoutes))
+	for i, rt := range oldRoutes {
+		rt.Handler = func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) }
+		routes[i] = rt
+	}
+}
+
+func TestRouteAuth(t *testing.T) {
+	setupAuthTest(t)
+	mux := buildMux(listenerConfig{})
+
+	for _, tc := range routeAuthCases {
+		path := tc.pattern
+		if strings.HasSuffix(path, "/") {
+			path += "x"
+		}
+		for _, c := range []struct {
+			name string
+			key  string
+			want int
+		}{
+			{"viewer", testCredentials.viewer, tc.viewer},
+			{"operator", testCredentials.operator, tc.operator},
+			{"admin", testCredentials.admin, tc.admin},
+			{"read-only key", testCredentials.readOnly, tc.readOnly},
+			{"server key", testCredentials.server, tc.server},
+			{"no key", "", tc.none},
+		} {
+			req := httptest.NewRequest(tc.method, path, nil)
+			if c.key != "" {
+				req.Header.Set("X-API-Key", c.key)
+			}
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+			if rec.Code != c.want {
+				t.Errorf("%s %s as %s: got %d, want %d", tc.method, path, c.name, rec.Code, c.want)
+			}
+		}
+	}
+}
+
+// 路由表中的每个路由和方法都要在 routeAuthCases 中列出预期结果
+func TestRouteAuthCoverage(t *testing.T) {
+	covered := make(map[string]bool)
+	for _, tc := range routeAuthCases {
+		covered[tc.method+" "+tc.pattern] = true
+	}
+	listed := make(map[string]bool)
+	for _, rt := range routes {
+		for _, m := range rt.Methods {
+			key := m + " " + rt.Pattern
+			listed[key] = true
+			if !covered[key] {
+				t.Errorf("%s has no entry in routeAuthCases", key)
+			}
+		}
+	}
+	for key := range covered {
+		if !listed[key] {
+			t.Errorf("routeAuthCases lists %s, which is not in the route table", key)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 认证失败日志：-auth-log 设置后，每次认证失败另外写一行固定格式的记录，供 fail2ban、CrowdSec 等
+// 在防火墙上封禁暴力破解的地址。格式不随 -log-format 变化，字段顺序固定：
+//
+//	2024-01-02T15:04:05Z esp32-wol auth failure: client=203.0.113.5 method=GET path=/api/wol/poll reason=invalid_api_key
+//
+// client 为真实客户端地址（经 -trusted-proxies 解析），path 中的空白替换为下划线，不包含查询参数。
+// 开启 -geoip 时行尾另外附带查到的 country=<代码> 和 asn=<编号>
+
+// 认证失败原因
+const (
+	authReasonAPIKey     = "invalid_api_key"         // API密钥或用户令牌无效
+	authReasonHook       = "unknown_hook"            // 入站 Webhook 令牌不存在
+	authReasonOAuthKey   = "oauth_invalid_api_key"   // OAuth 授权页输入的API密钥不正确
+	authReasonOAuth      = "oauth_invalid_client"    // OAuth 客户端认证失败
+	authReasonEnrollment = "unknown_enrollment_code" // 注册码不存在
+)
+
+var authLog struct {
+	mu  sync.Mutex
+	out io.Writer // nil 表示未开启
+}
+
+// 设置认证失败日志的输出：文件路径，"-" 表示标准错误
+func openAuthLog(path string, o *serveOptions) (*rotatingFile, error) {
+	if path == "-" {
+		authLog.out = os.Stderr
+		return nil, nil
+	}
+	f, err := openRotatingFile(path, o.logMaxSize, o.logMaxAge, o.logMaxBackups, o.logCompress)
+	if err != nil {
+		return nil, err
+	}
+	authLog.out = f
+	return f, nil
+}
+
+var authLogSanitizer = strings.NewReplacer(" ", "_", "\t", "_", "\r", "_", "\n", "_")
+
+func writeAuthLog(ip, method, path, reason string) {
+	if authLog.out == nil {
+		return
+	}
+	if ip == "" {
+		ip = "unknown"
+	}
+	line := fmt.Sprintf("%s esp32-wol auth failure: client=%s method=%s path=%s reason=%s",
+		time.Now().UTC().Format(time.RFC3339), ip, authLogSanitizer.Replace(method), authLogSanitizer.Replace(path), reason)
+	geo := lookupGeo(ip)
+	if geo.Country != "" {
+		line += " country=" + geo.Country
+	}
+	if geo.ASN != 0 {
+		line += fmt.Sprintf(" asn=%d", geo.ASN)
+	}
+	line += "\n"
+	authLog.mu.Lock()
+	defer authLog.mu.Unlock()
+	io.WriteString(authLog.out, line)
+}
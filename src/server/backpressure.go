@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 背压：设备队列或全部待下发消息超过上限时拒绝新的唤醒请求，而不是无限堆积。
+// 单个设备队列满返回 409（需等中继取走消息），全局超限返回 429 并带 Retry-After
+
+// 上限（-max-queue-per-device、-max-pending），0 表示不限制
+var (
+	maxQueuePerDevice = 50
+	maxPendingTotal   = 10000
+)
+
+const (
+	backpressureDeviceQueue = "device_queue_full"
+	backpressurePending     = "pending_limit"
+)
+
+// 全局超限时建议客户端等待的时间
+const backpressureRetryAfter = 30 * time.Second
+
+// 同一个队列的背压事件最多每分钟发布一次
+const backpressureEventInterval = time.Minute
+
+func checkQueueLimits() error {
+	if maxQueuePerDevice < 0 || maxPendingTotal < 0 {
+		return errors.New("-max-queue-per-device and -max-pending must not be negative")
+	}
+	return nil
+}
+
+type backpressureError struct {
+	Reason   string
+	DeviceID string
+	Depth    int
+	Limit    int
+}
+
+func (e *backpressureError) Error() string {
+	if e.Reason == backpressureDeviceQueue {
+		return fmt.Sprintf("queue for device %s is full (%d/%d pending)", e.DeviceID, e.Depth, e.Limit)
+	}
+	return fmt.Sprintf("too many pending messages (%d/%d)", e.Depth, e.Limit)
+}
+
+func (e *backpressureError) status() int {
+	if e.Reason == backpressureDeviceQueue {
+		return http.StatusConflict
+	}
+	return http.StatusTooManyRequests
+}
+
+var backpressureTotal = newCounterVec("esp32_wol_backpressure_total",
+	"Wake requests rejected because a queue limit was reached.", "reason")
+
+var backpressureEvents = struct {
+	mu   sync.Mutex
+	last map[string]time.Time // 设备ID（全局为空字符串） -> 上次发布事件的时间
+}{last: make(map[string]time.Time)}
+
+// 设备队列或全局待下发消息数超限时返回 *backpressureError，不计数也不发布事件
+func queueLimitError(deviceID string) *backpressureError {
+	if maxQueuePerDevice > 0 {
+		if depth := queues.len(deviceID); depth >= maxQueuePerDevice {
+			return &backpressureError{Reason: backpressureDeviceQueue, DeviceID: deviceID, Depth: depth, Limit: maxQueuePerDevice}
+		}
+	}
+	if maxPendingTotal > 0 {
+		if total := queues.total(); total >= maxPendingTotal {
+			return &backpressureError{Reason: backpressurePending, Depth: total, Limit: maxPendingTotal}
+		}
+	}
+	return nil
+}
+
+// 检查设备队列和全局待下发消息数，超限时返回 *backpressureError。调用方持有 storage.mu
+func checkBackpressure(deviceID string) error {
+	err := queueLimitError(deviceID)
+	if err == nil {
+		return nil
+	}
+
+	backpressureTotal.add(1, err.Reason)
+	now := time.Now()
+	backpressureEvents.mu.Lock()
+	publish := now.Sub(backpressureEvents.last[err.DeviceID]) >= backpressureEventInterval
+	if publish {
+		backpressureEvents.last[err.DeviceID] = now
+	}
+	backpressureEvents.mu.Unlock()
+	if publish {
+		slog.Warn("backpressure engaged, rejecting wake requests", "reason", err.Reason, "device_id", err.DeviceID, "depth", err.Depth, "limit", err.Limit)
+		events.publish(Event{Type: eventQueueBackpressure, DeviceID: err.DeviceID, Data: map[string]any{
+			"reason": err.Reason,
+			"depth":  err.Depth,
+			"limit":  err.Limit,
+		}})
+	}
+	return err
+}
+
+// 背压错误写为结构化响应并返回 true，其他错误返回 false 由调用方处理
+func writeBackpressure(w http.ResponseWriter, err error) bool {
+	var bp *backpressureError
+	if !errors.As(err, &bp) {
+		return false
+	}
+	resp := map[string]any{
+		"success": false,
+		"error":   bp.Reason,
+		"message": bp.Error(),
+		"depth":   bp.Depth,
+		"limit":   bp.Limit,
+	}
+	if bp.DeviceID != "" {
+		resp["device_id"] = bp.DeviceID
+	}
+	if bp.status() == http.StatusTooManyRequests {
+		w.Header().Set("Retry-After", strconv.Itoa(int(backpressureRetryAfter.Seconds())))
+	}
+	writeJSON(w, bp.status(), resp)
+	return true
+}
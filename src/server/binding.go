@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"time"
+)
+
+// 设备身份绑定：所有设备共用服务器API密钥时，知道密钥和设备ID就能冒充设备（轮询走它的唤醒指令、伪造确认）。
+// 开启 -device-binding 后，设备第一次出现时记录它的传输层身份，之后同一设备ID的请求必须来自同一身份：
+//   - cert：HTTPS 监听器设置了 client_ca 且设备出示了受信任的客户端证书时，为证书的 SHA-256 指纹
+//   - token：设备使用用户令牌或管理的API密钥（apikeys.go）时，为令牌或密钥ID
+//   - network：其他情况下为客户端地址所在的网段（IPv4 按 -device-binding-prefix，IPv6 按 -ipv6-client-prefix）
+//
+// 设备更换网络或证书后，管理员删除绑定（DELETE /api/admin/devices/<id>/binding），设备下次请求时重新绑定
+
+const (
+	bindingOff     = "off"
+	bindingLog     = "log"     // 只记录不一致，不拒绝请求
+	bindingEnforce = "enforce" // 拒绝身份不一致的请求
+)
+
+const (
+	bindingCert    = "cert"
+	bindingToken   = "token"
+	bindingNetwork = "network"
+)
+
+var (
+	deviceBindingMode   = bindingOff
+	deviceBindingPrefix = 24
+)
+
+var errDeviceIdentity = errors.New("device identity mismatch")
+
+// 设备绑定的身份
+type DeviceBinding struct {
+	Kind    string    `json:"kind"` // cert、token 或 network
+	Value   string    `json:"value"`
+	BoundAt time.Time `json:"bound_at"`
+}
+
+func checkBindingSettings() error {
+	switch deviceBindingMode {
+	case bindingOff, bindingLog, bindingEnforce:
+	default:
+		return fmt.Errorf("-device-binding must be %s, %s or %s", bindingOff, bindingLog, bindingEnforce)
+	}
+	if deviceBindingPrefix < 8 || deviceBindingPrefix > 32 {
+		return fmt.Errorf("-device-binding-prefix must be between 8 and 32")
+	}
+	return nil
+}
+
+// 请求的传输层身份，优先使用最强的一种
+func requestIdentity(r *http.Request) (kind, value string) {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		sum := sha256.Sum256(r.TLS.PeerCertificates[0].Raw)
+		return bindingCert, hex.EncodeToString(sum[:])
+	}
+	if p := requestPrincipal(r); p.token != "" {
+		return bindingToken, p.token
+	}
+	ip := clientIP(r)
+	if addr, err := netip.ParseAddr(ip); err == nil && addr.Is4() {
+		if prefix, err := addr.Prefix(deviceBindingPrefix); err == nil {
+			return bindingNetwork, prefix.String()
+		}
+	}
+	return bindingNetwork, clientNetwork(ip)
+}
+
+// 校验设备请求的身份：未绑定时绑定到本次请求的身份，不一致时记录警告并发布事件，
+// enforce 模式下返回 errDeviceIdentity。调用方持有 storage.mu 写锁
+func verifyDeviceIdentity(r *http.Request, device *Device) error {
+	if deviceBindingMode == bindingOff {
+		return nil
+	}
+	kind, value := requestIdentity(r)
+	if device.Binding == nil {
+		device.Binding = &DeviceBinding{Kind: kind, Value: value, BoundAt: time.Now()}
+		replicateDevice(device)
+		markDirty()
+		requestLogger(r).Info("device bound to identity", "device_id", device.ID, "kind", kind, "value", value)
+		return nil
+	}
+	if device.Binding.Kind == kind && device.Binding.Value == value {
+		return nil
+	}
+	enforced := deviceBindingMode == bindingEnforce
+	requestLogger(r).Warn("device identity mismatch", "device_id", device.ID, "path", r.URL.Path, "remote_addr", clientIP(r),
+		"bound_kind", device.Binding.Kind, "bound_value", device.Binding.Value, "kind", kind, "value", value, "rejected", enforced)
+	events.publish(Event{Type: eventDeviceIdentityMismatch, DeviceID: device.ID, Data: map[string]any{
+		"kind": kind, "value": value, "bound_kind": device.Binding.Kind, "bound_value": device.Binding.Value,
+		"remote_addr": clientIP(r), "rejected": enforced,
+	}})
+	if enforced {
+		return errDeviceIdentity
+	}
+	return nil
+}
+
+// 设备上报接口的身份校验，不通过时写出错误响应并返回 false
+func verifyDeviceRequest(w http.ResponseWriter, r *http.Request, deviceID string) bool {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	device, exists := storage.devices[deviceID]
+	if exists && verifyDeviceIdentity(r, device) != nil {
+		writeIdentityMismatch(w)
+		return false
+	}
+	return true
+}
+
+func writeIdentityMismatch(w http.ResponseWriter) {
+	writeJSON(w, http.StatusForbidden, map[string]interface{}{
+		"success": false,
+		"error":   "device_identity_mismatch",
+		"message": "This device is bound to a different client identity; ask an administrator to reset the binding",
+	})
+}
+
+// DELETE /api/admin/devices/{id}/binding：删除设备的身份绑定，设备下次请求时重新绑定
+func resetDeviceBinding(w http.ResponseWriter, r *http.Request, deviceID string) {
+	storage.mu.Lock()
+	device, exists := storage.devices[deviceID]
+	if !exists {
+		storage.mu.Unlock()
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+	previous := device.Binding
+	device.Binding = nil
+	replicateDevice(device)
+	storage.mu.Unlock()
+
+	if previous != nil {
+		markDirty()
+		requestLogger(r).Info("device binding reset", "device_id", deviceID, "kind", previous.Kind, "value", previous.Value,
+			"by", principalName(requestPrincipal(r)))
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"message": "Device binding reset, the device will be bound again on its next request",
+	})
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 批量唤醒：上传一组目标MAC地址（CSV 或 JSON 数组，可附带负责的中继设备），逐行检查后入队，
+// 整批使用同一个任务ID，响应和任务查询都给出每一行的结果。适合机房、教室一次唤醒几十台电脑。
+// 未指定设备的行按MAC地址查找可以唤醒的命名目标，由目标决定中继。
+// 任务只保存在内存中，保留最近 maxBulkJobs 个
+
+const (
+	maxBulkRows = 500
+	maxBulkJobs = 50
+)
+
+// 每一行的状态：invalid（检查未通过）、rejected（入队被拒绝，例如冷却或配额），
+// 入队后为消息的状态（queued、pending_approval、acked 等）
+const (
+	bulkRowInvalid  = "invalid"
+	bulkRowRejected = "rejected"
+)
+
+// 上传的一行
+type bulkWakeInput struct {
+	TargetMAC string `json:"target_mac"`
+	DeviceID  string `json:"device_id"` // 负责发送魔术包的中继，可选
+	line      int
+}
+
+type BulkWakeRow struct {
+	Row       int    `json:"row"` // CSV 为文件中的行号，JSON 为数组下标（从1开始）
+	TargetMAC string `json:"target_mac"`
+	DeviceID  string `json:"device_id,omitempty"`
+	Target    string `json:"target,omitempty"`
+	Status    string `json:"status"`
+	MessageID string `json:"message_id,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+type BulkWakeJob struct {
+	ID        string        `json:"id"`
+	Source    string        `json:"source"`
+	CreatedAt time.Time     `json:"created_at"`
+	Queued    int           `json:"queued"` // 入队（包括等待审批）的行数
+	Rows      []BulkWakeRow `json:"rows"`
+}
+
+var bulkJobs = struct {
+	mu    sync.Mutex
+	jobs  map[string]*BulkWakeJob
+	order []string
+}{jobs: make(map[string]*BulkWakeJob)}
+
+func saveBulkJob(job *BulkWakeJob) {
+	bulkJobs.mu.Lock()
+	defer bulkJobs.mu.Unlock()
+	bulkJobs.jobs[job.ID] = job
+	bulkJobs.order = append(bulkJobs.order, job.ID)
+	for len(bulkJobs.order) > maxBulkJobs {
+		delete(bulkJobs.jobs, bulkJobs.order[0])
+		bulkJobs.order = bulkJobs.order[1:]
+	}
+}
+
+// 解析上传的行：Content-Type 为 text/csv 或 application/json，其他类型按内容判断（以 [ 开头为 JSON）
+func readBulkRows(w http.ResponseWriter, r *http.Request) ([]bulkWakeInput, bool) {
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeJSONError(w, describeJSONError(err))
+		return nil, false
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	isJSON := mediaType == "application/json"
+	if mediaType != "text/csv" && !isJSON {
+		isJSON = bytes.HasPrefix(bytes.TrimSpace(data), []byte("["))
+	}
+
+	var rows []bulkWakeInput
+	if isJSON {
+		r.Body = io.NopCloser(bytes.NewReader(data))
+		if !readJSON(w, r, &rows) {
+			return nil, false
+		}
+		for i := range rows {
+			rows[i].line = i + 1
+		}
+	} else if rows, err = parseBulkCSV(data); err != nil {
+		writeJSONError(w, &jsonBodyError{Code: "invalid_csv", Message: err.Error(), Status: http.StatusBadRequest})
+		return nil, false
+	}
+
+	switch {
+	case len(rows) == 0:
+		writeJSONError(w, &jsonBodyError{Code: jsonErrorEmpty, Message: "no rows to wake", Status: http.StatusBadRequest})
+		return nil, false
+	case len(rows) > maxBulkRows:
+		writeJSONError(w, &jsonBodyError{Code: "too_many_rows", Message: fmt.Sprintf("at most %d rows per request, got %d", maxBulkRows, len(rows)), Status: http.StatusBadRequest})
+		return nil, false
+	}
+	return rows, true
+}
+
+// CSV：每行 target_mac[,device_id]，# 开头的行为注释，首行为表头时跳过
+func parseBulkCSV(data []byte) ([]bulkWakeInput, error) {
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	var rows []bulkWakeInput
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := reader.FieldPos(0)
+		if len(record) > 2 {
+			return nil, fmt.Errorf("line %d: expected target_mac[,device_id], got %d fields", line, len(record))
+		}
+		if len(rows) == 0 && strings.EqualFold(strings.TrimSpace(record[0]), "target_mac") {
+			continue
+		}
+		row := bulkWakeInput{TargetMAC: strings.TrimSpace(record[0]), line: line}
+		if len(record) == 2 {
+			row.DeviceID = strings.TrimSpace(record[1])
+		}
+		rows = append(rows, row)
+	}
+}
+
+// 检查一行并解析为唤醒请求，失败时返回原因。调用方持有 storage.mu
+func resolveBulkRow(p principal, in bulkWakeInput, source string) (wakeRequest, error) {
+	mac, err := normalizeMAC(in.TargetMAC)
+	if err != nil {
+		return wakeRequest{}, err
+	}
+	// 用户可以唤醒的、MAC地址相同的目标，按名称排序
+	var targets []*Target
+	for _, t := range storage.targets {
+		if t.MacAddress == mac && (in.DeviceID == "" || t.DeviceID == in.DeviceID) && p.canWakeTarget(t) {
+			targets = append(targets, t)
+		}
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i].Name < targets[j].Name })
+
+	if in.DeviceID == "" {
+		var devices []string
+		for _, t := range targets {
+			if !slices.Contains(devices, t.DeviceID) {
+				devices = append(devices, t.DeviceID)
+			}
+		}
+		switch len(devices) {
+		case 0:
+			return wakeRequest{}, errors.New("no target with this MAC address, set device_id")
+		case 1:
+		default:
+			return wakeRequest{}, fmt.Errorf("MAC address is reachable through several devices (%s), set device_id", strings.Join(devices, ", "))
+		}
+	}
+	if len(targets) > 0 {
+		t := targets[0]
+		return wakeRequest{DeviceID: t.DeviceID, TargetMAC: mac, Target: t.Name, Source: source, Owner: t.Owner}, nil
+	}
+	if _, exists := storage.devices[in.DeviceID]; !exists || !p.owns(deviceOwner(in.DeviceID)) {
+		return wakeRequest{}, fmt.Errorf("device %q not found", in.DeviceID)
+	}
+	return wakeRequest{DeviceID: in.DeviceID, TargetMAC: mac, Source: source}, nil
+}
+
+// POST /api/wol/bulk
+func bulkWakeHandler(w http.ResponseWriter, r *http.Request) {
+	rows, ok := readBulkRows(w, r)
+	if !ok {
+		return
+	}
+	if rejectDuringMaintenance(w) {
+		return
+	}
+	p := requestPrincipal(r)
+	source := principalName(p)
+	job := &BulkWakeJob{
+		ID:        fmt.Sprintf("bulk_%d", time.Now().UnixNano()),
+		Source:    source,
+		CreatedAt: time.Now().UTC(),
+		Rows:      make([]BulkWakeRow, len(rows)),
+	}
+
+	// 先逐行检查，同一MAC地址只唤醒一次
+	wakes := make([]*wakeRequest, len(rows))
+	seen := make(map[string]int)
+	storage.mu.RLock()
+	for i, in := range rows {
+		row := &job.Rows[i]
+		*row = BulkWakeRow{Row: in.line, TargetMAC: in.TargetMAC, DeviceID: in.DeviceID}
+		wake, err := resolveBulkRow(p, in, source)
+		if err == nil {
+			if first, dup := seen[wake.TargetMAC]; dup {
+				err = fmt.Errorf("duplicate of row %d", first)
+			}
+		}
+		if err != nil {
+			row.Status, row.Error = bulkRowInvalid, err.Error()
+			continue
+		}
+		seen[wake.TargetMAC] = in.line
+		row.TargetMAC, row.DeviceID, row.Target = wake.TargetMAC, wake.DeviceID, wake.Target
+		wakes[i] = &wake
+	}
+	storage.mu.RUnlock()
+
+	logger := requestLogger(r).With("job_id", job.ID)
+	for i, wake := range wakes {
+		if wake == nil {
+			continue
+		}
+		row := &job.Rows[i]
+		if err := reserveWake(p); err != nil {
+			row.Status, row.Error = bulkRowRejected, err.Error()
+			continue
+		}
+		message, err := queueWake(logger, *wake)
+		if err != nil {
+			refundWake(p)
+			row.Status, row.Error = bulkRowRejected, err.Error()
+			continue
+		}
+		row.Status, row.MessageID = message.Status, message.ID
+		job.Queued++
+	}
+	saveBulkJob(job)
+	logger.Info("bulk wake queued", "rows", len(rows), "queued", job.Queued)
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success": job.Queued == len(rows),
+		"job_id":  job.ID,
+		"queued":  job.Queued,
+		"rows":    job.Rows,
+		"message": fmt.Sprintf("%d of %d WOL messages queued", job.Queued, len(rows)),
+	})
+}
+
+// GET /api/wol/bulk/{id}：任务及每一行消息的当前状态。只有发起者和管理员可以查看
+func bulkJobHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/api/wol/bulk/")
+	p := requestPrincipal(r)
+	bulkJobs.mu.Lock()
+	job, exists := bulkJobs.jobs[id]
+	var view BulkWakeJob
+	if exists {
+		view = *job
+		view.Rows = slices.Clone(job.Rows)
+	}
+	bulkJobs.mu.Unlock()
+	if !exists || (!p.admin() && view.Source != principalName(p)) {
+		http.Error(w, "Bulk wake job not found", http.StatusNotFound)
+		return
+	}
+
+	storage.mu.RLock()
+	for i := range view.Rows {
+		if m, ok := storage.messages[view.Rows[i].MessageID]; ok {
+			view.Rows[i].Status, view.Rows[i].Error = m.Status, m.Error
+		}
+	}
+	storage.mu.RUnlock()
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"job":     view,
+	})
+}
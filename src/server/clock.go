@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+// 设备上报的时间戳（确认消息的处理时间、WiFi扫描时间等）。中继的RTC可能没有校时或走时不准，
+// 与服务器时间相差超过 -max-clock-skew 时不采用，改用服务器收到请求的时间，避免打乱历史记录的顺序。
+// 保存的时间统一转为UTC
+
+var maxClockSkew = 5 * time.Minute
+
+// 因超出容差而被替换的设备时间戳数量
+var clockSkewRejected atomic.Int64
+
+func checkClockSkew() error {
+	if maxClockSkew <= 0 {
+		return errors.New("-max-clock-skew must be positive")
+	}
+	return nil
+}
+
+// 校验设备上报的时间，返回应保存的时间（UTC）和设备时钟是否超出容差，未上报时返回服务器时间。
+// 同时在设备上记录时钟偏差，调用方需持有 storage.mu
+func deviceTimestamp(deviceID string, reported time.Time) (time.Time, bool) {
+	now := time.Now().UTC()
+	if reported.IsZero() {
+		return now, false
+	}
+	offset := reported.Sub(now)
+	if device, exists := storage.devices[deviceID]; exists {
+		device.ClockOffset = int64(offset.Round(time.Second) / time.Second)
+	}
+	if offset > maxClockSkew || offset < -maxClockSkew {
+		clockSkewRejected.Add(1)
+		slog.Warn("device clock out of tolerance, using server time", "device_id", deviceID,
+			"reported", reported, "offset", offset.Round(time.Second), "max_skew", maxClockSkew)
+		return now, true
+	}
+	return reported.UTC(), false
+}
@@ -0,0 +1,616 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 多副本部署：配置 redis 后，设备消息队列保存在 Redis 列表中，新消息通过 pub/sub
+// 通知所有副本，长轮询在任意副本上都能收到发往其他副本的唤醒请求。
+// 设备在线状态和消息状态的变更也通过同一频道同步到其他副本的内存中；
+// 设备运行计数、事件流和通知只记录本副本处理的请求
+
+// Redis 配置
+type RedisConfig struct {
+	Addr     string `json:"addr"` // host:6379，rediss://host:6380 使用TLS
+	Password string `json:"password"`
+	DB       int    `json:"db"`
+	Prefix   string `json:"prefix"` // 键和频道前缀，默认 esp32-wol:
+}
+
+// 订阅断开期间可能错过新消息通知，长轮询在集群模式下额外定期检查队列
+const clusterRecheckInterval = 5 * time.Second
+
+type clusterSync struct {
+	redis   *redisClient
+	prefix  string
+	replica string
+	updates chan clusterUpdate
+	stop    chan struct{}
+	done    chan struct{}
+
+	electionDone chan struct{} // 高可用模式下选举协程退出时关闭
+
+	mu         sync.Mutex
+	subscribed bool
+	lastErr    string
+	lastErrAt  time.Time
+	leaderID   string    // 当前主副本，高可用模式使用
+	renewedAt  time.Time // 本副本最近一次取得或续期租约的时间
+
+	pendingTotal int       // 缓存的全部队列消息数
+	pendingAt    time.Time // pendingTotal 的统计时间
+}
+
+// 集群模式下非 nil
+var cluster *clusterSync
+
+// 副本之间同步的变更
+type clusterUpdate struct {
+	Replica  string       `json:"replica"`
+	Kind     string       `json:"kind"` // notify、device、device_deleted、message、power、state、release
+	DeviceID string       `json:"device_id,omitempty"`
+	Device   *Device      `json:"device,omitempty"`
+	Message  *WOLMessage  `json:"message,omitempty"`
+	Power    *TargetPower `json:"power,omitempty"`
+}
+
+const (
+	clusterNotify        = "notify"
+	clusterDevice        = "device"
+	clusterDeviceDeleted = "device_deleted"
+	clusterMessage       = "message"
+	clusterPower         = "power"   // 主副本的开机状态检测结果
+	clusterState         = "state"   // 共享状态已更新（高可用模式）
+	clusterRelease       = "release" // 让设备的长轮询立即返回
+)
+
+func newCluster(cfg *RedisConfig) (*clusterSync, error) {
+	if cfg.Addr == "" {
+		return nil, errors.New("redis addr is required")
+	}
+	client, err := newRedisClient(cfg.Addr, cfg.Password, cfg.DB)
+	if err != nil {
+		return nil, err
+	}
+	id := make([]byte, 6)
+	rand.Read(id)
+	return &clusterSync{
+		redis:   client,
+		prefix:  firstNonEmpty(cfg.Prefix, "esp32-wol:"),
+		replica: hex.EncodeToString(id),
+		updates: make(chan clusterUpdate, 1024),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+
+		electionDone: make(chan struct{}),
+	}, nil
+}
+
+func (c *clusterSync) channel() string { return c.prefix + "updates" }
+
+func (c *clusterSync) devicesKey() string { return c.prefix + "devices" }
+
+func (c *clusterSync) queueKey(deviceID string) string { return c.prefix + "queue:" + deviceID }
+
+// 所有设备的处理中消息：有序集合，分数为确认期限（Unix毫秒），成员为消息JSON
+func (c *clusterSync) inflightKey() string { return c.prefix + "inflight" }
+
+// 原子地取出队列并移入处理中集合；ARGV[1] 为 0 时不保留（不重发）
+const clusterLeaseScript = `local items = redis.call("lrange", KEYS[1], 0, -1)
+local limit = tonumber(ARGV[2])
+local types = {}
+for i = 3, #ARGV do types[ARGV[i]] = true end
+local taken, kept, remaining = {}, {}, 0
+for _, item in ipairs(items) do
+	local match = #ARGV < 3
+	if not match then
+		local t = cjson.decode(item)["type"]
+		if t == nil or t == "" then t = "wake" end
+		match = types[t] == true
+	end
+	if match and (limit == 0 or #taken < limit) then
+		table.insert(taken, item)
+	else
+		if match then remaining = remaining + 1 end
+		table.insert(kept, item)
+	end
+end
+redis.call("del", KEYS[1])
+for _, item in ipairs(kept) do redis.call("rpush", KEYS[1], item) end
+if tonumber(ARGV[1]) > 0 then
+	for _, item in ipairs(taken) do redis.call("zadd", KEYS[2], ARGV[1], item) end
+end
+table.insert(taken, 1, remaining)
+return taken`
+
+// 连接 Redis，载入其他副本已知的设备，并开始订阅和发布
+func (c *clusterSync) start() error {
+	if _, err := c.redis.do("PING"); err != nil {
+		return err
+	}
+	reply, err := c.redis.do("HGETALL", c.devicesKey())
+	if err != nil {
+		return err
+	}
+	items, _ := reply.([]any)
+	loaded := 0
+	for i := 0; i+1 < len(items); i += 2 {
+		data, _ := items[i+1].([]byte)
+		var d Device
+		if json.Unmarshal(data, &d) == nil && d.ID != "" {
+			c.applyDevice(&d)
+			loaded++
+		}
+	}
+	slog.Info("cluster sync started", "redis", c.redis.addr, "replica", c.replica, "devices_loaded", loaded)
+
+	go c.redis.subscribe(c.channel(), c.stop, c.onSubscribe, c.onSubscribeError, c.apply)
+	go c.runPublisher()
+	if haEnabled {
+		go c.runElection()
+	} else {
+		close(c.electionDone)
+	}
+	return nil
+}
+
+// 停止订阅和选举（释放主副本租约），发出尚未发送的变更后关闭连接
+func (c *clusterSync) close() {
+	close(c.stop)
+	<-c.done
+	<-c.electionDone
+	c.redis.close()
+}
+
+func (c *clusterSync) onSubscribe() {
+	c.mu.Lock()
+	c.subscribed = true
+	c.mu.Unlock()
+	// 重新订阅后唤醒本副本所有等待中的长轮询，检查断线期间入队的消息
+	queues.notifyAll()
+}
+
+func (c *clusterSync) onSubscribeError(err error) {
+	c.mu.Lock()
+	c.subscribed = false
+	c.mu.Unlock()
+	c.recordError("subscribe", err)
+}
+
+func (c *clusterSync) recordError(op string, err error) {
+	slog.Warn("redis operation failed", "op", op, "error", err)
+	c.mu.Lock()
+	c.lastErr = fmt.Sprintf("%s: %v", op, err)
+	c.lastErrAt = time.Now()
+	c.mu.Unlock()
+}
+
+func (c *clusterSync) check() ComponentHealth {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.subscribed {
+		return ComponentHealth{Status: healthDown, Detail: firstNonEmpty(c.lastErr, "not subscribed")}
+	}
+	if c.lastErr != "" && time.Since(c.lastErrAt) < time.Minute {
+		return ComponentHealth{Status: healthDegraded, Detail: c.lastErr}
+	}
+	return ComponentHealth{Status: healthOK, Detail: "replica " + c.replica}
+}
+
+// 消息入队并通知其他副本
+func (c *clusterSync) push(deviceID string, message *WOLMessage) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	notify, _ := json.Marshal(clusterUpdate{Replica: c.replica, Kind: clusterNotify, DeviceID: deviceID})
+	_, err = c.redis.pipeline(
+		[]string{"RPUSH", c.queueKey(deviceID), string(data)},
+		[]string{"PUBLISH", c.channel(), string(notify)},
+	)
+	if err != nil {
+		c.recordError("push", err)
+	}
+	return err
+}
+
+// 原子地取出队列中符合轮询条件的消息准备下发，其余消息按原顺序留在队列中
+func (c *clusterSync) lease(deviceID string, f pollFilter) ([]*WOLMessage, int) {
+	var deadline int64
+	if ackTimeout > 0 {
+		deadline = time.Now().Add(ackTimeout).UnixMilli()
+	}
+	args := []string{"EVAL", clusterLeaseScript, "2", c.queueKey(deviceID), c.inflightKey(), strconv.FormatInt(deadline, 10), strconv.Itoa(f.max)}
+	for t := range f.types {
+		args = append(args, t)
+	}
+	reply, err := c.redis.do(args...)
+	if err != nil {
+		c.recordError("lease", err)
+		return nil, 0
+	}
+	items, _ := reply.([]any)
+	if len(items) == 0 {
+		return nil, 0
+	}
+	remaining, _ := items[0].(int64)
+	return decodeQueued(deviceID, items[1:]), int(remaining)
+}
+
+// 解码队列中的消息JSON，跳过无法解析的项
+func decodeQueued(deviceID string, items []any) []*WOLMessage {
+	messages := make([]*WOLMessage, 0, len(items))
+	for _, item := range items {
+		data, _ := item.([]byte)
+		message := &WOLMessage{}
+		if err := json.Unmarshal(data, message); err != nil {
+			slog.Warn("dropping malformed queued message", "device_id", deviceID, "error", err)
+			continue
+		}
+		messages = append(messages, message)
+	}
+	return messages
+}
+
+// 从处理中集合删除符合条件的消息；ZREM 成功的副本负责处理，多个副本同时清理时不会重复
+func (c *clusterSync) removeInflight(op string, match func(member []byte, m *WOLMessage) bool) []*WOLMessage {
+	reply, err := c.redis.do("ZRANGE", c.inflightKey(), "0", "-1", "WITHSCORES")
+	if err != nil {
+		c.recordError(op, err)
+		return nil
+	}
+	items, _ := reply.([]any)
+	var removed []*WOLMessage
+	for i := 0; i+1 < len(items); i += 2 {
+		data, _ := items[i].([]byte)
+		score, _ := items[i+1].([]byte)
+		message := &WOLMessage{}
+		if json.Unmarshal(data, message) != nil || !match(score, message) {
+			continue
+		}
+		reply, err := c.redis.do("ZREM", c.inflightKey(), string(data))
+		if err != nil {
+			c.recordError(op, err)
+			return removed
+		}
+		if n, _ := reply.(int64); n > 0 {
+			removed = append(removed, message)
+		}
+	}
+	return removed
+}
+
+func (c *clusterSync) ack(deviceID, messageID string) bool {
+	return len(c.removeInflight("ack", func(_ []byte, m *WOLMessage) bool {
+		return m.DeviceID == deviceID && m.ID == messageID
+	})) > 0
+}
+
+func (c *clusterSync) expired(now time.Time) map[string][]*WOLMessage {
+	result := make(map[string][]*WOLMessage)
+	for _, m := range c.removeInflight("expire", func(score []byte, _ *WOLMessage) bool {
+		deadline, _ := strconv.ParseFloat(string(score), 64)
+		return int64(deadline) < now.UnixMilli()
+	}) {
+		result[m.DeviceID] = append(result[m.DeviceID], m)
+	}
+	return result
+}
+
+func (c *clusterSync) dropInflight(deviceID string) []*WOLMessage {
+	return c.removeInflight("drop", func(_ []byte, m *WOLMessage) bool { return m.DeviceID == deviceID })
+}
+
+// 未确认的消息放回队首
+func (c *clusterSync) requeue(deviceID string, message *WOLMessage) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	notify, _ := json.Marshal(clusterUpdate{Replica: c.replica, Kind: clusterNotify, DeviceID: deviceID})
+	_, err = c.redis.pipeline(
+		[]string{"LPUSH", c.queueKey(deviceID), string(data)},
+		[]string{"PUBLISH", c.channel(), string(notify)},
+	)
+	if err != nil {
+		c.recordError("requeue", err)
+	}
+	return err
+}
+
+// 原子地取出队列中的全部消息
+func (c *clusterSync) take(deviceID string) []*WOLMessage {
+	key := c.queueKey(deviceID)
+	replies, err := c.redis.pipeline(
+		[]string{"MULTI"},
+		[]string{"LRANGE", key, "0", "-1"},
+		[]string{"DEL", key},
+		[]string{"EXEC"},
+	)
+	if err != nil {
+		c.recordError("take", err)
+		return nil
+	}
+	results, _ := replies[3].([]any)
+	if len(results) == 0 {
+		return nil
+	}
+	items, _ := results[0].([]any)
+	return decodeQueued(deviceID, items)
+}
+
+func (c *clusterSync) length(deviceID string) int {
+	reply, err := c.redis.do("LLEN", c.queueKey(deviceID))
+	if err != nil {
+		c.recordError("length", err)
+		return 0
+	}
+	n, _ := reply.(int64)
+	return int(n)
+}
+
+// 从队列中删除指定消息；消息已被其他副本取走时返回 false
+func (c *clusterSync) remove(deviceID, messageID string) bool {
+	key := c.queueKey(deviceID)
+	reply, err := c.redis.do("LRANGE", key, "0", "-1")
+	if err != nil {
+		c.recordError("remove", err)
+		return false
+	}
+	items, _ := reply.([]any)
+	for _, item := range items {
+		data, _ := item.([]byte)
+		var message WOLMessage
+		if json.Unmarshal(data, &message) != nil || message.ID != messageID {
+			continue
+		}
+		reply, err := c.redis.do("LREM", key, "1", string(data))
+		if err != nil {
+			c.recordError("remove", err)
+			return false
+		}
+		removed, _ := reply.(int64)
+		return removed > 0
+	}
+	return false
+}
+
+// 所有设备的队列长度
+// 全部队列中的消息总数，缓存 clusterRecheckInterval，避免每次唤醒都扫描 Redis
+func (c *clusterSync) total() int {
+	c.mu.Lock()
+	if time.Since(c.pendingAt) < clusterRecheckInterval {
+		defer c.mu.Unlock()
+		return c.pendingTotal
+	}
+	c.mu.Unlock()
+	total := 0
+	for _, depth := range c.depths() {
+		total += depth
+	}
+	c.mu.Lock()
+	c.pendingTotal, c.pendingAt = total, time.Now()
+	c.mu.Unlock()
+	return total
+}
+
+func (c *clusterSync) depths() map[string]int {
+	depths := make(map[string]int)
+	cursor := "0"
+	for {
+		reply, err := c.redis.do("SCAN", cursor, "MATCH", c.queueKey("*"), "COUNT", "200")
+		if err != nil {
+			c.recordError("scan", err)
+			return depths
+		}
+		parts, _ := reply.([]any)
+		if len(parts) != 2 {
+			return depths
+		}
+		next, _ := parts[0].([]byte)
+		keys, _ := parts[1].([]any)
+		if len(keys) > 0 {
+			cmds := make([][]string, len(keys))
+			for i, key := range keys {
+				k, _ := key.([]byte)
+				cmds[i] = []string{"LLEN", string(k)}
+			}
+			lengths, err := c.redis.pipeline(cmds...)
+			if err != nil {
+				c.recordError("scan", err)
+				return depths
+			}
+			for i, key := range keys {
+				k, _ := key.([]byte)
+				n, _ := lengths[i].(int64)
+				depths[strings.TrimPrefix(string(k), c.queueKey(""))] = int(n)
+			}
+		}
+		cursor = string(next)
+		if cursor == "0" {
+			return depths
+		}
+	}
+}
+
+// 把设备状态同步到其他副本。调用方持有 storage.mu，只复制不阻塞
+func replicateDevice(d *Device) {
+	if cluster == nil {
+		return
+	}
+	copied := *d
+	copied.Stats = DeviceStats{}
+	cluster.enqueue(clusterUpdate{Kind: clusterDevice, DeviceID: d.ID, Device: &copied})
+}
+
+func replicateDeviceDeleted(deviceID string) {
+	if cluster == nil {
+		return
+	}
+	cluster.enqueue(clusterUpdate{Kind: clusterDeviceDeleted, DeviceID: deviceID})
+}
+
+// 把开机状态检测结果同步到其他副本
+func replicatePower(p *TargetPower) {
+	if cluster == nil {
+		return
+	}
+	copied := *p
+	cluster.enqueue(clusterUpdate{Kind: clusterPower, Power: &copied})
+}
+
+// 把消息状态同步到其他副本。调用方持有 storage.mu
+func replicateMessage(m *WOLMessage) {
+	if cluster == nil {
+		return
+	}
+	copied := *m
+	cluster.enqueue(clusterUpdate{Kind: clusterMessage, DeviceID: m.DeviceID, Message: &copied})
+}
+
+func (c *clusterSync) enqueue(u clusterUpdate) {
+	u.Replica = c.replica
+	select {
+	case c.updates <- u:
+	default:
+		c.recordError("publish", errors.New("update queue full, dropping "+u.Kind))
+	}
+}
+
+// 按顺序发布本副本的变更，同时把设备信息写入 Redis 供新启动的副本载入
+func (c *clusterSync) runPublisher() {
+	defer close(c.done)
+	for {
+		var u clusterUpdate
+		select {
+		case u = <-c.updates:
+		case <-c.stop:
+			// 发出剩余的变更后退出
+			for {
+				select {
+				case u = <-c.updates:
+					c.publish(u)
+				default:
+					return
+				}
+			}
+		}
+		c.publish(u)
+	}
+}
+
+func (c *clusterSync) publish(u clusterUpdate) {
+	data, err := json.Marshal(u)
+	if err != nil {
+		return
+	}
+	cmds := [][]string{{"PUBLISH", c.channel(), string(data)}}
+	switch u.Kind {
+	case clusterDevice:
+		device, _ := json.Marshal(u.Device)
+		cmds = append(cmds, []string{"HSET", c.devicesKey(), u.DeviceID, string(device)})
+	case clusterDeviceDeleted:
+		cmds = append(cmds, []string{"HDEL", c.devicesKey(), u.DeviceID}, []string{"DEL", c.queueKey(u.DeviceID)})
+	}
+	if _, err := c.redis.pipeline(cmds...); err != nil {
+		c.recordError("publish", err)
+	}
+}
+
+// 处理其他副本发布的变更
+func (c *clusterSync) apply(payload []byte) {
+	var u clusterUpdate
+	if err := json.Unmarshal(payload, &u); err != nil {
+		slog.Warn("ignoring malformed cluster update", "error", err)
+		return
+	}
+	if u.Replica == c.replica {
+		return
+	}
+	switch u.Kind {
+	case clusterNotify:
+		queues.notify(u.DeviceID)
+	case clusterRelease:
+		longPolls.releaseLocal(u.DeviceID)
+	case clusterDevice:
+		if u.Device != nil {
+			c.applyDevice(u.Device)
+		}
+	case clusterDeviceDeleted:
+		storage.mu.Lock()
+		_, exists := storage.devices[u.DeviceID]
+		delete(storage.devices, u.DeviceID)
+		// 与 removeDevice 一样在持有 storage.mu 时关闭队列：入队和重新下发都持有 storage.mu，
+		// 不会向刚关闭的通知通道发送
+		queues.closeLocal(u.DeviceID)
+		storage.mu.Unlock()
+		if exists {
+			markDirty()
+		}
+	case clusterPower:
+		if u.Power != nil {
+			powerStates.Lock()
+			powerStates.m[u.Power.Target] = u.Power
+			powerStates.Unlock()
+		}
+	case clusterState:
+		if _, err := c.loadSharedState(); err != nil {
+			c.recordError("load state", err)
+		}
+	case clusterMessage:
+		if u.Message != nil {
+			storage.mu.Lock()
+			if existing, ok := storage.messages[u.Message.ID]; ok {
+				existing.Status = u.Message.Status
+				existing.Error = u.Message.Error
+				existing.ApprovedBy = u.Message.ApprovedBy
+				existing.QueuedAt, existing.DeliveredAt = u.Message.QueuedAt, u.Message.DeliveredAt
+				existing.AckedAt, existing.UpAt = u.Message.AckedAt, u.Message.UpAt
+			} else {
+				storage.messages[u.Message.ID] = u.Message
+			}
+			storage.mu.Unlock()
+		}
+	}
+}
+
+// 合并其他副本的设备信息；运行计数保留本副本的值
+func (c *clusterSync) applyDevice(d *Device) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	existing, exists := storage.devices[d.ID]
+	if !exists {
+		copied := *d
+		storage.devices[d.ID] = &copied
+		markDirty()
+		return
+	}
+	// 所有者、标签和固件通道由管理员修改，不随轮询时间变化
+	existing.Owner = d.Owner
+	existing.Tags = d.Tags
+	existing.FirmwareChannel = d.FirmwareChannel
+	if d.LastSeen.Before(existing.LastSeen) {
+		return
+	}
+	existing.Name = d.Name
+	existing.MacAddress = d.MacAddress
+	existing.Description = d.Description
+	existing.Version = d.Version
+	existing.Power = d.Power
+	existing.ClockOffset = d.ClockOffset
+	existing.LastSeen = d.LastSeen
+	existing.Approved = existing.Approved || d.Approved
+	if d.Online {
+		existing.Online = true
+		existing.offlineAlerted = false
+	}
+}
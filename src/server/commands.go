@@ -0,0 +1,401 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// 版本信息，发布构建时通过 -ldflags "-X main.version=..." 设置
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+// 子命令
+var commands = []struct {
+	name    string
+	summary string
+	run     func(args []string)
+}{
+	{"serve", "启动服务器（默认）", serve},
+	{"gen-key", "生成随机API密钥", genKeyCommand},
+	{"version", "显示版本信息", versionCommand},
+	{"check-config", "检查参数、环境变量和配置文件，不启动服务器", checkConfigCommand},
+	{"migrate", "将状态文件升级到当前版本", migrateCommand},
+	{"healthcheck", "检查本机运行中的服务器是否存活（用于 Docker HEALTHCHECK）", healthcheckCommand},
+	{"service", "安装、启动、停止或卸载 Windows 服务", serviceCommand},
+}
+
+func main() {
+	args := os.Args[1:]
+	// 由 Windows 服务管理器启动时在服务中运行
+	if runAsService != nil && runAsService(defaultServiceName, func() { runCommand(args) }) {
+		return
+	}
+	runCommand(args)
+}
+
+func runCommand(args []string) {
+	// -service install 等同于 service install
+	if len(args) > 0 && (args[0] == "-service" || args[0] == "--service") {
+		serviceCommand(args[1:])
+		return
+	}
+	// 不带子命令或直接以参数开头时按 serve 处理，兼容旧的启动方式
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		if len(args) > 0 && (args[0] == "-h" || args[0] == "-help" || args[0] == "--help") {
+			printUsage(os.Stdout)
+			return
+		}
+		serve(args)
+		return
+	}
+	for _, cmd := range commands {
+		if cmd.name == args[0] {
+			cmd.run(args[1:])
+			return
+		}
+	}
+	if args[0] == "help" {
+		printUsage(os.Stdout)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "未知子命令 %q\n\n", args[0])
+	printUsage(os.Stderr)
+	os.Exit(2)
+}
+
+func programName() string {
+	return filepath.Base(os.Args[0])
+}
+
+func printUsage(out io.Writer) {
+	fmt.Fprintf(out, "用法: %s <子命令> [参数]\n\n子命令:\n", programName())
+	for _, cmd := range commands {
+		fmt.Fprintf(out, "  %-14s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintf(out, "\n使用 \"%s <子命令> -h\" 查看子命令的参数\n", programName())
+}
+
+// 生成随机API密钥（base64url 编码）
+func genKeyCommand(args []string) {
+	fs := flag.NewFlagSet("gen-key", flag.ExitOnError)
+	size := fs.Int("bytes", 32, "随机字节数，至少16")
+	fs.Parse(args)
+	if *size < 16 {
+		fmt.Fprintln(os.Stderr, "-bytes must be at least 16")
+		os.Exit(2)
+	}
+
+	buf := make([]byte, *size)
+	if _, err := rand.Read(buf); err != nil {
+		fmt.Fprintln(os.Stderr, "failed to read random bytes:", err)
+		os.Exit(1)
+	}
+	fmt.Println(base64.RawURLEncoding.EncodeToString(buf))
+}
+
+// 构建信息，未通过 -ldflags 设置时从Go构建信息中读取提交号
+type buildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	BuildDate string `json:"build_date,omitempty"`
+	GoVersion string `json:"go_version"`
+	Platform  string `json:"platform"`
+}
+
+func currentBuildInfo() buildInfo {
+	info := buildInfo{
+		Version:   version,
+		Commit:    commit,
+		BuildDate: buildDate,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range bi.Settings {
+			switch {
+			case s.Key == "vcs.revision" && info.Commit == "":
+				info.Commit = s.Value
+			case s.Key == "vcs.time" && info.BuildDate == "":
+				info.BuildDate = s.Value
+			case s.Key == "vcs.modified" && s.Value == "true" && info.Commit != "" && !strings.HasSuffix(info.Commit, "-dirty"):
+				info.Commit += "-dirty"
+			}
+		}
+	}
+	return info
+}
+
+func versionCommand(args []string) {
+	fs := flag.NewFlagSet("version", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "以JSON格式输出")
+	fs.Parse(args)
+
+	info := currentBuildInfo()
+	if *asJSON {
+		json.NewEncoder(os.Stdout).Encode(info)
+		return
+	}
+	fmt.Printf("esp32-wol %s\n", info.Version)
+	if info.Commit != "" {
+		fmt.Printf("commit:     %s\n", info.Commit)
+	}
+	if info.BuildDate != "" {
+		fmt.Printf("built:      %s\n", info.BuildDate)
+	}
+	fmt.Printf("go:         %s %s\n", info.GoVersion, info.Platform)
+}
+
+// 请求本机服务器的 /healthz（或 /readyz），正常时退出码为0。容器镜像中通常没有 curl，
+// 用同一个程序做健康检查；默认地址从 ESP32_WOL_LISTEN、ESP32_WOL_PORT 和 ESP32_WOL_BASE_PATH 推导
+func healthcheckCommand(args []string) {
+	fs := flag.NewFlagSet("healthcheck", flag.ExitOnError)
+	target := fs.String("url", "", "检查的地址，默认根据环境变量推导，例如 http://127.0.0.1:8080/healthz")
+	ready := fs.Bool("ready", false, "检查 /readyz（就绪）而不是 /healthz（存活）")
+	timeout := fs.Duration("timeout", 3*time.Second, "请求超时")
+	fs.Parse(args)
+
+	if *target == "" {
+		path := "/healthz"
+		if *ready {
+			path = "/readyz"
+		}
+		*target = localServerURL() + path
+	}
+	client := &http.Client{
+		Timeout: *timeout,
+		// 访问本机，证书通常不是签发给回环地址的
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+	}
+	resp, err := client.Get(*target)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "unhealthy:", err)
+		os.Exit(1)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode != http.StatusOK {
+		fmt.Fprintf(os.Stderr, "unhealthy: %s %s\n", resp.Status, strings.TrimSpace(string(body)))
+		os.Exit(1)
+	}
+	fmt.Println(strings.TrimSpace(string(body)))
+}
+
+// 本机访问服务器的地址（含 -base-path）
+func localServerURL() string {
+	specs := strings.Fields(os.Getenv(envName("listen")))
+	if len(specs) == 0 {
+		specs = []string{":" + firstNonEmpty(os.Getenv(envName("port")), "8080")}
+	}
+	scheme, host, port := "http", "127.0.0.1", "8080"
+	if cfg, h, p, ok := firstTCPListener(specs); ok {
+		if cfg.TLSCert != "" {
+			scheme = "https"
+		}
+		host, port = loopbackHost(h), p
+	}
+	return scheme + "://" + net.JoinHostPort(host, port) + normalizeBasePath(os.Getenv(envName("base-path")))
+}
+
+// 检查 serve 的全部配置：参数、环境变量、配置文件、证书和状态文件
+func checkConfigCommand(args []string) {
+	o := parseServeFlags("check-config", args)
+
+	failed := false
+	check := func(name string, err error) {
+		if err != nil {
+			failed = true
+			fmt.Printf("FAIL  %s: %v\n", name, err)
+		} else {
+			fmt.Printf("ok    %s\n", name)
+		}
+	}
+	for _, name := range o.fromEnv {
+		fmt.Printf("      -%s set from %s\n", name, envName(name))
+	}
+
+	check("logging", setupLogging(io.Discard, o.logLevel, o.logFormat))
+
+	key, _ := o.resolveAPIKey()
+	switch {
+	case key == "":
+		check("api key", fmt.Errorf("not set: use -api-key or ESP32_WOL_API_KEY"))
+	case len(key) < 16:
+		check("api key", fmt.Errorf("only %d characters, use at least 16 (see gen-key)", len(key)))
+	default:
+		check("api key", nil)
+	}
+
+	check("ip settings", checkIPSettings())
+	check("device binding", checkBindingSettings())
+	if o.geoIPList != "" {
+		_, err := openGeoIP(o.geoIPList)
+		check("geoip", err)
+	}
+	_, err := parseTrustedProxies(o.trustedProxyList)
+	check("trusted proxies", err)
+	_, err = parseCORSOrigins(o.corsOriginList)
+	check("cors origins", err)
+	check("route deprecations", checkDeprecations())
+	check("http server limits", o.checkHTTPLimits())
+	check("queue limits", checkQueueLimits())
+	check("delivery settings", checkDeliverySettings())
+	check("approval settings", checkApprovalSettings())
+	check("wake cooldown", checkCooldownSettings())
+	check("clock skew", checkClockSkew())
+	check("device purge", checkPurgeSettings())
+	check("probe settings", checkProbeSettings())
+	check("energy settings", checkEnergySettings())
+	if ouiFile != "" {
+		check("oui file", loadOUIFile())
+	}
+
+	oauthRedirectURIs = parseOAuthRedirects(o.oauthRedirectList)
+	check("oauth", checkOAuthConfig())
+	if o.homekit.pin != "" {
+		check("homekit", checkHomeKitOptions(o.homekit))
+	}
+
+	specs := []string(o.listenSpecs)
+	if len(specs) == 0 {
+		specs = []string{":" + o.port}
+	}
+	for _, spec := range specs {
+		cfg, err := parseListenSpec(spec)
+		if err == nil && cfg.TLSCert != "" {
+			_, err = tls.LoadX509KeyPair(cfg.TLSCert, cfg.TLSKey)
+		}
+		if err == nil && cfg.ClientCA != "" {
+			_, err = clientCATLSConfig(cfg.ClientCA)
+		}
+		check("listen "+spec, err)
+	}
+
+	if o.mdns {
+		_, err := newMDNSResponder(o.mdnsName, specs)
+		check("mdns", err)
+	}
+
+	fileConfig, err := loadConfigFile(o.configPath)
+	if o.configPath != "" {
+		check("config file "+o.configPath, err)
+	}
+	if err == nil {
+		_, err = buildNotifiers(fileConfig.Notifications)
+		check("notifications", err)
+		_, err = buildHooks(fileConfig.Hooks)
+		check("hooks", err)
+		_, err = buildProxies(fileConfig.Proxies)
+		check("proxies", err)
+		if fileConfig.Alertmanager != nil {
+			_, err = buildAlertRules(fileConfig.Alertmanager)
+			check("alertmanager", err)
+		}
+		if fileConfig.TelegramBot != nil {
+			_, err = newTelegramBot(fileConfig.TelegramBot)
+			check("telegram bot", err)
+		}
+		if fileConfig.InfluxDB != nil {
+			_, err = newInfluxExporter(fileConfig.InfluxDB)
+			check("influxdb", err)
+		}
+		if fileConfig.Tunnel != nil {
+			_, err = newTunnel(fileConfig.Tunnel, specs)
+			check("tunnel", err)
+		}
+		if fileConfig.Redis != nil {
+			_, err = newCluster(fileConfig.Redis)
+			check("redis", err)
+		}
+		if haEnabled && fileConfig.Redis == nil {
+			check("ha", fmt.Errorf("-ha requires redis in the config file"))
+		}
+	}
+
+	if dataFile != "" {
+		_, err := readStateFile(dataFile)
+		check("data file "+dataFile, err)
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+	fmt.Println("configuration OK")
+}
+
+// 升级状态文件，升级前保留备份
+func migrateCommand(args []string) {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	fs.StringVar(&dataFile, "data-file", "", "状态文件路径")
+	dryRun := fs.Bool("dry-run", false, "只检查需要执行的迁移，不写入文件")
+	fs.Usage = usageWithEnv(fs)
+	fs.Parse(args)
+	if _, err := applyEnv(fs); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if dataFile == "" {
+		fmt.Fprintln(os.Stderr, "-data-file is required")
+		os.Exit(2)
+	}
+
+	fail := func(err error) {
+		fmt.Fprintf(os.Stderr, "migrate %s: %v\n", dataFile, err)
+		os.Exit(1)
+	}
+	data, err := os.ReadFile(dataFile)
+	if err != nil {
+		fail(err)
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		fail(err)
+	}
+	from, err := migrateState(raw)
+	if err != nil {
+		fail(err)
+	}
+	if from == stateVersion {
+		fmt.Printf("%s is already at version %d\n", dataFile, stateVersion)
+		return
+	}
+
+	// 用当前结构重新解析，确认迁移结果可以被服务器加载
+	migrated, err := json.Marshal(raw)
+	if err != nil {
+		fail(err)
+	}
+	var state persistedState
+	if err := json.Unmarshal(migrated, &state); err != nil {
+		fail(fmt.Errorf("migrated state is invalid: %w", err))
+	}
+	if *dryRun {
+		fmt.Printf("%s would be migrated from version %d to %d\n", dataFile, from, stateVersion)
+		return
+	}
+
+	backup := fmt.Sprintf("%s.v%d.bak", dataFile, from)
+	if err := os.WriteFile(backup, data, 0600); err != nil {
+		fail(fmt.Errorf("write backup: %w", err))
+	}
+	state.SavedAt = time.Now()
+	if err := writeStateFile(dataFile, state); err != nil {
+		fail(err)
+	}
+	fmt.Printf("%s migrated from version %d to %d (backup: %s)\n", dataFile, from, stateVersion, backup)
+}
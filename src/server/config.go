@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// 环境变量前缀：每个命令行参数都有对应的环境变量，
+// 例如 -port 对应 ESP32_WOL_PORT，-shutdown-timeout 对应 ESP32_WOL_SHUTDOWN_TIMEOUT
+const envPrefix = "ESP32_WOL_"
+
+// 参数名转换为环境变量名
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// 用环境变量填充未在命令行中显式设置的参数
+// 优先级：命令行参数 > 环境变量 > 默认值
+// 返回从环境变量中读取的参数名
+func applyEnv(fs *flag.FlagSet) ([]string, error) {
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	var fromEnv []string
+	var firstErr error
+	fs.VisitAll(func(f *flag.Flag) {
+		if explicit[f.Name] || firstErr != nil {
+			return
+		}
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok {
+			return
+		}
+		if err := fs.Set(f.Name, value); err != nil {
+			firstErr = fmt.Errorf("环境变量 %s 无效: %v", envName(f.Name), err)
+			return
+		}
+		fromEnv = append(fromEnv, f.Name)
+	})
+	return fromEnv, firstErr
+}
+
+// 帮助信息中列出每个参数对应的环境变量
+func usageWithEnv(fs *flag.FlagSet) func() {
+	return func() {
+		out := fs.Output()
+		fmt.Fprintf(out, "用法: %s %s [参数]\n\n", programName(), fs.Name())
+		fs.VisitAll(func(f *flag.Flag) {
+			name, usage := flag.UnquoteUsage(f)
+			fmt.Fprintf(out, "  -%s %s\n    \t%s", f.Name, name, usage)
+			if f.DefValue != "" {
+				fmt.Fprintf(out, "（默认 %s）", f.DefValue)
+			}
+			fmt.Fprintf(out, "\n    \t环境变量: %s\n", envName(f.Name))
+		})
+		fmt.Fprintln(out, "\n优先级：命令行参数 > 环境变量 > 默认值")
+	}
+}
+
+// 配置文件（JSON），保存无法用单个命令行参数表达的结构化配置
+type FileConfig struct {
+	Notifications NotificationConfig  `json:"notifications"`
+	Hooks         []HookConfig        `json:"hooks"`
+	TelegramBot   *TelegramBotConfig  `json:"telegram_bot"`
+	Alertmanager  *AlertmanagerConfig `json:"alertmanager"`
+	Tailscale     *TailscaleConfig    `json:"tailscale"`
+	Tunnel        *TunnelConfig       `json:"tunnel"`
+	Proxies       []ProxyConfig       `json:"proxies"`
+	Redis         *RedisConfig        `json:"redis"`
+	InfluxDB      *InfluxConfig       `json:"influxdb"`
+}
+
+// 读取配置文件，路径为空时返回空配置；未知字段视为错误，避免拼写错误被静默忽略
+func loadConfigFile(path string) (*FileConfig, error) {
+	cfg := &FileConfig{}
+	if path == "" {
+		return cfg, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// 配置文件中的时长，使用 "30s"、"5m" 这样的字符串
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"30s\"")
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
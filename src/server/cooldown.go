@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// 唤醒冷却：同一个目标MAC地址两次唤醒之间至少间隔一段时间，冷却期内的请求返回 429 和 Retry-After，
+// 避免反复触发的自动化在短时间内向网卡发送成百上千个魔术包。
+// 目标的 cooldown 优先，未设置时使用 -wake-cooldown（默认0，不限制）；同一MAC地址的多个目标取最长的冷却时间。
+// 唤醒进入设备队列时开始计时，记录只保存在内存中，每个副本分别计算
+
+var defaultWakeCooldown time.Duration
+
+// 目标MAC地址（规范化） -> 上次入队的时间，由 storage.mu 保护
+var lastWakes = make(map[string]time.Time)
+
+var cooldownRejectedTotal = newCounterVec("esp32_wol_cooldown_rejected_total",
+	"Wake requests rejected because the target MAC was woken within its cooldown.")
+
+func checkCooldownSettings() error {
+	if defaultWakeCooldown < 0 {
+		return errors.New("-wake-cooldown must not be negative")
+	}
+	return nil
+}
+
+type cooldownError struct {
+	TargetMAC  string
+	Cooldown   time.Duration
+	RetryAfter time.Duration
+}
+
+func (e *cooldownError) Error() string {
+	return fmt.Sprintf("%s was woken less than %s ago, retry in %s", e.TargetMAC, e.Cooldown, e.RetryAfter.Round(time.Second))
+}
+
+// 唤醒请求适用的冷却时间。调用方持有 storage.mu
+func wakeCooldown(req wakeRequest) time.Duration {
+	var cooldown time.Duration
+	configured := false
+	for _, t := range wakeTargets(req) {
+		if t.Cooldown != nil {
+			configured = true
+			if d := time.Duration(*t.Cooldown); d > cooldown {
+				cooldown = d
+			}
+		}
+	}
+	if !configured {
+		return defaultWakeCooldown
+	}
+	return cooldown
+}
+
+func cooldownKey(mac string) string {
+	if normalized, err := normalizeMAC(mac); err == nil {
+		return normalized
+	}
+	return mac
+}
+
+// 目标MAC地址仍在冷却期内时返回 *cooldownError，不计数。调用方持有 storage.mu
+func cooldownRemaining(req wakeRequest, now time.Time) *cooldownError {
+	cooldown := wakeCooldown(req)
+	if cooldown <= 0 {
+		return nil
+	}
+	last, ok := lastWakes[cooldownKey(req.TargetMAC)]
+	if !ok || now.Sub(last) >= cooldown {
+		return nil
+	}
+	return &cooldownError{TargetMAC: cooldownKey(req.TargetMAC), Cooldown: cooldown, RetryAfter: cooldown - now.Sub(last)}
+}
+
+// 检查冷却期，冷却期内返回 *cooldownError。调用方持有 storage.mu
+func checkCooldown(message *WOLMessage) error {
+	err := cooldownRemaining(wakeRequest{Target: message.Target, TargetMAC: message.TargetMAC}, time.Now())
+	if err == nil {
+		return nil
+	}
+	cooldownRejectedTotal.inc()
+	return err
+}
+
+// 记录唤醒入队的时间，顺便清理早已过期的记录。调用方持有 storage.mu 写锁
+func recordWake(mac string, now time.Time) {
+	lastWakes[cooldownKey(mac)] = now
+	for key, last := range lastWakes {
+		if now.Sub(last) > 24*time.Hour {
+			delete(lastWakes, key)
+		}
+	}
+}
+
+// 冷却错误写为 429 和 Retry-After 并返回 true，其他错误返回 false
+func writeCooldown(w http.ResponseWriter, err error) bool {
+	var ce *cooldownError
+	if !errors.As(err, &ce) {
+		return false
+	}
+	retryAfter := int(ce.RetryAfter.Seconds()) + 1
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	writeJSON(w, http.StatusTooManyRequests, map[string]any{
+		"success":     false,
+		"error":       "target_cooldown",
+		"target_mac":  ce.TargetMAC,
+		"cooldown":    ce.Cooldown.String(),
+		"retry_after": retryAfter,
+		"message":     ce.Error(),
+	})
+	return true
+}
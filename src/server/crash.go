@@ -0,0 +1,145 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 设备崩溃和重启原因上报。中继启动时上报 machine.reset_cause() 和上次未捕获异常的回溯，
+// 服务器为每台设备保存最近的报告（仅在内存中，重启后清空），短时间内异常重启过多时发布告警
+
+const (
+	maxCrashReports  = 20       // 每台设备保存的报告数
+	maxCrashDumpSize = 8 * 1024 // 回溯超过该长度时截断
+	maxCrashBody     = 16 * 1024
+)
+
+// 开机循环的告警阈值
+var (
+	alertBootLoopThreshold = 3
+	alertBootLoopWindow    = 10 * time.Minute
+)
+
+// 不算异常的重启原因：上电和深度睡眠唤醒
+var cleanResetReasons = map[string]bool{
+	"power_on":  true,
+	"deepsleep": true,
+}
+
+type CrashReport struct {
+	Time            time.Time `json:"time"`
+	ResetReason     string    `json:"reset_reason"`               // power_on、hard、watchdog、deepsleep、soft 或原始数值
+	Uptime          int64     `json:"uptime,omitempty"`           // 上次运行时长（秒），设备未知时为0
+	FirmwareVersion string    `json:"firmware_version,omitempty"` // 崩溃时运行的固件版本
+	Dump            string    `json:"dump,omitempty"`             // 未捕获异常的回溯
+	Truncated       bool      `json:"truncated,omitempty"`
+}
+
+// 异常重启：非上电/睡眠唤醒的重启，或附带了回溯
+func (c CrashReport) abnormal() bool {
+	return c.Dump != "" || !cleanResetReasons[c.ResetReason]
+}
+
+type crashLog struct {
+	mu      sync.Mutex
+	reports map[string][]CrashReport // 设备ID -> 报告，按时间先后
+	alerted map[string]time.Time     // 设备ID -> 最近一次开机循环告警时间
+}
+
+var crashes = &crashLog{
+	reports: make(map[string][]CrashReport),
+	alerted: make(map[string]time.Time),
+}
+
+// 记录报告，返回时间窗口内的异常重启次数和是否需要告警（每个窗口只告警一次）
+func (l *crashLog) record(deviceID string, report CrashReport) (int, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	list := append(l.reports[deviceID], report)
+	if len(list) > maxCrashReports {
+		list = append([]CrashReport(nil), list[len(list)-maxCrashReports:]...)
+	}
+	l.reports[deviceID] = list
+
+	if !report.abnormal() || alertBootLoopThreshold <= 0 {
+		return 0, false
+	}
+	count := 0
+	for _, c := range list {
+		if c.abnormal() && report.Time.Sub(c.Time) <= alertBootLoopWindow {
+			count++
+		}
+	}
+	if count < alertBootLoopThreshold || report.Time.Sub(l.alerted[deviceID]) <= alertBootLoopWindow {
+		return count, false
+	}
+	l.alerted[deviceID] = report.Time
+	return count, true
+}
+
+// 最近的报告，最新的在前
+func (l *crashLog) list(deviceID string) []CrashReport {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	stored := l.reports[deviceID]
+	list := make([]CrashReport, len(stored))
+	for i, c := range stored {
+		list[len(stored)-1-i] = c
+	}
+	return list
+}
+
+func (l *crashLog) forget(deviceID string) {
+	l.mu.Lock()
+	delete(l.reports, deviceID)
+	delete(l.alerted, deviceID)
+	l.mu.Unlock()
+}
+
+// POST /api/devices/<id>/crash
+func reportCrash(w http.ResponseWriter, r *http.Request, deviceID, version string) {
+	var req CrashReport
+	r.Body = http.MaxBytesReader(w, r.Body, maxCrashBody)
+	if !readJSON(w, r, &req) {
+		return
+	}
+	req.ResetReason = strings.ToLower(strings.TrimSpace(req.ResetReason))
+	if req.ResetReason == "" {
+		http.Error(w, "reset_reason is required", http.StatusBadRequest)
+		return
+	}
+	req.Time = time.Now()
+	if req.FirmwareVersion == "" {
+		req.FirmwareVersion = version
+	}
+	if len(req.Dump) > maxCrashDumpSize {
+		req.Dump = req.Dump[len(req.Dump)-maxCrashDumpSize:] // 保留回溯末尾的异常信息
+		req.Truncated = true
+	}
+
+	count, alert := crashes.record(deviceID, req)
+	requestLogger(r).Info("device reset reported", "device_id", deviceID, "reset_reason", req.ResetReason, "has_dump", req.Dump != "")
+	if req.abnormal() {
+		events.publish(Event{Type: eventDeviceCrashed, DeviceID: deviceID, Data: map[string]any{
+			"reset_reason":     req.ResetReason,
+			"uptime":           req.Uptime,
+			"firmware_version": req.FirmwareVersion,
+			"has_dump":         req.Dump != "",
+		}})
+	}
+	if alert {
+		slog.Warn("relay boot loop", "device_id", deviceID, "count", count)
+		events.publish(Event{Type: eventAlertBootLoop, DeviceID: deviceID, Data: map[string]any{
+			"count":        count,
+			"window":       alertBootLoopWindow.String(),
+			"reset_reason": req.ResetReason,
+		}})
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"message": "Crash report stored",
+	})
+}
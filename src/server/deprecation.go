@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 接口弃用通知：路由表的 Deprecations 声明弃用的接口或字段（查询参数、JSON 请求体的顶层字段），
+// 请求用到时响应带上 Deprecation（RFC 9745）、Sunset（RFC 8594）和可选的 Link 头，
+// JSON 响应体另加 "warnings" 数组，旧固件和脚本在接口移除之前就能得到机器可读的提醒。
+// 用量计入 esp32_wol_deprecated_requests_total，据此判断什么时候可以移除
+
+type deprecation struct {
+	Field  string // 查询参数或请求体字段，为空表示整个接口
+	Since  string // 开始弃用的日期 YYYY-MM-DD
+	Sunset string // 计划移除的日期 YYYY-MM-DD
+	Link   string // 说明或迁移文档，可选
+	Note   string // 替代方案
+}
+
+func (d deprecation) warning() string {
+	what := "this endpoint"
+	if d.Field != "" {
+		what = strconv.Quote(d.Field)
+	}
+	msg := fmt.Sprintf("%s is deprecated and will be removed after %s", what, d.Sunset)
+	if d.Note != "" {
+		msg += ": " + d.Note
+	}
+	return msg
+}
+
+var deprecatedRequestsTotal = newCounterVec("esp32_wol_deprecated_requests_total",
+	"Requests that used a deprecated endpoint or field.", "route", "field")
+
+// 检查路由表中的日期，Sunset 必须晚于 Since
+func checkDeprecations() error {
+	for _, rt := range routes {
+		for _, d := range rt.Deprecations {
+			since, err := time.Parse(time.DateOnly, d.Since)
+			if err != nil {
+				return fmt.Errorf("%s %s: since must be YYYY-MM-DD", rt.Pattern, d.Field)
+			}
+			sunset, err := time.Parse(time.DateOnly, d.Sunset)
+			if err != nil || !sunset.After(since) {
+				return fmt.Errorf("%s %s: sunset must be a YYYY-MM-DD date after since", rt.Pattern, d.Field)
+			}
+		}
+	}
+	return nil
+}
+
+// 收集本次请求的弃用提示，writeJSON 把它们加入响应体
+type deprecationWriter struct {
+	http.ResponseWriter
+	warnings []string
+}
+
+func (dw *deprecationWriter) Unwrap() http.ResponseWriter {
+	return dw.ResponseWriter
+}
+
+// 响应写入器上收集到的弃用提示
+func responseWarnings(w http.ResponseWriter) []string {
+	if dw, ok := w.(*deprecationWriter); ok {
+		return dw.warnings
+	}
+	return nil
+}
+
+// 只用于声明了弃用项的路由：请求用到弃用的接口或字段时设置响应头并记录提示
+func deprecationMiddleware(pattern string, deprecations []deprecation, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]json.RawMessage
+		if hasBodyFields(deprecations) {
+			if head, truncated := peekBody(r, int(maxRequestBody)); !truncated {
+				json.Unmarshal(head, &body)
+			}
+		}
+		query := r.URL.Query()
+		dw := &deprecationWriter{ResponseWriter: w}
+		for _, d := range deprecations {
+			_, inBody := body[d.Field]
+			if d.Field != "" && !query.Has(d.Field) && !inBody {
+				continue
+			}
+			setDeprecationHeaders(w.Header(), d)
+			dw.warnings = append(dw.warnings, d.warning())
+			deprecatedRequestsTotal.inc(pattern, d.Field)
+		}
+		if len(dw.warnings) == 0 {
+			handler(w, r)
+			return
+		}
+		requestLogger(r).Info("deprecated API used", "path", r.URL.Path, "warnings", dw.warnings)
+		handler(dw, r)
+	}
+}
+
+// 声明了弃用字段时才需要读取请求体
+func hasBodyFields(deprecations []deprecation) bool {
+	for _, d := range deprecations {
+		if d.Field != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// 同一请求用到多个弃用项时，Deprecation 取最早的日期，Sunset 取最早的移除日期
+func setDeprecationHeaders(h http.Header, d deprecation) {
+	since, _ := time.Parse(time.DateOnly, d.Since)
+	sunset, _ := time.Parse(time.DateOnly, d.Sunset)
+	if cur, err := strconv.ParseInt(strings.TrimPrefix(h.Get("Deprecation"), "@"), 10, 64); err != nil || since.Unix() < cur {
+		h.Set("Deprecation", "@"+strconv.FormatInt(since.Unix(), 10))
+	}
+	if cur, err := http.ParseTime(h.Get("Sunset")); err != nil || sunset.Before(cur) {
+		h.Set("Sunset", sunset.UTC().Format(http.TimeFormat))
+	}
+	if d.Link != "" {
+		h.Add("Link", "<"+d.Link+`>; rel="deprecation"; type="text/html"`)
+	}
+}
+
+// 在对象形式的响应中加入 warnings，其他值原样返回
+func withWarnings(v any, warnings []string) any {
+	generic, err := genericValue(v)
+	obj, ok := generic.(map[string]any)
+	if err != nil || !ok {
+		return v
+	}
+	obj["warnings"] = warnings
+	return obj
+}
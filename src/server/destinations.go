@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// 魔术包的发送地址：分段的网络中中继默认的广播地址不一定能到达目标，目标（或单次唤醒请求）可以列出多个地址，
+// 随唤醒消息下发，中继按顺序发送到每个地址——魔术包没有回应，中继无法判断哪个地址有效，某个地址发送失败时继续下一个。
+// 地址为 IPv4 地址，可带端口（默认为中继的 WOL 端口），也可以是入队时按目标最近已知的IP解析的关键字：
+//   - unicast：最近已知的IP，取负责唤醒的中继邻居表中该MAC地址的IP，没有时取开机检测的 probe.host（为IP时）
+//   - subnet：该IP所在 /24 网段的定向广播地址
+//
+// 关键字无法解析时跳过；一个也解析不出来时消息不带地址，中继使用默认的广播地址
+
+const maxDestinations = 8
+
+const (
+	destinationUnicast = "unicast"
+	destinationSubnet  = "subnet"
+)
+
+// 拆分 host[:port]，host 为 IPv4 地址或关键字，port 为0表示使用中继的默认端口
+func parseDestination(s string) (string, int, error) {
+	host, portText, hasPort := strings.Cut(strings.TrimSpace(s), ":")
+	port := 0
+	if hasPort {
+		n, err := strconv.Atoi(portText)
+		if err != nil || n < 1 || n > 65535 {
+			return "", 0, fmt.Errorf("invalid port in destination %q", s)
+		}
+		port = n
+	}
+	if host == destinationUnicast || host == destinationSubnet {
+		return host, port, nil
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil || !addr.Is4() {
+		return "", 0, fmt.Errorf("destination %q must be an IPv4 address, %s or %s, optionally with :port", s, destinationUnicast, destinationSubnet)
+	}
+	return addr.String(), port, nil
+}
+
+func validateDestinations(list []string) error {
+	if len(list) > maxDestinations {
+		return fmt.Errorf("at most %d destinations are allowed", maxDestinations)
+	}
+	for _, d := range list {
+		if _, _, err := parseDestination(d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 目标最近已知的IP，没有时返回无效地址
+func lastKnownIP(mac, deviceID string, probe *TargetProbe) netip.Addr {
+	if n, ok := neighbors.lookup(mac)[deviceID]; ok {
+		if addr, err := netip.ParseAddr(n.IP); err == nil && addr.Is4() {
+			return addr
+		}
+	}
+	if probe != nil {
+		if addr, err := netip.ParseAddr(probe.Host); err == nil && addr.Is4() {
+			return addr
+		}
+	}
+	return netip.Addr{}
+}
+
+// 把地址列表解析为具体的 IP[:port]，去掉重复的地址
+func resolveDestinations(list []string, mac, deviceID string, probe *TargetProbe) []string {
+	var resolved []string
+	seen := make(map[string]bool)
+	var known netip.Addr
+	for _, d := range list {
+		host, port, err := parseDestination(d)
+		if err != nil {
+			continue
+		}
+		if host == destinationUnicast || host == destinationSubnet {
+			if !known.IsValid() {
+				known = lastKnownIP(mac, deviceID, probe)
+			}
+			if !known.IsValid() {
+				continue
+			}
+			addr := known
+			if host == destinationSubnet {
+				b := known.As4()
+				b[3] = 255
+				addr = netip.AddrFrom4(b)
+			}
+			host = addr.String()
+		}
+		if port != 0 {
+			host += ":" + strconv.Itoa(port)
+		}
+		if !seen[host] {
+			seen[host] = true
+			resolved = append(resolved, host)
+		}
+	}
+	return resolved
+}
+
+// 唤醒消息的发送地址：请求中指定的地址优先，其次为目标的地址。调用方需持有 storage.mu
+func wakeDestinations(req wakeRequest) []string {
+	list := req.Destinations
+	var probe *TargetProbe
+	if t, exists := storage.targets[req.Target]; exists {
+		if len(list) == 0 {
+			list = t.Destinations
+		}
+		probe = t.Probe
+	}
+	if len(list) == 0 {
+		return nil
+	}
+	return resolveDestinations(list, req.TargetMAC, req.DeviceID, probe)
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// 目标自动发现：发现任务让一台中继扫描所在网段（neighbor_scan 命令，见 neighbors.go），
+// 中继上传后任务列出扫描到的主机、网卡厂商，以及尚未建为目标的候选；管理员用一次请求把候选转为目标。
+// 任务只保存在内存中，保留最近 maxDiscoveryJobs 个
+
+const maxDiscoveryJobs = 20
+
+// 任务状态
+const (
+	discoveryScanning  = "scanning"  // 等待中继上传扫描结果
+	discoveryCompleted = "completed" // 已收到扫描结果
+	discoveryFailed    = "failed"    // 命令失败或被取消
+)
+
+type DiscoveryJob struct {
+	ID          string     `json:"id"`
+	DeviceID    string     `json:"device_id"`
+	MessageID   string     `json:"message_id"`
+	Source      string     `json:"source"`
+	Status      string     `json:"status"`
+	Error       string     `json:"error,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+	HostCount   int        `json:"host_count"`
+	hosts       []Neighbor
+}
+
+// 任务中的一台主机；Candidate 为可以转为目标的主机的建议，中继自身和已有目标没有
+type DiscoveredHost struct {
+	NeighborView
+	Candidate *TargetSuggestion `json:"candidate,omitempty"`
+}
+
+var discoveries = struct {
+	mu    sync.Mutex
+	jobs  map[string]*DiscoveryJob
+	order []string
+}{jobs: make(map[string]*DiscoveryJob)}
+
+func saveDiscoveryJob(job *DiscoveryJob) {
+	discoveries.mu.Lock()
+	defer discoveries.mu.Unlock()
+	discoveries.jobs[job.ID] = job
+	discoveries.order = append(discoveries.order, job.ID)
+	for len(discoveries.order) > maxDiscoveryJobs {
+		delete(discoveries.jobs, discoveries.order[0])
+		discoveries.order = discoveries.order[1:]
+	}
+}
+
+// 中继上传了某个 neighbor_scan 命令的结果，由 uploadNeighbors 调用
+func completeDiscovery(messageID string, hosts []Neighbor) {
+	discoveries.mu.Lock()
+	defer discoveries.mu.Unlock()
+	for _, job := range discoveries.jobs {
+		if job.MessageID == messageID {
+			now := time.Now().UTC()
+			job.Status, job.Error, job.CompletedAt = discoveryCompleted, "", &now
+			job.hosts, job.HostCount = slices.Clone(hosts), len(hosts)
+		}
+	}
+}
+
+// 任务的副本，等待中的任务按命令消息的状态更新；只有发起者和管理员可以查看
+func discoveryJob(p principal, id string) (DiscoveryJob, bool) {
+	discoveries.mu.Lock()
+	defer discoveries.mu.Unlock()
+	job, exists := discoveries.jobs[id]
+	if !exists || (!p.admin() && job.Source != principalName(p)) {
+		return DiscoveryJob{}, false
+	}
+	if job.Status == discoveryScanning {
+		storage.mu.RLock()
+		msg, ok := storage.messages[job.MessageID]
+		storage.mu.RUnlock()
+		switch {
+		case !ok:
+			job.Status, job.Error = discoveryFailed, "command message expired"
+		case msg.Status == messageFailed || msg.Status == messageCancelled:
+			job.Status, job.Error = discoveryFailed, firstNonEmpty(msg.Error, "command "+msg.Status)
+		case msg.Status == messageAcked:
+			// 中继先上传结果再确认，确认了却没有结果说明上传失败
+			job.Status, job.Error = discoveryFailed, "relay acknowledged without uploading results"
+		}
+	}
+	return *job, true
+}
+
+// 任务中的主机，按IP排序
+func discoveredHosts(p principal, job DiscoveryJob) []DiscoveredHost {
+	storage.mu.RLock()
+	index := newNeighborIndex(p)
+	storage.mu.RUnlock()
+	table := make(map[string]Neighbor, len(job.hosts))
+	for _, n := range job.hosts {
+		table[n.MacAddress] = n
+	}
+	hosts := []DiscoveredHost{}
+	for _, n := range sortedNeighbors(table) {
+		host := DiscoveredHost{NeighborView: index.view(n, job.DeviceID)}
+		if index.candidate(host.NeighborView) {
+			suggestion := index.suggest(host.NeighborView)
+			host.Candidate = &suggestion
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts
+}
+
+// GET|POST /api/admin/discovery：任务列表（最新的在前）和创建任务 {"device_id"}
+func discoveryHandler(w http.ResponseWriter, r *http.Request) {
+	p := requestPrincipal(r)
+	switch r.Method {
+	case http.MethodGet:
+		discoveries.mu.Lock()
+		ids := slices.Clone(discoveries.order)
+		discoveries.mu.Unlock()
+		jobs := []DiscoveryJob{}
+		for i := len(ids) - 1; i >= 0; i-- {
+			if job, ok := discoveryJob(p, ids[i]); ok {
+				jobs = append(jobs, job)
+			}
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"success": true, "jobs": jobs, "total": len(jobs)})
+
+	case http.MethodPost:
+		var req struct {
+			DeviceID string `json:"device_id"`
+		}
+		if !readJSON(w, r, &req) {
+			return
+		}
+		storage.mu.RLock()
+		d, exists := storage.devices[req.DeviceID]
+		exists = exists && p.owns(d.Owner)
+		storage.mu.RUnlock()
+		if !exists {
+			http.Error(w, "Device not found", http.StatusNotFound)
+			return
+		}
+		source := principalName(p)
+		job := &DiscoveryJob{
+			ID:        fmt.Sprintf("disc_%d", time.Now().UnixNano()),
+			DeviceID:  req.DeviceID,
+			Source:    source,
+			Status:    discoveryScanning,
+			CreatedAt: time.Now().UTC(),
+		}
+		logger := requestLogger(r).With("job_id", job.ID)
+		message, err := queueWake(logger, wakeRequest{Type: messageTypeNeighborScan, DeviceID: req.DeviceID, Source: source})
+		if err != nil {
+			if writeBackpressure(w, err) {
+				return
+			}
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		job.MessageID = message.ID
+		saveDiscoveryJob(job)
+		logger.Info("discovery started", "device_id", req.DeviceID, "message_id", message.ID)
+		writeJSON(w, http.StatusAccepted, map[string]interface{}{"success": true, "job": job, "message": "Discovery started"})
+
+	default:
+		methodNotAllowed(w, r)
+	}
+}
+
+// GET /api/admin/discovery/{id}：任务和扫描到的主机；
+// POST /api/admin/discovery/{id}/promote：把候选主机转为目标
+func discoveryJobHandler(w http.ResponseWriter, r *http.Request) {
+	id, action := pathParams(r, "/api/admin/discovery/")
+	p := requestPrincipal(r)
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		job, ok := discoveryJob(p, id)
+		if !ok {
+			http.Error(w, "Discovery job not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"success": true, "job": job, "hosts": discoveredHosts(p, job)})
+	case action == "promote" && r.Method == http.MethodPost:
+		promoteDiscoveredHost(w, r, id)
+	case action == "" || action == "promote":
+		methodNotAllowed(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// 请求体 {"mac_address", "name", "description", "owner"}，省略名称和描述时使用建议的值；
+// 目标由扫描的中继负责唤醒，带 ICMP 开机检测。响应与 POST /api/admin/targets 相同
+func promoteDiscoveredHost(w http.ResponseWriter, r *http.Request, id string) {
+	var req struct {
+		MacAddress  string `json:"mac_address"`
+		Name        string `json:"name"`
+		Description string `json:"description"`
+		Owner       string `json:"owner"`
+	}
+	if !readJSON(w, r, &req) {
+		return
+	}
+	mac, err := normalizeMAC(req.MacAddress)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	p := requestPrincipal(r)
+	job, ok := discoveryJob(p, id)
+	if !ok {
+		http.Error(w, "Discovery job not found", http.StatusNotFound)
+		return
+	}
+	i := slices.IndexFunc(job.hosts, func(n Neighbor) bool { return n.MacAddress == mac })
+	if i < 0 {
+		http.Error(w, "Host not found in discovery job", http.StatusNotFound)
+		return
+	}
+	storage.mu.RLock()
+	index := newNeighborIndex(p)
+	storage.mu.RUnlock()
+	host := index.view(job.hosts[i], job.DeviceID)
+	switch {
+	case host.Relay:
+		http.Error(w, "Host is a relay", http.StatusConflict)
+		return
+	case host.Target != "":
+		http.Error(w, "Host is already target "+host.Target, http.StatusConflict)
+		return
+	}
+	suggestion := index.suggest(host)
+	target := Target{
+		Name:        firstNonEmpty(req.Name, suggestion.Name),
+		MacAddress:  mac,
+		DeviceID:    job.DeviceID,
+		Description: firstNonEmpty(req.Description, suggestion.Description),
+		Probe:       suggestion.Probe,
+		Owner:       req.Owner,
+	}
+	saveTarget(w, r, "", target)
+}
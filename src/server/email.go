@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// 邮件通知配置
+type EmailConfig struct {
+	Host            string           `json:"smtp_host"`
+	Port            int              `json:"smtp_port"` // 默认587；465 使用隐式TLS
+	Username        string           `json:"username"`
+	Password        string           `json:"password"`
+	From            string           `json:"from"`
+	AllowPlaintext  bool             `json:"allow_plaintext"` // 服务器不支持STARTTLS时仍然发送（仅限内网）
+	SubjectTemplate string           `json:"subject_template"`
+	BodyTemplate    string           `json:"body_template"`
+	Recipients      []EmailRecipient `json:"recipients"`
+	MaxRetries      *int             `json:"max_retries"`
+}
+
+// 收件人及其订阅的事件，events 为空时只接收告警事件
+type EmailRecipient struct {
+	Address string   `json:"address"`
+	Events  []string `json:"events"`
+}
+
+var defaultEmailEvents = []string{eventAlertRelayOffline, eventAlertRepeatedFailures, eventAlertBootLoop, eventAlertLowBattery}
+
+const (
+	defaultEmailSubject = `[ESP32 WOL] {{.Summary}}`
+	defaultEmailBody    = `{{.Summary}}
+
+Event:   {{.Event.Type}}
+Time:    {{.Event.Time.Format "2006-01-02 15:04:05 MST"}}
+{{- if .Event.DeviceID}}
+Relay:   {{.Event.DeviceID}}{{end}}
+{{- if .Event.MessageID}}
+Message: {{.Event.MessageID}}{{end}}
+{{- range $k, $v := .Event.Data}}
+{{$k}}: {{$v}}{{end}}
+`
+)
+
+// 模板可用的数据
+type emailTemplateData struct {
+	Summary string
+	Event   Event
+}
+
+type emailRecipient struct {
+	address string
+	filter  eventFilter
+}
+
+type emailNotifier struct {
+	cfg        EmailConfig
+	subject    *template.Template
+	body       *template.Template
+	recipients []emailRecipient
+}
+
+func newEmailNotifier(cfg EmailConfig) (*emailNotifier, error) {
+	if cfg.Host == "" || cfg.From == "" {
+		return nil, fmt.Errorf("smtp_host and from are required")
+	}
+	if len(cfg.Recipients) == 0 {
+		return nil, fmt.Errorf("at least one recipient is required")
+	}
+	if cfg.Port == 0 {
+		cfg.Port = 587
+	}
+	if cfg.SubjectTemplate == "" {
+		cfg.SubjectTemplate = defaultEmailSubject
+	}
+	if cfg.BodyTemplate == "" {
+		cfg.BodyTemplate = defaultEmailBody
+	}
+
+	subject, err := template.New("subject").Parse(cfg.SubjectTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("subject_template: %v", err)
+	}
+	body, err := template.New("body").Parse(cfg.BodyTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("body_template: %v", err)
+	}
+
+	n := &emailNotifier{cfg: cfg, subject: subject, body: body}
+	for i, rc := range cfg.Recipients {
+		if rc.Address == "" {
+			return nil, fmt.Errorf("recipients[%d]: address is required", i)
+		}
+		types := rc.Events
+		if len(types) == 0 {
+			types = defaultEmailEvents
+		}
+		filter, err := newEventFilter(types)
+		if err != nil {
+			return nil, fmt.Errorf("recipients[%d]: %v", i, err)
+		}
+		n.recipients = append(n.recipients, emailRecipient{address: rc.Address, filter: filter})
+	}
+	return n, nil
+}
+
+func (n *emailNotifier) name() string { return "email:" + n.cfg.Host }
+
+func (n *emailNotifier) wants(eventType string) bool {
+	for _, rc := range n.recipients {
+		if rc.filter.wants(eventType) {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *emailNotifier) send(ctx context.Context, e Event) error {
+	var to []string
+	for _, rc := range n.recipients {
+		if rc.filter.wants(e.Type) {
+			to = append(to, rc.address)
+		}
+	}
+	if len(to) == 0 {
+		return nil
+	}
+
+	data := emailTemplateData{Summary: eventSummary(e), Event: e}
+	var subject, body bytes.Buffer
+	if err := n.subject.Execute(&subject, data); err != nil {
+		return permanentError{err}
+	}
+	if err := n.body.Execute(&body, data); err != nil {
+		return permanentError{err}
+	}
+	return n.sendMail(ctx, to, strings.TrimSpace(subject.String()), body.String())
+}
+
+// 构造并发送纯文本邮件
+func (n *emailNotifier) sendMail(ctx context.Context, to []string, subject, body string) error {
+	msg := n.buildMessage(to, subject, body)
+	addr := net.JoinHostPort(n.cfg.Host, strconv.Itoa(n.cfg.Port))
+	tlsConfig := &tls.Config{ServerName: n.cfg.Host}
+
+	dialer := &net.Dialer{}
+	var conn net.Conn
+	var err error
+	if n.cfg.Port == 465 {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: tlsConfig}).DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	client, err := smtp.NewClient(conn, n.cfg.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if n.cfg.Port != 465 {
+		if ok, _ := client.Extension("STARTTLS"); ok {
+			if err := client.StartTLS(tlsConfig); err != nil {
+				return err
+			}
+		} else if !n.cfg.AllowPlaintext {
+			return permanentError{fmt.Errorf("%s does not support STARTTLS (set allow_plaintext to send anyway)", n.cfg.Host)}
+		}
+	}
+	if n.cfg.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", n.cfg.Username, n.cfg.Password, n.cfg.Host)); err != nil {
+			return err
+		}
+	}
+
+	if err := client.Mail(n.cfg.From); err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		if err := client.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+func (n *emailNotifier) buildMessage(to []string, subject, body string) []byte {
+	id := make([]byte, 12)
+	rand.Read(id)
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", n.cfg.From)
+	fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Message-ID: <%s@esp32-wol>\r\n", hex.EncodeToString(id))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	buf.WriteString(strings.ReplaceAll(strings.ReplaceAll(body, "\r\n", "\n"), "\n", "\r\n"))
+	return buf.Bytes()
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// 响应编码的内容协商：所有接口的结构化响应都经由 writeJSON 写出，按请求的 Accept 选择编码——
+// 默认 JSON，也可以是 CBOR（application/cbor，RFC 8949）或 MessagePack（application/msgpack），
+// 适合 JSON 解析开销较大的客户端。请求体仍然使用 JSON。
+// 非 JSON 编码由 JSON 编码结果转换而来，字段名、省略规则与 JSON 完全相同；对象的键按字典序排列
+
+type responseEncoding struct {
+	contentType string
+	encode      func(v any) ([]byte, error)
+}
+
+var (
+	encodingJSON    = &responseEncoding{contentType: "application/json", encode: encodeJSON}
+	encodingCBOR    = &responseEncoding{contentType: "application/cbor", encode: encodeCBOR}
+	encodingMsgpack = &responseEncoding{contentType: "application/msgpack", encode: encodeMsgpack}
+)
+
+// Accept 中的媒体类型 -> 编码，MessagePack 没有正式注册的类型，几种常见写法都接受
+var responseEncodings = map[string]*responseEncoding{
+	"application/json":          encodingJSON,
+	"application/cbor":          encodingCBOR,
+	"application/msgpack":       encodingMsgpack,
+	"application/x-msgpack":     encodingMsgpack,
+	"application/vnd.msgpack":   encodingMsgpack,
+	"application/x-messagepack": encodingMsgpack,
+}
+
+// 按 Accept 的 q 值选择编码，没有可用的编码时使用 JSON（不返回 406，
+// 浏览器和大多数客户端发送 */* 或不发送 Accept）
+func negotiateEncoding(accept string) *responseEncoding {
+	if accept == "" {
+		return encodingJSON
+	}
+	best, bestQ := encodingJSON, 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		enc, ok := responseEncodings[mediaType]
+		if !ok || q <= bestQ {
+			continue
+		}
+		best, bestQ = enc, q
+	}
+	return best
+}
+
+// 请求选择了非 JSON 编码时包装响应写入器，writeJSON 据此编码
+type negotiatedWriter struct {
+	http.ResponseWriter
+	encoding *responseEncoding
+}
+
+func (nw *negotiatedWriter) Unwrap() http.ResponseWriter {
+	return nw.ResponseWriter
+}
+
+// 所有路由使用；JSON（绝大多数请求）不包装
+func negotiateMiddleware(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		enc := negotiateEncoding(r.Header.Get("Accept"))
+		if enc == encodingJSON {
+			handler(w, r)
+			return
+		}
+		handler(&negotiatedWriter{ResponseWriter: w, encoding: enc}, r)
+	}
+}
+
+// 沿包装链查找协商的编码
+func responseEncodingOf(w http.ResponseWriter) *responseEncoding {
+	for {
+		if nw, ok := w.(*negotiatedWriter); ok {
+			return nw.encoding
+		}
+		u, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return encodingJSON
+		}
+		w = u.Unwrap()
+	}
+}
+
+// 编码响应体，返回内容类型
+func encodeResponse(w http.ResponseWriter, v any) (string, []byte, error) {
+	enc := responseEncodingOf(w)
+	body, err := enc.encode(v)
+	return enc.contentType, body, err
+}
+
+func encodeJSON(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	err := json.NewEncoder(&buf).Encode(v)
+	return buf.Bytes(), err
+}
+
+// 先按 JSON 编码再解析为通用值，保留 json 标签、omitempty 和 MarshalJSON 的效果
+func genericValue(v any) (any, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var generic any
+	err = dec.Decode(&generic)
+	return generic, err
+}
+
+func sortedKeys(m map[string]any) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// 数字：整数保持整数（超出 int64 的非负整数按 uint64），其余按 float64
+func numberValue(n json.Number) (i int64, u uint64, f float64, kind byte) {
+	if i, err := n.Int64(); err == nil {
+		return i, 0, 0, 'i'
+	}
+	if u, err := strconv.ParseUint(string(n), 10, 64); err == nil {
+		return 0, u, 0, 'u'
+	}
+	f, _ = n.Float64()
+	return 0, 0, f, 'f'
+}
+
+func encodeCBOR(v any) ([]byte, error) {
+	generic, err := genericValue(v)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	err = writeCBOR(&buf, generic)
+	return buf.Bytes(), err
+}
+
+// CBOR 数据项的头部：主类型和长度或数值
+func cborHead(buf *bytes.Buffer, major byte, n uint64) {
+	major <<= 5
+	switch {
+	case n < 24:
+		buf.WriteByte(major | byte(n))
+	case n <= math.MaxUint8:
+		buf.WriteByte(major | 24)
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(major | 25)
+		buf.Write(binary.BigEndian.AppendUint16(nil, uint16(n)))
+	case n <= math.MaxUint32:
+		buf.WriteByte(major | 26)
+		buf.Write(binary.BigEndian.AppendUint32(nil, uint32(n)))
+	default:
+		buf.WriteByte(major | 27)
+		buf.Write(binary.BigEndian.AppendUint64(nil, n))
+	}
+}
+
+func writeCBOR(buf *bytes.Buffer, v any) error {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteByte(0xf6)
+	case bool:
+		if v {
+			buf.WriteByte(0xf5)
+		} else {
+			buf.WriteByte(0xf4)
+		}
+	case json.Number:
+		i, u, f, kind := numberValue(v)
+		switch {
+		case kind == 'u':
+			cborHead(buf, 0, u)
+		case kind == 'i' && i >= 0:
+			cborHead(buf, 0, uint64(i))
+		case kind == 'i':
+			cborHead(buf, 1, uint64(-1-i))
+		default:
+			buf.WriteByte(0xfb)
+			buf.Write(binary.BigEndian.AppendUint64(nil, math.Float64bits(f)))
+		}
+	case string:
+		cborHead(buf, 3, uint64(len(v)))
+		buf.WriteString(v)
+	case []any:
+		cborHead(buf, 4, uint64(len(v)))
+		for _, item := range v {
+			if err := writeCBOR(buf, item); err != nil {
+				return err
+			}
+		}
+	case map[string]any:
+		cborHead(buf, 5, uint64(len(v)))
+		for _, k := range sortedKeys(v) {
+			cborHead(buf, 3, uint64(len(k)))
+			buf.WriteString(k)
+			if err := writeCBOR(buf, v[k]); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("cbor: unsupported value %T", v)
+	}
+	return nil
+}
+
+func encodeMsgpack(v any) ([]byte, error) {
+	generic, err := genericValue(v)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	err = writeMsgpack(&buf, generic)
+	return buf.Bytes(), err
+}
+
+// MessagePack 的字符串、数组和映射头部：fix 格式或 8/16/32 位长度
+func msgpackHead(buf *bytes.Buffer, n int, fix, fixMax byte, b8, b16, b32 byte) {
+	switch {
+	case n <= int(fixMax):
+		buf.WriteByte(fix | byte(n))
+	case b8 != 0 && n <= math.MaxUint8:
+		buf.WriteByte(b8)
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(b16)
+		buf.Write(binary.BigEndian.AppendUint16(nil, uint16(n)))
+	default:
+		buf.WriteByte(b32)
+		buf.Write(binary.BigEndian.AppendUint32(nil, uint32(n)))
+	}
+}
+
+func msgpackString(buf *bytes.Buffer, s string) {
+	msgpackHead(buf, len(s), 0xa0, 31, 0xd9, 0xda, 0xdb)
+	buf.WriteString(s)
+}
+
+func msgpackInt(buf *bytes.Buffer, i int64) {
+	switch {
+	case i >= 0 && i <= math.MaxInt8:
+		buf.WriteByte(byte(i))
+	case i >= 0 && i <= math.MaxUint8:
+		buf.Write([]byte{0xcc, byte(i)})
+	case i >= 0 && i <= math.MaxUint16:
+		buf.WriteByte(0xcd)
+		buf.Write(binary.BigEndian.AppendUint16(nil, uint16(i)))
+	case i >= 0 && i <= math.MaxUint32:
+		buf.WriteByte(0xce)
+		buf.Write(binary.BigEndian.AppendUint32(nil, uint32(i)))
+	case i >= 0:
+		buf.WriteByte(0xcf)
+		buf.Write(binary.BigEndian.AppendUint64(nil, uint64(i)))
+	case i >= -32:
+		buf.WriteByte(byte(i))
+	case i >= math.MinInt8:
+		buf.Write([]byte{0xd0, byte(i)})
+	case i >= math.MinInt16:
+		buf.WriteByte(0xd1)
+		buf.Write(binary.BigEndian.AppendUint16(nil, uint16(i)))
+	case i >= math.MinInt32:
+		buf.WriteByte(0xd2)
+		buf.Write(binary.BigEndian.AppendUint32(nil, uint32(i)))
+	default:
+		buf.WriteByte(0xd3)
+		buf.Write(binary.BigEndian.AppendUint64(nil, uint64(i)))
+	}
+}
+
+func writeMsgpack(buf *bytes.Buffer, v any) error {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+	case bool:
+		if v {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case json.Number:
+		i, u, f, kind := numberValue(v)
+		switch kind {
+		case 'i':
+			msgpackInt(buf, i)
+		case 'u':
+			buf.WriteByte(0xcf)
+			buf.Write(binary.BigEndian.AppendUint64(nil, u))
+		default:
+			buf.WriteByte(0xcb)
+			buf.Write(binary.BigEndian.AppendUint64(nil, math.Float64bits(f)))
+		}
+	case string:
+		msgpackString(buf, v)
+	case []any:
+		msgpackHead(buf, len(v), 0x90, 15, 0, 0xdc, 0xdd)
+		for _, item := range v {
+			if err := writeMsgpack(buf, item); err != nil {
+				return err
+			}
+		}
+	case map[string]any:
+		msgpackHead(buf, len(v), 0x80, 15, 0, 0xde, 0xdf)
+		for _, k := range sortedKeys(v) {
+			msgpackString(buf, k)
+			if err := writeMsgpack(buf, v[k]); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("msgpack: unsupported value %T", v)
+	}
+	return nil
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 用电估算：为目标设置开机功率 watts 和睡眠、关机时的待机功率 standby_watts 后，服务器每分钟记录一次
+// 目标的开关机状态，按天累计开机和关机时长，估算用电量，以及自动睡眠、关机（power_policy 的空闲策略和
+// 定时任务，见 agent.go）省下的电量。
+//
+// 状态优先取开机检测的结果（probe），没有检测时代理正在上报视为开机，代理领取命令后不再上报视为关机，
+// 其他情况不计入。关机前 agentCommandTTL 内领取过自动命令的目标，关机期间计为节省，直到再次开机；
+// 手动发出的命令不算。用电量按目标当前的功率计算，修改功率后历史数据随之变化
+
+const (
+	energyInterval  = time.Minute
+	energyRetention = 400 // 保留的天数
+)
+
+// -energy-price：每千瓦时的电价，用于估算电费，0 表示不计算
+var energyPrice float64
+
+// 目标一天的累计时长，日期为服务器时区
+type EnergyDay struct {
+	Target       string `json:"target"`
+	Date         string `json:"date"` // 2006-01-02
+	OnSeconds    int64  `json:"on_seconds"`
+	OffSeconds   int64  `json:"off_seconds"`
+	SavedSeconds int64  `json:"saved_seconds,omitempty"` // OffSeconds 中由自动睡眠、关机造成的部分
+}
+
+type energyKey struct {
+	target, date string
+}
+
+// 计量器的运行状态，只保存在内存中：服务器重启后，已经自动睡眠的目标要再次开机、自动睡眠后才重新计为节省
+var energyMeter = struct {
+	mu      sync.Mutex
+	state   map[string]string // 目标 -> 上次记录的状态
+	autoOff map[string]bool   // 目标 -> 当前的关机是否由自动命令造成
+	day     string            // 上次清理过期记录的日期
+}{state: make(map[string]string), autoOff: make(map[string]bool)}
+
+func checkEnergySettings() error {
+	if energyPrice < 0 || math.IsNaN(energyPrice) {
+		return fmt.Errorf("-energy-price must not be negative")
+	}
+	return nil
+}
+
+func validateWatts(watts, standby float64) error {
+	switch {
+	case watts < 0 || watts > 10000 || math.IsNaN(watts):
+		return fmt.Errorf("watts must be 0-10000")
+	case standby < 0 || standby > 10000 || math.IsNaN(standby):
+		return fmt.Errorf("standby_watts must be 0-10000")
+	case standby > 0 && watts == 0:
+		return fmt.Errorf("standby_watts requires watts")
+	case standby > watts:
+		return fmt.Errorf("standby_watts must not exceed watts")
+	}
+	return nil
+}
+
+// 自动发出的命令：空闲策略和定时任务
+func automaticCommand(c *AgentCommand) bool {
+	return c != nil && (c.Reason == "idle" || strings.HasPrefix(c.Reason, "schedule:"))
+}
+
+// 目标当前的开关机状态和最近领取的命令，无法判断时状态为 unknown。
+// 高可用模式下代理的状态只保存在收到上报的副本上，主副本只能使用开机检测的结果
+func meteredPower(name string, now time.Time) (string, *AgentCommand) {
+	state := targetPower(name)
+	agents.mu.Lock()
+	defer agents.mu.Unlock()
+	status, ok := agents.status[name]
+	if !ok {
+		return state, nil
+	}
+	last := status.LastCommand
+	if state == powerUnknown {
+		// 领取命令后错过了下一次上报，说明目标已经睡眠或关机
+		delivered := last != nil && last.DeliveredAt != nil && !last.DeliveredAt.Before(status.ReportedAt)
+		switch {
+		case delivered && now.Sub(status.ReportedAt) > 2*agentReportInterval:
+			state = powerOff
+		case now.Sub(status.ReportedAt) <= agentStaleAfter:
+			state = powerOn
+		}
+	}
+	if last != nil {
+		copied := *last
+		last = &copied
+	}
+	return state, last
+}
+
+func runEnergyMeter() {
+	ticker := time.NewTicker(energyInterval)
+	defer ticker.Stop()
+	last := time.Now()
+	for {
+		select {
+		case <-shutdownCh:
+			return
+		case now := <-ticker.C:
+			// 高可用模式下只有主副本累计，记录随状态同步给其他副本
+			if isLeader() {
+				meterEnergy(min(now.Sub(last), 2*energyInterval), now)
+			}
+			last = now
+		}
+	}
+}
+
+// 把最近 elapsed 的时长按各目标当前的状态计入今天的记录
+func meterEnergy(elapsed time.Duration, now time.Time) {
+	seconds := int64(elapsed.Round(time.Second).Seconds())
+	storage.mu.RLock()
+	var names []string
+	for name, t := range storage.targets {
+		if t.Watts > 0 {
+			names = append(names, name)
+		}
+	}
+	storage.mu.RUnlock()
+
+	type sample struct {
+		name  string
+		state string
+		saved bool
+	}
+	var samples []sample
+	energyMeter.mu.Lock()
+	for _, name := range names {
+		state, command := meteredPower(name, now)
+		switch state {
+		case powerOn:
+			energyMeter.autoOff[name] = false
+		case powerOff:
+			if energyMeter.state[name] != powerOff {
+				energyMeter.autoOff[name] = automaticCommand(command) && now.Sub(*command.DeliveredAt) <= agentCommandTTL
+			}
+		default:
+			continue
+		}
+		energyMeter.state[name] = state
+		samples = append(samples, sample{name, state, state == powerOff && energyMeter.autoOff[name]})
+	}
+	today := now.Format(time.DateOnly)
+	prune := energyMeter.day != today
+	energyMeter.day = today
+	energyMeter.mu.Unlock()
+	if len(samples) == 0 && !prune {
+		return
+	}
+
+	storage.mu.Lock()
+	for _, s := range samples {
+		if _, exists := storage.targets[s.name]; !exists {
+			continue
+		}
+		key := energyKey{s.name, today}
+		day, exists := storage.energy[key]
+		if !exists {
+			day = &EnergyDay{Target: s.name, Date: today}
+			storage.energy[key] = day
+		}
+		if s.state == powerOn {
+			day.OnSeconds += seconds
+		} else {
+			day.OffSeconds += seconds
+		}
+		if s.saved {
+			day.SavedSeconds += seconds
+		}
+	}
+	if prune {
+		oldest := now.AddDate(0, 0, -energyRetention).Format(time.DateOnly)
+		for key := range storage.energy {
+			if key.date < oldest {
+				delete(storage.energy, key)
+			}
+		}
+	}
+	storage.mu.Unlock()
+	markDirty()
+}
+
+// 目标改名时移动记录，删除时丢弃。调用方需持有 storage.mu 写锁
+func renameEnergy(oldName, newName string) {
+	for key, day := range storage.energy {
+		if key.target != oldName {
+			continue
+		}
+		delete(storage.energy, key)
+		if newName != "" {
+			day.Target = newName
+			storage.energy[energyKey{newName, key.date}] = day
+		}
+	}
+}
+
+// 一个目标或全部目标在统计范围内的用电
+type EnergyEntry struct {
+	Target       string   `json:"target"`
+	Watts        float64  `json:"watts,omitempty"`
+	StandbyWatts float64  `json:"standby_watts,omitempty"`
+	OnSeconds    int64    `json:"on_seconds"`
+	OffSeconds   int64    `json:"off_seconds"`
+	SavedSeconds int64    `json:"saved_seconds"`
+	UsedKWh      float64  `json:"used_kwh"`
+	SavedKWh     float64  `json:"saved_kwh"` // 节省时段内如果一直开机会多用的电量
+	Cost         *float64 `json:"cost,omitempty"`
+	SavedCost    *float64 `json:"saved_cost,omitempty"`
+}
+
+// 每天全部目标的用电
+type EnergyDayTotal struct {
+	Date     string  `json:"date"`
+	UsedKWh  float64 `json:"used_kwh"`
+	SavedKWh float64 `json:"saved_kwh"`
+}
+
+type EnergyStatsResponse struct {
+	Range   string           `json:"range"`
+	Start   string           `json:"start"` // 第一天的日期
+	End     string           `json:"end"`
+	Price   float64          `json:"price,omitempty"`
+	Total   EnergyEntry      `json:"total"`
+	Targets []EnergyEntry    `json:"targets"`
+	Days    []EnergyDayTotal `json:"days"`
+}
+
+func (e *EnergyEntry) add(day *EnergyDay, watts, standby float64) (used, saved float64) {
+	e.OnSeconds += day.OnSeconds
+	e.OffSeconds += day.OffSeconds
+	e.SavedSeconds += day.SavedSeconds
+	used = (float64(day.OnSeconds)*watts + float64(day.OffSeconds)*standby) / 3.6e6
+	saved = float64(day.SavedSeconds) * (watts - standby) / 3.6e6
+	e.UsedKWh += used
+	e.SavedKWh += saved
+	return used, saved
+}
+
+func roundKWh(v float64) float64 {
+	return math.Round(v*1000) / 1000
+}
+
+func (e *EnergyEntry) finish() {
+	e.UsedKWh, e.SavedKWh = roundKWh(e.UsedKWh), roundKWh(e.SavedKWh)
+	if energyPrice > 0 {
+		cost := math.Round(e.UsedKWh*energyPrice*100) / 100
+		saved := math.Round(e.SavedKWh*energyPrice*100) / 100
+		e.Cost, e.SavedCost = &cost, &saved
+	}
+}
+
+// 用电统计：GET /api/stats/energy?range=30d，按天统计，包含起始时间所在的一天。
+// 只列出设置了 watts、用户能看到的目标
+func energyStatsHandler(w http.ResponseWriter, r *http.Request) {
+	rangeParam := r.URL.Query().Get("range")
+	if rangeParam == "" {
+		rangeParam = "30d"
+	}
+	span, err := parseSpan(rangeParam)
+	if err != nil {
+		http.Error(w, "range must be a duration, e.g. 24h or 30d", http.StatusBadRequest)
+		return
+	}
+	now := time.Now()
+	resp := EnergyStatsResponse{
+		Range: rangeParam,
+		Start: now.Add(-span).Format(time.DateOnly),
+		End:   now.Format(time.DateOnly),
+		Price: energyPrice,
+		Total: EnergyEntry{Target: "total"},
+	}
+
+	p := requestPrincipal(r)
+	entries := make(map[string]*EnergyEntry)
+	days := make(map[string]*EnergyDayTotal)
+	storage.mu.RLock()
+	for name, t := range storage.targets {
+		if t.Watts > 0 && p.targetAccess(t) != "" {
+			entries[name] = &EnergyEntry{Target: name, Watts: t.Watts, StandbyWatts: t.StandbyWatts}
+		}
+	}
+	for key, day := range storage.energy {
+		e, ok := entries[key.target]
+		if !ok || key.date < resp.Start {
+			continue
+		}
+		used, saved := e.add(day, e.Watts, e.StandbyWatts)
+		resp.Total.add(day, e.Watts, e.StandbyWatts)
+		d, ok := days[key.date]
+		if !ok {
+			d = &EnergyDayTotal{Date: key.date}
+			days[key.date] = d
+		}
+		d.UsedKWh += used
+		d.SavedKWh += saved
+	}
+	storage.mu.RUnlock()
+
+	resp.Targets = make([]EnergyEntry, 0, len(entries))
+	for _, e := range entries {
+		e.finish()
+		resp.Targets = append(resp.Targets, *e)
+	}
+	resp.Total.finish()
+	sort.Slice(resp.Targets, func(i, j int) bool { return resp.Targets[i].Target < resp.Targets[j].Target })
+	resp.Days = make([]EnergyDayTotal, 0, len(days))
+	for _, d := range days {
+		d.UsedKWh, d.SavedKWh = roundKWh(d.UsedKWh), roundKWh(d.SavedKWh)
+		resp.Days = append(resp.Days, *d)
+	}
+	sort.Slice(resp.Days, func(i, j int) bool { return resp.Days[i].Date < resp.Days[j].Date })
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// 列表接口的条件请求：响应带弱 ETag（响应体的哈希），请求的 If-None-Match 与之相同时返回 304，
+// 频繁刷新的管理界面和脚本不用重复传输没有变化的数据。浏览器会自动带上 If-None-Match，
+// 返回 304 时使用缓存中的响应体
+
+// 以 200 写出 JSON，响应体与 If-None-Match 匹配时只返回 304
+func writeJSONCached(w http.ResponseWriter, r *http.Request, v interface{}) {
+	if warnings := responseWarnings(w); len(warnings) > 0 {
+		v = withWarnings(v, warnings)
+	}
+	// 不同编码的响应体不同，ETag 也不同
+	contentType, body, err := encodeResponse(w, v)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	sum := sha256.Sum256(body)
+	etag := `W/"` + hex.EncodeToString(sum[:12]) + `"`
+
+	h := w.Header()
+	h.Set("ETag", etag)
+	// 每次都要重新验证；不同密钥看到的列表不同
+	h.Set("Cache-Control", "private, no-cache")
+	addVary(h, "Accept", "X-API-Key", "Authorization")
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	h.Set("Content-Type", contentType)
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+// If-None-Match 使用弱比较：忽略 W/ 前缀，* 匹配任何响应
+func etagMatches(header, etag string) bool {
+	if header == "" {
+		return false
+	}
+	want := strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == want {
+			return true
+		}
+	}
+	return false
+}
+
+// 在 Vary 中加入请求头名称，已经列出的（例如内容协商加入的 Accept）不重复添加
+func addVary(h http.Header, names ...string) {
+	for _, name := range names {
+		listed := false
+		for _, value := range h.Values("Vary") {
+			for _, field := range strings.Split(value, ",") {
+				if strings.EqualFold(strings.TrimSpace(field), name) {
+					listed = true
+				}
+			}
+		}
+		if !listed {
+			h.Add("Vary", name)
+		}
+	}
+}
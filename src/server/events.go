@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 事件类型
+const (
+	eventDeviceRegistered       = "device.registered"
+	eventDeviceOnline           = "device.online"
+	eventDeviceOffline          = "device.offline"
+	eventDeviceApproved         = "device.approved"
+	eventDeviceDeleted          = "device.deleted"
+	eventDeviceStale            = "device.stale"         // 设备即将被自动清理
+	eventDeviceProvisioned      = "device.provisioned"   // 设备用注册码获取了配置
+	eventDeviceCrashed          = "device.crashed"       // 设备上报了异常重启
+	eventDevicePowerChanged     = "device.power_changed" // 设备的供电方式变化（USB/电池）
+	eventMessageQueued          = "message.queued"
+	eventMessageDelivered       = "message.delivered"
+	eventMessageAcked           = "message.acked"
+	eventMessageFailed          = "message.failed"
+	eventMessageCancelled       = "message.cancelled"
+	eventApprovalRequested      = "message.approval_requested" // 受保护目标的唤醒等待批准
+	eventMessageApproved        = "message.approved"           // 受保护目标的唤醒被批准并入队
+	eventMessageRejected        = "message.rejected"           // 受保护目标的唤醒被拒绝或审批超时
+	eventAuthFailureBurst       = "auth.failure_burst"
+	eventTargetUp               = "target.up"                // 检测到目标开机
+	eventTargetDown             = "target.down"              // 检测到目标关机
+	eventTargetFlapping         = "target.flapping"          // 目标的开机状态短时间内反复变化
+	eventTargetPowerOff         = "target.power_off"         // 目标上的代理领取了睡眠或关机命令
+	eventHALeader               = "ha.leader"                // 本副本成为高可用主副本
+	eventQueueBackpressure      = "queue.backpressure"       // 队列超限，开始拒绝唤醒请求
+	eventMaintenance            = "server.maintenance"       // 开启或关闭维护模式
+	eventQueuePurged            = "queue.purged"             // 管理员清空了设备队列
+	eventDeviceIdentityMismatch = "device.identity_mismatch" // 设备请求的身份与绑定的身份不一致
+
+	// 告警事件：由状态持续或重复失败派生
+	eventAlertRelayOffline     = "alert.relay_offline"
+	eventAlertRepeatedFailures = "alert.repeated_failures"
+	eventAlertBootLoop         = "alert.boot_loop"
+	eventAlertLowBattery       = "alert.low_battery"
+)
+
+// 服务器事件
+type Event struct {
+	ID        int64          `json:"id"`
+	Type      string         `json:"type"`
+	Time      time.Time      `json:"time"`
+	DeviceID  string         `json:"device_id,omitempty"`
+	MessageID string         `json:"message_id,omitempty"`
+	Data      map[string]any `json:"data,omitempty"`
+}
+
+// 事件总线：发布不阻塞，订阅者处理不过来时丢弃事件
+type eventBus struct {
+	mu          sync.Mutex
+	nextID      int64
+	subscribers map[chan Event]struct{}
+	recent      []Event // 最近的事件，用于断线重连后补发
+	recentSize  int
+}
+
+func newEventBus(recentSize int) *eventBus {
+	return &eventBus{
+		subscribers: make(map[chan Event]struct{}),
+		recentSize:  recentSize,
+	}
+}
+
+// 全局事件总线
+var events = newEventBus(256)
+
+func (b *eventBus) publish(e Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.nextID++
+	e.ID = b.nextID
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	b.recent = append(b.recent, e)
+	if len(b.recent) > b.recentSize {
+		b.recent = b.recent[len(b.recent)-b.recentSize:]
+	}
+
+	for ch := range b.subscribers {
+		select {
+		case ch <- e:
+		default:
+			slog.Warn("event dropped for slow subscriber", "event_id", e.ID, "type", e.Type)
+		}
+	}
+}
+
+// 订阅事件，返回事件通道、ID大于 afterID 的最近事件以及取消订阅函数
+func (b *eventBus) subscribe(afterID int64) (<-chan Event, []Event, func()) {
+	ch := make(chan Event, 64)
+
+	b.mu.Lock()
+	var backlog []Event
+	if afterID > 0 {
+		for _, e := range b.recent {
+			if e.ID > afterID {
+				backlog = append(backlog, e)
+			}
+		}
+	}
+	b.subscribers[ch] = struct{}{}
+	b.mu.Unlock()
+
+	cancel := func() {
+		b.mu.Lock()
+		delete(b.subscribers, ch)
+		b.mu.Unlock()
+	}
+	return ch, backlog, cancel
+}
+
+// 管理事件流（Server-Sent Events）
+// 可选参数 types=device.offline,message.acked 过滤事件类型；
+// 断线重连时浏览器会带上 Last-Event-ID，补发期间错过的事件
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	var types map[string]bool
+	if value := r.URL.Query().Get("types"); value != "" {
+		types = parseRouteList(value)
+	}
+	lastID, _ := strconv.ParseInt(r.Header.Get("Last-Event-ID"), 10, 64)
+
+	ch, backlog, cancel := events.subscribe(lastID)
+	defer cancel()
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(e Event) error {
+		if types != nil && !types[e.Type] {
+			return nil
+		}
+		data, _ := json.Marshal(e)
+		if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+
+	for _, e := range backlog {
+		if err := send(e); err != nil {
+			return
+		}
+	}
+	fmt.Fprint(w, ": connected\n\n")
+	rc.Flush()
+
+	heartbeat := time.NewTicker(15 * time.Second)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case e := <-ch:
+			if err := send(e); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			rc.Flush()
+		case <-r.Context().Done():
+			return
+		case <-shutdownCh:
+			return
+		}
+	}
+}
+
+// 自动清理长期未出现的设备（-purge-devices-after，0 表示不清理），
+// 清理前 purgeDevicesGrace 发布 device.stale 事件，设备在此期间轮询即可保留
+var (
+	purgeDevicesAfter time.Duration
+	purgeDevicesGrace = 24 * time.Hour
+)
+
+func checkPurgeSettings() error {
+	if purgeDevicesAfter < 0 || purgeDevicesGrace < 0 {
+		return errors.New("-purge-devices-after and -purge-grace must not be negative")
+	}
+	if purgeDevicesAfter > 0 && purgeDevicesGrace >= purgeDevicesAfter {
+		return errors.New("-purge-grace must be shorter than -purge-devices-after")
+	}
+	return nil
+}
+
+// 定期检查设备在线状态，超过 offlineAfter 未轮询的设备标记为离线；
+// 开启自动清理时删除超过 purgeDevicesAfter 未出现的设备
+func runDeviceMonitor(offlineAfter time.Duration) {
+	interval := offlineAfter / 10
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-shutdownCh:
+			return
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+		// 高可用模式下每个副本都更新在线状态，只有主副本发布离线事件和告警
+		leader := isLeader()
+		var purged []*Device
+		storage.mu.Lock()
+		for id, device := range storage.devices {
+			if device.Online && now.Sub(device.LastSeen) > offlineAfter {
+				device.Online = false
+				if leader {
+					slog.Warn("device offline", "device_id", id, "last_seen", device.LastSeen)
+					events.publish(Event{Type: eventDeviceOffline, DeviceID: id, Data: map[string]any{
+						"name":      device.Name,
+						"last_seen": device.LastSeen,
+					}})
+				}
+			}
+			if leader && !device.Online && !device.offlineAlerted && alertOfflineAfter > 0 && now.Sub(device.LastSeen) > alertOfflineAfter {
+				device.offlineAlerted = true
+				events.publish(Event{Type: eventAlertRelayOffline, DeviceID: id, Data: map[string]any{
+					"name":            device.Name,
+					"last_seen":       device.LastSeen,
+					"offline_minutes": int(now.Sub(device.LastSeen).Minutes()),
+				}})
+			}
+			if purgeDevicesAfter > 0 {
+				// 只删除至少提前 purgeDevicesGrace 发出过提醒的设备：提醒时间只保存在内存中，
+				// 重启或切换主副本后已超期的设备也先提醒，等待一个 purgeDevicesGrace 再删除
+				unseen := now.Sub(device.LastSeen)
+				switch {
+				case unseen < purgeDevicesAfter-purgeDevicesGrace:
+					device.staleNotifiedAt = time.Time{}
+				case !leader:
+				case device.staleNotifiedAt.IsZero():
+					device.staleNotifiedAt = now
+					purgeAt := device.LastSeen.Add(purgeDevicesAfter)
+					if earliest := now.Add(purgeDevicesGrace); purgeAt.Before(earliest) {
+						purgeAt = earliest
+					}
+					events.publish(Event{Type: eventDeviceStale, DeviceID: id, Data: map[string]any{
+						"name":      device.Name,
+						"last_seen": device.LastSeen,
+						"purge_at":  purgeAt,
+					}})
+				case unseen >= purgeDevicesAfter && now.Sub(device.staleNotifiedAt) >= purgeDevicesGrace:
+					purged = append(purged, device)
+				}
+			}
+		}
+		for _, device := range purged {
+			dropped := removeDevice(device.ID, "device purged")
+			// 删除的设备只在这条日志和 device.deleted 事件中留下记录
+			slog.Warn("stale device purged", "device_id", device.ID, "name", device.Name, "mac_address", device.MacAddress,
+				"last_seen", device.LastSeen, "purge_after", purgeDevicesAfter.String(), "dropped_messages", dropped)
+			events.publish(Event{Type: eventDeviceDeleted, DeviceID: device.ID, Data: map[string]any{
+				"name":             device.Name,
+				"reason":           "stale",
+				"last_seen":        device.LastSeen,
+				"dropped_messages": dropped,
+			}})
+		}
+		storage.mu.Unlock()
+		if len(purged) > 0 {
+			markDirty()
+		}
+	}
+}
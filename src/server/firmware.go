@@ -0,0 +1,404 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 固件托管：管理员把固件上传到命名通道（stable、beta 等），服务器保存 SHA-256 和大小，
+// 设备定期查询清单获取所在通道可用的最新版本。每个版本可以按设备标签和百分比逐步放量。
+// 固件文件保存在 -firmware-dir 中，元数据保存在状态文件里
+
+type Firmware struct {
+	ID        string    `json:"id"`
+	Channel   string    `json:"channel"`
+	Version   string    `json:"version"`
+	Size      int64     `json:"size"`
+	SHA256    string    `json:"sha256"`
+	Notes     string    `json:"notes,omitempty"`
+	Rollout   Rollout   `json:"rollout"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// 放量范围：设备需带有 tags 之一（为空表示不限），并落在前 percent% 的设备中
+type Rollout struct {
+	Percent int      `json:"percent"`
+	Tags    []string `json:"tags,omitempty"`
+}
+
+// 设备查询到的更新
+type FirmwareManifest struct {
+	UpdateAvailable bool   `json:"update_available"`
+	Channel         string `json:"channel"`
+	CurrentVersion  string `json:"current_version,omitempty"`
+	Version         string `json:"version,omitempty"`
+	Size            int64  `json:"size,omitempty"`
+	SHA256          string `json:"sha256,omitempty"`
+	URL             string `json:"url,omitempty"`
+	Notes           string `json:"notes,omitempty"`
+}
+
+const defaultFirmwareChannel = "stable"
+
+var (
+	// 固件文件目录（-firmware-dir），为空时不启用固件托管
+	firmwareDir string
+	// 单个固件文件的大小上限（-firmware-max-size）
+	firmwareMaxSize int64 = 16 << 20
+)
+
+func firmwarePath(id string) string {
+	return filepath.Join(firmwareDir, id+".bin")
+}
+
+// 设备在放量百分比中的位置（0-99），同一设备在各个版本中位置不变，先收到更新的总是同一批设备
+func rolloutBucket(deviceID string) int {
+	h := fnv.New32a()
+	h.Write([]byte(deviceID))
+	return int(h.Sum32() % 100)
+}
+
+func (ro Rollout) includes(d *Device) bool {
+	if len(ro.Tags) > 0 && !slices.ContainsFunc(ro.Tags, func(tag string) bool { return slices.Contains(d.Tags, tag) }) {
+		return false
+	}
+	return rolloutBucket(d.ID) < ro.Percent
+}
+
+func (ro Rollout) validate() error {
+	if ro.Percent < 0 || ro.Percent > 100 {
+		return errors.New("rollout percent must be between 0 and 100")
+	}
+	for _, tag := range ro.Tags {
+		if !namePattern.MatchString(tag) {
+			return fmt.Errorf("invalid tag %q", tag)
+		}
+	}
+	return nil
+}
+
+// 通道中的版本，新版本在前。调用方持有 storage.mu
+func channelReleases(channel string) []*Firmware {
+	var releases []*Firmware
+	for _, f := range storage.firmware {
+		if f.Channel == channel {
+			releases = append(releases, f)
+		}
+	}
+	sort.Slice(releases, func(i, j int) bool { return releases[i].CreatedAt.After(releases[j].CreatedAt) })
+	return releases
+}
+
+// 为设备选择更新：从新到旧找第一个放量范围包含该设备的版本；先遇到设备当前版本时
+// 不再往下找，避免降级。调用方持有 storage.mu
+func selectFirmware(d *Device, channel, current string) *Firmware {
+	for _, f := range channelReleases(channel) {
+		if f.Version == current {
+			return nil
+		}
+		if f.Rollout.includes(d) {
+			return f
+		}
+	}
+	return nil
+}
+
+// 固件清单：GET /api/firmware/manifest?device_id=<id>[&version=<当前版本>][&channel=<通道>]。
+// 管理员为设备指定的通道优先于请求中的 channel，都没有时为 stable
+func firmwareManifestHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	deviceID := query.Get("device_id")
+	if deviceID == "" {
+		http.Error(w, "device_id is required", http.StatusBadRequest)
+		return
+	}
+	p := requestPrincipal(r)
+
+	storage.mu.RLock()
+	device, exists := storage.devices[deviceID]
+	if !exists || !p.owns(device.Owner) {
+		storage.mu.RUnlock()
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+	channel := device.FirmwareChannel
+	if channel == "" {
+		channel = query.Get("channel")
+	}
+	if channel == "" {
+		channel = defaultFirmwareChannel
+	}
+	current := query.Get("version")
+	if current == "" {
+		current = device.Version
+	}
+	manifest := FirmwareManifest{Channel: channel, CurrentVersion: current}
+	if f := selectFirmware(device, channel, current); f != nil {
+		manifest.UpdateAvailable = true
+		manifest.Version = f.Version
+		manifest.Size = f.Size
+		manifest.SHA256 = f.SHA256
+		manifest.Notes = f.Notes
+		manifest.URL = externalURL(r, "/api/firmware/download/"+f.ID)
+	}
+	storage.mu.RUnlock()
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, manifest)
+}
+
+// 下载固件：GET /api/firmware/download/<id>，响应头 X-Checksum-SHA256 为文件的 SHA-256
+func firmwareDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	id, _ := pathParams(r, "/api/firmware/download/")
+	storage.mu.RLock()
+	f, exists := storage.firmware[id]
+	var fw Firmware
+	if exists {
+		fw = *f
+	}
+	storage.mu.RUnlock()
+	if !exists || firmwareDir == "" {
+		http.Error(w, "Firmware not found", http.StatusNotFound)
+		return
+	}
+	file, err := os.Open(firmwarePath(fw.ID))
+	if err != nil {
+		requestLogger(r).Error("firmware file missing", "firmware_id", fw.ID, "error", err)
+		http.Error(w, "Firmware file not available", http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("X-Checksum-SHA256", fw.SHA256)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "esp32-wol-"+fw.Version+".bin"))
+	http.ServeContent(w, r, "", fw.CreatedAt, file)
+}
+
+// 固件列表和上传：GET /api/admin/firmware[?channel=]，
+// POST /api/admin/firmware?channel=stable&version=1.2.0[&notes=][&percent=100][&tags=a,b]，请求体为固件文件
+func firmwareListHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		channel := r.URL.Query().Get("channel")
+		storage.mu.RLock()
+		list := make([]Firmware, 0, len(storage.firmware))
+		for _, f := range storage.firmware {
+			if channel == "" || f.Channel == channel {
+				copied := *f
+				copied.Rollout.Tags = append([]string(nil), f.Rollout.Tags...)
+				list = append(list, copied)
+			}
+		}
+		storage.mu.RUnlock()
+		sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.After(list[j].CreatedAt) })
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"success":  true,
+			"firmware": list,
+			"total":    len(list),
+		})
+
+	case http.MethodPost:
+		uploadFirmware(w, r)
+
+	default:
+		methodNotAllowed(w, r)
+	}
+}
+
+func uploadFirmware(w http.ResponseWriter, r *http.Request) {
+	if firmwareDir == "" {
+		http.Error(w, "Firmware hosting is disabled, start the server with -firmware-dir", http.StatusServiceUnavailable)
+		return
+	}
+	query := r.URL.Query()
+	f := &Firmware{
+		ID:        "fw_" + randomHex(8),
+		Channel:   query.Get("channel"),
+		Version:   query.Get("version"),
+		Notes:     query.Get("notes"),
+		Rollout:   Rollout{Percent: 100},
+		CreatedAt: time.Now(),
+	}
+	if f.Channel == "" {
+		f.Channel = defaultFirmwareChannel
+	}
+	if !namePattern.MatchString(f.Channel) {
+		http.Error(w, "channel must be 1-64 letters, digits, '.', '_' or '-'", http.StatusBadRequest)
+		return
+	}
+	if !namePattern.MatchString(f.Version) {
+		http.Error(w, "version is required (1-64 letters, digits, '.', '_' or '-')", http.StatusBadRequest)
+		return
+	}
+	if v := query.Get("percent"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, "percent must be a number", http.StatusBadRequest)
+			return
+		}
+		f.Rollout.Percent = n
+	}
+	if v := query.Get("tags"); v != "" {
+		f.Rollout.Tags = strings.Split(v, ",")
+	}
+	if err := f.Rollout.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	storage.mu.RLock()
+	duplicate := false
+	for _, existing := range storage.firmware {
+		duplicate = duplicate || (existing.Channel == f.Channel && existing.Version == f.Version)
+	}
+	storage.mu.RUnlock()
+	if duplicate {
+		http.Error(w, fmt.Sprintf("version %s already exists in channel %s", f.Version, f.Channel), http.StatusConflict)
+		return
+	}
+
+	// 先写临时文件，边写边计算校验和，完成后再改名
+	if err := os.MkdirAll(firmwareDir, 0o755); err != nil {
+		requestLogger(r).Error("cannot create firmware directory", "dir", firmwareDir, "error", err)
+		http.Error(w, "Cannot store firmware", http.StatusInternalServerError)
+		return
+	}
+	tmp, err := os.CreateTemp(firmwareDir, "upload-*.tmp")
+	if err != nil {
+		requestLogger(r).Error("cannot store firmware", "error", err)
+		http.Error(w, "Cannot store firmware", http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	sum := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, sum), http.MaxBytesReader(w, r.Body, firmwareMaxSize))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		http.Error(w, fmt.Sprintf("firmware larger than %d bytes", firmwareMaxSize), http.StatusRequestEntityTooLarge)
+		return
+	case err != nil:
+		requestLogger(r).Error("firmware upload failed", "error", err)
+		http.Error(w, "Firmware upload failed", http.StatusBadRequest)
+		return
+	case size == 0:
+		http.Error(w, "request body must contain the firmware image", http.StatusBadRequest)
+		return
+	}
+	f.Size = size
+	f.SHA256 = hex.EncodeToString(sum.Sum(nil))
+	if expected := query.Get("sha256"); expected != "" && !strings.EqualFold(expected, f.SHA256) {
+		http.Error(w, "sha256 does not match the uploaded file", http.StatusBadRequest)
+		return
+	}
+	if err := os.Rename(tmp.Name(), firmwarePath(f.ID)); err != nil {
+		requestLogger(r).Error("cannot store firmware", "error", err)
+		http.Error(w, "Cannot store firmware", http.StatusInternalServerError)
+		return
+	}
+
+	storage.mu.Lock()
+	storage.firmware[f.ID] = f
+	created := *f
+	storage.mu.Unlock()
+
+	markDirty()
+	requestLogger(r).Info("firmware uploaded", "firmware_id", f.ID, "channel", f.Channel, "version", f.Version, "size", f.Size, "sha256", f.SHA256)
+	writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"success":  true,
+		"message":  "Firmware uploaded",
+		"firmware": created,
+	})
+}
+
+// 单个固件：GET/DELETE /api/admin/firmware/<id>，PUT {"notes", "rollout": {"percent", "tags"}} 调整放量
+func firmwareHandler(w http.ResponseWriter, r *http.Request) {
+	id, _ := pathParams(r, "/api/admin/firmware/")
+	switch r.Method {
+	case http.MethodGet:
+		storage.mu.RLock()
+		f, exists := storage.firmware[id]
+		var fw Firmware
+		if exists {
+			fw = *f
+			fw.Rollout.Tags = append([]string(nil), f.Rollout.Tags...)
+		}
+		storage.mu.RUnlock()
+		if !exists {
+			http.Error(w, "Firmware not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"success": true, "firmware": fw})
+
+	case http.MethodPut:
+		var req struct {
+			Notes   *string  `json:"notes"`
+			Rollout *Rollout `json:"rollout"`
+		}
+		if !readJSON(w, r, &req) {
+			return
+		}
+		if req.Rollout != nil {
+			if err := req.Rollout.validate(); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		storage.mu.Lock()
+		f, exists := storage.firmware[id]
+		if !exists {
+			storage.mu.Unlock()
+			http.Error(w, "Firmware not found", http.StatusNotFound)
+			return
+		}
+		if req.Notes != nil {
+			f.Notes = *req.Notes
+		}
+		if req.Rollout != nil {
+			f.Rollout = *req.Rollout
+		}
+		fw := *f
+		storage.mu.Unlock()
+
+		markDirty()
+		requestLogger(r).Info("firmware rollout updated", "firmware_id", id, "percent", fw.Rollout.Percent, "tags", fw.Rollout.Tags)
+		writeJSON(w, http.StatusOK, map[string]interface{}{"success": true, "message": "Firmware updated", "firmware": fw})
+
+	case http.MethodDelete:
+		storage.mu.Lock()
+		_, exists := storage.firmware[id]
+		delete(storage.firmware, id)
+		storage.mu.Unlock()
+		if !exists {
+			http.Error(w, "Firmware not found", http.StatusNotFound)
+			return
+		}
+		if firmwareDir != "" {
+			if err := os.Remove(firmwarePath(id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+				slog.Warn("cannot remove firmware file", "firmware_id", id, "error", err)
+			}
+		}
+		markDirty()
+		requestLogger(r).Info("firmware deleted", "firmware_id", id)
+		writeJSON(w, http.StatusOK, map[string]interface{}{"success": true, "message": "Firmware deleted"})
+
+	default:
+		methodNotAllowed(w, r)
+	}
+}
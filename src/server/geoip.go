@@ -0,0 +1,471 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GeoIP：-geoip 指定本地的 MaxMind DB（.mmdb）文件后，请求日志、认证失败日志和 auth.failure_burst 事件
+// 附带客户端地址所属的国家和自治系统（ASN），便于发现暴露在公网上的实例被异常访问。
+// 支持 GeoLite2/GeoIP2 的 Country、City、ASN 库以及 DB-IP 的同格式库，多个文件用逗号分隔，
+// 各文件的结果合并（例如 Country 库提供国家，ASN 库提供自治系统）。
+// 查询完全在本地进行；文件被 geoipupdate 等工具替换后每小时自动重新载入
+
+// 地址的地理信息，查不到的字段为空
+type geoInfo struct {
+	Country string // ISO 3166-1 两字母代码
+	ASN     uint64
+	Org     string // 自治系统的组织名称
+}
+
+// 日志字段
+func (g geoInfo) attrs() []any {
+	var attrs []any
+	if g.Country != "" {
+		attrs = append(attrs, "geo_country", g.Country)
+	}
+	if g.ASN != 0 {
+		attrs = append(attrs, "geo_asn", g.ASN)
+	}
+	return attrs
+}
+
+type geoIPResolver struct {
+	paths []string
+
+	mu      sync.RWMutex
+	dbs     []*mmdbReader
+	modTime []time.Time
+	lastErr error
+}
+
+// 未设置 -geoip 时为 nil
+var geoIP *geoIPResolver
+
+func openGeoIP(list string) (*geoIPResolver, error) {
+	g := &geoIPResolver{}
+	for _, path := range strings.Split(list, ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			g.paths = append(g.paths, path)
+		}
+	}
+	if len(g.paths) == 0 {
+		return nil, errors.New("no database files")
+	}
+	if err := g.load(); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// 载入全部数据库，任一文件出错时保留之前载入的数据
+func (g *geoIPResolver) load() error {
+	dbs := make([]*mmdbReader, 0, len(g.paths))
+	modTimes := make([]time.Time, 0, len(g.paths))
+	for _, path := range g.paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		db, err := parseMMDB(data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		dbs = append(dbs, db)
+		modTimes = append(modTimes, info.ModTime())
+	}
+	g.mu.Lock()
+	g.dbs, g.modTime = dbs, modTimes
+	g.mu.Unlock()
+	return nil
+}
+
+// 文件修改时间变化时重新载入
+func (g *geoIPResolver) reloadIfChanged() {
+	g.mu.RLock()
+	changed := false
+	for i, path := range g.paths {
+		if info, err := os.Stat(path); err == nil && !info.ModTime().Equal(g.modTime[i]) {
+			changed = true
+		}
+	}
+	g.mu.RUnlock()
+	if !changed {
+		return
+	}
+	err := g.load()
+	g.mu.Lock()
+	g.lastErr = err
+	g.mu.Unlock()
+	if err != nil {
+		slog.Error("failed to reload geoip database", "error", err)
+		return
+	}
+	slog.Info("geoip database reloaded", "files", len(g.paths))
+}
+
+func (g *geoIPResolver) run() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-shutdownCh:
+			return
+		case <-ticker.C:
+			g.reloadIfChanged()
+		}
+	}
+}
+
+func (g *geoIPResolver) check() ComponentHealth {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	if g.lastErr != nil {
+		return ComponentHealth{Status: healthDegraded, Detail: "reload failed: " + g.lastErr.Error()}
+	}
+	return ComponentHealth{Status: healthOK, Detail: fmt.Sprintf("%d database(s)", len(g.dbs))}
+}
+
+func (g *geoIPResolver) lookup(addr netip.Addr) geoInfo {
+	var info geoInfo
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	for _, db := range g.dbs {
+		record, err := db.lookup(addr)
+		if err != nil || record == nil {
+			continue
+		}
+		if info.Country == "" {
+			info.Country = firstNonEmpty(mmdbText(record, "country", "iso_code"), mmdbText(record, "registered_country", "iso_code"))
+		}
+		if info.ASN == 0 {
+			info.ASN, _ = mmdbValue(record, "autonomous_system_number").(uint64)
+			info.Org = mmdbText(record, "autonomous_system_organization")
+		}
+	}
+	return info
+}
+
+// 查询客户端地址（或 IPv6 聚合后的网段）的地理信息，未开启 GeoIP 或地址无法解析时返回空值
+func lookupGeo(ip string) geoInfo {
+	if geoIP == nil {
+		return geoInfo{}
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		prefix, err := netip.ParsePrefix(ip)
+		if err != nil {
+			return geoInfo{}
+		}
+		addr = prefix.Addr()
+	}
+	return geoIP.lookup(addr.Unmap())
+}
+
+// 按路径取嵌套 map 中的值
+func mmdbValue(v any, path ...string) any {
+	for _, key := range path {
+		m, ok := v.(map[string]any)
+		if !ok {
+			return nil
+		}
+		v = m[key]
+	}
+	return v
+}
+
+func mmdbText(v any, path ...string) string {
+	s, _ := mmdbValue(v, path...).(string)
+	return s
+}
+
+// MaxMind DB 格式的最小实现：https://maxmind.github.io/MaxMind-DB/
+// 只支持查询，数据整体读入内存
+
+var mmdbMetadataMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+
+var errMMDBCorrupt = errors.New("invalid or corrupt MaxMind DB file")
+
+type mmdbReader struct {
+	tree       []byte
+	data       []byte
+	nodeCount  uint64
+	recordSize uint64
+	ipVersion  uint64
+	ipv4Start  uint64 // IPv6 库中 ::/96 对应的节点
+}
+
+func parseMMDB(file []byte) (*mmdbReader, error) {
+	// 元数据在文件最后 128KiB 内，以标记开头
+	start := 0
+	if len(file) > 128*1024 {
+		start = len(file) - 128*1024
+	}
+	i := bytes.LastIndex(file[start:], mmdbMetadataMarker)
+	if i < 0 {
+		return nil, errors.New("not a MaxMind DB file")
+	}
+	metaStart := start + i + len(mmdbMetadataMarker)
+	meta, _, err := (&mmdbDecoder{buf: file[metaStart:]}).decode(0, 0)
+	if err != nil {
+		return nil, err
+	}
+	db := &mmdbReader{}
+	db.nodeCount, _ = mmdbValue(meta, "node_count").(uint64)
+	db.recordSize, _ = mmdbValue(meta, "record_size").(uint64)
+	db.ipVersion, _ = mmdbValue(meta, "ip_version").(uint64)
+	if db.recordSize != 24 && db.recordSize != 28 && db.recordSize != 32 {
+		return nil, fmt.Errorf("unsupported record size %d", db.recordSize)
+	}
+	if db.ipVersion != 4 && db.ipVersion != 6 {
+		return nil, fmt.Errorf("unsupported ip version %d", db.ipVersion)
+	}
+	treeSize := db.nodeCount * db.recordSize / 4
+	// 搜索树之后是16字节的零，然后是数据区
+	if db.nodeCount == 0 || treeSize+16 > uint64(start+i) {
+		return nil, errMMDBCorrupt
+	}
+	db.tree = file[:treeSize]
+	db.data = file[treeSize+16 : start+i]
+
+	if db.ipVersion == 6 {
+		node := uint64(0)
+		for j := 0; j < 96 && node < db.nodeCount; j++ {
+			node = db.record(node, 0)
+		}
+		db.ipv4Start = node
+	}
+	return db, nil
+}
+
+// 节点的左（bit 为 0）或右记录
+func (db *mmdbReader) record(node uint64, bit int) uint64 {
+	b := db.tree[node*db.recordSize/4:]
+	switch db.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint64(b[0])<<16 | uint64(b[1])<<8 | uint64(b[2])
+	case 28:
+		if bit == 0 {
+			return uint64(b[3]&0xF0)<<20 | uint64(b[0])<<16 | uint64(b[1])<<8 | uint64(b[2])
+		}
+		return uint64(b[3]&0x0F)<<24 | uint64(b[4])<<16 | uint64(b[5])<<8 | uint64(b[6])
+	default:
+		return uint64(binary.BigEndian.Uint32(b[bit*4:]))
+	}
+}
+
+// 查询地址对应的记录，没有记录时返回 nil
+func (db *mmdbReader) lookup(addr netip.Addr) (any, error) {
+	var ip []byte
+	node := uint64(0)
+	switch {
+	case addr.Is4() && db.ipVersion == 6:
+		b := addr.As4()
+		ip, node = b[:], db.ipv4Start
+	case addr.Is4():
+		b := addr.As4()
+		ip = b[:]
+	case db.ipVersion == 4:
+		return nil, nil
+	default:
+		b := addr.As16()
+		ip = b[:]
+	}
+	for i := 0; i < len(ip)*8 && node < db.nodeCount; i++ {
+		bit := int(ip[i/8]>>(7-uint(i%8))) & 1
+		node = db.record(node, bit)
+	}
+	if node == db.nodeCount {
+		return nil, nil
+	}
+	if node < db.nodeCount {
+		return nil, errMMDBCorrupt
+	}
+	offset := node - db.nodeCount - 16
+	if offset >= uint64(len(db.data)) {
+		return nil, errMMDBCorrupt
+	}
+	value, _, err := (&mmdbDecoder{buf: db.data}).decode(offset, 0)
+	return value, err
+}
+
+// 数据区解码器，指针相对于 buf 的开头
+type mmdbDecoder struct {
+	buf []byte
+}
+
+const (
+	mmdbTypePointer = 1
+	mmdbTypeString  = 2
+	mmdbTypeDouble  = 3
+	mmdbTypeBytes   = 4
+	mmdbTypeUint16  = 5
+	mmdbTypeUint32  = 6
+	mmdbTypeMap     = 7
+	mmdbTypeInt32   = 8
+	mmdbTypeUint64  = 9
+	mmdbTypeUint128 = 10
+	mmdbTypeArray   = 11
+	mmdbTypeBool    = 14
+	mmdbTypeFloat   = 15
+)
+
+func (d *mmdbDecoder) take(offset, n uint64) ([]byte, error) {
+	if offset+n > uint64(len(d.buf)) || offset+n < offset {
+		return nil, errMMDBCorrupt
+	}
+	return d.buf[offset : offset+n], nil
+}
+
+// 解码 offset 处的值，返回值和下一个值的位置
+func (d *mmdbDecoder) decode(offset uint64, depth int) (any, uint64, error) {
+	if depth > 32 {
+		return nil, 0, errMMDBCorrupt
+	}
+	b, err := d.take(offset, 1)
+	if err != nil {
+		return nil, 0, err
+	}
+	ctrl := b[0]
+	offset++
+	kind := int(ctrl >> 5)
+
+	if kind == mmdbTypePointer {
+		n := uint64(ctrl>>3&3) + 1
+		p, err := d.take(offset, n)
+		if err != nil {
+			return nil, 0, err
+		}
+		v := uint64(ctrl & 7)
+		var target uint64
+		switch n {
+		case 1:
+			target = v<<8 | uint64(p[0])
+		case 2:
+			target = (v<<16 | uint64(p[0])<<8 | uint64(p[1])) + 2048
+		case 3:
+			target = (v<<24 | uint64(p[0])<<16 | uint64(p[1])<<8 | uint64(p[2])) + 526336
+		default:
+			target = uint64(binary.BigEndian.Uint32(p))
+		}
+		value, _, err := d.decode(target, depth+1)
+		return value, offset + n, err
+	}
+
+	if kind == 0 {
+		ext, err := d.take(offset, 1)
+		if err != nil {
+			return nil, 0, err
+		}
+		kind = 7 + int(ext[0])
+		offset++
+	}
+	size := uint64(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		s, err := d.take(offset, n)
+		if err != nil {
+			return nil, 0, err
+		}
+		offset += n
+		switch n {
+		case 1:
+			size = 29 + uint64(s[0])
+		case 2:
+			size = 285 + (uint64(s[0])<<8 | uint64(s[1]))
+		default:
+			size = 65821 + (uint64(s[0])<<16 | uint64(s[1])<<8 | uint64(s[2]))
+		}
+	}
+
+	switch kind {
+	case mmdbTypeMap:
+		m := make(map[string]any, size)
+		for i := uint64(0); i < size; i++ {
+			key, next, err := d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			k, ok := key.(string)
+			if !ok {
+				return nil, 0, errMMDBCorrupt
+			}
+			value, next, err := d.decode(next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[k] = value
+			offset = next
+		}
+		return m, offset, nil
+	case mmdbTypeArray:
+		a := make([]any, 0, size)
+		for i := uint64(0); i < size; i++ {
+			value, next, err := d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, value)
+			offset = next
+		}
+		return a, offset, nil
+	case mmdbTypeBool:
+		return size != 0, offset, nil
+	}
+
+	raw, err := d.take(offset, size)
+	if err != nil {
+		return nil, 0, err
+	}
+	offset += size
+	switch kind {
+	case mmdbTypeString:
+		return string(raw), offset, nil
+	case mmdbTypeBytes, mmdbTypeUint128:
+		return append([]byte(nil), raw...), offset, nil
+	case mmdbTypeDouble:
+		if size != 8 {
+			return nil, 0, errMMDBCorrupt
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(raw)), offset, nil
+	case mmdbTypeFloat:
+		if size != 4 {
+			return nil, 0, errMMDBCorrupt
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(raw))), offset, nil
+	case mmdbTypeUint16, mmdbTypeUint32, mmdbTypeUint64:
+		if size > 8 {
+			return nil, 0, errMMDBCorrupt
+		}
+		var n uint64
+		for _, c := range raw {
+			n = n<<8 | uint64(c)
+		}
+		return n, offset, nil
+	case mmdbTypeInt32:
+		if size > 4 {
+			return nil, 0, errMMDBCorrupt
+		}
+		var n uint32
+		for _, c := range raw {
+			n = n<<8 | uint32(c)
+		}
+		return int64(int32(n)), offset, nil
+	default:
+		return nil, 0, errMMDBCorrupt
+	}
+}
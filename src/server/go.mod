@@ -0,0 +1,3 @@
+module esp32-wol
+
+go 1.22
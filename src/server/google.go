@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sort"
+)
+
+// Google Home 智能家居 fulfillment：每个命名目标是一个支持 OnOff 的开关。
+// 平台通过 OAuth 账号关联获得访问令牌，请求带 Authorization: Bearer <token>。
+// 打开即唤醒，执行结果为 PENDING，直到中继确认；关闭会取消尚未下发的唤醒
+
+// 所有目标属于同一个用户
+const googleAgentUserID = "esp32-wol"
+
+type googleRequest struct {
+	RequestID string `json:"requestId"`
+	Inputs    []struct {
+		Intent  string          `json:"intent"`
+		Payload json.RawMessage `json:"payload"`
+	} `json:"inputs"`
+}
+
+type googleDeviceRef struct {
+	ID string `json:"id"`
+}
+
+// QUERY 请求
+type googleQueryPayload struct {
+	Devices []googleDeviceRef `json:"devices"`
+}
+
+// EXECUTE 请求
+type googleExecutePayload struct {
+	Commands []struct {
+		Devices   []googleDeviceRef `json:"devices"`
+		Execution []struct {
+			Command string `json:"command"`
+			Params  struct {
+				On *bool `json:"on"`
+			} `json:"params"`
+		} `json:"execution"`
+	} `json:"commands"`
+}
+
+// EXECUTE 中单个设备的执行结果
+type googleCommandResult struct {
+	IDs       []string       `json:"ids"`
+	Status    string         `json:"status"` // SUCCESS | PENDING | OFFLINE | ERROR
+	States    map[string]any `json:"states,omitempty"`
+	ErrorCode string         `json:"errorCode,omitempty"`
+}
+
+// 处理 Google 智能家居请求：POST /api/google/fulfillment
+func googleFulfillmentHandler(w http.ResponseWriter, r *http.Request) {
+	grantID, err := bearerGrant(r)
+	if err != nil {
+		requestLogger(r).Warn("google fulfillment authentication failed", "client_ip", clientIP(r))
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_token"})
+		return
+	}
+
+	var req googleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Inputs) == 0 {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	input := req.Inputs[0]
+	logger := requestLogger(r).With("grant_id", grantID)
+
+	var payload any
+	switch input.Intent {
+	case "action.devices.SYNC":
+		payload = map[string]any{"agentUserId": googleAgentUserID, "devices": googleSync()}
+
+	case "action.devices.QUERY":
+		var q googleQueryPayload
+		json.Unmarshal(input.Payload, &q)
+		devices := make(map[string]any, len(q.Devices))
+		for _, d := range q.Devices {
+			state, found := googleState(d.ID)
+			if !found {
+				devices[d.ID] = map[string]any{"status": "ERROR", "errorCode": "deviceNotFound"}
+				continue
+			}
+			state["status"] = "SUCCESS"
+			devices[d.ID] = state
+		}
+		payload = map[string]any{"devices": devices}
+
+	case "action.devices.EXECUTE":
+		var e googleExecutePayload
+		json.Unmarshal(input.Payload, &e)
+		results := []googleCommandResult{}
+		for _, cmd := range e.Commands {
+			for _, exec := range cmd.Execution {
+				for _, d := range cmd.Devices {
+					results = append(results, googleExecute(logger, d.ID, exec.Command, exec.Params.On))
+				}
+			}
+		}
+		payload = map[string]any{"commands": results}
+
+	case "action.devices.DISCONNECT":
+		// 用户在 Google Home 中解除关联
+		revokeOAuthGrant(grantID)
+		logger.Info("oauth grant revoked by google disconnect")
+		writeJSON(w, http.StatusOK, map[string]any{})
+		return
+
+	default:
+		logger.Warn("unsupported google intent", "intent", input.Intent)
+		payload = map[string]any{"errorCode": "notSupported"}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"requestId": req.RequestID, "payload": payload})
+}
+
+// SYNC 响应中的设备列表
+func googleSync() []map[string]any {
+	storage.mu.RLock()
+	targets := make([]Target, 0, len(storage.targets))
+	for _, t := range storage.targets {
+		targets = append(targets, *t)
+	}
+	storage.mu.RUnlock()
+	sort.Slice(targets, func(i, j int) bool { return targets[i].Name < targets[j].Name })
+
+	devices := make([]map[string]any, 0, len(targets))
+	for _, t := range targets {
+		devices = append(devices, map[string]any{
+			"id":              t.Name,
+			"type":            "action.devices.types.SWITCH",
+			"traits":          []string{"action.devices.traits.OnOff"},
+			"name":            map[string]any{"name": alexaFriendlyName(t.Name), "defaultNames": []string{t.Name}},
+			"willReportState": false,
+			"deviceInfo":      map[string]string{"manufacturer": "esp32-wol", "model": "Wake-on-LAN"},
+		})
+	}
+	return devices
+}
+
+// 目标当前状态：检测到开机或唤醒进行中为 on，中继在线且已批准为 online
+func googleState(name string) (map[string]any, bool) {
+	storage.mu.RLock()
+	defer storage.mu.RUnlock()
+	t, exists := storage.targets[name]
+	if !exists {
+		return nil, false
+	}
+	online := false
+	if device, exists := storage.devices[t.DeviceID]; exists {
+		online = device.Online && device.Approved
+	}
+	return map[string]any{"on": targetIsOn(name), "online": online}, true
+}
+
+// 执行开关命令
+func googleExecute(logger *slog.Logger, name, command string, on *bool) googleCommandResult {
+	result := googleCommandResult{IDs: []string{name}, Status: "ERROR"}
+	if command != "action.devices.commands.OnOff" || on == nil {
+		result.ErrorCode = "functionNotSupported"
+		return result
+	}
+	if _, found := googleState(name); !found {
+		result.ErrorCode = "deviceNotFound"
+		return result
+	}
+
+	logger = logger.With("target", name)
+	if *on {
+		reqs, err := resolveWake(name, "", "google")
+		if err == nil {
+			_, err = queueWake(logger, reqs[0])
+		}
+		switch {
+		case errors.Is(err, errDeviceNotApproved):
+			result.ErrorCode = "deviceOffline"
+			return result
+		case err != nil:
+			result.ErrorCode = "transientError"
+			return result
+		}
+		result.Status = "PENDING"
+	} else {
+		if err := cancelTargetWake(logger, name); err != nil {
+			result.ErrorCode = "deviceNotFound"
+			return result
+		}
+		result.Status = "SUCCESS"
+	}
+	result.States, _ = googleState(name)
+	return result
+}
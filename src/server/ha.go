@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// 高可用模式（-ha）：多个副本共用 Redis，通过租约选出一个主副本。定时任务、开机状态检测、
+// 设备离线事件和 Telegram 机器人只在主副本上运行，避免重复唤醒和重复通知；
+// 主副本退出时主动释放租约，崩溃或失联时租约在 haLeaseTTL 内过期，由其他副本接替。
+// 目标、分组、定时任务等状态保存在 Redis 中，所有副本共用
+
+const (
+	haLeaseTTL      = 15 * time.Second
+	haRenewInterval = 5 * time.Second
+)
+
+// -ha
+var haEnabled bool
+
+var haLeader atomic.Bool
+
+// 当前副本是否负责单实例任务；未开启高可用时总是 true
+func isLeader() bool {
+	return !haEnabled || haLeader.Load()
+}
+
+// 只有持有者才能续期和释放租约
+const (
+	haRenewScript   = `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("pexpire", KEYS[1], ARGV[2]) else return 0 end`
+	haReleaseScript = `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("del", KEYS[1]) else return 0 end`
+)
+
+func (c *clusterSync) leaderKey() string { return c.prefix + "leader" }
+
+func (c *clusterSync) stateKey() string { return c.prefix + "state" }
+
+// 定期竞选或续期，stop 关闭时释放租约
+func (c *clusterSync) runElection() {
+	defer close(c.electionDone)
+	ticker := time.NewTicker(haRenewInterval)
+	defer ticker.Stop()
+	for {
+		c.campaign()
+		select {
+		case <-c.stop:
+			if haLeader.Load() {
+				if _, err := c.redis.do("EVAL", haReleaseScript, "1", c.leaderKey(), c.replica); err != nil {
+					c.recordError("release leadership", err)
+				}
+				c.setLeader(false, "")
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *clusterSync) campaign() {
+	ttl := strconv.FormatInt(haLeaseTTL.Milliseconds(), 10)
+	if haLeader.Load() {
+		reply, err := c.redis.do("EVAL", haRenewScript, "1", c.leaderKey(), c.replica, ttl)
+		if err != nil {
+			c.recordError("renew leadership", err)
+			// Redis 暂时不可用：租约可能到期前主动让出，保证不会同时有两个主副本
+			c.mu.Lock()
+			expiring := time.Since(c.renewedAt) >= haLeaseTTL-haRenewInterval
+			c.mu.Unlock()
+			if expiring {
+				c.setLeader(false, "")
+			}
+			return
+		}
+		if n, _ := reply.(int64); n == 1 {
+			c.mu.Lock()
+			c.renewedAt = time.Now()
+			c.mu.Unlock()
+			return
+		}
+		c.setLeader(false, "")
+	}
+
+	replies, err := c.redis.pipeline(
+		[]string{"SET", c.leaderKey(), c.replica, "NX", "PX", ttl},
+		[]string{"GET", c.leaderKey()},
+	)
+	if err != nil {
+		c.recordError("campaign", err)
+		return
+	}
+	holder, _ := replies[1].([]byte)
+	if string(holder) == c.replica {
+		c.mu.Lock()
+		c.renewedAt = time.Now()
+		c.mu.Unlock()
+		c.setLeader(true, c.replica)
+		return
+	}
+	c.setLeader(false, string(holder))
+}
+
+func (c *clusterSync) setLeader(leader bool, holder string) {
+	c.mu.Lock()
+	c.leaderID = holder
+	c.mu.Unlock()
+	if haLeader.Swap(leader) == leader {
+		return
+	}
+	if leader {
+		slog.Info("became HA leader", "replica", c.replica)
+		events.publish(Event{Type: eventHALeader, Data: map[string]any{"replica": c.replica}})
+	} else {
+		slog.Warn("lost HA leadership", "replica", c.replica)
+	}
+}
+
+func (c *clusterSync) checkHA() ComponentHealth {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if haLeader.Load() {
+		return ComponentHealth{Status: healthOK, Detail: "leader " + c.replica}
+	}
+	if c.leaderID == "" {
+		return ComponentHealth{Status: healthDegraded, Detail: "no leader"}
+	}
+	return ComponentHealth{Status: healthOK, Detail: "follower of " + c.leaderID}
+}
+
+// 保存共享状态并通知其他副本重新载入
+func (c *clusterSync) saveSharedState(state persistedState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	notify, _ := json.Marshal(clusterUpdate{Replica: c.replica, Kind: clusterState})
+	_, err = c.redis.pipeline(
+		[]string{"SET", c.stateKey(), string(data)},
+		[]string{"PUBLISH", c.channel(), string(notify)},
+	)
+	if err != nil {
+		c.recordError("save state", err)
+	}
+	return err
+}
+
+// 载入共享状态；Redis 中还没有状态时返回 false
+func (c *clusterSync) loadSharedState() (bool, error) {
+	reply, err := c.redis.do("GET", c.stateKey())
+	if err != nil {
+		return false, err
+	}
+	data, _ := reply.([]byte)
+	if data == nil {
+		return false, nil
+	}
+	var state persistedState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return false, err
+	}
+	replaceSharedState(&state)
+	for _, d := range state.Devices {
+		c.applyDevice(d)
+	}
+	return true, nil
+}
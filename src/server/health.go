@@ -0,0 +1,152 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 组件健康状态
+const (
+	healthOK       = "ok"
+	healthDegraded = "degraded"
+	healthDown     = "down"
+)
+
+// 单个组件的检查结果
+type ComponentHealth struct {
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// 健康检查响应
+type HealthResponse struct {
+	Status     string                     `json:"status"`
+	Time       string                     `json:"time"`
+	Uptime     string                     `json:"uptime"`
+	Goroutines int                        `json:"goroutines"`
+	Components map[string]ComponentHealth `json:"components"`
+}
+
+// 服务器启动时间
+var startTime = time.Now()
+
+// 监听器是否已就绪
+var listenersUp atomic.Bool
+
+// 是否正在优雅关闭，关闭期间 /readyz 返回未就绪
+var draining atomic.Bool
+
+// 各子系统注册的健康检查
+var healthChecks = struct {
+	mu     sync.RWMutex
+	checks map[string]func() ComponentHealth
+}{checks: make(map[string]func() ComponentHealth)}
+
+// 注册组件健康检查，子系统启动时调用
+func registerHealthCheck(name string, check func() ComponentHealth) {
+	healthChecks.mu.Lock()
+	healthChecks.checks[name] = check
+	healthChecks.mu.Unlock()
+}
+
+// 执行所有组件检查，整体状态取最差的组件状态
+func runHealthChecks() (string, map[string]ComponentHealth) {
+	healthChecks.mu.RLock()
+	names := make([]string, 0, len(healthChecks.checks))
+	for name := range healthChecks.checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	checks := make([]func() ComponentHealth, len(names))
+	for i, name := range names {
+		checks[i] = healthChecks.checks[name]
+	}
+	healthChecks.mu.RUnlock()
+
+	overall := healthOK
+	components := make(map[string]ComponentHealth, len(names))
+	for i, name := range names {
+		result := checks[i]()
+		components[name] = result
+		if healthRank(result.Status) > healthRank(overall) {
+			overall = result.Status
+		}
+	}
+	return overall, components
+}
+
+func healthRank(status string) int {
+	switch status {
+	case healthOK:
+		return 0
+	case healthDegraded:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// 存储检查：在限定时间内拿不到锁说明存储已经卡死
+func checkStorage() ComponentHealth {
+	done := make(chan int, 1)
+	go func() {
+		storage.mu.RLock()
+		n := len(storage.devices)
+		storage.mu.RUnlock()
+		done <- n
+	}()
+
+	select {
+	case <-done:
+		return ComponentHealth{Status: healthOK, Detail: "memory"}
+	case <-time.After(2 * time.Second):
+		return ComponentHealth{Status: healthDown, Detail: "storage lock timeout"}
+	}
+}
+
+// 健康检查
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	status, components := runHealthChecks()
+
+	code := http.StatusOK
+	if status == healthDown {
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, HealthResponse{
+		Status:     status,
+		Time:       time.Now().Format(time.RFC3339),
+		Uptime:     time.Since(startTime).Round(time.Second).String(),
+		Goroutines: runtime.NumGoroutine(),
+		Components: components,
+	})
+}
+
+// 存活探针：只要进程能处理请求就返回成功
+func livenessHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": healthOK})
+}
+
+// 就绪探针：监听器已启动、存储可用且未处于关闭流程时才就绪
+func readinessHandler(w http.ResponseWriter, r *http.Request) {
+	reason := ""
+	switch {
+	case draining.Load():
+		reason = "shutting down"
+	case !listenersUp.Load():
+		reason = "listeners not started"
+	default:
+		if status, _ := runHealthChecks(); status == healthDown {
+			reason = "component down"
+		}
+	}
+
+	if reason != "" {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "not ready", "reason": reason})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ready"})
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Home Assistant 集成：目标以 RESTful Switch 的形式暴露。
+// 打开开关即唤醒目标，开关在唤醒进行中（消息尚未确认或失败）时为 on，之后自动回到 off；
+// 关闭开关会取消尚未下发的唤醒
+
+// 目标在 Home Assistant 中的状态
+type HATargetState struct {
+	Name        string      `json:"name"`
+	State       string      `json:"state"` // on | off
+	IsOn        bool        `json:"is_on"`
+	MacAddress  string      `json:"mac_address"`
+	DeviceID    string      `json:"device_id"`
+	Power       string      `json:"power"` // 检测到的开机状态：on、off 或 unknown
+	RelayOnline bool        `json:"relay_online"`
+	LastWake    *TargetWake `json:"last_wake"`
+}
+
+// 计算目标状态，调用方需持有 storage.mu 读锁
+func haTargetState(t *Target) HATargetState {
+	state := HATargetState{
+		Name:       t.Name,
+		State:      "off",
+		MacAddress: t.MacAddress,
+		DeviceID:   t.DeviceID,
+	}
+	if device, exists := storage.devices[t.DeviceID]; exists {
+		state.RelayOnline = device.Online
+	}
+	state.Power = targetPower(t.Name)
+	state.LastWake = lastTargetWake(t.Name)
+	if state.Power == powerOn || state.LastWake.inProgress() {
+		state.State, state.IsOn = "on", true
+	}
+	return state
+}
+
+// 所有目标的状态：GET /api/ha/targets，可配合 RESTful Sensor 使用
+func haTargetsHandler(w http.ResponseWriter, r *http.Request) {
+	storage.mu.RLock()
+	targets := make([]HATargetState, 0, len(storage.targets))
+	for _, t := range storage.targets {
+		targets = append(targets, haTargetState(t))
+	}
+	storage.mu.RUnlock()
+	sort.Slice(targets, func(i, j int) bool { return targets[i].Name < targets[j].Name })
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"targets": targets,
+		"total":   len(targets),
+	})
+}
+
+// 单个目标：GET 返回状态，POST {"state": "on"|"off"} 唤醒或取消唤醒。
+// 响应体始终是目标的最新状态，便于 Home Assistant 直接用 is_on 渲染
+func haTargetHandler(w http.ResponseWriter, r *http.Request) {
+	name, _ := pathParams(r, "/api/ha/targets/")
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var req struct {
+			State string `json:"state"`
+		}
+		if !readJSON(w, r, &req) {
+			return
+		}
+		switch strings.ToLower(req.State) {
+		case "on":
+			reqs, err := resolveWake(name, "", "homeassistant")
+			if err != nil {
+				http.Error(w, "Target not found", http.StatusNotFound)
+				return
+			}
+			if _, err := queueWake(requestLogger(r), reqs[0]); err != nil {
+				if writeMaintenance(w, err) || writeBackpressure(w, err) || writeAllowedHours(w, err) || writeCooldown(w, err) {
+					return
+				}
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
+		case "off":
+			if err := cancelTargetWake(requestLogger(r), name); err != nil {
+				http.Error(w, "Target not found", http.StatusNotFound)
+				return
+			}
+		default:
+			http.Error(w, `state must be "on" or "off"`, http.StatusBadRequest)
+			return
+		}
+	default:
+		methodNotAllowed(w, r)
+		return
+	}
+
+	storage.mu.RLock()
+	t, exists := storage.targets[name]
+	var state HATargetState
+	if exists {
+		state = haTargetState(t)
+	}
+	storage.mu.RUnlock()
+	if !exists {
+		http.Error(w, "Target not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, state)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"regexp"
+)
+
+// HomeKit 桥接：每个命名目标是一个开关配件，打开即唤醒。
+// 实现依赖第三方库 github.com/brutella/hap，位于 homekit_hap.go，需要用 -tags homekit 编译；
+// 默认构建只使用标准库，不包含 HomeKit 支持
+
+// HomeKit 参数
+type homekitOptions struct {
+	pin     string // 配对码，8位数字
+	addr    string // HAP 服务监听地址
+	dataDir string // 配对信息保存目录
+}
+
+// 启动 HomeKit 桥接，编译时未包含 HomeKit 支持时为 nil
+var startHomeKit func(opts homekitOptions) error
+
+var homekitPinPattern = regexp.MustCompile(`^\d{8}$`)
+
+// HomeKit 不接受的简单配对码
+var homekitTrivialPins = map[string]bool{
+	"00000000": true, "11111111": true, "22222222": true, "33333333": true, "44444444": true,
+	"55555555": true, "66666666": true, "77777777": true, "88888888": true, "99999999": true,
+	"12345678": true, "87654321": true,
+}
+
+func checkHomeKitOptions(opts homekitOptions) error {
+	if opts.pin == "" {
+		return nil
+	}
+	if startHomeKit == nil {
+		return fmt.Errorf("this binary was built without HomeKit support (build with -tags homekit)")
+	}
+	if !homekitPinPattern.MatchString(opts.pin) || homekitTrivialPins[opts.pin] {
+		return fmt.Errorf("-homekit-pin must be 8 digits and not trivial, e.g. 03145154")
+	}
+	return nil
+}
+
+// 配件ID由目标名称派生，目标列表变化后已配对的配件保持不变；1 保留给桥接器本身
+func homekitAccessoryID(name string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	if id := h.Sum64(); id > 1 {
+		return id
+	}
+	return 2
+}
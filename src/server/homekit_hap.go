@@ -0,0 +1,107 @@
+//go:build homekit
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+
+	"github.com/brutella/hap"
+	"github.com/brutella/hap/accessory"
+)
+
+func init() {
+	startHomeKit = runHomeKit
+}
+
+// 启动 HAP 服务。配件列表在启动时根据目标生成，增删目标后需重启服务器
+func runHomeKit(opts homekitOptions) error {
+	storage.mu.RLock()
+	targets := make([]Target, 0, len(storage.targets))
+	for _, t := range storage.targets {
+		targets = append(targets, *t)
+	}
+	storage.mu.RUnlock()
+	sort.Slice(targets, func(i, j int) bool { return targets[i].Name < targets[j].Name })
+
+	bridge := accessory.NewBridge(accessory.Info{Name: "ESP32 WOL", Manufacturer: "esp32-wol"})
+	switches := make(map[string]*accessory.Switch, len(targets))
+	accessories := make([]*accessory.A, 0, len(targets))
+	for _, t := range targets {
+		sw := accessory.NewSwitch(accessory.Info{
+			Name:         alexaFriendlyName(t.Name),
+			Manufacturer: "esp32-wol",
+			Model:        "Wake-on-LAN",
+			SerialNumber: t.MacAddress,
+		})
+		sw.Id = homekitAccessoryID(t.Name)
+		name := t.Name
+		sw.Switch.On.OnValueRemoteUpdate(func(on bool) { homekitSetOn(sw, name, on) })
+		switches[name] = sw
+		accessories = append(accessories, sw.A)
+	}
+
+	server, err := hap.NewServer(hap.NewFsStore(opts.dataDir), bridge.A, accessories...)
+	if err != nil {
+		return err
+	}
+	server.Pin = opts.pin
+	server.Addr = opts.addr
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-shutdownCh
+		cancel()
+	}()
+	go homekitWatch(ctx, switches)
+	go func() {
+		if err := server.ListenAndServe(ctx); err != nil && ctx.Err() == nil {
+			slog.Error("homekit server stopped", "error", err)
+		}
+	}()
+	slog.Info("homekit bridge started", "addr", opts.addr, "accessories", len(accessories))
+	return nil
+}
+
+// 在“家庭”中打开开关即唤醒，关闭会取消尚未下发的唤醒
+func homekitSetOn(sw *accessory.Switch, name string, on bool) {
+	logger := slog.With("target", name, "source", "homekit")
+	if !on {
+		if err := cancelTargetWake(logger, name); err != nil {
+			logger.Warn("homekit cancel failed", "error", err)
+		}
+		return
+	}
+	reqs, err := resolveWake(name, "", "homekit")
+	if err == nil {
+		_, err = queueWake(logger, reqs[0])
+	}
+	if err != nil {
+		logger.Warn("homekit wake failed", "error", err)
+		sw.Switch.On.SetValue(false)
+	}
+}
+
+// 唤醒或开机状态变化时同步开关状态：检测到开机或唤醒进行中为开，否则为关
+func homekitWatch(ctx context.Context, switches map[string]*accessory.Switch) {
+	ch, _, unsubscribe := events.subscribe(0)
+	defer unsubscribe()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-ch:
+			storage.mu.RLock()
+			name, _ := e.Data["target"].(string)
+			if m, exists := storage.messages[e.MessageID]; exists {
+				name = m.Target
+			}
+			on := name != "" && targetIsOn(name)
+			storage.mu.RUnlock()
+			if sw, ok := switches[name]; ok {
+				sw.Switch.On.SetValue(on)
+			}
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"text/template"
+)
+
+// 入站 Webhook：POST /hooks/<token> 触发配置好的唤醒，供 IFTTT、快捷指令等只能请求URL的服务使用。
+// target / group 可以是模板，从请求内容中取值，例如 {{.body.target}}；使用模板时必须用 allow 限定可唤醒的名称
+
+// 入站 Webhook 配置
+type HookConfig struct {
+	Name   string   `json:"name"`
+	Token  string   `json:"token"`  // URL中的令牌，至少16个字符
+	Target string   `json:"target"` // 目标名称或模板，与 group 二选一
+	Group  string   `json:"group"`  // 分组名称或模板
+	Allow  []string `json:"allow"`  // 模板渲染结果允许的名称
+}
+
+type inboundHook struct {
+	name   string
+	token  string
+	target *template.Template
+	group  *template.Template
+	allow  map[string]bool
+}
+
+// 当前生效的入站 Webhook
+var inboundHooks []*inboundHook
+
+// 入站请求体大小上限
+const maxHookBody = 64 << 10
+
+func buildHooks(cfgs []HookConfig) ([]*inboundHook, error) {
+	var hooks []*inboundHook
+	names := map[string]bool{}
+	for i, cfg := range cfgs {
+		label := cfg.Name
+		if label == "" {
+			label = fmt.Sprintf("#%d", i+1)
+		}
+		if names[cfg.Name] {
+			return nil, fmt.Errorf("hooks %s: duplicate name", label)
+		}
+		names[cfg.Name] = true
+		if len(cfg.Token) < 16 {
+			return nil, fmt.Errorf("hooks %s: token must be at least 16 characters", label)
+		}
+		if (cfg.Target == "") == (cfg.Group == "") {
+			return nil, fmt.Errorf("hooks %s: exactly one of target or group is required", label)
+		}
+		spec := cfg.Target + cfg.Group
+		tmpl, err := template.New(label).Option("missingkey=zero").Parse(spec)
+		if err != nil {
+			return nil, fmt.Errorf("hooks %s: %v", label, err)
+		}
+		if strings.Contains(spec, "{{") && len(cfg.Allow) == 0 {
+			return nil, fmt.Errorf("hooks %s: allow is required when target or group is a template", label)
+		}
+		h := &inboundHook{name: label, token: cfg.Token, allow: map[string]bool{}}
+		if cfg.Target != "" {
+			h.target = tmpl
+		} else {
+			h.group = tmpl
+		}
+		for _, name := range cfg.Allow {
+			h.allow[name] = true
+		}
+		hooks = append(hooks, h)
+	}
+	return hooks, nil
+}
+
+// 按令牌查找 Webhook（常量时间比较）
+func findHook(token string) *inboundHook {
+	var found *inboundHook
+	for _, h := range inboundHooks {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(h.token)) == 1 {
+			found = h
+		}
+	}
+	return found
+}
+
+// 模板数据：body 为解析后的JSON请求体，form 和 query 为表单字段和查询参数（取第一个值）
+func hookTemplateData(r *http.Request, body []byte) map[string]any {
+	data := map[string]any{"form": map[string]string{}, "query": map[string]string{}}
+	if len(bytes.TrimSpace(body)) > 0 {
+		var parsed any
+		if json.Unmarshal(body, &parsed) == nil {
+			data["body"] = parsed
+		}
+	}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		r.ParseForm()
+		for k, v := range r.PostForm {
+			data["form"].(map[string]string)[k] = v[0]
+		}
+	}
+	for k, v := range r.URL.Query() {
+		data["query"].(map[string]string)[k] = v[0]
+	}
+	return data
+}
+
+// 渲染目标或分组名称
+func (h *inboundHook) resolve(data map[string]any) (target, group string, err error) {
+	tmpl := h.target
+	if tmpl == nil {
+		tmpl = h.group
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", "", err
+	}
+	name := strings.TrimSpace(buf.String())
+	if name == "" || name == "<no value>" {
+		return "", "", fmt.Errorf("template produced an empty name")
+	}
+	if len(h.allow) > 0 && !h.allow[name] {
+		return "", "", fmt.Errorf("%q is not in the allow list", name)
+	}
+	if h.target != nil {
+		return name, "", nil
+	}
+	return "", name, nil
+}
+
+// 入站 Webhook：POST /hooks/<token>。
+// 令牌是URL的一部分，路由不使用请求日志中间件，由这里记录不含令牌的日志
+func hookHandler(w http.ResponseWriter, r *http.Request) {
+	token, _ := pathParams(r, "/hooks/")
+	hook := findHook(token)
+	if hook == nil {
+		ip := clientIP(r)
+		requestLogger(r).Warn("unknown hook token", "client_ip", ip)
+		authFailures.record(ip, r.Method, "/hooks/", authReasonHook)
+		http.NotFound(w, r)
+		return
+	}
+	if rejectDuringMaintenance(w) {
+		return
+	}
+	logger := requestLogger(r).With("hook", hook.name, "client_ip", clientIP(r))
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxHookBody))
+	if err != nil {
+		http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	target, group, err := hook.resolve(hookTemplateData(r, body))
+	if err != nil {
+		logger.Warn("hook rejected", "error", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	reqs, err := resolveWake(target, group, "hook:"+hook.name)
+	if err != nil {
+		logger.Warn("hook rejected", "error", err)
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	messageIDs := []string{}
+	failures := map[string]string{}
+	for _, req := range reqs {
+		message, err := queueWake(logger, req)
+		if err != nil {
+			failures[req.Target] = err.Error()
+			continue
+		}
+		messageIDs = append(messageIDs, message.ID)
+	}
+	logger.Info("hook triggered", "target", target, "group", group, "queued", len(messageIDs), "failed", len(failures))
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success":     len(failures) == 0,
+		"message_ids": messageIDs,
+		"errors":      failures,
+		"message":     fmt.Sprintf("%d of %d WOL messages queued", len(messageIDs), len(reqs)),
+	})
+}
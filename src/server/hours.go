@@ -0,0 +1,178 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// 目标允许唤醒的时段：目标设置 allowed_hours 后，时段之外的唤醒请求被拒绝（按服务器本地时区），
+// 避免自动化在夜里启动吵闹的机器。定时任务、语音助手、Webhook 等所有来源都受限制；
+// 管理员（服务器API密钥或 admin 角色）可以在发送唤醒时加上 "override_hours": true 越过限制
+
+// 一个允许唤醒的时段
+type TimeWindow struct {
+	From string   `json:"from"`           // HH:MM
+	To   string   `json:"to"`             // HH:MM，早于 from 时跨过午夜，24:00 表示到当天结束
+	Days []string `json:"days,omitempty"` // 时段开始的日期 mon..sun，为空表示每天
+}
+
+var errOutsideAllowedHours = errors.New("target does not accept wakes at this time")
+
+// 解析 HH:MM 为当天的分钟数，allowEnd 时接受 24:00
+func parseClock(s string, allowEnd bool) (int, error) {
+	if allowEnd && s == "24:00" {
+		return 24 * 60, nil
+	}
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("time must be HH:MM, got %q", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// 规范星期名称：小写、取前三个字母
+func normalizeDays(days []string) error {
+	for i, d := range days {
+		d = strings.ToLower(strings.TrimSpace(d))
+		if len(d) > 3 {
+			d = d[:3]
+		}
+		if _, ok := weekdayNames[d]; !ok {
+			return fmt.Errorf("unknown day %q", days[i])
+		}
+		days[i] = d
+	}
+	return nil
+}
+
+func (tw *TimeWindow) validate() error {
+	from, err := parseClock(tw.From, false)
+	if err != nil {
+		return err
+	}
+	to, err := parseClock(tw.To, true)
+	if err != nil {
+		return err
+	}
+	if from == to {
+		return fmt.Errorf("time window %s-%s is empty", tw.From, tw.To)
+	}
+	return normalizeDays(tw.Days)
+}
+
+func (tw *TimeWindow) startsOn(day time.Weekday) bool {
+	if len(tw.Days) == 0 {
+		return true
+	}
+	for _, d := range tw.Days {
+		if weekdayNames[d] == day {
+			return true
+		}
+	}
+	return false
+}
+
+// 时刻是否在时段内
+func (tw *TimeWindow) contains(t time.Time) bool {
+	from, _ := parseClock(tw.From, false)
+	to, _ := parseClock(tw.To, true)
+	now := t.Hour()*60 + t.Minute()
+	if from < to {
+		return tw.startsOn(t.Weekday()) && now >= from && now < to
+	}
+	// 跨过午夜：今天开始的时段的前半段，或昨天开始的时段的后半段
+	return (tw.startsOn(t.Weekday()) && now >= from) || (tw.startsOn(t.AddDate(0, 0, -1).Weekday()) && now < to)
+}
+
+func (tw TimeWindow) String() string {
+	s := tw.From + "-" + tw.To
+	if len(tw.Days) > 0 {
+		s += " " + strings.Join(tw.Days, ",")
+	}
+	return s
+}
+
+// 时段为空表示不限制
+func withinAllowedHours(windows []TimeWindow, t time.Time) bool {
+	if len(windows) == 0 {
+		return true
+	}
+	for i := range windows {
+		if windows[i].contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// after 之后最近一个时段的开始时间，一周内没有时返回零值
+func nextAllowedTime(windows []TimeWindow, after time.Time) time.Time {
+	var next time.Time
+	for i := range windows {
+		from, _ := parseClock(windows[i].From, false)
+		for d := 0; d <= 7; d++ {
+			day := after.AddDate(0, 0, d)
+			start := time.Date(day.Year(), day.Month(), day.Day(), from/60, from%60, 0, 0, after.Location())
+			if start.After(after) && windows[i].startsOn(start.Weekday()) {
+				if next.IsZero() || start.Before(next) {
+					next = start
+				}
+				break
+			}
+		}
+	}
+	return next
+}
+
+// 检查唤醒请求涉及的目标是否允许在 now 唤醒。调用方持有 storage.mu
+func checkAllowedHours(req wakeRequest, now time.Time) error {
+	for _, t := range wakeTargets(req) {
+		if withinAllowedHours(t.AllowedHours, now) {
+			continue
+		}
+		parts := make([]string, len(t.AllowedHours))
+		for i, tw := range t.AllowedHours {
+			parts[i] = tw.String()
+		}
+		msg := fmt.Sprintf("%s only accepts wakes %s", t.Name, strings.Join(parts, "; "))
+		if next := nextAllowedTime(t.AllowedHours, now); !next.IsZero() {
+			msg += ", next at " + next.Format("Mon 15:04")
+		}
+		return fmt.Errorf("%w: %s", errOutsideAllowedHours, msg)
+	}
+	return nil
+}
+
+// 唤醒请求涉及的目标：指定的命名目标，以及MAC地址相同的其他目标。调用方持有 storage.mu
+func wakeTargets(req wakeRequest) []*Target {
+	var targets []*Target
+	if t, exists := storage.targets[req.Target]; exists {
+		targets = append(targets, t)
+	}
+	mac, err := normalizeMAC(req.TargetMAC)
+	if err != nil {
+		return targets
+	}
+	for _, t := range storage.targets {
+		if t.Name != req.Target && t.MacAddress == mac {
+			targets = append(targets, t)
+		}
+	}
+	return targets
+}
+
+// 时段之外的唤醒返回 403 和 outside_allowed_hours，其他错误返回 false
+func writeAllowedHours(w http.ResponseWriter, err error) bool {
+	if !errors.Is(err, errOutsideAllowedHours) {
+		return false
+	}
+	writeJSON(w, http.StatusForbidden, map[string]interface{}{
+		"success": false,
+		"error":   "outside_allowed_hours",
+		"message": err.Error(),
+	})
+	return true
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// HTTP 服务器的连接与超时限制，防止慢速请求（slowloris）和大量连接耗尽资源。
+// 长轮询、事件流等长连接路由不受请求读写超时限制
+
+// 普通路由读取请求体和写出响应的超时（-read-timeout、-write-timeout）
+var (
+	requestReadTimeout  time.Duration
+	requestWriteTimeout time.Duration
+)
+
+// 请求体大小上限（-max-body-bytes），固件上传等路由单独限制
+var maxRequestBody int64 = 1 << 20
+
+// 所有监听器共享的连接数限制
+var connLimit = &connLimiter{}
+
+type httpServerOptions struct {
+	readHeaderTimeout time.Duration
+	idleTimeout       time.Duration
+	maxHeaderBytes    int
+}
+
+func (o *serveOptions) checkHTTPLimits() error {
+	switch {
+	case o.http.readHeaderTimeout <= 0:
+		return fmt.Errorf("-read-header-timeout must be positive")
+	case o.http.maxHeaderBytes < 1024:
+		return fmt.Errorf("-max-header-bytes must be at least 1024")
+	case o.http.idleTimeout < 0 || requestReadTimeout < 0 || requestWriteTimeout < 0:
+		return fmt.Errorf("-idle-timeout, -read-timeout and -write-timeout must not be negative")
+	case o.maxConns < 0 || maxLongPolls < 0:
+		return fmt.Errorf("-max-conns and -max-long-polls must not be negative")
+	case maxRequestBody < 1024:
+		return fmt.Errorf("-max-body-bytes must be at least 1024")
+	}
+	return nil
+}
+
+func newHTTPServer(handler http.Handler, o httpServerOptions) *http.Server {
+	return &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: o.readHeaderTimeout,
+		IdleTimeout:       o.idleTimeout,
+		MaxHeaderBytes:    o.maxHeaderBytes,
+		ConnState:         connLimit.connState,
+	}
+}
+
+// 为普通路由设置读写截止时间。请求体读完后取消读超时，
+// 否则连接上的后台读取会在超时后取消请求的 context
+func deadlineMiddleware(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rc := http.NewResponseController(w)
+		if requestWriteTimeout > 0 {
+			rc.SetWriteDeadline(time.Now().Add(requestWriteTimeout))
+			// 截止时间是连接级别的，keep-alive 连接上的下一个请求可能是长轮询
+			defer rc.SetWriteDeadline(time.Time{})
+		}
+		if requestReadTimeout > 0 && r.Body != nil && r.Body != http.NoBody {
+			if rc.SetReadDeadline(time.Now().Add(requestReadTimeout)) == nil {
+				r.Body = &deadlineBody{ReadCloser: r.Body, rc: rc}
+			}
+		}
+		handler(w, r)
+	}
+}
+
+// 限制请求体大小：声明的长度超过上限时直接返回 413，不读取请求体；
+// 未声明长度（分块传输）时读取超过上限会出错，连接随后被关闭
+func bodyLimitMiddleware(handler http.HandlerFunc, limit int64) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > limit {
+			requestLogger(r).Warn("request body too large", "content_length", r.ContentLength, "limit", limit)
+			http.Error(w, fmt.Sprintf("Request body too large (limit %d bytes)", limit), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+		}
+		handler(w, r)
+	}
+}
+
+// 读到请求体末尾时取消读截止时间
+type deadlineBody struct {
+	io.ReadCloser
+	rc   *http.ResponseController
+	done bool
+}
+
+func (b *deadlineBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF && !b.done {
+		b.done = true
+		b.rc.SetReadDeadline(time.Time{})
+	}
+	return n, err
+}
+
+// 连接数限制：超过上限的新连接直接关闭。通过 http.Server.ConnState 在连接关闭
+// （或升级为 WebSocket 被接管）时释放名额，不包装连接本身，TLS 监听器也能正常协商
+type connLimiter struct {
+	max      int64
+	open     atomic.Int64
+	rejected atomic.Int64
+	lastWarn atomic.Int64 // 上次告警的 Unix 秒，避免被攻击时刷屏
+}
+
+func (l *connLimiter) listener(ln net.Listener) net.Listener {
+	return &limitedListener{Listener: ln, limiter: l}
+}
+
+// 占用一个名额，已满时返回 false
+func (l *connLimiter) acquire() bool {
+	for {
+		open := l.open.Load()
+		if l.max > 0 && open >= l.max {
+			return false
+		}
+		if l.open.CompareAndSwap(open, open+1) {
+			return true
+		}
+	}
+}
+
+func (l *connLimiter) connState(_ net.Conn, state http.ConnState) {
+	if state == http.StateClosed || state == http.StateHijacked {
+		l.open.Add(-1)
+	}
+}
+
+func (l *connLimiter) reject(conn net.Conn) {
+	conn.Close()
+	l.rejected.Add(1)
+	now := time.Now().Unix()
+	if last := l.lastWarn.Load(); now-last >= 60 && l.lastWarn.CompareAndSwap(last, now) {
+		slog.Warn("connection limit reached, rejecting new connections", "max_conns", l.max, "remote", conn.RemoteAddr().String(), "rejected_total", l.rejected.Load())
+	}
+}
+
+type limitedListener struct {
+	net.Listener
+	limiter *connLimiter
+}
+
+func (l *limitedListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if l.limiter.acquire() {
+			return conn, nil
+		}
+		l.limiter.reject(conn)
+	}
+}
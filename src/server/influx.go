@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// InfluxDB 导出：按固定间隔把事件和设备遥测以 line protocol 推送到 InfluxDB（1.x 的 /write 或 2.x 的 /api/v2/write），
+// 也可以是 Telegraf、VictoriaMetrics 等任何接受 line protocol 的 HTTP 地址，适合使用 Influx+Grafana 而不是 Prometheus 的家庭监控。
+// 事件在两次推送之间缓存在内存中，推送失败时保留到下一次，超过上限时丢弃最旧的
+
+// InfluxDB 导出配置
+type InfluxConfig struct {
+	URL         string            `json:"url"`         // 写入地址，例如 http://influxdb:8086/api/v2/write?org=home&bucket=wol
+	Token       string            `json:"token"`       // InfluxDB 2.x 的 API 令牌
+	Username    string            `json:"username"`    // InfluxDB 1.x 的用户名和密码（HTTP 基本认证）
+	Password    string            `json:"password"`    //
+	Interval    Duration          `json:"interval"`    // 推送间隔，默认 10s
+	Measurement string            `json:"measurement"` // 测量名前缀，默认 esp32_wol
+	Tags        map[string]string `json:"tags"`        // 附加到每个数据点的标签，例如 {"site": "home"}
+	Events      []string          `json:"events"`      // 导出的事件类型，为空表示全部
+	MaxBuffer   int               `json:"max_buffer"`  // 推送失败时最多缓存的数据点，默认 10000
+}
+
+const (
+	defaultInfluxInterval  = 10 * time.Second
+	defaultInfluxMaxBuffer = 10000
+	influxTimeout          = 10 * time.Second
+)
+
+type influxExporter struct {
+	url         string
+	token       string
+	username    string
+	password    string
+	interval    time.Duration
+	measurement string
+	tags        string // 已转义的附加标签，以逗号开头
+	filter      eventFilter
+	maxBuffer   int
+	client      *http.Client
+
+	mu       sync.Mutex
+	buffer   []string // 待推送的数据点
+	dropped  int64
+	lastErr  string
+	lastPush time.Time
+}
+
+var influxWritesTotal = newCounterVec("esp32_wol_influx_writes_total",
+	"InfluxDB write requests by result.", "result")
+
+func newInfluxExporter(cfg *InfluxConfig) (*influxExporter, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	u, err := url.Parse(cfg.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("url must be an http(s) write endpoint, e.g. http://influxdb:8086/api/v2/write?org=home&bucket=wol")
+	}
+	if cfg.Token != "" && cfg.Username != "" {
+		return nil, fmt.Errorf("use either token or username/password")
+	}
+	filter, err := newEventFilter(cfg.Events)
+	if err != nil {
+		return nil, err
+	}
+	e := &influxExporter{
+		url:         cfg.URL,
+		token:       cfg.Token,
+		username:    cfg.Username,
+		password:    cfg.Password,
+		interval:    time.Duration(cfg.Interval),
+		measurement: firstNonEmpty(cfg.Measurement, "esp32_wol"),
+		filter:      filter,
+		maxBuffer:   cfg.MaxBuffer,
+		client:      &http.Client{Timeout: influxTimeout},
+	}
+	if e.interval == 0 {
+		e.interval = defaultInfluxInterval
+	}
+	if e.interval < time.Second {
+		return nil, fmt.Errorf("interval must be at least 1s")
+	}
+	if e.maxBuffer == 0 {
+		e.maxBuffer = defaultInfluxMaxBuffer
+	}
+	if e.maxBuffer < 0 {
+		return nil, fmt.Errorf("max_buffer must not be negative")
+	}
+	keys := make([]string, 0, len(cfg.Tags))
+	for k := range cfg.Tags {
+		if k == "" || cfg.Tags[k] == "" {
+			return nil, fmt.Errorf("tags must not have empty keys or values")
+		}
+		keys = append(keys, k)
+	}
+	// line protocol 建议标签按键排序
+	sort.Strings(keys)
+	for _, k := range keys {
+		e.tags += "," + influxEscapeTag(k) + "=" + influxEscapeTag(cfg.Tags[k])
+	}
+	return e, nil
+}
+
+// 运行导出器：订阅事件，按间隔推送，服务器关闭时停止
+func (e *influxExporter) run() {
+	ch, _, _ := events.subscribe(0)
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-shutdownCh:
+			return
+		case ev := <-ch:
+			if e.filter.wants(ev.Type) {
+				e.add(e.eventPoint(ev))
+			}
+		case <-ticker.C:
+			e.collect(time.Now())
+			ctx, cancel := context.WithTimeout(context.Background(), influxTimeout)
+			e.flush(ctx)
+			cancel()
+		}
+	}
+}
+
+func (e *influxExporter) add(lines ...string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.buffer = append(e.buffer, lines...)
+	if over := len(e.buffer) - e.maxBuffer; over > 0 {
+		e.buffer = append([]string(nil), e.buffer[over:]...)
+		e.dropped += int64(over)
+	}
+}
+
+// 事件数据点：<prefix>_event,type=...,device_id=...,target=... message_id="...",count=1i
+func (e *influxExporter) eventPoint(ev Event) string {
+	tags := map[string]string{"type": ev.Type, "device_id": ev.DeviceID}
+	fields := map[string]any{"count": 1}
+	if ev.MessageID != "" {
+		fields["message_id"] = ev.MessageID
+	}
+	for k, v := range ev.Data {
+		switch k {
+		case "target", "source", "status", "reason":
+			if s, ok := v.(string); ok {
+				tags[k] = s
+			}
+		case "error", "target_mac":
+			if s, ok := v.(string); ok {
+				fields[k] = s
+			}
+		}
+	}
+	return e.line("event", tags, fields, ev.Time)
+}
+
+// 采集设备遥测和服务器概况。高可用模式下只由主副本采集，避免重复
+func (e *influxExporter) collect(now time.Time) {
+	if !isLeader() {
+		return
+	}
+	var lines []string
+	storage.mu.RLock()
+	online := 0
+	for id, d := range storage.devices {
+		if d.Online {
+			online++
+		}
+		fields := map[string]any{
+			"online":             d.Online,
+			"approved":           d.Approved,
+			"last_seen_age":      now.Sub(d.LastSeen).Seconds(),
+			"pending":            queues.len(id),
+			"clock_offset":       d.ClockOffset,
+			"polls":              d.Stats.Polls,
+			"messages_queued":    d.Stats.MessagesQueued,
+			"messages_delivered": d.Stats.MessagesDelivered,
+			"messages_acked":     d.Stats.MessagesAcked,
+			"messages_failed":    d.Stats.MessagesFailed,
+		}
+		if d.Power != nil {
+			fields["on_battery"] = d.Power.Source == powerBattery
+			if d.Power.Percent > 0 {
+				fields["battery_percent"] = d.Power.Percent
+			}
+			if d.Power.Voltage > 0 {
+				fields["battery_volts"] = d.Power.Voltage
+			}
+		}
+		lines = append(lines, e.line("device", map[string]string{"device_id": id, "name": d.Name}, fields, now))
+	}
+	devices := len(storage.devices)
+	storage.mu.RUnlock()
+
+	lines = append(lines, e.line("server", nil, map[string]any{
+		"devices":           devices,
+		"devices_online":    online,
+		"pending_total":     queues.total(),
+		"active_long_polls": activeLongPolls.Load(),
+		"uptime":            now.Sub(startTime).Seconds(),
+	}, now))
+	e.add(lines...)
+}
+
+// 推送缓存的数据点，失败时保留到下一次
+func (e *influxExporter) flush(ctx context.Context) {
+	e.mu.Lock()
+	lines := e.buffer
+	e.buffer = nil
+	e.mu.Unlock()
+	if len(lines) == 0 {
+		return
+	}
+
+	err := e.write(ctx, lines)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err != nil {
+		influxWritesTotal.inc("error")
+		if e.lastErr == "" {
+			slog.Warn("influxdb write failed, points kept for the next attempt", "points", len(lines), "error", err)
+		}
+		e.lastErr = err.Error()
+		var perm permanentError
+		if !errors.As(err, &perm) {
+			// 失败的数据点放回缓存前面，保持时间顺序
+			e.buffer = append(lines, e.buffer...)
+			if over := len(e.buffer) - e.maxBuffer; over > 0 {
+				e.buffer = append([]string(nil), e.buffer[over:]...)
+				e.dropped += int64(over)
+			}
+		}
+		return
+	}
+	influxWritesTotal.inc("success")
+	if e.lastErr != "" {
+		slog.Info("influxdb write recovered", "points", len(lines))
+	}
+	e.lastErr = ""
+	e.lastPush = time.Now()
+}
+
+func (e *influxExporter) write(ctx context.Context, lines []string) error {
+	body := strings.Join(lines, "\n") + "\n"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.url, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	req.Header.Set("User-Agent", "ESP32-WOL-Server")
+	switch {
+	case e.token != "":
+		req.Header.Set("Authorization", "Token "+e.token)
+	case e.username != "":
+		req.SetBasicAuth(e.username, e.password)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	snippet, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("HTTP %d: %s", resp.StatusCode, bytes.TrimSpace(snippet))
+	// 400 表示数据格式有误，重试也不会成功；401/403/404 等配置问题保留数据等待修复
+	if resp.StatusCode == http.StatusBadRequest {
+		return permanentError{err}
+	}
+	return err
+}
+
+func (e *influxExporter) check() ComponentHealth {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.lastErr != "" {
+		return ComponentHealth{Status: healthDegraded, Detail: fmt.Sprintf("%s (%d points buffered, %d dropped)", e.lastErr, len(e.buffer), e.dropped)}
+	}
+	if e.lastPush.IsZero() {
+		return ComponentHealth{Status: healthOK, Detail: "no points written yet"}
+	}
+	return ComponentHealth{Status: healthOK, Detail: "last write " + e.lastPush.Format(time.RFC3339)}
+}
+
+// 一个数据点：<prefix>_<name>,<tags> <fields> <纳秒时间戳>；空标签省略
+func (e *influxExporter) line(name string, tags map[string]string, fields map[string]any, t time.Time) string {
+	var b strings.Builder
+	b.WriteString(influxEscapeMeasurement(e.measurement + "_" + name))
+	keys := make([]string, 0, len(tags))
+	for k, v := range tags {
+		if v != "" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		b.WriteString("," + influxEscapeTag(k) + "=" + influxEscapeTag(tags[k]))
+	}
+	b.WriteString(e.tags)
+	b.WriteByte(' ')
+	keys = keys[:0]
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for i, k := range keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(influxEscapeTag(k) + "=" + influxFieldValue(fields[k]))
+	}
+	b.WriteByte(' ')
+	b.WriteString(strconv.FormatInt(t.UnixNano(), 10))
+	return b.String()
+}
+
+var (
+	influxMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "\n", `\n`)
+	influxTagEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", `\n`)
+	influxStringEscaper      = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+)
+
+func influxEscapeMeasurement(s string) string { return influxMeasurementEscaper.Replace(s) }
+func influxEscapeTag(s string) string         { return influxTagEscaper.Replace(s) }
+
+// 字段值：整数带 i 后缀，字符串加引号
+func influxFieldValue(v any) string {
+	switch v := v.(type) {
+	case bool:
+		return strconv.FormatBool(v)
+	case int:
+		return strconv.Itoa(v) + "i"
+	case int64:
+		return strconv.FormatInt(v, 10) + "i"
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case string:
+		return `"` + influxStringEscaper.Replace(v) + `"`
+	default:
+		return `"` + influxStringEscaper.Replace(fmt.Sprint(v)) + `"`
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// IPv4/IPv6 双栈支持：-ip-family 限制监听器、按需唤醒代理和开机检测使用的地址族，
+// 客户端地址统一规范化（去掉方括号、端口和 zone，IPv4 映射地址还原为 IPv4），
+// 认证失败统计对 IPv6 客户端按 -ipv6-client-prefix 网段聚合，避免换用同一网段内的地址绕过
+
+const (
+	ipFamilyAny  = "any"
+	ipFamilyIPv4 = "ipv4"
+	ipFamilyIPv6 = "ipv6"
+)
+
+var (
+	ipFamily         = ipFamilyAny
+	ipv6ClientPrefix = 64
+)
+
+func checkIPSettings() error {
+	switch ipFamily {
+	case ipFamilyAny, ipFamilyIPv4, ipFamilyIPv6:
+	default:
+		return fmt.Errorf("-ip-family must be %s, %s or %s", ipFamilyAny, ipFamilyIPv4, ipFamilyIPv6)
+	}
+	if ipv6ClientPrefix < 1 || ipv6ClientPrefix > 128 {
+		return fmt.Errorf("-ipv6-client-prefix must be between 1 and 128")
+	}
+	return nil
+}
+
+// 按 -ip-family 选择网络类型，network 为 "tcp" 或 "udp"。
+// tcp6 监听全部地址时只接受 IPv6 连接（IPV6_V6ONLY），tcp 为双栈
+func ipNetwork(network string) string {
+	switch ipFamily {
+	case ipFamilyIPv4:
+		return network + "4"
+	case ipFamilyIPv6:
+		return network + "6"
+	}
+	return network
+}
+
+// 规范化IP地址：接受 "[addr]"、"addr:port"、"[addr]:port" 和带 zone 的链路本地地址，
+// 去掉 zone，IPv4 映射的 IPv6 地址（::ffff:a.b.c.d）还原为 IPv4。无法解析时原样返回
+func normalizeIP(s string) string {
+	s = strings.TrimSpace(s)
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	addr, err := netip.ParseAddr(strings.Trim(s, "[]"))
+	if err != nil {
+		return s
+	}
+	return addr.WithZone("").Unmap().String()
+}
+
+// 用于统计和限流的客户端标识：IPv4 为地址本身，IPv6 为所在的 -ipv6-client-prefix 网段
+func clientNetwork(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil || !addr.Is6() || ipv6ClientPrefix == 128 {
+		return ip
+	}
+	prefix, err := addr.Prefix(ipv6ClientPrefix)
+	if err != nil {
+		return ip
+	}
+	return prefix.String()
+}
+
+// 监听全部地址时访问本机使用的回环地址（只监听 IPv6 时为 ::1）
+func loopbackHost(host string) string {
+	if addr, err := netip.ParseAddr(host); host != "" && (err != nil || !addr.IsUnspecified()) {
+		return host
+	}
+	if ipFamily == ipFamilyIPv6 {
+		return "::1"
+	}
+	return "127.0.0.1"
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// 请求体的严格 JSON 解码：拒绝未知字段和多余内容，解码失败时返回结构化错误，
+// 指出出错的字段或位置，方便固件和客户端开发者定位问题
+
+const (
+	jsonErrorInvalid      = "invalid_json"
+	jsonErrorType         = "invalid_type"
+	jsonErrorUnknownField = "unknown_field"
+	jsonErrorEmpty        = "empty_body"
+	jsonErrorTooLarge     = "body_too_large"
+)
+
+type jsonBodyError struct {
+	Code    string
+	Message string
+	Field   string // 出错的字段路径，未知时为空
+	Offset  int64  // 出错位置（字节偏移），未知时为0
+	Status  int
+}
+
+func (e *jsonBodyError) Error() string {
+	return e.Message
+}
+
+// 解码请求体到 v，失败时返回 *jsonBodyError
+func decodeJSON(r *http.Request, v any) error {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return describeJSONError(err)
+	}
+	end := dec.InputOffset()
+	if _, err := dec.Token(); err != io.EOF {
+		return &jsonBodyError{
+			Code:    jsonErrorInvalid,
+			Message: fmt.Sprintf("unexpected data after JSON value at offset %d", end),
+			Offset:  end,
+			Status:  http.StatusBadRequest,
+		}
+	}
+	return nil
+}
+
+func describeJSONError(err error) *jsonBodyError {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &maxBytesErr):
+		return &jsonBodyError{
+			Code:    jsonErrorTooLarge,
+			Message: fmt.Sprintf("request body exceeds %d bytes", maxBytesErr.Limit),
+			Status:  http.StatusRequestEntityTooLarge,
+		}
+	case errors.Is(err, io.EOF):
+		return &jsonBodyError{Code: jsonErrorEmpty, Message: "request body is empty", Status: http.StatusBadRequest}
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return &jsonBodyError{Code: jsonErrorInvalid, Message: "request body ends in the middle of a JSON value", Status: http.StatusBadRequest}
+	case errors.As(err, &syntaxErr):
+		return &jsonBodyError{
+			Code:    jsonErrorInvalid,
+			Message: fmt.Sprintf("%s at offset %d", syntaxErr.Error(), syntaxErr.Offset),
+			Offset:  syntaxErr.Offset,
+			Status:  http.StatusBadRequest,
+		}
+	case errors.As(err, &typeErr):
+		field := typeErr.Field
+		if field == "" {
+			field = "(body)"
+		}
+		return &jsonBodyError{
+			Code:    jsonErrorType,
+			Message: fmt.Sprintf("field %s must be %s, got %s at offset %d", field, jsonTypeName(typeErr.Type.String()), typeErr.Value, typeErr.Offset),
+			Field:   typeErr.Field,
+			Offset:  typeErr.Offset,
+			Status:  http.StatusBadRequest,
+		}
+	}
+	// encoding/json 对未知字段没有专门的错误类型，只能从错误信息中取字段名
+	if name, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		name = strings.Trim(name, `"`)
+		return &jsonBodyError{
+			Code:    jsonErrorUnknownField,
+			Message: fmt.Sprintf("unknown field %q", name),
+			Field:   name,
+			Status:  http.StatusBadRequest,
+		}
+	}
+	// 自定义类型（例如 Duration）的 UnmarshalJSON 返回的错误
+	return &jsonBodyError{Code: jsonErrorInvalid, Message: err.Error(), Status: http.StatusBadRequest}
+}
+
+// Go 类型名换成 JSON 的说法
+func jsonTypeName(goType string) string {
+	switch {
+	case goType == "string":
+		return "a string"
+	case goType == "bool":
+		return "a boolean"
+	case strings.HasPrefix(goType, "int"), strings.HasPrefix(goType, "uint"), strings.HasPrefix(goType, "float"):
+		return "a number"
+	case strings.HasPrefix(goType, "[]"):
+		return "an array"
+	default:
+		return "an object"
+	}
+}
+
+// 解码请求体，失败时写入错误响应并返回 false
+func readJSON(w http.ResponseWriter, r *http.Request, v any) bool {
+	err := decodeJSON(r, v)
+	if err == nil {
+		return true
+	}
+	writeJSONError(w, err.(*jsonBodyError))
+	return false
+}
+
+func writeJSONError(w http.ResponseWriter, e *jsonBodyError) {
+	body := map[string]interface{}{
+		"success": false,
+		"error":   e.Code,
+		"message": e.Message,
+	}
+	if e.Field != "" {
+		body["field"] = e.Field
+	}
+	if e.Offset > 0 {
+		body["offset"] = e.Offset
+	}
+	writeJSON(w, e.Status, body)
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// 唤醒延迟：唤醒消息记录各阶段的时间——入队 queued_at、第一次下发给中继 delivered_at、收到成功的确认 acked_at、
+// 确认目标已开机 up_at，一次唤醒的耗时据此分为三段，用来判断慢在哪里：
+//   - poll：入队到下发，取决于中继的轮询间隔（长轮询时接近0）
+//   - relay：下发到确认，中继发送魔术包并回复确认的耗时，包含未确认时的重新下发
+//   - boot：确认到开机，目标的开机时间
+//
+// total 为入队到开机。目标开机由开机检测（probe）从关机变为开机确认，没有检测时由目标上的代理离线后重新上报确认；
+// 只记录在确认后 bootWindow 内开机的最近一次唤醒。消息只保存在内存中，统计范围不超过服务器本次运行的时间
+
+const bootWindow = 15 * time.Minute
+
+const (
+	latencyPoll  = "poll"
+	latencyRelay = "relay"
+	latencyBoot  = "boot"
+	latencyTotal = "total"
+)
+
+var latencyStages = []string{latencyPoll, latencyRelay, latencyBoot, latencyTotal}
+
+var wakeLatency = newHistogramVec("esp32_wol_wake_latency_seconds",
+	"Wake latency by stage: poll (queued to delivered), relay (delivered to acked), boot (acked to target up), total.",
+	[]float64{.1, .5, 1, 2, 5, 10, 30, 60, 120, 300, 600}, "stage")
+
+// 唤醒消息某个阶段的耗时（秒），阶段尚未完成时返回 false
+func (m *WOLMessage) stageSeconds(stage string) (float64, bool) {
+	var from, to *time.Time
+	switch stage {
+	case latencyPoll:
+		from, to = m.QueuedAt, m.DeliveredAt
+	case latencyRelay:
+		from, to = m.DeliveredAt, m.AckedAt
+	case latencyBoot:
+		from, to = m.AckedAt, m.UpAt
+	case latencyTotal:
+		from, to = m.QueuedAt, m.UpAt
+	}
+	if m.Type != "" || from == nil || to == nil {
+		return 0, false
+	}
+	return max(to.Sub(*from), 0).Seconds(), true
+}
+
+// 阶段完成时计入 Prometheus 指标
+func observeLatency(m *WOLMessage, stage string) {
+	if seconds, ok := m.stageSeconds(stage); ok {
+		wakeLatency.observe(seconds, stage)
+	}
+}
+
+// 一次唤醒各阶段的耗时（秒），尚未完成的阶段省略
+type WakeLatency struct {
+	Poll  *float64 `json:"poll,omitempty"`
+	Relay *float64 `json:"relay,omitempty"`
+	Boot  *float64 `json:"boot,omitempty"`
+	Total *float64 `json:"total,omitempty"`
+}
+
+func roundSeconds(v float64) float64 {
+	return math.Round(v*1000) / 1000
+}
+
+// 消息的各阶段耗时，管理命令和还没有下发的唤醒返回 nil
+func messageLatency(m *WOLMessage) *WakeLatency {
+	var l WakeLatency
+	fields := map[string]**float64{latencyPoll: &l.Poll, latencyRelay: &l.Relay, latencyBoot: &l.Boot, latencyTotal: &l.Total}
+	found := false
+	for stage, field := range fields {
+		if seconds, ok := m.stageSeconds(stage); ok {
+			rounded := roundSeconds(seconds)
+			*field, found = &rounded, true
+		}
+	}
+	if !found {
+		return nil
+	}
+	return &l
+}
+
+// 目标最近一次唤醒消息，调用方需持有 storage.mu
+func lastWakeMessage(name string) *WOLMessage {
+	var last *WOLMessage
+	for _, m := range storage.messages {
+		if m.Type == "" && m.Target == name && (last == nil || m.CreatedAt.After(last.CreatedAt)) {
+			last = m
+		}
+	}
+	return last
+}
+
+// 最近一次唤醒已确认、在 bootWindow 内还没有确认开机。调用方需持有 storage.mu 读锁
+func awaitingBoot(name string, now time.Time) bool {
+	last := lastWakeMessage(name)
+	return last != nil && last.Status == messageAcked && last.AckedAt != nil && last.UpAt == nil && now.Sub(*last.AckedAt) <= bootWindow
+}
+
+// 目标确认开机：记录最近一次唤醒的开机时间。最近一次唤醒尚未确认、已记录过或确认后超过 bootWindow 时不做任何事
+func confirmAwake(name string, at time.Time) {
+	storage.mu.Lock()
+	last := lastWakeMessage(name)
+	// 检测开始时确认可能还没有到达，此时开机耗时记为0
+	if last == nil || !awaitingBoot(name, at) || (last.DeliveredAt != nil && at.Before(*last.DeliveredAt)) {
+		storage.mu.Unlock()
+		return
+	}
+	last.UpAt = &at
+	replicateMessage(last)
+	observeLatency(last, latencyBoot)
+	observeLatency(last, latencyTotal)
+	latency := messageLatency(last)
+	storage.mu.Unlock()
+
+	slog.Info("wake confirmed", "target", name, "message_id", last.ID, "boot_seconds", *latency.Boot, "total_seconds", *latency.Total)
+}
+
+// 一个阶段的耗时分布（秒）
+type LatencySummary struct {
+	Count int     `json:"count"`
+	P50   float64 `json:"p50"`
+	P95   float64 `json:"p95"`
+	Max   float64 `json:"max"`
+}
+
+// 一组唤醒的延迟，没有样本的阶段省略
+type LatencyStatsEntry struct {
+	Key     string                     `json:"key"`
+	Wakes   int                        `json:"wakes"`
+	Stages  map[string]*LatencySummary `json:"stages"`
+	samples map[string][]float64
+}
+
+type LatencyStatsResponse struct {
+	GroupBy string              `json:"group_by"`
+	Range   string              `json:"range"`
+	Start   time.Time           `json:"start"`
+	End     time.Time           `json:"end"`
+	Total   LatencyStatsEntry   `json:"total"`
+	Groups  []LatencyStatsEntry `json:"groups"`
+}
+
+func (e *LatencyStatsEntry) add(m *WOLMessage) {
+	e.Wakes++
+	if e.samples == nil {
+		e.samples = make(map[string][]float64)
+	}
+	for _, stage := range latencyStages {
+		if seconds, ok := m.stageSeconds(stage); ok {
+			e.samples[stage] = append(e.samples[stage], seconds)
+		}
+	}
+}
+
+func (e *LatencyStatsEntry) finish() {
+	e.Stages = make(map[string]*LatencySummary)
+	for stage, values := range e.samples {
+		sort.Float64s(values)
+		e.Stages[stage] = &LatencySummary{
+			Count: len(values),
+			P50:   roundSeconds(percentile(values, 0.5)),
+			P95:   roundSeconds(percentile(values, 0.95)),
+			Max:   roundSeconds(values[len(values)-1]),
+		}
+	}
+}
+
+// 已排序样本的百分位数（最近秩法）
+func percentile(sorted []float64, p float64) float64 {
+	i := int(math.Ceil(p*float64(len(sorted)))) - 1
+	return sorted[max(i, 0)]
+}
+
+// 唤醒延迟统计：GET /api/stats/latency?group_by=target&range=7d
+// group_by 可选 target（默认）、device，按键排序；只统计唤醒消息，用户只统计自己能看到的消息
+func latencyStatsHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	groupBy, rangeParam := q.Get("group_by"), q.Get("range")
+	if groupBy == "" {
+		groupBy = "target"
+	}
+	if rangeParam == "" {
+		rangeParam = "7d"
+	}
+	span, err := parseSpan(rangeParam)
+	if err != nil {
+		http.Error(w, "range must be a duration, e.g. 24h or 30d", http.StatusBadRequest)
+		return
+	}
+	var key func(m *WOLMessage) string
+	switch groupBy {
+	case "target":
+		key = func(m *WOLMessage) string { return firstNonEmpty(m.Target, m.TargetMAC) }
+	case "device":
+		key = func(m *WOLMessage) string { return m.DeviceID }
+	default:
+		http.Error(w, "group_by must be target or device", http.StatusBadRequest)
+		return
+	}
+
+	end := time.Now()
+	start := end.Add(-span)
+	resp := LatencyStatsResponse{GroupBy: groupBy, Range: rangeParam, Start: start, End: end, Total: LatencyStatsEntry{Key: "total"}}
+	groups := make(map[string]*LatencyStatsEntry)
+
+	p := requestPrincipal(r)
+	storage.mu.RLock()
+	for _, m := range storage.messages {
+		if m.Type != "" || m.QueuedAt == nil || m.CreatedAt.Before(start) || !p.canSeeMessage(m) {
+			continue
+		}
+		k := key(m)
+		g, exists := groups[k]
+		if !exists {
+			g = &LatencyStatsEntry{Key: k}
+			groups[k] = g
+		}
+		g.add(m)
+		resp.Total.add(m)
+	}
+	storage.mu.RUnlock()
+
+	resp.Groups = make([]LatencyStatsEntry, 0, len(groups))
+	for _, g := range groups {
+		g.finish()
+		resp.Groups = append(resp.Groups, *g)
+	}
+	resp.Total.finish()
+	sort.Slice(resp.Groups, func(i, j int) bool { return resp.Groups[i].Key < resp.Groups[j].Key })
+	writeJSON(w, http.StatusOK, resp)
+}
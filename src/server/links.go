@@ -0,0 +1,268 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 唤醒链接：无需API密钥即可唤醒指定目标的限时签名URL
+type WakeLink struct {
+	ID        string    `json:"id"`
+	Target    string    `json:"target"`
+	Label     string    `json:"label,omitempty"` // 备注，例如发给谁
+	ExpiresAt time.Time `json:"expires_at"`
+	CreatedAt time.Time `json:"created_at"`
+	Uses      int64     `json:"uses"`
+	LastUsed  time.Time `json:"last_used"`
+}
+
+// 唤醒链接签名密钥（-link-secret），为空时由API密钥派生
+var linkSecret string
+
+const (
+	defaultLinkTTL = 7 * 24 * time.Hour
+	maxLinkTTL     = 366 * 24 * time.Hour
+	// 同一链接在该时间内重复打开不会再次唤醒，避免刷新或链接预览重复发送
+	linkCooldown = 30 * time.Second
+)
+
+func linkSigningKey() []byte {
+	if linkSecret != "" {
+		return []byte(linkSecret)
+	}
+	mac := hmac.New(sha256.New, []byte(API_KEY))
+	mac.Write([]byte("esp32-wol wake links"))
+	return mac.Sum(nil)
+}
+
+// 签名覆盖链接ID、目标和过期时间，任何一项被修改都会校验失败
+func signWakeLink(id, target string, expires int64) string {
+	mac := hmac.New(sha256.New, linkSigningKey())
+	fmt.Fprintf(mac, "%s\n%s\n%d", id, target, expires)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func wakeLinkURL(r *http.Request, l WakeLink) string {
+	exp := l.ExpiresAt.Unix()
+	q := url.Values{}
+	q.Set("id", l.ID)
+	q.Set("exp", strconv.FormatInt(exp, 10))
+	q.Set("sig", signWakeLink(l.ID, l.Target, exp))
+	return externalURL(r, "/wake?"+q.Encode())
+}
+
+// 管理接口中的唤醒链接，附带完整URL
+type WakeLinkView struct {
+	WakeLink
+	URL     string `json:"url"`
+	Expired bool   `json:"expired"`
+}
+
+// 唤醒链接列表和创建
+func wakeLinksHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		storage.mu.RLock()
+		links := make([]WakeLinkView, 0, len(storage.wakeLinks))
+		for _, l := range storage.wakeLinks {
+			links = append(links, WakeLinkView{WakeLink: *l, URL: wakeLinkURL(r, *l), Expired: time.Now().After(l.ExpiresAt)})
+		}
+		storage.mu.RUnlock()
+		sort.Slice(links, func(i, j int) bool { return links[i].CreatedAt.Before(links[j].CreatedAt) })
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"success": true,
+			"links":   links,
+			"total":   len(links),
+		})
+
+	case http.MethodPost:
+		var req struct {
+			Target    string   `json:"target"`
+			Label     string   `json:"label"`
+			ExpiresIn Duration `json:"expires_in"` // 例如 "168h"，默认7天
+		}
+		if !readJSON(w, r, &req) {
+			return
+		}
+		ttl := time.Duration(req.ExpiresIn)
+		if ttl == 0 {
+			ttl = defaultLinkTTL
+		}
+		if ttl < time.Minute || ttl > maxLinkTTL {
+			http.Error(w, "expires_in must be between 1m and 8784h", http.StatusBadRequest)
+			return
+		}
+
+		buf := make([]byte, 8)
+		rand.Read(buf)
+		now := time.Now()
+		link := &WakeLink{
+			ID:        "lnk_" + hex.EncodeToString(buf),
+			Target:    req.Target,
+			Label:     req.Label,
+			ExpiresAt: now.Add(ttl).Truncate(time.Second),
+			CreatedAt: now,
+		}
+
+		storage.mu.Lock()
+		if _, exists := storage.targets[req.Target]; !exists {
+			storage.mu.Unlock()
+			http.Error(w, fmt.Sprintf("target %q not found", req.Target), http.StatusBadRequest)
+			return
+		}
+		storage.wakeLinks[link.ID] = link
+		storage.mu.Unlock()
+
+		markDirty()
+		requestLogger(r).Info("wake link created", "link_id", link.ID, "target", link.Target, "expires_at", link.ExpiresAt)
+		writeJSON(w, http.StatusCreated, map[string]interface{}{
+			"success": true,
+			"message": "Wake link created",
+			"link":    WakeLinkView{WakeLink: *link, URL: wakeLinkURL(r, *link)},
+		})
+
+	default:
+		methodNotAllowed(w, r)
+	}
+}
+
+// 撤销唤醒链接：DELETE /api/admin/wake-links/<id>
+func wakeLinkHandler(w http.ResponseWriter, r *http.Request) {
+	id, _ := pathParams(r, "/api/admin/wake-links/")
+	storage.mu.Lock()
+	_, exists := storage.wakeLinks[id]
+	delete(storage.wakeLinks, id)
+	storage.mu.Unlock()
+	if !exists {
+		http.Error(w, "Wake link not found", http.StatusNotFound)
+		return
+	}
+
+	markDirty()
+	requestLogger(r).Info("wake link revoked", "link_id", id)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"success": true, "message": "Wake link revoked"})
+}
+
+var wakePage = template.Must(template.New("wake").Parse(`<!DOCTYPE html>
+<html lang="zh-CN">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex">
+<title>{{.Title}}</title>
+</head>
+<body style="font-family: system-ui, sans-serif; text-align: center; padding: 3rem 1rem;">
+<h1>{{.Title}}</h1>
+<p>{{.Detail}}</p>
+</body>
+</html>
+`))
+
+func renderWakePage(w http.ResponseWriter, status int, title, detail string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.WriteHeader(status)
+	wakePage.Execute(w, map[string]string{"Title": title, "Detail": detail})
+}
+
+// 打开唤醒链接：GET /wake?id=...&exp=...&sig=...，校验签名后唤醒链接绑定的目标
+func wakeLinkVisitHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	id := q.Get("id")
+	exp, err := strconv.ParseInt(q.Get("exp"), 10, 64)
+	if id == "" || err != nil || q.Get("sig") == "" {
+		renderWakePage(w, http.StatusBadRequest, "链接无效", "链接不完整，请确认复制了完整的地址。")
+		return
+	}
+
+	storage.mu.Lock()
+	link, exists := storage.wakeLinks[id]
+	if !exists || link.ExpiresAt.Unix() != exp ||
+		!hmac.Equal([]byte(q.Get("sig")), []byte(signWakeLink(id, link.Target, exp))) {
+		storage.mu.Unlock()
+		requestLogger(r).Warn("invalid wake link", "link_id", id, "client_ip", clientIP(r))
+		renderWakePage(w, http.StatusNotFound, "链接无效", "链接不存在或已被撤销。")
+		return
+	}
+	if time.Now().After(link.ExpiresAt) {
+		storage.mu.Unlock()
+		renderWakePage(w, http.StatusGone, "链接已过期", "请联系管理员重新获取链接。")
+		return
+	}
+	if m := storage.maintenance; m != nil {
+		retryAfter := m.RetryAfter
+		storage.mu.Unlock()
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		renderWakePage(w, http.StatusServiceUnavailable, "服务器维护中", "暂时无法发送唤醒指令，请稍后再试。")
+		return
+	}
+	target := link.Target
+	recent := time.Since(link.LastUsed) < linkCooldown
+	if !recent {
+		link.Uses++
+		link.LastUsed = time.Now()
+	}
+	storage.mu.Unlock()
+
+	if recent {
+		renderWakePage(w, http.StatusOK, "已发送唤醒指令", fmt.Sprintf("刚刚已经唤醒过 %s，请稍候片刻。", target))
+		return
+	}
+	markDirty()
+
+	reqs, err := resolveWake(target, "", "link:"+id)
+	if err == nil {
+		_, err = queueWake(requestLogger(r).With("link_id", id), reqs[0])
+	}
+	// 允许时段和冷却时间与API一样返回 403、429，不是服务器的临时故障
+	var ce *cooldownError
+	switch {
+	case errors.Is(err, errOutsideAllowedHours):
+		requestLogger(r).Info("wake link outside allowed hours", "link_id", id, "target", target)
+		renderWakePage(w, http.StatusForbidden, "当前时段不允许唤醒", allowedHoursNotice(target, time.Now()))
+		return
+	case errors.As(err, &ce):
+		requestLogger(r).Info("wake link in cooldown", "link_id", id, "target", target, "retry_after", ce.RetryAfter.Round(time.Second).String())
+		w.Header().Set("Retry-After", strconv.Itoa(int(ce.RetryAfter.Seconds())+1))
+		renderWakePage(w, http.StatusTooManyRequests, "刚刚唤醒过",
+			fmt.Sprintf("%s 刚刚被唤醒过，请在 %s 之后再试。", target, time.Now().Add(ce.RetryAfter).Format("15:04:05")))
+		return
+	case err != nil:
+		requestLogger(r).Error("wake link failed", "link_id", id, "target", target, "error", err)
+		renderWakePage(w, http.StatusServiceUnavailable, "唤醒失败", "暂时无法发送唤醒指令，请稍后再试。")
+		return
+	}
+	renderWakePage(w, http.StatusOK, "已发送唤醒指令", fmt.Sprintf("%s 正在启动，通常需要一分钟左右。", target))
+}
+
+// 唤醒页面上的允许时段说明：目标接受唤醒的时段和下一次可以唤醒的时间
+func allowedHoursNotice(target string, now time.Time) string {
+	storage.mu.RLock()
+	var windows []TimeWindow
+	if t, exists := storage.targets[target]; exists {
+		windows = t.AllowedHours
+	}
+	storage.mu.RUnlock()
+	parts := make([]string, len(windows))
+	for i, tw := range windows {
+		parts[i] = tw.String()
+	}
+	notice := fmt.Sprintf("%s 只在 %s 接受唤醒", target, strings.Join(parts, "；"))
+	if next := nextAllowedTime(windows, now); !next.IsZero() {
+		notice += "，下次可以唤醒的时间为 " + next.Format("01-02 15:04")
+	}
+	return notice + "。"
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// 根据监听地址创建监听器
+// 支持 "host:port"、"tcp://host:port"、"unix:///path/to.sock"、"tailscale://hostname[:port]"
+// 和 "systemd://[name]"；systemd 的一个名称可以对应多个套接字，因此返回多个监听器
+func openListeners(spec string, socketMode string) ([]net.Listener, error) {
+	if name, ok := strings.CutPrefix(spec, "systemd://"); ok {
+		return takeSystemdListeners(name)
+	}
+	var listener net.Listener
+	var err error
+	if path, ok := strings.CutPrefix(spec, "unix://"); ok {
+		listener, err = openUnixListener(path, socketMode)
+	} else if strings.HasPrefix(spec, "tailscale://") {
+		var hostname, port string
+		if hostname, port, err = parseTailscaleAddr(spec); err == nil {
+			listener, err = listenTailscale(hostname, port)
+		}
+	} else {
+		listener, err = net.Listen(ipNetwork("tcp"), strings.TrimPrefix(spec, "tcp://"))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []net.Listener{listener}, nil
+}
+
+// 创建Unix域套接字监听器，并设置文件权限
+func openUnixListener(path string, socketMode string) (net.Listener, error) {
+	if path == "" {
+		return nil, fmt.Errorf("unix socket path is empty")
+	}
+
+	mode, err := strconv.ParseUint(socketMode, 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid socket mode %q: %v", socketMode, err)
+	}
+
+	// 清理上次异常退出遗留的套接字文件
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, os.FileMode(mode)); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// 可重复的 -listen 参数，单个值中也可以用空白分隔多个地址（便于通过环境变量配置）
+type listenFlag []string
+
+func (f *listenFlag) String() string {
+	return strings.Join(*f, " ")
+}
+
+func (f *listenFlag) Set(value string) error {
+	*f = append(*f, strings.Fields(value)...)
+	return nil
+}
+
+// 监听器配置
+// 格式: [scheme://]addr[?选项]，scheme 为 http（默认）、https、unix、tailscale 或 systemd。
+// IPv6 地址写在方括号中，例如 [::]:8080、[fe80::1%eth0]:8080
+// 选项:
+//
+//	cert, key  HTTPS证书和私钥文件（https 必填，systemd 可选）
+//	client_ca  受信任的客户端证书CA文件（PEM），设置后请求客户端证书（可选），用于设备身份绑定
+//	routes     允许的路由分组，逗号分隔: public, device, control, admin；默认全部
+//	auth=off   该监听器上不校验API密钥（仅用于本机可信访问）
+type listenerConfig struct {
+	Addr     string
+	TLSCert  string
+	TLSKey   string
+	ClientCA string
+	Routes   map[string]bool // nil 表示允许全部分组
+	NoAuth   bool
+}
+
+// 解析监听地址
+func parseListenSpec(spec string) (listenerConfig, error) {
+	var cfg listenerConfig
+
+	addr, rawQuery, _ := strings.Cut(spec, "?")
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return cfg, err
+	}
+
+	switch {
+	case strings.HasPrefix(addr, "https://"):
+		cfg.Addr = strings.TrimPrefix(addr, "https://")
+		cfg.TLSCert = query.Get("cert")
+		cfg.TLSKey = query.Get("key")
+		if cfg.TLSCert == "" || cfg.TLSKey == "" {
+			return cfg, fmt.Errorf("https listener requires cert and key")
+		}
+	case strings.HasPrefix(addr, "http://"):
+		cfg.Addr = strings.TrimPrefix(addr, "http://")
+	case strings.HasPrefix(addr, "tailscale://"):
+		if _, _, err := parseTailscaleAddr(addr); err != nil {
+			return cfg, err
+		}
+		cfg.Addr = addr
+	case strings.HasPrefix(addr, "systemd://"):
+		cfg.Addr = addr
+		cfg.TLSCert = query.Get("cert")
+		cfg.TLSKey = query.Get("key")
+		if (cfg.TLSCert == "") != (cfg.TLSKey == "") {
+			return cfg, fmt.Errorf("systemd listener needs both cert and key for HTTPS")
+		}
+	default:
+		cfg.Addr = addr
+	}
+	cfg.ClientCA = query.Get("client_ca")
+	if cfg.ClientCA != "" && cfg.TLSCert == "" {
+		return cfg, fmt.Errorf("client_ca requires an HTTPS listener")
+	}
+	// URL 形式中链路本地地址的 zone 写作 %25，例如 http://[fe80::1%25eth0]:8080
+	if !strings.Contains(cfg.Addr, "://") {
+		cfg.Addr = strings.Replace(cfg.Addr, "%25", "%", 1)
+	}
+
+	if groups := query.Get("routes"); groups != "" && groups != "all" {
+		cfg.Routes = make(map[string]bool)
+		for _, group := range strings.Split(groups, ",") {
+			group = strings.TrimSpace(group)
+			switch group {
+			case routeGroupPublic, routeGroupDevice, routeGroupControl, routeGroupAdmin:
+				cfg.Routes[group] = true
+			default:
+				return cfg, fmt.Errorf("unknown route group %q", group)
+			}
+		}
+	}
+
+	switch query.Get("auth") {
+	case "", "on":
+	case "off":
+		cfg.NoAuth = true
+	default:
+		return cfg, fmt.Errorf("auth must be on or off")
+	}
+	return cfg, nil
+}
+
+// 该监听器是否允许访问指定路由分组
+func (c listenerConfig) allows(group string) bool {
+	return c.Routes == nil || c.Routes[group]
+}
+
+// 用于日志显示的策略描述
+func (c listenerConfig) describe() string {
+	parts := []string{"http"}
+	if c.TLSCert != "" {
+		parts[0] = "https"
+	}
+	if strings.HasPrefix(c.Addr, "tailscale://") {
+		parts[0] = "tailscale"
+	}
+	if strings.HasPrefix(c.Addr, "systemd://") {
+		parts[0] += "+systemd"
+	}
+	if c.Routes == nil {
+		parts = append(parts, "routes=all")
+	} else {
+		groups := make([]string, 0, len(c.Routes))
+		for group := range c.Routes {
+			groups = append(groups, group)
+		}
+		sort.Strings(groups)
+		parts = append(parts, "routes="+strings.Join(groups, ","))
+	}
+	if c.ClientCA != "" {
+		parts = append(parts, "client_ca")
+	}
+	if c.NoAuth {
+		parts = append(parts, "auth=off")
+	}
+	return strings.Join(parts, " ")
+}
+
+// 第一个 TCP 监听器（跳过 Unix 域套接字和 Tailscale），用于推导本机访问地址
+func firstTCPListener(specs []string) (cfg listenerConfig, host, port string, ok bool) {
+	for _, spec := range specs {
+		cfg, err := parseListenSpec(spec)
+		if err != nil {
+			continue
+		}
+		if name, isSystemd := strings.CutPrefix(cfg.Addr, "systemd://"); isSystemd {
+			if host, port, ok = systemdTCPAddr(name); ok {
+				return cfg, host, port, true
+			}
+			continue
+		}
+		if strings.Contains(cfg.Addr, "://") {
+			continue
+		}
+		if host, port, err = net.SplitHostPort(cfg.Addr); err == nil {
+			return cfg, host, port, true
+		}
+	}
+	return listenerConfig{}, "", "", false
+}
+
+// client_ca 的 TLS 配置：请求但不强制客户端证书，出示的证书必须由该CA签发。
+// 没有证书的客户端照常按API密钥认证，证书只作为设备身份绑定的依据
+func clientCATLSConfig(path string) (*tls.Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificate found in %s", path)
+	}
+	return &tls.Config{ClientCAs: pool, ClientAuth: tls.VerifyClientCertIfGiven}, nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// 实时状态推送的消息
+type liveMessage struct {
+	Type     string       `json:"type"` // snapshot 或 event
+	Devices  []Device     `json:"devices,omitempty"`
+	Messages []WOLMessage `json:"messages,omitempty"`
+	Event    *Event       `json:"event,omitempty"`
+}
+
+// 快照中包含的最近消息数
+const liveRecentMessages = 50
+
+// 当前设备和最近消息的快照
+func liveSnapshot() liveMessage {
+	storage.mu.RLock()
+	devices := make([]Device, 0, len(storage.devices))
+	for _, d := range storage.devices {
+		devices = append(devices, *d)
+	}
+	messages := make([]WOLMessage, 0, len(storage.messages))
+	for _, m := range storage.messages {
+		messages = append(messages, *m)
+	}
+	storage.mu.RUnlock()
+
+	sort.Slice(devices, func(i, j int) bool { return devices[i].ID < devices[j].ID })
+	sort.Slice(messages, func(i, j int) bool { return messages[i].CreatedAt.After(messages[j].CreatedAt) })
+	if len(messages) > liveRecentMessages {
+		messages = messages[:liveRecentMessages]
+	}
+	return liveMessage{Type: "snapshot", Devices: devices, Messages: messages}
+}
+
+// 实时状态 WebSocket：GET /api/admin/ws
+// 连接后先推送设备和最近消息的快照，之后推送每个事件。
+// 浏览器的 WebSocket 无法设置请求头，API密钥通过 api_key 查询参数传递
+func liveHandler(w http.ResponseWriter, r *http.Request) {
+	// 先订阅再取快照，避免两者之间的事件丢失
+	ch, _, cancel := events.subscribe(0)
+	defer cancel()
+
+	ws, err := upgradeWebSocket(w, r)
+	if err != nil {
+		return
+	}
+	requestLogger(r).Info("live status client connected", "client_ip", clientIP(r))
+
+	send := func(m liveMessage) error {
+		data, _ := json.Marshal(m)
+		return ws.writeText(data)
+	}
+	if err := send(liveSnapshot()); err != nil {
+		ws.conn.Close()
+		return
+	}
+
+	readErr := make(chan error, 1)
+	go func() { readErr <- ws.readLoop(90 * time.Second) }()
+
+	heartbeat := time.NewTicker(30 * time.Second)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case e := <-ch:
+			if err := send(liveMessage{Type: "event", Event: &e}); err != nil {
+				ws.conn.Close()
+				return
+			}
+		case <-heartbeat.C:
+			if err := ws.ping(); err != nil {
+				ws.conn.Close()
+				return
+			}
+		case <-readErr:
+			ws.close(1000, "")
+			requestLogger(r).Info("live status client disconnected")
+			return
+		case <-shutdownCh:
+			ws.close(1001, "server shutting down")
+			return
+		}
+	}
+}
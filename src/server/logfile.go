@@ -0,0 +1,212 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 轮转日志文件的时间戳格式，追加在文件名后，例如 server.log.20240102-150405
+const logBackupTimeFormat = "20060102-150405"
+
+// 按大小轮转的日志文件，旧文件可选gzip压缩，并按数量和保留时间清理
+type rotatingFile struct {
+	path       string
+	maxSize    int64         // 单个文件最大字节数，0 表示不按大小轮转
+	maxAge     time.Duration // 旧文件保留时间，0 表示不按时间清理
+	maxBackups int           // 保留的旧文件数量，0 表示不限制
+	compress   bool
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+
+	cleanup chan struct{}
+}
+
+func openRotatingFile(path string, maxSizeMB int, maxAge time.Duration, maxBackups int, compress bool) (*rotatingFile, error) {
+	rf := &rotatingFile{
+		path:       path,
+		maxSize:    int64(maxSizeMB) * 1024 * 1024,
+		maxAge:     maxAge,
+		maxBackups: maxBackups,
+		compress:   compress,
+		cleanup:    make(chan struct{}, 1),
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	go rf.cleanupLoop()
+	rf.triggerCleanup()
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	file, err := os.OpenFile(rf.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	rf.file = file
+	rf.size = info.Size()
+	return nil
+}
+
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.file == nil {
+		return 0, os.ErrClosed
+	}
+	if rf.maxSize > 0 && rf.size > 0 && rf.size+int64(len(p)) > rf.maxSize {
+		if err := rf.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "log rotation failed: %v\n", err)
+		}
+	}
+
+	n, err := rf.file.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+// 把当前文件重命名为带时间戳的备份，并打开新文件
+func (rf *rotatingFile) rotate() error {
+	if err := rf.file.Close(); err != nil {
+		return err
+	}
+	rf.file = nil
+
+	backup := rf.path + "." + time.Now().Format(logBackupTimeFormat)
+	if _, err := os.Stat(backup); err == nil {
+		backup += fmt.Sprintf(".%d", time.Now().UnixNano())
+	}
+	if err := os.Rename(rf.path, backup); err != nil {
+		// 重命名失败时继续写原文件，避免丢日志
+		if openErr := rf.open(); openErr != nil {
+			return openErr
+		}
+		return err
+	}
+	if err := rf.open(); err != nil {
+		return err
+	}
+	rf.triggerCleanup()
+	return nil
+}
+
+func (rf *rotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.file == nil {
+		return nil
+	}
+	err := rf.file.Close()
+	rf.file = nil
+	close(rf.cleanup)
+	return err
+}
+
+func (rf *rotatingFile) triggerCleanup() {
+	select {
+	case rf.cleanup <- struct{}{}:
+	default:
+	}
+}
+
+// 压缩和清理在后台进行，不阻塞日志写入
+func (rf *rotatingFile) cleanupLoop() {
+	for range rf.cleanup {
+		if err := rf.compressAndPrune(); err != nil {
+			fmt.Fprintf(os.Stderr, "log cleanup failed: %v\n", err)
+		}
+	}
+}
+
+func (rf *rotatingFile) compressAndPrune() error {
+	backups, err := filepath.Glob(rf.path + ".*")
+	if err != nil {
+		return err
+	}
+
+	if rf.compress {
+		for i, backup := range backups {
+			if strings.HasSuffix(backup, ".gz") {
+				continue
+			}
+			if err := gzipFile(backup); err != nil {
+				return err
+			}
+			backups[i] = backup + ".gz"
+		}
+	}
+
+	// 文件名中的时间戳可以直接按字典序排序，最新的在前
+	sort.Sort(sort.Reverse(sort.StringSlice(backups)))
+	for i, backup := range backups {
+		expired := false
+		if rf.maxBackups > 0 && i >= rf.maxBackups {
+			expired = true
+		}
+		if rf.maxAge > 0 {
+			if info, err := os.Stat(backup); err == nil && time.Since(info.ModTime()) > rf.maxAge {
+				expired = true
+			}
+		}
+		if expired {
+			if err := os.Remove(backup); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func gzipFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	dst, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(dst)
+	if _, err := io.Copy(gz, src); err != nil {
+		gz.Close()
+		dst.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	// 保留原文件的修改时间，按保留时间清理时才准确
+	os.Chtimes(path+".gz", info.ModTime(), info.ModTime())
+	return os.Remove(path)
+}
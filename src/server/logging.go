@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// 初始化全局日志：按参数选择级别和输出格式
+func setupLogging(out io.Writer, level, format string) error {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("invalid log level %q", level)
+	}
+
+	opts := &slog.HandlerOptions{Level: lvl}
+	var handler slog.Handler
+	switch format {
+	case "text":
+		handler = slog.NewTextHandler(out, opts)
+	case "json":
+		handler = slog.NewJSONHandler(out, opts)
+	default:
+		return fmt.Errorf("invalid log format %q", format)
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// 记录错误并退出
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+type requestIDKey struct{}
+
+// 生成随机请求ID
+func newRequestID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// 请求ID中间件：沿用客户端或代理传入的 X-Request-ID，否则生成新的，并在响应头中返回
+func requestIDMiddleware(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if id == "" || len(id) > 64 {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		handler(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	}
+}
+
+// 带请求ID字段的日志记录器
+func requestLogger(r *http.Request) *slog.Logger {
+	if id, ok := r.Context().Value(requestIDKey{}).(string); ok {
+		return slog.Default().With("request_id", id)
+	}
+	return slog.Default()
+}
+
+// 日志中记录的请求/响应体最大字节数，0 表示不记录请求体
+var logBodyLimit = 4096
+
+// 不记录请求/响应体的路由（高频接口）
+var logBodySkip = map[string]bool{}
+
+// 解析逗号分隔的路由列表
+func parseRouteList(value string) map[string]bool {
+	set := make(map[string]bool)
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			set[item] = true
+		}
+	}
+	return set
+}
+
+// 响应写入器包装器，用于捕获响应内容（最多 limit 字节）并统计写出的字节数。
+// 事件流响应不捕获内容，缓冲区在第一次捕获时才分配
+type responseWriter struct {
+	http.ResponseWriter
+	body       bytes.Buffer
+	limit      int
+	truncated  bool
+	statusCode int
+	written    int64
+}
+
+func newResponseWriter(w http.ResponseWriter, limit int) *responseWriter {
+	return &responseWriter{
+		ResponseWriter: w,
+		limit:          limit,
+		statusCode:     http.StatusOK,
+	}
+}
+
+func (rw *responseWriter) Write(b []byte) (int, error) {
+	n, err := rw.ResponseWriter.Write(b)
+	rw.written += int64(n)
+	if rw.limit <= 0 {
+		return n, err
+	}
+	if room := rw.limit - rw.body.Len(); room > 0 {
+		if len(b) > room {
+			rw.body.Write(b[:room])
+			rw.truncated = true
+		} else {
+			rw.body.Write(b)
+		}
+	} else if len(b) > 0 {
+		rw.truncated = true
+	}
+	return n, err
+}
+
+func (rw *responseWriter) WriteHeader(statusCode int) {
+	rw.statusCode = statusCode
+	if strings.HasPrefix(rw.Header().Get("Content-Type"), "text/event-stream") {
+		rw.limit = 0
+	}
+	rw.ResponseWriter.WriteHeader(statusCode)
+}
+
+// 读取请求体的前 limit 字节用于日志，其余部分原样留给处理函数
+func peekBody(r *http.Request, limit int) (head []byte, truncated bool) {
+	if limit <= 0 || r.Body == nil || r.Body == http.NoBody {
+		return nil, false
+	}
+	head, _ = io.ReadAll(io.LimitReader(r.Body, int64(limit)+1))
+	if len(head) > limit {
+		truncated = true
+	}
+	r.Body = readCloser{io.MultiReader(bytes.NewReader(head), r.Body), r.Body}
+	if truncated {
+		head = head[:limit]
+	}
+	return head, truncated
+}
+
+// 组合后的请求体，关闭时关闭原始请求体
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// 日志中间件，logBody 为 false 时只记录请求行和状态码
+func loggingMiddleware(handler http.HandlerFunc, logBody bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// 日志级别高于 info 时不记录请求，也不包装响应写入器（设备多时 -log-level warn 可明显减少开销）
+		if !slog.Default().Enabled(r.Context(), slog.LevelInfo) {
+			handler(w, r)
+			return
+		}
+		start := time.Now()
+		logger := requestLogger(r)
+
+		limit := logBodyLimit
+		if !logBody {
+			limit = 0
+		}
+
+		// 记录请求
+		ip := clientIP(r)
+		attrs := []any{"client_ip", ip, "method", r.Method, "scheme", requestScheme(r),
+			"host", r.Host, "path", r.URL.Path}
+		attrs = append(attrs, lookupGeo(ip).attrs()...)
+		if body, truncated := peekBody(r, limit); len(body) > 0 {
+			attrs = append(attrs, "body", string(body))
+			if truncated {
+				attrs = append(attrs, "body_truncated", true)
+			}
+		}
+		logger.Info("request", attrs...)
+
+		// 包装响应写入器；WebSocket 升级后连接被接管，不捕获响应
+		if r.Header.Get("Upgrade") != "" {
+			limit = 0
+		}
+		rw := newResponseWriter(w, limit)
+
+		// 调用处理函数
+		handler(rw, r)
+
+		// 记录响应
+		attrs = []any{"status", rw.statusCode, "bytes", rw.written, "duration_ms", float64(time.Since(start).Microseconds()) / 1000}
+		if rw.body.Len() > 0 {
+			attrs = append(attrs, "body", strings.TrimSpace(rw.body.String()))
+			if rw.truncated {
+				attrs = append(attrs, "body_truncated", true)
+			}
+		}
+		logger.Info("response", attrs...)
+	}
+}
+
+// 供 http.ResponseController 访问底层连接（Flush 等）
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
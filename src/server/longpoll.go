@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 等待中的长轮询：记录每个长轮询的设备、客户端和开始时间，管理员可以查看，
+// 也可以让某个设备的长轮询立即返回空结果（例如释放卡住的连接，或让设备尽快重新轮询以获取新配置），
+// 设备按正常的轮询流程重新连接
+
+type longPoll struct {
+	DeviceID   string    `json:"device_id"`
+	RemoteAddr string    `json:"remote_addr"`
+	UserAgent  string    `json:"user_agent,omitempty"`
+	RequestID  string    `json:"request_id,omitempty"`
+	StartedAt  time.Time `json:"started_at"`
+
+	release chan struct{} // 关闭时长轮询立即返回
+	once    sync.Once
+}
+
+func (lp *longPoll) end() {
+	lp.once.Do(func() { close(lp.release) })
+}
+
+type longPollRegistry struct {
+	mu    sync.Mutex
+	polls map[*longPoll]struct{}
+}
+
+var longPolls = &longPollRegistry{polls: make(map[*longPoll]struct{})}
+
+func (reg *longPollRegistry) add(deviceID string, r *http.Request) *longPoll {
+	lp := &longPoll{
+		DeviceID:   deviceID,
+		RemoteAddr: clientIP(r),
+		UserAgent:  r.UserAgent(),
+		StartedAt:  time.Now(),
+		release:    make(chan struct{}),
+	}
+	if id, ok := r.Context().Value(requestIDKey{}).(string); ok {
+		lp.RequestID = id
+	}
+	reg.mu.Lock()
+	reg.polls[lp] = struct{}{}
+	reg.mu.Unlock()
+	return lp
+}
+
+func (reg *longPollRegistry) remove(lp *longPoll) {
+	reg.mu.Lock()
+	delete(reg.polls, lp)
+	reg.mu.Unlock()
+}
+
+// 按开始时间排序的当前长轮询
+func (reg *longPollRegistry) list() []*longPoll {
+	reg.mu.Lock()
+	polls := make([]*longPoll, 0, len(reg.polls))
+	for lp := range reg.polls {
+		polls = append(polls, lp)
+	}
+	reg.mu.Unlock()
+	sort.Slice(polls, func(i, j int) bool { return polls[i].StartedAt.Before(polls[j].StartedAt) })
+	return polls
+}
+
+// 让设备在本副本上的长轮询立即返回，返回结束的数量
+func (reg *longPollRegistry) releaseLocal(deviceID string) int {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	n := 0
+	for lp := range reg.polls {
+		if lp.DeviceID == deviceID {
+			lp.end()
+			n++
+		}
+	}
+	return n
+}
+
+// 让设备的长轮询立即返回；集群模式下同时通知其他副本
+func (reg *longPollRegistry) release(deviceID string) int {
+	if cluster != nil {
+		cluster.enqueue(clusterUpdate{Kind: clusterRelease, DeviceID: deviceID})
+	}
+	return reg.releaseLocal(deviceID)
+}
+
+// 管理接口中的长轮询
+type LongPollInfo struct {
+	*longPoll
+	DeviceName string  `json:"device_name,omitempty"`
+	Duration   float64 `json:"duration"` // 已等待的秒数
+}
+
+// GET /api/admin/long-polls：本副本上等待中的长轮询，用户只能看到自己的设备
+func longPollsHandler(w http.ResponseWriter, r *http.Request) {
+	p := requestPrincipal(r)
+	now := time.Now()
+	polls := []LongPollInfo{}
+	storage.mu.RLock()
+	for _, lp := range longPolls.list() {
+		device, exists := storage.devices[lp.DeviceID]
+		if !exists || !p.owns(device.Owner) {
+			continue
+		}
+		polls = append(polls, LongPollInfo{longPoll: lp, DeviceName: device.Name, Duration: now.Sub(lp.StartedAt).Seconds()})
+	}
+	storage.mu.RUnlock()
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success":    true,
+		"long_polls": polls,
+		"total":      len(polls),
+		"limit":      maxLongPolls,
+	})
+}
+
+// POST /api/admin/devices/{id}/release：让设备的长轮询立即返回空结果
+func releaseLongPoll(w http.ResponseWriter, r *http.Request, deviceID string) {
+	storage.mu.RLock()
+	_, exists := storage.devices[deviceID]
+	storage.mu.RUnlock()
+	if !exists {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	}
+	released := longPolls.release(deviceID)
+	requestLogger(r).Info("long poll released", "device_id", deviceID, "released", released, "by", principalName(requestPrincipal(r)))
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success":  true,
+		"released": released,
+		"message":  "Long poll released, the device will reconnect",
+	})
+}
@@ -2,33 +2,99 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
-	"strings"
+	"os/signal"
 	"sync"
+	"syscall"
 	"time"
 )
 
 // 设备信息
 type Device struct {
-	ID          string    `json:"id"`
-	Name        string    `json:"name"`
-	MacAddress  string    `json:"mac_address"`
-	Description string    `json:"description"`
-	Version     string    `json:"version"`
-	LastSeen    time.Time `json:"last_seen"`
+	ID              string         `json:"id"`
+	Name            string         `json:"name"`
+	MacAddress      string         `json:"mac_address"`
+	Description     string         `json:"description"`
+	Version         string         `json:"version"`
+	LastSeen        time.Time      `json:"last_seen"`
+	Online          bool           `json:"online"`
+	Approved        bool           `json:"approved"`
+	Owner           string         `json:"owner,omitempty"`            // 所属用户或组织（org:<name>），为空时只有管理员可见
+	Tags            []string       `json:"tags,omitempty"`             // 管理员设置的标签，用于固件放量等
+	FirmwareChannel string         `json:"firmware_channel,omitempty"` // 固件通道，为空时使用设备查询清单时指定的通道
+	Power           *PowerStatus   `json:"power,omitempty"`            // 最近上报的供电状态
+	ClockOffset     int64          `json:"clock_offset,omitempty"`     // 最近上报的时间戳与服务器时间之差（秒），正数表示设备时钟偏快
+	Binding         *DeviceBinding `json:"binding,omitempty"`          // 绑定的传输层身份（-device-binding）
+	Stats           DeviceStats    `json:"stats"`
+
+	offlineAlerted  bool      // 本次离线是否已发出告警
+	staleNotifiedAt time.Time // 发出即将清理的提醒的时间，未提醒时为零值
+	batteryAlerted  bool      // 本次低电量是否已发出告警
+}
+
+// 设备运行计数
+type DeviceStats struct {
+	MessagesQueued    int64 `json:"messages_queued"`
+	MessagesDelivered int64 `json:"messages_delivered"`
+	MessagesAcked     int64 `json:"messages_acked"`
+	MessagesFailed    int64 `json:"messages_failed"`
+	Polls             int64 `json:"polls"`
+	LongPollTimeouts  int64 `json:"long_poll_timeouts"`
 }
 
+// 消息状态
+const (
+	messageCreated   = "created"   // 目标设备未注册，消息未进入队列
+	messageQueued    = "queued"    // 等待设备轮询
+	messageDelivered = "delivered" // 已下发给设备
+	messageAcked     = "acked"     // 设备确认已发送魔术包
+	messageFailed    = "failed"    // 设备报告发送失败
+	messageCancelled = "cancelled" // 下发前被取消
+
+	messagePendingApproval = "pending_approval" // 受保护目标的唤醒，等待另一位管理员批准，见 approval.go
+)
+
+// 消息类型，唤醒消息的类型为空（兼容旧固件）
+const (
+	messageTypeReboot   = "device_reboot" // 重启中继本身
+	messageTypeWiFiScan = "wifi_scan"     // 扫描WiFi并上报结果
+	// 上报所在网段中发现的主机（邻居表），见 neighbors.go
+	messageTypeNeighborScan = "neighbor_scan"
+)
+
 // WOL消息
 type WOLMessage struct {
-	ID        string    `json:"id"`
-	TargetMAC string    `json:"target_mac"`
-	CreatedAt time.Time `json:"created_at"`
+	ID        string `json:"id"`
+	Type      string `json:"type,omitempty"` // 管理命令的类型，唤醒消息为空
+	DeviceID  string `json:"device_id"`
+	TargetMAC string `json:"target_mac"`
+	Target    string `json:"target,omitempty"` // 目标名称
+	Source    string `json:"source,omitempty"` // 请求来源
+	Owner     string `json:"owner,omitempty"`  // 所属用户或组织（目标或设备的所有者）
+	Status    string `json:"status"`
+	Error     string `json:"error,omitempty"`
+	Attempts  int    `json:"attempts,omitempty"` // 下发次数，未确认时会重新下发
+	// 魔术包的发送地址（IP[:port]），中继按顺序发送到每个地址；为空时使用中继默认的广播地址，见 destinations.go
+	Destinations []string `json:"destinations,omitempty"`
+	// 批准受保护目标唤醒的管理员
+	ApprovedBy string    `json:"approved_by,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	// 中继处理消息的时间（UTC），设备未上报或时钟超出容差时为服务器收到确认的时间
+	HandledAt *time.Time `json:"handled_at,omitempty"`
+	// 唤醒各阶段的时间（服务器时间），见 latency.go
+	QueuedAt    *time.Time `json:"queued_at,omitempty"`
+	DeliveredAt *time.Time `json:"delivered_at,omitempty"` // 第一次下发给中继
+	AckedAt     *time.Time `json:"acked_at,omitempty"`     // 收到成功的确认
+	UpAt        *time.Time `json:"up_at,omitempty"`        // 确认目标已开机
 }
 
 // 设备注册请求
@@ -37,33 +103,88 @@ type DeviceRegistrationRequest struct {
 	MacAddress  string `json:"mac_address"`
 	Description string `json:"description"`
 	Version     string `json:"version"`
+	// 供电状态，可选
+	Power *PowerStatus `json:"power"`
+	// 固件附带上报的网络信息，目前不保存
+	IPAddress   string         `json:"ip_address"`
+	NetworkInfo map[string]any `json:"network_info"`
 }
 
 // 发送WOL消息请求
 type SendWOLRequest struct {
 	DeviceID  string `json:"device_id"`  // ESP32设备ID
 	TargetMAC string `json:"target_mac"` // WOL目标MAC地址
+	Target    string `json:"target"`     // 或使用命名目标
+	Group     string `json:"group"`      // 或唤醒整个分组
+	// 只唤醒检测为关机的目标，已开机的跳过（未配置检测的目标照常唤醒）
+	OnlyIfDown bool `json:"only_if_down"`
+	// 只检查请求并返回将会如何处理，不入队也不计入配额
+	DryRun bool `json:"dry_run"`
+	// 越过目标的允许唤醒时段，只有管理员可以使用
+	OverrideHours bool `json:"override_hours"`
+	// 本次唤醒的发送地址，覆盖目标的 destinations
+	Destinations []string `json:"destinations"`
+}
+
+// 设备确认消息请求
+type AckRequest struct {
+	DeviceID  string `json:"device_id"`
+	MessageID string `json:"message_id"`
+	Success   bool   `json:"success"`
+	Error     string `json:"error"`
+	// 中继处理消息的时间（RFC 3339），可选
+	HandledAt time.Time `json:"handled_at"`
 }
 
 // 轮询响应
 type PollResponse struct {
 	Messages []WOLMessage `json:"messages"`
 	Total    int          `json:"total"`
+	// 因 max_messages 留在队列中、符合条件的消息数量，大于0时设备处理完应立即再次轮询
+	Remaining int `json:"remaining,omitempty"`
 }
 
-// 简单的内存存储
+// 简单的内存存储，设备、目标、分组和定时任务可持久化到状态文件
 type SimpleStorage struct {
-	mu       sync.RWMutex
-	devices  map[string]*Device
-	messages map[string]*WOLMessage
-	pending  map[string][]*WOLMessage // device_id -> messages
+	mu        sync.RWMutex
+	devices   map[string]*Device
+	messages  map[string]*WOLMessage
+	targets   map[string]*Target   // name -> target
+	groups    map[string]*Group    // name -> group
+	schedules map[string]*Schedule // id -> schedule
+	wakeLinks map[string]*WakeLink // id -> wake link
+
+	enrollments map[string]*Enrollment // id -> 设备注册码
+	firmware    map[string]*Firmware   // id -> 固件版本
+
+	oauthGrants map[string]*OAuthGrant // id -> oauth grant
+	users       map[string]*User       // name -> user
+	orgs        map[string]*Org        // name -> organization
+	apiKeys     map[string]*APIKey     // id -> 管理的服务器API密钥
+
+	maintenance *Maintenance // 维护模式，未开启时为 nil
+
+	energy map[energyKey]*EnergyDay // 目标每天的开关机时长，见 energy.go
 }
 
 func NewSimpleStorage() *SimpleStorage {
 	return &SimpleStorage{
-		devices:  make(map[string]*Device),
-		messages: make(map[string]*WOLMessage),
-		pending:  make(map[string][]*WOLMessage),
+		devices:   make(map[string]*Device),
+		messages:  make(map[string]*WOLMessage),
+		targets:   make(map[string]*Target),
+		groups:    make(map[string]*Group),
+		schedules: make(map[string]*Schedule),
+		wakeLinks: make(map[string]*WakeLink),
+
+		enrollments: make(map[string]*Enrollment),
+		firmware:    make(map[string]*Firmware),
+
+		oauthGrants: make(map[string]*OAuthGrant),
+		users:       make(map[string]*User),
+		orgs:        make(map[string]*Org),
+		apiKeys:     make(map[string]*APIKey),
+
+		energy: make(map[energyKey]*EnergyDay),
 	}
 }
 
@@ -73,150 +194,668 @@ var storage = NewSimpleStorage()
 // 全局API密钥变量
 var API_KEY string
 
-// 响应写入器包装器，用于捕获响应内容
-type responseWriter struct {
-	http.ResponseWriter
-	body       *bytes.Buffer
-	statusCode int
+// 服务器关闭信号，关闭后长轮询立即返回
+var shutdownCh = make(chan struct{})
+
+// serve 子命令的参数
+type serveOptions struct {
+	apiKey           string
+	port             string
+	listenSpecs      listenFlag
+	socketMode       string
+	shutdownTimeout  time.Duration
+	trustedProxyList string
+	corsOriginList   string
+	basePath         string
+	drainDelay       time.Duration
+	configPath       string
+	offlineAfter     time.Duration
+	logLevel         string
+	logFormat        string
+	logBodySkipList  string
+	logFilePath      string
+	logMaxSize       int
+	logMaxAge        time.Duration
+	logMaxBackups    int
+	logCompress      bool
+	authLogPath      string
+	geoIPList        string
+
+	oauthRedirectList string
+	homekit           homekitOptions
+	mdns              bool
+	mdnsName          string
+	http              httpServerOptions
+	maxConns          int
+
+	fromEnv []string // 从环境变量读取的参数名
 }
 
-func newResponseWriter(w http.ResponseWriter) *responseWriter {
-	return &responseWriter{
-		ResponseWriter: w,
-		body:           &bytes.Buffer{},
-		statusCode:     http.StatusOK,
+// 解析 serve 参数（check-config 使用同一组参数）
+func parseServeFlags(name string, args []string) *serveOptions {
+	o := &serveOptions{}
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.StringVar(&o.apiKey, "api-key", "", "API密钥，用于身份验证")
+	fs.StringVar(&o.port, "port", "8080", "服务器监听端口")
+	fs.Var(&o.listenSpecs, "listen", "监听地址，可重复或用空格分隔多个，例如 127.0.0.1:8080?auth=off、unix:///run/esp32-wol.sock 或 tailscale://esp32-wol（设置后忽略 -port）")
+	fs.StringVar(&o.socketMode, "socket-mode", "0660", "Unix域套接字文件权限（八进制）")
+	fs.DurationVar(&o.shutdownTimeout, "shutdown-timeout", 15*time.Second, "优雅关闭的最长等待时间")
+	fs.StringVar(&ipFamily, "ip-family", ipFamilyAny, "监听器、按需唤醒代理和开机检测使用的地址族：any（双栈）、ipv4 或 ipv6")
+	fs.IntVar(&ipv6ClientPrefix, "ipv6-client-prefix", 64, "IPv6 客户端按该长度的网段统计认证失败，128 表示按单个地址")
+	fs.StringVar(&o.trustedProxyList, "trusted-proxies", "", "受信任的反向代理地址或网段，逗号分隔，例如 127.0.0.1,10.0.0.0/8")
+	fs.StringVar(&o.corsOriginList, "cors-origins", "", "允许从浏览器跨域调用接口的来源，逗号分隔，例如 https://dash.example.com，* 表示任意来源")
+	fs.StringVar(&o.basePath, "base-path", "", "URL路径前缀，例如部署在 nginx 的 /wol/ 下时设为 /wol")
+	fs.StringVar(&publicURL, "public-url", "", "对外访问地址，例如 https://wol.example.com，用于生成唤醒链接；为空时根据请求推断")
+	fs.StringVar(&linkSecret, "link-secret", "", "唤醒链接的签名密钥，为空时由API密钥派生（更换API密钥会使已发出的链接失效）")
+	fs.StringVar(&oauthClientID, "oauth-client-id", "", "账号关联（Google Home 等）的 OAuth 客户端ID，为空时不启用 OAuth")
+	fs.StringVar(&oauthClientSecret, "oauth-client-secret", "", "OAuth 客户端密钥")
+	fs.StringVar(&o.oauthRedirectList, "oauth-redirect-uris", defaultOAuthRedirectURIs, "允许的 OAuth 回调地址前缀，逗号分隔")
+	fs.StringVar(&o.homekit.pin, "homekit-pin", "", "HomeKit 配对码（8位数字），设置后启用 HomeKit 桥接（需用 -tags homekit 编译）")
+	fs.StringVar(&o.homekit.addr, "homekit-listen", ":51826", "HomeKit 桥接的监听地址")
+	fs.StringVar(&o.homekit.dataDir, "homekit-data-dir", "homekit", "HomeKit 配对信息保存目录")
+	fs.DurationVar(&o.http.readHeaderTimeout, "read-header-timeout", 10*time.Second, "读取请求头的超时时间，防止慢速请求占用连接")
+	fs.DurationVar(&requestReadTimeout, "read-timeout", 30*time.Second, "读取请求体的超时时间（长轮询和事件流除外），0 表示不限制")
+	fs.DurationVar(&requestWriteTimeout, "write-timeout", 60*time.Second, "写出响应的超时时间（长轮询和事件流除外），0 表示不限制")
+	fs.DurationVar(&o.http.idleTimeout, "idle-timeout", 120*time.Second, "keep-alive 空闲连接的保持时间")
+	fs.IntVar(&o.http.maxHeaderBytes, "max-header-bytes", 64<<10, "请求头最大字节数")
+	fs.Int64Var(&maxRequestBody, "max-body-bytes", 1<<20, "请求体最大字节数，超过时返回 413（固件上传使用 -firmware-max-size）")
+	fs.IntVar(&o.maxConns, "max-conns", 4096, "所有监听器的最大并发连接数，超过时新连接被直接关闭，0 表示不限制")
+	fs.Int64Var(&maxLongPolls, "max-long-polls", 2048, "同时等待的长轮询上限，超过时轮询立即返回空结果（设备按轮询间隔重试），0 表示不限制")
+	fs.DurationVar(&approvalTimeout, "approval-timeout", time.Hour, "受保护目标的唤醒等待批准的最长时间，超时自动拒绝")
+	fs.DurationVar(&defaultWakeCooldown, "wake-cooldown", 0, "同一目标MAC地址两次唤醒的最短间隔，目标的 cooldown 优先，0 表示不限制")
+	fs.DurationVar(&ackTimeout, "ack-timeout", 60*time.Second, "下发后等待设备确认的时间，超时未确认的消息重新下发，0 表示下发即删除")
+	fs.IntVar(&maxDeliveryAttempts, "max-delivery-attempts", 5, "消息最多下发次数，仍未确认时标记为失败")
+	fs.DurationVar(&maxClockSkew, "max-clock-skew", 5*time.Minute, "设备上报的时间戳与服务器时间允许的最大偏差，超出时改用服务器时间")
+	fs.IntVar(&maxQueuePerDevice, "max-queue-per-device", 50, "单个设备待下发消息的上限，超过时唤醒请求返回 409，0 表示不限制")
+	fs.IntVar(&maxPendingTotal, "max-pending", 10000, "全部设备待下发消息总数的上限，超过时唤醒请求返回 429，0 表示不限制")
+	fs.DurationVar(&o.drainDelay, "drain-delay", 0, "收到退出信号后先将 /readyz 置为未就绪并继续服务的时间，便于负载均衡摘除流量")
+
+	fs.StringVar(&o.configPath, "config", "", "JSON配置文件路径（通知等结构化配置）")
+	fs.StringVar(&dataFile, "data-file", "", "状态文件路径，保存设备、目标、分组、定时任务和唤醒链接；为空时仅保存在内存中")
+	fs.StringVar(&firmwareDir, "firmware-dir", "", "固件文件目录，设置后启用固件托管（/api/admin/firmware）")
+	fs.Int64Var(&firmwareMaxSize, "firmware-max-size", 16<<20, "单个固件文件的最大字节数")
+	fs.DurationVar(&probeInterval, "probe-interval", 60*time.Second, "目标开机状态检测间隔（唤醒进行中的目标每5秒检测一次）")
+	fs.DurationVar(&probeTimeout, "probe-timeout", 2*time.Second, "单次开机状态检测的超时时间")
+	fs.IntVar(&probeConfirm, "probe-confirm", 2, "开机和关机之间的变化需要连续相同的检测结果次数，1 表示立即生效")
+	fs.Float64Var(&energyPrice, "energy-price", 0, "每千瓦时的电价，用于在用电统计中估算电费和节省的费用，0 表示不计算")
+	fs.StringVar(&ouiFile, "oui-file", "", "MAC地址厂商数据（IEEE oui.txt、oui.csv 或 Wireshark manuf 文件），为空时使用内置的常见厂商表")
+	fs.BoolVar(&haEnabled, "ha", false, "高可用模式：通过配置文件中的 redis 选举主副本，定时任务、状态检测、离线告警和 Telegram 机器人只在主副本上运行，状态保存在 Redis 中")
+	fs.BoolVar(&o.mdns, "mdns", false, "在局域网中通过 mDNS 通告服务（_esp32wol._tcp），ESP32 可自动发现服务器地址")
+	fs.StringVar(&o.mdnsName, "mdns-name", "", "mDNS 服务实例名，默认 esp32-wol (主机名)")
+	fs.BoolVar(&apiKeyAuth, "api-key-auth", true, "接受 -api-key 作为请求的密钥；全部改用 /api/admin/api-keys 创建的密钥后可关闭（-api-key 仍用于派生签名密钥）")
+	fs.BoolVar(&requireApproval, "require-approval", false, "新设备需经管理员批准后才能接收唤醒指令")
+	fs.StringVar(&deviceBindingMode, "device-binding", bindingOff, "设备身份绑定：off、log（只记录不一致）或 enforce（拒绝与首次出现时身份不一致的设备请求）")
+	fs.IntVar(&deviceBindingPrefix, "device-binding-prefix", 24, "按网段绑定时 IPv4 网段的前缀长度")
+	fs.IntVar(&authBurstThreshold, "auth-burst-threshold", 5, "同一IP在时间窗口内认证失败达到该次数时触发 auth.failure_burst 事件，0 表示关闭")
+	fs.DurationVar(&authBurstWindow, "auth-burst-window", time.Minute, "认证失败计数的时间窗口")
+	fs.DurationVar(&o.offlineAfter, "offline-after", 5*time.Minute, "设备超过该时间未轮询即视为离线")
+	fs.DurationVar(&purgeDevicesAfter, "purge-devices-after", 0, "自动删除超过该时间未出现的设备，0 表示不清理")
+	fs.DurationVar(&purgeDevicesGrace, "purge-grace", 24*time.Hour, "自动删除前提前多久发布 device.stale 事件")
+	fs.DurationVar(&alertOfflineAfter, "alert-offline-after", 15*time.Minute, "中继离线超过该时间时触发 alert.relay_offline 告警，0 表示关闭")
+	fs.IntVar(&alertFailureThreshold, "alert-failure-threshold", 3, "同一目标在时间窗口内唤醒失败达到该次数时触发 alert.repeated_failures 告警，0 表示关闭")
+	fs.DurationVar(&alertFailureWindow, "alert-failure-window", 30*time.Minute, "唤醒失败计数的时间窗口")
+	fs.IntVar(&alertBootLoopThreshold, "alert-boot-loop-threshold", 3, "中继在时间窗口内异常重启达到该次数时触发 alert.boot_loop 告警，0 表示关闭")
+	fs.DurationVar(&alertBootLoopWindow, "alert-boot-loop-window", 10*time.Minute, "异常重启计数的时间窗口")
+	fs.IntVar(&alertBatteryPercent, "alert-battery-percent", 20, "电池供电的中继电量低于该百分比时触发 alert.low_battery 告警，0 表示关闭")
+	fs.Float64Var(&alertBatteryVoltage, "alert-battery-voltage", 0, "电池供电的中继电压低于该值（V）时触发 alert.low_battery 告警，0 表示关闭")
+	fs.StringVar(&o.logLevel, "log-level", "info", "日志级别: debug, info, warn, error")
+	fs.StringVar(&o.logFormat, "log-format", "text", "日志格式: text 或 json")
+	fs.IntVar(&logBodyLimit, "log-body-limit", 4096, "日志中记录的请求/响应体最大字节数，0 表示不记录")
+	fs.StringVar(&o.logBodySkipList, "log-body-skip", "/api/wol/poll,/api/admin/events,/api/admin/wake-links,/api/admin/enrollments,/api/admin/api-keys,/api/provision,/api/admin/firmware,/api/firmware/download,/oauth/authorize,/oauth/token", "不记录请求/响应体的路由，逗号分隔")
+	fs.StringVar(&o.logFilePath, "log-file", "", "日志文件路径，为空时输出到标准错误")
+	fs.IntVar(&o.logMaxSize, "log-max-size", 100, "单个日志文件最大大小（MB），超过后轮转")
+	fs.DurationVar(&o.logMaxAge, "log-max-age", 30*24*time.Hour, "轮转后的旧日志保留时间，0 表示不按时间清理")
+	fs.IntVar(&o.logMaxBackups, "log-max-backups", 10, "保留的旧日志文件数量，0 表示不限制")
+	fs.BoolVar(&o.logCompress, "log-compress", true, "是否gzip压缩轮转后的旧日志")
+	fs.StringVar(&o.geoIPList, "geoip", "", "本地 MaxMind DB（.mmdb）文件，逗号分隔，例如 GeoLite2-Country.mmdb,GeoLite2-ASN.mmdb；请求日志和认证失败记录附带国家和ASN")
+	fs.StringVar(&o.authLogPath, "auth-log", "", "认证失败日志文件（固定的单行格式，供 fail2ban/CrowdSec 使用），- 表示标准错误，为空时不写；按 -log-max-size 等参数轮转")
+
+	fs.Usage = usageWithEnv(fs)
+	fs.Parse(args)
+
+	fromEnv, err := applyEnv(fs)
+	if err != nil {
+		fatal("invalid environment configuration", "error", err)
 	}
+	o.fromEnv = fromEnv
+	return o
 }
 
-func (rw *responseWriter) Write(b []byte) (int, error) {
-	rw.body.Write(b)
-	return rw.ResponseWriter.Write(b)
+// 确定API密钥：-api-key / ESP32_WOL_API_KEY，兼容旧的环境变量名 ESP32_API_KEY
+func (o *serveOptions) resolveAPIKey() (key string, legacy bool) {
+	if o.apiKey != "" {
+		return o.apiKey, false
+	}
+	return os.Getenv("ESP32_API_KEY"), true
 }
 
-func (rw *responseWriter) WriteHeader(statusCode int) {
-	rw.statusCode = statusCode
-	rw.ResponseWriter.WriteHeader(statusCode)
-}
+// 启动服务器
+func serve(args []string) {
+	o := parseServeFlags("serve", args)
 
-// 身份验证中间件
-func authMiddleware(handler http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		// 从Header或Query参数获取API密钥
-		apiKey := r.Header.Get("X-API-Key")
-		if apiKey == "" {
-			apiKey = r.URL.Query().Get("api_key")
-		}
-
-		// 验证API密钥
-		if apiKey != API_KEY {
-			log.Printf("[认证失败] %s %s - 无效的API密钥: %s", r.Method, r.URL.Path, apiKey)
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusUnauthorized)
-			json.NewEncoder(w).Encode(map[string]string{
-				"error": "Unauthorized: Invalid API key",
-			})
-			return
+	var err error
+	var logOut io.Writer = os.Stderr
+	var logFile *rotatingFile
+	if o.logFilePath != "" {
+		logFile, err = openRotatingFile(o.logFilePath, o.logMaxSize, o.logMaxAge, o.logMaxBackups, o.logCompress)
+		if err != nil {
+			fatal("failed to open log file", "path", o.logFilePath, "error", err)
+		}
+		logOut = logFile
+	}
+	if err := setupLogging(logOut, o.logLevel, o.logFormat); err != nil {
+		fatal("invalid logging configuration", "error", err)
+	}
+	var authLogFile *rotatingFile
+	if o.authLogPath != "" {
+		authLogFile, err = openAuthLog(o.authLogPath, o)
+		if err != nil {
+			fatal("failed to open auth log", "path", o.authLogPath, "error", err)
 		}
+	}
+	if o.geoIPList != "" {
+		geoIP, err = openGeoIP(o.geoIPList)
+		if err != nil {
+			fatal("failed to open geoip database", "error", err)
+		}
+		registerHealthCheck("geoip", geoIP.check)
+		go geoIP.run()
+	}
+	logBodySkip = parseRouteList(o.logBodySkipList)
+	for _, name := range o.fromEnv {
+		slog.Info("option set from environment", "flag", name, "env", envName(name))
+	}
 
-		// 认证通过，继续处理请求
-		handler(w, r)
+	// 检查API密钥
+	key, legacy := o.resolveAPIKey()
+	if key == "" {
+		fatal("an API key is required: set -api-key or ESP32_WOL_API_KEY")
 	}
-}
+	if legacy {
+		slog.Info("API key read from legacy environment variable", "env", "ESP32_API_KEY")
+	}
+	API_KEY = key
 
-// 日志中间件
-func loggingMiddleware(handler http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
+	if err := checkIPSettings(); err != nil {
+		fatal("invalid IP settings", "error", err)
+	}
+	if err := checkBindingSettings(); err != nil {
+		fatal("invalid device binding settings", "error", err)
+	}
+	trustedProxies, err = parseTrustedProxies(o.trustedProxyList)
+	if err != nil {
+		fatal("invalid -trusted-proxies", "error", err)
+	}
+	corsOrigins, err = parseCORSOrigins(o.corsOriginList)
+	if err != nil {
+		fatal("invalid -cors-origins", "error", err)
+	}
+	if err := checkDeprecations(); err != nil {
+		fatal("invalid route deprecation", "error", err)
+	}
+	basePath = normalizeBasePath(o.basePath)
+	oauthRedirectURIs = parseOAuthRedirects(o.oauthRedirectList)
+	if err := checkOAuthConfig(); err != nil {
+		fatal("invalid OAuth configuration", "error", err)
+	}
 
-		// 读取请求体
-		body, _ := io.ReadAll(r.Body)
-		r.Body = io.NopCloser(bytes.NewBuffer(body))
+	fileConfig, err := loadConfigFile(o.configPath)
+	if err != nil {
+		fatal("failed to load config file", "path", o.configPath, "error", err)
+	}
 
-		// 记录请求
-		log.Printf("[请求] %s %s", r.Method, r.URL.Path)
-		if len(body) > 0 {
-			log.Printf("[请求体] %s", string(body))
+	if dataFile != "" {
+		if err := loadState(dataFile); err != nil {
+			fatal("failed to load state", "path", dataFile, "error", err)
 		}
+		registerHealthCheck("state_file", checkStateFile)
+	}
+	if !apiKeyAuth && !haveEnabledAPIKeys() {
+		slog.Warn("-api-key-auth=false but no API keys are enabled, only auth=off listeners and user tokens can access the server")
+	}
 
-		// 包装响应写入器
-		rw := newResponseWriter(w)
+	if fileConfig.Redis != nil {
+		if cluster, err = newCluster(fileConfig.Redis); err != nil {
+			fatal("invalid redis configuration", "error", err)
+		}
+		if err := cluster.start(); err != nil {
+			fatal("failed to connect to redis", "addr", fileConfig.Redis.Addr, "error", err)
+		}
+		registerHealthCheck("redis", cluster.check)
+	}
+	if haEnabled {
+		if cluster == nil {
+			fatal("-ha requires redis in the config file")
+		}
+		loaded, err := cluster.loadSharedState()
+		if err != nil {
+			fatal("failed to load shared state", "error", err)
+		}
+		if !loaded {
+			// 第一个启动的副本把本地状态（-data-file）写入 Redis
+			if err := saveState(); err != nil {
+				fatal("failed to save shared state", "error", err)
+			}
+		}
+		registerHealthCheck("ha", cluster.checkHA)
+	}
+	restorePending()
+	if dataFile != "" || haEnabled {
+		// 高可用模式下尽快保存，缩短两个副本同时修改时互相覆盖的窗口
+		interval := 10 * time.Second
+		if haEnabled {
+			interval = time.Second
+		}
+		go runStateFlusher(interval)
+	}
 
-		// 调用处理函数
-		handler(rw, r)
+	registerHealthCheck("storage", checkStorage)
+	registerHealthCheck("scheduler", checkScheduler)
+	registerHealthCheck("maintenance", checkMaintenance)
+	go runDeviceMonitor(o.offlineAfter)
+	go runScheduler()
+	if err := o.checkHTTPLimits(); err != nil {
+		fatal("invalid HTTP server limits", "error", err)
+	}
+	connLimit.max = int64(o.maxConns)
+	if err := checkQueueLimits(); err != nil {
+		fatal("invalid queue limits", "error", err)
+	}
+	if err := checkDeliverySettings(); err != nil {
+		fatal("invalid delivery settings", "error", err)
+	}
+	go runRedelivery()
+	if err := checkApprovalSettings(); err != nil {
+		fatal("invalid approval settings", "error", err)
+	}
+	go runApprovalExpiry()
+	if err := checkCooldownSettings(); err != nil {
+		fatal("invalid wake cooldown", "error", err)
+	}
+	if err := checkClockSkew(); err != nil {
+		fatal("invalid clock skew tolerance", "error", err)
+	}
+	if err := checkPurgeSettings(); err != nil {
+		fatal("invalid device purge settings", "error", err)
+	}
+	if err := checkProbeSettings(); err != nil {
+		fatal("invalid probe settings", "error", err)
+	}
+	registerHealthCheck("prober", checkProber)
+	if err := loadOUIFile(); err != nil {
+		fatal("failed to load oui file", "path", ouiFile, "error", err)
+	}
+	go runProber()
+	if err := checkEnergySettings(); err != nil {
+		fatal("invalid energy settings", "error", err)
+	}
+	go runEnergyMeter()
 
-		// 记录响应
-		duration := time.Since(start)
-		log.Printf("[响应] %d - %s (%v)", rw.statusCode, strings.TrimSpace(rw.body.String()), duration)
+	if inboundHooks, err = buildHooks(fileConfig.Hooks); err != nil {
+		fatal("invalid hook configuration", "error", err)
+	}
+	if alertRules, err = buildAlertRules(fileConfig.Alertmanager); err != nil {
+		fatal("invalid alertmanager configuration", "error", err)
+	}
+	if err := checkHomeKitOptions(o.homekit); err != nil {
+		fatal("invalid HomeKit configuration", "error", err)
+	}
+	if o.homekit.pin != "" {
+		if err := startHomeKit(o.homekit); err != nil {
+			fatal("failed to start HomeKit bridge", "error", err)
+		}
+	}
+	proxies, err := buildProxies(fileConfig.Proxies)
+	if err != nil {
+		fatal("invalid proxy configuration", "error", err)
+	}
+	for _, p := range proxies {
+		if err := p.start(); err != nil {
+			fatal("failed to start proxy", "proxy", p.Name, "addr", p.Listen, "error", err)
+		}
+	}
+	if len(proxies) > 0 {
+		registerHealthCheck("proxies", checkProxies(proxies))
+	}
+	bot, err := newTelegramBot(fileConfig.TelegramBot)
+	if err != nil {
+		fatal("invalid telegram_bot configuration", "error", err)
+	}
+	if bot != nil {
+		registerHealthCheck("telegram_bot", bot.check)
+		go bot.run()
+	}
+	if err := startNotifications(fileConfig.Notifications); err != nil {
+		fatal("invalid notification configuration", "error", err)
+	}
+	influx, err := newInfluxExporter(fileConfig.InfluxDB)
+	if err != nil {
+		fatal("invalid influxdb configuration", "error", err)
+	}
+	if influx != nil {
+		registerHealthCheck("influxdb", influx.check)
+		go influx.run()
 	}
-}
 
-func main() {
-	// 解析命令行参数
-	apiKey := flag.String("api-key", "", "API密钥，用于身份验证")
-	port := flag.String("port", "8080", "服务器监听端口")
-	flag.Parse()
+	slog.Info("starting ESP32 WOL server", "api_key", maskAPIKey(API_KEY))
+	tailscaleConfig = fileConfig.Tailscale
 
-	// 检查API密钥
-	if *apiKey == "" {
-		// 尝试从环境变量获取
-		if envKey := os.Getenv("ESP32_API_KEY"); envKey != "" {
-			API_KEY = envKey
-			log.Println("使用环境变量中的API密钥")
-		} else {
-			log.Fatal("错误: 必须通过 -api-key 参数或 ESP32_API_KEY 环境变量指定API密钥")
+	// 启动服务器
+	if err := inheritSystemdSockets(); err != nil {
+		fatal("failed to use sockets passed by systemd", "error", err)
+	}
+	specs := []string(o.listenSpecs)
+	if len(specs) == 0 && len(systemdSockets) > 0 {
+		specs = []string{"systemd://"}
+	}
+	if len(specs) == 0 {
+		specs = []string{":" + o.port}
+	}
+	tunnel, err := newTunnel(fileConfig.Tunnel, specs)
+	if err != nil {
+		fatal("invalid tunnel configuration", "error", err)
+	}
+	var mdns *mdnsResponder
+	if o.mdns {
+		if mdns, err = newMDNSResponder(o.mdnsName, specs); err != nil {
+			fatal("invalid mDNS configuration", "error", err)
 		}
-	} else {
-		API_KEY = *apiKey
-		log.Println("使用命令行参数中的API密钥")
 	}
 
-	log.Println("启动简化版ESP32 WOL服务器...")
-	log.Printf("API密钥: %s", maskAPIKey(API_KEY))
+	type openedListener struct {
+		cfg      listenerConfig
+		listener net.Listener
+	}
+	var opened []openedListener
+	for _, spec := range specs {
+		cfg, err := parseListenSpec(spec)
+		if err != nil {
+			fatal("invalid listen address", "listen", spec, "error", err)
+		}
+		if cfg.TLSCert != "" {
+			if err := addCertFingerprint(cfg.TLSCert); err != nil {
+				slog.Warn("cannot read certificate fingerprint for provisioning", "cert", cfg.TLSCert, "error", err)
+			}
+		}
+		listeners, err := openListeners(cfg.Addr, o.socketMode)
+		if err != nil {
+			fatal("failed to listen", "addr", cfg.Addr, "error", err)
+		}
+		for _, listener := range listeners {
+			opened = append(opened, openedListener{cfg, listener})
+		}
+	}
+	closeUnusedSystemdSockets()
 
-	// 路由（使用日志中间件和认证中间件）
-	http.HandleFunc("/health", loggingMiddleware(healthHandler))
-	http.HandleFunc("/api/devices/register", loggingMiddleware(authMiddleware(registerDeviceHandler)))
-	http.HandleFunc("/api/wol/send", loggingMiddleware(authMiddleware(sendWOLHandler)))
-	http.HandleFunc("/api/wol/poll", loggingMiddleware(authMiddleware(pollWOLHandler)))
+	var servers []*http.Server
+	serveErr := make(chan error, len(opened))
+	for _, l := range opened {
+		cfg := l.cfg
+		listener := connLimit.listener(l.listener)
+		server := newHTTPServer(withBasePath(basePath, buildMux(cfg)), o.http)
+		if cfg.ClientCA != "" {
+			tlsConfig, err := clientCATLSConfig(cfg.ClientCA)
+			if err != nil {
+				fatal("invalid client_ca", "addr", cfg.Addr, "error", err)
+			}
+			server.TLSConfig = tlsConfig
+		}
+		servers = append(servers, server)
+		go func() {
+			slog.Info("listening", "addr", cfg.Addr, "local_addr", listener.Addr().String(), "policy", cfg.describe())
+			if cfg.TLSCert != "" {
+				serveErr <- server.ServeTLS(listener, cfg.TLSCert, cfg.TLSKey)
+			} else {
+				serveErr <- server.Serve(listener)
+			}
+		}()
+	}
+	listenersUp.Store(true)
+	sdNotify(fmt.Sprintf("READY=1\nSTATUS=Serving on %d listener(s)", len(servers)))
+	go runSystemdWatchdog()
+	if tunnel != nil {
+		registerHealthCheck("tunnel", tunnel.check)
+		go tunnel.run()
+	}
+	if o.mdns {
+		if err := mdns.start(); err != nil {
+			slog.Warn("mDNS advertisement disabled", "error", err)
+		}
+	}
 
-	// 启动服务器
-	serverPort := ":" + *port
-	log.Printf("服务器启动在端口 %s", serverPort)
-	log.Fatal(http.ListenAndServe(serverPort, nil))
-}
+	// 等待退出信号
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	select {
+	case err := <-serveErr:
+		if !errors.Is(err, http.ErrServerClosed) {
+			fatal("server error", "error", err)
+		}
+	case <-ctx.Done():
+	case <-stopRequests:
+	}
+	stop()
+
+	// 关闭期间再次收到信号时立即退出，不再等待排空（作为容器的 PID 1 运行时，
+	// 内核不会对未处理的信号执行默认动作，需要自己处理）
+	force := make(chan os.Signal, 1)
+	signal.Notify(force, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-force
+		slog.Warn("second shutdown signal received, exiting immediately")
+		os.Exit(1)
+	}()
 
-// 掩码API密钥用于日志显示
-func maskAPIKey(key string) string {
-	if len(key) <= 8 {
-		return "****"
+	sdNotify("STOPPING=1")
+	draining.Store(true)
+	if o.drainDelay > 0 {
+		slog.Info("shutdown signal received, draining", "drain_delay", o.drainDelay.String())
+		time.Sleep(o.drainDelay)
+	}
+
+	slog.Info("shutting down", "timeout", o.shutdownTimeout.String())
+	if err := shutdownServers(servers, o.shutdownTimeout); err != nil {
+		slog.Warn("graceful shutdown incomplete, remaining connections closed", "error", err)
+	}
+	if closeTailscale != nil {
+		closeTailscale()
+	}
+	if tunnel != nil {
+		<-tunnel.done
+	}
+	if influx != nil {
+		// 推送关闭前缓存的事件
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		influx.flush(ctx)
+		cancel()
+	}
+	if err := saveFinalState(); err != nil {
+		slog.Error("failed to save state", "path", dataFile, "error", err)
+	}
+	if cluster != nil {
+		cluster.close()
+	}
+	slog.Info("server stopped")
+	if authLogFile != nil {
+		authLogFile.Close()
+	}
+	if logFile != nil {
+		logFile.Close()
 	}
-	return key[:4] + "****" + key[len(key)-4:]
 }
 
-// 健康检查
-func healthHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+// 优雅关闭：停止接收新请求，通知长轮询尽快返回，等待进行中的请求完成
+func shutdownServers(servers []*http.Server, timeout time.Duration) error {
+	close(shutdownCh)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(servers))
+	for i, server := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := server.Shutdown(ctx); err != nil {
+				server.Close()
+				errs[i] = err
+			}
+		}()
 	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{
-		"status": "ok",
-		"time":   time.Now().Format(time.RFC3339),
-	})
+// 路由分组，用于按监听器限制可访问的接口
+const (
+	routeGroupPublic  = "public"  // 健康检查、探针
+	routeGroupDevice  = "device"  // ESP32设备调用的接口
+	routeGroupControl = "control" // 控制端调用的接口
+	routeGroupAdmin   = "admin"   // 管理接口
+)
+
+// 路由定义
+type route struct {
+	Pattern string
+	Handler http.HandlerFunc
+	Group   string
+	Auth    bool  // 是否需要API密钥
+	Log     bool  // 是否记录请求日志
+	Stream  bool  // 长轮询、事件流等长连接，不设置请求读写超时
+	MaxBody int64 // 请求体上限，0 使用 -max-body-bytes，-1 表示由处理函数自行限制
+	// 用户令牌读取（GET/HEAD）和修改所需的最低角色，roleNone 表示只有服务器API密钥可以访问。
+	// 允许用户访问的处理函数按所有者过滤
+	Read, Write role
+	View        bool // 只读API密钥可以读取（GET/HEAD），只用于不含密钥、令牌等机密的只读接口
+	// 接受的请求方法，OPTIONS 和其他方法由 methodMiddleware 处理，见 methods.go
+	Methods []string
+	// 弃用的接口或字段，见 deprecation.go
+	Deprecations []deprecation
 }
 
-// 设备注册
-func registerDeviceHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+// 旧固件在轮询时附带设备信息自动注册，现在的固件启动时调用 /api/devices/register
+var pollRegistrationDeprecations = []deprecation{
+	{Field: "device_name", Since: "2026-10-17", Sunset: "2027-06-30", Note: "register with POST /api/devices/register"},
+	{Field: "device_version", Since: "2026-10-17", Sunset: "2027-06-30", Note: "register with POST /api/devices/register"},
+	{Field: "device_description", Since: "2026-10-17", Sunset: "2027-06-30", Note: "register with POST /api/devices/register"},
+}
+
+// 路由表
+var routes = []route{
+	{Pattern: "/health", Handler: healthHandler, Group: routeGroupPublic, Log: true, Methods: []string{http.MethodGet}},
+	{Pattern: "/healthz", Handler: livenessHandler, Group: routeGroupPublic, Methods: []string{http.MethodGet, http.MethodHead}},
+	{Pattern: "/readyz", Handler: readinessHandler, Group: routeGroupPublic, Methods: []string{http.MethodGet, http.MethodHead}},
+	{Pattern: "/api/version", Handler: versionHandler, Group: routeGroupPublic, Auth: true, Read: roleViewer, View: true, Methods: []string{http.MethodGet, http.MethodHead}},
+	{Pattern: "/metrics", Handler: metricsHandler, Group: routeGroupPublic, Auth: true, View: true, Methods: []string{http.MethodGet}},
+	{Pattern: "/api/devices/register", Handler: registerDeviceHandler, Group: routeGroupDevice, Auth: true, Log: true, Write: roleOperator, Methods: []string{http.MethodPost}},
+	{Pattern: "/api/wol/poll", Handler: pollWOLHandler, Group: routeGroupDevice, Auth: true, Log: true, Stream: true, Read: roleOperator, Methods: []string{http.MethodGet},
+		Deprecations: pollRegistrationDeprecations},
+	{Pattern: "/api/wol/ack", Handler: ackWOLHandler, Group: routeGroupDevice, Auth: true, Log: true, Write: roleOperator, Methods: []string{http.MethodPost}},
+	{Pattern: "/api/devices/", Handler: deviceHandler, Group: routeGroupDevice, Auth: true, Log: true, Read: roleViewer, Write: roleOperator, View: true, Methods: []string{http.MethodGet, http.MethodPost}},
+	{Pattern: "/api/agent/", Handler: agentReportHandler, Group: routeGroupDevice, Auth: true, Log: true, Write: roleOperator, Methods: []string{http.MethodPost}},
+	{Pattern: "/api/time", Handler: timeHandler, Group: routeGroupDevice, Auth: true, Read: roleViewer, Methods: []string{http.MethodGet, http.MethodHead}},
+	{Pattern: "/api/provision", Handler: provisionHandler, Group: routeGroupDevice, Log: true, Methods: []string{http.MethodGet}},
+	{Pattern: "/api/firmware/manifest", Handler: firmwareManifestHandler, Group: routeGroupDevice, Auth: true, Log: true, Read: roleOperator, Methods: []string{http.MethodGet}},
+	{Pattern: "/api/firmware/download/", Handler: firmwareDownloadHandler, Group: routeGroupDevice, Auth: true, Log: true, Read: roleOperator, Methods: []string{http.MethodGet, http.MethodHead}},
+	{Pattern: "/api/wol/send", Handler: sendWOLHandler, Group: routeGroupControl, Auth: true, Log: true, Write: roleOperator, Methods: []string{http.MethodPost}},
+	{Pattern: "/api/wol/bulk", Handler: bulkWakeHandler, Group: routeGroupControl, Auth: true, Log: true, Write: roleOperator, Methods: []string{http.MethodPost}},
+	{Pattern: "/api/wol/bulk/", Handler: bulkJobHandler, Group: routeGroupControl, Auth: true, Log: true, Read: roleViewer, View: true, Methods: []string{http.MethodGet}},
+	{Pattern: "/api/wol/messages/", Handler: messageHandler, Group: routeGroupControl, Auth: true, Log: true, Read: roleViewer, Write: roleOperator, View: true, Methods: []string{http.MethodGet, http.MethodPost, http.MethodDelete}},
+	{Pattern: "/api/targets/power", Handler: targetPowerHandler, Group: routeGroupControl, Auth: true, Log: true, View: true, Methods: []string{http.MethodGet}},
+	{Pattern: "/api/ha/targets", Handler: haTargetsHandler, Group: routeGroupControl, Auth: true, Log: true, View: true, Methods: []string{http.MethodGet}},
+	{Pattern: "/api/ha/targets/", Handler: haTargetHandler, Group: routeGroupControl, Auth: true, Log: true, View: true, Methods: []string{http.MethodGet, http.MethodPost}},
+	{Pattern: "/api/alexa", Handler: alexaHandler, Group: routeGroupControl, Auth: true, Log: true, Methods: []string{http.MethodPost}},
+	{Pattern: "/api/google/fulfillment", Handler: googleFulfillmentHandler, Group: routeGroupControl, Log: true, Methods: []string{http.MethodPost}},
+	{Pattern: "/oauth/authorize", Handler: oauthAuthorizeHandler, Group: routeGroupControl, Log: true, Methods: []string{http.MethodGet, http.MethodPost}},
+	{Pattern: "/oauth/token", Handler: oauthTokenHandler, Group: routeGroupControl, Log: true, Methods: []string{http.MethodPost}},
+	{Pattern: "/api/alertmanager", Handler: alertmanagerHandler, Group: routeGroupControl, Auth: true, Log: true, Methods: []string{http.MethodPost}},
+	{Pattern: "/hooks/", Handler: hookHandler, Group: routeGroupControl, Methods: []string{http.MethodPost}},
+	{Pattern: "/api/admin/events", Handler: eventsHandler, Group: routeGroupAdmin, Auth: true, Log: true, Stream: true, View: true, Methods: []string{http.MethodGet}},
+	{Pattern: "/api/admin/ws", Handler: liveHandler, Group: routeGroupAdmin, Auth: true, Log: true, Stream: true, View: true, Methods: []string{http.MethodGet}},
+	{Pattern: "/api/stats", Handler: statsHandler, Group: routeGroupAdmin, Auth: true, Log: true, View: true, Methods: []string{http.MethodGet}},
+	{Pattern: "/api/stats/devices", Handler: deviceStatsHandler, Group: routeGroupAdmin, Auth: true, Log: true, Read: roleViewer, View: true, Methods: []string{http.MethodGet}},
+	{Pattern: "/api/stats/history", Handler: historyHandler, Group: routeGroupAdmin, Auth: true, Log: true, Read: roleViewer, View: true, Methods: []string{http.MethodGet}},
+	{Pattern: "/api/stats/wakes", Handler: wakeStatsHandler, Group: routeGroupAdmin, Auth: true, Log: true, Read: roleViewer, View: true, Methods: []string{http.MethodGet}},
+	{Pattern: "/api/stats/energy", Handler: energyStatsHandler, Group: routeGroupAdmin, Auth: true, Log: true, Read: roleViewer, View: true, Methods: []string{http.MethodGet}},
+	{Pattern: "/api/stats/latency", Handler: latencyStatsHandler, Group: routeGroupAdmin, Auth: true, Log: true, Read: roleViewer, View: true, Methods: []string{http.MethodGet}},
+	{Pattern: "/api/admin/devices", Handler: adminDevicesHandler, Group: routeGroupAdmin, Auth: true, Log: true, Read: roleViewer, View: true, Methods: []string{http.MethodGet}},
+	{Pattern: "/api/admin/devices/", Handler: adminDeviceHandler, Group: routeGroupAdmin, Auth: true, Log: true, Write: roleAdmin, Methods: []string{http.MethodPost, http.MethodPut, http.MethodDelete}},
+	{Pattern: "/api/admin/neighbors", Handler: neighborsHandler, Group: routeGroupAdmin, Auth: true, Log: true, Read: roleViewer, View: true, Methods: []string{http.MethodGet}},
+	{Pattern: "/api/admin/discovery", Handler: discoveryHandler, Group: routeGroupAdmin, Auth: true, Log: true, Read: roleViewer, Write: roleAdmin, View: true, Methods: []string{http.MethodGet, http.MethodPost}},
+	{Pattern: "/api/admin/discovery/", Handler: discoveryJobHandler, Group: routeGroupAdmin, Auth: true, Log: true, Read: roleViewer, Write: roleAdmin, View: true, Methods: []string{http.MethodGet, http.MethodPost}},
+	{Pattern: "/api/admin/targets", Handler: targetsHandler, Group: routeGroupAdmin, Auth: true, Log: true, Read: roleViewer, Write: roleAdmin, View: true, Methods: []string{http.MethodGet, http.MethodPost}},
+	{Pattern: "/api/admin/targets/", Handler: targetHandler, Group: routeGroupAdmin, Auth: true, Log: true, Read: roleViewer, Write: roleAdmin, View: true, Methods: []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete}},
+	{Pattern: "/api/admin/agents", Handler: agentsHandler, Group: routeGroupAdmin, Auth: true, Log: true, Read: roleViewer, View: true, Methods: []string{http.MethodGet}},
+	{Pattern: "/api/admin/groups", Handler: groupsHandler, Group: routeGroupAdmin, Auth: true, Log: true, View: true, Methods: []string{http.MethodGet, http.MethodPost}},
+	{Pattern: "/api/admin/groups/", Handler: groupHandler, Group: routeGroupAdmin, Auth: true, Log: true, View: true, Methods: []string{http.MethodGet, http.MethodPut, http.MethodDelete}},
+	{Pattern: "/api/admin/schedules", Handler: schedulesHandler, Group: routeGroupAdmin, Auth: true, Log: true, Read: roleViewer, Write: roleOperator, View: true, Methods: []string{http.MethodGet, http.MethodPost}},
+	{Pattern: "/api/admin/schedules/", Handler: scheduleHandler, Group: routeGroupAdmin, Auth: true, Log: true, Read: roleViewer, Write: roleOperator, View: true, Methods: []string{http.MethodGet, http.MethodPut, http.MethodDelete}},
+	{Pattern: "/api/admin/wake-links", Handler: wakeLinksHandler, Group: routeGroupAdmin, Auth: true, Log: true, Methods: []string{http.MethodGet, http.MethodPost}},
+	{Pattern: "/api/admin/wake-links/", Handler: wakeLinkHandler, Group: routeGroupAdmin, Auth: true, Log: true, Methods: []string{http.MethodDelete}},
+	{Pattern: "/api/admin/enrollments", Handler: enrollmentsHandler, Group: routeGroupAdmin, Auth: true, Log: true, Methods: []string{http.MethodGet, http.MethodPost}},
+	{Pattern: "/api/admin/enrollments/", Handler: enrollmentHandler, Group: routeGroupAdmin, Auth: true, Log: true, Methods: []string{http.MethodDelete}},
+	{Pattern: "/api/admin/firmware", Handler: firmwareListHandler, Group: routeGroupAdmin, Auth: true, Log: true, MaxBody: -1, Methods: []string{http.MethodGet, http.MethodPost}},
+	{Pattern: "/api/admin/firmware/", Handler: firmwareHandler, Group: routeGroupAdmin, Auth: true, Log: true, Methods: []string{http.MethodGet, http.MethodPut, http.MethodDelete}},
+	{Pattern: "/api/admin/oauth-grants", Handler: oauthGrantsHandler, Group: routeGroupAdmin, Auth: true, Log: true, Methods: []string{http.MethodGet}},
+	{Pattern: "/api/admin/oauth-grants/", Handler: oauthGrantHandler, Group: routeGroupAdmin, Auth: true, Log: true, Methods: []string{http.MethodDelete}},
+	{Pattern: "/api/admin/users", Handler: usersHandler, Group: routeGroupAdmin, Auth: true, Log: true, Methods: []string{http.MethodGet, http.MethodPost}},
+	{Pattern: "/api/admin/users/", Handler: userHandler, Group: routeGroupAdmin, Auth: true, Log: true, Methods: []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete}},
+	{Pattern: "/api/admin/tokens", Handler: tokensHandler, Group: routeGroupAdmin, Auth: true, Log: true, Read: roleViewer, Write: roleViewer, Methods: []string{http.MethodGet, http.MethodPost}},
+	{Pattern: "/api/admin/tokens/", Handler: tokensHandler, Group: routeGroupAdmin, Auth: true, Log: true, Read: roleViewer, Write: roleViewer, Methods: []string{http.MethodPut, http.MethodDelete}},
+	{Pattern: "/api/admin/long-polls", Handler: longPollsHandler, Group: routeGroupAdmin, Auth: true, Log: true, Read: roleViewer, View: true, Methods: []string{http.MethodGet}},
+	{Pattern: "/api/admin/api-keys", Handler: apiKeysHandler, Group: routeGroupAdmin, Auth: true, Log: true, Methods: []string{http.MethodGet, http.MethodPost}},
+	{Pattern: "/api/admin/api-keys/", Handler: apiKeyHandler, Group: routeGroupAdmin, Auth: true, Log: true, Methods: []string{http.MethodPut, http.MethodDelete}},
+	{Pattern: "/api/admin/purge", Handler: purgeAllHandler, Group: routeGroupAdmin, Auth: true, Log: true, Methods: []string{http.MethodPost}},
+	{Pattern: "/api/admin/maintenance", Handler: maintenanceHandler, Group: routeGroupAdmin, Auth: true, Log: true, Read: roleViewer, View: true, Methods: []string{http.MethodGet, http.MethodPut}},
+	{Pattern: "/api/admin/quota", Handler: quotaHandler, Group: routeGroupAdmin, Auth: true, Log: true, Read: roleViewer, Methods: []string{http.MethodGet}},
+	{Pattern: "/api/admin/orgs", Handler: orgsHandler, Group: routeGroupAdmin, Auth: true, Log: true, Read: roleViewer, Methods: []string{http.MethodGet, http.MethodPost}},
+	{Pattern: "/api/admin/orgs/", Handler: orgHandler, Group: routeGroupAdmin, Auth: true, Log: true, Read: roleViewer, Methods: []string{http.MethodGet, http.MethodPut, http.MethodDelete}},
+	{Pattern: "/ui/", Handler: uiHandler, Group: routeGroupAdmin, Methods: []string{http.MethodGet, http.MethodHead}},
+	{Pattern: "/wake", Handler: wakeLinkVisitHandler, Group: routeGroupControl, Log: true, Methods: []string{http.MethodGet}},
+}
+
+// 按监听器策略构建路由（使用日志中间件和认证中间件）
+func buildMux(cfg listenerConfig) *http.ServeMux {
+	mux := http.NewServeMux()
+	for _, rt := range routes {
+		if !cfg.allows(rt.Group) {
+			continue
+		}
+		handler := rt.Handler
+		if len(rt.Deprecations) > 0 {
+			handler = deprecationMiddleware(rt.Pattern, rt.Deprecations, handler)
+		}
+		handler = negotiateMiddleware(handler)
+		if rt.Auth && !cfg.NoAuth {
+			handler = authMiddleware(handler, rt.Read, rt.Write, rt.View)
+		}
+		switch {
+		case rt.MaxBody > 0:
+			handler = bodyLimitMiddleware(handler, rt.MaxBody)
+		case rt.MaxBody == 0:
+			handler = bodyLimitMiddleware(handler, maxRequestBody)
+		}
+		// 预检请求不带认证信息，在认证之前处理
+		handler = methodMiddleware(rt.Methods, handler)
+		if rt.Log {
+			handler = loggingMiddleware(handler, !logBodySkip[rt.Pattern])
+		}
+		handler = metricsMiddleware(rt.Pattern, handler)
+		handler = requestIDMiddleware(handler)
+		if !rt.Stream {
+			handler = deadlineMiddleware(handler)
+		}
+		mux.HandleFunc(rt.Pattern, handler)
 	}
+	return mux
+}
 
+// 设备注册
+func registerDeviceHandler(w http.ResponseWriter, r *http.Request) {
 	var req DeviceRegistrationRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+	if !readJSON(w, r, &req) {
 		return
 	}
 
@@ -224,11 +863,38 @@ func registerDeviceHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Name and mac_address are required", http.StatusBadRequest)
 		return
 	}
+	if req.Power != nil {
+		if err := req.Power.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
 
 	// 使用MAC地址作为设备ID
 	deviceID := req.MacAddress
+	p := requestPrincipal(r)
 
 	storage.mu.Lock()
+	existing, exists := storage.devices[deviceID]
+	if exists && !p.owns(existing.Owner) {
+		storage.mu.Unlock()
+		http.Error(w, "Device belongs to another user", http.StatusForbidden)
+		return
+	}
+	if exists {
+		if err := verifyDeviceIdentity(r, existing); err != nil {
+			storage.mu.Unlock()
+			writeIdentityMismatch(w)
+			return
+		}
+	}
+	if !exists && !p.admin() {
+		if err := checkCountQuota(p.user, quotaMaxDevices); err != nil {
+			storage.mu.Unlock()
+			writeQuotaError(w, err)
+			return
+		}
+	}
 	device := &Device{
 		ID:          deviceID,
 		Name:        req.Name,
@@ -236,180 +902,743 @@ func registerDeviceHandler(w http.ResponseWriter, r *http.Request) {
 		Description: req.Description,
 		Version:     req.Version,
 		LastSeen:    time.Now(),
+		Online:      true,
+		Approved:    !requireApproval,
+		Owner:       p.user,
+	}
+	// 重新注册（例如设备重启）时保留运行计数、批准状态、所有者、标签和固件通道
+	if exists {
+		device.Stats = existing.Stats
+		device.Approved = existing.Approved
+		device.Owner = existing.Owner
+		device.Tags = existing.Tags
+		device.FirmwareChannel = existing.FirmwareChannel
+		device.Power = existing.Power
+		device.batteryAlerted = existing.batteryAlerted
+		device.Binding = existing.Binding
+	}
+	verifyDeviceIdentity(r, device)
+	if req.Power != nil {
+		updateDevicePower(device, req.Power)
 	}
 	storage.devices[deviceID] = device
+	replicateDevice(device)
 	storage.mu.Unlock()
+	markDirty()
 
-	log.Printf("设备注册成功: %s (%s)", req.Name, req.MacAddress)
+	requestLogger(r).Info("device registered", "device_id", deviceID, "name", req.Name, "approved", device.Approved)
+	events.publish(Event{Type: eventDeviceRegistered, DeviceID: deviceID, Data: map[string]any{"name": req.Name, "approved": device.Approved}})
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
+	writeJSON(w, http.StatusOK, map[string]interface{}{
 		"success":   true,
 		"device_id": deviceID,
 		"message":   "Device registered successfully",
 	})
 }
 
+// 设备上报与查询：/api/devices/<id>/<action>
+//   - POST crash、GET crashes：重启原因与崩溃回溯（crash.go）
+//   - POST wifi-scan、GET wifi-scans：WiFi扫描结果（wifiscan.go）
+//   - POST neighbors、GET neighbors：邻居表（neighbors.go）
+func deviceHandler(w http.ResponseWriter, r *http.Request) {
+	deviceID, action := pathParams(r, "/api/devices/")
+	p := requestPrincipal(r)
+	storage.mu.RLock()
+	device, exists := storage.devices[deviceID]
+	visible := exists && p.owns(device.Owner)
+	version := ""
+	if visible {
+		version = device.Version
+	}
+	storage.mu.RUnlock()
+
+	switch {
+	case action != "crash" && action != "crashes" && action != "wifi-scan" && action != "wifi-scans" && action != "neighbors":
+		http.NotFound(w, r)
+	case !visible:
+		http.Error(w, "Device not found", http.StatusNotFound)
+	case r.Method == http.MethodPost && !verifyDeviceRequest(w, r, deviceID):
+	case action == "crash" && r.Method == http.MethodPost:
+		reportCrash(w, r, deviceID, version)
+	case action == "crashes" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string]any{"device_id": deviceID, "crashes": crashes.list(deviceID)})
+	case action == "wifi-scan" && r.Method == http.MethodPost:
+		uploadWiFiScan(w, r, deviceID)
+	case action == "wifi-scans" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string]any{"device_id": deviceID, "scans": wifiScans.list(deviceID)})
+	case action == "neighbors" && r.Method == http.MethodPost:
+		uploadNeighbors(w, r, deviceID)
+	case action == "neighbors" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string]any{"device_id": deviceID, "neighbors": neighbors.list(deviceID)})
+	default:
+		methodNotAllowed(w, r)
+	}
+}
+
 // 发送WOL消息（控制端调用）
 func sendWOLHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	var req SendWOLRequest
+	if !readJSON(w, r, &req) {
 		return
 	}
-
-	var req SendWOLRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+	// 试运行在结果中报告维护模式
+	if !req.DryRun && rejectDuringMaintenance(w) {
 		return
 	}
 
-	if req.DeviceID == "" {
-		http.Error(w, "device_id is required", http.StatusBadRequest)
+	// 用户只能唤醒自己的目标和设备，以及以 wake 权限共享给自己的目标，分组由管理员维护
+	p := requestPrincipal(r)
+	// 来源区分各个管理的API密钥，审批时用于判断批准者是否就是请求者
+	source := principalName(p)
+	if req.OverrideHours && !p.admin() && p.role < roleAdmin {
+		http.Error(w, "override_hours requires an administrator", http.StatusForbidden)
 		return
 	}
-
-	if req.TargetMAC == "" {
-		http.Error(w, "target_mac is required", http.StatusBadRequest)
+	if err := validateDestinations(req.Destinations); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// 创建WOL消息
-	messageID := fmt.Sprintf("msg_%d", time.Now().UnixNano())
-	message := &WOLMessage{
-		ID:        messageID,
-		TargetMAC: req.TargetMAC,
-		CreatedAt: time.Now(),
+	// 指定命名目标或分组时，由服务器解析中继设备和MAC地址
+	var wakes []wakeRequest
+	if req.Target != "" || req.Group != "" {
+		if req.DeviceID != "" || req.TargetMAC != "" || (req.Target != "" && req.Group != "") {
+			http.Error(w, "use one of target, group, or device_id with target_mac", http.StatusBadRequest)
+			return
+		}
+		if req.Group != "" && !p.admin() {
+			http.Error(w, "Groups can only be woken with the server API key", http.StatusForbidden)
+			return
+		}
+		if req.Target != "" && !p.admin() {
+			storage.mu.RLock()
+			var access string
+			if t, exists := storage.targets[req.Target]; exists {
+				access = p.targetAccess(t)
+			}
+			storage.mu.RUnlock()
+			switch access {
+			case "":
+				http.Error(w, fmt.Sprintf("target %q not found", req.Target), http.StatusNotFound)
+				return
+			case shareRead:
+				http.Error(w, "Target is shared with you read-only", http.StatusForbidden)
+				return
+			}
+		}
+		var err error
+		wakes, err = resolveWake(req.Target, req.Group, source)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+	} else {
+		if req.DeviceID == "" {
+			http.Error(w, "device_id is required", http.StatusBadRequest)
+			return
+		}
+
+		if req.TargetMAC == "" {
+			http.Error(w, "target_mac is required", http.StatusBadRequest)
+			return
+		}
+		// 试运行时无效的MAC地址由 planWake 在结果中报告
+		targetMAC := req.TargetMAC
+		if mac, err := normalizeMAC(targetMAC); err == nil {
+			targetMAC = mac
+		} else if !req.DryRun {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !p.admin() {
+			storage.mu.RLock()
+			_, exists := storage.devices[req.DeviceID]
+			owned := exists && p.owns(deviceOwner(req.DeviceID))
+			storage.mu.RUnlock()
+			if !owned {
+				http.Error(w, "Device not found", http.StatusNotFound)
+				return
+			}
+		}
+		wakes = []wakeRequest{{DeviceID: req.DeviceID, TargetMAC: targetMAC, Source: source}}
 	}
 
-	storage.mu.Lock()
-	storage.messages[messageID] = message
+	for i := range wakes {
+		wakes[i].Override = req.OverrideHours
+		wakes[i].Destinations = req.Destinations
+	}
 
-	// 找到目标设备并添加到待处理队列
-	if _, exists := storage.devices[req.DeviceID]; exists {
-		storage.pending[req.DeviceID] = append(storage.pending[req.DeviceID], message)
-		log.Printf("WOL消息已添加到设备 %s 的队列: %s (目标MAC: %s)", req.DeviceID, messageID, req.TargetMAC)
-	} else {
-		log.Printf("警告: 设备 %s 未注册，但消息已创建: %s (目标MAC: %s)", req.DeviceID, messageID, req.TargetMAC)
+	// only_if_down：跳过检测为开机的目标
+	skipped := []string{}
+	if req.OnlyIfDown {
+		remaining := wakes[:0]
+		for _, wake := range wakes {
+			if wake.Target != "" && targetPower(wake.Target) == powerOn {
+				skipped = append(skipped, wake.Target)
+				continue
+			}
+			remaining = append(remaining, wake)
+		}
+		wakes = remaining
+	}
+	if req.DryRun {
+		dryRunWake(w, r, p, wakes, skipped)
+		return
+	}
+	if req.Group == "" && len(wakes) == 0 {
+		requestLogger(r).Info("wake skipped, target is on", "target", req.Target)
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"success": true,
+			"skipped": skipped,
+			"message": "Target is already on",
+		})
+		return
 	}
-	storage.mu.Unlock()
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"success":    true,
-		"message_id": messageID,
-		"message":    "WOL message sent successfully",
+	if req.Group == "" {
+		if err := reserveWake(p); err != nil {
+			writeQuotaError(w, err)
+			return
+		}
+		message, err := queueWake(requestLogger(r), wakes[0])
+		if err != nil {
+			refundWake(p)
+			if writeMaintenance(w, err) || writeBackpressure(w, err) || writeAllowedHours(w, err) || writeCooldown(w, err) {
+				return
+			}
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if message.Status == messagePendingApproval {
+			writeJSON(w, http.StatusAccepted, map[string]interface{}{
+				"success":    true,
+				"message_id": message.ID,
+				"status":     message.Status,
+				"message":    "Target is protected, the wake is awaiting approval by another administrator",
+			})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"success":    true,
+			"message_id": message.ID,
+			"message":    "WOL message sent successfully",
+		})
+		return
+	}
+
+	// 分组唤醒：逐个入队，部分失败时在 errors 中列出
+	messageIDs := []string{}
+	pending := []string{} // 受保护目标的消息，等待批准
+	failures := map[string]string{}
+	for _, wake := range wakes {
+		message, err := queueWake(requestLogger(r), wake)
+		if err != nil {
+			failures[wake.Target] = err.Error()
+			continue
+		}
+		messageIDs = append(messageIDs, message.ID)
+		if message.Status == messagePendingApproval {
+			pending = append(pending, message.ID)
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success":          len(failures) == 0,
+		"message_ids":      messageIDs,
+		"pending_approval": pending,
+		"errors":           failures,
+		"skipped":          skipped,
+		"message":          fmt.Sprintf("%d of %d WOL messages queued", len(messageIDs), len(wakes)),
 	})
 }
 
-// 设备轮询WOL消息（ESP32调用）
-func pollWOLHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+// 试运行：返回每个唤醒会被如何处理以及配额检查结果，不创建消息
+func dryRunWake(w http.ResponseWriter, r *http.Request, p principal, wakes []wakeRequest, skipped []string) {
+	plans := make([]WakePlan, 0, len(wakes))
+	ok, queued := true, 0
+	for _, wake := range wakes {
+		plan := planWake(wake)
+		switch plan.Action {
+		case planReject:
+			ok = false
+		case planQueue:
+			queued++
+		}
+		plans = append(plans, plan)
+	}
+	resp := map[string]interface{}{
+		"dry_run": true,
+		"wakes":   plans,
+		"skipped": skipped,
 	}
+	if len(wakes) > 0 {
+		if err := peekWakeQuota(p); err != nil {
+			ok = false
+			resp["quota_error"] = err.Error()
+		}
+	}
+	resp["success"] = ok
+	resp["message"] = fmt.Sprintf("%d of %d WOL messages would be queued", queued, len(plans))
+	requestLogger(r).Info("wake dry run", "wakes", len(plans), "skipped", len(skipped), "ok", ok)
+	writeJSON(w, http.StatusOK, resp)
+}
 
-	deviceID := r.URL.Query().Get("device_id")
+// 设备轮询WOL消息（ESP32调用）
+func pollWOLHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	deviceID := query.Get("device_id")
 	if deviceID == "" {
 		http.Error(w, "device_id parameter is required", http.StatusBadRequest)
 		return
 	}
+	filter, err := parsePollFilter(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// 供电状态参数有误时忽略，不影响轮询
+	power, err := parsePowerQuery(query)
+	if err != nil {
+		requestLogger(r).Warn("invalid power status", "device_id", deviceID, "error", err)
+	}
 
 	// 检查设备是否存在，如果不存在则自动注册
+	p := requestPrincipal(r)
 	storage.mu.Lock()
-	if device, exists := storage.devices[deviceID]; exists {
+	device, exists := storage.devices[deviceID]
+	if exists && !p.owns(device.Owner) {
+		storage.mu.Unlock()
+		http.Error(w, "Device belongs to another user", http.StatusForbidden)
+		return
+	}
+	if exists {
+		if err := verifyDeviceIdentity(r, device); err != nil {
+			storage.mu.Unlock()
+			writeIdentityMismatch(w)
+			return
+		}
 		// 设备已存在，更新最后见到时间
 		device.LastSeen = time.Now()
+		if !device.Online {
+			device.Online = true
+			device.offlineAlerted = false
+			requestLogger(r).Info("device back online", "device_id", deviceID)
+			events.publish(Event{Type: eventDeviceOnline, DeviceID: deviceID})
+		}
 	} else {
 		// 设备不存在，自动注册
-		deviceName := r.URL.Query().Get("device_name")
-		deviceVersion := r.URL.Query().Get("device_version")
-		deviceDescription := r.URL.Query().Get("device_description")
-		
+		if !p.admin() {
+			if err := checkCountQuota(p.user, quotaMaxDevices); err != nil {
+				storage.mu.Unlock()
+				writeQuotaError(w, err)
+				return
+			}
+		}
+		deviceName := query.Get("device_name")
+		deviceVersion := query.Get("device_version")
+		deviceDescription := query.Get("device_description")
+
 		// 如果没有提供设备名称，使用设备ID作为名称
 		if deviceName == "" {
 			deviceName = "ESP32-" + deviceID
 		}
-		
+
 		// 创建新设备
-		newDevice := &Device{
+		device = &Device{
 			ID:          deviceID,
 			Name:        deviceName,
 			MacAddress:  deviceID, // 使用deviceID作为MAC地址
 			Description: deviceDescription,
 			Version:     deviceVersion,
 			LastSeen:    time.Now(),
+			Online:      true,
+			Approved:    !requireApproval,
+			Owner:       p.user,
 		}
-		storage.devices[deviceID] = newDevice
-		
-		log.Printf("设备自动注册成功: %s (%s)", deviceName, deviceID)
+		storage.devices[deviceID] = device
+		verifyDeviceIdentity(r, device)
+		markDirty()
+
+		requestLogger(r).Info("device auto-registered", "device_id", deviceID, "name", deviceName, "approved", device.Approved)
+		events.publish(Event{Type: eventDeviceRegistered, DeviceID: deviceID, Data: map[string]any{"name": deviceName, "approved": device.Approved}})
+	}
+
+	device.Stats.Polls++
+	if power != nil {
+		updateDevicePower(device, power)
 	}
+	replicateDevice(device)
+	storage.mu.Unlock()
 
 	// 获取待处理消息
-	messages := storage.pending[deviceID]
+	messages, remaining := takePending(deviceID, filter)
 	if len(messages) > 0 {
-		// 返回消息并清空队列
-		response := PollResponse{
-			Messages: make([]WOLMessage, len(messages)),
-			Total:    len(messages),
+		requestLogger(r).Info("messages delivered", "device_id", deviceID, "count", len(messages), "remaining", remaining)
+		writePollResponse(w, messages, remaining)
+		return
+	}
+
+	// 长轮询：等待新消息。等待中的长轮询已达上限时直接返回空结果，
+	// 设备按轮询间隔重试，相当于退化为短轮询
+	if !acquireLongPoll() {
+		longPollsRejected.Add(1)
+		requestLogger(r).Debug("long poll limit reached, answering immediately", "device_id", deviceID, "max_long_polls", maxLongPolls)
+		writePollResponse(w, nil, 0)
+		return
+	}
+	defer activeLongPolls.Add(-1)
+	poll := longPolls.add(deviceID, r)
+	defer longPolls.remove(poll)
+
+	// 不用 time.After：消息提前到达时计时器要到超时才会释放，设备多时占用大量内存
+	timeout := time.NewTimer(120 * time.Second)
+	defer timeout.Stop()
+	// 等待设备队列的入队通知，不再定时获取全局锁检查
+	queue := queues.get(deviceID)
+	var recheck <-chan time.Time
+	if cluster != nil {
+		ticker := time.NewTicker(clusterRecheckInterval)
+		defer ticker.Stop()
+		recheck = ticker.C
+	}
+
+	for {
+		select {
+		case <-timeout.C:
+			// 超时，返回空结果
+			storage.mu.Lock()
+			if device, exists := storage.devices[deviceID]; exists {
+				device.Stats.LongPollTimeouts++
+			}
+			storage.mu.Unlock()
+
+			writePollResponse(w, nil, 0)
+			return
+
+		case <-shutdownCh:
+			// 服务器正在关闭，立即返回空结果让设备稍后重连
+			writePollResponse(w, nil, 0)
+			return
+
+		case <-poll.release:
+			// 管理员结束了长轮询，返回空结果，设备按轮询间隔重新连接
+			requestLogger(r).Debug("long poll released", "device_id", deviceID)
+			writePollResponse(w, nil, 0)
+			return
+
+		case <-r.Context().Done():
+			// 设备已断开连接，停止等待，避免把新消息下发到已关闭的连接
+			requestLogger(r).Debug("long poll abandoned by client", "device_id", deviceID)
+			return
+
+		case _, open := <-queue.notify:
+			if !open {
+				// 设备被删除后队列已关闭，重新获取（设备重新注册时会创建新队列）
+				queue = queues.get(deviceID)
+			}
+		case <-recheck:
 		}
-		for i, msg := range messages {
-			response.Messages[i] = *msg
+
+		messages, remaining := takePending(deviceID, filter)
+		if len(messages) > 0 {
+			requestLogger(r).Info("messages delivered", "device_id", deviceID, "count", len(messages), "remaining", remaining, "long_poll", true)
+			writePollResponse(w, messages, remaining)
+			return
 		}
-		// 清空队列
-		storage.pending[deviceID] = nil
-		storage.mu.Unlock()
+	}
+}
+
+// 空轮询的响应预先编码，绝大多数轮询直接写出这段字节
+var emptyPollResponse = []byte(`{"messages":[],"total":0}` + "\n")
+
+// 编码轮询响应的缓冲区，避免每次响应都分配
+var pollBuffers = sync.Pool{New: func() any { return new(bytes.Buffer) }}
+
+func writePollResponse(w http.ResponseWriter, messages []WOLMessage, remaining int) {
+	if len(responseWarnings(w)) > 0 || responseEncodingOf(w) != encodingJSON {
+		writeJSON(w, http.StatusOK, PollResponse{Messages: append([]WOLMessage{}, messages...), Total: len(messages), Remaining: remaining})
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if len(messages) == 0 {
+		w.Write(emptyPollResponse)
+		return
+	}
+	buf := pollBuffers.Get().(*bytes.Buffer)
+	buf.Reset()
+	json.NewEncoder(buf).Encode(PollResponse{Messages: messages, Total: len(messages), Remaining: remaining})
+	w.Write(buf.Bytes())
+	// 异常大的缓冲区不放回，避免长期占用内存
+	if buf.Cap() <= 64<<10 {
+		pollBuffers.Put(buf)
+	}
+}
+
+// 同时等待的长轮询上限（-max-long-polls），0 表示不限制。
+// 每个长轮询占用一个协程和若干缓冲区，小内存主机上用来限制内存占用
+var maxLongPolls int64
+
+// 占用一个长轮询名额，已满时返回 false
+func acquireLongPoll() bool {
+	for {
+		active := activeLongPolls.Load()
+		if maxLongPolls > 0 && active >= maxLongPolls {
+			return false
+		}
+		if activeLongPolls.CompareAndSwap(active, active+1) {
+			return true
+		}
+	}
+}
+
+// 取出设备符合轮询条件的待处理消息准备下发，消息在设备确认前留在处理中列表，调用方不能持有 storage.mu。
+// 队列为空时只获取设备队列的锁，不争用全局锁
+func takePending(deviceID string, f pollFilter) ([]WOLMessage, int) {
+	if queues.len(deviceID) == 0 {
+		return nil, 0
+	}
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	pending, remaining := queues.lease(deviceID, f)
+	if len(pending) == 0 {
+		return nil, remaining
+	}
+	messages := make([]WOLMessage, len(pending))
+	for i, msg := range pending {
+		// 集群模式下队列中是消息的副本，优先使用内存中的记录
+		if local, ok := storage.messages[msg.ID]; ok {
+			msg = local
+		} else {
+			storage.messages[msg.ID] = msg
+		}
+		msg.Status = messageDelivered
+		msg.Attempts++
+		if msg.DeliveredAt == nil {
+			now := time.Now()
+			msg.DeliveredAt = &now
+			observeLatency(msg, latencyPoll)
+		}
+		replicateMessage(msg)
+		messages[i] = *msg
+		events.publish(Event{Type: eventMessageDelivered, DeviceID: deviceID, MessageID: msg.ID, Data: messageEventData(msg, nil)})
+	}
+	if device, exists := storage.devices[deviceID]; exists {
+		device.Stats.MessagesDelivered += int64(len(messages))
+	}
+	countMessages(messageDelivered, len(messages))
+	return messages, remaining
+}
+
+// 设备确认消息处理结果（ESP32调用）
+func ackWOLHandler(w http.ResponseWriter, r *http.Request) {
+	var req AckRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
 
-		log.Printf("设备 %s 轮询到 %d 条消息", deviceID, len(messages))
+	if req.DeviceID == "" || req.MessageID == "" {
+		http.Error(w, "device_id and message_id are required", http.StatusBadRequest)
+		return
+	}
 
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(response)
+	p := requestPrincipal(r)
+	storage.mu.Lock()
+	message, exists := storage.messages[req.MessageID]
+	if !exists || message.DeviceID != req.DeviceID || !p.owns(deviceOwner(req.DeviceID)) {
+		storage.mu.Unlock()
+		http.Error(w, "Message not found", http.StatusNotFound)
 		return
 	}
+	if device, exists := storage.devices[req.DeviceID]; exists {
+		if err := verifyDeviceIdentity(r, device); err != nil {
+			storage.mu.Unlock()
+			writeIdentityMismatch(w)
+			return
+		}
+	}
+	// 确认迟到时消息可能已重新入队，一并删除避免重复下发
+	if !queues.ack(req.DeviceID, req.MessageID) {
+		queues.remove(req.DeviceID, req.MessageID)
+	}
+	status, eventType := messageAcked, eventMessageAcked
+	if !req.Success {
+		status, eventType = messageFailed, eventMessageFailed
+	}
+	message.Status = status
+	message.Error = req.Error
+	handledAt, skewed := deviceTimestamp(req.DeviceID, req.HandledAt)
+	message.HandledAt = &handledAt
+	if req.Success && message.AckedAt == nil {
+		now := time.Now()
+		message.AckedAt = &now
+		observeLatency(message, latencyRelay)
+	}
+	replicateMessage(message)
+	targetMAC, messageType := message.TargetMAC, message.Type
+	data := messageEventData(message, map[string]any{"success": req.Success, "error": req.Error})
+	if device, exists := storage.devices[req.DeviceID]; exists {
+		if req.Success {
+			device.Stats.MessagesAcked++
+		} else {
+			device.Stats.MessagesFailed++
+		}
+	}
 	storage.mu.Unlock()
 
-	// 长轮询：等待新消息
-	timeout := time.After(120 * time.Second)  // 30秒超时
-	ticker := time.NewTicker(1 * time.Second) // 每秒检查一次
-	defer ticker.Stop()
+	countMessages(status, 1)
+	if !req.Success && messageType == "" {
+		wakeFailures.record(targetMAC, req.DeviceID, req.Error)
+	}
+	requestLogger(r).Info("message acknowledged", "device_id", req.DeviceID, "message_id", req.MessageID, "success", req.Success, "error", req.Error)
+	events.publish(Event{Type: eventType, DeviceID: req.DeviceID, MessageID: req.MessageID, Data: data})
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success":    true,
+		"message":    "Ack recorded",
+		"clock_skew": skewed, // 设备时钟超出容差，固件据此重新校时
+	})
+}
 
+// 定期把超过确认期限的消息重新入队，下发次数用完时标记为失败
+func runRedelivery() {
+	if ackTimeout == 0 {
+		return
+	}
+	interval := ackTimeout / 4
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
 	for {
 		select {
-		case <-timeout:
-			// 超时，返回空结果
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(PollResponse{
-				Messages: []WOLMessage{},
-				Total:    0,
-			})
+		case <-shutdownCh:
 			return
-
 		case <-ticker.C:
-			// 检查是否有新消息
-			storage.mu.RLock()
-			messages := storage.pending[deviceID]
-			if len(messages) > 0 {
-				// 有新消息，返回并清空队列
-				response := PollResponse{
-					Messages: make([]WOLMessage, len(messages)),
-					Total:    len(messages),
-				}
-				for i, msg := range messages {
-					response.Messages[i] = *msg
-				}
-				storage.mu.RUnlock()
-
-				// 清空队列
-				storage.mu.Lock()
-				storage.pending[deviceID] = nil
-				storage.mu.Unlock()
+		}
+		for deviceID, expired := range queues.expired(time.Now()) {
+			for _, msg := range expired {
+				redeliver(deviceID, msg)
+			}
+		}
+	}
+}
 
-				log.Printf("设备 %s 长轮询到 %d 条消息", deviceID, len(messages))
+func redeliver(deviceID string, msg *WOLMessage) {
+	storage.mu.Lock()
+	if local, ok := storage.messages[msg.ID]; ok {
+		msg = local
+	}
+	// 确认与超时同时发生时以确认为准
+	if msg.Status != messageDelivered {
+		storage.mu.Unlock()
+		return
+	}
+	if msg.Attempts < maxDeliveryAttempts {
+		msg.Status = messageQueued
+		err := queues.requeue(deviceID, msg)
+		if err != nil {
+			msg.Status = messageFailed
+			msg.Error = "queue unavailable"
+		}
+		replicateMessage(msg)
+		storage.mu.Unlock()
+		if err != nil {
+			slog.Error("failed to requeue unacknowledged message", "device_id", deviceID, "message_id", msg.ID, "error", err)
+			countMessages(messageFailed, 1)
+			return
+		}
+		messagesRedelivered.Add(1)
+		slog.Warn("message not acknowledged, redelivering", "device_id", deviceID, "message_id", msg.ID, "attempts", msg.Attempts)
+		return
+	}
+	msg.Status = messageFailed
+	msg.Error = fmt.Sprintf("not acknowledged after %d deliveries", msg.Attempts)
+	replicateMessage(msg)
+	if device, exists := storage.devices[deviceID]; exists {
+		device.Stats.MessagesFailed++
+	}
+	data := messageEventData(msg, map[string]any{"success": false, "error": msg.Error})
+	messageType, targetMAC, errMsg := msg.Type, msg.TargetMAC, msg.Error
+	storage.mu.Unlock()
 
-				w.Header().Set("Content-Type", "application/json")
-				json.NewEncoder(w).Encode(response)
-				return
-			}
-			storage.mu.RUnlock()
+	countMessages(messageFailed, 1)
+	if messageType == "" {
+		wakeFailures.record(targetMAC, deviceID, errMsg)
+	}
+	slog.Warn("message not acknowledged, giving up", "device_id", deviceID, "message_id", msg.ID, "attempts", maxDeliveryAttempts)
+	events.publish(Event{Type: eventMessageFailed, DeviceID: deviceID, MessageID: msg.ID, Data: data})
+}
+
+// 查询消息状态（GET）或取消尚未下发的消息（DELETE）：/api/wol/messages/<id>；
+// 批准或拒绝受保护目标的唤醒（POST）：/api/wol/messages/<id>/approve、/reject
+func messageHandler(w http.ResponseWriter, r *http.Request) {
+	messageID, action := pathParams(r, "/api/wol/messages/")
+	if action != "" {
+		switch {
+		case action != "approve" && action != "reject":
+			http.NotFound(w, r)
+		case r.Method != http.MethodPost:
+			methodNotAllowed(w, r)
+		default:
+			reviewMessage(w, r, messageID, action)
+		}
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		if messageID == "search" {
+			searchMessages(w, r)
+			return
 		}
+	case http.MethodDelete:
+		cancelMessage(w, r, messageID)
+		return
+	default:
+		methodNotAllowed(w, r)
+		return
 	}
+
+	storage.mu.RLock()
+	message, exists := storage.messages[messageID]
+	var copied WOLMessage
+	if exists {
+		copied = *message
+	}
+	storage.mu.RUnlock()
+	if !exists || !requestPrincipal(r).canSeeMessage(&copied) {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"message": copied,
+		"latency": messageLatency(&copied),
+	})
+}
+
+// 取消尚未下发的消息：DELETE /api/wol/messages/<id>
+func cancelMessage(w http.ResponseWriter, r *http.Request, messageID string) {
+	storage.mu.RLock()
+	message, exists := storage.messages[messageID]
+	owned := exists && requestPrincipal(r).canSeeMessage(message)
+	storage.mu.RUnlock()
+	if !owned {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+	err := cancelWake(requestLogger(r), messageID)
+	switch {
+	case errors.Is(err, errMessageNotFound):
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"message": "Message cancelled",
+	})
 }
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// 维护模式：暂停接受新的唤醒请求（返回 503 和 Retry-After），设备轮询、确认和管理接口照常工作，
+// 便于迁移存储或排查问题。状态保存在状态文件中，重启后保持；高可用模式下随共享状态同步到其他副本
+
+type Maintenance struct {
+	Reason     string    `json:"reason,omitempty"`
+	Since      time.Time `json:"since"`
+	By         string    `json:"by,omitempty"`
+	RetryAfter int       `json:"retry_after"` // 建议客户端等待的秒数
+}
+
+// 未指定时建议客户端等待的时间
+const defaultMaintenanceRetryAfter = 5 * time.Minute
+
+var errMaintenance = errors.New("server is in maintenance mode")
+
+// 处于维护模式时写 503 响应并返回 true
+func writeMaintenance(w http.ResponseWriter, err error) bool {
+	if !errors.Is(err, errMaintenance) {
+		return false
+	}
+	storage.mu.RLock()
+	m := storage.maintenance
+	resp := map[string]any{
+		"success": false,
+		"error":   "maintenance",
+		"message": errMaintenance.Error(),
+	}
+	retryAfter := int(defaultMaintenanceRetryAfter.Seconds())
+	if m != nil {
+		if m.Reason != "" {
+			resp["reason"] = m.Reason
+		}
+		resp["since"] = m.Since
+		retryAfter = m.RetryAfter
+	}
+	storage.mu.RUnlock()
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	writeJSON(w, http.StatusServiceUnavailable, resp)
+	return true
+}
+
+// 在请求处理开始时检查维护模式，处于维护模式时写 503 响应并返回 true
+func rejectDuringMaintenance(w http.ResponseWriter) bool {
+	storage.mu.RLock()
+	active := storage.maintenance != nil
+	storage.mu.RUnlock()
+	return active && writeMaintenance(w, errMaintenance)
+}
+
+// 维护模式开关的请求体
+type MaintenanceRequest struct {
+	Enabled    bool   `json:"enabled"`
+	Reason     string `json:"reason"`
+	RetryAfter int    `json:"retry_after"` // 秒，0 使用默认值
+}
+
+// GET /api/admin/maintenance 查看维护状态；PUT 开启或关闭，请求体 {"enabled", "reason", "retry_after"}
+func maintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		storage.mu.RLock()
+		m := storage.maintenance
+		resp := map[string]any{"success": true, "enabled": m != nil}
+		if m != nil {
+			resp["maintenance"] = *m
+		}
+		storage.mu.RUnlock()
+		writeJSON(w, http.StatusOK, resp)
+	case http.MethodPut:
+		var req MaintenanceRequest
+		if !readJSON(w, r, &req) {
+			return
+		}
+		if req.RetryAfter < 0 || req.RetryAfter > 86400 {
+			http.Error(w, "retry_after must be between 0 and 86400 seconds", http.StatusBadRequest)
+			return
+		}
+		if len(req.Reason) > 200 {
+			http.Error(w, "reason must be at most 200 characters", http.StatusBadRequest)
+			return
+		}
+		by := principalName(requestPrincipal(r))
+
+		storage.mu.Lock()
+		was := storage.maintenance
+		var m *Maintenance
+		if req.Enabled {
+			m = &Maintenance{Reason: req.Reason, Since: time.Now().UTC(), By: by, RetryAfter: req.RetryAfter}
+			if m.RetryAfter == 0 {
+				m.RetryAfter = int(defaultMaintenanceRetryAfter.Seconds())
+			}
+			// 已处于维护模式时只更新说明，保留开始时间
+			if was != nil {
+				m.Since = was.Since
+			}
+		}
+		storage.maintenance = m
+		storage.mu.Unlock()
+		markDirty()
+
+		logger := requestLogger(r)
+		data := map[string]any{"enabled": req.Enabled, "by": by}
+		if req.Enabled {
+			logger.Warn("maintenance mode enabled, new wake requests are rejected", "reason", req.Reason, "retry_after", m.RetryAfter)
+			data["reason"] = req.Reason
+		} else if was != nil {
+			logger.Info("maintenance mode disabled", "duration", time.Since(was.Since).Round(time.Second).String())
+		}
+		if (was != nil) != req.Enabled {
+			events.publish(Event{Type: eventMaintenance, Data: data})
+		}
+		resp := map[string]any{"success": true, "enabled": req.Enabled}
+		if m != nil {
+			resp["maintenance"] = *m
+		}
+		writeJSON(w, http.StatusOK, resp)
+	default:
+		methodNotAllowed(w, r)
+	}
+}
+
+// 健康检查中显示维护状态，维护模式不影响就绪
+func checkMaintenance() ComponentHealth {
+	storage.mu.RLock()
+	defer storage.mu.RUnlock()
+	m := storage.maintenance
+	if m == nil {
+		return ComponentHealth{Status: healthOK, Detail: "off"}
+	}
+	detail := fmt.Sprintf("on since %s", m.Since.Format(time.RFC3339))
+	if m.Reason != "" {
+		detail += ": " + m.Reason
+	}
+	return ComponentHealth{Status: healthOK, Detail: detail}
+}
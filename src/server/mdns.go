@@ -0,0 +1,340 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// mDNS/DNS-SD 服务通告（RFC 6762/6763）：在局域网中以 _esp32wol._tcp 通告服务器地址，
+// 新刷写的 ESP32 和手机 App 不需要填写服务器IP即可找到服务器。只实现应答和通告，仅 IPv4
+
+const (
+	mdnsService     = "_esp32wol._tcp.local."
+	mdnsServiceEnum = "_services._dns-sd._udp.local."
+
+	mdnsTTLHost    = 120  // 主机地址和 SRV 记录
+	mdnsTTLService = 4500 // PTR 和 TXT 记录
+	mdnsTTLLegacy  = 10   // 非 5353 端口的简单查询（RFC 6762 6.7）
+
+	dnsTypeA   = 1
+	dnsTypePTR = 12
+	dnsTypeTXT = 16
+	dnsTypeSRV = 33
+	dnsTypeANY = 255
+
+	dnsClassIN     = 1
+	mdnsCacheFlush = 0x8000 // 记录 class 最高位：该名称下的记录由本机独占
+	mdnsUnicast    = 0x8000 // 问题 class 最高位：要求单播应答
+)
+
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+type mdnsResponder struct {
+	conn     *net.UDPConn
+	instance string // 实例名，例如 "esp32-wol (nas)._esp32wol._tcp.local."
+	host     string // 主机名，例如 "nas.local."
+	ip       net.IP // 监听在指定地址时只通告该地址
+	port     uint16
+	txt      []string
+}
+
+type mdnsQuestion struct {
+	name  string
+	qtype uint16
+}
+
+type mdnsRecord struct {
+	name   string
+	rtype  uint16
+	ttl    uint32
+	data   []byte
+	unique bool
+}
+
+// 创建 mDNS 应答器，通告第一个 TCP 监听器的端口；name 为空时使用主机名
+func newMDNSResponder(name string, specs []string) (*mdnsResponder, error) {
+	cfg, host, port, ok := firstTCPListener(specs)
+	if !ok {
+		return nil, fmt.Errorf("mDNS needs a TCP listener to advertise")
+	}
+	portNum, err := net.LookupPort("tcp", port)
+	if err != nil {
+		return nil, err
+	}
+
+	hostname, _ := os.Hostname()
+	hostname, _, _ = strings.Cut(hostname, ".")
+	if hostname == "" {
+		hostname = "esp32-wol"
+	}
+	if name == "" {
+		name = "esp32-wol (" + hostname + ")"
+	}
+	// 实例名是单个 DNS 标签，不能包含点
+	name = strings.ReplaceAll(name, ".", "-")
+	if len(name) > 63 {
+		return nil, fmt.Errorf("mDNS name must be at most 63 bytes")
+	}
+
+	proto := "http"
+	if cfg.TLSCert != "" {
+		proto = "https"
+	}
+	m := &mdnsResponder{
+		instance: name + "." + mdnsService,
+		host:     hostname + ".local.",
+		port:     uint16(portNum),
+		txt:      []string{"proto=" + proto, "path=" + basePath, "version=" + version},
+	}
+	if ipFamily == ipFamilyIPv6 {
+		return nil, fmt.Errorf("mDNS only advertises IPv4 listeners, not available with -ip-family %s", ipFamilyIPv6)
+	}
+	if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() {
+		if m.ip = ip.To4(); m.ip == nil {
+			return nil, fmt.Errorf("mDNS only advertises IPv4 listeners")
+		}
+	}
+	return m, nil
+}
+
+// 加入组播组并开始应答，启动时通告两次，服务器关闭时发送 TTL 为0的告别通告
+func (m *mdnsResponder) start() error {
+	conn, err := net.ListenMulticastUDP("udp4", nil, mdnsGroup)
+	if err != nil {
+		return err
+	}
+	m.conn = conn
+	slog.Info("advertising via mDNS", "service", m.instance, "host", m.host, "port", m.port)
+
+	go m.serve()
+	go func() {
+		m.announce(false)
+		select {
+		case <-shutdownCh:
+		case <-time.After(time.Second):
+			m.announce(false)
+			<-shutdownCh
+		}
+		m.announce(true)
+		conn.Close()
+	}()
+	return nil
+}
+
+func (m *mdnsResponder) announce(goodbye bool) {
+	answers := append([]mdnsRecord{m.ptrRecord()}, m.instanceRecords()...)
+	answers = append(answers, m.addressRecords()...)
+	if goodbye {
+		for i := range answers {
+			answers[i].ttl = 0
+		}
+	}
+	if _, err := m.conn.WriteToUDP(buildMDNSResponse(0, nil, answers, nil, false), mdnsGroup); err != nil {
+		slog.Warn("mDNS announcement failed", "error", err)
+	}
+}
+
+func (m *mdnsResponder) serve() {
+	buf := make([]byte, 9000)
+	for {
+		n, src, err := m.conn.ReadFromUDP(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				slog.Warn("mDNS responder stopped", "error", err)
+			}
+			return
+		}
+		m.handleQuery(buf[:n], src)
+	}
+}
+
+// 应答查询。源端口不是 5353 的是简单 DNS 客户端（例如 ESP32 上的查询），
+// 按 RFC 6762 6.7 单播回复并带上原查询ID和问题
+func (m *mdnsResponder) handleQuery(msg []byte, src *net.UDPAddr) {
+	if len(msg) < 12 || msg[2]&0x80 != 0 {
+		return // 不是查询
+	}
+	id := binary.BigEndian.Uint16(msg[0:2])
+	qdcount := int(binary.BigEndian.Uint16(msg[4:6]))
+	legacy := src.Port != mdnsGroup.Port
+
+	var answers, extra []mdnsRecord
+	var questions []mdnsQuestion
+	unicast := legacy
+	off := 12
+	for i := 0; i < qdcount; i++ {
+		name, next, err := readDNSName(msg, off)
+		if err != nil || next+4 > len(msg) {
+			return
+		}
+		qtype := binary.BigEndian.Uint16(msg[next : next+2])
+		qclass := binary.BigEndian.Uint16(msg[next+2 : next+4])
+		off = next + 4
+		if qclass&mdnsUnicast != 0 {
+			unicast = true
+		}
+		a, x := m.answer(name, qtype)
+		if len(a) > 0 && legacy {
+			questions = append(questions, mdnsQuestion{name: name, qtype: qtype})
+		}
+		answers = append(answers, a...)
+		extra = append(extra, x...)
+	}
+	if len(answers) == 0 {
+		return
+	}
+
+	resp := buildMDNSResponse(id, questions, answers, extra, legacy)
+	dst := mdnsGroup
+	if unicast {
+		dst = src
+	}
+	if _, err := m.conn.WriteToUDP(resp, dst); err != nil {
+		slog.Debug("mDNS response failed", "to", dst.String(), "error", err)
+	}
+}
+
+// 返回问题对应的应答记录和附加记录
+func (m *mdnsResponder) answer(name string, qtype uint16) (answers, extra []mdnsRecord) {
+	want := func(t uint16) bool { return qtype == t || qtype == dnsTypeANY }
+	switch {
+	case strings.EqualFold(name, mdnsService) && want(dnsTypePTR):
+		answers = []mdnsRecord{m.ptrRecord()}
+		extra = append(m.instanceRecords(), m.addressRecords()...)
+	case strings.EqualFold(name, mdnsServiceEnum) && want(dnsTypePTR):
+		answers = []mdnsRecord{{name: mdnsServiceEnum, rtype: dnsTypePTR, ttl: mdnsTTLService, data: appendDNSName(nil, mdnsService)}}
+	case strings.EqualFold(name, m.instance):
+		for _, r := range m.instanceRecords() {
+			if want(r.rtype) {
+				answers = append(answers, r)
+			}
+		}
+		extra = m.addressRecords()
+	case strings.EqualFold(name, m.host) && want(dnsTypeA):
+		answers = m.addressRecords()
+	}
+	return answers, extra
+}
+
+func (m *mdnsResponder) ptrRecord() mdnsRecord {
+	return mdnsRecord{name: mdnsService, rtype: dnsTypePTR, ttl: mdnsTTLService, data: appendDNSName(nil, m.instance)}
+}
+
+// 实例的 SRV 和 TXT 记录
+func (m *mdnsResponder) instanceRecords() []mdnsRecord {
+	srv := binary.BigEndian.AppendUint16(make([]byte, 4), m.port) // 优先级和权重为0
+	srv = appendDNSName(srv, m.host)
+	var txt []byte
+	for _, s := range m.txt {
+		txt = append(txt, byte(len(s)))
+		txt = append(txt, s...)
+	}
+	return []mdnsRecord{
+		{name: m.instance, rtype: dnsTypeSRV, ttl: mdnsTTLHost, data: srv, unique: true},
+		{name: m.instance, rtype: dnsTypeTXT, ttl: mdnsTTLService, data: txt, unique: true},
+	}
+}
+
+// 主机的 IPv4 地址记录，每次应答时重新读取网卡地址，DHCP 变更后无需重启
+func (m *mdnsResponder) addressRecords() []mdnsRecord {
+	var ips []net.IP
+	if m.ip != nil {
+		ips = []net.IP{m.ip}
+	} else {
+		ifaces, _ := net.Interfaces()
+		for _, iface := range ifaces {
+			if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+				continue
+			}
+			addrs, _ := iface.Addrs()
+			for _, addr := range addrs {
+				if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+					ips = append(ips, ipnet.IP.To4())
+				}
+			}
+		}
+	}
+	records := make([]mdnsRecord, 0, len(ips))
+	for _, ip := range ips {
+		records = append(records, mdnsRecord{name: m.host, rtype: dnsTypeA, ttl: mdnsTTLHost, data: ip, unique: true})
+	}
+	return records
+}
+
+func buildMDNSResponse(id uint16, questions []mdnsQuestion, answers, extra []mdnsRecord, legacy bool) []byte {
+	msg := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(msg[0:2], id)
+	binary.BigEndian.PutUint16(msg[2:4], 0x8400) // 应答，权威
+	binary.BigEndian.PutUint16(msg[4:6], uint16(len(questions)))
+	binary.BigEndian.PutUint16(msg[6:8], uint16(len(answers)))
+	binary.BigEndian.PutUint16(msg[10:12], uint16(len(extra)))
+	for _, q := range questions {
+		msg = appendDNSName(msg, q.name)
+		msg = binary.BigEndian.AppendUint16(msg, q.qtype)
+		msg = binary.BigEndian.AppendUint16(msg, dnsClassIN)
+	}
+	for _, r := range append(answers, extra...) {
+		class, ttl := uint16(dnsClassIN), r.ttl
+		if legacy {
+			ttl = min(ttl, mdnsTTLLegacy)
+		} else if r.unique {
+			class |= mdnsCacheFlush
+		}
+		msg = appendDNSName(msg, r.name)
+		msg = binary.BigEndian.AppendUint16(msg, r.rtype)
+		msg = binary.BigEndian.AppendUint16(msg, class)
+		msg = binary.BigEndian.AppendUint32(msg, ttl)
+		msg = binary.BigEndian.AppendUint16(msg, uint16(len(r.data)))
+		msg = append(msg, r.data...)
+	}
+	return msg
+}
+
+// 写入不压缩的域名
+func appendDNSName(b []byte, name string) []byte {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+// 读取域名（支持压缩指针），返回以点结尾的名称和名称之后的偏移
+func readDNSName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	next := -1
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return "", 0, errors.New("truncated name")
+		}
+		n := int(msg[off])
+		switch {
+		case n == 0:
+			if next < 0 {
+				next = off + 1
+			}
+			return strings.Join(labels, ".") + ".", next, nil
+		case n&0xC0 == 0xC0:
+			if off+1 >= len(msg) || jumps > 10 {
+				return "", 0, errors.New("bad compression pointer")
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:off+2]) & 0x3FFF)
+			jumps++
+		default:
+			if off+1+n > len(msg) {
+				return "", 0, errors.New("truncated label")
+			}
+			labels = append(labels, string(msg[off+1:off+1+n]))
+			off += 1 + n
+		}
+	}
+}
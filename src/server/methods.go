@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// 请求方法：路由表中的 Methods 为每个路由接受的方法，由 methodMiddleware 统一处理——
+// OPTIONS 返回 204 和 Allow，其他不在列表中的方法返回 405 和 Allow。
+// 同一路由下不同子路径接受的方法不同时，处理函数用 methodNotAllowed 返回带 Allow 的 405。
+//
+// 跨域：-cors-origins 列出的来源（或 *）可以从浏览器直接调用接口，预检请求（OPTIONS）不需要认证，
+// 允许的方法与 Allow 相同；未设置时不返回任何 CORS 头
+
+// 允许跨域访问的来源，* 表示任意来源
+var corsOrigins []string
+
+// 预检请求允许的请求头和可以读取的响应头
+const (
+	corsAllowHeaders  = "X-API-Key, Authorization, Content-Type, If-None-Match, X-Request-Id"
+	corsExposeHeaders = "ETag, Retry-After, X-Request-Id, Deprecation, Sunset, Link"
+	corsMaxAge        = "600"
+)
+
+type allowKey struct{}
+
+// 解析 -cors-origins：逗号分隔的 scheme://host[:port]，或 *
+func parseCORSOrigins(value string) ([]string, error) {
+	var origins []string
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if item != "*" {
+			u, err := url.Parse(item)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || (u.Path != "" && u.Path != "/") {
+				return nil, fmt.Errorf("invalid origin %q, expected scheme://host[:port]", item)
+			}
+			item = u.Scheme + "://" + u.Host
+		}
+		origins = append(origins, item)
+	}
+	return origins, nil
+}
+
+func corsAllowed(origin string) bool {
+	return origin != "" && (slices.Contains(corsOrigins, "*") || slices.Contains(corsOrigins, origin))
+}
+
+// 只接受路由表中列出的方法；OPTIONS 返回 Allow，来自允许来源的预检请求附带 CORS 头
+func methodMiddleware(methods []string, handler http.HandlerFunc) http.HandlerFunc {
+	allow := strings.Join(append(slices.Clone(methods), http.MethodOptions), ", ")
+	return func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		h := w.Header()
+		if len(corsOrigins) > 0 {
+			h.Add("Vary", "Origin")
+		}
+		if corsAllowed(origin) {
+			h.Set("Access-Control-Allow-Origin", origin)
+			h.Set("Access-Control-Expose-Headers", corsExposeHeaders)
+		}
+		if r.Method == http.MethodOptions {
+			h.Set("Allow", allow)
+			if corsAllowed(origin) && r.Header.Get("Access-Control-Request-Method") != "" {
+				h.Set("Access-Control-Allow-Methods", allow)
+				h.Set("Access-Control-Allow-Headers", corsAllowHeaders)
+				h.Set("Access-Control-Max-Age", corsMaxAge)
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if !slices.Contains(methods, r.Method) {
+			h.Set("Allow", allow)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		handler(w, r.WithContext(context.WithValue(r.Context(), allowKey{}, allow)))
+	}
+}
+
+// 返回 405，Allow 为路由接受的全部方法
+func methodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	if allow, ok := r.Context().Value(allowKey{}).(string); ok {
+		w.Header().Set("Allow", allow)
+	}
+	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+}
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Prometheus 文本格式的指标导出，只实现本服务需要的计数器、仪表和直方图
+
+// 指标采集接口
+type metricCollector interface {
+	writeMetric(w *bufio.Writer)
+}
+
+// 已注册的指标，按注册顺序输出
+var metricsRegistry []metricCollector
+
+func registerMetric(c metricCollector) {
+	metricsRegistry = append(metricsRegistry, c)
+}
+
+// 带标签的计数器
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+	mu     sync.Mutex
+	values map[string]*labeledValue
+}
+
+type labeledValue struct {
+	labelValues []string
+	value       float64
+}
+
+// 标签值组合的键。只在新建时保存标签值的副本，可变参数切片不逃逸到堆上，
+// 每个请求都要计数，单个标签时也不拼接字符串
+func labelKey(labelValues []string) string {
+	if len(labelValues) == 1 {
+		return labelValues[0]
+	}
+	return strings.Join(labelValues, "\xff")
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	c := &counterVec{name: name, help: help, labels: labels, values: make(map[string]*labeledValue)}
+	registerMetric(c)
+	return c
+}
+
+// 计数加一，标签值顺序与定义时一致
+func (c *counterVec) inc(labelValues ...string) {
+	c.add(1, labelValues...)
+}
+
+func (c *counterVec) add(delta float64, labelValues ...string) {
+	key := labelKey(labelValues)
+	c.mu.Lock()
+	v, ok := c.values[key]
+	if !ok {
+		v = &labeledValue{labelValues: append([]string(nil), labelValues...)}
+		c.values[key] = v
+	}
+	v.value += delta
+	c.mu.Unlock()
+}
+
+func (c *counterVec) writeMetric(w *bufio.Writer) {
+	writeHeader(w, c.name, c.help, "counter")
+	c.mu.Lock()
+	samples := make([]metricSample, 0, len(c.values))
+	for _, v := range c.values {
+		samples = append(samples, metricSample{labelValues: v.labelValues, value: v.value})
+	}
+	c.mu.Unlock()
+	writeSamples(w, c.name, c.labels, samples)
+}
+
+// 抓取时计算的指标（仪表或由外部维护的计数器）
+type gaugeFunc struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	collect func() []metricSample
+}
+
+type metricSample struct {
+	labelValues []string
+	value       float64
+}
+
+func newGaugeFunc(name, help string, labels []string, collect func() []metricSample) *gaugeFunc {
+	g := &gaugeFunc{name: name, help: help, kind: "gauge", labels: labels, collect: collect}
+	registerMetric(g)
+	return g
+}
+
+func newCounterFunc(name, help string, labels []string, collect func() []metricSample) *gaugeFunc {
+	g := &gaugeFunc{name: name, help: help, kind: "counter", labels: labels, collect: collect}
+	registerMetric(g)
+	return g
+}
+
+func (g *gaugeFunc) writeMetric(w *bufio.Writer) {
+	writeHeader(w, g.name, g.help, g.kind)
+	writeSamples(w, g.name, g.labels, g.collect())
+}
+
+// 带标签的直方图
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	mu      sync.Mutex
+	values  map[string]*histogramValue
+}
+
+type histogramValue struct {
+	labelValues []string
+	counts      []uint64 // 每个桶的累计计数
+	sum         float64
+	count       uint64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	h := &histogramVec{name: name, help: help, labels: labels, buckets: buckets, values: make(map[string]*histogramValue)}
+	registerMetric(h)
+	return h
+}
+
+func (h *histogramVec) observe(value float64, labelValues ...string) {
+	key := labelKey(labelValues)
+	h.mu.Lock()
+	v, ok := h.values[key]
+	if !ok {
+		v = &histogramValue{labelValues: append([]string(nil), labelValues...), counts: make([]uint64, len(h.buckets))}
+		h.values[key] = v
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			v.counts[i]++
+		}
+	}
+	v.sum += value
+	v.count++
+	h.mu.Unlock()
+}
+
+func (h *histogramVec) writeMetric(w *bufio.Writer) {
+	writeHeader(w, h.name, h.help, "histogram")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	bucketLabels := append(append([]string{}, h.labels...), "le")
+	for _, key := range keys {
+		v := h.values[key]
+		for i, bound := range h.buckets {
+			writeSample(w, h.name+"_bucket", bucketLabels, append(append([]string{}, v.labelValues...), formatFloat(bound)), float64(v.counts[i]))
+		}
+		writeSample(w, h.name+"_bucket", bucketLabels, append(append([]string{}, v.labelValues...), "+Inf"), float64(v.count))
+		writeSample(w, h.name+"_sum", h.labels, v.labelValues, v.sum)
+		writeSample(w, h.name+"_count", h.labels, v.labelValues, float64(v.count))
+	}
+}
+
+func writeHeader(w *bufio.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func writeSamples(w *bufio.Writer, name string, labels []string, samples []metricSample) {
+	sort.Slice(samples, func(i, j int) bool {
+		return strings.Join(samples[i].labelValues, "\xff") < strings.Join(samples[j].labelValues, "\xff")
+	})
+	for _, s := range samples {
+		writeSample(w, name, labels, s.labelValues, s.value)
+	}
+}
+
+func writeSample(w *bufio.Writer, name string, labels, labelValues []string, value float64) {
+	w.WriteString(name)
+	if len(labels) > 0 {
+		w.WriteByte('{')
+		for i, label := range labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(label)
+			w.WriteString(`="`)
+			w.WriteString(escapeLabelValue(labelValues[i]))
+			w.WriteByte('"')
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(value))
+	w.WriteByte('\n')
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(value string) string {
+	return labelEscaper.Replace(value)
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// 当前等待中的长轮询数量，以及因 -max-long-polls 未能等待的轮询数量
+var (
+	activeLongPolls   atomic.Int64
+	longPollsRejected atomic.Int64
+)
+
+// 因未确认而重新入队的消息数量
+var messagesRedelivered atomic.Int64
+
+// 服务指标
+var (
+	httpRequestsTotal = newCounterVec("esp32_wol_http_requests_total",
+		"HTTP requests by route, method and status code.", "route", "method", "status")
+	httpRequestDuration = newHistogramVec("esp32_wol_http_request_duration_seconds",
+		"HTTP request latency by route.", []float64{.005, .01, .05, .1, .5, 1, 5, 30, 60, 120}, "route")
+	httpResponseBytes = newCounterVec("esp32_wol_http_response_bytes_total",
+		"HTTP response body bytes written by route.", "route")
+	wolMessagesTotal = newCounterVec("esp32_wol_messages_total",
+		"WOL messages by lifecycle event.", "event")
+)
+
+func init() {
+	newGaugeFunc("esp32_wol_active_long_polls", "Long-poll requests currently waiting for messages.", nil,
+		func() []metricSample {
+			return []metricSample{{value: float64(activeLongPolls.Load())}}
+		})
+	newCounterFunc("esp32_wol_long_polls_rejected_total", "Polls answered immediately because -max-long-polls was reached.", nil,
+		func() []metricSample {
+			return []metricSample{{value: float64(longPollsRejected.Load())}}
+		})
+	newCounterFunc("esp32_wol_messages_redelivered_total", "Messages requeued because the relay did not acknowledge them within -ack-timeout.", nil,
+		func() []metricSample {
+			return []metricSample{{value: float64(messagesRedelivered.Load())}}
+		})
+	newCounterFunc("esp32_wol_clock_skew_rejected_total", "Device timestamps replaced with server time because they were outside -max-clock-skew.", nil,
+		func() []metricSample {
+			return []metricSample{{value: float64(clockSkewRejected.Load())}}
+		})
+	newGaugeFunc("esp32_wol_open_connections", "Open HTTP connections across all listeners.", nil,
+		func() []metricSample {
+			return []metricSample{{value: float64(connLimit.open.Load())}}
+		})
+	newCounterFunc("esp32_wol_connections_rejected_total", "Connections closed because -max-conns was reached.", nil,
+		func() []metricSample {
+			return []metricSample{{value: float64(connLimit.rejected.Load())}}
+		})
+	newGaugeFunc("esp32_wol_ha_leader", "1 if this replica runs the scheduler, prober and alerts (always 1 without -ha).", nil,
+		func() []metricSample {
+			if isLeader() {
+				return []metricSample{{value: 1}}
+			}
+			return []metricSample{{}}
+		})
+	newGaugeFunc("esp32_wol_maintenance", "1 while maintenance mode rejects new wake requests.", nil,
+		func() []metricSample {
+			storage.mu.RLock()
+			defer storage.mu.RUnlock()
+			if storage.maintenance != nil {
+				return []metricSample{{value: 1}}
+			}
+			return []metricSample{{}}
+		})
+	newGaugeFunc("esp32_wol_devices", "Registered devices.", nil,
+		func() []metricSample {
+			storage.mu.RLock()
+			defer storage.mu.RUnlock()
+			return []metricSample{{value: float64(len(storage.devices))}}
+		})
+	newGaugeFunc("esp32_wol_device_last_seen_age_seconds", "Seconds since each device was last seen.", []string{"device_id"},
+		func() []metricSample {
+			storage.mu.RLock()
+			defer storage.mu.RUnlock()
+			samples := make([]metricSample, 0, len(storage.devices))
+			for id, device := range storage.devices {
+				samples = append(samples, metricSample{labelValues: []string{id}, value: time.Since(device.LastSeen).Seconds()})
+			}
+			return samples
+		})
+	newGaugeFunc("esp32_wol_device_battery_percent", "Battery charge reported by each battery-powered relay.", []string{"device_id"},
+		func() []metricSample {
+			storage.mu.RLock()
+			defer storage.mu.RUnlock()
+			var samples []metricSample
+			for id, device := range storage.devices {
+				if device.Power != nil && device.Power.Source == powerBattery && device.Power.Percent > 0 {
+					samples = append(samples, metricSample{labelValues: []string{id}, value: float64(device.Power.Percent)})
+				}
+			}
+			return samples
+		})
+	newGaugeFunc("esp32_wol_device_battery_volts", "Battery voltage reported by each relay.", []string{"device_id"},
+		func() []metricSample {
+			storage.mu.RLock()
+			defer storage.mu.RUnlock()
+			var samples []metricSample
+			for id, device := range storage.devices {
+				if device.Power != nil && device.Power.Voltage > 0 {
+					samples = append(samples, metricSample{labelValues: []string{id}, value: device.Power.Voltage})
+				}
+			}
+			return samples
+		})
+	newGaugeFunc("esp32_wol_target_up", "Probed power state per target (1 on, 0 off).", []string{"target"},
+		func() []metricSample {
+			powerStates.RLock()
+			defer powerStates.RUnlock()
+			samples := make([]metricSample, 0, len(powerStates.m))
+			for name, p := range powerStates.m {
+				switch p.State {
+				case powerOn:
+					samples = append(samples, metricSample{labelValues: []string{name}, value: 1})
+				case powerOff:
+					samples = append(samples, metricSample{labelValues: []string{name}})
+				}
+			}
+			return samples
+		})
+	newGaugeFunc("esp32_wol_queue_depth", "Pending WOL messages per device.", []string{"device_id"},
+		func() []metricSample {
+			depths := queues.depths()
+			samples := make([]metricSample, 0, len(depths))
+			for id, depth := range depths {
+				samples = append(samples, metricSample{labelValues: []string{id}, value: float64(depth)})
+			}
+			return samples
+		})
+	newCounterFunc("esp32_wol_device_messages_total", "WOL messages per device by lifecycle event.", []string{"device_id", "event"},
+		func() []metricSample {
+			storage.mu.RLock()
+			defer storage.mu.RUnlock()
+			samples := make([]metricSample, 0, len(storage.devices)*4)
+			for id, device := range storage.devices {
+				samples = append(samples,
+					metricSample{labelValues: []string{id, "queued"}, value: float64(device.Stats.MessagesQueued)},
+					metricSample{labelValues: []string{id, "delivered"}, value: float64(device.Stats.MessagesDelivered)},
+					metricSample{labelValues: []string{id, "acked"}, value: float64(device.Stats.MessagesAcked)},
+					metricSample{labelValues: []string{id, "failed"}, value: float64(device.Stats.MessagesFailed)})
+			}
+			return samples
+		})
+	newCounterFunc("esp32_wol_device_polls_total", "Poll requests served per device.", []string{"device_id"},
+		func() []metricSample {
+			storage.mu.RLock()
+			defer storage.mu.RUnlock()
+			samples := make([]metricSample, 0, len(storage.devices))
+			for id, device := range storage.devices {
+				samples = append(samples, metricSample{labelValues: []string{id}, value: float64(device.Stats.Polls)})
+			}
+			return samples
+		})
+	newCounterFunc("esp32_wol_device_long_poll_timeouts_total", "Long polls that ended without messages per device.", []string{"device_id"},
+		func() []metricSample {
+			storage.mu.RLock()
+			defer storage.mu.RUnlock()
+			samples := make([]metricSample, 0, len(storage.devices))
+			for id, device := range storage.devices {
+				samples = append(samples, metricSample{labelValues: []string{id}, value: float64(device.Stats.LongPollTimeouts)})
+			}
+			return samples
+		})
+}
+
+// 记录响应状态码和写出的字节数，供指标中间件使用
+type statusRecorder struct {
+	http.ResponseWriter
+	route      string
+	statusCode int
+}
+
+// 每次写入都计数，事件流等长连接在连接期间就能看到流量
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(b)
+	if n > 0 {
+		httpResponseBytes.add(float64(n), r.route)
+	}
+	return n, err
+}
+
+func (r *statusRecorder) WriteHeader(statusCode int) {
+	r.statusCode = statusCode
+	r.ResponseWriter.WriteHeader(statusCode)
+}
+
+// 指标中间件：按路由统计请求数和耗时
+func metricsMiddleware(routeName string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, route: routeName, statusCode: http.StatusOK}
+		handler(rec, r)
+		httpRequestsTotal.inc(routeName, r.Method, strconv.Itoa(rec.statusCode))
+		httpRequestDuration.observe(time.Since(start).Seconds(), routeName)
+	}
+}
+
+// Prometheus 指标
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	for _, c := range metricsRegistry {
+		c.writeMetric(bw)
+	}
+	bw.Flush()
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MQTT 桥接：把事件和消息状态发布到外部 MQTT broker，供其他家庭自动化组件订阅。
+// 作为通知渠道运行，复用通知子系统的队列、重试和健康状态。
+// 只实现发布所需的 MQTT 3.1.1 子集（CONNECT、PUBLISH QoS 0/1、PINGREQ）
+
+// MQTT 桥接配置
+type MQTTConfig struct {
+	Broker       string   `json:"broker"` // tcp://host:1883 或 tls://host:8883
+	Username     string   `json:"username"`
+	Password     string   `json:"password"`
+	ClientID     string   `json:"client_id"`     // 默认 esp32-wol-<主机名>
+	TopicPrefix  string   `json:"topic_prefix"`  // 默认 esp32-wol
+	EventTopic   *string  `json:"event_topic"`   // 默认 <prefix>/events/{type}，空字符串表示不发布
+	MessageTopic *string  `json:"message_topic"` // 默认 <prefix>/messages/{device_id}，空字符串表示不发布
+	QoS          int      `json:"qos"`           // 0 或 1
+	Retain       bool     `json:"retain"`
+	Events       []string `json:"events"` // 为空表示全部事件
+	MaxRetries   *int     `json:"max_retries"`
+}
+
+type mqttNotifier struct {
+	addr         string
+	useTLS       bool
+	host         string
+	username     string
+	password     string
+	clientID     string
+	statusTopic  string
+	eventTopic   string
+	messageTopic string
+	qos          byte
+	retain       bool
+	filter       eventFilter
+
+	mu       sync.Mutex
+	conn     *mqttConn
+	packetID uint16
+}
+
+// 一个 MQTT 连接：读协程分发 PUBACK，定时发送 PINGREQ 保持连接
+type mqttConn struct {
+	net.Conn
+	writeMu sync.Mutex
+	acks    chan uint16
+	done    chan struct{}
+}
+
+const (
+	mqttKeepAlive = 60 * time.Second
+	mqttTimeout   = 10 * time.Second
+)
+
+func newMQTTNotifier(cfg MQTTConfig) (*mqttNotifier, error) {
+	u, err := url.Parse(cfg.Broker)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid broker %q", cfg.Broker)
+	}
+	n := &mqttNotifier{host: u.Hostname(), username: cfg.Username, password: cfg.Password, retain: cfg.Retain}
+	port := u.Port()
+	switch u.Scheme {
+	case "tcp", "mqtt":
+		if port == "" {
+			port = "1883"
+		}
+	case "tls", "ssl", "mqtts":
+		n.useTLS = true
+		if port == "" {
+			port = "8883"
+		}
+	default:
+		return nil, fmt.Errorf("invalid broker %q: scheme must be tcp or tls", cfg.Broker)
+	}
+	n.addr = net.JoinHostPort(n.host, port)
+
+	if cfg.QoS != 0 && cfg.QoS != 1 {
+		return nil, fmt.Errorf("qos must be 0 or 1")
+	}
+	n.qos = byte(cfg.QoS)
+	if n.filter, err = newEventFilter(cfg.Events); err != nil {
+		return nil, err
+	}
+
+	n.clientID = cfg.ClientID
+	if n.clientID == "" {
+		hostname, _ := os.Hostname()
+		n.clientID = "esp32-wol-" + hostname
+	}
+	prefix := strings.TrimRight(cfg.TopicPrefix, "/")
+	if prefix == "" {
+		prefix = "esp32-wol"
+	}
+	n.statusTopic = prefix + "/status"
+	n.eventTopic = prefix + "/events/{type}"
+	if cfg.EventTopic != nil {
+		n.eventTopic = *cfg.EventTopic
+	}
+	n.messageTopic = prefix + "/messages/{device_id}"
+	if cfg.MessageTopic != nil {
+		n.messageTopic = *cfg.MessageTopic
+	}
+	for _, topic := range []string{n.eventTopic, n.messageTopic} {
+		if strings.ContainsAny(topic, "#+") {
+			return nil, fmt.Errorf("topic %q must not contain wildcards", topic)
+		}
+	}
+	return n, nil
+}
+
+func (n *mqttNotifier) name() string { return "mqtt:" + n.addr }
+
+func (n *mqttNotifier) wants(eventType string) bool { return n.filter.wants(eventType) }
+
+// 展开主题中的占位符：{type}、{device_id}、{message_id}、{target}
+func (n *mqttNotifier) topic(tmpl string, e Event, target string) string {
+	return strings.NewReplacer(
+		"{type}", e.Type,
+		"{device_id}", e.DeviceID,
+		"{message_id}", e.MessageID,
+		"{target}", target,
+	).Replace(tmpl)
+}
+
+// 发布事件；消息相关事件还会发布消息的最新状态
+func (n *mqttNotifier) send(ctx context.Context, e Event) error {
+	var payloads []struct {
+		topic string
+		body  []byte
+	}
+	add := func(topic string, v any) {
+		body, _ := json.Marshal(v)
+		payloads = append(payloads, struct {
+			topic string
+			body  []byte
+		}{topic, body})
+	}
+
+	var message *WOLMessage
+	if e.MessageID != "" {
+		storage.mu.RLock()
+		if m, exists := storage.messages[e.MessageID]; exists {
+			copied := *m
+			message = &copied
+		}
+		storage.mu.RUnlock()
+	}
+	target := ""
+	if message != nil {
+		target = message.Target
+	}
+	if n.eventTopic != "" {
+		add(n.topic(n.eventTopic, e, target), e)
+	}
+	if n.messageTopic != "" && message != nil {
+		add(n.topic(n.messageTopic, e, target), message)
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	conn, err := n.connect(ctx)
+	if err != nil {
+		return err
+	}
+	for _, p := range payloads {
+		if err := n.publish(conn, p.topic, p.body, n.qos, n.retain); err != nil {
+			conn.Close()
+			n.conn = nil
+			return err
+		}
+	}
+	return nil
+}
+
+// 返回可用的连接，必要时重新连接。调用方需持有 n.mu
+func (n *mqttNotifier) connect(ctx context.Context) (*mqttConn, error) {
+	if n.conn != nil {
+		select {
+		case <-n.conn.done:
+			n.conn = nil
+		default:
+			return n.conn, nil
+		}
+	}
+
+	dialer := &net.Dialer{Timeout: mqttTimeout}
+	var raw net.Conn
+	var err error
+	if n.useTLS {
+		raw, err = (&tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: n.host}}).DialContext(ctx, "tcp", n.addr)
+	} else {
+		raw, err = dialer.DialContext(ctx, "tcp", n.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// CONNECT：clean session，遗嘱消息在连接异常断开时把状态置为 offline
+	var body []byte
+	body = appendMQTTString(body, "MQTT")
+	flags := byte(0x02 | 0x04 | 0x20) // clean session, will, will retain
+	if n.username != "" {
+		flags |= 0x80
+		if n.password != "" {
+			flags |= 0x40
+		}
+	}
+	body = append(body, 4, flags)
+	body = binary.BigEndian.AppendUint16(body, uint16(mqttKeepAlive.Seconds()))
+	body = appendMQTTString(body, n.clientID)
+	body = appendMQTTString(body, n.statusTopic)
+	body = appendMQTTString(body, "offline")
+	if n.username != "" {
+		body = appendMQTTString(body, n.username)
+		if n.password != "" {
+			body = appendMQTTString(body, n.password)
+		}
+	}
+
+	raw.SetDeadline(time.Now().Add(mqttTimeout))
+	r := bufio.NewReader(raw)
+	if _, err := raw.Write(mqttPacket(0x10, body)); err != nil {
+		raw.Close()
+		return nil, err
+	}
+	kind, ack, err := readMQTTPacket(r)
+	if err != nil {
+		raw.Close()
+		return nil, fmt.Errorf("read CONNACK: %w", err)
+	}
+	if kind != 0x20 || len(ack) != 2 {
+		raw.Close()
+		return nil, fmt.Errorf("unexpected packet 0x%02x instead of CONNACK", kind)
+	}
+	if ack[1] != 0 {
+		raw.Close()
+		err := fmt.Errorf("broker refused connection: return code %d", ack[1])
+		if ack[1] == 4 || ack[1] == 5 { // 用户名密码错误或未授权，重试也不会成功
+			return nil, permanentError{err}
+		}
+		return nil, err
+	}
+	raw.SetDeadline(time.Time{})
+
+	conn := &mqttConn{Conn: raw, acks: make(chan uint16, 16), done: make(chan struct{})}
+	go conn.readLoop(r)
+	go conn.keepAlive()
+	if err := n.publish(conn, n.statusTopic, []byte("online"), n.qos, true); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	n.conn = conn
+	return conn, nil
+}
+
+// 发布一条消息，QoS 1 时等待 PUBACK。调用方需持有 n.mu
+func (n *mqttNotifier) publish(conn *mqttConn, topic string, payload []byte, qos byte, retain bool) error {
+	header := byte(0x30) | qos<<1
+	if retain {
+		header |= 0x01
+	}
+	body := appendMQTTString(nil, topic)
+	var id uint16
+	if qos > 0 {
+		n.packetID++
+		if n.packetID == 0 {
+			n.packetID = 1
+		}
+		id = n.packetID
+		body = binary.BigEndian.AppendUint16(body, id)
+	}
+	body = append(body, payload...)
+	if err := conn.write(mqttPacket(header, body)); err != nil {
+		return err
+	}
+	if qos == 0 {
+		return nil
+	}
+
+	timeout := time.After(mqttTimeout)
+	for {
+		select {
+		case acked := <-conn.acks:
+			if acked == id {
+				return nil
+			}
+		case <-conn.done:
+			return errors.New("connection closed before PUBACK")
+		case <-timeout:
+			return errors.New("timed out waiting for PUBACK")
+		}
+	}
+}
+
+func (c *mqttConn) write(packet []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.SetWriteDeadline(time.Now().Add(mqttTimeout))
+	_, err := c.Write(packet)
+	return err
+}
+
+func (c *mqttConn) readLoop(r *bufio.Reader) {
+	defer close(c.done)
+	defer c.Close()
+	for {
+		kind, body, err := readMQTTPacket(r)
+		if err != nil {
+			return
+		}
+		if kind == 0x40 && len(body) == 2 { // PUBACK
+			select {
+			case c.acks <- binary.BigEndian.Uint16(body):
+			default:
+			}
+		}
+	}
+}
+
+func (c *mqttConn) keepAlive() {
+	ticker := time.NewTicker(mqttKeepAlive / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			if err := c.write([]byte{0xC0, 0x00}); err != nil { // PINGREQ
+				c.Close()
+				return
+			}
+		}
+	}
+}
+
+// 组装数据包：固定头 + 剩余长度（变长编码）+ 内容
+func mqttPacket(header byte, body []byte) []byte {
+	packet := []byte{header}
+	length := len(body)
+	for {
+		b := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			b |= 0x80
+		}
+		packet = append(packet, b)
+		if length == 0 {
+			break
+		}
+	}
+	return append(packet, body...)
+}
+
+func appendMQTTString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+// 读取一个数据包，返回包类型（高4位）和内容
+func readMQTTPacket(r *bufio.Reader) (byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		if i == 4 {
+			return 0, nil, errors.New("malformed remaining length")
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length += int(b&0x7f) * multiplier
+		multiplier *= 128
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return header & 0xf0, body, nil
+}
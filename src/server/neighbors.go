@@ -0,0 +1,315 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 中继的邻居表：管理员下发 neighbor_scan 命令后，中继上报所在网段中发现的主机（MAC地址与IP），
+// 服务器按中继合并保存，用于建议新的唤醒目标，并检查目标是否由能看到它的中继负责唤醒。
+// 只保存在内存中，超过 neighborMaxAge 未再出现的条目被丢弃
+
+const (
+	maxNeighbors    = 256 // 每台中继保存的条目数，超出时丢弃最久未出现的
+	maxNeighborBody = 32 * 1024
+	neighborMaxAge  = 7 * 24 * time.Hour
+)
+
+type Neighbor struct {
+	MacAddress string    `json:"mac_address"`
+	IP         string    `json:"ip"`
+	Name       string    `json:"name,omitempty"` // 主机名（例如 NetBIOS 名称），可选
+	SeenAt     time.Time `json:"seen_at"`
+}
+
+// 中继上传的邻居表
+type NeighborReport struct {
+	Time      time.Time  `json:"time"`
+	MessageID string     `json:"message_id,omitempty"` // 触发扫描的命令，主动上报时为空
+	Neighbors []Neighbor `json:"neighbors"`
+}
+
+type neighborLog struct {
+	mu     sync.Mutex
+	tables map[string]map[string]Neighbor // 设备ID -> MAC地址 -> 条目
+}
+
+var neighbors = &neighborLog{tables: make(map[string]map[string]Neighbor)}
+
+// 合并一次上报，同一MAC地址保留最新的IP和名称
+func (l *neighborLog) merge(deviceID string, entries []Neighbor, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	table := l.tables[deviceID]
+	if table == nil {
+		table = make(map[string]Neighbor)
+		l.tables[deviceID] = table
+	}
+	for _, n := range entries {
+		if n.Name == "" {
+			n.Name = table[n.MacAddress].Name
+		}
+		table[n.MacAddress] = n
+	}
+	for mac, n := range table {
+		if now.Sub(n.SeenAt) > neighborMaxAge {
+			delete(table, mac)
+		}
+	}
+	if len(table) > maxNeighbors {
+		list := sortedNeighbors(table)
+		sort.Slice(list, func(i, j int) bool { return list[i].SeenAt.After(list[j].SeenAt) })
+		for _, n := range list[maxNeighbors:] {
+			delete(table, n.MacAddress)
+		}
+	}
+}
+
+// 中继的邻居表，按IP排序
+func (l *neighborLog) list(deviceID string) []Neighbor {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return sortedNeighbors(l.tables[deviceID])
+}
+
+// 看到过该MAC地址的中继 -> 条目
+func (l *neighborLog) lookup(mac string) map[string]Neighbor {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	seen := make(map[string]Neighbor)
+	for deviceID, table := range l.tables {
+		if n, ok := table[mac]; ok {
+			seen[deviceID] = n
+		}
+	}
+	return seen
+}
+
+func (l *neighborLog) forget(deviceID string) {
+	l.mu.Lock()
+	delete(l.tables, deviceID)
+	l.mu.Unlock()
+}
+
+func sortedNeighbors(table map[string]Neighbor) []Neighbor {
+	list := make([]Neighbor, 0, len(table))
+	for _, n := range table {
+		list = append(list, n)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		a, errA := netip.ParseAddr(list[i].IP)
+		b, errB := netip.ParseAddr(list[j].IP)
+		if errA != nil || errB != nil || a == b {
+			return list[i].MacAddress < list[j].MacAddress
+		}
+		return a.Less(b)
+	})
+	return list
+}
+
+// POST /api/devices/<id>/neighbors
+func uploadNeighbors(w http.ResponseWriter, r *http.Request, deviceID string) {
+	var req NeighborReport
+	r.Body = http.MaxBytesReader(w, r.Body, maxNeighborBody)
+	if !readJSON(w, r, &req) {
+		return
+	}
+	for i := range req.Neighbors {
+		n := &req.Neighbors[i]
+		mac, err := normalizeMAC(n.MacAddress)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("neighbors[%d]: %v", i, err), http.StatusBadRequest)
+			return
+		}
+		if net.ParseIP(n.IP) == nil {
+			http.Error(w, fmt.Sprintf("neighbors[%d]: invalid IP address %q", i, n.IP), http.StatusBadRequest)
+			return
+		}
+		n.MacAddress, n.Name = mac, strings.TrimSpace(n.Name)
+	}
+	if req.MessageID != "" {
+		storage.mu.RLock()
+		msg, exists := storage.messages[req.MessageID]
+		valid := exists && msg.DeviceID == deviceID && msg.Type == messageTypeNeighborScan
+		storage.mu.RUnlock()
+		if !valid {
+			http.Error(w, "Message not found", http.StatusNotFound)
+			return
+		}
+	}
+	storage.mu.Lock()
+	req.Time, _ = deviceTimestamp(deviceID, req.Time)
+	storage.mu.Unlock()
+	for i := range req.Neighbors {
+		req.Neighbors[i].SeenAt = req.Time
+	}
+	neighbors.merge(deviceID, req.Neighbors, time.Now())
+	if req.MessageID != "" {
+		completeDiscovery(req.MessageID, req.Neighbors)
+	}
+	requestLogger(r).Info("neighbor table uploaded", "device_id", deviceID, "message_id", req.MessageID, "neighbors", len(req.Neighbors))
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"message": "Neighbor table stored",
+	})
+}
+
+// 检查负责唤醒的中继是否看到过该MAC地址：只有其他中继看到过时返回提示，没有任何记录时返回空
+func neighborCoverage(mac, deviceID string) string {
+	normalized, err := normalizeMAC(mac)
+	if err != nil {
+		return ""
+	}
+	seen := neighbors.lookup(normalized)
+	if len(seen) == 0 {
+		return ""
+	}
+	if _, ok := seen[deviceID]; ok {
+		return ""
+	}
+	relays := make([]string, 0, len(seen))
+	for id := range seen {
+		relays = append(relays, id)
+	}
+	sort.Strings(relays)
+	return fmt.Sprintf("%s was not seen by relay %s but by %s, the magic packet may not reach it", normalized, deviceID, strings.Join(relays, ", "))
+}
+
+// 邻居表中的一台主机
+type NeighborView struct {
+	Neighbor
+	DeviceID string `json:"device_id"`
+	Vendor   string `json:"vendor,omitempty"` // 网卡厂商，见 oui.go
+	Relay    bool   `json:"relay,omitempty"`  // 已注册的中继
+	Target   string `json:"target,omitempty"` // MAC地址相同的目标
+}
+
+// 根据邻居表建议的目标，可以直接提交给 POST /api/admin/targets
+type TargetSuggestion struct {
+	Name        string       `json:"name"`
+	MacAddress  string       `json:"mac_address"`
+	DeviceID    string       `json:"device_id"`
+	Description string       `json:"description,omitempty"` // 网卡厂商
+	Probe       *TargetProbe `json:"probe"`
+}
+
+// 标记邻居表中的中继和已有目标、为建议的目标分配名称
+type neighborIndex struct {
+	relayMACs    map[string]bool
+	targetsByMAC map[string]string // MAC地址 -> 用户能看到的目标，有多个时取名称最小的
+	used         map[string]bool   // 已使用的目标名称
+}
+
+// 调用方持有 storage.mu 读锁
+func newNeighborIndex(p principal) *neighborIndex {
+	x := &neighborIndex{relayMACs: make(map[string]bool), targetsByMAC: make(map[string]string), used: make(map[string]bool)}
+	for _, d := range storage.devices {
+		if mac, err := normalizeMAC(d.MacAddress); err == nil {
+			x.relayMACs[mac] = true
+		}
+	}
+	for name, t := range storage.targets {
+		x.used[name] = true
+		if p.canWakeTarget(t) && (x.targetsByMAC[t.MacAddress] == "" || name < x.targetsByMAC[t.MacAddress]) {
+			x.targetsByMAC[t.MacAddress] = name
+		}
+	}
+	return x
+}
+
+func (x *neighborIndex) view(n Neighbor, deviceID string) NeighborView {
+	return NeighborView{
+		Neighbor: n,
+		DeviceID: deviceID,
+		Vendor:   macVendor(n.MacAddress),
+		Relay:    x.relayMACs[n.MacAddress],
+		Target:   x.targetsByMAC[n.MacAddress],
+	}
+}
+
+// 中继自身和已有目标不建议
+func (x *neighborIndex) candidate(v NeighborView) bool {
+	return !v.Relay && v.Target == ""
+}
+
+func (x *neighborIndex) suggest(v NeighborView) TargetSuggestion {
+	return TargetSuggestion{
+		Name:        suggestedName(v.Neighbor, x.used),
+		MacAddress:  v.MacAddress,
+		DeviceID:    v.DeviceID,
+		Description: v.Vendor,
+		Probe:       &TargetProbe{Method: "icmp", Host: v.IP},
+	}
+}
+
+var nonNameChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// 建议的目标名称：主机名，没有时按IP生成
+func suggestedName(n Neighbor, used map[string]bool) string {
+	name := strings.Trim(nonNameChars.ReplaceAllString(strings.ToLower(n.Name), "-"), "-._")
+	if !namePattern.MatchString(name) {
+		name = "host-" + strings.NewReplacer(".", "-", ":", "-").Replace(n.IP)
+	}
+	for i, base := 2, name; used[name]; i++ {
+		name = fmt.Sprintf("%s-%d", base, i)
+	}
+	used[name] = true
+	return name
+}
+
+// GET /api/admin/neighbors[?mac=...]：用户能看到的中继上报的主机，以及尚未建为目标的主机的建议
+func neighborsHandler(w http.ResponseWriter, r *http.Request) {
+	p := requestPrincipal(r)
+	var filter string
+	if mac := r.URL.Query().Get("mac"); mac != "" {
+		var err error
+		if filter, err = normalizeMAC(mac); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	storage.mu.RLock()
+	var relays []string
+	for id, d := range storage.devices {
+		if p.owns(d.Owner) {
+			relays = append(relays, id)
+		}
+	}
+	index := newNeighborIndex(p)
+	storage.mu.RUnlock()
+	sort.Strings(relays)
+
+	views := []NeighborView{}
+	latest := make(map[string]int) // MAC地址 -> 最近看到它的中继的条目
+	for _, id := range relays {
+		for _, n := range neighbors.list(id) {
+			if filter != "" && n.MacAddress != filter {
+				continue
+			}
+			if i, ok := latest[n.MacAddress]; !ok || n.SeenAt.After(views[i].SeenAt) {
+				latest[n.MacAddress] = len(views)
+			}
+			views = append(views, index.view(n, id))
+		}
+	}
+	// 同一主机由最近看到它的中继负责
+	suggestions := []TargetSuggestion{}
+	for i, v := range views {
+		if index.candidate(v) && latest[v.MacAddress] == i {
+			suggestions = append(suggestions, index.suggest(v))
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success":     true,
+		"neighbors":   views,
+		"suggestions": suggestions,
+	})
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 通知配置
+type NotificationConfig struct {
+	Webhooks []WebhookConfig  `json:"webhooks"`
+	Telegram []TelegramConfig `json:"telegram"`
+	Email    *EmailConfig     `json:"email"`
+	MQTT     []MQTTConfig     `json:"mqtt"`
+}
+
+// 通知渠道
+type notifier interface {
+	name() string
+	wants(eventType string) bool
+	send(ctx context.Context, e Event) error
+}
+
+// 不需要重试的错误（例如对方返回 4xx）
+type permanentError struct{ err error }
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// 已知的事件类型，用于校验配置
+var knownEventTypes = map[string]bool{
+	eventDeviceRegistered:       true,
+	eventDeviceOnline:           true,
+	eventDeviceOffline:          true,
+	eventDeviceApproved:         true,
+	eventDeviceDeleted:          true,
+	eventDeviceStale:            true,
+	eventDeviceProvisioned:      true,
+	eventDeviceCrashed:          true,
+	eventDevicePowerChanged:     true,
+	eventMessageQueued:          true,
+	eventMessageDelivered:       true,
+	eventMessageAcked:           true,
+	eventMessageFailed:          true,
+	eventMessageCancelled:       true,
+	eventApprovalRequested:      true,
+	eventMessageApproved:        true,
+	eventMessageRejected:        true,
+	eventAuthFailureBurst:       true,
+	eventTargetUp:               true,
+	eventTargetDown:             true,
+	eventTargetFlapping:         true,
+	eventTargetPowerOff:         true,
+	eventHALeader:               true,
+	eventQueueBackpressure:      true,
+	eventMaintenance:            true,
+	eventQueuePurged:            true,
+	eventDeviceIdentityMismatch: true,
+
+	eventAlertRelayOffline:     true,
+	eventAlertRepeatedFailures: true,
+	eventAlertBootLoop:         true,
+	eventAlertLowBattery:       true,
+}
+
+// 事件过滤器，为空表示接收全部事件
+type eventFilter map[string]bool
+
+func newEventFilter(types []string) (eventFilter, error) {
+	if len(types) == 0 {
+		return nil, nil
+	}
+	filter := make(eventFilter, len(types))
+	for _, t := range types {
+		if !knownEventTypes[t] {
+			return nil, fmt.Errorf("unknown event type %q", t)
+		}
+		filter[t] = true
+	}
+	return filter, nil
+}
+
+func (f eventFilter) wants(eventType string) bool {
+	return f == nil || f[eventType]
+}
+
+// 每个通知渠道一个发送协程和队列，慢渠道不影响其他渠道
+type notifierWorker struct {
+	notifier   notifier
+	queue      chan Event
+	maxRetries int
+
+	mu          sync.Mutex
+	lastError   string
+	lastErrorAt time.Time
+	lastSuccess time.Time
+}
+
+var notificationsTotal = newCounterVec("esp32_wol_notifications_total",
+	"Notification deliveries by notifier and result.", "notifier", "result")
+
+// 默认重试次数
+const defaultNotifyRetries = 3
+
+func retriesOrDefault(retries *int) int {
+	if retries == nil {
+		return defaultNotifyRetries
+	}
+	return *retries
+}
+
+// 按配置创建通知器，配置无效时返回错误（check-config 也用于校验）
+func buildNotifiers(cfg NotificationConfig) ([]*notifierWorker, error) {
+	var workers []*notifierWorker
+	for i, wc := range cfg.Webhooks {
+		n, err := newWebhookNotifier(wc)
+		if err != nil {
+			return nil, fmt.Errorf("webhooks[%d]: %v", i, err)
+		}
+		workers = append(workers, &notifierWorker{notifier: n, queue: make(chan Event, 100), maxRetries: retriesOrDefault(wc.MaxRetries)})
+	}
+	for i, tc := range cfg.Telegram {
+		n, err := newTelegramNotifier(tc)
+		if err != nil {
+			return nil, fmt.Errorf("telegram[%d]: %v", i, err)
+		}
+		workers = append(workers, &notifierWorker{notifier: n, queue: make(chan Event, 100), maxRetries: retriesOrDefault(tc.MaxRetries)})
+	}
+	for i, mc := range cfg.MQTT {
+		n, err := newMQTTNotifier(mc)
+		if err != nil {
+			return nil, fmt.Errorf("mqtt[%d]: %v", i, err)
+		}
+		workers = append(workers, &notifierWorker{notifier: n, queue: make(chan Event, 100), maxRetries: retriesOrDefault(mc.MaxRetries)})
+	}
+	if cfg.Email != nil {
+		n, err := newEmailNotifier(*cfg.Email)
+		if err != nil {
+			return nil, fmt.Errorf("email: %v", err)
+		}
+		workers = append(workers, &notifierWorker{notifier: n, queue: make(chan Event, 100), maxRetries: retriesOrDefault(cfg.Email.MaxRetries)})
+	}
+	return workers, nil
+}
+
+// 启动通知子系统，没有配置任何渠道时不启动
+func startNotifications(cfg NotificationConfig) error {
+	workers, err := buildNotifiers(cfg)
+	if err != nil || len(workers) == 0 {
+		return err
+	}
+
+	for _, w := range workers {
+		go w.run()
+	}
+
+	ch, _, _ := events.subscribe(0)
+	go func() {
+		for e := range ch {
+			for _, w := range workers {
+				if !w.notifier.wants(e.Type) {
+					continue
+				}
+				select {
+				case w.queue <- e:
+				default:
+					notificationsTotal.inc(w.notifier.name(), "dropped")
+					slog.Warn("notification queue full, event dropped", "notifier", w.notifier.name(), "event_id", e.ID, "type", e.Type)
+				}
+			}
+		}
+	}()
+
+	registerHealthCheck("notifications", func() ComponentHealth {
+		var failing []string
+		for _, w := range workers {
+			w.mu.Lock()
+			if w.lastErrorAt.After(w.lastSuccess) {
+				failing = append(failing, w.notifier.name()+": "+w.lastError)
+			}
+			w.mu.Unlock()
+		}
+		if len(failing) > 0 {
+			return ComponentHealth{Status: healthDegraded, Detail: strings.Join(failing, "; ")}
+		}
+		return ComponentHealth{Status: healthOK, Detail: fmt.Sprintf("%d notifiers", len(workers))}
+	})
+
+	slog.Info("notifications enabled", "notifiers", len(workers))
+	return nil
+}
+
+func (w *notifierWorker) run() {
+	for {
+		select {
+		case <-shutdownCh:
+			return
+		case e := <-w.queue:
+			w.deliver(e)
+		}
+	}
+}
+
+// 发送单个事件，失败时指数退避重试
+func (w *notifierWorker) deliver(e Event) {
+	name := w.notifier.name()
+	backoff := time.Second
+
+	for attempt := 0; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+		err := w.notifier.send(ctx, e)
+		cancel()
+
+		if err == nil {
+			w.mu.Lock()
+			w.lastSuccess = time.Now()
+			w.mu.Unlock()
+			notificationsTotal.inc(name, "success")
+			return
+		}
+
+		var permanent permanentError
+		retry := attempt < w.maxRetries && !errors.As(err, &permanent)
+		slog.Warn("notification failed", "notifier", name, "event_id", e.ID, "type", e.Type,
+			"attempt", attempt+1, "retry", retry, "error", err)
+		if !retry {
+			w.mu.Lock()
+			w.lastError = err.Error()
+			w.lastErrorAt = time.Now()
+			w.mu.Unlock()
+			notificationsTotal.inc(name, "failure")
+			return
+		}
+
+		select {
+		case <-shutdownCh:
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > time.Minute {
+			backoff = time.Minute
+		}
+	}
+}
+
+// 面向人的事件描述，用于聊天、邮件等通知渠道
+func eventSummary(e Event) string {
+	if kind, _ := e.Data["type"].(string); kind != "" {
+		return commandSummary(kind, e)
+	}
+	target, _ := e.Data["target_mac"].(string)
+	switch e.Type {
+	case eventMessageQueued:
+		return fmt.Sprintf("Wake requested for %s via relay %s", target, e.DeviceID)
+	case eventMessageDelivered:
+		return fmt.Sprintf("Wake command for %s delivered to relay %s", target, e.DeviceID)
+	case eventMessageAcked:
+		return fmt.Sprintf("Wake confirmed: relay %s sent the magic packet to %s", e.DeviceID, target)
+	case eventMessageFailed:
+		return fmt.Sprintf("Wake failed: relay %s could not wake %s: %v", e.DeviceID, target, e.Data["error"])
+	case eventMessageCancelled:
+		return fmt.Sprintf("Wake for %s via relay %s cancelled", target, e.DeviceID)
+	case eventApprovalRequested:
+		return fmt.Sprintf("Wake for protected target %v requested by %v, awaiting approval (message %s)", e.Data["target"], e.Data["source"], e.MessageID)
+	case eventMessageApproved:
+		return fmt.Sprintf("Wake for protected target %v approved by %v", e.Data["target"], e.Data["by"])
+	case eventMessageRejected:
+		return fmt.Sprintf("Wake for protected target %v rejected: %v", e.Data["target"], e.Data["reason"])
+	case eventDeviceRegistered:
+		return fmt.Sprintf("Relay %s registered (%v)", e.DeviceID, e.Data["name"])
+	case eventDeviceOnline:
+		return fmt.Sprintf("Relay %s is back online", e.DeviceID)
+	case eventDeviceOffline:
+		return fmt.Sprintf("Relay %s went offline (last seen %v)", e.DeviceID, e.Data["last_seen"])
+	case eventDeviceApproved:
+		return fmt.Sprintf("Relay %s approved", e.DeviceID)
+	case eventDeviceDeleted:
+		if e.Data["reason"] == "stale" {
+			return fmt.Sprintf("Relay %s deleted after not being seen since %v", e.DeviceID, e.Data["last_seen"])
+		}
+		return fmt.Sprintf("Relay %s deleted", e.DeviceID)
+	case eventDeviceProvisioned:
+		return fmt.Sprintf("Relay %s provisioned with enrollment %v", e.DeviceID, e.Data["enrollment_id"])
+	case eventDeviceCrashed:
+		return fmt.Sprintf("Relay %s restarted unexpectedly (reset reason: %v)", e.DeviceID, e.Data["reset_reason"])
+	case eventDevicePowerChanged:
+		if e.Data["source"] == powerBattery {
+			return fmt.Sprintf("Relay %s lost external power and is running on battery (%v%%)", e.DeviceID, e.Data["percent"])
+		}
+		return fmt.Sprintf("Relay %s is back on %v power", e.DeviceID, e.Data["source"])
+	case eventDeviceStale:
+		return fmt.Sprintf("Relay %s has not been seen since %v and will be deleted at %v", e.DeviceID, e.Data["last_seen"], e.Data["purge_at"])
+	case eventAlertRelayOffline:
+		return fmt.Sprintf("ALERT: relay %s has been offline for %v minutes", e.DeviceID, e.Data["offline_minutes"])
+	case eventAlertRepeatedFailures:
+		return fmt.Sprintf("ALERT: %v failed wake attempts for %s within %v (last error: %v)", e.Data["count"], target, e.Data["window"], e.Data["error"])
+	case eventAlertBootLoop:
+		return fmt.Sprintf("ALERT: relay %s restarted unexpectedly %v times within %v", e.DeviceID, e.Data["count"], e.Data["window"])
+	case eventAlertLowBattery:
+		return fmt.Sprintf("ALERT: relay %s battery is low (%v%%, %vV)", e.DeviceID, e.Data["percent"], e.Data["voltage"])
+	case eventTargetUp:
+		return fmt.Sprintf("Target %v is up (%v)", e.Data["target"], e.Data["detail"])
+	case eventTargetDown:
+		return fmt.Sprintf("Target %v is down", e.Data["target"])
+	case eventTargetFlapping:
+		return fmt.Sprintf("Target %v changed power state %v times within %v, suppressing up/down notifications until it settles", e.Data["target"], e.Data["changes"], e.Data["window"])
+	case eventTargetPowerOff:
+		return fmt.Sprintf("Target %v is going to %v (%v)", e.Data["target"], e.Data["action"], e.Data["reason"])
+	case eventHALeader:
+		return fmt.Sprintf("Replica %v is now the HA leader", e.Data["replica"])
+	case eventQueueBackpressure:
+		if e.DeviceID != "" {
+			return fmt.Sprintf("Queue for relay %s is full (%v/%v), rejecting wake requests", e.DeviceID, e.Data["depth"], e.Data["limit"])
+		}
+		return fmt.Sprintf("Too many pending wake requests (%v/%v), rejecting new ones", e.Data["depth"], e.Data["limit"])
+	case eventQueuePurged:
+		return fmt.Sprintf("%v queued messages for relay %s were purged by %v", e.Data["purged"], e.DeviceID, e.Data["by"])
+	case eventDeviceIdentityMismatch:
+		if e.Data["rejected"] == true {
+			return fmt.Sprintf("Rejected a request for relay %s from %v: identity %v:%v does not match the bound %v:%v", e.DeviceID, e.Data["remote_addr"], e.Data["kind"], e.Data["value"], e.Data["bound_kind"], e.Data["bound_value"])
+		}
+		return fmt.Sprintf("Request for relay %s from %v used identity %v:%v instead of the bound %v:%v", e.DeviceID, e.Data["remote_addr"], e.Data["kind"], e.Data["value"], e.Data["bound_kind"], e.Data["bound_value"])
+	case eventMaintenance:
+		if e.Data["enabled"] == true {
+			if reason, _ := e.Data["reason"].(string); reason != "" {
+				return fmt.Sprintf("Maintenance mode enabled by %v, wake requests are paused: %s", e.Data["by"], reason)
+			}
+			return fmt.Sprintf("Maintenance mode enabled by %v, wake requests are paused", e.Data["by"])
+		}
+		return fmt.Sprintf("Maintenance mode disabled by %v, wake requests are accepted again", e.Data["by"])
+	case eventAuthFailureBurst:
+		if country, ok := e.Data["country"].(string); ok {
+			return fmt.Sprintf("%v failed authentication attempts from %v (%s, AS%v) within %v", e.Data["count"], e.Data["client_ip"], country, e.Data["asn"], e.Data["window"])
+		}
+		return fmt.Sprintf("%v failed authentication attempts from %v within %v", e.Data["count"], e.Data["client_ip"], e.Data["window"])
+	default:
+		return e.Type
+	}
+}
+
+// 管理命令的名称，用于事件描述
+var commandNames = map[string]string{
+	messageTypeReboot:   "Reboot",
+	messageTypeWiFiScan: "WiFi scan",
+}
+
+// 管理命令的事件描述
+func commandSummary(kind string, e Event) string {
+	name := commandNames[kind]
+	if name == "" {
+		name = kind
+	}
+	switch e.Type {
+	case eventMessageQueued:
+		return fmt.Sprintf("%s requested for relay %s", name, e.DeviceID)
+	case eventMessageDelivered:
+		return fmt.Sprintf("%s command delivered to relay %s", name, e.DeviceID)
+	case eventMessageAcked:
+		if kind == messageTypeReboot {
+			return fmt.Sprintf("Relay %s is rebooting", e.DeviceID)
+		}
+		return fmt.Sprintf("%s completed on relay %s", name, e.DeviceID)
+	case eventMessageFailed:
+		return fmt.Sprintf("%s failed on relay %s: %v", name, e.DeviceID, e.Data["error"])
+	case eventMessageCancelled:
+		return fmt.Sprintf("%s for relay %s cancelled", name, e.DeviceID)
+	default:
+		return e.Type
+	}
+}
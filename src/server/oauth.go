@@ -0,0 +1,363 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 账号关联用的 OAuth 2.0 授权服务器（授权码模式），供 Google Home 等智能家居平台使用。
+// 用户在授权页面输入API密钥完成授权；每次授权生成一个可撤销的授权记录（grant），
+// 访问令牌和刷新令牌都是绑定 grant 的签名字符串，无需单独保存
+
+// OAuth 客户端配置（-oauth-client-id、-oauth-client-secret），未设置时 OAuth 接口不可用
+var (
+	oauthClientID     string
+	oauthClientSecret string
+	oauthRedirectURIs []string // 允许的回调地址前缀
+)
+
+// 默认允许的回调地址：Google Home 和 Alexa 账号关联
+const defaultOAuthRedirectURIs = "https://oauth-redirect.googleusercontent.com/r/,https://oauth-redirect-sandbox.googleusercontent.com/r/," +
+	"https://pitangui.amazon.com/api/skill/link/,https://layla.amazon.com/api/skill/link/,https://alexa.amazon.co.jp/api/skill/link/"
+
+const (
+	oauthCodeTTL   = 5 * time.Minute
+	oauthAccessTTL = time.Hour
+)
+
+// 一次账号关联授权
+type OAuthGrant struct {
+	ID        string    `json:"id"`
+	ClientID  string    `json:"client_id"`
+	CreatedAt time.Time `json:"created_at"`
+	LastUsed  time.Time `json:"last_used"`
+}
+
+// 尚未换取令牌的授权码，只保存在内存中
+type oauthCode struct {
+	clientID    string
+	redirectURI string
+	expires     time.Time
+}
+
+var (
+	oauthCodesMu sync.Mutex
+	oauthCodes   = map[string]oauthCode{}
+)
+
+var errInvalidToken = errors.New("invalid or expired access token")
+
+func oauthSigningKey() []byte {
+	mac := hmac.New(sha256.New, []byte(API_KEY))
+	mac.Write([]byte("esp32-wol oauth"))
+	return mac.Sum(nil)
+}
+
+func signOAuth(parts ...string) string {
+	mac := hmac.New(sha256.New, oauthSigningKey())
+	mac.Write([]byte(strings.Join(parts, "\n")))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// 访问令牌：at.<grant>.<过期时间>.<签名>
+func newAccessToken(grantID string) string {
+	exp := strconv.FormatInt(time.Now().Add(oauthAccessTTL).Unix(), 10)
+	return "at." + grantID + "." + exp + "." + signOAuth("at", grantID, exp)
+}
+
+// 刷新令牌：rt.<grant>.<签名>，撤销 grant 后失效
+func newRefreshToken(grantID string) string {
+	return "rt." + grantID + "." + signOAuth("rt", grantID)
+}
+
+// 校验令牌签名，返回 grant ID
+func parseOAuthToken(token, kind string) (string, error) {
+	parts := strings.Split(token, ".")
+	switch {
+	case kind == "at" && len(parts) == 4 && parts[0] == "at":
+		exp, err := strconv.ParseInt(parts[2], 10, 64)
+		if err != nil || time.Now().Unix() > exp ||
+			!hmac.Equal([]byte(parts[3]), []byte(signOAuth("at", parts[1], parts[2]))) {
+			return "", errInvalidToken
+		}
+		return parts[1], nil
+	case kind == "rt" && len(parts) == 3 && parts[0] == "rt":
+		if !hmac.Equal([]byte(parts[2]), []byte(signOAuth("rt", parts[1]))) {
+			return "", errInvalidToken
+		}
+		return parts[1], nil
+	}
+	return "", errInvalidToken
+}
+
+// 校验请求的 Bearer 访问令牌，返回对应的 grant ID
+func bearerGrant(r *http.Request) (string, error) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return "", errInvalidToken
+	}
+	grantID, err := parseOAuthToken(strings.TrimSpace(token), "at")
+	if err != nil {
+		return "", err
+	}
+	storage.mu.Lock()
+	grant, exists := storage.oauthGrants[grantID]
+	if exists {
+		grant.LastUsed = time.Now()
+	}
+	storage.mu.Unlock()
+	if !exists {
+		return "", errInvalidToken
+	}
+	markDirty()
+	return grantID, nil
+}
+
+func oauthRedirectAllowed(uri string) bool {
+	for _, prefix := range oauthRedirectURIs {
+		if strings.HasPrefix(uri, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+var authorizePage = template.Must(template.New("authorize").Parse(`<!DOCTYPE html>
+<html lang="zh-CN">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex">
+<title>授权访问 ESP32 WOL</title>
+</head>
+<body style="font-family: system-ui, sans-serif; max-width: 24rem; margin: 0 auto; padding: 3rem 1rem;">
+<h1>授权访问</h1>
+<p>{{.Host}} 请求控制你的唤醒目标。输入服务器的API密钥以完成授权。</p>
+{{if .Error}}<p style="color: #b00;">{{.Error}}</p>{{end}}
+<form method="post">
+<input type="hidden" name="response_type" value="code">
+<input type="hidden" name="client_id" value="{{.ClientID}}">
+<input type="hidden" name="redirect_uri" value="{{.RedirectURI}}">
+<input type="hidden" name="state" value="{{.State}}">
+<p><input type="password" name="api_key" placeholder="API密钥" autocomplete="current-password" required autofocus style="width: 100%;"></p>
+<p><button type="submit">授权</button></p>
+</form>
+</body>
+</html>
+`))
+
+// 授权页面：GET 显示表单，POST 校验API密钥后带授权码跳转回平台
+func oauthAuthorizeHandler(w http.ResponseWriter, r *http.Request) {
+	if oauthClientID == "" {
+		http.Error(w, "OAuth is not configured", http.StatusNotFound)
+		return
+	}
+	r.ParseForm()
+	clientID, redirectURI, state := r.Form.Get("client_id"), r.Form.Get("redirect_uri"), r.Form.Get("state")
+	if r.Form.Get("response_type") != "code" || clientID != oauthClientID || !oauthRedirectAllowed(redirectURI) {
+		requestLogger(r).Warn("invalid oauth authorize request", "client_id", clientID, "redirect_uri", redirectURI)
+		http.Error(w, "invalid authorization request", http.StatusBadRequest)
+		return
+	}
+
+	page := map[string]string{"ClientID": clientID, "RedirectURI": redirectURI, "State": state}
+	if u, err := url.Parse(redirectURI); err == nil {
+		page["Host"] = u.Host
+	}
+	render := func(status int) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Referrer-Policy", "no-referrer")
+		w.Header().Set("X-Frame-Options", "DENY")
+		w.WriteHeader(status)
+		authorizePage.Execute(w, page)
+	}
+	if r.Method == http.MethodGet {
+		render(http.StatusOK)
+		return
+	}
+
+	// 只读密钥不能授权语音助手唤醒
+	if _, readOnly, ok := lookupServerKey(r.PostForm.Get("api_key")); !ok || readOnly {
+		ip := clientIP(r)
+		requestLogger(r).Warn("oauth authorization failed", "client_ip", ip)
+		authFailures.record(ip, r.Method, r.URL.Path, authReasonOAuthKey)
+		page["Error"] = "API密钥不正确"
+		render(http.StatusUnauthorized)
+		return
+	}
+
+	code := randomHex(32)
+	oauthCodesMu.Lock()
+	for c, pending := range oauthCodes {
+		if time.Now().After(pending.expires) {
+			delete(oauthCodes, c)
+		}
+	}
+	oauthCodes[code] = oauthCode{clientID: clientID, redirectURI: redirectURI, expires: time.Now().Add(oauthCodeTTL)}
+	oauthCodesMu.Unlock()
+
+	q := url.Values{}
+	q.Set("code", code)
+	if state != "" {
+		q.Set("state", state)
+	}
+	sep := "?"
+	if strings.Contains(redirectURI, "?") {
+		sep = "&"
+	}
+	requestLogger(r).Info("oauth authorization granted", "client_id", clientID)
+	http.Redirect(w, r, redirectURI+sep+q.Encode(), http.StatusFound)
+}
+
+// 令牌接口：授权码换取令牌（authorization_code）或刷新访问令牌（refresh_token）
+func oauthTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if oauthClientID == "" {
+		http.Error(w, "OAuth is not configured", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	tokenError := func(status int, code string) {
+		writeJSON(w, status, map[string]string{"error": code})
+	}
+
+	r.ParseForm()
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok {
+		clientID, clientSecret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	if clientID != oauthClientID || subtle.ConstantTimeCompare([]byte(clientSecret), []byte(oauthClientSecret)) != 1 {
+		requestLogger(r).Warn("oauth client authentication failed", "client_id", clientID, "client_ip", clientIP(r))
+		authFailures.record(clientIP(r), r.Method, r.URL.Path, authReasonOAuth)
+		tokenError(http.StatusUnauthorized, "invalid_client")
+		return
+	}
+
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		code := r.PostForm.Get("code")
+		oauthCodesMu.Lock()
+		pending, exists := oauthCodes[code]
+		delete(oauthCodes, code) // 授权码只能使用一次
+		oauthCodesMu.Unlock()
+		if !exists || time.Now().After(pending.expires) || pending.clientID != clientID ||
+			(r.PostForm.Has("redirect_uri") && r.PostForm.Get("redirect_uri") != pending.redirectURI) {
+			tokenError(http.StatusBadRequest, "invalid_grant")
+			return
+		}
+
+		grant := &OAuthGrant{ID: "grt_" + randomHex(8), ClientID: clientID, CreatedAt: time.Now()}
+		storage.mu.Lock()
+		storage.oauthGrants[grant.ID] = grant
+		storage.mu.Unlock()
+		markDirty()
+		requestLogger(r).Info("oauth grant created", "grant_id", grant.ID, "client_id", clientID)
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"token_type":    "Bearer",
+			"access_token":  newAccessToken(grant.ID),
+			"refresh_token": newRefreshToken(grant.ID),
+			"expires_in":    int(oauthAccessTTL.Seconds()),
+		})
+
+	case "refresh_token":
+		grantID, err := parseOAuthToken(r.PostForm.Get("refresh_token"), "rt")
+		storage.mu.RLock()
+		_, exists := storage.oauthGrants[grantID]
+		storage.mu.RUnlock()
+		if err != nil || !exists {
+			tokenError(http.StatusBadRequest, "invalid_grant")
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"token_type":   "Bearer",
+			"access_token": newAccessToken(grantID),
+			"expires_in":   int(oauthAccessTTL.Seconds()),
+		})
+
+	default:
+		tokenError(http.StatusBadRequest, "unsupported_grant_type")
+	}
+}
+
+// 撤销授权，之后该授权的访问令牌和刷新令牌都会失效
+func revokeOAuthGrant(grantID string) bool {
+	storage.mu.Lock()
+	_, exists := storage.oauthGrants[grantID]
+	delete(storage.oauthGrants, grantID)
+	storage.mu.Unlock()
+	if exists {
+		markDirty()
+	}
+	return exists
+}
+
+// 授权列表：GET /api/admin/oauth-grants
+func oauthGrantsHandler(w http.ResponseWriter, r *http.Request) {
+	storage.mu.RLock()
+	grants := make([]OAuthGrant, 0, len(storage.oauthGrants))
+	for _, g := range storage.oauthGrants {
+		grants = append(grants, *g)
+	}
+	storage.mu.RUnlock()
+	sort.Slice(grants, func(i, j int) bool { return grants[i].CreatedAt.Before(grants[j].CreatedAt) })
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"grants":  grants,
+		"total":   len(grants),
+	})
+}
+
+// 撤销授权：DELETE /api/admin/oauth-grants/<id>
+func oauthGrantHandler(w http.ResponseWriter, r *http.Request) {
+	id, _ := pathParams(r, "/api/admin/oauth-grants/")
+	if !revokeOAuthGrant(id) {
+		http.Error(w, "Grant not found", http.StatusNotFound)
+		return
+	}
+	requestLogger(r).Info("oauth grant revoked", "grant_id", id)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"success": true, "message": "Grant revoked"})
+}
+
+// 解析逗号分隔的回调地址前缀
+func parseOAuthRedirects(list string) []string {
+	var uris []string
+	for _, uri := range strings.Split(list, ",") {
+		if uri = strings.TrimSpace(uri); uri != "" {
+			uris = append(uris, uri)
+		}
+	}
+	return uris
+}
+
+// 校验 OAuth 参数
+func checkOAuthConfig() error {
+	if (oauthClientID == "") != (oauthClientSecret == "") {
+		return fmt.Errorf("-oauth-client-id and -oauth-client-secret must be set together")
+	}
+	for _, uri := range oauthRedirectURIs {
+		if u, err := url.Parse(uri); err != nil || u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("invalid redirect uri prefix %q", uri)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// 组织：一组用户共用的设备和目标。资源的所有者写作 "org:<name>" 时，组织的所有成员
+// 都可以查看和使用；个人资源仍只有本人可见。组织和成员由管理员管理
+
+type Org struct {
+	Name      string    `json:"name"`
+	Members   []string  `json:"members"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// 管理接口中的组织信息
+type OrgInfo struct {
+	Name      string    `json:"name"`
+	Owner     string    `json:"owner"` // 把资源分配给组织时使用的所有者值
+	Members   []string  `json:"members"`
+	CreatedAt time.Time `json:"created_at"`
+	Devices   int       `json:"devices"`
+	Targets   int       `json:"targets"`
+}
+
+const orgOwnerPrefix = "org:"
+
+func orgOwner(name string) string { return orgOwnerPrefix + name }
+
+// 检查所有者是否存在：空字符串（只归管理员）、用户名或 org:<组织名>。调用方持有 storage.mu
+func checkOwner(owner string) error {
+	if owner == "" {
+		return nil
+	}
+	if name, ok := strings.CutPrefix(owner, orgOwnerPrefix); ok {
+		if _, exists := storage.orgs[name]; !exists {
+			return fmt.Errorf("organization %q not found", name)
+		}
+		return nil
+	}
+	if _, exists := storage.users[owner]; !exists {
+		return fmt.Errorf("user %q not found", owner)
+	}
+	return nil
+}
+
+// 用户所属的组织，调用方持有 storage.mu
+func userOrgs(user string) []string {
+	var orgs []string
+	for _, o := range storage.orgs {
+		if slices.Contains(o.Members, user) {
+			orgs = append(orgs, o.Name)
+		}
+	}
+	return orgs
+}
+
+func orgInfo(o *Org) OrgInfo {
+	devices, targets := ownedResources(orgOwner(o.Name))
+	return OrgInfo{
+		Name:      o.Name,
+		Owner:     orgOwner(o.Name),
+		Members:   append([]string{}, o.Members...),
+		CreatedAt: o.CreatedAt,
+		Devices:   devices,
+		Targets:   targets,
+	}
+}
+
+// 组织列表和创建：GET/POST /api/admin/orgs。用户只能看到自己所属的组织
+func orgsHandler(w http.ResponseWriter, r *http.Request) {
+	p := requestPrincipal(r)
+	switch r.Method {
+	case http.MethodGet:
+		storage.mu.RLock()
+		orgs := make([]OrgInfo, 0, len(storage.orgs))
+		for _, o := range storage.orgs {
+			if p.admin() || slices.Contains(p.orgs, o.Name) {
+				orgs = append(orgs, orgInfo(o))
+			}
+		}
+		storage.mu.RUnlock()
+		sort.Slice(orgs, func(i, j int) bool { return orgs[i].Name < orgs[j].Name })
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"success": true,
+			"orgs":    orgs,
+			"total":   len(orgs),
+		})
+
+	case http.MethodPost:
+		if !p.admin() {
+			http.Error(w, "Forbidden: this action requires the server API key", http.StatusForbidden)
+			return
+		}
+		var req struct {
+			Name    string   `json:"name"`
+			Members []string `json:"members"`
+		}
+		if !readJSON(w, r, &req) {
+			return
+		}
+		if !namePattern.MatchString(req.Name) {
+			http.Error(w, "name must be 1-64 letters, digits, '.', '_' or '-'", http.StatusBadRequest)
+			return
+		}
+		org := &Org{Name: req.Name, Members: []string{}, CreatedAt: time.Now()}
+
+		storage.mu.Lock()
+		if _, exists := storage.orgs[org.Name]; exists {
+			storage.mu.Unlock()
+			http.Error(w, "Organization already exists", http.StatusConflict)
+			return
+		}
+		for _, member := range req.Members {
+			if _, exists := storage.users[member]; !exists {
+				storage.mu.Unlock()
+				http.Error(w, fmt.Sprintf("user %q not found", member), http.StatusBadRequest)
+				return
+			}
+			if !slices.Contains(org.Members, member) {
+				org.Members = append(org.Members, member)
+			}
+		}
+		sort.Strings(org.Members)
+		storage.orgs[org.Name] = org
+		info := orgInfo(org)
+		storage.mu.Unlock()
+
+		markDirty()
+		requestLogger(r).Info("organization created", "org", org.Name, "members", len(org.Members))
+		writeJSON(w, http.StatusCreated, map[string]interface{}{
+			"success": true,
+			"message": "Organization created",
+			"org":     info,
+		})
+
+	default:
+		methodNotAllowed(w, r)
+	}
+}
+
+// 单个组织：GET/DELETE /api/admin/orgs/<name>，
+// PUT/DELETE /api/admin/orgs/<name>/members/<user> 添加、移除成员
+func orgHandler(w http.ResponseWriter, r *http.Request) {
+	name, action := pathParams(r, "/api/admin/orgs/")
+	p := requestPrincipal(r)
+	storage.mu.RLock()
+	_, exists := storage.orgs[name]
+	storage.mu.RUnlock()
+	// 不属于该组织的用户看不到它
+	if !exists || !(p.admin() || slices.Contains(p.orgs, name)) {
+		http.Error(w, "Organization not found", http.StatusNotFound)
+		return
+	}
+	member, isMember := strings.CutPrefix(action, "members/")
+
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		storage.mu.RLock()
+		var info OrgInfo
+		if o, ok := storage.orgs[name]; ok {
+			info = orgInfo(o)
+		}
+		storage.mu.RUnlock()
+		writeJSON(w, http.StatusOK, map[string]interface{}{"success": true, "org": info})
+
+	case action == "" && r.Method == http.MethodDelete:
+		if !p.admin() {
+			http.Error(w, "Forbidden: this action requires the server API key", http.StatusForbidden)
+			return
+		}
+		storage.mu.Lock()
+		if devices, targets := ownedResources(orgOwner(name)); devices+targets > 0 {
+			storage.mu.Unlock()
+			http.Error(w, fmt.Sprintf("Organization still owns %d devices and %d targets", devices, targets), http.StatusConflict)
+			return
+		}
+		delete(storage.orgs, name)
+		storage.mu.Unlock()
+
+		markDirty()
+		requestLogger(r).Info("organization deleted", "org", name)
+		writeJSON(w, http.StatusOK, map[string]interface{}{"success": true, "message": "Organization deleted"})
+
+	case isMember && member != "" && (r.Method == http.MethodPut || r.Method == http.MethodDelete):
+		if !p.admin() {
+			http.Error(w, "Forbidden: this action requires the server API key", http.StatusForbidden)
+			return
+		}
+		storage.mu.Lock()
+		org, ok := storage.orgs[name]
+		if !ok {
+			storage.mu.Unlock()
+			http.Error(w, "Organization not found", http.StatusNotFound)
+			return
+		}
+		msg := "Member added"
+		if r.Method == http.MethodPut {
+			if _, found := storage.users[member]; !found {
+				storage.mu.Unlock()
+				http.Error(w, fmt.Sprintf("user %q not found", member), http.StatusBadRequest)
+				return
+			}
+			if !slices.Contains(org.Members, member) {
+				org.Members = append(org.Members, member)
+				sort.Strings(org.Members)
+			}
+		} else {
+			i := slices.Index(org.Members, member)
+			if i < 0 {
+				storage.mu.Unlock()
+				http.Error(w, "Member not found", http.StatusNotFound)
+				return
+			}
+			org.Members = slices.Delete(org.Members, i, i+1)
+			msg = "Member removed"
+		}
+		info := orgInfo(org)
+		storage.mu.Unlock()
+
+		markDirty()
+		requestLogger(r).Info(strings.ToLower(msg), "org", name, "user", member)
+		writeJSON(w, http.StatusOK, map[string]interface{}{"success": true, "message": msg, "org": info})
+
+	case action == "" || isMember:
+		methodNotAllowed(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
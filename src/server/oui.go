@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// MAC地址的厂商查询：按前3字节（OUI）查找网卡厂商，用于在发现的主机中区分电脑、NAS、虚拟机和IoT设备。
+// 内置一张常见厂商的小表；-oui-file 指定 IEEE 注册表（oui.txt 或 oui.csv）或 Wireshark 的 manuf 文件后
+// 使用完整的数据。本地管理的地址（第一个字节的第2位为1，例如手机的随机MAC地址）没有厂商
+
+var ouiFile string // -oui-file
+
+// 常见的电脑网卡、主板、NAS、虚拟化和开发板厂商
+var builtinOUIs = map[string]string{
+	"00000C": "Cisco Systems",
+	"00E04C": "Realtek Semiconductor",
+	"001B21": "Intel Corporate",
+	"001E67": "Intel Corporate",
+	"6805CA": "Intel Corporate",
+	"A0369F": "Intel Corporate",
+	"001422": "Dell",
+	"B8AC6F": "Dell",
+	"F8BC12": "Dell",
+	"001A92": "ASUSTek Computer",
+	"2C56DC": "ASUSTek Computer",
+	"AC220B": "ASUSTek Computer",
+	"00241D": "Giga-Byte Technology",
+	"1C1B0D": "Giga-Byte Technology",
+	"74D435": "Giga-Byte Technology",
+	"B42E99": "Giga-Byte Technology",
+	"4CCC6A": "Micro-Star International",
+	"D8CB8A": "Micro-Star International",
+	"001CB3": "Apple",
+	"ACBC32": "Apple",
+	"001132": "Synology",
+	"005056": "VMware",
+	"000C29": "VMware",
+	"00155D": "Microsoft Hyper-V",
+	"080027": "Oracle VirtualBox",
+	"B827EB": "Raspberry Pi Foundation",
+	"DCA632": "Raspberry Pi Trading",
+	"E45F01": "Raspberry Pi Trading",
+	"D83ADD": "Raspberry Pi Trading",
+	"2CCF67": "Raspberry Pi Trading",
+	"18FE34": "Espressif",
+	"5CCF7F": "Espressif",
+	"240AC4": "Espressif",
+	"30AEA4": "Espressif",
+	"246F28": "Espressif",
+	"A4CF12": "Espressif",
+}
+
+// OUI（6位大写十六进制）-> 厂商
+var ouiVendors = builtinOUIs
+
+// 载入 -oui-file，与内置表合并
+func loadOUIFile() error {
+	if ouiFile == "" {
+		return nil
+	}
+	vendors, err := readOUIFile(ouiFile)
+	if err != nil {
+		return err
+	}
+	for prefix, vendor := range builtinOUIs {
+		if _, ok := vendors[prefix]; !ok {
+			vendors[prefix] = vendor
+		}
+	}
+	ouiVendors = vendors
+	return nil
+}
+
+// 逐行识别三种格式：
+//
+//	oui.txt:  00-00-0C   (hex)		Cisco Systems, Inc
+//	oui.csv:  MA-L,00000C,"Cisco Systems, Inc",...
+//	manuf:    00:00:0C	Cisco	Cisco Systems, Inc
+//
+// 比 /24 更长的前缀（MA-M、MA-S）忽略
+func readOUIFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	vendors := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		var prefix, vendor string
+		switch {
+		case strings.Contains(text, "(hex)"):
+			prefix, vendor, _ = strings.Cut(text, "(hex)")
+		case strings.HasPrefix(text, "MA-L,"):
+			record, err := csv.NewReader(strings.NewReader(text)).Read()
+			if err != nil || len(record) < 3 {
+				return nil, fmt.Errorf("%s:%d: invalid CSV record", path, line)
+			}
+			prefix, vendor = record[1], record[2]
+		case strings.Contains(text, "\t"):
+			fields := strings.Split(text, "\t")
+			prefix, vendor = fields[0], fields[len(fields)-1]
+		default:
+			continue
+		}
+		if prefix = ouiPrefix(prefix); prefix != "" && strings.TrimSpace(vendor) != "" {
+			vendors[prefix] = strings.TrimSpace(vendor)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(vendors) == 0 {
+		return nil, errors.New(path + ": no OUI entries found")
+	}
+	return vendors, nil
+}
+
+// 去掉分隔符后为6位十六进制时返回大写形式，否则返回空
+func ouiPrefix(s string) string {
+	s = strings.NewReplacer("-", "", ":", "", ".", "").Replace(strings.TrimSpace(s))
+	if len(s) != 6 {
+		return ""
+	}
+	if _, err := strconv.ParseUint(s, 16, 32); err != nil {
+		return ""
+	}
+	return strings.ToUpper(s)
+}
+
+// 规范化的MAC地址（aa:bb:cc:dd:ee:ff）对应的厂商，查不到或为本地管理的地址时返回空
+func macVendor(mac string) string {
+	prefix := ouiPrefix(mac[:min(len(mac), 8)])
+	if prefix == "" {
+		return ""
+	}
+	if first, _ := strconv.ParseUint(prefix[:2], 16, 8); first&0x02 != 0 {
+		return ""
+	}
+	return ouiVendors[prefix]
+}
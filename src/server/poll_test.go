@@ -0,0 +1,128 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// 轮询路径的基准测试，用 go test -run ^$ -bench . -benchmem 查看每次操作的内存分配。
+// 空轮询是绝大多数请求，空队列的 takePending 应当不分配内存
+
+const benchDeviceID = "AA:BB:CC:DD:EE:01"
+
+// 每个基准测试使用独立的存储和队列，结束后恢复
+func setupPollBench(b *testing.B) {
+	b.Helper()
+	oldStorage, oldQueues, oldAckTimeout, oldLogger := storage, queues, ackTimeout, slog.Default()
+	b.Cleanup(func() {
+		storage, queues, ackTimeout = oldStorage, oldQueues, oldAckTimeout
+		slog.SetDefault(oldLogger)
+	})
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	storage = NewSimpleStorage()
+	queues = newQueueRegistry()
+	// 下发即删除，处理中列表不随迭代增长
+	ackTimeout = 0
+	storage.devices[benchDeviceID] = &Device{ID: benchDeviceID, Name: "bench", MacAddress: benchDeviceID, Online: true, Approved: true, LastSeen: time.Now()}
+}
+
+func benchMessage() *WOLMessage {
+	return &WOLMessage{ID: "msg_bench", DeviceID: benchDeviceID, TargetMAC: "AA:BB:CC:DD:EE:FF", Status: messageQueued, CreatedAt: time.Now()}
+}
+
+// 只保留响应头、丢弃响应体的 ResponseWriter，避免 httptest.ResponseRecorder 的缓冲区计入分配
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func (w *discardResponseWriter) Header() http.Header         { return w.header }
+func (w *discardResponseWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (w *discardResponseWriter) WriteHeader(int)             {}
+
+func BenchmarkTakePendingEmpty(b *testing.B) {
+	setupPollBench(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		takePending(benchDeviceID, pollFilter{})
+	}
+}
+
+func BenchmarkTakePending(b *testing.B) {
+	setupPollBench(b)
+	msg := benchMessage()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		queues.push(benchDeviceID, msg)
+		takePending(benchDeviceID, pollFilter{})
+	}
+}
+
+func BenchmarkQueueLease(b *testing.B) {
+	setupPollBench(b)
+	msg := benchMessage()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		queues.push(benchDeviceID, msg)
+		queues.lease(benchDeviceID, pollFilter{})
+	}
+}
+
+func BenchmarkQueueLeaseFiltered(b *testing.B) {
+	setupPollBench(b)
+	command := benchMessage()
+	command.Type = "device_reboot"
+	queues.push(benchDeviceID, command)
+	msg := benchMessage()
+	filter := pollFilter{max: 1, types: map[string]bool{"wake": true}}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		queues.push(benchDeviceID, msg)
+		queues.lease(benchDeviceID, filter)
+	}
+}
+
+func BenchmarkWritePollResponseEmpty(b *testing.B) {
+	w := &discardResponseWriter{header: make(http.Header)}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		writePollResponse(w, nil, 0)
+	}
+}
+
+func BenchmarkWritePollResponse(b *testing.B) {
+	w := &discardResponseWriter{header: make(http.Header)}
+	messages := []WOLMessage{*benchMessage()}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		writePollResponse(w, messages, 0)
+	}
+}
+
+// 空的长轮询：队列为空，开始等待后服务器关闭，直接返回空结果。
+// 覆盖参数解析、设备更新、长轮询登记、计时器和空响应
+func BenchmarkPollEmptyLongPoll(b *testing.B) {
+	setupPollBench(b)
+	oldShutdown := shutdownCh
+	closed := make(chan struct{})
+	close(closed)
+	shutdownCh = closed
+	b.Cleanup(func() { shutdownCh = oldShutdown })
+
+	r := httptest.NewRequest(http.MethodGet, "/api/wol/poll?device_id="+benchDeviceID, nil)
+	w := &discardResponseWriter{header: make(http.Header)}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pollWOLHandler(w, r)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// 中继供电状态：电池供电的中继（例如放在车库、仓库）在注册和轮询时上报供电方式、电池电压和电量，
+// 电量或电压低于阈值时发布告警，便于在电池耗尽前处理
+
+const (
+	powerUSB     = "usb"
+	powerBattery = "battery"
+)
+
+// 低电量告警阈值，0 表示关闭
+var (
+	alertBatteryPercent = 20
+	alertBatteryVoltage = 0.0
+)
+
+// 告警后回升超过阈值这么多才重新计算，避免电量在阈值附近波动时反复告警
+const (
+	batteryPercentHysteresis = 5
+	batteryVoltageHysteresis = 0.1
+)
+
+// 供电状态。设备上的记录不会被原地修改，每次上报替换为新的值，复制设备时可以共享
+type PowerStatus struct {
+	Source    string    `json:"source"`            // usb 或 battery
+	Voltage   float64   `json:"voltage,omitempty"` // 电池电压（V），未知时为0
+	Percent   int       `json:"percent,omitempty"` // 电池电量（%），未知时为0
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (s *PowerStatus) validate() error {
+	if s.Source != powerUSB && s.Source != powerBattery {
+		return fmt.Errorf("power source must be %q or %q", powerUSB, powerBattery)
+	}
+	if s.Voltage < 0 || s.Voltage > 30 {
+		return fmt.Errorf("battery voltage %v out of range", s.Voltage)
+	}
+	if s.Percent < 0 || s.Percent > 100 {
+		return fmt.Errorf("battery percent %d out of range", s.Percent)
+	}
+	return nil
+}
+
+// 从轮询参数 power_source、battery_voltage、battery_percent 解析供电状态，未上报时返回 nil
+func parsePowerQuery(query url.Values) (*PowerStatus, error) {
+	source := query.Get("power_source")
+	if source == "" {
+		return nil, nil
+	}
+	status := &PowerStatus{Source: source}
+	if v := query.Get("battery_voltage"); v != "" {
+		voltage, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid battery_voltage %q", v)
+		}
+		status.Voltage = voltage
+	}
+	if v := query.Get("battery_percent"); v != "" {
+		percent, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid battery_percent %q", v)
+		}
+		status.Percent = percent
+	}
+	if err := status.validate(); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// 低于告警阈值
+func (s *PowerStatus) low() bool {
+	if s.Source != powerBattery {
+		return false
+	}
+	return (alertBatteryPercent > 0 && s.Percent > 0 && s.Percent <= alertBatteryPercent) ||
+		(alertBatteryVoltage > 0 && s.Voltage > 0 && s.Voltage <= alertBatteryVoltage)
+}
+
+// 已回升到阈值以上（含回差）或改用USB供电
+func (s *PowerStatus) recovered() bool {
+	if s.Source != powerBattery {
+		return true
+	}
+	if alertBatteryPercent > 0 && s.Percent > 0 && s.Percent <= alertBatteryPercent+batteryPercentHysteresis {
+		return false
+	}
+	if alertBatteryVoltage > 0 && s.Voltage > 0 && s.Voltage <= alertBatteryVoltage+batteryVoltageHysteresis {
+		return false
+	}
+	return true
+}
+
+// 记录设备上报的供电状态，供电方式变化或电量过低时发布事件。调用方需持有 storage.mu
+func updateDevicePower(device *Device, status *PowerStatus) {
+	status.UpdatedAt = time.Now()
+	previous := device.Power
+	device.Power = status
+
+	if previous != nil && previous.Source != status.Source {
+		slog.Info("device power source changed", "device_id", device.ID, "from", previous.Source, "to", status.Source)
+		events.publish(Event{Type: eventDevicePowerChanged, DeviceID: device.ID, Data: map[string]any{
+			"source":   status.Source,
+			"previous": previous.Source,
+			"percent":  status.Percent,
+			"voltage":  status.Voltage,
+		}})
+	}
+	switch {
+	case status.low() && !device.batteryAlerted:
+		device.batteryAlerted = true
+		slog.Warn("relay battery low", "device_id", device.ID, "percent", status.Percent, "voltage", status.Voltage)
+		events.publish(Event{Type: eventAlertLowBattery, DeviceID: device.ID, Data: map[string]any{
+			"percent": status.Percent,
+			"voltage": status.Voltage,
+		}})
+	case device.batteryAlerted && status.recovered():
+		device.batteryAlerted = false
+	}
+}
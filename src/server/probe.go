@@ -0,0 +1,493 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os/exec"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// 目标开机状态检测：服务器定期检测配置了 probe 的目标，记录开机/关机状态，
+// 用于 only_if_down 唤醒和“哪些机器开着”的状态查询。
+//
+// 抖动抑制：开机和关机之间的变化需要连续 -probe-confirm 次相同的结果才生效，待确认期间按唤醒时的间隔加快检测；
+// 短时间内状态反复变化的目标标记为 flapping，期间不再发布 target.up / target.down，稳定后发布最终状态
+
+// 目标的检测方式
+type TargetProbe struct {
+	Method    string `json:"method"`              // tcp、icmp、arping 或 snmp
+	Host      string `json:"host"`                // 目标主机名或IP
+	Port      int    `json:"port,omitempty"`      // tcp 检测的端口，例如 22 或 3389
+	Community string `json:"community,omitempty"` // snmp 团体名，默认 public
+}
+
+// 开机状态
+const (
+	powerOn      = "on"
+	powerOff     = "off"
+	powerUnknown = "unknown" // 未配置检测或尚未检测
+)
+
+// 目标的最近一次检测结果
+type TargetPower struct {
+	Target    string    `json:"target"`
+	State     string    `json:"state"`
+	Method    string    `json:"method,omitempty"`
+	Detail    string    `json:"detail,omitempty"`
+	LatencyMS float64   `json:"latency_ms,omitempty"`
+	CheckedAt time.Time `json:"checked_at,omitempty"`
+	ChangedAt time.Time `json:"changed_at,omitempty"`
+	// 最近的检测结果与 State 不同、尚未确认时为该结果，Confirmations 为连续出现的次数，
+	// PendingSince 为第一次出现的检测开始时间
+	Pending       string      `json:"pending,omitempty"`
+	Confirmations int         `json:"confirmations,omitempty"`
+	PendingSince  *time.Time  `json:"pending_since,omitempty"`
+	Flapping      bool        `json:"flapping,omitempty"`
+	changes       []time.Time // flapWindow 内的状态变化时间
+}
+
+var (
+	probeInterval = 60 * time.Second // -probe-interval
+	probeTimeout  = 2 * time.Second  // -probe-timeout
+	probeConfirm  = 2                // -probe-confirm
+)
+
+// flapWindow 内状态变化达到 flapChanges 次即为 flapping，窗口内不再变化后恢复
+const (
+	flapWindow  = 10 * time.Minute
+	flapChanges = 4
+)
+
+// 唤醒进行中的目标按该间隔检测，尽快确认开机
+const probeWakeInterval = 5 * time.Second
+
+// 同时进行的检测数量上限
+const maxConcurrentProbes = 16
+
+// 检测结果，独立于 storage.mu，避免检测耗时影响其他请求
+var powerStates = struct {
+	sync.RWMutex
+	m       map[string]*TargetPower
+	running map[string]bool
+}{m: make(map[string]*TargetPower), running: make(map[string]bool)}
+
+func checkProbeSettings() error {
+	switch {
+	case probeInterval < time.Second:
+		return fmt.Errorf("-probe-interval must be at least 1s")
+	case probeTimeout <= 0:
+		return fmt.Errorf("-probe-timeout must be positive")
+	case probeConfirm < 1:
+		return fmt.Errorf("-probe-confirm must be at least 1")
+	}
+	return nil
+}
+
+func validateProbe(p *TargetProbe) error {
+	if p == nil {
+		return nil
+	}
+	if p.Host == "" {
+		return fmt.Errorf("probe.host is required")
+	}
+	switch p.Method {
+	case "tcp":
+		if p.Port < 1 || p.Port > 65535 {
+			return fmt.Errorf("probe.port must be 1-65535 for tcp probes")
+		}
+	case "icmp", "arping", "snmp":
+		if p.Port != 0 && p.Method != "snmp" {
+			return fmt.Errorf("probe.port is only used by tcp and snmp probes")
+		}
+	default:
+		return fmt.Errorf("probe.method must be tcp, icmp, arping or snmp")
+	}
+	return nil
+}
+
+// 目标当前的开机状态；未配置检测或尚未检测时为 unknown
+func targetPower(name string) string {
+	powerStates.RLock()
+	defer powerStates.RUnlock()
+	if p, exists := powerStates.m[name]; exists {
+		return p.State
+	}
+	return powerUnknown
+}
+
+// 执行一次检测，返回目标是否开机
+func runProbe(ctx context.Context, p TargetProbe) (bool, string, error) {
+	switch p.Method {
+	case "tcp":
+		return probeTCP(ctx, p)
+	case "icmp":
+		return probeCommand(ctx, pingCommand(p.Host))
+	case "arping":
+		return probeCommand(ctx, []string{"arping", "-c", "1", "-w", strconv.Itoa(int(max(probeTimeout/time.Second, 1))), p.Host})
+	case "snmp":
+		return probeSNMP(ctx, p)
+	}
+	return false, "", fmt.Errorf("unknown probe method %q", p.Method)
+}
+
+// TCP 检测：连接成功或被拒绝（对方回复了 RST）都说明主机在线
+func probeTCP(ctx context.Context, p TargetProbe) (bool, string, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, ipNetwork("tcp"), net.JoinHostPort(p.Host, strconv.Itoa(p.Port)))
+	if err == nil {
+		conn.Close()
+		return true, fmt.Sprintf("port %d open", p.Port), nil
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return true, fmt.Sprintf("port %d closed", p.Port), nil
+	}
+	return false, "", err
+}
+
+// 使用系统 ping 命令，无需服务器拥有原始套接字权限
+func pingCommand(host string) []string {
+	secs := strconv.Itoa(int(max(probeTimeout/time.Second, 1)))
+	switch runtime.GOOS {
+	case "windows":
+		return []string{"ping", "-n", "1", "-w", strconv.Itoa(int(probeTimeout / time.Millisecond)), host}
+	case "darwin", "freebsd", "openbsd", "netbsd":
+		return []string{"ping", "-c", "1", "-t", secs, host}
+	default:
+		return []string{"ping", "-c", "1", "-W", secs, host}
+	}
+}
+
+func probeCommand(ctx context.Context, args []string) (bool, string, error) {
+	out, err := exec.CommandContext(ctx, args[0], args[1:]...).CombinedOutput()
+	if errors.Is(err, exec.ErrNotFound) {
+		return false, "", err
+	}
+	// Windows 的 ping 在“无法访问目标主机”时也返回0，以是否收到 TTL 为准
+	if err == nil && (runtime.GOOS != "windows" || bytes.Contains(out, []byte("TTL="))) {
+		return true, args[0] + " reply", nil
+	}
+	return false, "", fmt.Errorf("no %s reply", args[0])
+}
+
+// sysUpTime.0 (1.3.6.1.2.1.1.3.0)
+var snmpSysUpTimeOID = []byte{0x2B, 6, 1, 2, 1, 1, 3, 0}
+
+// SNMP v2c 查询 sysUpTime：收到应答即为开机，同时报告系统运行时间
+func probeSNMP(ctx context.Context, p TargetProbe) (bool, string, error) {
+	port := p.Port
+	if port == 0 {
+		port = 161
+	}
+	community := firstNonEmpty(p.Community, "public")
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, ipNetwork("udp"), net.JoinHostPort(p.Host, strconv.Itoa(port)))
+	if err != nil {
+		return false, "", err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	requestID := time.Now().UnixNano() & 0x7FFFFFFF
+	varbind := berTLV(0x30, berTLV(0x30, append(berTLV(0x06, snmpSysUpTimeOID), 0x05, 0x00)))
+	pdu := berTLV(0xA0, concatBytes(berInt(requestID), berInt(0), berInt(0), varbind)) // GetRequest
+	msg := berTLV(0x30, concatBytes(berInt(1), berTLV(0x04, []byte(community)), pdu))  // version 1 = v2c
+	if _, err := conn.Write(msg); err != nil {
+		return false, "", err
+	}
+
+	buf := make([]byte, 1500)
+	n, err := conn.Read(buf)
+	if err != nil {
+		// 对方回复 ICMP 端口不可达，主机在线但没有运行 SNMP 代理
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			return true, "no SNMP agent", nil
+		}
+		return false, "", err
+	}
+	// 团体名错误时代理不会应答；收到应答后尽量解析 sysUpTime（TimeTicks，单位1/100秒）
+	resp := buf[:n]
+	if i := bytes.Index(resp, berTLV(0x06, snmpSysUpTimeOID)); i >= 0 {
+		v := resp[i+len(snmpSysUpTimeOID)+2:]
+		if len(v) >= 2 && v[0] == 0x43 && int(v[1]) <= 8 && len(v) >= 2+int(v[1]) {
+			var ticks uint64
+			for _, b := range v[2 : 2+int(v[1])] {
+				ticks = ticks<<8 | uint64(b)
+			}
+			return true, "uptime " + (time.Duration(ticks) * 10 * time.Millisecond).Round(time.Second).String(), nil
+		}
+	}
+	return true, "snmp reply", nil
+}
+
+// BER 编码
+func berTLV(tag byte, content []byte) []byte {
+	b := []byte{tag}
+	switch n := len(content); {
+	case n < 0x80:
+		b = append(b, byte(n))
+	case n < 0x100:
+		b = append(b, 0x81, byte(n))
+	default:
+		b = append(b, 0x82, byte(n>>8), byte(n))
+	}
+	return append(b, content...)
+}
+
+func berInt(v int64) []byte {
+	var b []byte
+	for {
+		b = append([]byte{byte(v)}, b...)
+		v >>= 8
+		if v == 0 && b[0] < 0x80 {
+			break
+		}
+	}
+	return berTLV(0x02, b)
+}
+
+func concatBytes(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+// 定期检测：到达 -probe-interval 的目标和唤醒进行中的目标
+func runProber() {
+	ticker := time.NewTicker(min(probeInterval, probeWakeInterval))
+	defer ticker.Stop()
+	sem := make(chan struct{}, maxConcurrentProbes)
+	for {
+		// 高可用模式下只有主副本检测，结果同步给其他副本
+		if isLeader() {
+			probeDueTargets(sem)
+		}
+		select {
+		case <-shutdownCh:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func probeDueTargets(sem chan struct{}) {
+	type due struct {
+		name  string
+		probe TargetProbe
+	}
+	var list []due
+	names := make(map[string]bool)
+
+	storage.mu.RLock()
+	powerStates.Lock()
+	for name, t := range storage.targets {
+		if t.Probe == nil {
+			continue
+		}
+		names[name] = true
+		last, checked := powerStates.m[name]
+		interval := probeInterval
+		// 唤醒已确认、目标仍为关机时也加快检测，使唤醒延迟中的开机耗时更准确（见 latency.go）
+		if lastTargetWake(name).inProgress() || checked && last.Pending != "" || checked && last.State == powerOff && awaitingBoot(name, time.Now()) {
+			interval = min(probeInterval, probeWakeInterval)
+		}
+		if powerStates.running[name] || checked && last.Method == t.Probe.Method && time.Since(last.CheckedAt) < interval {
+			continue
+		}
+		powerStates.running[name] = true
+		list = append(list, due{name, *t.Probe})
+	}
+	// 清理已删除或取消检测的目标
+	for name := range powerStates.m {
+		if !names[name] {
+			delete(powerStates.m, name)
+		}
+	}
+	powerStates.Unlock()
+	storage.mu.RUnlock()
+
+	for _, d := range list {
+		sem <- struct{}{}
+		go func() {
+			defer func() { <-sem }()
+			probeTarget(d.name, d.probe)
+		}()
+	}
+}
+
+// 检测一个目标并记录结果，状态变化得到确认时发布 target.up / target.down 事件
+func probeTarget(name string, p TargetProbe) {
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	start := time.Now()
+	on, detail, err := runProbe(ctx, p)
+	cancel()
+	latency := time.Since(start)
+
+	state := powerOff
+	switch {
+	case on:
+		state = powerOn
+	case errors.Is(err, exec.ErrNotFound):
+		state = powerUnknown // 检测命令不可用，无法判断
+		detail = err.Error()
+	case err != nil:
+		detail = err.Error()
+	}
+
+	powerStates.Lock()
+	delete(powerStates.running, name)
+	prev, exists := powerStates.m[name]
+	result := &TargetPower{
+		Target:    name,
+		State:     state,
+		Method:    p.Method,
+		Detail:    detail,
+		CheckedAt: start, // 以开始时间计算下次检测，避免与定时器错开一个周期
+		ChangedAt: start,
+	}
+	if on {
+		result.LatencyMS = float64(latency.Microseconds()) / 1000
+	}
+	changed := false
+	if exists {
+		result.ChangedAt = prev.ChangedAt
+		result.changes = recentChanges(prev.changes, start)
+		changed = dampPower(prev, result)
+		if changed {
+			result.ChangedAt = start
+		}
+		if changed && prev.State != powerUnknown && result.State != powerUnknown {
+			result.changes = append(result.changes, start)
+		}
+		result.Flapping = len(result.changes) >= flapChanges
+	}
+	powerStates.m[name] = result
+	powerStates.Unlock()
+	replicatePower(result)
+	if changed && exists && prev.State == powerOff && result.State == powerOn {
+		// 开机时间取第一次检测到开机的时间，而不是达到 -probe-confirm 次确认的这次检测
+		upAt := start
+		if prev.Pending == powerOn && prev.PendingSince != nil {
+			upAt = *prev.PendingSince
+		}
+		confirmAwake(name, upAt)
+	}
+
+	// 启动后的第一次检测和无法判断的结果不算状态变化；flapping 期间只在开始时通知一次，结束时发布最终状态
+	known := result.State != powerUnknown && exists && prev.State != powerUnknown
+	switch {
+	case !exists || result.State == powerUnknown:
+	case result.Flapping && !prev.Flapping && known:
+		slog.Warn("target power is flapping", "target", name, "changes", len(result.changes), "window", flapWindow.String())
+		events.publish(Event{Type: eventTargetFlapping, Data: map[string]any{
+			"target":  name,
+			"method":  p.Method,
+			"changes": len(result.changes),
+			"window":  flapWindow.String(),
+		}})
+	case result.Flapping:
+	case changed && known, prev.Flapping && !result.Flapping:
+		eventType := eventTargetDown
+		if result.State == powerOn {
+			eventType = eventTargetUp
+		}
+		events.publish(Event{Type: eventType, Data: map[string]any{
+			"target": name,
+			"method": p.Method,
+			"detail": detail,
+		}})
+	}
+}
+
+// 按 -probe-confirm 决定新的检测结果是否改变状态，未确认时保持原状态并记录待确认的结果。
+// 与 unknown 之间的变化（首次得到结果、检测命令不可用）立即生效
+func dampPower(prev, result *TargetPower) bool {
+	observed := result.State
+	if observed == prev.State {
+		return false
+	}
+	if observed == powerUnknown || prev.State == powerUnknown {
+		return true
+	}
+	checked := result.CheckedAt
+	confirmations, since := 1, &checked
+	if prev.Pending == observed {
+		confirmations, since = prev.Confirmations+1, prev.PendingSince
+	}
+	if confirmations >= probeConfirm {
+		return true
+	}
+	result.State = prev.State
+	result.Pending, result.Confirmations, result.PendingSince = observed, confirmations, since
+	return false
+}
+
+// 去掉 flapWindow 之前的状态变化
+func recentChanges(changes []time.Time, now time.Time) []time.Time {
+	var recent []time.Time
+	for _, t := range changes {
+		if now.Sub(t) < flapWindow {
+			recent = append(recent, t)
+		}
+	}
+	return recent
+}
+
+// 目标开机状态：GET /api/targets/power[?target=名称]
+func targetPowerHandler(w http.ResponseWriter, r *http.Request) {
+	filter := r.URL.Query().Get("target")
+	storage.mu.RLock()
+	names := make([]string, 0, len(storage.targets))
+	for name := range storage.targets {
+		if filter == "" || name == filter {
+			names = append(names, name)
+		}
+	}
+	storage.mu.RUnlock()
+	if filter != "" && len(names) == 0 {
+		http.Error(w, "Target not found", http.StatusNotFound)
+		return
+	}
+	sort.Strings(names)
+
+	states := make([]TargetPower, 0, len(names))
+	counts := map[string]int{powerOn: 0, powerOff: 0, powerUnknown: 0}
+	powerStates.RLock()
+	for _, name := range names {
+		p := TargetPower{Target: name, State: powerUnknown}
+		if s, exists := powerStates.m[name]; exists {
+			p = *s
+		}
+		states = append(states, p)
+		counts[p.State]++
+	}
+	powerStates.RUnlock()
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"targets": states,
+		"counts":  counts,
+	})
+}
+
+func checkProber() ComponentHealth {
+	powerStates.RLock()
+	defer powerStates.RUnlock()
+	on := 0
+	for _, p := range powerStates.m {
+		if p.State == powerOn {
+			on++
+		}
+	}
+	return ComponentHealth{Status: healthOK, Detail: fmt.Sprintf("%d of %d probed targets on", on, len(powerStates.m))}
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// 设备配置下发：管理员创建一次性的注册码，固件首次启动时用注册码获取服务器地址、令牌、
+// 轮询间隔和广播参数，不再需要把这些配置编译进固件。配置文档用注册码做 HMAC-SHA256 签名，
+// 设备用同一个注册码校验，即使通过明文 HTTP 获取也能发现篡改
+
+type Enrollment struct {
+	ID               string     `json:"id"`
+	CodeHash         string     `json:"code_hash,omitempty"` // 规范化注册码的 SHA-256，接口中不返回
+	Label            string     `json:"label,omitempty"`
+	User             string     `json:"user,omitempty"` // 为该用户签发设备令牌，为空时下发服务器API密钥
+	DeviceName       string     `json:"device_name,omitempty"`
+	PollInterval     int        `json:"poll_interval,omitempty"` // 秒
+	BroadcastIP      string     `json:"broadcast_ip,omitempty"`
+	WOLPort          int        `json:"wol_port,omitempty"`
+	CertFingerprints []string   `json:"cert_fingerprints,omitempty"`
+	ExpiresAt        time.Time  `json:"expires_at"`
+	UsedAt           *time.Time `json:"used_at,omitempty"`
+	UsedBy           string     `json:"used_by,omitempty"` // 获取配置的设备ID
+	CreatedAt        time.Time  `json:"created_at"`
+}
+
+// 下发给设备的配置文档，字段为空时固件使用 config.py 中的默认值
+type ProvisionDocument struct {
+	Version          int      `json:"version"`
+	EnrollmentID     string   `json:"enrollment_id"`
+	ServerURL        string   `json:"server_url"`
+	APIKey           string   `json:"api_key"`
+	DeviceName       string   `json:"device_name,omitempty"`
+	PollInterval     int      `json:"poll_interval,omitempty"`
+	BroadcastIP      string   `json:"broadcast_ip,omitempty"`
+	WOLPort          int      `json:"wol_port,omitempty"`
+	CertFingerprints []string `json:"cert_fingerprints,omitempty"`
+	IssuedAt         int64    `json:"issued_at"`
+}
+
+const (
+	defaultEnrollmentTTL = 24 * time.Hour
+	maxEnrollmentTTL     = 30 * 24 * time.Hour
+	// 去掉容易混淆的 0/O、1/I/L 后的字符
+	enrollmentAlphabet = "23456789ABCDEFGHJKMNPQRSTUVWXYZ"
+)
+
+// HTTPS 监听器证书的 SHA-256 指纹（DER，小写十六进制），启动时填充
+var serverCertFingerprints []string
+
+// 记录 HTTPS 监听器证书的指纹，读取失败时只记录警告
+func addCertFingerprint(certFile string) error {
+	data, err := os.ReadFile(certFile)
+	if err != nil {
+		return err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return fmt.Errorf("no certificate found in %s", certFile)
+	}
+	if _, err := x509.ParseCertificate(block.Bytes); err != nil {
+		return err
+	}
+	sum := sha256.Sum256(block.Bytes)
+	fp := hex.EncodeToString(sum[:])
+	for _, existing := range serverCertFingerprints {
+		if existing == fp {
+			return nil
+		}
+	}
+	serverCertFingerprints = append(serverCertFingerprints, fp)
+	return nil
+}
+
+// 生成 XXXX-XXXX 形式的注册码
+func newEnrollmentCode() string {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	code := make([]byte, 0, 9)
+	for i, b := range buf {
+		if i == 4 {
+			code = append(code, '-')
+		}
+		code = append(code, enrollmentAlphabet[int(b)%len(enrollmentAlphabet)])
+	}
+	return string(code)
+}
+
+// 忽略大小写、空格和连字符，便于手工输入
+func normalizeEnrollmentCode(code string) string {
+	code = strings.ToUpper(code)
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, code)
+}
+
+func hashEnrollmentCode(code string) string {
+	sum := sha256.Sum256([]byte(normalizeEnrollmentCode(code)))
+	return hex.EncodeToString(sum[:])
+}
+
+// 配置文档的签名：以规范化注册码为密钥的 HMAC-SHA256（十六进制）
+func signProvisionPayload(code string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(normalizeEnrollmentCode(code)))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func validFingerprint(fp string) bool {
+	b, err := hex.DecodeString(fp)
+	return err == nil && len(b) == sha256.Size
+}
+
+// 注册码列表和创建：GET/POST /api/admin/enrollments（仅服务器API密钥）
+func enrollmentsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		storage.mu.RLock()
+		list := make([]Enrollment, 0, len(storage.enrollments))
+		for _, e := range storage.enrollments {
+			copied := *e
+			copied.CodeHash = ""
+			list = append(list, copied)
+		}
+		storage.mu.RUnlock()
+		sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"success":     true,
+			"enrollments": list,
+			"total":       len(list),
+		})
+
+	case http.MethodPost:
+		var req struct {
+			Label            string   `json:"label"`
+			User             string   `json:"user"`
+			DeviceName       string   `json:"device_name"`
+			PollInterval     int      `json:"poll_interval"`
+			BroadcastIP      string   `json:"broadcast_ip"`
+			WOLPort          int      `json:"wol_port"`
+			CertFingerprints []string `json:"cert_fingerprints"`
+			ExpiresIn        Duration `json:"expires_in"` // 默认24小时
+		}
+		if !readJSON(w, r, &req) {
+			return
+		}
+		ttl := time.Duration(req.ExpiresIn)
+		if ttl == 0 {
+			ttl = defaultEnrollmentTTL
+		}
+		if ttl < time.Minute || ttl > maxEnrollmentTTL {
+			http.Error(w, "expires_in must be between 1m and 720h", http.StatusBadRequest)
+			return
+		}
+		if req.PollInterval < 0 || req.PollInterval > 3600 {
+			http.Error(w, "poll_interval must be between 1 and 3600 seconds", http.StatusBadRequest)
+			return
+		}
+		if req.WOLPort < 0 || req.WOLPort > 65535 {
+			http.Error(w, "wol_port must be between 1 and 65535", http.StatusBadRequest)
+			return
+		}
+		if req.BroadcastIP != "" && net.ParseIP(req.BroadcastIP).To4() == nil {
+			http.Error(w, "broadcast_ip must be an IPv4 address", http.StatusBadRequest)
+			return
+		}
+		fingerprints := make([]string, 0, len(req.CertFingerprints))
+		for _, fp := range req.CertFingerprints {
+			fp = strings.ToLower(strings.ReplaceAll(fp, ":", ""))
+			if !validFingerprint(fp) {
+				http.Error(w, "cert_fingerprints must be SHA-256 fingerprints in hex", http.StatusBadRequest)
+				return
+			}
+			fingerprints = append(fingerprints, fp)
+		}
+
+		code := newEnrollmentCode()
+		now := time.Now()
+		e := &Enrollment{
+			ID:               "enr_" + randomHex(8),
+			CodeHash:         hashEnrollmentCode(code),
+			Label:            req.Label,
+			User:             req.User,
+			DeviceName:       req.DeviceName,
+			PollInterval:     req.PollInterval,
+			BroadcastIP:      req.BroadcastIP,
+			WOLPort:          req.WOLPort,
+			CertFingerprints: fingerprints,
+			ExpiresAt:        now.Add(ttl).Truncate(time.Second),
+			CreatedAt:        now,
+		}
+
+		storage.mu.Lock()
+		if e.User != "" {
+			u, exists := storage.users[e.User]
+			if !exists {
+				storage.mu.Unlock()
+				http.Error(w, fmt.Sprintf("user %q not found", e.User), http.StatusBadRequest)
+				return
+			}
+			// 中继需要注册、轮询和确认消息
+			if userRole, _ := parseRole(u.Role); userRole < roleOperator {
+				storage.mu.Unlock()
+				http.Error(w, "user must have the operator or admin role to run a relay", http.StatusBadRequest)
+				return
+			}
+		}
+		storage.enrollments[e.ID] = e
+		info := *e
+		info.CodeHash = ""
+		storage.mu.Unlock()
+
+		markDirty()
+		requestLogger(r).Info("enrollment created", "enrollment_id", e.ID, "user", e.User, "expires_at", e.ExpiresAt)
+		writeJSON(w, http.StatusCreated, map[string]interface{}{
+			"success":    true,
+			"message":    "Enrollment created",
+			"code":       code,
+			"enrollment": info,
+		})
+
+	default:
+		methodNotAllowed(w, r)
+	}
+}
+
+// 删除注册码：DELETE /api/admin/enrollments/<id>
+func enrollmentHandler(w http.ResponseWriter, r *http.Request) {
+	id, _ := pathParams(r, "/api/admin/enrollments/")
+	storage.mu.Lock()
+	_, exists := storage.enrollments[id]
+	delete(storage.enrollments, id)
+	storage.mu.Unlock()
+	if !exists {
+		http.Error(w, "Enrollment not found", http.StatusNotFound)
+		return
+	}
+	markDirty()
+	requestLogger(r).Info("enrollment deleted", "enrollment_id", id)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"success": true, "message": "Enrollment deleted"})
+}
+
+// 设备获取配置：GET /api/provision?code=<注册码>[&device_id=<MAC>]，不需要API密钥。
+// 每个注册码只能使用一次，返回 {"payload": "<JSON文本>", "signature": "<HMAC>"}
+func provisionHandler(w http.ResponseWriter, r *http.Request) {
+	code := r.URL.Query().Get("code")
+	deviceID := r.URL.Query().Get("device_id")
+	if code == "" {
+		http.Error(w, "code is required", http.StatusBadRequest)
+		return
+	}
+	hash := hashEnrollmentCode(code)
+	now := time.Now()
+
+	storage.mu.Lock()
+	var e *Enrollment
+	for _, candidate := range storage.enrollments {
+		if hmac.Equal([]byte(candidate.CodeHash), []byte(hash)) {
+			e = candidate
+			break
+		}
+	}
+	switch {
+	case e == nil:
+		storage.mu.Unlock()
+		ip := clientIP(r)
+		requestLogger(r).Warn("provisioning with unknown enrollment code", "client_ip", ip)
+		authFailures.record(ip, r.Method, r.URL.Path, authReasonEnrollment)
+		http.Error(w, "Enrollment code not found", http.StatusNotFound)
+		return
+	case e.UsedAt != nil:
+		storage.mu.Unlock()
+		http.Error(w, "Enrollment code has already been used", http.StatusGone)
+		return
+	case now.After(e.ExpiresAt):
+		storage.mu.Unlock()
+		http.Error(w, "Enrollment code has expired", http.StatusGone)
+		return
+	}
+
+	apiKey := API_KEY
+	if e.User != "" {
+		u, exists := storage.users[e.User]
+		if !exists {
+			storage.mu.Unlock()
+			http.Error(w, "Enrollment user no longer exists", http.StatusGone)
+			return
+		}
+		if len(u.Tokens) >= maxUserTokens {
+			storage.mu.Unlock()
+			http.Error(w, fmt.Sprintf("User already has %d tokens, revoke one first", maxUserTokens), http.StatusConflict)
+			return
+		}
+		label := "provision " + e.ID
+		if e.DeviceName != "" {
+			label = "relay " + e.DeviceName
+		}
+		token, t := newUserToken(label)
+		u.Tokens = append(u.Tokens, t)
+		apiKey = token
+	} else if !apiKeyAuth {
+		// 不再接受 -api-key 时为设备创建单独的密钥
+		if len(storage.apiKeys) >= maxAPIKeys {
+			storage.mu.Unlock()
+			http.Error(w, "Too many API keys, delete one first", http.StatusConflict)
+			return
+		}
+		label := "provision " + e.ID
+		if e.DeviceName != "" {
+			label = "relay " + e.DeviceName
+		}
+		key, k := newAPIKey(label)
+		storage.apiKeys[k.ID] = k
+		apiKey = key
+	}
+	e.UsedAt = &now
+	e.UsedBy = deviceID
+	fingerprints := e.CertFingerprints
+	if len(fingerprints) == 0 {
+		fingerprints = serverCertFingerprints
+	}
+	doc := ProvisionDocument{
+		Version:          1,
+		EnrollmentID:     e.ID,
+		ServerURL:        externalURL(r, ""),
+		APIKey:           apiKey,
+		DeviceName:       e.DeviceName,
+		PollInterval:     e.PollInterval,
+		BroadcastIP:      e.BroadcastIP,
+		WOLPort:          e.WOLPort,
+		CertFingerprints: fingerprints,
+		IssuedAt:         now.Unix(),
+	}
+	user := e.User
+	storage.mu.Unlock()
+	markDirty()
+
+	payload, _ := json.Marshal(doc)
+	requestLogger(r).Info("device provisioned", "enrollment_id", doc.EnrollmentID, "device_id", deviceID, "user", user)
+	events.publish(Event{Type: eventDeviceProvisioned, DeviceID: deviceID, Data: map[string]any{"enrollment_id": doc.EnrollmentID}})
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"payload":   string(payload),
+		"signature": signProvisionPayload(code, payload),
+		"algorithm": "HMAC-SHA256",
+	})
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// 受信任的反向代理网段，只有来自这些地址的请求才会采信 X-Forwarded-* 头
+var trustedProxies []*net.IPNet
+
+// 解析逗号分隔的代理地址列表，支持单个IP和CIDR
+func parseTrustedProxies(value string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(normalizeIP(item))
+			if ip == nil {
+				return nil, fmt.Errorf("invalid proxy address %q", item)
+			}
+			bits := 32
+			if ip.To4() == nil {
+				bits = 128
+			}
+			item = fmt.Sprintf("%s/%d", ip, bits)
+		}
+		_, ipNet, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// 判断地址是否属于受信任代理
+// Unix域套接字连接没有远端IP，只可能来自本机代理，视为受信任
+func isTrustedProxy(host string) bool {
+	if host == "" || host == "@" {
+		return true
+	}
+	ip := net.ParseIP(normalizeIP(host))
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range trustedProxies {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// 连接的直接对端地址（已规范化，见 normalizeIP）
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return normalizeIP(host)
+}
+
+// 获取客户端真实IP
+// 直接对端是受信任代理时，从右向左遍历 X-Forwarded-For，返回第一个不受信任的地址
+func clientIP(r *http.Request) string {
+	host := remoteHost(r)
+	if !isTrustedProxy(host) {
+		return host
+	}
+
+	forwarded := r.Header.Values("X-Forwarded-For")
+	var hops []string
+	for _, value := range forwarded {
+		for _, hop := range strings.Split(value, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		if !isTrustedProxy(hops[i]) || i == 0 {
+			return normalizeIP(hops[i])
+		}
+	}
+	return host
+}
+
+// 获取客户端使用的协议（http/https）
+func requestScheme(r *http.Request) string {
+	if isTrustedProxy(remoteHost(r)) {
+		if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+			return strings.ToLower(strings.TrimSpace(strings.Split(proto, ",")[0]))
+		}
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// URL路径前缀（-base-path）
+var basePath string
+
+// 对外访问地址（-public-url），为空时根据请求推断
+var publicURL string
+
+// 生成对外可访问的绝对URL，path 不含 -base-path 前缀
+func externalURL(r *http.Request, path string) string {
+	if publicURL != "" {
+		return strings.TrimRight(publicURL, "/") + path
+	}
+	host := r.Host
+	if isTrustedProxy(remoteHost(r)) {
+		if fwd := r.Header.Get("X-Forwarded-Host"); fwd != "" {
+			host = strings.TrimSpace(strings.Split(fwd, ",")[0])
+		}
+	}
+	return requestScheme(r) + "://" + host + basePath + path
+}
+
+// 规范化URL前缀: "wol/" -> "/wol"，"/" -> ""
+func normalizeBasePath(path string) string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return ""
+	}
+	return "/" + path
+}
+
+// 部署在反向代理的子路径下时，去掉URL前缀后再路由
+func withBasePath(basePath string, handler http.Handler) http.Handler {
+	if basePath == "" {
+		return handler
+	}
+	return http.StripPrefix(basePath, handler)
+}
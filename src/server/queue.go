@@ -0,0 +1,426 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 设备消息队列：每个设备一个队列，有独立的锁和通知通道。长轮询等待通知，
+// 不再每秒获取全局锁检查队列，一个设备的队列操作也不会阻塞其他设备。
+// 加锁顺序：需要同时持有时先 storage.mu 后队列锁。
+// 集群模式下消息保存在 Redis 中（见 cluster.go），这里只保留本副本的通知通道
+//
+// 下发的消息先移到“处理中”列表，设备确认后才删除；超过 ackTimeout 未确认的消息
+// 重新入队（排在队首），下发 maxDeliveryAttempts 次仍未确认时标记为失败。
+// 设备在处理前重启或响应没有送达时消息不会丢失
+
+// 轮询参数：内存小的固件用 max_messages 限制一次接收的消息数量，用 types 只接收部分类型的消息
+// （逗号分隔，唤醒消息为 wake）。不符合条件和超出数量的消息留在队列中，等待下次轮询
+type pollFilter struct {
+	max   int             // 0 表示不限制
+	types map[string]bool // 为空表示全部类型
+}
+
+func parsePollFilter(query url.Values) (pollFilter, error) {
+	var f pollFilter
+	if v := query.Get("max_messages"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return f, errors.New("max_messages must be a positive integer")
+		}
+		f.max = n
+	}
+	if v := query.Get("types"); v != "" {
+		f.types = make(map[string]bool)
+		for _, t := range strings.Split(v, ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				f.types[t] = true
+			}
+		}
+		if len(f.types) == 0 {
+			return f, errors.New("types must list at least one message type")
+		}
+	}
+	return f, nil
+}
+
+// 消息在轮询参数中的类型名称
+func pollType(m *WOLMessage) string {
+	if m.Type == "" {
+		return "wake"
+	}
+	return m.Type
+}
+
+func (f pollFilter) match(m *WOLMessage) bool {
+	return len(f.types) == 0 || f.types[pollType(m)]
+}
+
+// 队列表分片数量，减少大量设备同时轮询时在队列表上的竞争
+const queueShardCount = 64
+
+// 确认超时和最大下发次数，ackTimeout 为 0 时下发即删除（不重发）
+var (
+	ackTimeout          = 60 * time.Second
+	maxDeliveryAttempts = 5
+)
+
+func checkDeliverySettings() error {
+	if ackTimeout < 0 {
+		return errors.New("-ack-timeout must not be negative")
+	}
+	if ackTimeout > 0 && ackTimeout < time.Second {
+		return errors.New("-ack-timeout must be at least 1s")
+	}
+	if maxDeliveryAttempts < 1 {
+		return errors.New("-max-delivery-attempts must be at least 1")
+	}
+	return nil
+}
+
+type deviceQueue struct {
+	mu       sync.Mutex
+	messages []*WOLMessage
+	inflight []inflightMessage // 已下发、等待确认的消息
+	notify   chan struct{}     // 容量为1，入队时发出信号；队列被删除时关闭
+}
+
+type inflightMessage struct {
+	message  *WOLMessage
+	deadline time.Time
+}
+
+type queueShard struct {
+	mu     sync.Mutex
+	queues map[string]*deviceQueue
+}
+
+type queueRegistry struct {
+	shards  [queueShardCount]queueShard
+	pending atomic.Int64 // 全部队列中的消息总数（非集群模式）
+}
+
+var queues = newQueueRegistry()
+
+func newQueueRegistry() *queueRegistry {
+	r := &queueRegistry{}
+	for i := range r.shards {
+		r.shards[i].queues = make(map[string]*deviceQueue)
+	}
+	return r
+}
+
+// FNV-1a，直接遍历字符串，每次轮询都会调用，不做内存分配
+func (r *queueRegistry) shard(deviceID string) *queueShard {
+	h := uint32(2166136261)
+	for i := 0; i < len(deviceID); i++ {
+		h ^= uint32(deviceID[i])
+		h *= 16777619
+	}
+	return &r.shards[h%queueShardCount]
+}
+
+// 设备的队列，不存在时创建
+func (r *queueRegistry) get(deviceID string) *deviceQueue {
+	s := r.shard(deviceID)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q, exists := s.queues[deviceID]
+	if !exists {
+		q = &deviceQueue{notify: make(chan struct{}, 1)}
+		s.queues[deviceID] = q
+	}
+	return q
+}
+
+// 设备的队列，不存在时返回 nil
+func (r *queueRegistry) lookup(deviceID string) *deviceQueue {
+	s := r.shard(deviceID)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.queues[deviceID]
+}
+
+// 消息入队并通知等待中的长轮询
+func (r *queueRegistry) push(deviceID string, message *WOLMessage) error {
+	q := r.get(deviceID)
+	if cluster != nil {
+		if err := cluster.push(deviceID, message); err != nil {
+			return err
+		}
+	} else {
+		q.mu.Lock()
+		q.messages = append(q.messages, message)
+		q.mu.Unlock()
+		r.pending.Add(1)
+	}
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// 通知等待中的长轮询检查队列（其他副本入队了消息）
+func (r *queueRegistry) notify(deviceID string) {
+	if q := r.lookup(deviceID); q != nil {
+		select {
+		case q.notify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (r *queueRegistry) notifyAll() {
+	for i := range r.shards {
+		s := &r.shards[i]
+		s.mu.Lock()
+		for _, q := range s.queues {
+			select {
+			case q.notify <- struct{}{}:
+			default:
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// 队列中的消息数量
+func (r *queueRegistry) len(deviceID string) int {
+	if cluster != nil {
+		return cluster.length(deviceID)
+	}
+	q := r.lookup(deviceID)
+	if q == nil {
+		return 0
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.messages)
+}
+
+// 全部队列中的消息总数；集群模式下为定期从 Redis 统计的近似值
+func (r *queueRegistry) total() int {
+	if cluster != nil {
+		return cluster.total()
+	}
+	return int(r.pending.Load())
+}
+
+// 取出队列中符合轮询条件的消息准备下发，消息移到处理中列表，确认或超时前不会再次下发；
+// 其余消息按原顺序留在队列中。同时返回因 max_messages 留下、符合条件的消息数量
+func (r *queueRegistry) lease(deviceID string, f pollFilter) ([]*WOLMessage, int) {
+	if cluster != nil {
+		return cluster.lease(deviceID, f)
+	}
+	q := r.lookup(deviceID)
+	if q == nil {
+		return nil, 0
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var messages, kept []*WOLMessage
+	remaining := 0
+	for _, msg := range q.messages {
+		switch {
+		case !f.match(msg):
+			kept = append(kept, msg)
+		case f.max > 0 && len(messages) >= f.max:
+			kept = append(kept, msg)
+			remaining++
+		default:
+			messages = append(messages, msg)
+		}
+	}
+	q.messages = kept
+	r.pending.Add(-int64(len(messages)))
+	if ackTimeout > 0 {
+		deadline := time.Now().Add(ackTimeout)
+		for _, msg := range messages {
+			q.inflight = append(q.inflight, inflightMessage{message: msg, deadline: deadline})
+		}
+	}
+	return messages, remaining
+}
+
+// 设备确认后从处理中列表删除，返回是否找到
+func (r *queueRegistry) ack(deviceID, messageID string) bool {
+	if cluster != nil {
+		return cluster.ack(deviceID, messageID)
+	}
+	q := r.lookup(deviceID)
+	if q == nil {
+		return false
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, in := range q.inflight {
+		if in.message.ID == messageID {
+			q.inflight = append(q.inflight[:i:i], q.inflight[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// 取出所有超过确认期限的消息，按设备分组
+func (r *queueRegistry) expired(now time.Time) map[string][]*WOLMessage {
+	if cluster != nil {
+		return cluster.expired(now)
+	}
+	result := make(map[string][]*WOLMessage)
+	for i := range r.shards {
+		s := &r.shards[i]
+		s.mu.Lock()
+		for id, q := range s.queues {
+			q.mu.Lock()
+			kept := q.inflight[:0]
+			for _, in := range q.inflight {
+				if now.After(in.deadline) {
+					result[id] = append(result[id], in.message)
+				} else {
+					kept = append(kept, in)
+				}
+			}
+			clear(q.inflight[len(kept):])
+			q.inflight = kept
+			q.mu.Unlock()
+		}
+		s.mu.Unlock()
+	}
+	return result
+}
+
+// 未确认的消息重新放回队首并通知长轮询
+func (r *queueRegistry) requeue(deviceID string, message *WOLMessage) error {
+	q := r.get(deviceID)
+	if cluster != nil {
+		if err := cluster.requeue(deviceID, message); err != nil {
+			return err
+		}
+	} else {
+		q.mu.Lock()
+		q.messages = append([]*WOLMessage{message}, q.messages...)
+		q.mu.Unlock()
+		r.pending.Add(1)
+	}
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// 从队列中移除指定消息，返回是否找到
+func (r *queueRegistry) remove(deviceID, messageID string) bool {
+	if cluster != nil {
+		return cluster.remove(deviceID, messageID)
+	}
+	q := r.lookup(deviceID)
+	if q == nil {
+		return false
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, msg := range q.messages {
+		if msg.ID == messageID {
+			q.messages = append(q.messages[:i:i], q.messages[i+1:]...)
+			r.pending.Add(-1)
+			return true
+		}
+	}
+	return false
+}
+
+// 清空设备队列中尚未下发的消息并返回；已下发、等待确认的消息不受影响
+func (r *queueRegistry) purge(deviceID string) []*WOLMessage {
+	if cluster != nil {
+		return cluster.take(deviceID)
+	}
+	q := r.lookup(deviceID)
+	if q == nil {
+		return nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	messages := q.messages
+	q.messages = nil
+	r.pending.Add(-int64(len(messages)))
+	return messages
+}
+
+// 删除设备的队列并返回其中的消息（包括等待确认的消息）；关闭通知通道，让等待中的长轮询重新获取队列
+func (r *queueRegistry) drop(deviceID string) []*WOLMessage {
+	if cluster != nil {
+		messages := cluster.take(deviceID)
+		messages = append(messages, cluster.dropInflight(deviceID)...)
+		r.closeLocal(deviceID)
+		return messages
+	}
+	return r.closeLocal(deviceID)
+}
+
+// 删除本副本的队列并关闭通知通道，返回本地队列和处理中列表里的消息。
+// 调用方持有 storage.mu，避免与 push、requeue 并发时向已关闭的通道发送
+func (r *queueRegistry) closeLocal(deviceID string) []*WOLMessage {
+	s := r.shard(deviceID)
+	s.mu.Lock()
+	q, exists := s.queues[deviceID]
+	delete(s.queues, deviceID)
+	s.mu.Unlock()
+	if !exists {
+		return nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	close(q.notify)
+	r.pending.Add(-int64(len(q.messages)))
+	messages := q.messages
+	for _, in := range q.inflight {
+		messages = append(messages, in.message)
+	}
+	return messages
+}
+
+// 本副本队列中尚未确认的消息（等待确认的在前，按下发顺序），关闭时写入状态文件
+func (r *queueRegistry) unacknowledged() []*WOLMessage {
+	var messages []*WOLMessage
+	for i := range r.shards {
+		s := &r.shards[i]
+		s.mu.Lock()
+		for _, q := range s.queues {
+			q.mu.Lock()
+			for _, in := range q.inflight {
+				messages = append(messages, in.message)
+			}
+			messages = append(messages, q.messages...)
+			q.mu.Unlock()
+		}
+		s.mu.Unlock()
+	}
+	return messages
+}
+
+// 各设备的队列长度
+func (r *queueRegistry) depths() map[string]int {
+	if cluster != nil {
+		return cluster.depths()
+	}
+	depths := make(map[string]int)
+	for i := range r.shards {
+		s := &r.shards[i]
+		s.mu.Lock()
+		for id, q := range s.queues {
+			q.mu.Lock()
+			depths[id] = len(q.messages)
+			q.mu.Unlock()
+		}
+		s.mu.Unlock()
+	}
+	return depths
+}
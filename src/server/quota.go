@@ -0,0 +1,289 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 配额：限制用户每小时/每天的唤醒次数，以及可拥有的设备和定时任务数量，用于多人共用或半公开的部署。
+// 令牌也可以单独设置唤醒次数配额（例如给脚本一个受限的令牌），与用户的配额同时生效。
+// 唤醒次数按滑动窗口在内存中统计，重启后清零，高可用模式下每个副本分别统计
+
+// 0 表示不限制
+type Quota struct {
+	WakesPerHour int `json:"wakes_per_hour,omitempty"`
+	WakesPerDay  int `json:"wakes_per_day,omitempty"`
+	MaxDevices   int `json:"max_devices,omitempty"`
+	MaxSchedules int `json:"max_schedules,omitempty"`
+}
+
+const (
+	quotaWakesPerHour = "wakes_per_hour"
+	quotaWakesPerDay  = "wakes_per_day"
+	quotaMaxDevices   = "max_devices"
+	quotaMaxSchedules = "max_schedules"
+)
+
+// 全部为0（不限制）时返回 nil
+func (q *Quota) normalized() *Quota {
+	if q == nil || *q == (Quota{}) {
+		return nil
+	}
+	copied := *q
+	return &copied
+}
+
+// token 为 true 时只允许唤醒次数配额
+func (q *Quota) validate(token bool) error {
+	if q == nil {
+		return nil
+	}
+	if q.WakesPerHour < 0 || q.WakesPerDay < 0 || q.MaxDevices < 0 || q.MaxSchedules < 0 {
+		return errors.New("quota values must not be negative")
+	}
+	if token && (q.MaxDevices != 0 || q.MaxSchedules != 0) {
+		return errors.New("token quotas only support wakes_per_hour and wakes_per_day")
+	}
+	return nil
+}
+
+// 用户或令牌的当前用量
+type QuotaUsage struct {
+	WakesLastHour int `json:"wakes_last_hour"`
+	WakesLastDay  int `json:"wakes_last_day"`
+	Devices       int `json:"devices,omitempty"`
+	Schedules     int `json:"schedules,omitempty"`
+}
+
+type quotaError struct {
+	Quota      string
+	Limit      int
+	Used       int
+	RetryAfter time.Duration // 唤醒次数配额多久后恢复，数量配额为0
+}
+
+func (e *quotaError) Error() string {
+	return fmt.Sprintf("quota %s exceeded (%d/%d)", e.Quota, e.Used, e.Limit)
+}
+
+var quotaExceededTotal = newCounterVec("esp32_wol_quota_exceeded_total",
+	"Requests rejected because a user or token quota was reached.", "quota")
+
+// 配额错误写为结构化响应并返回 true：唤醒次数超限返回 429 并带 Retry-After，数量超限返回 403
+func writeQuotaError(w http.ResponseWriter, err error) bool {
+	var qe *quotaError
+	if !errors.As(err, &qe) {
+		return false
+	}
+	status := http.StatusForbidden
+	if qe.RetryAfter > 0 {
+		status = http.StatusTooManyRequests
+		w.Header().Set("Retry-After", strconv.Itoa(int(qe.RetryAfter.Seconds())+1))
+	}
+	writeJSON(w, status, map[string]any{
+		"success": false,
+		"error":   "quota_exceeded",
+		"quota":   qe.Quota,
+		"limit":   qe.Limit,
+		"used":    qe.Used,
+		"message": qe.Error(),
+	})
+	return true
+}
+
+// 最近一天内的唤醒时间，键为 user:<name> 或 token:<id>
+var wakeUsage = struct {
+	mu    sync.Mutex
+	times map[string][]time.Time
+}{times: make(map[string][]time.Time)}
+
+// 去掉一天以前的记录，调用方持有 wakeUsage.mu
+func recentWakes(key string, now time.Time) []time.Time {
+	times := wakeUsage.times[key]
+	i := 0
+	for i < len(times) && now.Sub(times[i]) >= 24*time.Hour {
+		i++
+	}
+	if i == len(times) {
+		delete(wakeUsage.times, key)
+		return nil
+	}
+	times = times[i:]
+	wakeUsage.times[key] = times
+	return times
+}
+
+// 时间窗口内的唤醒次数，以及窗口内最早一次唤醒（用于计算恢复时间）
+func countSince(times []time.Time, since time.Time) (int, time.Time) {
+	for i, t := range times {
+		if !t.Before(since) {
+			return len(times) - i, t
+		}
+	}
+	return 0, time.Time{}
+}
+
+// 检查唤醒次数配额
+func checkWakeLimits(key string, q Quota, now time.Time) error {
+	times := recentWakes(key, now)
+	limits := []struct {
+		name   string
+		limit  int
+		window time.Duration
+	}{
+		{quotaWakesPerHour, q.WakesPerHour, time.Hour},
+		{quotaWakesPerDay, q.WakesPerDay, 24 * time.Hour},
+	}
+	for _, l := range limits {
+		if l.limit <= 0 {
+			continue
+		}
+		if used, oldest := countSince(times, now.Add(-l.window)); used >= l.limit {
+			return &quotaError{Quota: l.name, Limit: l.limit, Used: used, RetryAfter: oldest.Add(l.window).Sub(now)}
+		}
+	}
+	return nil
+}
+
+// 用户或令牌的唤醒次数配额
+func wakeQuotas(p principal) (user, token Quota) {
+	storage.mu.RLock()
+	defer storage.mu.RUnlock()
+	u, exists := storage.users[p.user]
+	if !exists {
+		return user, token
+	}
+	if u.Quota != nil {
+		user = *u.Quota
+	}
+	for _, t := range u.Tokens {
+		if t.ID == p.token && t.Quota != nil {
+			token = *t.Quota
+		}
+	}
+	return user, token
+}
+
+// 检查并记录一次用户发起的唤醒；入队失败时调用 refundWake 退回。管理员不受限制
+func reserveWake(p principal) error {
+	if p.admin() {
+		return nil
+	}
+	userQuota, tokenQuota := wakeQuotas(p)
+	now := time.Now()
+	keys := wakeUsageKeys(p)
+
+	wakeUsage.mu.Lock()
+	defer wakeUsage.mu.Unlock()
+	if err := checkWakeQuotas(keys, userQuota, tokenQuota, now); err != nil {
+		quotaExceededTotal.add(1, err.(*quotaError).Quota)
+		return err
+	}
+	for _, key := range keys {
+		wakeUsage.times[key] = append(wakeUsage.times[key], now)
+	}
+	return nil
+}
+
+// 检查用户和令牌的唤醒次数配额，调用方持有 wakeUsage.mu
+func checkWakeQuotas(keys []string, userQuota, tokenQuota Quota, now time.Time) error {
+	err := checkWakeLimits(keys[0], userQuota, now)
+	if err == nil && len(keys) > 1 {
+		err = checkWakeLimits(keys[1], tokenQuota, now)
+	}
+	return err
+}
+
+// 检查一次唤醒是否会超出配额，不记录次数（试运行使用）
+func peekWakeQuota(p principal) error {
+	if p.admin() {
+		return nil
+	}
+	userQuota, tokenQuota := wakeQuotas(p)
+	wakeUsage.mu.Lock()
+	defer wakeUsage.mu.Unlock()
+	return checkWakeQuotas(wakeUsageKeys(p), userQuota, tokenQuota, time.Now())
+}
+
+// 用户的统计键，使用令牌时还有令牌的统计键（定时任务代表用户唤醒时没有令牌）
+func wakeUsageKeys(p principal) []string {
+	if p.token == "" {
+		return []string{"user:" + p.user}
+	}
+	return []string{"user:" + p.user, "token:" + p.token}
+}
+
+func refundWake(p principal) {
+	if p.admin() {
+		return
+	}
+	wakeUsage.mu.Lock()
+	defer wakeUsage.mu.Unlock()
+	for _, key := range wakeUsageKeys(p) {
+		if times := wakeUsage.times[key]; len(times) > 0 {
+			wakeUsage.times[key] = times[:len(times)-1]
+		}
+	}
+}
+
+// 最近一小时和一天的唤醒次数
+func wakeCounts(key string) (hour, day int) {
+	now := time.Now()
+	wakeUsage.mu.Lock()
+	defer wakeUsage.mu.Unlock()
+	times := recentWakes(key, now)
+	hour, _ = countSince(times, now.Add(-time.Hour))
+	return hour, len(times)
+}
+
+// 检查用户能否再拥有一个设备或定时任务，调用方持有 storage.mu。管理员不受限制
+func checkCountQuota(user, quota string) error {
+	u, exists := storage.users[user]
+	if !exists || u.Quota == nil {
+		return nil
+	}
+	limit, used := 0, 0
+	switch quota {
+	case quotaMaxDevices:
+		limit = u.Quota.MaxDevices
+		used, _ = ownedResources(user)
+	case quotaMaxSchedules:
+		limit = u.Quota.MaxSchedules
+		used = ownedSchedules(user)
+	}
+	if limit > 0 && used >= limit {
+		quotaExceededTotal.add(1, quota)
+		return &quotaError{Quota: quota, Limit: limit, Used: used}
+	}
+	return nil
+}
+
+// 用户当前的用量，调用方持有 storage.mu
+func userUsage(name string) QuotaUsage {
+	hour, day := wakeCounts("user:" + name)
+	devices, _ := ownedResources(name)
+	return QuotaUsage{WakesLastHour: hour, WakesLastDay: day, Devices: devices, Schedules: ownedSchedules(name)}
+}
+
+// 当前用户和所用令牌的配额与用量：GET /api/admin/quota
+func quotaHandler(w http.ResponseWriter, r *http.Request) {
+	p := requestPrincipal(r)
+	if p.admin() {
+		http.Error(w, "Quotas apply to user tokens, use /api/admin/users/<name>", http.StatusBadRequest)
+		return
+	}
+	userQuota, tokenQuota := wakeQuotas(p)
+	storage.mu.RLock()
+	usage := userUsage(p.user)
+	storage.mu.RUnlock()
+	hour, day := wakeCounts("token:" + p.token)
+	writeJSON(w, http.StatusOK, map[string]any{
+		"success": true,
+		"user":    map[string]any{"name": p.user, "quota": userQuota, "usage": usage},
+		"token":   map[string]any{"id": p.token, "quota": tokenQuota, "usage": QuotaUsage{WakesLastHour: hour, WakesLastDay: day}},
+	})
+}
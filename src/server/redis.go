@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 最小的 Redis 客户端：RESP2 协议，支持命令流水线（含 MULTI/EXEC）和频道订阅。
+// 只实现多副本同步需要的功能，不引入第三方依赖
+
+const (
+	redisPoolSize = 8
+	redisTimeout  = 5 * time.Second
+)
+
+type redisClient struct {
+	addr     string
+	host     string
+	useTLS   bool
+	password string
+	db       int
+	idle     chan *redisConn
+}
+
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+// 服务器返回的错误回复
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// addr 为 host:port、redis://host:port 或 rediss://host:port（TLS）
+func newRedisClient(addr, password string, db int) (*redisClient, error) {
+	c := &redisClient{password: password, db: db, idle: make(chan *redisConn, redisPoolSize)}
+	if strings.Contains(addr, "://") {
+		u, err := url.Parse(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redis address: %w", err)
+		}
+		switch u.Scheme {
+		case "redis":
+		case "rediss":
+			c.useTLS = true
+		default:
+			return nil, fmt.Errorf("unsupported redis scheme %q (use redis:// or rediss://)", u.Scheme)
+		}
+		addr = u.Host
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = addr, "6379"
+	}
+	if host == "" {
+		return nil, errors.New("redis address has no host")
+	}
+	c.host = host
+	c.addr = net.JoinHostPort(host, port)
+	if db < 0 {
+		return nil, errors.New("redis db must not be negative")
+	}
+	return c, nil
+}
+
+func (c *redisClient) dial() (*redisConn, error) {
+	d := net.Dialer{Timeout: redisTimeout}
+	conn, err := d.Dial("tcp", c.addr)
+	if err != nil {
+		return nil, err
+	}
+	if c.useTLS {
+		conn = tls.Client(conn, &tls.Config{ServerName: c.host})
+	}
+	rc := &redisConn{Conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+
+	var setup [][]string
+	if c.password != "" {
+		setup = append(setup, []string{"AUTH", c.password})
+	}
+	if c.db != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(c.db)})
+	}
+	if len(setup) > 0 {
+		if _, err := rc.exchange(setup); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return rc, nil
+}
+
+// 在一个连接上依次发送命令并读取全部回复。返回第一个错误回复，
+// 网络错误时关闭连接；复用的空闲连接可能已被服务器关闭，失败时换新连接重试一次
+func (c *redisClient) pipeline(cmds ...[]string) ([]any, error) {
+	for attempt := 0; ; attempt++ {
+		var conn *redisConn
+		pooled := false
+		select {
+		case conn = <-c.idle:
+			pooled = true
+		default:
+			var err error
+			if conn, err = c.dial(); err != nil {
+				return nil, err
+			}
+		}
+
+		replies, err := conn.exchange(cmds)
+		var replyErr redisError
+		if err != nil && !errors.As(err, &replyErr) {
+			conn.Close()
+			if pooled && attempt == 0 {
+				continue
+			}
+			return nil, err
+		}
+		select {
+		case c.idle <- conn:
+		default:
+			conn.Close()
+		}
+		return replies, err
+	}
+}
+
+func (c *redisClient) do(args ...string) (any, error) {
+	replies, err := c.pipeline(args)
+	if len(replies) == 0 {
+		return nil, err
+	}
+	return replies[0], err
+}
+
+func (c *redisClient) close() {
+	for {
+		select {
+		case conn := <-c.idle:
+			conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+func (rc *redisConn) exchange(cmds [][]string) ([]any, error) {
+	rc.SetDeadline(time.Now().Add(redisTimeout))
+	defer rc.SetDeadline(time.Time{})
+	for _, args := range cmds {
+		rc.writeCommand(args)
+	}
+	if err := rc.w.Flush(); err != nil {
+		return nil, err
+	}
+	replies := make([]any, len(cmds))
+	var firstErr error
+	for i := range cmds {
+		reply, err := rc.readReply()
+		var replyErr redisError
+		if errors.As(err, &replyErr) {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		replies[i] = reply
+	}
+	return replies, firstErr
+}
+
+func (rc *redisConn) writeCommand(args []string) {
+	fmt.Fprintf(rc.w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(rc.w, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+}
+
+// 读取一个回复：简单字符串为 string，整数为 int64，批量字符串为 []byte（空为 nil），
+// 数组为 []any（其中的错误回复以 redisError 值出现）
+func (rc *redisConn) readReply() (any, error) {
+	line, err := rc.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errors.New("redis: malformed reply")
+	}
+	kind, body := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, redisError(body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, errors.New("redis: malformed bulk length")
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(rc.r, buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, errors.New("redis: malformed array length")
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]any, n)
+		for i := range items {
+			item, err := rc.readReply()
+			var replyErr redisError
+			if errors.As(err, &replyErr) {
+				items[i] = replyErr
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			items[i] = item
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("redis: unexpected reply type %q", kind)
+	}
+}
+
+// 订阅频道并逐条处理消息，连接断开后每隔几秒重连，stop 关闭时返回。
+// 每次订阅成功后调用 onSubscribe，便于补偿断线期间错过的通知
+func (c *redisClient) subscribe(channel string, stop <-chan struct{}, onSubscribe func(), onError func(error), handle func([]byte)) {
+	for {
+		err := c.subscribeOnce(channel, stop, onSubscribe, handle)
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		onError(err)
+		select {
+		case <-stop:
+			return
+		case <-time.After(3 * time.Second):
+		}
+	}
+}
+
+func (c *redisClient) subscribeOnce(channel string, stop <-chan struct{}, onSubscribe func(), handle func([]byte)) error {
+	conn, err := c.dial()
+	if err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-stop:
+		case <-done:
+		}
+		conn.Close()
+	}()
+
+	conn.SetWriteDeadline(time.Now().Add(redisTimeout))
+	conn.writeCommand([]string{"SUBSCRIBE", channel})
+	if err := conn.w.Flush(); err != nil {
+		return err
+	}
+	for {
+		reply, err := conn.readReply()
+		if err != nil {
+			return err
+		}
+		items, _ := reply.([]any)
+		if len(items) < 3 {
+			continue
+		}
+		kind, _ := items[0].([]byte)
+		switch string(kind) {
+		case "subscribe":
+			onSubscribe()
+		case "message":
+			if payload, ok := items[2].([]byte); ok {
+				handle(payload)
+			}
+		}
+	}
+}
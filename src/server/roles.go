@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// 用户角色，在认证中间件中按路由检查：
+//   - viewer：查看自己能看到的设备、目标、消息和唤醒历史
+//   - operator：另外可以发送唤醒、取消消息，以及用令牌运行中继（注册、轮询、确认）
+//   - admin：另外可以管理自己能看到的设备和目标（删除设备、转移所有者、增删改目标）
+//
+// 角色只决定能做哪些操作，能看到哪些资源仍由所有者决定。服务器API密钥不受角色限制，
+// 只有它可以管理用户、组织、分组、定时任务等全局配置
+
+type role int
+
+const (
+	roleNone role = iota // 用户令牌不能访问
+	roleViewer
+	roleOperator
+	roleAdmin
+)
+
+var roleNames = map[role]string{
+	roleViewer:   "viewer",
+	roleOperator: "operator",
+	roleAdmin:    "admin",
+}
+
+func (r role) String() string {
+	if name, ok := roleNames[r]; ok {
+		return name
+	}
+	return "none"
+}
+
+func parseRole(s string) (role, error) {
+	for r, name := range roleNames {
+		if name == s {
+			return r, nil
+		}
+	}
+	return roleNone, fmt.Errorf("role must be viewer, operator or admin, got %q", s)
+}
+
+// 新用户的默认角色
+const defaultUserRole = "operator"
+
+// 路由对用户令牌要求的最低角色：GET/HEAD 使用 Read，其他方法使用 Write
+func requiredRole(method string, read, write role) role {
+	if method == http.MethodGet || method == http.MethodHead {
+		return read
+	}
+	return write
+}
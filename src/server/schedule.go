@@ -0,0 +1,359 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// 定时任务，按服务器本地时区执行：默认唤醒目标，action 为 suspend 或 shutdown 时
+// 让目标上的代理睡眠或关机（见 agent.go）
+type Schedule struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Target    string    `json:"target,omitempty"` // 目标名称，与 group 二选一
+	Group     string    `json:"group,omitempty"`  // 分组名称
+	Action    string    `json:"action,omitempty"` // 为空表示唤醒，或 suspend、shutdown
+	Time      string    `json:"time"`             // HH:MM
+	Days      []string  `json:"days,omitempty"`   // mon..sun，为空表示每天
+	Enabled   bool      `json:"enabled"`
+	Owner     string    `json:"owner,omitempty"` // 创建任务的用户，为空表示管理员创建
+	LastRun   time.Time `json:"last_run"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// 校验并规范定时任务字段
+func (s *Schedule) validate() error {
+	if (s.Target == "") == (s.Group == "") {
+		return fmt.Errorf("exactly one of target or group is required")
+	}
+	if _, err := time.Parse("15:04", s.Time); err != nil {
+		return fmt.Errorf("time must be HH:MM")
+	}
+	if s.Action == "wake" {
+		s.Action = ""
+	}
+	if s.Action != "" && !validAgentAction(s.Action) {
+		return fmt.Errorf("action must be wake, %s or %s", agentActionSuspend, agentActionShutdown)
+	}
+	return normalizeDays(s.Days)
+}
+
+// 计算 after 之后的下一次执行时间
+func (s *Schedule) nextRun(after time.Time) time.Time {
+	clock, _ := time.Parse("15:04", s.Time)
+	for i := 0; i <= 7; i++ {
+		day := after.AddDate(0, 0, i)
+		run := time.Date(day.Year(), day.Month(), day.Day(), clock.Hour(), clock.Minute(), 0, 0, after.Location())
+		if run.After(after) && s.runsOn(run.Weekday()) {
+			return run
+		}
+	}
+	return time.Time{}
+}
+
+func (s *Schedule) runsOn(day time.Weekday) bool {
+	if len(s.Days) == 0 {
+		return true
+	}
+	for _, d := range s.Days {
+		if weekdayNames[d] == day {
+			return true
+		}
+	}
+	return false
+}
+
+// 管理接口中的定时任务，附带下次执行时间
+type ScheduleView struct {
+	Schedule
+	NextRun *time.Time `json:"next_run,omitempty"`
+}
+
+func scheduleView(s Schedule) ScheduleView {
+	view := ScheduleView{Schedule: s}
+	if s.Enabled {
+		next := s.nextRun(time.Now())
+		view.NextRun = &next
+	}
+	return view
+}
+
+// 用户创建的定时任务数量，调用方持有 storage.mu
+func ownedSchedules(user string) int {
+	n := 0
+	for _, s := range storage.schedules {
+		if s.Owner == user {
+			n++
+		}
+	}
+	return n
+}
+
+// 定时任务所属用户的身份，管理员创建的任务返回管理员。调用方持有 storage.mu
+func scheduleOwner(s *Schedule) principal {
+	if s.Owner == "" {
+		return principal{}
+	}
+	p := principal{user: s.Owner, orgs: userOrgs(s.Owner)}
+	if u, exists := storage.users[s.Owner]; exists {
+		p.role, _ = parseRole(u.Role)
+	}
+	return p
+}
+
+// 调度器最近一次检查的时间（UnixNano）
+var schedulerLastTick atomic.Int64
+
+// 调度循环：每次检查上次检查之后到现在之间是否有到期任务
+func runScheduler() {
+	ticker := time.NewTicker(15 * time.Second)
+	defer ticker.Stop()
+	last := time.Now()
+	schedulerLastTick.Store(last.UnixNano())
+	for {
+		select {
+		case <-shutdownCh:
+			return
+		case now := <-ticker.C:
+			if isLeader() {
+				runDueSchedules(last, now)
+			}
+			last = now
+			schedulerLastTick.Store(now.UnixNano())
+		}
+	}
+}
+
+func runDueSchedules(from, to time.Time) {
+	storage.mu.Lock()
+	var due []Schedule
+	var owners []principal
+	for _, s := range storage.schedules {
+		if !s.Enabled {
+			continue
+		}
+		if next := s.nextRun(from); !next.IsZero() && !next.After(to) {
+			s.LastRun = to
+			due = append(due, *s)
+			owners = append(owners, scheduleOwner(s))
+		}
+	}
+	storage.mu.Unlock()
+	if len(due) > 0 {
+		markDirty()
+	}
+
+	for i, s := range due {
+		logger := slog.With("schedule_id", s.ID)
+		reqs, err := resolveWake(s.Target, s.Group, "schedule:"+s.ID)
+		if err != nil {
+			logger.Error("scheduled wake failed", "error", err)
+			continue
+		}
+		// 用户的任务按用户的权限执行：目标已不归该用户、也不再共享给他时跳过，唤醒计入用户的配额
+		owner := owners[i]
+		for _, req := range reqs {
+			if !owner.admin() && (!scheduleCanWake(owner, req.Target) || owner.role < roleOperator) {
+				logger.Warn("scheduled wake skipped, owner can no longer wake target", "owner", s.Owner, "target", req.Target)
+				continue
+			}
+			// 睡眠和关机不计入配额；目标没有在线的代理（多半已经关机）时跳过
+			if s.Action != "" {
+				if command, err := requestAgentCommand(req.Target, s.Action, "schedule:"+s.ID); err != nil {
+					logger.Info("scheduled "+s.Action+" skipped", "target", req.Target, "error", err)
+				} else {
+					logger.Info("scheduled "+s.Action+" queued", "target", req.Target, "command_id", command.ID)
+				}
+				continue
+			}
+			if err := reserveWake(owner); err != nil {
+				logger.Warn("scheduled wake skipped", "owner", s.Owner, "target", req.Target, "error", err)
+				continue
+			}
+			if _, err := queueWake(logger, req); err != nil {
+				refundWake(owner)
+				logger.Error("scheduled wake failed", "target", req.Target, "device_id", req.DeviceID, "error", err)
+			}
+		}
+	}
+}
+
+// 调度器健康检查：超过一分钟未运行视为异常
+func checkScheduler() ComponentHealth {
+	last := time.Unix(0, schedulerLastTick.Load())
+	if age := time.Since(last); age > time.Minute {
+		return ComponentHealth{Status: healthDegraded, Detail: fmt.Sprintf("last run %s ago", age.Round(time.Second))}
+	}
+	storage.mu.RLock()
+	enabled := 0
+	for _, s := range storage.schedules {
+		if s.Enabled {
+			enabled++
+		}
+	}
+	storage.mu.RUnlock()
+	return ComponentHealth{Status: healthOK, Detail: fmt.Sprintf("%d enabled", enabled)}
+}
+
+// 定时任务列表和创建。用户只能看到和管理自己创建的任务
+func schedulesHandler(w http.ResponseWriter, r *http.Request) {
+	p := requestPrincipal(r)
+	switch r.Method {
+	case http.MethodGet:
+		storage.mu.RLock()
+		schedules := make([]ScheduleView, 0, len(storage.schedules))
+		for _, s := range storage.schedules {
+			if p.owns(s.Owner) {
+				schedules = append(schedules, scheduleView(*s))
+			}
+		}
+		storage.mu.RUnlock()
+		sort.Slice(schedules, func(i, j int) bool { return schedules[i].ID < schedules[j].ID })
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"success":   true,
+			"schedules": schedules,
+			"total":     len(schedules),
+		})
+
+	case http.MethodPost:
+		var req Schedule
+		if !readJSON(w, r, &req) {
+			return
+		}
+		req.ID = fmt.Sprintf("sch_%d", time.Now().UnixNano())
+		req.CreatedAt = time.Now()
+		req.LastRun = time.Time{}
+		req.Owner = p.user
+		saveSchedule(w, r, req, true)
+
+	default:
+		methodNotAllowed(w, r)
+	}
+}
+
+// 单个定时任务：GET/PUT/DELETE /api/admin/schedules/<id>
+func scheduleHandler(w http.ResponseWriter, r *http.Request) {
+	id, _ := pathParams(r, "/api/admin/schedules/")
+	p := requestPrincipal(r)
+	switch r.Method {
+	case http.MethodGet:
+		storage.mu.RLock()
+		s, exists := storage.schedules[id]
+		exists = exists && p.owns(s.Owner)
+		var view ScheduleView
+		if exists {
+			view = scheduleView(*s)
+		}
+		storage.mu.RUnlock()
+		if !exists {
+			http.Error(w, "Schedule not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"success": true, "schedule": view})
+
+	case http.MethodPut:
+		var req Schedule
+		if !readJSON(w, r, &req) {
+			return
+		}
+		storage.mu.RLock()
+		existing, exists := storage.schedules[id]
+		exists = exists && p.owns(existing.Owner)
+		if exists {
+			req.CreatedAt = existing.CreatedAt
+			req.LastRun = existing.LastRun
+			req.Owner = existing.Owner
+		}
+		storage.mu.RUnlock()
+		if !exists {
+			http.Error(w, "Schedule not found", http.StatusNotFound)
+			return
+		}
+		req.ID = id
+		saveSchedule(w, r, req, false)
+
+	case http.MethodDelete:
+		storage.mu.Lock()
+		s, exists := storage.schedules[id]
+		exists = exists && p.owns(s.Owner)
+		if exists {
+			delete(storage.schedules, id)
+		}
+		storage.mu.Unlock()
+		if !exists {
+			http.Error(w, "Schedule not found", http.StatusNotFound)
+			return
+		}
+		markDirty()
+		requestLogger(r).Info("schedule deleted", "schedule_id", id)
+		writeJSON(w, http.StatusOK, map[string]interface{}{"success": true, "message": "Schedule deleted"})
+
+	default:
+		methodNotAllowed(w, r)
+	}
+}
+
+func saveSchedule(w http.ResponseWriter, r *http.Request, s Schedule, create bool) {
+	if err := s.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// 用户只能为自己能唤醒的目标创建任务，不能使用分组
+	p := requestPrincipal(r)
+	if s.Group != "" && !p.admin() {
+		http.Error(w, "Groups can only be scheduled with the server API key", http.StatusForbidden)
+		return
+	}
+
+	storage.mu.Lock()
+	if s.Target != "" {
+		if t, exists := storage.targets[s.Target]; !exists || !p.canWakeTarget(t) {
+			storage.mu.Unlock()
+			http.Error(w, fmt.Sprintf("target %q not found", s.Target), http.StatusBadRequest)
+			return
+		}
+	}
+	if s.Group != "" {
+		if _, exists := storage.groups[s.Group]; !exists {
+			storage.mu.Unlock()
+			http.Error(w, fmt.Sprintf("group %q not found", s.Group), http.StatusBadRequest)
+			return
+		}
+	}
+	if !create {
+		if _, exists := storage.schedules[s.ID]; !exists {
+			storage.mu.Unlock()
+			http.Error(w, "Schedule not found", http.StatusNotFound)
+			return
+		}
+	}
+	if create && s.Owner != "" {
+		if err := checkCountQuota(s.Owner, quotaMaxSchedules); err != nil {
+			storage.mu.Unlock()
+			writeQuotaError(w, err)
+			return
+		}
+	}
+	saved := s
+	storage.schedules[s.ID] = &saved
+	storage.mu.Unlock()
+
+	markDirty()
+	status, msg := http.StatusCreated, "Schedule created"
+	if !create {
+		status, msg = http.StatusOK, "Schedule updated"
+	}
+	requestLogger(r).Info(strings.ToLower(msg), "schedule_id", s.ID, "action", s.Action, "time", s.Time, "target", s.Target, "group", s.Group, "enabled", s.Enabled)
+	writeJSON(w, status, map[string]interface{}{"success": true, "message": msg, "schedule": scheduleView(s)})
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 消息搜索：GET /api/wol/messages/search，按目标、设备、状态、请求者和时间范围过滤，
+// 按创建时间排序，用游标分页。用户令牌只能搜到自己能看到的消息
+
+const (
+	defaultSearchLimit = 50
+	maxSearchLimit     = 500
+)
+
+// 消息搜索条件
+type messageQuery struct {
+	targetMAC string
+	target    string
+	deviceID  string
+	statuses  map[string]bool
+	requester string
+	kind      string // wake、command 或空（全部）
+	since     time.Time
+	until     time.Time
+	ascending bool
+	limit     int
+	after     *searchCursor
+}
+
+// 分页游标：上一页最后一条消息的创建时间和ID
+type searchCursor struct {
+	createdAt int64
+	id        string
+}
+
+func (c searchCursor) encode() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(c.createdAt, 10) + ":" + c.id))
+}
+
+func decodeSearchCursor(s string) (*searchCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	nanos, id, ok := strings.Cut(string(raw), ":")
+	if !ok || id == "" {
+		return nil, fmt.Errorf("malformed cursor")
+	}
+	createdAt, err := strconv.ParseInt(nanos, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &searchCursor{createdAt: createdAt, id: id}, nil
+}
+
+// 解析时间参数：RFC 3339 时间，或相对现在的时长（例如 7d 表示7天前）
+func parseSearchTime(s string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	span, err := parseSpan(s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("must be an RFC 3339 time or a duration such as 7d")
+	}
+	return now.Add(-span), nil
+}
+
+func parseMessageQuery(q url.Values) (*messageQuery, error) {
+	mq := &messageQuery{
+		target:    q.Get("target"),
+		deviceID:  q.Get("device_id"),
+		requester: q.Get("requester"),
+		kind:      q.Get("type"),
+		limit:     defaultSearchLimit,
+	}
+	if mac := q.Get("target_mac"); mac != "" {
+		normalized, err := normalizeMAC(mac)
+		if err != nil {
+			return nil, err
+		}
+		mq.targetMAC = normalized
+	}
+	if s := q.Get("status"); s != "" {
+		mq.statuses = make(map[string]bool)
+		for _, status := range strings.Split(s, ",") {
+			switch status {
+			case messageCreated, messageQueued, messageDelivered, messageAcked, messageFailed, messageCancelled, messagePendingApproval:
+				mq.statuses[status] = true
+			default:
+				return nil, fmt.Errorf("unknown status %q", status)
+			}
+		}
+	}
+	switch mq.kind {
+	case "", "wake", "command":
+	default:
+		return nil, fmt.Errorf("type must be wake or command")
+	}
+	now := time.Now()
+	for _, p := range []struct {
+		name string
+		dst  *time.Time
+	}{{"since", &mq.since}, {"until", &mq.until}} {
+		if v := q.Get(p.name); v != "" {
+			t, err := parseSearchTime(v, now)
+			if err != nil {
+				return nil, fmt.Errorf("%s %s", p.name, err)
+			}
+			*p.dst = t
+		}
+	}
+	switch q.Get("order") {
+	case "", "desc":
+	case "asc":
+		mq.ascending = true
+	default:
+		return nil, fmt.Errorf("order must be asc or desc")
+	}
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxSearchLimit {
+			return nil, fmt.Errorf("limit must be between 1 and %d", maxSearchLimit)
+		}
+		mq.limit = n
+	}
+	if v := q.Get("cursor"); v != "" {
+		cursor, err := decodeSearchCursor(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cursor")
+		}
+		mq.after = cursor
+	}
+	return mq, nil
+}
+
+func (mq *messageQuery) match(m *WOLMessage) bool {
+	switch {
+	case mq.targetMAC != "" && !strings.EqualFold(m.TargetMAC, mq.targetMAC),
+		mq.target != "" && m.Target != mq.target,
+		mq.deviceID != "" && m.DeviceID != mq.deviceID,
+		mq.statuses != nil && !mq.statuses[m.Status],
+		mq.kind == "wake" && m.Type != "",
+		mq.kind == "command" && m.Type == "",
+		!mq.since.IsZero() && m.CreatedAt.Before(mq.since),
+		!mq.until.IsZero() && !m.CreatedAt.Before(mq.until):
+		return false
+	}
+	// 请求者可以是完整来源（schedule:abc）、用户名或来源类别（schedule）
+	if mq.requester != "" && m.Source != mq.requester && wakeRequester(m) != mq.requester {
+		return false
+	}
+	return true
+}
+
+// 按排序方向比较两条消息：a 在 b 之前时返回 true
+func (mq *messageQuery) before(aNanos int64, aID string, bNanos int64, bID string) bool {
+	if aNanos != bNanos {
+		return (aNanos < bNanos) == mq.ascending
+	}
+	if aID == bID {
+		return false
+	}
+	return (aID < bID) == mq.ascending
+}
+
+func searchMessages(w http.ResponseWriter, r *http.Request) {
+	mq, err := parseMessageQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	p := requestPrincipal(r)
+	storage.mu.RLock()
+	matched := make([]WOLMessage, 0)
+	for _, m := range storage.messages {
+		if mq.match(m) && p.canSeeMessage(m) {
+			matched = append(matched, *m)
+		}
+	}
+	storage.mu.RUnlock()
+
+	sort.Slice(matched, func(i, j int) bool {
+		return mq.before(matched[i].CreatedAt.UnixNano(), matched[i].ID, matched[j].CreatedAt.UnixNano(), matched[j].ID)
+	})
+	total := len(matched)
+	page := matched
+	if mq.after != nil {
+		start := sort.Search(len(page), func(i int) bool {
+			return mq.before(mq.after.createdAt, mq.after.id, page[i].CreatedAt.UnixNano(), page[i].ID)
+		})
+		page = page[start:]
+	}
+	resp := map[string]interface{}{
+		"success": true,
+		"total":   total,
+	}
+	if len(page) > mq.limit {
+		page = page[:mq.limit]
+		last := page[len(page)-1]
+		resp["next_cursor"] = searchCursor{createdAt: last.CreatedAt.UnixNano(), id: last.ID}.encode()
+	}
+	resp["messages"] = page
+	writeJSON(w, http.StatusOK, resp)
+}
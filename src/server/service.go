@@ -0,0 +1,79 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+// Windows 服务：在常开的 Windows 小主机上以系统服务运行服务器。
+// 实现依赖 golang.org/x/sys/windows/svc，位于 service_windows.go，需要在 Windows 上用 -tags winservice 编译；
+// 默认构建只使用标准库，不包含服务支持
+
+const defaultServiceName = "esp32-wol"
+
+// 安装、卸载、启动、停止和查询服务，编译时未包含服务支持时为 nil
+var controlService func(name, action string, serveArgs []string) error
+
+// 进程由服务管理器启动时接管运行：在服务中调用 run 并返回 true；
+// 不是以服务启动时返回 false。编译时未包含服务支持时为 nil
+var runAsService func(name string, run func()) bool
+
+// 服务管理器等外部的停止请求，serve 收到后与 SIGTERM 一样优雅关闭
+var stopRequests = make(chan struct{}, 1)
+
+func requestStop() {
+	select {
+	case stopRequests <- struct{}{}:
+	default:
+	}
+}
+
+// service install|uninstall|start|stop|status [-name 服务名] [-- serve 参数]
+func serviceCommand(args []string) {
+	fs := flag.NewFlagSet("service", flag.ExitOnError)
+	name := fs.String("name", defaultServiceName, "服务名称")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "用法: %s service <install|uninstall|start|stop|status> [-name 服务名] [serve 参数...]\n\n", programName())
+		fmt.Fprintln(fs.Output(), "install 之后的 serve 参数会写入服务的启动命令，例如:")
+		fmt.Fprintf(fs.Output(), "  %s service install -config C:\\esp32-wol\\wol.json -data-file C:\\esp32-wol\\state.json\n\n", programName())
+		fs.PrintDefaults()
+	}
+	if len(args) == 0 || args[0] == "-h" || args[0] == "-help" || args[0] == "--help" {
+		fs.Usage()
+		os.Exit(2)
+	}
+	action := args[0]
+	rest := args[1:]
+	// -name 只能紧跟在动作之后，其余参数原样传给 serve
+	if len(rest) >= 2 && (rest[0] == "-name" || rest[0] == "--name") {
+		fs.Parse(rest[:2])
+		rest = rest[2:]
+	}
+	switch action {
+	case "install":
+		if len(rest) > 0 && rest[0] == "--" {
+			rest = rest[1:]
+		}
+		// 提前检查参数，避免安装后服务无法启动
+		parseServeFlags("service install", rest)
+	case "uninstall", "start", "stop", "status":
+		if len(rest) > 0 {
+			fmt.Fprintf(os.Stderr, "%s takes no serve arguments\n", action)
+			os.Exit(2)
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "unknown service action %q\n\n", action)
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	if controlService == nil {
+		fmt.Fprintln(os.Stderr, "this binary was built without Windows service support (build on Windows with -tags winservice)")
+		os.Exit(1)
+	}
+	if err := controlService(*name, action, rest); err != nil {
+		fmt.Fprintf(os.Stderr, "service %s: %v\n", action, err)
+		os.Exit(1)
+	}
+}
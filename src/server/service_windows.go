@@ -0,0 +1,181 @@
+//go:build windows && winservice
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+func init() {
+	controlService = controlWindowsService
+	runAsService = runWindowsService
+}
+
+// 停止服务时等待的最长时间，应大于 -drain-delay 与 -shutdown-timeout 之和
+const serviceStopWait = 60 * time.Second
+
+func controlWindowsService(name, action string, serveArgs []string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("connect to service manager (run as administrator): %w", err)
+	}
+	defer m.Disconnect()
+
+	if action == "install" {
+		return installService(m, name, serveArgs)
+	}
+	s, err := m.OpenService(name)
+	if err != nil {
+		return fmt.Errorf("open service %s: %w", name, err)
+	}
+	defer s.Close()
+
+	switch action {
+	case "uninstall":
+		if status, err := s.Query(); err == nil && status.State != svc.Stopped {
+			if err := stopService(s); err != nil {
+				return err
+			}
+		}
+		if err := s.Delete(); err != nil {
+			return err
+		}
+		fmt.Printf("service %s removed\n", name)
+	case "start":
+		if err := s.Start(); err != nil {
+			return err
+		}
+		fmt.Printf("service %s started\n", name)
+	case "stop":
+		if err := stopService(s); err != nil {
+			return err
+		}
+		fmt.Printf("service %s stopped\n", name)
+	case "status":
+		status, err := s.Query()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s: %s\n", name, serviceStateName(status.State))
+	}
+	return nil
+}
+
+func installService(m *mgr.Mgr, name string, serveArgs []string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if exe, err = filepath.Abs(exe); err != nil {
+		return err
+	}
+	if s, err := m.OpenService(name); err == nil {
+		s.Close()
+		return fmt.Errorf("service %s already exists", name)
+	}
+	s, err := m.CreateService(name, exe, mgr.Config{
+		DisplayName: "ESP32 WOL Server",
+		Description: "Relays Wake-on-LAN requests to ESP32 devices.",
+		StartType:   mgr.StartAutomatic,
+	}, append([]string{"serve"}, serveArgs...)...)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	// 异常退出后自动重启：前两次5秒后，之后1分钟后，一天内无异常时重新计数
+	err = s.SetRecoveryActions([]mgr.RecoveryAction{
+		{Type: mgr.ServiceRestart, Delay: 5 * time.Second},
+		{Type: mgr.ServiceRestart, Delay: 5 * time.Second},
+		{Type: mgr.ServiceRestart, Delay: time.Minute},
+	}, uint32((24 * time.Hour).Seconds()))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "warning: cannot set recovery actions: %v\n", err)
+	}
+	fmt.Printf("service %s installed: %s serve %v\n", name, exe, serveArgs)
+	return nil
+}
+
+func stopService(s *mgr.Service) error {
+	status, err := s.Control(svc.Stop)
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(serviceStopWait)
+	for status.State != svc.Stopped {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("service did not stop within %s", serviceStopWait)
+		}
+		time.Sleep(300 * time.Millisecond)
+		if status, err = s.Query(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func serviceStateName(state svc.State) string {
+	switch state {
+	case svc.Stopped:
+		return "stopped"
+	case svc.StartPending:
+		return "starting"
+	case svc.StopPending:
+		return "stopping"
+	case svc.Running:
+		return "running"
+	case svc.PausePending, svc.Paused, svc.ContinuePending:
+		return "paused"
+	}
+	return fmt.Sprintf("state %d", state)
+}
+
+func runWindowsService(name string, run func()) bool {
+	isService, err := svc.IsWindowsService()
+	if err != nil || !isService {
+		return false
+	}
+	// 服务的工作目录是 System32，切换到程序所在目录，使相对路径（-data-file 等）按安装位置解析
+	if exe, err := os.Executable(); err == nil {
+		os.Chdir(filepath.Dir(exe))
+	}
+	if err := svc.Run(name, &serviceHandler{run: run}); err != nil {
+		fmt.Fprintf(os.Stderr, "service %s failed: %v\n", name, err)
+		os.Exit(1)
+	}
+	return true
+}
+
+type serviceHandler struct {
+	run func()
+}
+
+func (h *serviceHandler) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.run()
+	}()
+	const accepts = svc.AcceptStop | svc.AcceptShutdown
+	status <- svc.Status{State: svc.Running, Accepts: accepts}
+	for {
+		select {
+		case <-done:
+			return false, 0
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Interrogate:
+				status <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending, WaitHint: uint32(serviceStopWait / time.Millisecond)}
+				requestStop()
+			}
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"net/http"
+	"strings"
+)
+
+// 目标共享：所有者可以把单个目标共享给其他用户，只读（read）或可唤醒（wake）。
+// 共享的只是目标本身，对方看不到负责唤醒的中继，也看不到所有者的其他资源
+
+const (
+	shareRead = "read"
+	shareWake = "wake"
+)
+
+// 用户对目标的访问级别：owner（所有者或所属组织成员、管理员）、wake、read，无权访问时为空。
+// 调用方持有 storage.mu
+func (p principal) targetAccess(t *Target) string {
+	if p.owns(t.Owner) {
+		return "owner"
+	}
+	return t.Shares[p.user]
+}
+
+func (p principal) canWakeTarget(t *Target) bool {
+	access := p.targetAccess(t)
+	return access == "owner" || access == shareWake
+}
+
+// 定时任务的所有者是否仍能唤醒该目标，按名称查找目标
+func scheduleCanWake(owner principal, target string) bool {
+	storage.mu.RLock()
+	defer storage.mu.RUnlock()
+	t, exists := storage.targets[target]
+	return exists && owner.canWakeTarget(t)
+}
+
+// 用户能看到自己资源上的消息，以及自己通过共享目标发起的唤醒
+func (p principal) canSeeMessage(m *WOLMessage) bool {
+	return p.owns(m.Owner) || (p.user != "" && m.Source == "user:"+p.user)
+}
+
+// 接口中的目标：共享给当前用户的目标附带访问级别，并隐藏中继和共享列表
+type TargetView struct {
+	Target
+	Access string `json:"access,omitempty"`
+}
+
+// 调用方持有 storage.mu
+func targetView(p principal, t *Target) TargetView {
+	view := TargetView{Target: *t}
+	view.Shares = maps.Clone(t.Shares)
+	if access := p.targetAccess(t); access != "owner" {
+		view.Access = access
+		view.DeviceID = ""
+		view.Shares = nil
+	}
+	return view
+}
+
+// 失去唤醒权限后，删除用户为该目标创建的定时任务，调用方持有 storage.mu
+func removeShareSchedules(target, user string) int {
+	removed := 0
+	for id, s := range storage.schedules {
+		if s.Target == target && s.Owner == user {
+			delete(storage.schedules, id)
+			removed++
+		}
+	}
+	return removed
+}
+
+// 删除用户时撤销共享给他的目标，调用方持有 storage.mu
+func removeUserShares(user string) {
+	for _, t := range storage.targets {
+		delete(t.Shares, user)
+		if len(t.Shares) == 0 {
+			t.Shares = nil
+		}
+	}
+}
+
+// 共享管理：PUT /api/admin/targets/<name>/shares/<user> {"access": "read"|"wake"}，
+// DELETE 同一路径取消共享。只有目标的所有者可以操作
+func targetShareHandler(w http.ResponseWriter, r *http.Request, name, user string) {
+	var access string
+	switch r.Method {
+	case http.MethodPut:
+		var req struct {
+			Access string `json:"access"`
+		}
+		if !readJSON(w, r, &req) {
+			return
+		}
+		if req.Access != shareRead && req.Access != shareWake {
+			http.Error(w, "access must be read or wake", http.StatusBadRequest)
+			return
+		}
+		access = req.Access
+	case http.MethodDelete:
+	default:
+		methodNotAllowed(w, r)
+		return
+	}
+
+	p := requestPrincipal(r)
+	schedules := 0
+	storage.mu.Lock()
+	t, exists := storage.targets[name]
+	if !exists || p.targetAccess(t) == "" {
+		storage.mu.Unlock()
+		http.Error(w, "Target not found", http.StatusNotFound)
+		return
+	}
+	if !p.owns(t.Owner) {
+		storage.mu.Unlock()
+		http.Error(w, "Only the target's owner can share it", http.StatusForbidden)
+		return
+	}
+	if access != "" {
+		if _, found := storage.users[user]; !found {
+			storage.mu.Unlock()
+			http.Error(w, fmt.Sprintf("user %q not found", user), http.StatusBadRequest)
+			return
+		}
+		if user == t.Owner {
+			storage.mu.Unlock()
+			http.Error(w, "Cannot share a target with its owner", http.StatusBadRequest)
+			return
+		}
+		if t.Shares == nil {
+			t.Shares = make(map[string]string)
+		}
+		t.Shares[user] = access
+		if access == shareRead {
+			schedules = removeShareSchedules(name, user)
+		}
+	} else {
+		if _, shared := t.Shares[user]; !shared {
+			storage.mu.Unlock()
+			http.Error(w, "Share not found", http.StatusNotFound)
+			return
+		}
+		delete(t.Shares, user)
+		if len(t.Shares) == 0 {
+			t.Shares = nil
+		}
+		schedules = removeShareSchedules(name, user)
+	}
+	view := targetView(p, t)
+	storage.mu.Unlock()
+
+	markDirty()
+	msg := "Target shared"
+	if access == "" {
+		msg = "Target share removed"
+	}
+	requestLogger(r).Info(strings.ToLower(msg), "target", name, "user", user, "access", access, "schedules_deleted", schedules)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"success": true, "message": msg, "target": view})
+}
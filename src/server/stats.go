@@ -0,0 +1,420 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 按分钟统计最近一小时的消息吞吐量
+type throughputTracker struct {
+	mu      sync.Mutex
+	buckets [60]throughputBucket
+}
+
+type throughputBucket struct {
+	minute int64 // Unix分钟数，用于判断桶是否过期
+	counts map[string]int64
+}
+
+var throughput = &throughputTracker{}
+
+func (t *throughputTracker) add(event string, n int) {
+	minute := time.Now().Unix() / 60
+	t.mu.Lock()
+	b := &t.buckets[minute%60]
+	if b.minute != minute || b.counts == nil {
+		b.minute = minute
+		b.counts = make(map[string]int64)
+	}
+	b.counts[event] += int64(n)
+	t.mu.Unlock()
+}
+
+// 最近 minutes 分钟（含当前分钟）内各事件的计数
+func (t *throughputTracker) sum(minutes int) map[string]int64 {
+	now := time.Now().Unix() / 60
+	result := map[string]int64{messageQueued: 0, messageDelivered: 0, messageAcked: 0, messageFailed: 0, messageCancelled: 0}
+	t.mu.Lock()
+	for _, b := range t.buckets {
+		if b.counts != nil && now-b.minute < int64(minutes) {
+			for event, n := range b.counts {
+				result[event] += n
+			}
+		}
+	}
+	t.mu.Unlock()
+	return result
+}
+
+// 记录消息生命周期事件：更新 Prometheus 计数和吞吐量统计
+func countMessages(event string, n int) {
+	wolMessagesTotal.add(float64(n), event)
+	throughput.add(event, n)
+}
+
+// 服务器统计
+type StatsResponse struct {
+	Uptime            string                      `json:"uptime"`
+	UptimeSeconds     int64                       `json:"uptime_seconds"`
+	StartedAt         time.Time                   `json:"started_at"`
+	Goroutines        int                         `json:"goroutines"`
+	HeapBytes         uint64                      `json:"heap_bytes"`
+	Allocs            uint64                      `json:"allocs"`
+	Devices           DeviceTotals                `json:"devices"`
+	Messages          map[string]int              `json:"messages"`
+	PendingTotal      int                         `json:"pending_total"`
+	ActiveLongPoll    int64                       `json:"active_long_polls"`
+	MaxLongPolls      int64                       `json:"max_long_polls"`
+	LongPollsRejected int64                       `json:"long_polls_rejected"`
+	Throughput        map[string]map[string]int64 `json:"throughput"`
+}
+
+// 设备数量
+type DeviceTotals struct {
+	Total   int `json:"total"`
+	Online  int `json:"online"`
+	Offline int `json:"offline"`
+}
+
+// 服务器统计概览
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	resp := StatsResponse{
+		Uptime:            time.Since(startTime).Round(time.Second).String(),
+		UptimeSeconds:     int64(time.Since(startTime).Seconds()),
+		StartedAt:         startTime,
+		Goroutines:        runtime.NumGoroutine(),
+		HeapBytes:         mem.HeapAlloc,
+		Allocs:            mem.Mallocs,
+		Messages:          make(map[string]int),
+		ActiveLongPoll:    activeLongPolls.Load(),
+		MaxLongPolls:      maxLongPolls,
+		LongPollsRejected: longPollsRejected.Load(),
+		Throughput: map[string]map[string]int64{
+			"1m":  throughput.sum(1),
+			"5m":  throughput.sum(5),
+			"15m": throughput.sum(15),
+			"60m": throughput.sum(60),
+		},
+	}
+
+	storage.mu.RLock()
+	for _, device := range storage.devices {
+		resp.Devices.Total++
+		if device.Online {
+			resp.Devices.Online++
+		}
+	}
+	for _, message := range storage.messages {
+		resp.Messages[message.Status]++
+	}
+	storage.mu.RUnlock()
+	for _, depth := range queues.depths() {
+		resp.PendingTotal += depth
+	}
+	resp.Devices.Offline = resp.Devices.Total - resp.Devices.Online
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// 单个设备的统计信息
+type DeviceStatsEntry struct {
+	DeviceID string      `json:"device_id"`
+	Name     string      `json:"name"`
+	Online   bool        `json:"online"`
+	LastSeen time.Time   `json:"last_seen"`
+	Pending  int         `json:"pending"`
+	Stats    DeviceStats `json:"stats"`
+}
+
+// 设备统计（按设备ID排序）
+func deviceStatsHandler(w http.ResponseWriter, r *http.Request) {
+	p := requestPrincipal(r)
+	storage.mu.RLock()
+	entries := make([]DeviceStatsEntry, 0, len(storage.devices))
+	for id, device := range storage.devices {
+		if !p.owns(device.Owner) {
+			continue
+		}
+		entries = append(entries, DeviceStatsEntry{
+			DeviceID: id,
+			Name:     device.Name,
+			Online:   device.Online,
+			LastSeen: device.LastSeen,
+			Pending:  queues.len(id),
+			Stats:    device.Stats,
+		})
+	}
+	storage.mu.RUnlock()
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].DeviceID < entries[j].DeviceID })
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"devices": entries,
+		"total":   len(entries),
+	})
+}
+
+// 解析时长参数，在 time.ParseDuration 基础上支持天，例如 7d
+func parseSpan(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return d, nil
+}
+
+// 唤醒历史中的一个时间桶
+type HistoryBucket struct {
+	Time   time.Time      `json:"time"`
+	Total  int            `json:"total"`
+	Counts map[string]int `json:"counts"`
+}
+
+// 唤醒历史
+type HistoryResponse struct {
+	Bucket  string          `json:"bucket"`
+	Range   string          `json:"range"`
+	By      string          `json:"by"`
+	Start   time.Time       `json:"start"`
+	End     time.Time       `json:"end"`
+	Totals  map[string]int  `json:"totals"`
+	Buckets []HistoryBucket `json:"buckets"`
+}
+
+// 单次查询最多返回的时间桶数量
+const maxHistoryBuckets = 2000
+
+// 唤醒历史聚合：GET /api/stats/history?bucket=1h&range=7d&by=target
+// by 可选 status（默认）、target、device；可用 target、device_id 参数过滤。
+// 数据来自服务器内存中的消息记录，所有时间桶都会返回（没有消息的计数为0），便于直接绘图
+func historyHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	bucketParam, rangeParam, by := q.Get("bucket"), q.Get("range"), q.Get("by")
+	if bucketParam == "" {
+		bucketParam = "1h"
+	}
+	if rangeParam == "" {
+		rangeParam = "24h"
+	}
+	if by == "" {
+		by = "status"
+	}
+	bucket, err := parseSpan(bucketParam)
+	if err != nil || bucket < time.Minute {
+		http.Error(w, "bucket must be a duration of at least 1m, e.g. 1h or 1d", http.StatusBadRequest)
+		return
+	}
+	span, err := parseSpan(rangeParam)
+	if err != nil {
+		http.Error(w, "range must be a duration, e.g. 24h or 7d", http.StatusBadRequest)
+		return
+	}
+	if span/bucket > maxHistoryBuckets {
+		http.Error(w, fmt.Sprintf("range/bucket must not exceed %d buckets", maxHistoryBuckets), http.StatusBadRequest)
+		return
+	}
+	var key func(m *WOLMessage) string
+	switch by {
+	case "status":
+		key = func(m *WOLMessage) string { return m.Status }
+	case "target":
+		key = func(m *WOLMessage) string {
+			if m.Target != "" {
+				return m.Target
+			}
+			if m.Type != "" {
+				return m.Type
+			}
+			return m.TargetMAC
+		}
+	case "device":
+		key = func(m *WOLMessage) string { return m.DeviceID }
+	default:
+		http.Error(w, "by must be status, target or device", http.StatusBadRequest)
+		return
+	}
+	filterTarget, filterDevice := q.Get("target"), q.Get("device_id")
+
+	end := time.Now().Truncate(bucket).Add(bucket)
+	start := end.Add(-span).Truncate(bucket)
+	resp := HistoryResponse{
+		Bucket: bucketParam,
+		Range:  rangeParam,
+		By:     by,
+		Start:  start,
+		End:    end,
+		Totals: make(map[string]int),
+	}
+	for t := start; t.Before(end); t = t.Add(bucket) {
+		resp.Buckets = append(resp.Buckets, HistoryBucket{Time: t, Counts: make(map[string]int)})
+	}
+
+	// 用户只统计自己能看到的消息
+	p := requestPrincipal(r)
+	storage.mu.RLock()
+	for _, m := range storage.messages {
+		if m.CreatedAt.Before(start) || !m.CreatedAt.Before(end) || !p.canSeeMessage(m) {
+			continue
+		}
+		if filterTarget != "" && m.Target != filterTarget && m.TargetMAC != filterTarget {
+			continue
+		}
+		if filterDevice != "" && m.DeviceID != filterDevice {
+			continue
+		}
+		b := &resp.Buckets[int(m.CreatedAt.Sub(start)/bucket)]
+		k := key(m)
+		b.Counts[k]++
+		b.Total++
+		resp.Totals[k]++
+	}
+	storage.mu.RUnlock()
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// 一组唤醒的统计
+type WakeStatsEntry struct {
+	Key       string `json:"key"`
+	Total     int    `json:"total"`
+	Acked     int    `json:"acked"`
+	Failed    int    `json:"failed"`
+	Cancelled int    `json:"cancelled"`
+	Pending   int    `json:"pending"` // 尚未确认（未注册设备的消息也计入）
+	// 成功率 = acked / (acked + failed)，没有已完成的唤醒时省略
+	SuccessRate *float64   `json:"success_rate,omitempty"`
+	LastWake    *time.Time `json:"last_wake,omitempty"`
+}
+
+// 唤醒统计
+type WakeStatsResponse struct {
+	GroupBy string           `json:"group_by"`
+	Range   string           `json:"range"`
+	Start   time.Time        `json:"start"`
+	End     time.Time        `json:"end"`
+	Total   WakeStatsEntry   `json:"total"`
+	Groups  []WakeStatsEntry `json:"groups"`
+}
+
+// 按请求者分组的键：用户令牌为用户名，其他来源为来源类别（api、schedule、hook、link 等）
+func wakeRequester(m *WOLMessage) string {
+	if name, ok := strings.CutPrefix(m.Source, "user:"); ok {
+		return name
+	}
+	if kind, _, ok := strings.Cut(m.Source, ":"); ok {
+		return kind
+	}
+	if m.Source == "" {
+		return "unknown"
+	}
+	return m.Source
+}
+
+func (e *WakeStatsEntry) add(m *WOLMessage) {
+	e.Total++
+	switch m.Status {
+	case messageAcked:
+		e.Acked++
+	case messageFailed:
+		e.Failed++
+	case messageCancelled:
+		e.Cancelled++
+	default:
+		e.Pending++
+	}
+	if e.LastWake == nil || m.CreatedAt.After(*e.LastWake) {
+		created := m.CreatedAt
+		e.LastWake = &created
+	}
+}
+
+func (e *WakeStatsEntry) finish() {
+	if done := e.Acked + e.Failed; done > 0 {
+		rate := math.Round(float64(e.Acked)/float64(done)*1000) / 1000
+		e.SuccessRate = &rate
+	}
+}
+
+// 唤醒统计：GET /api/stats/wakes?group_by=target&range=30d
+// group_by 可选 target（默认）、device、user，按唤醒次数从多到少排序；只统计唤醒消息，不含重启等管理命令。
+// 消息只保存在内存中，统计范围不超过服务器本次运行的时间
+func wakeStatsHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	groupBy, rangeParam := q.Get("group_by"), q.Get("range")
+	if groupBy == "" {
+		groupBy = "target"
+	}
+	if rangeParam == "" {
+		rangeParam = "30d"
+	}
+	span, err := parseSpan(rangeParam)
+	if err != nil {
+		http.Error(w, "range must be a duration, e.g. 24h or 30d", http.StatusBadRequest)
+		return
+	}
+	var key func(m *WOLMessage) string
+	switch groupBy {
+	case "target":
+		key = func(m *WOLMessage) string { return firstNonEmpty(m.Target, m.TargetMAC) }
+	case "device":
+		key = func(m *WOLMessage) string { return m.DeviceID }
+	case "user":
+		key = wakeRequester
+	default:
+		http.Error(w, "group_by must be target, device or user", http.StatusBadRequest)
+		return
+	}
+
+	end := time.Now()
+	start := end.Add(-span)
+	resp := WakeStatsResponse{GroupBy: groupBy, Range: rangeParam, Start: start, End: end, Total: WakeStatsEntry{Key: "total"}}
+	groups := make(map[string]*WakeStatsEntry)
+
+	// 用户只统计自己能看到的消息
+	p := requestPrincipal(r)
+	storage.mu.RLock()
+	for _, m := range storage.messages {
+		if m.Type != "" || m.CreatedAt.Before(start) || !p.canSeeMessage(m) {
+			continue
+		}
+		k := key(m)
+		g, exists := groups[k]
+		if !exists {
+			g = &WakeStatsEntry{Key: k}
+			groups[k] = g
+		}
+		g.add(m)
+		resp.Total.add(m)
+	}
+	storage.mu.RUnlock()
+
+	resp.Groups = make([]WakeStatsEntry, 0, len(groups))
+	for _, g := range groups {
+		g.finish()
+		resp.Groups = append(resp.Groups, *g)
+	}
+	resp.Total.finish()
+	sort.Slice(resp.Groups, func(i, j int) bool {
+		if resp.Groups[i].Total != resp.Groups[j].Total {
+			return resp.Groups[i].Total > resp.Groups[j].Total
+		}
+		return resp.Groups[i].Key < resp.Groups[j].Key
+	})
+	writeJSON(w, http.StatusOK, resp)
+}
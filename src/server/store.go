@@ -0,0 +1,479 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 状态文件格式版本
+const stateVersion = 1
+
+// 持久化到状态文件的内容；消息队列只在正常关闭时写入（Pending），运行中仍只保存在内存中
+type persistedState struct {
+	Version   int         `json:"version"`
+	SavedAt   time.Time   `json:"saved_at"`
+	Devices   []*Device   `json:"devices"`
+	Targets   []*Target   `json:"targets"`
+	Groups    []*Group    `json:"groups"`
+	Schedules []*Schedule `json:"schedules"`
+	WakeLinks []*WakeLink `json:"wake_links,omitempty"`
+
+	Enrollments []*Enrollment `json:"enrollments,omitempty"`
+	Firmware    []*Firmware   `json:"firmware,omitempty"`
+
+	OAuthGrants []*OAuthGrant `json:"oauth_grants,omitempty"`
+	Users       []*User       `json:"users,omitempty"`
+	Orgs        []*Org        `json:"orgs,omitempty"`
+	APIKeys     []*APIKey     `json:"api_keys,omitempty"`
+
+	Maintenance *Maintenance `json:"maintenance,omitempty"`
+
+	Energy []*EnergyDay `json:"energy,omitempty"`
+
+	// 关闭时尚未被设备确认的消息，下次启动时重新入队
+	Pending []*WOLMessage `json:"pending,omitempty"`
+	// 等待批准的唤醒（pending_approval），每次保存时写入，重启后继续等待
+	Approvals []*WOLMessage `json:"approvals,omitempty"`
+}
+
+// 状态文件路径，为空表示不持久化
+var dataFile string
+
+// 自上次保存后状态是否有变化
+var stateDirty atomic.Bool
+
+// 保证同一时间只有一个写入者
+var saveMu sync.Mutex
+
+// 最近一次保存失败的错误，供健康检查使用
+var lastSaveErr atomic.Value
+
+// 标记状态已变化，由后台任务定期写入文件
+func markDirty() {
+	stateDirty.Store(true)
+}
+
+// 状态文件迁移，键为源版本：stateMigrations[n] 把版本 n 的文件升级到 n+1
+var stateMigrations = map[int]func(raw map[string]json.RawMessage) error{
+	// 缺少 version 字段（例如手工编写）的文件与版本1结构相同
+	0: func(raw map[string]json.RawMessage) error { return nil },
+}
+
+// 读取状态文件的版本号
+func stateFileVersion(raw map[string]json.RawMessage) (int, error) {
+	version := 0
+	if v, ok := raw["version"]; ok {
+		if err := json.Unmarshal(v, &version); err != nil {
+			return 0, fmt.Errorf("invalid version: %w", err)
+		}
+	}
+	return version, nil
+}
+
+// 将状态文件内容升级到当前版本，返回原始版本
+func migrateState(raw map[string]json.RawMessage) (int, error) {
+	from, err := stateFileVersion(raw)
+	if err != nil {
+		return 0, err
+	}
+	if from > stateVersion {
+		return from, fmt.Errorf("state file has version %d, this server supports up to %d", from, stateVersion)
+	}
+	for v := from; v < stateVersion; v++ {
+		migrate, ok := stateMigrations[v]
+		if !ok {
+			return from, fmt.Errorf("no migration from state version %d", v)
+		}
+		if err := migrate(raw); err != nil {
+			return from, fmt.Errorf("migrate state version %d to %d: %w", v, v+1, err)
+		}
+		raw["version"] = json.RawMessage(strconv.Itoa(v + 1))
+	}
+	return from, nil
+}
+
+// 读取并解析状态文件；文件不存在时返回 nil。版本较旧时需先执行 migrate 子命令
+func readStateFile(path string) (*persistedState, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	version, err := stateFileVersion(raw)
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	if version > stateVersion {
+		return nil, fmt.Errorf("%s has version %d, this server supports up to %d", path, version, stateVersion)
+	}
+	if version < stateVersion {
+		return nil, fmt.Errorf("%s has version %d, run the migrate command to upgrade it to version %d", path, version, stateVersion)
+	}
+
+	var state persistedState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	return &state, nil
+}
+
+// 从状态文件恢复设备、目标、分组和定时任务，文件不存在时视为空状态
+func loadState(path string) error {
+	state, err := readStateFile(path)
+	if err != nil || state == nil {
+		return err
+	}
+
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	for _, d := range state.Devices {
+		// 重启后设备需重新轮询才算在线
+		d.Online = false
+		storage.devices[d.ID] = d
+	}
+	for _, t := range state.Targets {
+		storage.targets[t.Name] = t
+	}
+	for _, g := range state.Groups {
+		storage.groups[g.Name] = g
+	}
+	for _, sch := range state.Schedules {
+		storage.schedules[sch.ID] = sch
+	}
+	for _, l := range state.WakeLinks {
+		storage.wakeLinks[l.ID] = l
+	}
+	for _, e := range state.Enrollments {
+		storage.enrollments[e.ID] = e
+	}
+	for _, f := range state.Firmware {
+		storage.firmware[f.ID] = f
+	}
+	for _, g := range state.OAuthGrants {
+		storage.oauthGrants[g.ID] = g
+	}
+	for _, u := range state.Users {
+		upgradeUser(u)
+		storage.users[u.Name] = u
+	}
+	for _, o := range state.Orgs {
+		storage.orgs[o.Name] = o
+	}
+	for _, k := range state.APIKeys {
+		storage.apiKeys[k.ID] = k
+	}
+	storage.maintenance = state.Maintenance
+	for _, e := range state.Energy {
+		storage.energy[energyKey{e.Target, e.Date}] = e
+	}
+	for _, m := range state.Approvals {
+		storage.messages[m.ID] = m
+	}
+	if state.Maintenance != nil {
+		slog.Warn("maintenance mode is on, new wake requests are rejected", "since", state.Maintenance.Since, "reason", state.Maintenance.Reason)
+	}
+	loadedPending = state.Pending
+	slog.Info("state loaded", "path", path, "devices", len(state.Devices), "targets", len(state.Targets),
+		"groups", len(state.Groups), "schedules", len(state.Schedules), "pending_messages", len(state.Pending), "pending_approvals", len(state.Approvals))
+	return nil
+}
+
+// 状态文件中上次关闭时未确认的消息，连接 Redis 之后由 restorePending 重新入队
+var loadedPending []*WOLMessage
+
+func restorePending() {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	for _, m := range loadedPending {
+		if _, exists := storage.devices[m.DeviceID]; !exists {
+			continue
+		}
+		m.Status = messageQueued
+		if err := queues.push(m.DeviceID, m); err != nil {
+			slog.Error("failed to restore pending message", "device_id", m.DeviceID, "message_id", m.ID, "error", err)
+			continue
+		}
+		storage.messages[m.ID] = m
+	}
+	loadedPending = nil
+}
+
+// 用其他副本保存的状态替换目标、分组、定时任务、唤醒链接、注册码、固件、OAuth 授权、用户、组织、API密钥和用电记录（高可用模式）。
+// 设备由调用方合并，保留本副本的在线状态和运行计数
+func replaceSharedState(state *persistedState) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	storage.targets = make(map[string]*Target, len(state.Targets))
+	for _, t := range state.Targets {
+		storage.targets[t.Name] = t
+	}
+	storage.groups = make(map[string]*Group, len(state.Groups))
+	for _, g := range state.Groups {
+		storage.groups[g.Name] = g
+	}
+	storage.schedules = make(map[string]*Schedule, len(state.Schedules))
+	for _, sch := range state.Schedules {
+		storage.schedules[sch.ID] = sch
+	}
+	storage.wakeLinks = make(map[string]*WakeLink, len(state.WakeLinks))
+	for _, l := range state.WakeLinks {
+		storage.wakeLinks[l.ID] = l
+	}
+	storage.enrollments = make(map[string]*Enrollment, len(state.Enrollments))
+	for _, e := range state.Enrollments {
+		storage.enrollments[e.ID] = e
+	}
+	storage.firmware = make(map[string]*Firmware, len(state.Firmware))
+	for _, f := range state.Firmware {
+		storage.firmware[f.ID] = f
+	}
+	storage.oauthGrants = make(map[string]*OAuthGrant, len(state.OAuthGrants))
+	for _, g := range state.OAuthGrants {
+		storage.oauthGrants[g.ID] = g
+	}
+	storage.users = make(map[string]*User, len(state.Users))
+	for _, u := range state.Users {
+		upgradeUser(u)
+		storage.users[u.Name] = u
+	}
+	storage.orgs = make(map[string]*Org, len(state.Orgs))
+	for _, o := range state.Orgs {
+		storage.orgs[o.Name] = o
+	}
+	storage.apiKeys = make(map[string]*APIKey, len(state.APIKeys))
+	for _, k := range state.APIKeys {
+		storage.apiKeys[k.ID] = k
+	}
+	storage.maintenance = state.Maintenance
+	storage.energy = make(map[energyKey]*EnergyDay, len(state.Energy))
+	for _, e := range state.Energy {
+		storage.energy[energyKey{e.Target, e.Date}] = e
+	}
+	// 消息由副本之间同步，这里只补上本副本还不知道的等待批准的唤醒
+	for _, m := range state.Approvals {
+		if _, exists := storage.messages[m.ID]; !exists {
+			storage.messages[m.ID] = m
+		}
+	}
+}
+
+// 复制当前状态，调用方需持有 storage.mu 读锁
+func snapshotState() persistedState {
+	state := persistedState{Version: stateVersion, SavedAt: time.Now()}
+	for _, d := range storage.devices {
+		copied := *d
+		copied.Tags = append([]string(nil), d.Tags...)
+		state.Devices = append(state.Devices, &copied)
+	}
+	for _, t := range storage.targets {
+		copied := *t
+		copied.Shares = maps.Clone(t.Shares)
+		copied.Destinations = append([]string(nil), t.Destinations...)
+		state.Targets = append(state.Targets, &copied)
+	}
+	for _, g := range storage.groups {
+		copied := *g
+		copied.Targets = append([]string(nil), g.Targets...)
+		state.Groups = append(state.Groups, &copied)
+	}
+	for _, s := range storage.schedules {
+		copied := *s
+		copied.Days = append([]string(nil), s.Days...)
+		state.Schedules = append(state.Schedules, &copied)
+	}
+	for _, l := range storage.wakeLinks {
+		copied := *l
+		state.WakeLinks = append(state.WakeLinks, &copied)
+	}
+	for _, e := range storage.enrollments {
+		copied := *e
+		copied.CertFingerprints = append([]string(nil), e.CertFingerprints...)
+		if e.UsedAt != nil {
+			used := *e.UsedAt
+			copied.UsedAt = &used
+		}
+		state.Enrollments = append(state.Enrollments, &copied)
+	}
+	for _, f := range storage.firmware {
+		copied := *f
+		copied.Rollout.Tags = append([]string(nil), f.Rollout.Tags...)
+		state.Firmware = append(state.Firmware, &copied)
+	}
+	for _, g := range storage.oauthGrants {
+		copied := *g
+		state.OAuthGrants = append(state.OAuthGrants, &copied)
+	}
+	for _, u := range storage.users {
+		copied := *u
+		copied.Tokens = make([]*UserToken, len(u.Tokens))
+		for i, t := range u.Tokens {
+			token := *t
+			copied.Tokens[i] = &token
+		}
+		if u.Quota != nil {
+			q := *u.Quota
+			copied.Quota = &q
+		}
+		state.Users = append(state.Users, &copied)
+	}
+	for _, o := range storage.orgs {
+		copied := *o
+		copied.Members = append([]string(nil), o.Members...)
+		state.Orgs = append(state.Orgs, &copied)
+	}
+	for _, k := range storage.apiKeys {
+		copied := *k
+		state.APIKeys = append(state.APIKeys, &copied)
+	}
+	if storage.maintenance != nil {
+		m := *storage.maintenance
+		state.Maintenance = &m
+	}
+	for _, e := range storage.energy {
+		copied := *e
+		state.Energy = append(state.Energy, &copied)
+	}
+	for _, m := range storage.messages {
+		if m.Status == messagePendingApproval {
+			copied := *m
+			copied.Destinations = append([]string(nil), m.Destinations...)
+			state.Approvals = append(state.Approvals, &copied)
+		}
+	}
+	// 固定顺序，便于对比和版本管理
+	sort.Slice(state.Devices, func(i, j int) bool { return state.Devices[i].ID < state.Devices[j].ID })
+	sort.Slice(state.Targets, func(i, j int) bool { return state.Targets[i].Name < state.Targets[j].Name })
+	sort.Slice(state.Groups, func(i, j int) bool { return state.Groups[i].Name < state.Groups[j].Name })
+	sort.Slice(state.Schedules, func(i, j int) bool { return state.Schedules[i].ID < state.Schedules[j].ID })
+	sort.Slice(state.WakeLinks, func(i, j int) bool { return state.WakeLinks[i].ID < state.WakeLinks[j].ID })
+	sort.Slice(state.Enrollments, func(i, j int) bool { return state.Enrollments[i].ID < state.Enrollments[j].ID })
+	sort.Slice(state.Firmware, func(i, j int) bool { return state.Firmware[i].ID < state.Firmware[j].ID })
+	sort.Slice(state.OAuthGrants, func(i, j int) bool { return state.OAuthGrants[i].ID < state.OAuthGrants[j].ID })
+	sort.Slice(state.Users, func(i, j int) bool { return state.Users[i].Name < state.Users[j].Name })
+	sort.Slice(state.Orgs, func(i, j int) bool { return state.Orgs[i].Name < state.Orgs[j].Name })
+	sort.Slice(state.APIKeys, func(i, j int) bool { return state.APIKeys[i].ID < state.APIKeys[j].ID })
+	sort.Slice(state.Energy, func(i, j int) bool {
+		if state.Energy[i].Target != state.Energy[j].Target {
+			return state.Energy[i].Target < state.Energy[j].Target
+		}
+		return state.Energy[i].Date < state.Energy[j].Date
+	})
+	sort.Slice(state.Approvals, func(i, j int) bool { return state.Approvals[i].ID < state.Approvals[j].ID })
+	return state
+}
+
+// 将当前状态写入文件：先写临时文件再重命名，避免写到一半时崩溃损坏原文件。
+// 高可用模式下同时写入 Redis 供其他副本载入
+func saveState() error {
+	return writeState(false)
+}
+
+// 关闭时的最后一次保存：HTTP 服务器已停止，队列不再变化，同时保存尚未确认的消息，
+// 重启后重新下发，避免容器重启丢失进行中的唤醒。多副本模式下队列在 Redis 中，不需要保存
+func saveFinalState() error {
+	return writeState(cluster == nil)
+}
+
+func writeState(withPending bool) error {
+	if dataFile == "" && !haEnabled {
+		return nil
+	}
+	saveMu.Lock()
+	defer saveMu.Unlock()
+
+	stateDirty.Store(false)
+	storage.mu.RLock()
+	state := snapshotState()
+	if withPending {
+		for _, m := range queues.unacknowledged() {
+			copied := *m
+			state.Pending = append(state.Pending, &copied)
+		}
+	}
+	storage.mu.RUnlock()
+
+	var err error
+	if dataFile != "" {
+		err = writeStateFile(dataFile, state)
+	}
+	if err == nil && haEnabled && cluster != nil {
+		err = cluster.saveSharedState(state)
+	}
+	if err != nil {
+		stateDirty.Store(true)
+		lastSaveErr.Store(err.Error())
+		return err
+	}
+	lastSaveErr.Store("")
+	return nil
+}
+
+func writeStateFile(path string, state persistedState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// 定期保存有变化的状态
+func runStateFlusher(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-shutdownCh:
+			return
+		case <-ticker.C:
+			if !stateDirty.Load() {
+				continue
+			}
+			if err := saveState(); err != nil {
+				slog.Error("failed to save state", "path", dataFile, "error", err)
+			}
+		}
+	}
+}
+
+// 状态文件健康检查：最近一次保存失败时降级
+func checkStateFile() ComponentHealth {
+	if msg, _ := lastSaveErr.Load().(string); msg != "" {
+		return ComponentHealth{Status: healthDegraded, Detail: "last save failed: " + msg}
+	}
+	return ComponentHealth{Status: healthOK, Detail: dataFile}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// systemd 集成：
+//   - 套接字激活：由 .socket 单元创建监听套接字并传给服务器（LISTEN_FDS、LISTEN_FDNAMES），
+//     监听地址写作 systemd://[名称]。重启服务期间套接字一直由 systemd 持有，新连接在队列中等待而不会被拒绝
+//   - 就绪通知：Type=notify 时在监听器就绪后发送 READY=1，收到退出信号时发送 STOPPING=1，
+//     设置了 WatchdogSec 时定期发送 WATCHDOG=1
+
+// systemd 传入的第一个文件描述符
+const systemdListenFDsStart = 3
+
+type systemdSocket struct {
+	name     string
+	listener net.Listener
+	used     bool
+}
+
+// 继承的监听套接字，按 systemd 传入的顺序
+var systemdSockets []*systemdSocket
+
+// 读取 systemd 传入的监听套接字，并清除相关环境变量，避免传给子进程（例如 cloudflared）
+func inheritSystemdSockets() error {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	for i := 0; i < count; i++ {
+		name := "unknown"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(systemdListenFDsStart+i), name)
+		// FileListener 复制了描述符（带 close-on-exec），原描述符随即关闭
+		listener, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("socket %d (%s) from systemd: %v", systemdListenFDsStart+i, name, err)
+		}
+		systemdSockets = append(systemdSockets, &systemdSocket{name: name, listener: listener})
+	}
+	return nil
+}
+
+// 按 FileDescriptorName 取继承的套接字，name 为空时取全部。每个套接字只能使用一次
+func takeSystemdListeners(name string) ([]net.Listener, error) {
+	var listeners []net.Listener
+	for _, s := range systemdSockets {
+		if name != "" && s.name != name {
+			continue
+		}
+		if s.used {
+			return nil, fmt.Errorf("systemd socket %s (%s) is already used by another listener", s.name, s.listener.Addr())
+		}
+		s.used = true
+		listeners = append(listeners, s.listener)
+	}
+	if len(listeners) == 0 {
+		if len(systemdSockets) == 0 {
+			return nil, fmt.Errorf("no sockets passed by systemd (is the service started by a .socket unit?)")
+		}
+		return nil, fmt.Errorf("no socket named %q passed by systemd", name)
+	}
+	return listeners, nil
+}
+
+// 关闭没有被任何监听地址使用的套接字
+func closeUnusedSystemdSockets() {
+	for _, s := range systemdSockets {
+		if !s.used {
+			slog.Warn("socket passed by systemd is not used by any listener", "name", s.name, "addr", s.listener.Addr().String())
+			s.listener.Close()
+		}
+	}
+}
+
+// 第一个继承的 TCP 套接字的地址，用于推导本机访问地址
+func systemdTCPAddr(name string) (host, port string, ok bool) {
+	for _, s := range systemdSockets {
+		if name != "" && s.name != name {
+			continue
+		}
+		if addr, isTCP := s.listener.Addr().(*net.TCPAddr); isTCP {
+			host, port, err := net.SplitHostPort(addr.String())
+			return host, port, err == nil
+		}
+	}
+	return "", "", false
+}
+
+// 向 systemd 发送状态通知（sd_notify），未在 systemd 下运行时不做任何事
+func sdNotify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	// 抽象命名空间的套接字
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		slog.Warn("systemd notification failed", "state", state, "error", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		slog.Warn("systemd notification failed", "state", state, "error", err)
+	}
+}
+
+// 设置了 WatchdogSec 时按一半的间隔发送心跳，服务器关闭时停止
+func runSystemdWatchdog() {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	interval := time.Duration(usec) * time.Microsecond / 2
+	slog.Info("systemd watchdog enabled", "interval", interval.String())
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-shutdownCh:
+			return
+		case <-ticker.C:
+			sdNotify("WATCHDOG=1")
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Tailscale 监听器：-listen tailscale://主机名[:端口]，服务器作为独立节点加入 tailnet，无需开放公网端口。
+// 实现依赖 tailscale.com/tsnet，位于 tailscale_tsnet.go，需要用 -tags tailscale 编译
+
+// 配置文件中的 tailscale 段
+type TailscaleConfig struct {
+	AuthKey   string `json:"auth_key"`  // 为空时使用环境变量 TS_AUTHKEY，都没有时在日志中输出登录链接
+	StateDir  string `json:"state_dir"` // 节点状态目录，默认 tailscale
+	Ephemeral bool   `json:"ephemeral"` // 临时节点，退出后自动从 tailnet 移除
+}
+
+var tailscaleConfig *TailscaleConfig
+
+// 在 tailnet 上监听，编译时未包含 Tailscale 支持时为 nil
+var listenTailscale func(hostname, port string) (net.Listener, error)
+
+// 关闭 tailnet 节点，在HTTP服务器关闭之后调用
+var closeTailscale func()
+
+// 解析 tailscale://主机名[:端口]，端口默认80；端口为443时使用 tailnet 自动签发的HTTPS证书
+func parseTailscaleAddr(addr string) (hostname, port string, err error) {
+	hostname = strings.TrimPrefix(addr, "tailscale://")
+	port = "80"
+	if h, p, splitErr := net.SplitHostPort(hostname); splitErr == nil {
+		hostname, port = h, p
+	}
+	if hostname == "" || strings.ContainsAny(hostname, "./") {
+		return "", "", fmt.Errorf("tailscale listener needs a machine name, e.g. tailscale://esp32-wol")
+	}
+	if listenTailscale == nil {
+		return "", "", fmt.Errorf("this binary was built without Tailscale support (build with -tags tailscale)")
+	}
+	return hostname, port, nil
+}
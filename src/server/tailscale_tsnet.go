@@ -0,0 +1,70 @@
+//go:build tailscale
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"path/filepath"
+	"sync"
+
+	"tailscale.com/tsnet"
+)
+
+func init() {
+	listenTailscale = tsnetListen
+	closeTailscale = tsnetClose
+}
+
+// 每个主机名一个 tailnet 节点，多个 -listen 可共用
+var tsnetNodes = struct {
+	sync.Mutex
+	servers map[string]*tsnet.Server
+}{servers: make(map[string]*tsnet.Server)}
+
+func tsnetListen(hostname, port string) (net.Listener, error) {
+	tsnetNodes.Lock()
+	defer tsnetNodes.Unlock()
+
+	srv, exists := tsnetNodes.servers[hostname]
+	if !exists {
+		cfg := tailscaleConfig
+		if cfg == nil {
+			cfg = &TailscaleConfig{}
+		}
+		dir := cfg.StateDir
+		if dir == "" {
+			dir = "tailscale"
+		}
+		logger := slog.With("component", "tailscale", "hostname", hostname)
+		srv = &tsnet.Server{
+			Hostname:  hostname,
+			AuthKey:   cfg.AuthKey,
+			Dir:       filepath.Join(dir, hostname),
+			Ephemeral: cfg.Ephemeral,
+			// tsnet 的内部日志很多，只在 debug 级别输出；需要登录时的链接通过 UserLogf 输出
+			Logf:     func(format string, args ...any) { logger.Debug(fmt.Sprintf(format, args...)) },
+			UserLogf: func(format string, args ...any) { logger.Info(fmt.Sprintf(format, args...)) },
+		}
+		if err := srv.Start(); err != nil {
+			return nil, err
+		}
+		tsnetNodes.servers[hostname] = srv
+	}
+
+	if port == "443" {
+		return srv.ListenTLS("tcp", ":443")
+	}
+	return srv.Listen("tcp", ":"+port)
+}
+
+func tsnetClose() {
+	tsnetNodes.Lock()
+	defer tsnetNodes.Unlock()
+	for hostname, srv := range tsnetNodes.servers {
+		if err := srv.Close(); err != nil {
+			slog.Warn("failed to close tailscale node", "hostname", hostname, "error", err)
+		}
+	}
+}
@@ -0,0 +1,840 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// 命名的唤醒目标，绑定负责发送魔术包的中继设备
+type Target struct {
+	Name        string       `json:"name"`
+	MacAddress  string       `json:"mac_address"`
+	DeviceID    string       `json:"device_id"`
+	Description string       `json:"description,omitempty"`
+	Probe       *TargetProbe `json:"probe,omitempty"` // 开机状态检测，可选
+	Owner       string       `json:"owner,omitempty"` // 所属用户或组织（org:<name>），为空时只有管理员可见
+	// 受保护的目标：唤醒需要另一位管理员批准，见 approval.go。只有服务器API密钥可以修改
+	Protected bool `json:"protected,omitempty"`
+	// 允许唤醒的时段，为空表示不限制，见 hours.go
+	AllowedHours []TimeWindow `json:"allowed_hours,omitempty"`
+	// 两次唤醒的最短间隔，覆盖 -wake-cooldown，"0s" 表示不限制，见 cooldown.go
+	Cooldown *Duration `json:"cooldown,omitempty"`
+	// 空闲或定时自动睡眠、关机，需要目标上运行代理，见 agent.go
+	PowerPolicy *PowerPolicy `json:"power_policy,omitempty"`
+	// 魔术包的发送地址，中继按顺序发送到每个地址，为空时使用中继默认的广播地址，见 destinations.go
+	Destinations []string `json:"destinations,omitempty"`
+	// 估算的开机功率和睡眠、关机时的待机功率（W），用于用电统计，见 energy.go
+	Watts        float64 `json:"watts,omitempty"`
+	StandbyWatts float64 `json:"standby_watts,omitempty"`
+	// 共享给其他用户：用户名 -> read 或 wake，见 shares.go
+	Shares    map[string]string `json:"shares,omitempty"`
+	CreatedAt time.Time         `json:"created_at"`
+}
+
+// 目标分组，唤醒分组即唤醒其中所有目标
+type Group struct {
+	Name        string    `json:"name"`
+	Targets     []string  `json:"targets"`
+	Description string    `json:"description,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// 目标和分组名称：字母数字开头，可包含 . _ -
+var namePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// 将MAC地址规范为大写冒号分隔格式
+func normalizeMAC(s string) (string, error) {
+	hw, err := net.ParseMAC(strings.TrimSpace(s))
+	if err != nil || len(hw) != 6 {
+		return "", fmt.Errorf("invalid MAC address %q", s)
+	}
+	return strings.ToUpper(hw.String()), nil
+}
+
+var errDeviceNotApproved = errors.New("device not approved")
+
+// 一次唤醒请求
+type wakeRequest struct {
+	Type      string // 管理命令的类型，唤醒为空
+	DeviceID  string
+	TargetMAC string
+	Target    string // 目标名称，直接指定MAC时为空
+	Source    string // 请求来源，例如 api、schedule:<id>
+	Owner     string // 目标的所有者，直接指定MAC时使用设备的所有者
+	Override  bool   // 管理员越过目标的允许时段
+	// 发送地址，为空时使用目标的 destinations
+	Destinations []string
+}
+
+// 创建WOL消息并加入设备队列。设备未注册时消息仅被记录，不进入队列
+func queueWake(logger *slog.Logger, req wakeRequest) (WOLMessage, error) {
+	message := &WOLMessage{
+		ID:        fmt.Sprintf("msg_%d", time.Now().UnixNano()),
+		Type:      req.Type,
+		DeviceID:  req.DeviceID,
+		TargetMAC: req.TargetMAC,
+		Target:    req.Target,
+		Source:    req.Source,
+		Owner:     req.Owner,
+		Status:    messageCreated,
+		CreatedAt: time.Now(),
+	}
+
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	// 维护模式只暂停唤醒，重启、WiFi扫描等管理命令照常下发
+	if storage.maintenance != nil && req.Type == "" {
+		logger.Warn("wol message rejected", "device_id", req.DeviceID, "target_mac", req.TargetMAC, "error", errMaintenance)
+		return WOLMessage{}, errMaintenance
+	}
+	device, exists := storage.devices[req.DeviceID]
+	if exists && !device.Approved {
+		return WOLMessage{}, errDeviceNotApproved
+	}
+	if message.Owner == "" && exists {
+		message.Owner = device.Owner
+	}
+	if req.Type == "" {
+		message.Destinations = wakeDestinations(req)
+	}
+	if req.Type == "" && !req.Override {
+		if err := checkAllowedHours(req, time.Now()); err != nil {
+			logger.Warn("wol message rejected", "device_id", req.DeviceID, "target_mac", req.TargetMAC, "target", req.Target, "source", req.Source, "error", err)
+			return WOLMessage{}, err
+		}
+	}
+	if req.Type == "" {
+		if target := protectedTarget(req); target != "" {
+			requestApproval(logger, message, target)
+			return *message, nil
+		}
+	}
+	return enqueueMessage(logger, message)
+}
+
+// 将新建或刚批准的消息加入设备队列，设备未注册时仅记录。调用方持有 storage.mu 写锁
+func enqueueMessage(logger *slog.Logger, message *WOLMessage) (WOLMessage, error) {
+	device, exists := storage.devices[message.DeviceID]
+	if exists && !device.Approved {
+		return WOLMessage{}, errDeviceNotApproved
+	}
+	if exists {
+		if err := checkBackpressure(message.DeviceID); err != nil {
+			logger.Warn("wol message rejected", "device_id", message.DeviceID, "target_mac", message.TargetMAC, "error", err)
+			return WOLMessage{}, err
+		}
+		if message.Type == "" {
+			if err := checkCooldown(message); err != nil {
+				logger.Warn("wol message rejected", "device_id", message.DeviceID, "target_mac", message.TargetMAC, "target", message.Target, "source", message.Source, "error", err)
+				return WOLMessage{}, err
+			}
+		}
+	}
+	storage.messages[message.ID] = message
+	if !exists {
+		message.Status = messageCreated
+		replicateMessage(message)
+		logger.Warn("wol message created for unregistered device", "device_id", message.DeviceID, "message_id", message.ID, "target_mac", message.TargetMAC)
+		return *message, nil
+	}
+
+	message.Status = messageQueued
+	queuedAt := time.Now()
+	message.QueuedAt = &queuedAt
+	if err := queues.push(message.DeviceID, message); err != nil {
+		message.Status = messageFailed
+		message.Error = "queue unavailable"
+		countMessages(messageFailed, 1)
+		logger.Error("failed to queue wol message", "device_id", message.DeviceID, "message_id", message.ID, "error", err)
+		return WOLMessage{}, fmt.Errorf("queue message: %w", err)
+	}
+	device.Stats.MessagesQueued++
+	if message.Type == "" {
+		recordWake(message.TargetMAC, time.Now())
+	}
+	replicateMessage(message)
+	countMessages(messageQueued, 1)
+	logger.Info("wol message queued", "device_id", message.DeviceID, "message_id", message.ID, "type", message.Type, "target_mac", message.TargetMAC, "target", message.Target, "source", message.Source)
+	data := messageEventData(message, map[string]any{"source": message.Source})
+	if message.Target != "" {
+		data["target"] = message.Target
+	}
+	events.publish(Event{Type: eventMessageQueued, DeviceID: message.DeviceID, MessageID: message.ID, Data: data})
+	return *message, nil
+}
+
+// 试运行的结果：一次唤醒请求会被如何处理
+type WakePlan struct {
+	Target       string `json:"target,omitempty"`
+	DeviceID     string `json:"device_id"`
+	TargetMAC    string `json:"target_mac"`
+	Action       string `json:"action"` // queue：进入设备队列；record：设备未注册，仅记录；reject：会被拒绝；approval：等待批准
+	Error        string `json:"error,omitempty"`
+	DeviceOnline bool   `json:"device_online"`
+	QueueDepth   int    `json:"queue_depth"`
+	Power        string `json:"power,omitempty"` // 目标的检测状态，未配置检测时省略
+	// 中继的邻居表中没有该MAC地址、只有其他中继看到过时的提示，见 neighbors.go
+	Warning string `json:"warning,omitempty"`
+}
+
+const (
+	planQueue    = "queue"
+	planRecord   = "record"
+	planReject   = "reject"
+	planApproval = "approval" // 受保护的目标，需要另一位管理员批准
+)
+
+// 按 queueWake 的规则检查唤醒请求，不创建消息、不入队、不发布事件
+func planWake(req wakeRequest) WakePlan {
+	plan := WakePlan{Target: req.Target, DeviceID: req.DeviceID, TargetMAC: req.TargetMAC, Action: planQueue}
+	if req.Type == "" {
+		if _, err := normalizeMAC(req.TargetMAC); err != nil {
+			plan.Action, plan.Error = planReject, err.Error()
+			return plan
+		}
+		plan.Warning = neighborCoverage(req.TargetMAC, req.DeviceID)
+	}
+	if req.Target != "" {
+		if state := targetPower(req.Target); state != powerUnknown {
+			plan.Power = state
+		}
+	}
+
+	storage.mu.RLock()
+	defer storage.mu.RUnlock()
+	device, exists := storage.devices[req.DeviceID]
+	if exists {
+		plan.DeviceOnline = device.Online
+		plan.QueueDepth = queues.len(req.DeviceID)
+	}
+	switch {
+	case storage.maintenance != nil && req.Type == "":
+		plan.Action, plan.Error = planReject, errMaintenance.Error()
+	case !exists:
+		plan.Action, plan.Error = planRecord, "device not registered, the message would be recorded but not delivered"
+	case !device.Approved:
+		plan.Action, plan.Error = planReject, errDeviceNotApproved.Error()
+	case req.Type == "" && !req.Override && checkAllowedHours(req, time.Now()) != nil:
+		plan.Action, plan.Error = planReject, checkAllowedHours(req, time.Now()).Error()
+	case req.Type == "" && protectedTarget(req) != "":
+		plan.Action = planApproval
+	default:
+		if err := queueLimitError(req.DeviceID); err != nil {
+			plan.Action, plan.Error = planReject, err.Error()
+		} else if req.Type == "" {
+			if err := cooldownRemaining(req, time.Now()); err != nil {
+				plan.Action, plan.Error = planReject, err.Error()
+			}
+		}
+	}
+	return plan
+}
+
+// 消息事件的数据：目标MAC，管理命令附带类型
+func messageEventData(message *WOLMessage, data map[string]any) map[string]any {
+	if data == nil {
+		data = make(map[string]any)
+	}
+	data["target_mac"] = message.TargetMAC
+	if message.Type != "" {
+		data["type"] = message.Type
+	}
+	return data
+}
+
+var (
+	errMessageNotFound       = errors.New("message not found")
+	errMessageNotCancellable = errors.New("message can no longer be cancelled")
+)
+
+// 取消尚未下发的消息（排队中、仅被记录或等待批准的消息）；已下发给设备的消息无法取消
+func cancelWake(logger *slog.Logger, messageID string) error {
+	storage.mu.Lock()
+	message, exists := storage.messages[messageID]
+	if !exists {
+		storage.mu.Unlock()
+		return errMessageNotFound
+	}
+	if message.Status != messageQueued && message.Status != messageCreated && message.Status != messagePendingApproval {
+		status := message.Status
+		storage.mu.Unlock()
+		return fmt.Errorf("message is %s: %w", status, errMessageNotCancellable)
+	}
+	// 集群模式下消息可能已被其他副本下发，状态还没有同步过来
+	if !queues.remove(message.DeviceID, messageID) && message.Status == messageQueued {
+		storage.mu.Unlock()
+		return fmt.Errorf("message is %s: %w", messageDelivered, errMessageNotCancellable)
+	}
+	message.Status = messageCancelled
+	replicateMessage(message)
+	deviceID, data := message.DeviceID, messageEventData(message, nil)
+	storage.mu.Unlock()
+
+	countMessages(messageCancelled, 1)
+	logger.Info("wol message cancelled", "device_id", deviceID, "message_id", messageID)
+	events.publish(Event{Type: eventMessageCancelled, DeviceID: deviceID, MessageID: messageID, Data: data})
+	return nil
+}
+
+// 目标最近一次唤醒
+type TargetWake struct {
+	MessageID string    `json:"message_id"`
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+// 超过这个时间仍未确认的唤醒不再视为进行中，避免中继未回复确认时目标一直显示为正在唤醒
+const wakeWindow = 5 * time.Minute
+
+// 唤醒是否仍在进行中（尚未确认或失败）
+func (w *TargetWake) inProgress() bool {
+	if w == nil || time.Since(w.Time) > wakeWindow {
+		return false
+	}
+	return w.Status == messageCreated || w.Status == messageQueued || w.Status == messageDelivered
+}
+
+// 目标最近一次唤醒，没有记录时返回 nil。调用方需持有 storage.mu 读锁
+func lastTargetWake(name string) *TargetWake {
+	var last *WOLMessage
+	for _, m := range storage.messages {
+		if m.Target == name && (last == nil || m.CreatedAt.After(last.CreatedAt)) {
+			last = m
+		}
+	}
+	if last == nil {
+		return nil
+	}
+	return &TargetWake{MessageID: last.ID, Status: last.Status, Error: last.Error, Time: last.CreatedAt}
+}
+
+var errTargetNotFound = errors.New("target not found")
+
+// 取消目标进行中的唤醒；没有进行中的唤醒或唤醒已下发给中继时不做任何事
+func cancelTargetWake(logger *slog.Logger, name string) error {
+	storage.mu.RLock()
+	_, exists := storage.targets[name]
+	last := lastTargetWake(name)
+	storage.mu.RUnlock()
+	if !exists {
+		return errTargetNotFound
+	}
+	if !last.inProgress() {
+		return nil
+	}
+	if err := cancelWake(logger, last.MessageID); err != nil && !errors.Is(err, errMessageNotCancellable) {
+		return err
+	}
+	return nil
+}
+
+// 将目标或分组名称解析为唤醒请求
+func resolveWake(target, group, source string) ([]wakeRequest, error) {
+	storage.mu.RLock()
+	defer storage.mu.RUnlock()
+
+	names := []string{target}
+	if group != "" {
+		g, exists := storage.groups[group]
+		if !exists {
+			return nil, fmt.Errorf("group %q not found", group)
+		}
+		names = g.Targets
+	}
+	reqs := make([]wakeRequest, 0, len(names))
+	for _, name := range names {
+		t, exists := storage.targets[name]
+		if !exists {
+			return nil, fmt.Errorf("target %q not found", name)
+		}
+		reqs = append(reqs, wakeRequest{DeviceID: t.DeviceID, TargetMAC: t.MacAddress, Target: t.Name, Source: source, Owner: t.Owner})
+	}
+	return reqs, nil
+}
+
+// 目标列表和创建
+func targetsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		p := requestPrincipal(r)
+		storage.mu.RLock()
+		targets := make([]TargetView, 0, len(storage.targets))
+		for _, t := range storage.targets {
+			if p.targetAccess(t) != "" {
+				targets = append(targets, targetView(p, t))
+			}
+		}
+		storage.mu.RUnlock()
+		sort.Slice(targets, func(i, j int) bool { return targets[i].Name < targets[j].Name })
+		writeJSONCached(w, r, map[string]interface{}{
+			"success": true,
+			"targets": targets,
+			"total":   len(targets),
+		})
+
+	case http.MethodPost:
+		var req Target
+		if !readJSON(w, r, &req) {
+			return
+		}
+		saveTarget(w, r, "", req)
+
+	default:
+		methodNotAllowed(w, r)
+	}
+}
+
+// 单个目标：GET/PUT/DELETE /api/admin/targets/<name>，共享：/api/admin/targets/<name>/shares/<user>，
+// 睡眠和关机：POST /api/admin/targets/<name>/suspend|shutdown
+func targetHandler(w http.ResponseWriter, r *http.Request) {
+	name, action := pathParams(r, "/api/admin/targets/")
+	if user, ok := strings.CutPrefix(action, "shares/"); ok && user != "" {
+		targetShareHandler(w, r, name, user)
+		return
+	}
+	if action == agentActionSuspend || action == agentActionShutdown {
+		if r.Method != http.MethodPost {
+			methodNotAllowed(w, r)
+			return
+		}
+		targetPowerCommand(w, r, name, action)
+		return
+	}
+	if action != "" {
+		http.NotFound(w, r)
+		return
+	}
+	p := requestPrincipal(r)
+	storage.mu.RLock()
+	var access string
+	if t, exists := storage.targets[name]; exists {
+		access = p.targetAccess(t)
+	}
+	storage.mu.RUnlock()
+	if access == shareRead || access == shareWake {
+		if r.Method == http.MethodPut || r.Method == http.MethodDelete {
+			http.Error(w, "Target is shared with you, only its owner can change it", http.StatusForbidden)
+			return
+		}
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		storage.mu.RLock()
+		t, exists := storage.targets[name]
+		exists = exists && p.targetAccess(t) != ""
+		var view TargetView
+		if exists {
+			view = targetView(p, t)
+		}
+		storage.mu.RUnlock()
+		if !exists {
+			http.Error(w, "Target not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"success": true, "target": view})
+
+	case http.MethodPut:
+		var req Target
+		if !readJSON(w, r, &req) {
+			return
+		}
+		if req.Name == "" {
+			req.Name = name
+		}
+		saveTarget(w, r, name, req)
+
+	case http.MethodDelete:
+		storage.mu.Lock()
+		t, exists := storage.targets[name]
+		if !exists || !p.owns(t.Owner) {
+			storage.mu.Unlock()
+			http.Error(w, "Target not found", http.StatusNotFound)
+			return
+		}
+		// 被共享用户的定时任务随目标删除，不阻止删除
+		if ref := targetReference(name, t.Shares); ref != "" {
+			storage.mu.Unlock()
+			http.Error(w, "Target is used by "+ref, http.StatusConflict)
+			return
+		}
+		for user := range t.Shares {
+			removeShareSchedules(name, user)
+		}
+		delete(storage.targets, name)
+		renameEnergy(name, "")
+		storage.mu.Unlock()
+		forgetAgent(name)
+
+		markDirty()
+		requestLogger(r).Info("target deleted", "target", name)
+		writeJSON(w, http.StatusOK, map[string]interface{}{"success": true, "message": "Target deleted"})
+
+	default:
+		methodNotAllowed(w, r)
+	}
+}
+
+// 创建（oldName 为空）或更新目标
+func saveTarget(w http.ResponseWriter, r *http.Request, oldName string, req Target) {
+	if !namePattern.MatchString(req.Name) {
+		http.Error(w, "name must be 1-64 letters, digits, '.', '_' or '-'", http.StatusBadRequest)
+		return
+	}
+	mac, err := normalizeMAC(req.MacAddress)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.DeviceID == "" {
+		http.Error(w, "device_id is required", http.StatusBadRequest)
+		return
+	}
+	if err := validateProbe(req.Probe); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for i := range req.AllowedHours {
+		if err := req.AllowedHours[i].validate(); err != nil {
+			http.Error(w, "allowed_hours: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if req.Cooldown != nil && *req.Cooldown < 0 {
+		http.Error(w, "cooldown must not be negative", http.StatusBadRequest)
+		return
+	}
+	if req.PowerPolicy != nil {
+		if err := req.PowerPolicy.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if err := validateDestinations(req.Destinations); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateWatts(req.Watts, req.StandbyWatts); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// 时段和冷却时间随目标一起修改，省略时清除
+	target := &Target{
+		Name:         req.Name,
+		MacAddress:   mac,
+		DeviceID:     req.DeviceID,
+		Description:  req.Description,
+		Probe:        req.Probe,
+		Owner:        req.Owner,
+		Protected:    req.Protected,
+		AllowedHours: req.AllowedHours,
+		Cooldown:     req.Cooldown,
+		PowerPolicy:  req.PowerPolicy,
+		Destinations: req.Destinations,
+		Watts:        req.Watts,
+		StandbyWatts: req.StandbyWatts,
+		CreatedAt:    time.Now(),
+	}
+
+	p := requestPrincipal(r)
+	storage.mu.Lock()
+	var existing *Target
+	if oldName == "" {
+		if _, exists := storage.targets[target.Name]; exists {
+			storage.mu.Unlock()
+			http.Error(w, "Target already exists", http.StatusConflict)
+			return
+		}
+	} else {
+		var exists bool
+		existing, exists = storage.targets[oldName]
+		if !exists || !p.owns(existing.Owner) {
+			storage.mu.Unlock()
+			http.Error(w, "Target not found", http.StatusNotFound)
+			return
+		}
+		if target.Name != oldName {
+			if _, taken := storage.targets[target.Name]; taken {
+				storage.mu.Unlock()
+				http.Error(w, "Target already exists", http.StatusConflict)
+				return
+			}
+			if ref := targetReference(oldName, nil); ref != "" {
+				storage.mu.Unlock()
+				http.Error(w, "Cannot rename target used by "+ref, http.StatusConflict)
+				return
+			}
+		}
+		target.CreatedAt = existing.CreatedAt
+		if !p.admin() {
+			target.Protected = existing.Protected
+		}
+		// 共享只通过 shares 接口修改
+		target.Shares = existing.Shares
+	}
+	// 省略 owner 时保留原所有者，新目标归创建它的用户；用户只能指定自己或自己所属的组织，
+	// 并且只能使用自己能看到的中继。管理员可以指定任意所有者
+	if target.Owner == "" {
+		if existing != nil {
+			target.Owner = existing.Owner
+		} else {
+			target.Owner = p.user
+		}
+	}
+	if err := checkOwner(target.Owner); err != nil {
+		storage.mu.Unlock()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !p.admin() {
+		if existing == nil && target.Protected {
+			storage.mu.Unlock()
+			http.Error(w, "Only the server API key can protect targets", http.StatusForbidden)
+			return
+		}
+		if !p.owns(target.Owner) {
+			storage.mu.Unlock()
+			http.Error(w, "owner must be yourself or one of your organizations", http.StatusForbidden)
+			return
+		}
+		// 组织的目标必须使用组织的中继，否则其他成员唤醒时会用到他们看不到的个人设备
+		relayOwner := deviceOwner(target.DeviceID)
+		if !p.owns(relayOwner) || (strings.HasPrefix(target.Owner, orgOwnerPrefix) && relayOwner != target.Owner) {
+			storage.mu.Unlock()
+			http.Error(w, "device_id must be one of your devices", http.StatusBadRequest)
+			return
+		}
+	}
+	if oldName != "" && target.Name != oldName {
+		delete(storage.targets, oldName)
+		renameEnergy(oldName, target.Name)
+	}
+	if existing == nil {
+		target.Shares = nil
+	}
+	// 转给曾共享过的用户后，不再需要这条共享
+	if _, shared := target.Shares[target.Owner]; shared {
+		shares := make(map[string]string, len(target.Shares))
+		for user, access := range target.Shares {
+			if user != target.Owner {
+				shares[user] = access
+			}
+		}
+		target.Shares = shares
+		if len(shares) == 0 {
+			target.Shares = nil
+		}
+	}
+	storage.targets[target.Name] = target
+	storage.mu.Unlock()
+
+	markDirty()
+	status, msg := http.StatusCreated, "Target created"
+	if oldName != "" {
+		status, msg = http.StatusOK, "Target updated"
+	}
+	requestLogger(r).Info(strings.ToLower(msg), "target", target.Name, "device_id", target.DeviceID, "target_mac", target.MacAddress)
+	resp := map[string]interface{}{"success": true, "message": msg, "target": target}
+	if warning := neighborCoverage(target.MacAddress, target.DeviceID); warning != "" {
+		resp["warning"] = warning
+	}
+	writeJSON(w, status, resp)
+}
+
+// 目标是否开机：检测到开机，或唤醒正在进行中。调用方需持有 storage.mu 读锁
+func targetIsOn(name string) bool {
+	return targetPower(name) == powerOn || lastTargetWake(name).inProgress()
+}
+
+// 返回引用该目标的分组或定时任务描述，shares 中用户的定时任务不计入。调用方需持有 storage.mu
+func targetReference(name string, shares map[string]string) string {
+	for _, g := range storage.groups {
+		for _, t := range g.Targets {
+			if t == name {
+				return "group " + g.Name
+			}
+		}
+	}
+	for _, s := range storage.schedules {
+		if _, shared := shares[s.Owner]; s.Target == name && !shared {
+			return "schedule " + s.ID
+		}
+	}
+	for _, l := range storage.wakeLinks {
+		if l.Target == name {
+			return "wake link " + l.ID
+		}
+	}
+	return ""
+}
+
+// 分组列表和创建
+func groupsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		storage.mu.RLock()
+		groups := make([]Group, 0, len(storage.groups))
+		for _, g := range storage.groups {
+			groups = append(groups, *g)
+		}
+		storage.mu.RUnlock()
+		sort.Slice(groups, func(i, j int) bool { return groups[i].Name < groups[j].Name })
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"success": true,
+			"groups":  groups,
+			"total":   len(groups),
+		})
+
+	case http.MethodPost:
+		var req Group
+		if !readJSON(w, r, &req) {
+			return
+		}
+		saveGroup(w, r, "", req)
+
+	default:
+		methodNotAllowed(w, r)
+	}
+}
+
+// 单个分组：GET/PUT/DELETE /api/admin/groups/<name>
+func groupHandler(w http.ResponseWriter, r *http.Request) {
+	name, _ := pathParams(r, "/api/admin/groups/")
+	switch r.Method {
+	case http.MethodGet:
+		storage.mu.RLock()
+		g, exists := storage.groups[name]
+		var group Group
+		if exists {
+			group = *g
+		}
+		storage.mu.RUnlock()
+		if !exists {
+			http.Error(w, "Group not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"success": true, "group": group})
+
+	case http.MethodPut:
+		var req Group
+		if !readJSON(w, r, &req) {
+			return
+		}
+		if req.Name == "" {
+			req.Name = name
+		}
+		saveGroup(w, r, name, req)
+
+	case http.MethodDelete:
+		storage.mu.Lock()
+		if _, exists := storage.groups[name]; !exists {
+			storage.mu.Unlock()
+			http.Error(w, "Group not found", http.StatusNotFound)
+			return
+		}
+		if ref := groupReference(name); ref != "" {
+			storage.mu.Unlock()
+			http.Error(w, "Group is used by "+ref, http.StatusConflict)
+			return
+		}
+		delete(storage.groups, name)
+		storage.mu.Unlock()
+
+		markDirty()
+		requestLogger(r).Info("group deleted", "group", name)
+		writeJSON(w, http.StatusOK, map[string]interface{}{"success": true, "message": "Group deleted"})
+
+	default:
+		methodNotAllowed(w, r)
+	}
+}
+
+// 创建（oldName 为空）或更新分组
+func saveGroup(w http.ResponseWriter, r *http.Request, oldName string, req Group) {
+	if !namePattern.MatchString(req.Name) {
+		http.Error(w, "name must be 1-64 letters, digits, '.', '_' or '-'", http.StatusBadRequest)
+		return
+	}
+	if len(req.Targets) == 0 {
+		http.Error(w, "targets must not be empty", http.StatusBadRequest)
+		return
+	}
+	group := &Group{
+		Name:        req.Name,
+		Description: req.Description,
+		CreatedAt:   time.Now(),
+	}
+	seen := make(map[string]bool)
+	for _, t := range req.Targets {
+		if !seen[t] {
+			seen[t] = true
+			group.Targets = append(group.Targets, t)
+		}
+	}
+
+	storage.mu.Lock()
+	for _, t := range group.Targets {
+		if _, exists := storage.targets[t]; !exists {
+			storage.mu.Unlock()
+			http.Error(w, fmt.Sprintf("target %q not found", t), http.StatusBadRequest)
+			return
+		}
+	}
+	if oldName == "" {
+		if _, exists := storage.groups[group.Name]; exists {
+			storage.mu.Unlock()
+			http.Error(w, "Group already exists", http.StatusConflict)
+			return
+		}
+	} else {
+		existing, exists := storage.groups[oldName]
+		if !exists {
+			storage.mu.Unlock()
+			http.Error(w, "Group not found", http.StatusNotFound)
+			return
+		}
+		if group.Name != oldName {
+			if _, taken := storage.groups[group.Name]; taken {
+				storage.mu.Unlock()
+				http.Error(w, "Group already exists", http.StatusConflict)
+				return
+			}
+			if ref := groupReference(oldName); ref != "" {
+				storage.mu.Unlock()
+				http.Error(w, "Cannot rename group used by "+ref, http.StatusConflict)
+				return
+			}
+			delete(storage.groups, oldName)
+		}
+		group.CreatedAt = existing.CreatedAt
+	}
+	storage.groups[group.Name] = group
+	storage.mu.Unlock()
+
+	markDirty()
+	status, msg := http.StatusCreated, "Group created"
+	if oldName != "" {
+		status, msg = http.StatusOK, "Group updated"
+	}
+	requestLogger(r).Info(strings.ToLower(msg), "group", group.Name, "targets", len(group.Targets))
+	writeJSON(w, status, map[string]interface{}{"success": true, "message": msg, "group": group})
+}
+
+// 返回引用该分组的定时任务描述，调用方需持有 storage.mu
+func groupReference(name string) string {
+	for _, s := range storage.schedules {
+		if s.Group == name {
+			return "schedule " + s.ID
+		}
+	}
+	return ""
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Telegram 通知配置
+type TelegramConfig struct {
+	BotToken   string     `json:"bot_token"`
+	ChatID     flexString `json:"chat_id"`     // 数字ID或 @频道名
+	Events     []string   `json:"events"`      // 默认：唤醒请求/确认/失败和中继离线
+	APIURL     string     `json:"api_url"`     // 默认 https://api.telegram.org，可指向自建Bot API
+	MaxRetries *int       `json:"max_retries"` // 默认3次
+}
+
+// 默认订阅的事件
+var defaultTelegramEvents = []string{eventMessageQueued, eventMessageAcked, eventMessageFailed, eventDeviceOffline}
+
+// 既可以写成字符串也可以写成数字的配置项
+type flexString string
+
+func (f *flexString) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*f = flexString(s)
+		return nil
+	}
+	var n json.Number
+	if err := json.Unmarshal(data, &n); err != nil {
+		return fmt.Errorf("must be a string or number")
+	}
+	*f = flexString(n.String())
+	return nil
+}
+
+type telegramNotifier struct {
+	apiURL string
+	token  string
+	chatID string
+	filter eventFilter
+}
+
+func newTelegramNotifier(cfg TelegramConfig) (*telegramNotifier, error) {
+	if cfg.BotToken == "" || cfg.ChatID == "" {
+		return nil, fmt.Errorf("bot_token and chat_id are required")
+	}
+	types := cfg.Events
+	if len(types) == 0 {
+		types = defaultTelegramEvents
+	}
+	filter, err := newEventFilter(types)
+	if err != nil {
+		return nil, err
+	}
+	apiURL := strings.TrimRight(cfg.APIURL, "/")
+	if apiURL == "" {
+		apiURL = "https://api.telegram.org"
+	}
+	return &telegramNotifier{apiURL: apiURL, token: cfg.BotToken, chatID: string(cfg.ChatID), filter: filter}, nil
+}
+
+func (n *telegramNotifier) name() string { return "telegram:" + n.chatID }
+
+func (n *telegramNotifier) wants(eventType string) bool { return n.filter.wants(eventType) }
+
+func (n *telegramNotifier) send(ctx context.Context, e Event) error {
+	return n.sendText(ctx, n.chatID, "ESP32 WOL: "+eventSummary(e))
+}
+
+// 调用 sendMessage 发送文本消息
+func (n *telegramNotifier) sendText(ctx context.Context, chatID, text string) error {
+	body, _ := json.Marshal(map[string]any{
+		"chat_id":                  chatID,
+		"text":                     text,
+		"disable_web_page_preview": true,
+	})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.apiURL+"/bot"+n.token+"/sendMessage", bytes.NewReader(body))
+	if err != nil {
+		return permanentError{err}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return doNotifyRequest(req)
+}
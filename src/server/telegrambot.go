@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Telegram 机器人命令：通过长轮询 getUpdates 接收命令，只响应 allowed_chats 中的会话，
+// 服务器无需对公网开放即可远程唤醒
+
+// Telegram 机器人配置
+type TelegramBotConfig struct {
+	BotToken     string       `json:"bot_token"`
+	AllowedChats []flexString `json:"allowed_chats"` // 允许发送命令的会话ID
+	APIURL       string       `json:"api_url"`       // 默认 https://api.telegram.org
+}
+
+type telegramBot struct {
+	api     *telegramNotifier // 复用 sendMessage
+	client  *http.Client
+	allowed map[string]bool
+
+	mu       sync.Mutex
+	watching map[string]telegramWatch // 等待结果的消息ID
+
+	lastErr atomic.Value
+}
+
+// 通过机器人发起的唤醒，确认或失败后回复到原会话
+type telegramWatch struct {
+	chatID string
+	since  time.Time
+}
+
+type telegramUpdate struct {
+	UpdateID int64 `json:"update_id"`
+	Message  *struct {
+		Chat struct {
+			ID int64 `json:"id"`
+		} `json:"chat"`
+		From struct {
+			Username string `json:"username"`
+		} `json:"from"`
+		Text string `json:"text"`
+	} `json:"message"`
+}
+
+// getUpdates 长轮询等待时间
+const telegramPollTimeout = 50 * time.Second
+
+const telegramBotHelp = `Commands:
+/wake <target> - wake a target
+/wakegroup <group> - wake every target in a group
+/cancel <message-id> - cancel a wake that has not reached the relay
+/status [message-id] - server summary, or the status of a wake
+/targets - list targets
+/devices - list relays`
+
+func newTelegramBot(cfg *TelegramBotConfig) (*telegramBot, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	if cfg.BotToken == "" || len(cfg.AllowedChats) == 0 {
+		return nil, fmt.Errorf("bot_token and allowed_chats are required")
+	}
+	apiURL := strings.TrimRight(cfg.APIURL, "/")
+	if apiURL == "" {
+		apiURL = "https://api.telegram.org"
+	}
+	b := &telegramBot{
+		api:      &telegramNotifier{apiURL: apiURL, token: cfg.BotToken},
+		client:   &http.Client{Timeout: telegramPollTimeout + 15*time.Second},
+		allowed:  make(map[string]bool),
+		watching: make(map[string]telegramWatch),
+	}
+	for _, id := range cfg.AllowedChats {
+		b.allowed[string(id)] = true
+	}
+	return b, nil
+}
+
+// 运行机器人，直到服务器关闭
+func (b *telegramBot) run() {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-shutdownCh
+		cancel()
+	}()
+	go b.watchResults(ctx)
+
+	var offset int64
+	for ctx.Err() == nil {
+		// 同一个机器人令牌只能有一个 getUpdates 连接，高可用模式下由主副本接收命令
+		if !isLeader() {
+			select {
+			case <-ctx.Done():
+			case <-time.After(haRenewInterval):
+			}
+			continue
+		}
+		updates, err := b.getUpdates(ctx, offset)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			b.lastErr.Store(err.Error())
+			slog.Warn("telegram getUpdates failed", "error", err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(10 * time.Second):
+			}
+			continue
+		}
+		b.lastErr.Store("")
+		for _, u := range updates {
+			offset = u.UpdateID + 1
+			if u.Message == nil || !strings.HasPrefix(u.Message.Text, "/") {
+				continue
+			}
+			chatID := strconv.FormatInt(u.Message.Chat.ID, 10)
+			logger := slog.With("chat_id", chatID, "username", u.Message.From.Username)
+			var reply string
+			if !b.allowed[chatID] {
+				logger.Warn("telegram command from chat not in allowed_chats")
+				reply = fmt.Sprintf("This chat (%s) is not allowed to control the server.", chatID)
+			} else {
+				reply = b.handle(logger, chatID, u.Message.Text)
+			}
+			if err := b.api.sendText(ctx, chatID, reply); err != nil {
+				logger.Warn("telegram reply failed", "error", err)
+			}
+		}
+	}
+}
+
+func (b *telegramBot) getUpdates(ctx context.Context, offset int64) ([]telegramUpdate, error) {
+	q := url.Values{}
+	q.Set("offset", strconv.FormatInt(offset, 10))
+	q.Set("timeout", strconv.Itoa(int(telegramPollTimeout.Seconds())))
+	q.Set("allowed_updates", `["message"]`)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, b.api.apiURL+"/bot"+b.api.token+"/getUpdates?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := b.client.Do(req)
+	if err != nil {
+		// 错误信息中不带完整URL，避免泄露令牌
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			return nil, fmt.Errorf("%s: %v", req.URL.Host, urlErr.Err)
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		OK          bool             `json:"ok"`
+		Description string           `json:"description"`
+		Result      []telegramUpdate `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("HTTP %d: %v", resp.StatusCode, err)
+	}
+	if !result.OK {
+		return nil, fmt.Errorf("HTTP %d: %s", resp.StatusCode, result.Description)
+	}
+	return result.Result, nil
+}
+
+// 处理一条命令，返回回复内容
+func (b *telegramBot) handle(logger *slog.Logger, chatID, text string) string {
+	fields := strings.Fields(text)
+	command, _, _ := strings.Cut(fields[0], "@") // 群组中的命令带有 @机器人名
+	args := fields[1:]
+	logger.Info("telegram command", "command", command)
+
+	switch command {
+	case "/start", "/help":
+		return telegramBotHelp
+
+	case "/wake", "/wakegroup":
+		if len(args) != 1 {
+			return "Usage: " + command + " <name>"
+		}
+		target, group := args[0], ""
+		if command == "/wakegroup" {
+			target, group = "", args[0]
+		}
+		reqs, err := resolveWake(target, group, "telegram:"+chatID)
+		if err != nil {
+			return "Error: " + err.Error()
+		}
+		var lines []string
+		for _, req := range reqs {
+			message, err := queueWake(logger, req)
+			if err != nil {
+				lines = append(lines, fmt.Sprintf("%s: %v", req.Target, err))
+				continue
+			}
+			b.mu.Lock()
+			b.watching[message.ID] = telegramWatch{chatID: chatID, since: time.Now()}
+			b.mu.Unlock()
+			lines = append(lines, fmt.Sprintf("%s: wake %s (%s)", req.Target, message.Status, message.ID))
+		}
+		return strings.Join(lines, "\n")
+
+	case "/cancel":
+		if len(args) != 1 {
+			return "Usage: /cancel <message-id>"
+		}
+		if err := cancelWake(logger, args[0]); err != nil {
+			return "Error: " + err.Error()
+		}
+		return "Cancelled " + args[0]
+
+	case "/status":
+		if len(args) == 1 {
+			storage.mu.RLock()
+			m, exists := storage.messages[args[0]]
+			var copied WOLMessage
+			if exists {
+				copied = *m
+			}
+			storage.mu.RUnlock()
+			if !exists {
+				return "Message not found"
+			}
+			status := fmt.Sprintf("%s: %s (target %s, relay %s, created %s)", copied.ID, copied.Status,
+				firstNonEmpty(copied.Target, copied.TargetMAC, copied.Type), copied.DeviceID, copied.CreatedAt.Format(time.DateTime))
+			if copied.Error != "" {
+				status += "\nError: " + copied.Error
+			}
+			return status
+		}
+		storage.mu.RLock()
+		online, pending := 0, 0
+		for id, d := range storage.devices {
+			if d.Online {
+				online++
+			}
+			pending += queues.len(id)
+		}
+		total, targets := len(storage.devices), len(storage.targets)
+		storage.mu.RUnlock()
+		return fmt.Sprintf("Relays online: %d/%d\nTargets: %d\nPending wakes: %d\nUptime: %s",
+			online, total, targets, pending, time.Since(startTime).Round(time.Second))
+
+	case "/targets":
+		storage.mu.RLock()
+		var lines []string
+		for _, t := range storage.targets {
+			state := "relay offline"
+			if d, exists := storage.devices[t.DeviceID]; exists && d.Online {
+				state = "relay online"
+			}
+			lines = append(lines, fmt.Sprintf("%s - %s via %s (%s)", t.Name, t.MacAddress, t.DeviceID, state))
+		}
+		storage.mu.RUnlock()
+		if len(lines) == 0 {
+			return "No targets"
+		}
+		sort.Strings(lines)
+		return strings.Join(lines, "\n")
+
+	case "/devices":
+		storage.mu.RLock()
+		var lines []string
+		for id, d := range storage.devices {
+			state := "offline"
+			if d.Online {
+				state = "online"
+			}
+			if !d.Approved {
+				state += ", pending approval"
+			}
+			lines = append(lines, fmt.Sprintf("%s %s (%s, %d queued, last seen %s)", id, d.Name, state, queues.len(id), d.LastSeen.Format(time.DateTime)))
+		}
+		storage.mu.RUnlock()
+		if len(lines) == 0 {
+			return "No relays"
+		}
+		sort.Strings(lines)
+		return strings.Join(lines, "\n")
+
+	default:
+		return "Unknown command.\n\n" + telegramBotHelp
+	}
+}
+
+// 通过机器人发起的唤醒有结果时回复到原会话
+func (b *telegramBot) watchResults(ctx context.Context) {
+	ch, _, cancel := events.subscribe(0)
+	defer cancel()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-ch:
+			if e.Type != eventMessageAcked && e.Type != eventMessageFailed && e.Type != eventMessageCancelled {
+				continue
+			}
+			b.mu.Lock()
+			watch, exists := b.watching[e.MessageID]
+			delete(b.watching, e.MessageID)
+			// 长时间没有结果的唤醒不再跟踪
+			for id, w := range b.watching {
+				if time.Since(w.since) > wakeWindow {
+					delete(b.watching, id)
+				}
+			}
+			b.mu.Unlock()
+			if !exists {
+				continue
+			}
+			if err := b.api.sendText(ctx, watch.chatID, eventSummary(e)); err != nil {
+				slog.Warn("telegram reply failed", "chat_id", watch.chatID, "error", err)
+			}
+		}
+	}
+}
+
+// 机器人健康检查：最近一次 getUpdates 失败时降级
+func (b *telegramBot) check() ComponentHealth {
+	if msg, _ := b.lastErr.Load().(string); msg != "" {
+		return ComponentHealth{Status: healthDegraded, Detail: msg}
+	}
+	return ComponentHealth{Status: healthOK, Detail: fmt.Sprintf("%d allowed chats", len(b.allowed))}
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// 设备校时：受限网络中无法访问NTP的ESP32可以从服务器获取当前时间。
+// 响应尽量小，便于在内存紧张的设备上解析
+
+type TimeResponse struct {
+	Epoch     int64  `json:"epoch"`      // Unix时间（秒）
+	EpochMs   int64  `json:"epoch_ms"`   // Unix时间（毫秒）
+	Timezone  string `json:"timezone"`   // 服务器时区，未配置 TZ 时为时区缩写
+	UTCOffset int    `json:"utc_offset"` // 服务器当前相对UTC的偏移（秒），含夏令时
+}
+
+// GET /api/time
+func timeHandler(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	abbr, offset := now.Zone()
+	tz := time.Local.String()
+	if tz == "Local" || tz == "" {
+		tz = abbr
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, TimeResponse{
+		Epoch:     now.Unix(),
+		EpochMs:   now.UnixMilli(),
+		Timezone:  tz,
+		UTCOffset: offset,
+	})
+}
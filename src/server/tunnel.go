@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 出站隧道：启动时运行 cloudflared（或任意隧道客户端）并在退出后自动重启，
+// 服务器在 CGNAT 后面时无需配置路由器即可从外网访问
+
+// 配置文件中的 tunnel 段
+type TunnelConfig struct {
+	Provider string   `json:"provider"` // cloudflare（默认）或 command
+	Token    string   `json:"token"`    // Cloudflare Tunnel 令牌；为空时使用临时的 Quick Tunnel（trycloudflare.com）
+	Binary   string   `json:"binary"`   // cloudflared 路径，默认从 PATH 查找
+	Command  []string `json:"command"`  // provider 为 command 时执行的命令，参数中的 {origin} 替换为本地地址
+	Origin   string   `json:"origin"`   // 隧道转发到的本地地址，默认取第一个 TCP 监听地址
+}
+
+type tunnelClient struct {
+	name   string
+	args   []string
+	env    []string
+	origin string
+	done   chan struct{} // run 返回后关闭
+
+	mu       sync.Mutex
+	running  bool
+	url      string // 从隧道客户端输出中识别的公网地址
+	lastErr  string
+	restarts int
+}
+
+// Quick Tunnel 启动后在输出中打印分配到的地址
+var tunnelURLPattern = regexp.MustCompile(`https://[a-z0-9-]+\.trycloudflare\.com`)
+
+func newTunnel(cfg *TunnelConfig, specs []string) (*tunnelClient, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	origin := cfg.Origin
+	if origin == "" {
+		var err error
+		if origin, err = tunnelOrigin(specs); err != nil {
+			return nil, err
+		}
+	}
+
+	t := &tunnelClient{origin: origin, done: make(chan struct{})}
+	switch cfg.Provider {
+	case "", "cloudflare":
+		t.name = "cloudflared"
+		binary := firstNonEmpty(cfg.Binary, "cloudflared")
+		if cfg.Token != "" {
+			// 令牌通过环境变量传递，避免出现在进程列表中；转发地址在 Cloudflare 后台的 Public Hostname 中配置
+			t.args = []string{binary, "tunnel", "--no-autoupdate", "run"}
+			t.env = []string{"TUNNEL_TOKEN=" + cfg.Token}
+		} else {
+			t.args = []string{binary, "tunnel", "--no-autoupdate", "--url", origin}
+		}
+	case "command":
+		if len(cfg.Command) == 0 {
+			return nil, fmt.Errorf("command is required when provider is command")
+		}
+		t.name = cfg.Command[0]
+		for _, arg := range cfg.Command {
+			t.args = append(t.args, strings.ReplaceAll(arg, "{origin}", origin))
+		}
+	default:
+		return nil, fmt.Errorf("unknown tunnel provider %q (cloudflare or command)", cfg.Provider)
+	}
+	if _, err := exec.LookPath(t.args[0]); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// 从监听地址推导本地转发地址：取第一个 TCP 监听器，监听全部地址时使用回环地址
+func tunnelOrigin(specs []string) (string, error) {
+	cfg, host, port, ok := firstTCPListener(specs)
+	if !ok {
+		return "", fmt.Errorf("no TCP listener to forward to, set tunnel.origin")
+	}
+	host = loopbackHost(host)
+	scheme := "http"
+	if cfg.TLSCert != "" {
+		scheme = "https"
+	}
+	return scheme + "://" + net.JoinHostPort(host, port), nil
+}
+
+// 运行隧道客户端，异常退出后按指数退避重启，服务器关闭时停止
+func (t *tunnelClient) run() {
+	defer close(t.done)
+	slog.Info("starting tunnel", "client", t.name, "origin", t.origin)
+	backoff := time.Second
+	for {
+		started := time.Now()
+		err := t.runOnce()
+		select {
+		case <-shutdownCh:
+			return
+		default:
+		}
+		if time.Since(started) > time.Minute {
+			backoff = time.Second
+		}
+		if err == nil {
+			err = errors.New("tunnel client exited")
+		}
+		t.mu.Lock()
+		t.running = false
+		t.lastErr = err.Error()
+		t.restarts++
+		t.mu.Unlock()
+		slog.Warn("tunnel stopped, restarting", "client", t.name, "error", err, "retry_in", backoff.String())
+		select {
+		case <-shutdownCh:
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, time.Minute)
+	}
+}
+
+func (t *tunnelClient) runOnce() error {
+	cmd := exec.Command(t.args[0], t.args[1:]...)
+	cmd.Env = append(os.Environ(), t.env...)
+	pr, pw := io.Pipe()
+	cmd.Stdout = pw
+	cmd.Stderr = pw
+	if err := cmd.Start(); err != nil {
+		pw.Close()
+		return err
+	}
+	go t.scanOutput(pr)
+
+	t.mu.Lock()
+	t.running = true
+	t.lastErr = ""
+	t.mu.Unlock()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+		pw.Close()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-shutdownCh:
+		// Windows 不支持发送中断信号，直接结束进程
+		if err := cmd.Process.Signal(os.Interrupt); err != nil {
+			cmd.Process.Kill()
+		}
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			cmd.Process.Kill()
+			<-done
+		}
+		slog.Info("tunnel stopped", "client", t.name)
+		return nil
+	}
+}
+
+// 隧道客户端的输出写入日志，并从中识别公网地址
+func (t *tunnelClient) scanOutput(r io.Reader) {
+	logger := slog.With("component", "tunnel", "client", t.name)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.Contains(line, " ERR ") {
+			logger.Warn(line)
+		} else {
+			logger.Debug(line)
+		}
+		if u := tunnelURLPattern.FindString(line); u != "" {
+			t.mu.Lock()
+			t.url = u
+			t.mu.Unlock()
+			logger.Info("tunnel ready", "url", u)
+		}
+	}
+	io.Copy(io.Discard, r)
+}
+
+func (t *tunnelClient) check() ComponentHealth {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.running {
+		return ComponentHealth{Status: healthDegraded, Detail: firstNonEmpty(t.lastErr, "starting")}
+	}
+	detail := firstNonEmpty(t.url, t.origin)
+	if t.restarts > 0 {
+		detail += fmt.Sprintf(", %d restarts", t.restarts)
+	}
+	return ComponentHealth{Status: healthOK, Detail: detail}
+}
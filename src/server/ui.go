@@ -0,0 +1,22 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// 管理界面静态文件，编译时嵌入二进制
+//
+//go:embed web
+var webFiles embed.FS
+
+var uiFS, _ = fs.Sub(webFiles, "web")
+
+// 管理界面（/ui/）。页面本身无需认证，页面中调用的管理接口需要API密钥
+func uiHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "default-src 'self'; style-src 'self'; script-src 'self'; connect-src 'self'")
+	http.StripPrefix("/ui", http.FileServer(http.FS(uiFS))).ServeHTTP(w, r)
+}
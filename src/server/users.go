@@ -0,0 +1,532 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// 本地用户账号：每个用户用自己的访问令牌调用API，只能看到和操作自己拥有的设备、目标和消息。
+// 一个用户可以有多个带标签的令牌（例如每台电脑、每个脚本一个），可以自行创建和撤销。
+// 服务器API密钥（-api-key）和免认证监听器相当于管理员，可以访问全部资源并管理用户；
+// 没有所有者的资源只有管理员可见，属于组织的资源组织成员都可见（见 orgs.go）
+
+type User struct {
+	Name      string       `json:"name"`
+	Role      string       `json:"role"` // viewer、operator 或 admin，见 roles.go
+	Quota     *Quota       `json:"quota,omitempty"`
+	Tokens    []*UserToken `json:"tokens"`
+	TokenHash string       `json:"token_hash,omitempty"` // 旧版本的单个令牌，载入时转换为 Tokens
+	CreatedAt time.Time    `json:"created_at"`
+}
+
+// 用户的访问令牌，只保存 SHA-256，令牌本身只在创建时返回
+type UserToken struct {
+	ID         string     `json:"id"`
+	Label      string     `json:"label"`
+	Hash       string     `json:"hash"`
+	Hint       string     `json:"hint"`            // 令牌开头几位，便于辨认
+	Quota      *Quota     `json:"quota,omitempty"` // 只有唤醒次数配额
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+// 接口中的令牌信息，不包含摘要
+type UserTokenInfo struct {
+	ID         string     `json:"id"`
+	Label      string     `json:"label"`
+	Hint       string     `json:"hint"`
+	Quota      *Quota     `json:"quota,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+// 管理接口中的用户信息，不包含令牌摘要
+type UserInfo struct {
+	Name      string     `json:"name"`
+	Role      string     `json:"role"`
+	CreatedAt time.Time  `json:"created_at"`
+	Devices   int        `json:"devices"`
+	Targets   int        `json:"targets"`
+	Tokens    int        `json:"tokens"`
+	Quota     *Quota     `json:"quota,omitempty"`
+	Usage     QuotaUsage `json:"usage"`
+}
+
+// 用户令牌前缀，便于在日志和密钥扫描中识别
+const userTokenPrefix = "wolu_"
+
+// 每个用户最多的令牌数
+const maxUserTokens = 20
+
+// 令牌最近使用时间的更新间隔，避免每次轮询都加写锁
+const tokenUsageInterval = time.Minute
+
+func newUserToken(label string) (string, *UserToken) {
+	token := userTokenPrefix + randomHex(20)
+	return token, &UserToken{
+		ID:        "tok_" + randomHex(8),
+		Label:     label,
+		Hash:      hashToken(token),
+		Hint:      token[:len(userTokenPrefix)+6],
+		CreatedAt: time.Now(),
+	}
+}
+
+func (t *UserToken) info() UserTokenInfo {
+	info := UserTokenInfo{ID: t.ID, Label: t.Label, Hint: t.Hint, CreatedAt: t.CreatedAt}
+	if t.Quota != nil {
+		q := *t.Quota
+		info.Quota = &q
+	}
+	if t.LastUsedAt != nil {
+		last := *t.LastUsedAt
+		info.LastUsedAt = &last
+	}
+	return info
+}
+
+// 升级旧版本保存的用户：没有角色的用户原来可以管理自己的全部资源，设为 admin；
+// 单个令牌转换为标签为 default 的令牌，ID 由摘要得出，高可用模式下各副本各自转换共享状态时结果相同
+func upgradeUser(u *User) {
+	if u.Role == "" {
+		u.Role = roleAdmin.String()
+	}
+	if len(u.TokenHash) < 16 {
+		return
+	}
+	u.Tokens = append(u.Tokens, &UserToken{
+		ID:        "tok_" + u.TokenHash[:16],
+		Label:     "default",
+		Hash:      u.TokenHash,
+		Hint:      userTokenPrefix,
+		CreatedAt: u.CreatedAt,
+	})
+	u.TokenHash = ""
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// 请求的身份：user 为空表示管理员（服务器API密钥），token 为使用的令牌ID，
+// role 为用户的角色，orgs 为认证时用户所属的组织
+type principal struct {
+	user  string
+	token string
+	role  role
+	orgs  []string
+}
+
+type principalKey struct{}
+
+func withPrincipal(r *http.Request, p principal) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), principalKey{}, p))
+}
+
+// 请求的身份；没有经过用户令牌认证的请求视为管理员
+func requestPrincipal(r *http.Request) principal {
+	p, _ := r.Context().Value(principalKey{}).(principal)
+	return p
+}
+
+func (p principal) admin() bool { return p.user == "" }
+
+// 是否可以访问属于 owner 的资源，也用于判断能否把资源分配给 owner
+func (p principal) owns(owner string) bool {
+	if p.user == "" || owner == p.user {
+		return true
+	}
+	org, ok := strings.CutPrefix(owner, orgOwnerPrefix)
+	return ok && slices.Contains(p.orgs, org)
+}
+
+// 查找令牌对应的用户，找不到时返回 false
+func lookupUserToken(token string) (principal, bool) {
+	if token == "" {
+		return principal{}, false
+	}
+	hash := []byte(hashToken(token))
+	var p principal
+	var found *UserToken
+	stale := false
+	storage.mu.RLock()
+	for _, u := range storage.users {
+		for _, t := range u.Tokens {
+			if subtle.ConstantTimeCompare(hash, []byte(t.Hash)) == 1 {
+				p = principal{user: u.Name, token: t.ID, orgs: userOrgs(u.Name)}
+				p.role, _ = parseRole(u.Role)
+				found = t
+				stale = t.LastUsedAt == nil || time.Since(*t.LastUsedAt) >= tokenUsageInterval
+			}
+		}
+	}
+	storage.mu.RUnlock()
+	if found == nil {
+		return principal{}, false
+	}
+	// 最近使用时间随下一次保存写入，不单独触发保存
+	if stale {
+		now := time.Now()
+		storage.mu.Lock()
+		found.LastUsedAt = &now
+		storage.mu.Unlock()
+	}
+	return p, true
+}
+
+// 设备的所有者，设备不存在时为空。调用方需持有 storage.mu
+func deviceOwner(deviceID string) string {
+	if d, exists := storage.devices[deviceID]; exists {
+		return d.Owner
+	}
+	return ""
+}
+
+// 用户或组织（org:<name>）拥有的设备和目标数量，调用方需持有 storage.mu
+func ownedResources(owner string) (devices, targets int) {
+	for _, d := range storage.devices {
+		if d.Owner == owner {
+			devices++
+		}
+	}
+	for _, t := range storage.targets {
+		if t.Owner == owner {
+			targets++
+		}
+	}
+	return devices, targets
+}
+
+func userInfo(u *User) UserInfo {
+	devices, targets := ownedResources(u.Name)
+	info := UserInfo{Name: u.Name, Role: u.Role, CreatedAt: u.CreatedAt, Devices: devices, Targets: targets, Tokens: len(u.Tokens), Usage: userUsage(u.Name)}
+	if u.Quota != nil {
+		q := *u.Quota
+		info.Quota = &q
+	}
+	return info
+}
+
+// 用户列表和创建：GET/POST /api/admin/users
+func usersHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		storage.mu.RLock()
+		users := make([]UserInfo, 0, len(storage.users))
+		for _, u := range storage.users {
+			users = append(users, userInfo(u))
+		}
+		storage.mu.RUnlock()
+		sort.Slice(users, func(i, j int) bool { return users[i].Name < users[j].Name })
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"success": true,
+			"users":   users,
+			"total":   len(users),
+		})
+
+	case http.MethodPost:
+		var req struct {
+			Name string `json:"name"`
+			Role string `json:"role"`
+		}
+		if !readJSON(w, r, &req) {
+			return
+		}
+		if !namePattern.MatchString(req.Name) {
+			http.Error(w, "name must be 1-64 letters, digits, '.', '_' or '-'", http.StatusBadRequest)
+			return
+		}
+		if req.Role == "" {
+			req.Role = defaultUserRole
+		}
+		if _, err := parseRole(req.Role); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		token, t := newUserToken("default")
+		user := &User{Name: req.Name, Role: req.Role, Tokens: []*UserToken{t}, CreatedAt: t.CreatedAt}
+
+		storage.mu.Lock()
+		if _, exists := storage.users[user.Name]; exists {
+			storage.mu.Unlock()
+			http.Error(w, "User already exists", http.StatusConflict)
+			return
+		}
+		storage.users[user.Name] = user
+		info := userInfo(user)
+		storage.mu.Unlock()
+
+		markDirty()
+		requestLogger(r).Info("user created", "user", user.Name, "role", user.Role)
+		writeJSON(w, http.StatusCreated, map[string]interface{}{
+			"success": true,
+			"message": "User created",
+			"user":    info,
+			"token":   token,
+		})
+
+	default:
+		methodNotAllowed(w, r)
+	}
+}
+
+// 单个用户：GET/PUT/DELETE /api/admin/users/<name>（PUT 修改角色和配额 {"role", "quota"}），POST /api/admin/users/<name>/token 撤销全部令牌并
+// 生成一个新令牌；GET/POST /api/admin/users/<name>/tokens、DELETE /api/admin/users/<name>/tokens/<id>
+// 管理用户的令牌
+func userHandler(w http.ResponseWriter, r *http.Request) {
+	name, action := pathParams(r, "/api/admin/users/")
+	if action == "tokens" || strings.HasPrefix(action, "tokens/") {
+		storage.mu.RLock()
+		_, exists := storage.users[name]
+		storage.mu.RUnlock()
+		if !exists {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		userTokens(w, r, name, strings.TrimPrefix(strings.TrimPrefix(action, "tokens"), "/"))
+		return
+	}
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		storage.mu.RLock()
+		u, exists := storage.users[name]
+		var info UserInfo
+		if exists {
+			info = userInfo(u)
+		}
+		storage.mu.RUnlock()
+		if !exists {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"success": true, "user": info})
+
+	case action == "" && r.Method == http.MethodPut:
+		// 省略的字段保持不变，"quota": {} 取消配额
+		var req struct {
+			Role  string `json:"role"`
+			Quota *Quota `json:"quota"`
+		}
+		if !readJSON(w, r, &req) {
+			return
+		}
+		if req.Role != "" {
+			if _, err := parseRole(req.Role); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if err := req.Quota.validate(false); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		storage.mu.Lock()
+		u, exists := storage.users[name]
+		var info UserInfo
+		if exists {
+			if req.Role != "" {
+				u.Role = req.Role
+			}
+			if req.Quota != nil {
+				u.Quota = req.Quota.normalized()
+			}
+			info = userInfo(u)
+		}
+		storage.mu.Unlock()
+		if !exists {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+
+		markDirty()
+		requestLogger(r).Info("user updated", "user", name, "role", info.Role, "quota", info.Quota != nil)
+		writeJSON(w, http.StatusOK, map[string]interface{}{"success": true, "message": "User updated", "user": info})
+
+	case action == "" && r.Method == http.MethodDelete:
+		storage.mu.Lock()
+		if _, exists := storage.users[name]; !exists {
+			storage.mu.Unlock()
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		// 与目标被引用时一样，先由管理员转移或删除用户的资源
+		if devices, targets := ownedResources(name); devices+targets > 0 {
+			storage.mu.Unlock()
+			http.Error(w, fmt.Sprintf("User still owns %d devices and %d targets", devices, targets), http.StatusConflict)
+			return
+		}
+		delete(storage.users, name)
+		removeUserShares(name)
+		for _, o := range storage.orgs {
+			o.Members = slices.DeleteFunc(o.Members, func(m string) bool { return m == name })
+		}
+		// 用户的定时任务随用户删除
+		schedules := 0
+		for id, s := range storage.schedules {
+			if s.Owner == name {
+				delete(storage.schedules, id)
+				schedules++
+			}
+		}
+		storage.mu.Unlock()
+
+		markDirty()
+		requestLogger(r).Info("user deleted", "user", name, "schedules_deleted", schedules)
+		writeJSON(w, http.StatusOK, map[string]interface{}{"success": true, "message": "User deleted"})
+
+	case action == "token" && r.Method == http.MethodPost:
+		token, t := newUserToken("default")
+		storage.mu.Lock()
+		u, exists := storage.users[name]
+		if exists {
+			u.Tokens = []*UserToken{t}
+		}
+		storage.mu.Unlock()
+		if !exists {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+
+		markDirty()
+		requestLogger(r).Info("user token regenerated", "user", name)
+		writeJSON(w, http.StatusOK, map[string]interface{}{"success": true, "message": "Token regenerated", "token": token})
+
+	case action == "" || action == "token":
+		methodNotAllowed(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// 当前用户的令牌：GET/POST /api/admin/tokens、DELETE /api/admin/tokens/<id>
+func tokensHandler(w http.ResponseWriter, r *http.Request) {
+	p := requestPrincipal(r)
+	if p.admin() {
+		http.Error(w, "Token management requires a user token, use /api/admin/users/<name>/tokens", http.StatusBadRequest)
+		return
+	}
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/admin/tokens"), "/")
+	userTokens(w, r, p.user, id)
+}
+
+// 列出、创建（id 为空）、设置配额（PUT {"quota"}）或撤销用户的令牌
+func userTokens(w http.ResponseWriter, r *http.Request, name, id string) {
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		storage.mu.RLock()
+		var tokens []UserTokenInfo
+		if u, exists := storage.users[name]; exists {
+			tokens = make([]UserTokenInfo, 0, len(u.Tokens))
+			for _, t := range u.Tokens {
+				tokens = append(tokens, t.info())
+			}
+		}
+		storage.mu.RUnlock()
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"success": true,
+			"tokens":  tokens,
+			"total":   len(tokens),
+		})
+
+	case id == "" && r.Method == http.MethodPost:
+		var req struct {
+			Label string `json:"label"`
+		}
+		if !readJSON(w, r, &req) {
+			return
+		}
+		req.Label = strings.TrimSpace(req.Label)
+		if req.Label == "" || len(req.Label) > 64 {
+			http.Error(w, "label must be 1-64 characters", http.StatusBadRequest)
+			return
+		}
+		token, t := newUserToken(req.Label)
+		storage.mu.Lock()
+		u, exists := storage.users[name]
+		if !exists {
+			storage.mu.Unlock()
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		if len(u.Tokens) >= maxUserTokens {
+			storage.mu.Unlock()
+			http.Error(w, fmt.Sprintf("User already has %d tokens, revoke one first", maxUserTokens), http.StatusConflict)
+			return
+		}
+		u.Tokens = append(u.Tokens, t)
+		storage.mu.Unlock()
+
+		markDirty()
+		requestLogger(r).Info("user token created", "user", name, "token_id", t.ID, "label", t.Label)
+		writeJSON(w, http.StatusCreated, map[string]interface{}{
+			"success": true,
+			"message": "Token created",
+			"token":   token,
+			"info":    t.info(),
+		})
+
+	case id != "" && r.Method == http.MethodPut:
+		var req struct {
+			Quota *Quota `json:"quota"`
+		}
+		if !readJSON(w, r, &req) {
+			return
+		}
+		if err := req.Quota.validate(true); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		storage.mu.Lock()
+		var info *UserTokenInfo
+		if u, exists := storage.users[name]; exists {
+			for _, t := range u.Tokens {
+				if t.ID == id {
+					t.Quota = req.Quota.normalized()
+					ti := t.info()
+					info = &ti
+				}
+			}
+		}
+		storage.mu.Unlock()
+		if info == nil {
+			http.Error(w, "Token not found", http.StatusNotFound)
+			return
+		}
+
+		markDirty()
+		requestLogger(r).Info("user token updated", "user", name, "token_id", id, "quota", info.Quota != nil)
+		writeJSON(w, http.StatusOK, map[string]interface{}{"success": true, "message": "Token updated", "info": info})
+
+	case id != "" && r.Method == http.MethodDelete:
+		storage.mu.Lock()
+		revoked := false
+		if u, exists := storage.users[name]; exists {
+			n := len(u.Tokens)
+			u.Tokens = slices.DeleteFunc(u.Tokens, func(t *UserToken) bool { return t.ID == id })
+			revoked = len(u.Tokens) < n
+		}
+		storage.mu.Unlock()
+		if !revoked {
+			http.Error(w, "Token not found", http.StatusNotFound)
+			return
+		}
+
+		markDirty()
+		requestLogger(r).Info("user token revoked", "user", name, "token_id", id)
+		writeJSON(w, http.StatusOK, map[string]interface{}{"success": true, "message": "Token revoked"})
+
+	case id == "" || !strings.Contains(id, "/"):
+		methodNotAllowed(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"time"
+)
+
+// 服务器版本：客户端（wolctl、管理界面、固件）据此判断兼容性并显示运行中的版本。
+// 版本号、提交号和构建时间在发布构建时通过 -ldflags 注入，见 commands.go
+
+type VersionResponse struct {
+	buildInfo
+	Compiler     string    `json:"compiler"`
+	NumCPU       int       `json:"num_cpu"`
+	StateVersion int       `json:"state_version"` // 状态文件格式版本
+	StartedAt    time.Time `json:"started_at"`
+}
+
+// GET /api/version
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, VersionResponse{
+		buildInfo:    currentBuildInfo(),
+		Compiler:     runtime.Compiler,
+		NumCPU:       runtime.NumCPU(),
+		StateVersion: stateVersion,
+		StartedAt:    startTime.UTC().Truncate(time.Second),
+	})
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// 按需唤醒的 TCP 代理：监听本地端口并转发到目标机器（例如 SSH、RDP），
+// 目标休眠时第一个连接会触发唤醒，连接保持等待直到目标端口可以连接，再开始转发
+
+// 配置文件中的 proxies 项
+type ProxyConfig struct {
+	Name        string   `json:"name"`
+	Listen      string   `json:"listen"`       // 本地监听地址，例如 ":2222"
+	Target      string   `json:"target"`       // 唤醒的命名目标
+	Upstream    string   `json:"upstream"`     // 转发地址，例如 "192.168.1.20:22"
+	WakeTimeout Duration `json:"wake_timeout"` // 唤醒后等待目标可连接的最长时间，默认3m
+}
+
+type wakeProxy struct {
+	ProxyConfig
+	wakeTimeout time.Duration
+	listener    net.Listener
+	logger      *slog.Logger
+
+	mu        sync.Mutex
+	lastWake  time.Time // 最近一次由代理发起唤醒的时间，等待期间的其他连接不重复唤醒
+	lastError string
+}
+
+const (
+	defaultProxyWakeTimeout = 3 * time.Minute
+	proxyDialTimeout        = 2 * time.Second
+	proxyRetryInterval      = 2 * time.Second
+	maxProxyBuffer          = 64 << 10 // 等待唤醒期间最多暂存的客户端数据
+)
+
+var errProxyClientGone = errors.New("client disconnected")
+
+func buildProxies(cfgs []ProxyConfig) ([]*wakeProxy, error) {
+	var proxies []*wakeProxy
+	seen := map[string]bool{}
+	for i, pc := range cfgs {
+		if pc.Name == "" {
+			pc.Name = fmt.Sprintf("#%d", i+1)
+		}
+		if seen[pc.Name] {
+			return nil, fmt.Errorf("proxy %s: duplicate name", pc.Name)
+		}
+		seen[pc.Name] = true
+		if pc.Listen == "" || pc.Target == "" || pc.Upstream == "" {
+			return nil, fmt.Errorf("proxy %s: listen, target and upstream are required", pc.Name)
+		}
+		if _, _, err := net.SplitHostPort(pc.Upstream); err != nil {
+			return nil, fmt.Errorf("proxy %s: invalid upstream: %v", pc.Name, err)
+		}
+		p := &wakeProxy{ProxyConfig: pc, wakeTimeout: time.Duration(pc.WakeTimeout)}
+		if p.wakeTimeout == 0 {
+			p.wakeTimeout = defaultProxyWakeTimeout
+		}
+		if p.wakeTimeout < 0 {
+			return nil, fmt.Errorf("proxy %s: wake_timeout must be positive", pc.Name)
+		}
+		proxies = append(proxies, p)
+	}
+	return proxies, nil
+}
+
+// 打开监听端口并开始接受连接，服务器关闭时停止监听
+func (p *wakeProxy) start() error {
+	listener, err := net.Listen(ipNetwork("tcp"), p.Listen)
+	if err != nil {
+		return err
+	}
+	p.listener = listener
+	p.logger = slog.With("proxy", p.Name, "target", p.Target)
+	p.logger.Info("wake-on-access proxy listening", "addr", p.Listen, "upstream", p.Upstream)
+
+	go func() {
+		<-shutdownCh
+		listener.Close()
+	}()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go p.handle(conn)
+		}
+	}()
+	return nil
+}
+
+func (p *wakeProxy) handle(client net.Conn) {
+	defer client.Close()
+	logger := p.logger.With("client", client.RemoteAddr().String())
+
+	upstream, err := net.DialTimeout(ipNetwork("tcp"), p.Upstream, proxyDialTimeout)
+	if err != nil {
+		// 目标不可达：唤醒并等待目标上线
+		start := time.Now()
+		logger.Info("upstream unreachable, waking target", "error", err)
+		if err := p.wake(logger); err != nil {
+			logger.Warn("proxy wake failed", "error", err)
+			p.setError(err)
+			return
+		}
+		var early []byte
+		if upstream, early, err = p.waitUpstream(client); err != nil {
+			logger.Warn("target did not come up", "waited", time.Since(start).Round(time.Second).String(), "error", err)
+			if !errors.Is(err, errProxyClientGone) {
+				p.setError(err)
+			}
+			return
+		}
+		logger.Info("target is up, proxying", "waited", time.Since(start).Round(time.Second).String())
+		if _, err := upstream.Write(early); err != nil {
+			upstream.Close()
+			return
+		}
+	}
+	defer upstream.Close()
+	p.setError(nil)
+
+	done := make(chan struct{}, 2)
+	pipe := func(dst, src net.Conn) {
+		io.Copy(dst, src)
+		// 一个方向结束后关闭写端，让另一端收到 EOF
+		if tc, ok := dst.(*net.TCPConn); ok {
+			tc.CloseWrite()
+		}
+		done <- struct{}{}
+	}
+	go pipe(upstream, client)
+	go pipe(client, upstream)
+	<-done
+	<-done
+}
+
+// 发起唤醒；目标已有进行中的唤醒（包括代理刚刚发起的）时不重复唤醒
+func (p *wakeProxy) wake(logger *slog.Logger) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if time.Since(p.lastWake) < p.wakeTimeout {
+		return nil
+	}
+	storage.mu.RLock()
+	inProgress := lastTargetWake(p.Target).inProgress()
+	storage.mu.RUnlock()
+	if inProgress {
+		return nil
+	}
+
+	reqs, err := resolveWake(p.Target, "", "proxy:"+p.Name)
+	if err != nil {
+		return err
+	}
+	if _, err := queueWake(logger, reqs[0]); err != nil {
+		return err
+	}
+	p.lastWake = time.Now()
+	return nil
+}
+
+// 反复尝试连接目标，直到成功、超时或客户端断开。
+// 等待期间客户端先发送的数据（例如 SSH 版本号）暂存下来，连接目标后先转发这些数据
+func (p *wakeProxy) waitUpstream(client net.Conn) (net.Conn, []byte, error) {
+	var buffered []byte
+	clientGone := make(chan struct{})
+	readerDone := make(chan struct{})
+	go func() {
+		defer close(readerDone)
+		b := make([]byte, 4096)
+		for len(buffered) < maxProxyBuffer {
+			n, err := client.Read(b)
+			buffered = append(buffered, b[:n]...)
+			if err != nil {
+				if !errors.Is(err, os.ErrDeadlineExceeded) {
+					close(clientGone)
+				}
+				return
+			}
+		}
+	}()
+
+	deadline := time.Now().Add(p.wakeTimeout)
+	for time.Now().Before(deadline) {
+		select {
+		case <-shutdownCh:
+			return nil, nil, fmt.Errorf("server shutting down")
+		case <-clientGone:
+			return nil, nil, errProxyClientGone
+		case <-time.After(proxyRetryInterval):
+		}
+		conn, err := net.DialTimeout(ipNetwork("tcp"), p.Upstream, proxyDialTimeout)
+		if err != nil {
+			continue
+		}
+		// 停止暂存，之后由转发接管客户端连接
+		client.SetReadDeadline(time.Now())
+		<-readerDone
+		client.SetReadDeadline(time.Time{})
+		select {
+		case <-clientGone:
+			conn.Close()
+			return nil, nil, errProxyClientGone
+		default:
+		}
+		return conn, buffered, nil
+	}
+	return nil, nil, fmt.Errorf("timed out after %s", p.wakeTimeout)
+}
+
+func (p *wakeProxy) setError(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err != nil {
+		p.lastError = err.Error()
+	} else {
+		p.lastError = ""
+	}
+}
+
+// 所有代理的健康状态：最近一次连接失败时为 degraded
+func checkProxies(proxies []*wakeProxy) func() ComponentHealth {
+	return func() ComponentHealth {
+		for _, p := range proxies {
+			p.mu.Lock()
+			msg := p.lastError
+			p.mu.Unlock()
+			if msg != "" {
+				return ComponentHealth{Status: healthDegraded, Detail: p.Name + ": " + msg}
+			}
+		}
+		return ComponentHealth{Status: healthOK, Detail: fmt.Sprintf("%d proxies", len(proxies))}
+	}
+}
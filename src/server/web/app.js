@@ -0,0 +1,679 @@
+'use strict';
+
+// 使用相对路径，部署在 -base-path 下时同样可用
+const API = '../api';
+const dayNames = { mon: '一', tue: '二', wed: '三', thu: '四', fri: '五', sat: '六', sun: '日' };
+const actionNames = { '': '唤醒', suspend: '睡眠', shutdown: '关机' };
+
+let state = { devices: [], targets: [], groups: [], schedules: [], links: [], approvals: [], power: {} };
+
+function apiKey() {
+  return localStorage.getItem('esp32-wol-api-key') || '';
+}
+
+function showStatus(text, isError) {
+  const el = document.getElementById('status');
+  el.textContent = text;
+  el.className = isError ? 'error' : '';
+}
+
+async function api(method, path, body) {
+  const opts = { method, headers: { 'X-API-Key': apiKey() } };
+  if (body !== undefined) {
+    opts.headers['Content-Type'] = 'application/json';
+    opts.body = JSON.stringify(body);
+  }
+  const resp = await fetch(API + path, opts);
+  const text = await resp.text();
+  if (!resp.ok) {
+    throw new Error(text.trim() || resp.statusText);
+  }
+  return text ? JSON.parse(text) : {};
+}
+
+// 执行操作并刷新列表，成功时返回 true；done 为提示文字，或在操作完成后生成提示的函数
+async function run(action, done) {
+  try {
+    await action();
+  } catch (err) {
+    showStatus(err.message, true);
+    return false;
+  }
+  if (typeof done === 'function') {
+    done = done();
+  }
+  if (done) {
+    showStatus(done);
+  }
+  await refresh();
+  return true;
+}
+
+function el(tag, text, className) {
+  const node = document.createElement(tag);
+  if (text !== undefined) {
+    node.textContent = text;
+  }
+  if (className) {
+    node.className = className;
+  }
+  return node;
+}
+
+function button(text, onClick) {
+  const b = el('button', text);
+  b.type = 'button';
+  b.addEventListener('click', onClick);
+  return b;
+}
+
+function row(cells, actions) {
+  const tr = el('tr');
+  for (const cell of cells) {
+    const td = el('td');
+    if (cell instanceof Node) {
+      td.appendChild(cell);
+    } else {
+      td.textContent = cell;
+    }
+    tr.appendChild(td);
+  }
+  const td = el('td');
+  for (const a of actions || []) {
+    td.appendChild(a);
+  }
+  tr.appendChild(td);
+  return tr;
+}
+
+function fill(sectionId, rows) {
+  const tbody = document.querySelector('#' + sectionId + ' tbody');
+  tbody.replaceChildren(...rows);
+}
+
+function formatTime(value) {
+  if (!value || value.startsWith('0001-')) {
+    return '-';
+  }
+  return new Date(value).toLocaleString();
+}
+
+// 唤醒页：每个目标和分组一个大按钮，便于手机上单手操作
+function renderWake() {
+  const grid = document.querySelector('#wake .wake-grid');
+  const buttons = [];
+  for (const t of state.targets) {
+    const on = (state.power || {})[t.name]?.state === 'on';
+    buttons.push(wakeButton(t.name, (on ? '已开机 · ' : '') + (t.description || t.mac_address), { target: t.name }, on ? 'on' : ''));
+  }
+  for (const g of state.groups) {
+    buttons.push(wakeButton(g.name, '分组 · ' + g.targets.length + ' 台', { group: g.name }, 'group'));
+  }
+  grid.replaceChildren(...buttons);
+  document.querySelector('#wake .hint').classList.toggle('hidden', buttons.length > 0);
+}
+
+function wakeButton(title, subtitle, body, className) {
+  const b = el('button', title, 'wake-button ' + className);
+  b.type = 'button';
+  b.disabled = !navigator.onLine;
+  b.appendChild(el('small', subtitle));
+  b.addEventListener('click', async () => {
+    b.disabled = true;
+    if (navigator.vibrate) {
+      navigator.vibrate(30);
+    }
+    await sendWake(body, title);
+    b.disabled = !navigator.onLine;
+  });
+  return b;
+}
+
+// 发送唤醒；受保护的目标需要另一位管理员批准后才会下发
+function sendWake(body, title) {
+  let pending = false;
+  return run(async () => {
+    const resp = await api('POST', '/wol/send', body);
+    pending = resp.status === 'pending_approval' || (resp.pending_approval || []).length > 0;
+  }, () => (pending ? '等待另一位管理员批准: ' : '已发送唤醒指令: ') + title);
+}
+
+// 等待批准的受保护目标唤醒，请求者本人不能批准
+function renderApprovals() {
+  const approvals = state.approvals || [];
+  fill('approvals', approvals.map(m => row([formatTime(m.created_at), m.target || m.target_mac, m.source || '-'], [
+    button('批准', () => run(() => api('POST', '/wol/messages/' + encodeURIComponent(m.id) + '/approve'), '已批准唤醒 ' + (m.target || m.target_mac))),
+    button('拒绝', () => run(() => api('POST', '/wol/messages/' + encodeURIComponent(m.id) + '/reject'), '已拒绝唤醒 ' + (m.target || m.target_mac))),
+  ])));
+  document.getElementById('approvals').classList.toggle('hidden', approvals.length === 0);
+}
+
+function renderDevices() {
+  fill('devices', state.devices.map(d => {
+    let status = el('span', d.online ? '在线' : '离线', d.online ? 'online' : 'offline');
+    if (!d.approved) {
+      status = el('span', '待批准', 'unapproved');
+    }
+    const actions = [];
+    if (!d.approved) {
+      actions.push(button('批准', () => run(() => api('POST', '/admin/devices/' + encodeURIComponent(d.id) + '/approve'), '已批准 ' + d.id)));
+    }
+    actions.push(button('删除', () => {
+      if (confirm('删除设备 ' + d.id + '？')) {
+        run(() => api('DELETE', '/admin/devices/' + encodeURIComponent(d.id)), '已删除 ' + d.id);
+      }
+    }));
+    return row([d.id, d.name, d.version || '-', status, formatTime(d.last_seen), String(d.pending)], actions);
+  }));
+}
+
+// 服务器检测到的开机状态，未配置检测的目标显示 -
+const powerNames = { on: '开机', off: '关机', unknown: '未知' };
+
+function powerLabel(name) {
+  const p = (state.power || {})[name];
+  if (!p || (p.state === 'unknown' && !p.method)) {
+    return '-';
+  }
+  let text = powerNames[p.state] || p.state;
+  let className = p.state === 'on' ? 'online' : 'offline';
+  if (p.flapping) {
+    text += '（不稳定）';
+    className = 'unapproved';
+  } else if (p.pending) {
+    text += '（待确认' + (powerNames[p.pending] || p.pending) + '）';
+  }
+  const label = el('span', text, className);
+  label.title = [p.detail, p.checked_at && '检测于 ' + formatTime(p.checked_at)].filter(Boolean).join('\n');
+  return label;
+}
+
+function renderTargets() {
+  fill('targets', state.targets.map(t => row([t.name + (t.protected ? ' (需批准)' : ''), t.mac_address, t.device_id, powerLabel(t.name), t.description || ''], [
+    button('唤醒', () => sendWake({ target: t.name }, t.name)),
+    button('删除', () => {
+      if (confirm('删除目标 ' + t.name + '？')) {
+        run(() => api('DELETE', '/admin/targets/' + encodeURIComponent(t.name)), '已删除 ' + t.name);
+      }
+    }),
+  ])));
+}
+
+function renderGroups() {
+  fill('groups', state.groups.map(g => row([g.name, g.targets.join(', '), g.description || ''], [
+    button('唤醒', () => run(() => api('POST', '/wol/send', { group: g.name }), '已发送唤醒指令: ' + g.name)),
+    button('删除', () => {
+      if (confirm('删除分组 ' + g.name + '？')) {
+        run(() => api('DELETE', '/admin/groups/' + encodeURIComponent(g.name)), '已删除 ' + g.name);
+      }
+    }),
+  ])));
+}
+
+function renderSchedules() {
+  fill('schedules', state.schedules.map(s => {
+    const days = (s.days || []).map(d => dayNames[d]).join(' ') || '每天';
+    const ref = s.target ? '目标 ' + s.target : '分组 ' + s.group;
+    const toggle = Object.assign({}, s, { enabled: !s.enabled });
+    delete toggle.next_run;
+    return row([s.name || s.id, ref, actionNames[s.action || ''], s.time, days, formatTime(s.next_run), s.enabled ? '是' : '否'], [
+      button(s.enabled ? '停用' : '启用', () => run(() => api('PUT', '/admin/schedules/' + encodeURIComponent(s.id), toggle))),
+      button('删除', () => {
+        if (confirm('删除定时任务 ' + (s.name || s.id) + '？')) {
+          run(() => api('DELETE', '/admin/schedules/' + encodeURIComponent(s.id)), '已删除定时任务');
+        }
+      }),
+    ]);
+  }));
+}
+
+function renderLinks() {
+  fill('links', (state.links || []).map(l => {
+    const expires = l.expired ? '已过期' : formatTime(l.expires_at);
+    return row([l.label || l.id, l.target, expires, String(l.uses), formatTime(l.last_used)], [
+      button('复制', () => copyLink(l.url)),
+      button('撤销', () => {
+        if (confirm('撤销链接 ' + (l.label || l.id) + '？撤销后该链接立即失效。')) {
+          run(() => api('DELETE', '/admin/wake-links/' + encodeURIComponent(l.id)), '已撤销链接');
+        }
+      }),
+    ]);
+  }));
+}
+
+async function copyLink(url) {
+  try {
+    await navigator.clipboard.writeText(url);
+    showStatus('链接已复制');
+  } catch (err) {
+    // 非HTTPS页面无法使用剪贴板接口，改为弹出链接供手动复制
+    prompt('复制链接', url);
+  }
+}
+
+// 更新表单中的下拉选项
+function renderOptions() {
+  const devices = document.querySelector('.device-select');
+  devices.replaceChildren(...state.devices.map(d => {
+    const o = el('option', d.name + ' (' + d.id + ')');
+    o.value = d.id;
+    return o;
+  }));
+
+  const targets = document.querySelector('.target-select');
+  targets.replaceChildren(...state.targets.map(t => {
+    const o = el('option', t.name);
+    o.value = t.name;
+    return o;
+  }));
+
+  const linkTargets = document.querySelector('.link-target-select');
+  linkTargets.replaceChildren(...state.targets.map(t => {
+    const o = el('option', t.name);
+    o.value = t.name;
+    return o;
+  }));
+
+  const refs = document.querySelector('.ref-select');
+  refs.replaceChildren(
+    ...state.targets.map(t => {
+      const o = el('option', '目标: ' + t.name);
+      o.value = 'target:' + t.name;
+      return o;
+    }),
+    ...state.groups.map(g => {
+      const o = el('option', '分组: ' + g.name);
+      o.value = 'group:' + g.name;
+      return o;
+    }),
+  );
+}
+
+function render() {
+  renderWake();
+  renderApprovals();
+  renderDevices();
+  renderTargets();
+  renderGroups();
+  renderSchedules();
+  renderLinks();
+  renderOptions();
+}
+
+async function refresh() {
+  if (!apiKey()) {
+    showStatus('请输入API密钥', true);
+    return;
+  }
+  if (!navigator.onLine) {
+    showStatus('离线，显示上次同步的数据', true);
+    return;
+  }
+  try {
+    const [devices, targets, groups, schedules, links, approvals, power] = await Promise.all([
+      api('GET', '/admin/devices'),
+      api('GET', '/admin/targets'),
+      api('GET', '/admin/groups'),
+      api('GET', '/admin/schedules'),
+      api('GET', '/admin/wake-links'),
+      api('GET', '/wol/messages/search?status=pending_approval&order=asc'),
+      api('GET', '/targets/power'),
+    ]);
+    state = {
+      devices: devices.devices,
+      targets: targets.targets,
+      groups: groups.groups,
+      schedules: schedules.schedules,
+      links: links.links,
+      approvals: approvals.messages,
+      power: Object.fromEntries(power.targets.map(p => [p.target, p])),
+    };
+  } catch (err) {
+    showStatus(err.message, true);
+    return;
+  }
+  // 缓存最近一次数据，离线打开时仍能显示
+  localStorage.setItem('esp32-wol-state', JSON.stringify(state));
+  render();
+  if (!document.getElementById('version').textContent) {
+    loadVersion();
+  }
+}
+
+// 在标题旁显示服务器版本
+async function loadVersion() {
+  try {
+    const info = await api('GET', '/version');
+    const commit = info.commit ? ' (' + info.commit.slice(0, 7) + ')' : '';
+    const node = document.getElementById('version');
+    node.textContent = info.version + commit;
+    node.title = [info.build_date, info.go_version, info.platform].filter(Boolean).join(' · ');
+  } catch (err) {
+    console.warn('version unavailable', err);
+  }
+}
+
+document.getElementById('login').addEventListener('submit', e => {
+  e.preventDefault();
+  localStorage.setItem('esp32-wol-api-key', document.getElementById('api-key').value);
+  showStatus('');
+  refresh();
+  if (live.socket) {
+    live.socket.close();
+  } else {
+    connectLive();
+  }
+});
+
+for (const tab of document.querySelectorAll('nav button')) {
+  tab.addEventListener('click', () => {
+    document.querySelectorAll('nav button, .tab').forEach(n => n.classList.remove('active'));
+    tab.classList.add('active');
+    document.getElementById(tab.dataset.tab).classList.add('active');
+    if (tab.dataset.tab === 'history') {
+      loadHistory();
+      loadEnergy();
+      loadLatency();
+    }
+  });
+}
+
+document.getElementById('target-form').addEventListener('submit', e => {
+  e.preventDefault();
+  const f = new FormData(e.target);
+  run(() => api('POST', '/admin/targets', {
+    name: f.get('name'),
+    mac_address: f.get('mac_address'),
+    device_id: f.get('device_id'),
+    description: f.get('description'),
+  }), '已添加目标').then(ok => ok && e.target.reset());
+});
+
+document.getElementById('group-form').addEventListener('submit', e => {
+  e.preventDefault();
+  const f = new FormData(e.target);
+  run(() => api('POST', '/admin/groups', {
+    name: f.get('name'),
+    targets: f.getAll('targets'),
+    description: f.get('description'),
+  }), '已添加分组').then(ok => ok && e.target.reset());
+});
+
+document.getElementById('link-form').addEventListener('submit', async e => {
+  e.preventDefault();
+  const f = new FormData(e.target);
+  let url = '';
+  const ok = await run(async () => {
+    const resp = await api('POST', '/admin/wake-links', {
+      target: f.get('target'),
+      label: f.get('label'),
+      expires_in: f.get('expires_in'),
+    });
+    url = resp.link.url;
+  }, '已生成链接');
+  if (ok) {
+    e.target.reset();
+    copyLink(url);
+  }
+});
+
+document.getElementById('schedule-form').addEventListener('submit', e => {
+  e.preventDefault();
+  const f = new FormData(e.target);
+  const [kind, name] = f.get('ref').split(/:(.*)/s);
+  const body = { name: f.get('name'), action: f.get('action'), time: f.get('time'), days: f.getAll('days'), enabled: true };
+  body[kind] = name;
+  run(() => api('POST', '/admin/schedules', body), '已添加定时任务').then(ok => ok && e.target.reset());
+});
+
+// 统计：唤醒次数堆叠柱状图
+const chartColors = ['#2563eb', '#16a34a', '#dc2626', '#d97706', '#7c3aed', '#0891b2', '#db2777', '#4b5563'];
+const statusColors = { queued: '#2563eb', delivered: '#0891b2', acked: '#16a34a', failed: '#dc2626', created: '#9ca3af' };
+
+async function loadHistory() {
+  const f = new FormData(document.getElementById('history-form'));
+  const [range, bucket] = f.get('range').split('|');
+  const by = f.get('by');
+  let data;
+  try {
+    data = await api('GET', '/stats/history?range=' + range + '&bucket=' + bucket + '&by=' + by);
+  } catch (err) {
+    showStatus(err.message, true);
+    return;
+  }
+
+  const keys = Object.keys(data.totals).sort();
+  const color = (k, i) => (by === 'status' && statusColors[k]) || chartColors[i % chartColors.length];
+  const max = Math.max(1, ...data.buckets.map(b => b.total));
+  const w = 600, h = 220, n = data.buckets.length, bw = w / n;
+  const ns = 'http://www.w3.org/2000/svg';
+  const svg = document.createElementNS(ns, 'svg');
+  svg.setAttribute('viewBox', '0 0 ' + w + ' ' + (h + 20));
+  svg.setAttribute('preserveAspectRatio', 'none');
+  data.buckets.forEach((b, i) => {
+    let y = h;
+    keys.forEach((k, ki) => {
+      const v = b.counts[k] || 0;
+      if (!v) {
+        return;
+      }
+      const bh = v / max * (h - 10);
+      y -= bh;
+      const rect = document.createElementNS(ns, 'rect');
+      rect.setAttribute('x', i * bw + 1);
+      rect.setAttribute('y', y);
+      rect.setAttribute('width', Math.max(bw - 2, 1));
+      rect.setAttribute('height', bh);
+      rect.setAttribute('fill', color(k, ki));
+      const title = document.createElementNS(ns, 'title');
+      title.textContent = new Date(b.time).toLocaleString() + ' ' + k + ': ' + v;
+      rect.appendChild(title);
+      svg.appendChild(rect);
+    });
+    // 标签过密时只显示部分
+    if (i % Math.ceil(n / 8) === 0) {
+      const label = document.createElementNS(ns, 'text');
+      label.setAttribute('x', i * bw + 2);
+      label.setAttribute('y', h + 14);
+      const t = new Date(b.time);
+      label.textContent = bucket === '1h' ? t.getHours() + ':00' : (t.getMonth() + 1) + '/' + t.getDate();
+      svg.appendChild(label);
+    }
+  });
+  document.querySelector('#history .chart').replaceChildren(svg);
+
+  const legend = document.querySelector('#history .legend');
+  legend.replaceChildren(...keys.map((k, ki) => {
+    const span = el('span', k + ' ' + data.totals[k]);
+    const swatch = el('i');
+    swatch.style.background = color(k, ki);
+    span.prepend(swatch);
+    return span;
+  }));
+}
+
+// 节能：统计范围内估算的用电量和自动睡眠节省的电量，只列出设置了功率的目标
+async function loadEnergy() {
+  const range = new FormData(document.getElementById('history-form')).get('range').split('|')[0];
+  let data;
+  try {
+    data = await api('GET', '/stats/energy?range=' + range);
+  } catch (err) {
+    showStatus(err.message, true);
+    return;
+  }
+  document.getElementById('energy').classList.toggle('hidden', data.targets.length === 0);
+  const t = data.total;
+  const percent = t.used_kwh + t.saved_kwh > 0 ? Math.round(t.saved_kwh / (t.used_kwh + t.saved_kwh) * 100) : 0;
+  const summary = document.querySelector('#energy .energy-summary');
+  summary.replaceChildren('估算用电 ' + t.used_kwh.toFixed(1) + ' kWh，自动睡眠节省 ', el('strong', t.saved_kwh.toFixed(1) + ' kWh（' + percent + '%）'));
+  if (t.cost !== undefined) {
+    summary.append('，电费约 ' + t.cost.toFixed(2) + '，节省 ' + t.saved_cost.toFixed(2));
+  }
+  const hours = s => (s / 3600).toFixed(1) + ' 小时';
+  fill('energy', data.targets.map(e => row([
+    e.target,
+    e.watts + ' W / ' + (e.standby_watts || 0) + ' W',
+    hours(e.on_seconds),
+    hours(e.saved_seconds),
+    e.used_kwh.toFixed(2),
+    e.saved_kwh.toFixed(2),
+  ])));
+}
+
+// 唤醒延迟：各目标每个阶段耗时的中位数和 P95，最后一行为全部合计
+async function loadLatency() {
+  const range = new FormData(document.getElementById('history-form')).get('range').split('|')[0];
+  let data;
+  try {
+    data = await api('GET', '/stats/latency?group_by=target&range=' + range);
+  } catch (err) {
+    showStatus(err.message, true);
+    return;
+  }
+  document.getElementById('latency').classList.toggle('hidden', data.groups.length === 0);
+  const stage = (g, name) => {
+    const s = g.stages[name];
+    return s ? s.p50.toFixed(1) + ' / ' + s.p95.toFixed(1) + ' 秒' : '-';
+  };
+  const groups = data.groups.length > 1 ? [...data.groups, { ...data.total, key: '全部' }] : data.groups;
+  fill('latency', groups.map(g => row([g.key, g.wakes, stage(g, 'poll'), stage(g, 'relay'), stage(g, 'boot'), stage(g, 'total')])));
+}
+
+document.getElementById('history-form').addEventListener('change', () => {
+  loadHistory();
+  loadEnergy();
+  loadLatency();
+});
+
+// 实时状态：通过 WebSocket 接收快照和事件，设备在线状态和消息状态即时更新
+const live = { devices: new Map(), messages: new Map(), socket: null, retry: 1000, flash: null };
+const liveStatus = {
+  'message.queued': 'queued',
+  'message.delivered': 'delivered',
+  'message.acked': 'acked',
+  'message.failed': 'failed',
+};
+const statusNames = { created: '未入队', queued: '排队中', delivered: '已下发', acked: '已唤醒', failed: '失败' };
+
+function renderLive() {
+  const devices = document.querySelector('#live .live-devices');
+  devices.replaceChildren(...[...live.devices.values()].map(d => {
+    const card = el('div', undefined, 'live-device' + (d.online ? ' online' : ''));
+    card.appendChild(el('strong', d.name || d.id));
+    card.appendChild(el('div', d.online ? '在线' : '离线', d.online ? 'online' : 'offline'));
+    return card;
+  }));
+
+  const messages = [...live.messages.values()].sort((a, b) => b.created_at.localeCompare(a.created_at)).slice(0, 50);
+  fill('live', messages.map(m => {
+    const tr = row([formatTime(m.created_at), m.id, m.target || m.target_mac, m.device_id,
+      el('span', statusNames[m.status] || m.status, 'status-' + m.status)]);
+    tr.lastChild.remove();
+    if (m.id === live.flash) {
+      tr.className = 'flash';
+    }
+    return tr;
+  }));
+}
+
+function applyLiveEvent(e) {
+  const data = e.data || {};
+  switch (e.type) {
+    case 'device.registered':
+    case 'device.online':
+    case 'device.offline':
+    case 'device.approved': {
+      const d = live.devices.get(e.device_id) || { id: e.device_id, name: data.name };
+      d.online = e.type !== 'device.offline';
+      live.devices.set(e.device_id, d);
+      break;
+    }
+    case 'device.deleted':
+      live.devices.delete(e.device_id);
+      break;
+    case 'target.up':
+    case 'target.down':
+    case 'target.flapping': {
+      // 开机状态变化时更新唤醒页和目标列表，其余字段在下次刷新时更新
+      const p = { ...((state.power || {})[data.target] || { target: data.target, method: data.method }) };
+      if (e.type === 'target.flapping') {
+        p.flapping = true;
+      } else {
+        Object.assign(p, { state: e.type === 'target.up' ? 'on' : 'off', detail: data.detail, flapping: false, pending: undefined });
+      }
+      state.power = { ...state.power, [data.target]: p };
+      renderWake();
+      renderTargets();
+      return;
+    }
+    default: {
+      const status = liveStatus[e.type];
+      if (!status) {
+        return;
+      }
+      const m = live.messages.get(e.message_id) ||
+        { id: e.message_id, device_id: e.device_id, created_at: e.time, target_mac: data.target_mac, target: data.target };
+      m.status = status;
+      live.messages.set(m.id, m);
+      live.flash = m.id;
+    }
+  }
+  renderLive();
+}
+
+function connectLive() {
+  if (!apiKey() || live.socket) {
+    return;
+  }
+  const url = new URL('../api/admin/ws', location.href);
+  url.protocol = url.protocol === 'https:' ? 'wss:' : 'ws:';
+  url.searchParams.set('api_key', apiKey());
+  const socket = new WebSocket(url);
+  live.socket = socket;
+
+  socket.onopen = () => {
+    live.retry = 1000;
+    document.getElementById('live-state').textContent = '已连接，实时更新中';
+  };
+  socket.onmessage = msg => {
+    const m = JSON.parse(msg.data);
+    if (m.type === 'snapshot') {
+      live.devices = new Map((m.devices || []).map(d => [d.id, d]));
+      live.messages = new Map((m.messages || []).map(x => [x.id, x]));
+      renderLive();
+    } else if (m.type === 'event') {
+      applyLiveEvent(m.event);
+    }
+  };
+  socket.onclose = () => {
+    live.socket = null;
+    document.getElementById('live-state').textContent = '连接已断开，正在重连…';
+    // 指数退避重连，最长30秒
+    setTimeout(connectLive, live.retry);
+    live.retry = Math.min(live.retry * 2, 30000);
+  };
+}
+
+try {
+  state = JSON.parse(localStorage.getItem('esp32-wol-state')) || state;
+} catch (err) {
+  localStorage.removeItem('esp32-wol-state');
+}
+render();
+refresh();
+connectLive();
+// 定期刷新设备在线状态
+setInterval(refresh, 15000);
+window.addEventListener('online', () => {
+  showStatus('');
+  refresh();
+});
+window.addEventListener('offline', () => {
+  showStatus('离线，显示上次同步的数据', true);
+  renderWake();
+});
+
+if ('serviceWorker' in navigator) {
+  navigator.serviceWorker.register('sw.js').catch(err => console.warn('service worker registration failed', err));
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Webhook 通知配置
+type WebhookConfig struct {
+	Name       string   `json:"name"`
+	URL        string   `json:"url"`
+	Events     []string `json:"events"`      // 为空表示全部事件
+	Format     string   `json:"format"`      // json（默认，原始事件）、slack、discord
+	Secret     string   `json:"secret"`      // 设置后对请求体做HMAC-SHA256签名
+	MaxRetries *int     `json:"max_retries"` // 默认3次
+}
+
+// 通知请求使用的HTTP客户端
+var notifyHTTPClient = &http.Client{Timeout: 15 * time.Second}
+
+// Webhook 通知：按格式把事件POST到指定地址
+type webhookNotifier struct {
+	label  string
+	url    string
+	format string
+	secret string
+	filter eventFilter
+}
+
+func newWebhookNotifier(cfg WebhookConfig) (*webhookNotifier, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid url %q", cfg.URL)
+	}
+	filter, err := newEventFilter(cfg.Events)
+	if err != nil {
+		return nil, err
+	}
+	format := cfg.Format
+	switch format {
+	case "":
+		format = "json"
+	case "json", "slack", "discord":
+	default:
+		return nil, fmt.Errorf("unknown format %q", cfg.Format)
+	}
+	label := cfg.Name
+	if label == "" {
+		label = format + ":" + u.Host
+	}
+	return &webhookNotifier{label: label, url: cfg.URL, format: format, secret: cfg.Secret, filter: filter}, nil
+}
+
+func (n *webhookNotifier) name() string { return n.label }
+
+func (n *webhookNotifier) wants(eventType string) bool { return n.filter.wants(eventType) }
+
+func (n *webhookNotifier) send(ctx context.Context, e Event) error {
+	var payload any = e
+	switch n.format {
+	case "slack":
+		payload = slackPayload(e)
+	case "discord":
+		payload = discordPayload(e)
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return permanentError{err}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return permanentError{err}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "ESP32-WOL-Server")
+	req.Header.Set("X-WOL-Event", e.Type)
+	req.Header.Set("X-WOL-Delivery", strconv.FormatInt(e.ID, 10))
+	if n.secret != "" {
+		req.Header.Set("X-WOL-Signature", signPayload(n.secret, time.Now(), body))
+	}
+	return doNotifyRequest(req)
+}
+
+// 签名格式: t=<unix时间戳>,v1=<hex(HMAC-SHA256(secret, "<时间戳>.<请求体>"))>
+// 接收方应校验时间戳，拒绝过旧的请求以防重放
+func signPayload(secret string, now time.Time, body []byte) string {
+	ts := strconv.FormatInt(now.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "t=" + ts + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// 发送通知请求：2xx 为成功，4xx（429除外）不再重试
+func doNotifyRequest(req *http.Request) error {
+	resp, err := notifyHTTPClient.Do(req)
+	if err != nil {
+		// 错误信息中不带完整URL，避免泄露其中的令牌
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			return fmt.Errorf("%s: %v", req.URL.Host, urlErr.Err)
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	snippet, _ := io.ReadAll(io.LimitReader(resp.Body, 256))
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	err = fmt.Errorf("%s: HTTP %d: %s", req.URL.Host, resp.StatusCode, bytes.TrimSpace(snippet))
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+		return permanentError{err}
+	}
+	return err
+}
+
+// 事件严重程度，决定聊天消息的颜色
+func eventSeverity(eventType string) string {
+	switch eventType {
+	case eventMessageFailed, eventDeviceOffline, eventAlertRelayOffline, eventAlertRepeatedFailures, eventAlertBootLoop, eventAlertLowBattery, eventDeviceCrashed, eventAuthFailureBurst, eventQueueBackpressure:
+		return "danger"
+	case eventMessageAcked, eventDeviceOnline:
+		return "good"
+	default:
+		return "info"
+	}
+}
+
+// 事件的附加字段，按键名排序
+func eventFields(e Event) [][2]string {
+	var fields [][2]string
+	if e.DeviceID != "" {
+		fields = append(fields, [2]string{"relay", e.DeviceID})
+	}
+	if e.MessageID != "" {
+		fields = append(fields, [2]string{"message", e.MessageID})
+	}
+	keys := make([]string, 0, len(e.Data))
+	for k := range e.Data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if v := fmt.Sprint(e.Data[k]); v != "" {
+			fields = append(fields, [2]string{k, v})
+		}
+	}
+	return fields
+}
+
+// Slack incoming webhook 消息（attachments 带颜色条）
+func slackPayload(e Event) map[string]any {
+	colors := map[string]string{"danger": "#d0021b", "good": "#2eb886", "info": "#439fe0"}
+	var fields []map[string]any
+	for _, f := range eventFields(e) {
+		fields = append(fields, map[string]any{"title": f[0], "value": f[1], "short": true})
+	}
+	summary := eventSummary(e)
+	return map[string]any{
+		"text": summary,
+		"attachments": []map[string]any{{
+			"color":    colors[eventSeverity(e.Type)],
+			"fallback": summary,
+			"title":    e.Type,
+			"fields":   fields,
+			"footer":   "ESP32 WOL",
+			"ts":       e.Time.Unix(),
+		}},
+	}
+}
+
+// Discord webhook 消息（embed）
+func discordPayload(e Event) map[string]any {
+	colors := map[string]int{"danger": 0xd0021b, "good": 0x2eb886, "info": 0x439fe0}
+	var fields []map[string]any
+	for _, f := range eventFields(e) {
+		fields = append(fields, map[string]any{"name": f[0], "value": f[1], "inline": true})
+	}
+	return map[string]any{
+		"username": "ESP32 WOL",
+		"embeds": []map[string]any{{
+			"title":       eventSummary(e),
+			"description": e.Type,
+			"color":       colors[eventSeverity(e.Type)],
+			"timestamp":   e.Time.Format(time.RFC3339),
+			"fields":      fields,
+		}},
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// WiFi扫描报告：管理员下发 wifi_scan 命令后，中继扫描周围的网络并上传结果，
+// 用于远程排查中继信号差的问题。每台设备保存最近几次扫描（仅在内存中）
+
+const (
+	maxWiFiScans    = 5
+	maxWiFiNetworks = 64 // 单次扫描保存的网络数，按信号强度保留最强的
+	maxWiFiScanBody = 32 * 1024
+)
+
+type WiFiNetwork struct {
+	SSID     string `json:"ssid"`
+	BSSID    string `json:"bssid"`
+	Channel  int    `json:"channel"`
+	RSSI     int    `json:"rssi"`               // dBm
+	Security string `json:"security,omitempty"` // open、wep、wpa-psk、wpa2-psk 等
+	Hidden   bool   `json:"hidden,omitempty"`
+}
+
+type WiFiScan struct {
+	Time      time.Time     `json:"time"`                 // 扫描时间（UTC），设备未上报或时钟超出容差时为服务器收到的时间
+	MessageID string        `json:"message_id,omitempty"` // 触发扫描的命令，主动上报时为空
+	SSID      string        `json:"ssid,omitempty"`       // 中继当前连接的网络
+	RSSI      int           `json:"rssi,omitempty"`       // 当前连接的信号强度
+	Networks  []WiFiNetwork `json:"networks"`
+}
+
+type wifiScanLog struct {
+	mu    sync.Mutex
+	scans map[string][]WiFiScan // 设备ID -> 扫描结果，按时间先后
+}
+
+var wifiScans = &wifiScanLog{scans: make(map[string][]WiFiScan)}
+
+func (l *wifiScanLog) add(deviceID string, scan WiFiScan) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	list := append(l.scans[deviceID], scan)
+	if len(list) > maxWiFiScans {
+		list = append([]WiFiScan(nil), list[len(list)-maxWiFiScans:]...)
+	}
+	l.scans[deviceID] = list
+}
+
+// 最近的扫描，最新的在前
+func (l *wifiScanLog) list(deviceID string) []WiFiScan {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	stored := l.scans[deviceID]
+	list := make([]WiFiScan, len(stored))
+	for i, s := range stored {
+		list[len(stored)-1-i] = s
+	}
+	return list
+}
+
+func (l *wifiScanLog) forget(deviceID string) {
+	l.mu.Lock()
+	delete(l.scans, deviceID)
+	l.mu.Unlock()
+}
+
+// POST /api/devices/<id>/wifi-scan
+func uploadWiFiScan(w http.ResponseWriter, r *http.Request, deviceID string) {
+	var req WiFiScan
+	r.Body = http.MaxBytesReader(w, r.Body, maxWiFiScanBody)
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if req.MessageID != "" {
+		storage.mu.RLock()
+		msg, exists := storage.messages[req.MessageID]
+		valid := exists && msg.DeviceID == deviceID && msg.Type == messageTypeWiFiScan
+		storage.mu.RUnlock()
+		if !valid {
+			http.Error(w, "Message not found", http.StatusNotFound)
+			return
+		}
+	}
+	storage.mu.Lock()
+	req.Time, _ = deviceTimestamp(deviceID, req.Time)
+	storage.mu.Unlock()
+	if req.Networks == nil {
+		req.Networks = []WiFiNetwork{}
+	}
+	sort.SliceStable(req.Networks, func(i, j int) bool { return req.Networks[i].RSSI > req.Networks[j].RSSI })
+	if len(req.Networks) > maxWiFiNetworks {
+		req.Networks = req.Networks[:maxWiFiNetworks]
+	}
+	wifiScans.add(deviceID, req)
+	requestLogger(r).Info("wifi scan uploaded", "device_id", deviceID, "message_id", req.MessageID, "networks", len(req.Networks), "rssi", req.RSSI)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"message": "WiFi scan stored",
+	})
+}
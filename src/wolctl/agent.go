@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"runtime"
+	"syscall"
+	"time"
+)
+
+// 配套代理：在目标电脑上运行，定期向服务器上报用户的空闲时间，并执行服务器下发的睡眠或关机命令
+// （目标的 power_policy、action 为 suspend/shutdown 的定时任务，或管理员手动发出）。
+// 空闲时间和睡眠、关机命令的实现按平台分别在 agent_<系统>.go 中
+
+const agentVersion = "1"
+
+func agentCommand(c *client, args []string) error {
+	fs := flag.NewFlagSet("agent", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "report idle time and log commands without running them")
+	once := fs.Bool("once", false, "report once and exit")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: wolctl agent [-dry-run] [-once] <target>")
+	}
+	target := fs.Arg(0)
+	hostname, _ := os.Hostname()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	interval := time.Minute
+	for {
+		idle, err := idleTime()
+		if err != nil {
+			// 读不到空闲时间时按正在使用上报，空闲策略不会触发，定时和手动命令仍然执行
+			log.Printf("cannot read idle time: %v", err)
+			idle = 0
+		}
+		result, err := c.doContext(ctx, http.MethodPost, "/api/agent/"+url.PathEscape(target), map[string]any{
+			"hostname":     hostname,
+			"platform":     runtime.GOOS + "/" + runtime.GOARCH,
+			"version":      agentVersion,
+			"idle_seconds": int64(idle.Seconds()),
+		})
+		switch {
+		case ctx.Err() != nil:
+			return nil
+		case err != nil && *once:
+			return err
+		case err != nil:
+			// 服务器重启或网络中断时继续重试
+			log.Printf("report failed: %v", err)
+		default:
+			if seconds, ok := result["report_interval"].(float64); ok && seconds >= 1 {
+				interval = time.Duration(seconds) * time.Second
+			}
+			if command, ok := result["command"].(map[string]any); ok {
+				if err := runPowerCommand(command, *dryRun); err != nil {
+					log.Printf("%v", err)
+				}
+			}
+		}
+		if *once {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(interval):
+		}
+	}
+}
+
+func runPowerCommand(command map[string]any, dryRun bool) error {
+	action, _ := command["action"].(string)
+	cmd := powerCommand(action)
+	if cmd == nil {
+		return fmt.Errorf("command %v: %s is not supported on %s", command["id"], action, runtime.GOOS)
+	}
+	log.Printf("command %v: %s (%v): %s", command["id"], action, command["reason"], cmd)
+	if dryRun {
+		return nil
+	}
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("command %v: %s failed: %w", command["id"], action, err)
+	}
+	return nil
+}
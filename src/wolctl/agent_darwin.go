@@ -0,0 +1,36 @@
+package main
+
+import (
+	"errors"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+var hidIdleTime = regexp.MustCompile(`"HIDIdleTime" = (\d+)`)
+
+// 空闲时间来自 IOHIDSystem 的 HIDIdleTime（最后一次输入到现在的纳秒数）
+func idleTime() (time.Duration, error) {
+	out, err := exec.Command("ioreg", "-c", "IOHIDSystem", "-d", "4").Output()
+	if err != nil {
+		return 0, err
+	}
+	m := hidIdleTime.FindSubmatch(out)
+	if m == nil {
+		return 0, errors.New("HIDIdleTime not found in ioreg output")
+	}
+	ns, err := strconv.ParseInt(string(m[1]), 10, 64)
+	return time.Duration(ns), err
+}
+
+func powerCommand(action string) *exec.Cmd {
+	switch action {
+	case "suspend":
+		return exec.Command("pmset", "sleepnow")
+	case "shutdown":
+		// 需要 root 权限
+		return exec.Command("shutdown", "-h", "now")
+	}
+	return nil
+}
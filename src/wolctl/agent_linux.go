@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 没有任何登录会话时开始计时的时间
+var noSessionsSince time.Time
+
+// 空闲时间来自 systemd-logind：所有会话都空闲时 IdleHint 为 yes，IdleSinceHint 为开始空闲的时间
+// （桌面环境在锁屏或屏幕空闲时设置，终端会话按最后输入的时间）。
+// 无人登录的机器没有会话，从代理发现没有会话时开始计算
+func idleTime() (time.Duration, error) {
+	out, err := exec.Command("loginctl", "show", "--property=IdleHint", "--property=IdleSinceHint").Output()
+	if err != nil {
+		return 0, err
+	}
+	props := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		if k, v, ok := strings.Cut(scanner.Text(), "="); ok {
+			props[k] = v
+		}
+	}
+	if props["IdleHint"] == "yes" {
+		if since, err := strconv.ParseInt(props["IdleSinceHint"], 10, 64); err == nil && since > 0 {
+			return time.Since(time.UnixMicro(since)), nil
+		}
+	}
+
+	sessions, err := exec.Command("loginctl", "list-sessions", "--no-legend").Output()
+	if err != nil {
+		return 0, err
+	}
+	if len(bytes.TrimSpace(sessions)) > 0 {
+		noSessionsSince = time.Time{}
+		if props["IdleHint"] == "" {
+			return 0, errors.New("loginctl did not report IdleHint")
+		}
+		return 0, nil
+	}
+	if noSessionsSince.IsZero() {
+		noSessionsSince = time.Now()
+	}
+	return time.Since(noSessionsSince), nil
+}
+
+func powerCommand(action string) *exec.Cmd {
+	switch action {
+	case "suspend":
+		return exec.Command("systemctl", "suspend")
+	case "shutdown":
+		return exec.Command("systemctl", "poweroff")
+	}
+	return nil
+}
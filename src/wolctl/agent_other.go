@@ -0,0 +1,18 @@
+//go:build !linux && !windows && !darwin
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+	"time"
+)
+
+func idleTime() (time.Duration, error) {
+	return 0, fmt.Errorf("idle time is not supported on %s", runtime.GOOS)
+}
+
+func powerCommand(action string) *exec.Cmd {
+	return nil
+}
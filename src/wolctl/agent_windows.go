@@ -0,0 +1,41 @@
+package main
+
+import (
+	"os/exec"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+var (
+	procGetLastInputInfo = syscall.NewLazyDLL("user32.dll").NewProc("GetLastInputInfo")
+	procGetTickCount     = syscall.NewLazyDLL("kernel32.dll").NewProc("GetTickCount")
+)
+
+type lastInputInfo struct {
+	cbSize uint32
+	dwTime uint32
+}
+
+// 空闲时间为当前会话最后一次键盘或鼠标输入到现在的时间，代理需要在用户的会话中运行
+// （例如登录时启动的计划任务），作为服务运行时读到的是服务会话的输入
+func idleTime() (time.Duration, error) {
+	info := lastInputInfo{cbSize: uint32(unsafe.Sizeof(lastInputInfo{}))}
+	if ok, _, err := procGetLastInputInfo.Call(uintptr(unsafe.Pointer(&info))); ok == 0 {
+		return 0, err
+	}
+	tick, _, _ := procGetTickCount.Call()
+	// 两者都是开机后的毫秒数，49.7天回绕，按无符号相减
+	return time.Duration(uint32(tick)-info.dwTime) * time.Millisecond, nil
+}
+
+func powerCommand(action string) *exec.Cmd {
+	switch action {
+	case "suspend":
+		// 开启了休眠时进入休眠而不是睡眠（powercfg /hibernate off 关闭休眠）
+		return exec.Command("rundll32.exe", "powrprof.dll,SetSuspendState", "0,1,0")
+	case "shutdown":
+		return exec.Command("shutdown.exe", "/s", "/t", "0")
+	}
+	return nil
+}
@@ -0,0 +1,3 @@
+module wolctl
+
+go 1.22
@@ -0,0 +1,1533 @@
+// wolctl 是 ESP32 WOL 服务器的命令行客户端
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const usage = `Usage: wolctl [options] <command> [arguments]
+
+Commands:
+  devices list                      list relay devices
+  devices tag <id> [tag...]         set a device's tags (no tags clears them)
+  devices channel <id> <channel>    pin a device to a firmware channel ("" follows the device)
+  devices reboot <id>               restart a relay (track it with "wolctl status -wait 30s <message-id>")
+  devices wifi-scan <id>            ask a relay to scan for WiFi networks and upload the results
+  devices purge <id>                drop every message still queued for a relay
+  devices purge-all                 drop every queued message on the server (server API key only)
+  devices polls                     list relays currently waiting in a long poll
+  devices release <id>              end a relay's long poll now; it reconnects on its next poll
+  devices wifi <id>                 show the networks a relay saw in its latest scan
+  devices neighbor-scan <id>        ask a relay to report the hosts it finds on its subnet
+  devices neighbors <id>            show the hosts (MAC and IP) a relay has reported
+  devices crashes <id>              show a relay's recent reset reasons and crash dumps
+  firmware list [channel]           list uploaded firmware builds
+  firmware upload <channel> <version> <file> [percent=N] [tags=a,b]
+  firmware rollout <id> <percent> [tag...]  change which devices are offered a build
+  firmware delete <id>              delete a firmware build
+  targets list                      list named wake targets
+  targets share <name> <user> read|wake  share one of your targets with another user
+  targets unshare <name> <user>     stop sharing a target
+  targets protect|unprotect <name>  require a second administrator's approval to wake a target
+  targets hours <name> [HH:MM-HH:MM[@mon,tue]...]  only accept wakes in these windows (none clears them)
+  targets cooldown <name> <duration|default>  minimum time between wakes, e.g. 2m ("default" uses the server's -wake-cooldown)
+  targets suggest [-add]            list hosts seen by relays that are not targets yet (-add creates them)
+  discover list                     list recent discovery jobs
+  discover start [-wait 2m] <id>    ask a relay to scan its subnet for hosts to add as targets
+  discover show <job-id>            show the hosts a discovery job found, with NIC vendors
+  discover promote <job-id> <mac> [name]  create a target from a discovered host
+  groups list                       list target groups
+  users list|add|delete|token <name> manage user accounts (server API key only)
+  users add <name> [role]           create a user (role viewer, operator or admin)
+  users role <name> <role>          change a user's role
+  users quota <name> [key=value...] set a user's quota (wakes_per_hour, wakes_per_day,
+                                    max_devices, max_schedules; no values removes it)
+  tokens quota <id> [key=value...]  limit one of your tokens (wakes_per_hour, wakes_per_day)
+  quota                             show your quota and usage (user token)
+  tokens list|create <label>|revoke <id> manage your own API tokens (user token)
+  keys list|create <label>|delete <id> manage server API keys (server API key only)
+  keys create -read-only <label>    create a key that can only view devices, targets, messages
+                                    and stats, e.g. for a wall display
+  keys disable|enable <id>          stop or resume accepting a server API key
+  keys rename <id> <label>          change a server API key's label
+  orgs list|add|delete <name>       manage organizations
+  enrollments list|delete <id>      manage relay enrollment codes
+  enrollments create [key=value...] create a one-time enrollment code (user, device_name, label,
+                                    poll_interval, broadcast_ip, wol_port, expires_in)
+  orgs add-member|remove-member <org> <user>
+  wake <target>                     wake a named target
+  wake -group <name>                wake every target in a group
+  wake -device <id> -mac <mac>      wake a MAC address through a specific relay
+  wake -file <rows.csv|rows.json>   wake every MAC address in a file (target_mac[,device_id] per row)
+  wake -dry-run ...                 check a wake (device, access, quota, queue) without sending it
+  wake -override-hours <target>     wake outside the target's allowed hours (administrators only)
+  wake -to <address,...> ...        send this wake's magic packet to these addresses instead
+  stats [target|device|user] [range]  wake counts and success rates, e.g. "stats device 7d"
+  stats energy [range]              estimated energy use and savings from auto-suspend
+  stats latency [target|device] [range]  wake latency (p50/p95) per stage: poll wait, relay,
+                                    target boot
+  messages [-all] [key=value...]    search messages (target, target_mac, device_id, status,
+                                    requester, type, since, until, order, limit, cursor)
+  status <message-id>               show the status and stage timestamps of a wake message
+  bulk <job-id>                     show the rows of a bulk wake ("wake -file") and their status
+  cancel <message-id>               cancel a wake message that has not been delivered yet
+  approve|reject <message-id>       review a wake of a protected target (list them with
+                                    "messages status=pending_approval")
+  targets suspend|shutdown <name>   ask the agent on a target to suspend or shut it down
+  targets policy <name> [suspend|shutdown idle=30m]  suspend a target after it has been idle (no
+                                    arguments removes the policy; needs "wolctl agent" on the target)
+  targets destinations <name> [address...]  send the target's magic packets to each address in
+                                    order: IPv4[:port], "unicast" (last known IP) or "subnet"
+                                    (its /24 broadcast); no addresses uses the relay's default
+  targets watts <name> [watts [standby]]  set a target's estimated power draw when on and when
+                                    suspended/off, for "stats energy" (no values removes it)
+  agent [-dry-run] <target>         run on a target: report idle time, run suspend/shutdown commands
+  agents list                       list the agents reporting for your targets
+  tui                               interactive terminal interface with live updates
+  version                           show the server's version and build information
+  maintenance [on [reason] [retry=N]|off]  show or toggle maintenance mode (new wakes get 503)
+  simulate [-devices N] [...]       emulate a fleet of relays for load testing the server
+
+Options:
+`
+
+// 配置文件内容，默认位于 <用户配置目录>/wolctl/config.json
+type config struct {
+	Server string `json:"server"`
+	APIKey string `json:"api_key"`
+}
+
+// 服务器客户端
+type client struct {
+	server string
+	apiKey string
+	http   *http.Client
+}
+
+// 输出为JSON而不是表格，便于脚本处理
+var jsonOutput bool
+
+func main() {
+	global := flag.NewFlagSet("wolctl", flag.ExitOnError)
+	configPath := global.String("config", defaultConfigPath(), "config file path")
+	server := global.String("server", "", "server URL, e.g. https://wol.example.com (overrides config and WOLCTL_SERVER)")
+	apiKey := global.String("api-key", "", "API key (overrides config and WOLCTL_API_KEY)")
+	timeout := global.Duration("timeout", 10*time.Second, "request timeout")
+	global.BoolVar(&jsonOutput, "json", false, "print raw JSON responses")
+	global.Usage = func() {
+		fmt.Fprint(global.Output(), usage)
+		global.PrintDefaults()
+	}
+	global.Parse(os.Args[1:])
+
+	args := global.Args()
+	if len(args) == 0 {
+		global.Usage()
+		os.Exit(2)
+	}
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		fail(err)
+	}
+	// 优先级：命令行参数 > 环境变量 > 配置文件
+	for _, o := range []struct {
+		dst       *string
+		flag, env string
+	}{
+		{&cfg.Server, *server, "WOLCTL_SERVER"},
+		{&cfg.APIKey, *apiKey, "WOLCTL_API_KEY"},
+	} {
+		if o.flag != "" {
+			*o.dst = o.flag
+		} else if v := os.Getenv(o.env); v != "" {
+			*o.dst = v
+		}
+	}
+	if cfg.Server == "" {
+		fail(fmt.Errorf("no server configured: set \"server\" in %s, WOLCTL_SERVER or -server", *configPath))
+	}
+
+	c := &client{
+		server: strings.TrimRight(cfg.Server, "/"),
+		apiKey: cfg.APIKey,
+		http:   &http.Client{Timeout: *timeout},
+	}
+
+	switch cmd, rest := args[0], args[1:]; cmd {
+	case "devices":
+		err = devicesCommand(c, rest)
+	case "firmware":
+		err = firmwareCommand(c, rest)
+	case "targets":
+		err = targetsCommand(c, rest)
+	case "groups":
+		err = listCommand(c, rest, "/api/admin/groups", "groups", []string{"NAME", "TARGETS", "DESCRIPTION"},
+			func(item map[string]any) []any {
+				return []any{item["name"], item["targets"], item["description"]}
+			})
+	case "users":
+		err = usersCommand(c, rest)
+	case "tokens":
+		err = tokensCommand(c, rest)
+	case "keys":
+		err = keysCommand(c, rest)
+	case "quota":
+		err = quotaCommand(c, rest)
+	case "enrollments":
+		err = enrollmentsCommand(c, rest)
+	case "orgs":
+		err = orgsCommand(c, rest)
+	case "wake":
+		err = wakeCommand(c, rest)
+	case "bulk":
+		err = bulkCommand(c, rest)
+	case "agent":
+		err = agentCommand(c, rest)
+	case "agents":
+		err = listCommand(c, rest, "/api/admin/agents", "agents", []string{"TARGET", "HOST", "PLATFORM", "IDLE", "ONLINE", "REPORTED", "LAST COMMAND"},
+			func(item map[string]any) []any {
+				var last any
+				if cmd, ok := item["last_command"].(map[string]any); ok {
+					last = fmt.Sprintf("%v (%v) at %s", cmd["action"], cmd["reason"], formatCell(cmd["delivered_at"]))
+				}
+				idle, _ := item["idle_seconds"].(float64)
+				return []any{item["target"], item["hostname"], item["platform"], (time.Duration(idle) * time.Second).String(), item["online"], item["reported_at"], last}
+			})
+	case "discover":
+		err = discoverCommand(c, rest)
+	case "messages":
+		err = messagesCommand(c, rest)
+	case "stats":
+		err = statsCommand(c, rest)
+	case "status":
+		err = statusCommand(c, rest)
+	case "cancel":
+		if len(rest) != 1 {
+			err = errors.New("usage: wolctl cancel <message-id>")
+			break
+		}
+		_, err = c.do(http.MethodDelete, "/api/wol/messages/"+rest[0], nil)
+	case "approve", "reject":
+		if len(rest) != 1 {
+			err = fmt.Errorf("usage: wolctl %s <message-id>", cmd)
+			break
+		}
+		_, err = c.do(http.MethodPost, "/api/wol/messages/"+url.PathEscape(rest[0])+"/"+cmd, nil)
+	case "tui":
+		err = tuiCommand(c, rest)
+	case "version":
+		err = versionCommand(c, rest)
+	case "maintenance":
+		err = maintenanceCommand(c, rest)
+	case "simulate":
+		err = simulateCommand(c, rest)
+	default:
+		err = fmt.Errorf("unknown command %q (see wolctl -h)", cmd)
+	}
+	if err != nil {
+		fail(err)
+	}
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, "wolctl:", err)
+	os.Exit(1)
+}
+
+func defaultConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "wolctl.json"
+	}
+	return filepath.Join(dir, "wolctl", "config.json")
+}
+
+// 读取配置文件，文件不存在时返回空配置
+func loadConfig(path string) (config, error) {
+	var cfg config
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return cfg, nil
+	}
+	if err != nil {
+		return cfg, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return cfg, fmt.Errorf("parse %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// 发送请求并解析JSON响应；非2xx时返回服务器给出的错误信息
+func (c *client) do(method, path string, body any) (map[string]any, error) {
+	return c.doContext(context.Background(), method, path, body)
+}
+
+func (c *client) doContext(ctx context.Context, method, path string, body any) (map[string]any, error) {
+	// io.Reader 作为原始请求体发送（例如上传固件），其他值编码为JSON
+	var reader io.Reader
+	contentType := "application/json"
+	if raw, ok := body.(io.Reader); ok {
+		reader = raw
+		contentType = "application/octet-stream"
+	} else if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.server+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	if c.apiKey != "" {
+		req.Header.Set("X-API-Key", c.apiKey)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(data)))
+	}
+	if jsonOutput {
+		os.Stdout.Write(data)
+	}
+
+	var result map[string]any
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("%s %s: invalid response: %w", method, path, err)
+	}
+	return result, nil
+}
+
+// 通用的列表命令，目前只支持 list 子命令
+func listCommand(c *client, args []string, path, key string, header []string, columns func(map[string]any) []any) error {
+	if len(args) != 1 || args[0] != "list" {
+		return fmt.Errorf("usage: wolctl %s list", key)
+	}
+	result, err := c.do(http.MethodGet, path, nil)
+	if err != nil || jsonOutput {
+		return err
+	}
+
+	items, _ := result[key].([]any)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(header, "\t"))
+	for _, item := range items {
+		fields, _ := item.(map[string]any)
+		cells := columns(fields)
+		strs := make([]string, len(cells))
+		for i, cell := range cells {
+			strs[i] = formatCell(cell)
+		}
+		fmt.Fprintln(tw, strings.Join(strs, "\t"))
+	}
+	return tw.Flush()
+}
+
+func formatCell(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return "-"
+	case string:
+		if v == "" {
+			return "-"
+		}
+		if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+			return t.Local().Format("2006-01-02 15:04:05")
+		}
+		return v
+	case []any:
+		parts := make([]string, len(v))
+		for i, p := range v {
+			parts[i] = formatCell(p)
+		}
+		return strings.Join(parts, ",")
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// 用户管理：创建和重新生成令牌时输出新令牌（只显示这一次）
+func usersCommand(c *client, args []string) error {
+	if len(args) == 1 && args[0] == "list" {
+		return listCommand(c, args, "/api/admin/users", "users", []string{"NAME", "ROLE", "DEVICES", "TARGETS", "TOKENS", "CREATED"},
+			func(item map[string]any) []any {
+				return []any{item["name"], item["role"], item["devices"], item["targets"], item["tokens"], item["created_at"]}
+			})
+	}
+	var result map[string]any
+	var err error
+	switch {
+	case (len(args) == 2 || len(args) == 3) && args[0] == "add":
+		req := map[string]string{"name": args[1]}
+		if len(args) == 3 {
+			req["role"] = args[2]
+		}
+		result, err = c.do(http.MethodPost, "/api/admin/users", req)
+	case len(args) == 3 && args[0] == "role":
+		_, err = c.do(http.MethodPut, "/api/admin/users/"+url.PathEscape(args[1]), map[string]string{"role": args[2]})
+		return err
+	case len(args) >= 2 && args[0] == "quota":
+		quota, err := parseQuota(args[2:])
+		if err != nil {
+			return err
+		}
+		_, err = c.do(http.MethodPut, "/api/admin/users/"+url.PathEscape(args[1]), map[string]any{"quota": quota})
+		return err
+	case len(args) == 2 && args[0] == "delete":
+		_, err = c.do(http.MethodDelete, "/api/admin/users/"+url.PathEscape(args[1]), nil)
+		return err
+	case len(args) == 2 && args[0] == "token":
+		result, err = c.do(http.MethodPost, "/api/admin/users/"+url.PathEscape(args[1])+"/token", nil)
+	default:
+		return errors.New("usage: wolctl users list | add <name> [role] | role <name> <role> | quota <name> [key=value...] | delete <name> | token <name>")
+	}
+	if err != nil || jsonOutput {
+		return err
+	}
+	fmt.Println(result["token"])
+	return nil
+}
+
+// 当前用户的令牌，创建时输出新令牌（只显示这一次）
+func tokensCommand(c *client, args []string) error {
+	if len(args) == 1 && args[0] == "list" {
+		return listCommand(c, args, "/api/admin/tokens", "tokens", []string{"ID", "LABEL", "HINT", "CREATED", "LAST USED"},
+			func(item map[string]any) []any {
+				return []any{item["id"], item["label"], item["hint"], item["created_at"], item["last_used_at"]}
+			})
+	}
+	switch {
+	case len(args) == 2 && args[0] == "create":
+		result, err := c.do(http.MethodPost, "/api/admin/tokens", map[string]string{"label": args[1]})
+		if err != nil || jsonOutput {
+			return err
+		}
+		fmt.Println(result["token"])
+		return nil
+	case len(args) == 2 && args[0] == "revoke":
+		_, err := c.do(http.MethodDelete, "/api/admin/tokens/"+url.PathEscape(args[1]), nil)
+		return err
+	case len(args) >= 2 && args[0] == "quota":
+		quota, err := parseQuota(args[2:])
+		if err != nil {
+			return err
+		}
+		_, err = c.do(http.MethodPut, "/api/admin/tokens/"+url.PathEscape(args[1]), map[string]any{"quota": quota})
+		return err
+	}
+	return errors.New("usage: wolctl tokens list | create <label> | revoke <id> | quota <id> [key=value...]")
+}
+
+// 服务器API密钥，创建时输出新密钥（只显示这一次）
+func keysCommand(c *client, args []string) error {
+	if len(args) == 1 && args[0] == "list" {
+		return listCommand(c, args, "/api/admin/api-keys", "api_keys", []string{"ID", "LABEL", "HINT", "READ ONLY", "DISABLED", "CREATED", "LAST USED"},
+			func(item map[string]any) []any {
+				return []any{item["id"], item["label"], item["hint"], item["read_only"], item["disabled"], item["created_at"], item["last_used_at"]}
+			})
+	}
+	switch {
+	case (len(args) == 2 || (len(args) == 3 && args[1] == "-read-only")) && args[0] == "create":
+		body := map[string]any{"label": args[len(args)-1], "read_only": len(args) == 3}
+		result, err := c.do(http.MethodPost, "/api/admin/api-keys", body)
+		if err != nil || jsonOutput {
+			return err
+		}
+		fmt.Println(result["api_key"])
+		return nil
+	case len(args) == 2 && (args[0] == "disable" || args[0] == "enable"):
+		_, err := c.do(http.MethodPut, "/api/admin/api-keys/"+url.PathEscape(args[1]), map[string]any{"disabled": args[0] == "disable"})
+		return err
+	case len(args) == 3 && args[0] == "rename":
+		_, err := c.do(http.MethodPut, "/api/admin/api-keys/"+url.PathEscape(args[1]), map[string]any{"label": args[2]})
+		return err
+	case len(args) == 2 && args[0] == "delete":
+		_, err := c.do(http.MethodDelete, "/api/admin/api-keys/"+url.PathEscape(args[1]), nil)
+		return err
+	}
+	return errors.New("usage: wolctl keys list | create [-read-only] <label> | disable <id> | enable <id> | rename <id> <label> | delete <id>")
+}
+
+// 设备注册码：create 输出注册码，填入固件的 PROVISION_CODE
+func enrollmentsCommand(c *client, args []string) error {
+	if len(args) == 1 && args[0] == "list" {
+		return listCommand(c, args, "/api/admin/enrollments", "enrollments", []string{"ID", "LABEL", "USER", "DEVICE NAME", "EXPIRES", "USED BY"},
+			func(item map[string]any) []any {
+				return []any{item["id"], item["label"], item["user"], item["device_name"], item["expires_at"], item["used_by"]}
+			})
+	}
+	switch {
+	case len(args) >= 1 && args[0] == "create":
+		req := map[string]any{}
+		for _, arg := range args[1:] {
+			key, value, ok := strings.Cut(arg, "=")
+			if !ok {
+				return fmt.Errorf("invalid option %q, use key=value", arg)
+			}
+			switch key {
+			case "poll_interval", "wol_port":
+				n, err := strconv.Atoi(value)
+				if err != nil {
+					return fmt.Errorf("%s must be a number", key)
+				}
+				req[key] = n
+			case "user", "device_name", "label", "broadcast_ip", "expires_in":
+				req[key] = value
+			default:
+				return fmt.Errorf("unknown option %q", key)
+			}
+		}
+		result, err := c.do(http.MethodPost, "/api/admin/enrollments", req)
+		if err != nil || jsonOutput {
+			return err
+		}
+		fmt.Println(result["code"])
+		return nil
+	case len(args) == 2 && args[0] == "delete":
+		_, err := c.do(http.MethodDelete, "/api/admin/enrollments/"+url.PathEscape(args[1]), nil)
+		return err
+	}
+	return errors.New("usage: wolctl enrollments list | create [key=value...] | delete <id>")
+}
+
+// 解析 key=value 形式的配额，没有参数时返回空配额（取消限制）
+func parseQuota(args []string) (map[string]int, error) {
+	quota := map[string]int{}
+	for _, arg := range args {
+		key, value, ok := strings.Cut(arg, "=")
+		n, err := strconv.Atoi(value)
+		if !ok || err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid quota %q, use key=number", arg)
+		}
+		quota[key] = n
+	}
+	return quota, nil
+}
+
+// 当前用户的配额和用量
+func quotaCommand(c *client, args []string) error {
+	if len(args) != 0 {
+		return errors.New("usage: wolctl quota")
+	}
+	result, err := c.do(http.MethodGet, "/api/admin/quota", nil)
+	if err != nil || jsonOutput {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SCOPE\tQUOTA\tUSED\tLIMIT")
+	rows := []struct{ usage, quota string }{
+		{"wakes_last_hour", "wakes_per_hour"},
+		{"wakes_last_day", "wakes_per_day"},
+		{"devices", "max_devices"},
+		{"schedules", "max_schedules"},
+	}
+	for _, scope := range []string{"user", "token"} {
+		section, _ := result[scope].(map[string]any)
+		usage, _ := section["usage"].(map[string]any)
+		quota, _ := section["quota"].(map[string]any)
+		for _, row := range rows {
+			if scope == "token" && (row.quota == "max_devices" || row.quota == "max_schedules") {
+				continue
+			}
+			limit := quota[row.quota]
+			if limit == nil {
+				limit = "unlimited"
+			}
+			used := usage[row.usage]
+			if used == nil {
+				used = float64(0)
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", scope, row.quota, formatCell(used), formatCell(limit))
+		}
+	}
+	return tw.Flush()
+}
+
+func devicesCommand(c *client, args []string) error {
+	if len(args) == 1 && args[0] == "list" {
+		return listCommand(c, args, "/api/admin/devices", "devices", []string{"ID", "NAME", "ONLINE", "APPROVED", "OWNER", "TAGS", "POWER", "LAST SEEN", "PENDING"},
+			func(item map[string]any) []any {
+				var power any
+				if p, ok := item["power"].(map[string]any); ok {
+					power = p["source"]
+					if percent, ok := p["percent"].(float64); ok {
+						power = fmt.Sprintf("%v %v%%", p["source"], percent)
+					}
+				}
+				return []any{item["id"], item["name"], item["online"], item["approved"], item["owner"], item["tags"], power, item["last_seen"], item["pending"]}
+			})
+	}
+	var err error
+	switch {
+	case len(args) >= 2 && args[0] == "tag":
+		tags := append([]string{}, args[2:]...)
+		_, err = c.do(http.MethodPut, "/api/admin/devices/"+url.PathEscape(args[1]), map[string]any{"tags": tags})
+	case len(args) == 3 && args[0] == "channel":
+		_, err = c.do(http.MethodPut, "/api/admin/devices/"+url.PathEscape(args[1]), map[string]any{"firmware_channel": args[2]})
+	case len(args) == 2 && (args[0] == "reboot" || args[0] == "wifi-scan" || args[0] == "neighbor-scan"):
+		var result map[string]any
+		result, err = c.do(http.MethodPost, "/api/admin/devices/"+url.PathEscape(args[1])+"/"+args[0], nil)
+		if err == nil && !jsonOutput {
+			fmt.Println(result["message_id"])
+		}
+	case len(args) == 2 && args[0] == "purge":
+		var result map[string]any
+		result, err = c.do(http.MethodPost, "/api/admin/devices/"+url.PathEscape(args[1])+"/purge", nil)
+		if err == nil && !jsonOutput {
+			fmt.Println(result["message"])
+		}
+	case len(args) == 1 && args[0] == "polls":
+		return listCommand(c, []string{"list"}, "/api/admin/long-polls", "long_polls", []string{"DEVICE", "NAME", "REMOTE", "USER AGENT", "STARTED", "WAITING"},
+			func(item map[string]any) []any {
+				waiting, _ := item["duration"].(float64)
+				return []any{item["device_id"], item["device_name"], item["remote_addr"], item["user_agent"], item["started_at"], fmt.Sprintf("%.0fs", waiting)}
+			})
+	case len(args) == 2 && args[0] == "release":
+		var result map[string]any
+		result, err = c.do(http.MethodPost, "/api/admin/devices/"+url.PathEscape(args[1])+"/release", nil)
+		if err == nil && !jsonOutput {
+			fmt.Printf("released %s long poll(s)\n", formatCell(result["released"]))
+		}
+	case len(args) == 1 && args[0] == "purge-all":
+		var result map[string]any
+		result, err = c.do(http.MethodPost, "/api/admin/purge", nil)
+		if err == nil && !jsonOutput {
+			fmt.Println(result["message"])
+		}
+	case len(args) == 2 && args[0] == "wifi":
+		return wifiCommand(c, args[1])
+	case len(args) == 2 && args[0] == "neighbors":
+		return listCommand(c, []string{"list"}, "/api/devices/"+url.PathEscape(args[1])+"/neighbors", "neighbors", []string{"IP", "MAC", "NAME", "SEEN"},
+			func(item map[string]any) []any {
+				return []any{item["ip"], item["mac_address"], item["name"], item["seen_at"]}
+			})
+	case len(args) == 2 && args[0] == "crashes":
+		return listCommand(c, []string{"list"}, "/api/devices/"+url.PathEscape(args[1])+"/crashes", "crashes", []string{"TIME", "RESET REASON", "UPTIME", "FIRMWARE", "DUMP"},
+			func(item map[string]any) []any {
+				// 回溯最后一行是异常信息
+				dump, _ := item["dump"].(string)
+				lines := strings.Split(strings.TrimSpace(dump), "\n")
+				dump = lines[len(lines)-1]
+				return []any{item["time"], item["reset_reason"], item["uptime"], item["firmware_version"], dump}
+			})
+	default:
+		return errors.New("usage: wolctl devices list | tag <id> [tag...] | channel <id> <channel> | reboot <id> | wifi-scan <id> | neighbor-scan <id> | purge <id> | purge-all | polls | release <id> | wifi <id> | neighbors <id> | crashes <id>")
+	}
+	return err
+}
+
+// 显示中继最近一次WiFi扫描的结果
+func wifiCommand(c *client, deviceID string) error {
+	result, err := c.do(http.MethodGet, "/api/devices/"+url.PathEscape(deviceID)+"/wifi-scans", nil)
+	if err != nil || jsonOutput {
+		return err
+	}
+	scans, _ := result["scans"].([]any)
+	if len(scans) == 0 {
+		return fmt.Errorf("no WiFi scan from %s yet, run \"wolctl devices wifi-scan %s\" first", deviceID, deviceID)
+	}
+	scan, _ := scans[0].(map[string]any)
+	fmt.Printf("scanned %s, connected to %s (%v dBm)\n", formatCell(scan["time"]), formatCell(scan["ssid"]), formatCell(scan["rssi"]))
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SSID\tBSSID\tCHANNEL\tRSSI\tSECURITY")
+	networks, _ := scan["networks"].([]any)
+	for _, n := range networks {
+		net, _ := n.(map[string]any)
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", formatCell(net["ssid"]), formatCell(net["bssid"]), formatCell(net["channel"]), formatCell(net["rssi"]), formatCell(net["security"]))
+	}
+	return tw.Flush()
+}
+
+func firmwareCommand(c *client, args []string) error {
+	switch {
+	case len(args) >= 1 && len(args) <= 2 && args[0] == "list":
+		path := "/api/admin/firmware"
+		if len(args) == 2 {
+			path += "?channel=" + url.QueryEscape(args[1])
+		}
+		return listCommand(c, args[:1], path, "firmware", []string{"ID", "CHANNEL", "VERSION", "SIZE", "SHA256", "ROLLOUT", "CREATED"},
+			func(item map[string]any) []any {
+				rollout, _ := item["rollout"].(map[string]any)
+				desc := fmt.Sprintf("%v%%", rollout["percent"])
+				if tags, ok := rollout["tags"].([]any); ok && len(tags) > 0 {
+					desc += fmt.Sprintf(" of %v", formatCell(tags))
+				}
+				return []any{item["id"], item["channel"], item["version"], item["size"], item["sha256"], desc, item["created_at"]}
+			})
+	case len(args) >= 4 && args[0] == "upload":
+		q := url.Values{"channel": {args[1]}, "version": {args[2]}}
+		for _, opt := range args[4:] {
+			key, value, ok := strings.Cut(opt, "=")
+			if !ok || (key != "percent" && key != "tags" && key != "notes") {
+				return fmt.Errorf("unknown option %q, use percent=N, tags=a,b or notes=text", opt)
+			}
+			q.Set(key, value)
+		}
+		file, err := os.Open(args[3])
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		result, err := c.do(http.MethodPost, "/api/admin/firmware?"+q.Encode(), file)
+		if err != nil || jsonOutput {
+			return err
+		}
+		fw, _ := result["firmware"].(map[string]any)
+		fmt.Printf("%v %v/%v %v bytes sha256 %v\n", fw["id"], fw["channel"], fw["version"], fw["size"], fw["sha256"])
+		return nil
+	case len(args) >= 3 && args[0] == "rollout":
+		percent, err := strconv.Atoi(args[2])
+		if err != nil {
+			return errors.New("percent must be a number")
+		}
+		rollout := map[string]any{"percent": percent, "tags": append([]string{}, args[3:]...)}
+		_, err = c.do(http.MethodPut, "/api/admin/firmware/"+url.PathEscape(args[1]), map[string]any{"rollout": rollout})
+		return err
+	case len(args) == 2 && args[0] == "delete":
+		_, err := c.do(http.MethodDelete, "/api/admin/firmware/"+url.PathEscape(args[1]), nil)
+		return err
+	}
+	return errors.New("usage: wolctl firmware list [channel] | upload <channel> <version> <file> [percent=N] [tags=a,b] | rollout <id> <percent> [tag...] | delete <id>")
+}
+
+func targetsCommand(c *client, args []string) error {
+	if len(args) == 1 && args[0] == "list" {
+		return listCommand(c, args, "/api/admin/targets", "targets", []string{"NAME", "MAC", "RELAY", "OWNER", "ACCESS", "DESCRIPTION"},
+			func(item map[string]any) []any {
+				return []any{item["name"], item["mac_address"], item["device_id"], item["owner"], item["access"], item["description"]}
+			})
+	}
+	var err error
+	switch {
+	case len(args) == 4 && args[0] == "share":
+		_, err = c.do(http.MethodPut, "/api/admin/targets/"+url.PathEscape(args[1])+"/shares/"+url.PathEscape(args[2]), map[string]string{"access": args[3]})
+	case len(args) == 3 && args[0] == "unshare":
+		_, err = c.do(http.MethodDelete, "/api/admin/targets/"+url.PathEscape(args[1])+"/shares/"+url.PathEscape(args[2]), nil)
+	case len(args) == 2 && (args[0] == "protect" || args[0] == "unprotect"):
+		err = updateTarget(c, args[1], map[string]any{"protected": args[0] == "protect"})
+	case len(args) >= 2 && args[0] == "hours":
+		windows, perr := parseWindows(args[2:])
+		if perr != nil {
+			return perr
+		}
+		err = updateTarget(c, args[1], map[string]any{"allowed_hours": windows})
+	case len(args) >= 1 && args[0] == "suggest":
+		return suggestTargets(c, args[1:])
+	case len(args) == 3 && args[0] == "cooldown":
+		var cooldown any = args[2]
+		if args[2] == "default" {
+			cooldown = nil
+		}
+		err = updateTarget(c, args[1], map[string]any{"cooldown": cooldown})
+	case len(args) == 2 && (args[0] == "suspend" || args[0] == "shutdown"):
+		var result map[string]any
+		result, err = c.do(http.MethodPost, "/api/admin/targets/"+url.PathEscape(args[1])+"/"+args[0], nil)
+		if err == nil && !jsonOutput {
+			fmt.Println(result["message"])
+		}
+	case len(args) >= 2 && args[0] == "policy":
+		var policy any
+		if len(args) > 2 {
+			if policy, err = parsePowerPolicy(args[2:]); err != nil {
+				return err
+			}
+		}
+		err = updateTarget(c, args[1], map[string]any{"power_policy": policy})
+	case len(args) >= 2 && args[0] == "destinations":
+		var destinations any
+		if len(args) > 2 {
+			destinations = args[2:]
+		}
+		err = updateTarget(c, args[1], map[string]any{"destinations": destinations})
+	case len(args) >= 2 && len(args) <= 4 && args[0] == "watts":
+		changes := map[string]any{"watts": nil, "standby_watts": nil}
+		for i, k := range []string{"watts", "standby_watts"} {
+			if len(args) > i+2 {
+				v, perr := strconv.ParseFloat(args[i+2], 64)
+				if perr != nil {
+					return fmt.Errorf("invalid %s %q", k, args[i+2])
+				}
+				changes[k] = v
+			}
+		}
+		err = updateTarget(c, args[1], changes)
+	default:
+		return errors.New("usage: wolctl targets list | share <name> <user> read|wake | unshare <name> <user> | protect|unprotect <name> | hours <name> [HH:MM-HH:MM[@mon,tue]...] | cooldown <name> <duration|default> | suggest [-add] | suspend|shutdown <name> | policy <name> [suspend|shutdown] [idle=30m] | destinations <name> [address...] | watts <name> [watts [standby_watts]]")
+	}
+	return err
+}
+
+// 解析 "shutdown idle=45m" 形式的自动睡眠策略，时长的校验交给服务器
+func parsePowerPolicy(args []string) (map[string]any, error) {
+	policy := map[string]any{}
+	for _, arg := range args {
+		switch k, v, _ := strings.Cut(arg, "="); {
+		case arg == "suspend" || arg == "shutdown":
+			policy["action"] = arg
+		case k == "idle" && v != "":
+			policy["idle_after"] = v
+		default:
+			return nil, fmt.Errorf("invalid policy argument %q, expected suspend, shutdown or idle=<duration>", arg)
+		}
+	}
+	return policy, nil
+}
+
+// 列出中继邻居表中尚未建为目标的主机，-add 按建议创建目标
+func suggestTargets(c *client, args []string) error {
+	fs := flag.NewFlagSet("targets suggest", flag.ExitOnError)
+	add := fs.Bool("add", false, "create a target for every suggestion")
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		return errors.New("usage: wolctl targets suggest [-add]")
+	}
+	result, err := c.do(http.MethodGet, "/api/admin/neighbors", nil)
+	if err != nil {
+		return err
+	}
+	suggestions, _ := result["suggestions"].([]any)
+	if !jsonOutput {
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tMAC\tRELAY\tIP\tVENDOR")
+		for _, item := range suggestions {
+			s, _ := item.(map[string]any)
+			probe, _ := s["probe"].(map[string]any)
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", formatCell(s["name"]), formatCell(s["mac_address"]), formatCell(s["device_id"]), formatCell(probe["host"]), formatCell(s["description"]))
+		}
+		tw.Flush()
+	}
+	if !*add {
+		return nil
+	}
+	for _, s := range suggestions {
+		if _, err := c.do(http.MethodPost, "/api/admin/targets", s); err != nil {
+			return err
+		}
+	}
+	if !jsonOutput {
+		fmt.Printf("created %d target(s)\n", len(suggestions))
+	}
+	return nil
+}
+
+// 修改目标的部分字段，其余字段按服务器上的值原样写回；值为 nil 的字段被清除
+func updateTarget(c *client, name string, changes map[string]any) error {
+	path := "/api/admin/targets/" + url.PathEscape(name)
+	result, err := c.do(http.MethodGet, path, nil)
+	if err != nil {
+		return err
+	}
+	target, _ := result["target"].(map[string]any)
+	body := map[string]any{}
+	for _, k := range []string{"name", "mac_address", "device_id", "description", "probe", "owner", "protected", "allowed_hours", "cooldown", "power_policy", "destinations", "watts", "standby_watts"} {
+		if v, ok := target[k]; ok {
+			body[k] = v
+		}
+	}
+	for k, v := range changes {
+		if v == nil {
+			delete(body, k)
+		} else {
+			body[k] = v
+		}
+	}
+	_, err = c.do(http.MethodPut, path, body)
+	return err
+}
+
+// 解析 22:00-06:00@mon,tue 形式的时段，时间的校验交给服务器
+func parseWindows(args []string) ([]map[string]any, error) {
+	windows := []map[string]any{}
+	for _, arg := range args {
+		spec, days, _ := strings.Cut(arg, "@")
+		from, to, ok := strings.Cut(spec, "-")
+		if !ok {
+			return nil, fmt.Errorf("time window must be HH:MM-HH:MM[@mon,tue], got %q", arg)
+		}
+		window := map[string]any{"from": from, "to": to}
+		if days != "" {
+			window["days"] = strings.Split(days, ",")
+		}
+		windows = append(windows, window)
+	}
+	return windows, nil
+}
+
+const orgsUsage = "usage: wolctl orgs list | add <name> | delete <name> | add-member <org> <user> | remove-member <org> <user>"
+
+func orgsCommand(c *client, args []string) error {
+	if len(args) == 1 && args[0] == "list" {
+		return listCommand(c, args, "/api/admin/orgs", "orgs", []string{"NAME", "OWNER", "MEMBERS", "DEVICES", "TARGETS"},
+			func(item map[string]any) []any {
+				return []any{item["name"], item["owner"], item["members"], item["devices"], item["targets"]}
+			})
+	}
+	var err error
+	switch {
+	case len(args) == 2 && args[0] == "add":
+		_, err = c.do(http.MethodPost, "/api/admin/orgs", map[string]string{"name": args[1]})
+	case len(args) == 2 && args[0] == "delete":
+		_, err = c.do(http.MethodDelete, "/api/admin/orgs/"+url.PathEscape(args[1]), nil)
+	case len(args) == 3 && args[0] == "add-member":
+		_, err = c.do(http.MethodPut, "/api/admin/orgs/"+url.PathEscape(args[1])+"/members/"+url.PathEscape(args[2]), nil)
+	case len(args) == 3 && args[0] == "remove-member":
+		_, err = c.do(http.MethodDelete, "/api/admin/orgs/"+url.PathEscape(args[1])+"/members/"+url.PathEscape(args[2]), nil)
+	default:
+		return errors.New(orgsUsage)
+	}
+	return err
+}
+
+func wakeCommand(c *client, args []string) error {
+	fs := flag.NewFlagSet("wake", flag.ExitOnError)
+	group := fs.String("group", "", "wake every target in this group")
+	device := fs.String("device", "", "relay device ID (with -mac)")
+	mac := fs.String("mac", "", "target MAC address (with -device)")
+	wait := fs.Duration("wait", 0, "wait up to this long for the relay to confirm, e.g. 30s")
+	dryRun := fs.Bool("dry-run", false, "only check the request and show what would happen")
+	overrideHours := fs.Bool("override-hours", false, "wake even outside the target's allowed hours (administrators only)")
+	file := fs.String("file", "", "wake every MAC address in a CSV (target_mac[,device_id]) or JSON file")
+	to := fs.String("to", "", "comma-separated addresses the relay sends the magic packet to, e.g. 192.168.1.255,unicast")
+	fs.Parse(args)
+	if *file != "" {
+		if fs.NArg() != 0 || *group != "" || *device != "" || *mac != "" || *dryRun || *overrideHours || *to != "" {
+			return errors.New("usage: wolctl wake [-wait 30s] -file <rows.csv|rows.json>")
+		}
+		return bulkWake(c, *file, *wait)
+	}
+
+	var body map[string]any
+	switch {
+	case *group != "" && fs.NArg() == 0 && *device == "" && *mac == "":
+		body = map[string]any{"group": *group}
+	case *device != "" && *mac != "" && fs.NArg() == 0 && *group == "":
+		body = map[string]any{"device_id": *device, "target_mac": *mac}
+	case fs.NArg() == 1 && *group == "" && *device == "" && *mac == "":
+		body = map[string]any{"target": fs.Arg(0)}
+	default:
+		return errors.New("usage: wolctl wake [-dry-run] [-override-hours] [-to <address,...>] <target> | -group <name> | -device <id> -mac <mac>")
+	}
+	if *dryRun {
+		body["dry_run"] = true
+	}
+	if *overrideHours {
+		body["override_hours"] = true
+	}
+	if *to != "" {
+		body["destinations"] = strings.Split(*to, ",")
+	}
+
+	result, err := c.do(http.MethodPost, "/api/wol/send", body)
+	if err != nil {
+		return err
+	}
+	if *dryRun {
+		return printDryRun(result)
+	}
+	var ids []string
+	if id, ok := result["message_id"].(string); ok {
+		ids = append(ids, id)
+	}
+	if list, ok := result["message_ids"].([]any); ok {
+		for _, id := range list {
+			ids = append(ids, fmt.Sprint(id))
+		}
+	}
+	if !jsonOutput {
+		for _, id := range ids {
+			fmt.Println(id)
+		}
+	}
+	if failures, ok := result["errors"].(map[string]any); ok && len(failures) > 0 {
+		for target, msg := range failures {
+			fmt.Fprintf(os.Stderr, "wolctl: %s: %v\n", target, msg)
+		}
+		return fmt.Errorf("%d target(s) could not be woken", len(failures))
+	}
+	// 受保护目标的唤醒等待另一位管理员批准，不等待确认
+	pending := make(map[string]bool)
+	if result["status"] == "pending_approval" {
+		pending[fmt.Sprint(result["message_id"])] = true
+	}
+	if list, ok := result["pending_approval"].([]any); ok {
+		for _, id := range list {
+			pending[fmt.Sprint(id)] = true
+		}
+	}
+	for id := range pending {
+		fmt.Fprintf(os.Stderr, "wolctl: %s is awaiting approval by another administrator\n", id)
+	}
+
+	if *wait > 0 {
+		for _, id := range ids {
+			if pending[id] {
+				continue
+			}
+			if err := waitMessage(c, id, *wait); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// 批量唤醒文件中的MAC地址，逐行显示结果，有行未能入队时返回错误
+func bulkWake(c *client, path string, wait time.Duration) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	result, err := c.do(http.MethodPost, "/api/wol/bulk", f)
+	if err != nil {
+		return err
+	}
+	rows, _ := result["rows"].([]any)
+	if !jsonOutput {
+		fmt.Printf("job %v: %v\n", result["job_id"], result["message"])
+		printBulkRows(rows)
+	}
+	if wait > 0 {
+		for _, item := range rows {
+			row, _ := item.(map[string]any)
+			if id, ok := row["message_id"].(string); ok && row["status"] != "pending_approval" {
+				if err := waitMessage(c, id, wait); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if result["success"] != true {
+		return fmt.Errorf("%v", result["message"])
+	}
+	return nil
+}
+
+func bulkCommand(c *client, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: wolctl bulk <job-id>")
+	}
+	result, err := c.do(http.MethodGet, "/api/wol/bulk/"+url.PathEscape(args[0]), nil)
+	if err != nil || jsonOutput {
+		return err
+	}
+	job, _ := result["job"].(map[string]any)
+	rows, _ := job["rows"].([]any)
+	fmt.Printf("job %v by %v at %s: %v of %d queued\n", job["id"], job["source"], formatCell(job["created_at"]), job["queued"], len(rows))
+	printBulkRows(rows)
+	return nil
+}
+
+// 目标自动发现任务
+func discoverCommand(c *client, args []string) error {
+	const usage = "usage: wolctl discover list | start [-wait 2m] <device-id> | show <job-id> | promote <job-id> <mac> [name]"
+	if len(args) == 0 {
+		return errors.New(usage)
+	}
+	switch args[0] {
+	case "list":
+		return listCommand(c, args, "/api/admin/discovery", "jobs", []string{"ID", "DEVICE", "STATUS", "HOSTS", "CREATED", "ERROR"},
+			func(item map[string]any) []any {
+				return []any{item["id"], item["device_id"], item["status"], item["host_count"], item["created_at"], item["error"]}
+			})
+	case "start":
+		fs := flag.NewFlagSet("discover start", flag.ExitOnError)
+		wait := fs.Duration("wait", 0, "wait for the relay's results and show them")
+		fs.Parse(args[1:])
+		if fs.NArg() != 1 {
+			return errors.New(usage)
+		}
+		result, err := c.do(http.MethodPost, "/api/admin/discovery", map[string]any{"device_id": fs.Arg(0)})
+		if err != nil {
+			return err
+		}
+		job, _ := result["job"].(map[string]any)
+		id, _ := job["id"].(string)
+		if *wait <= 0 {
+			if !jsonOutput {
+				fmt.Println(id)
+			}
+			return nil
+		}
+		deadline := time.Now().Add(*wait)
+		for {
+			result, err = c.do(http.MethodGet, "/api/admin/discovery/"+url.PathEscape(id), nil)
+			if err != nil {
+				return err
+			}
+			job, _ = result["job"].(map[string]any)
+			if job["status"] != "scanning" {
+				break
+			}
+			if time.Now().After(deadline) {
+				return fmt.Errorf("discovery %s: timed out waiting for the relay", id)
+			}
+			time.Sleep(2 * time.Second)
+		}
+		return printDiscovery(result)
+	case "show":
+		if len(args) != 2 {
+			return errors.New(usage)
+		}
+		result, err := c.do(http.MethodGet, "/api/admin/discovery/"+url.PathEscape(args[1]), nil)
+		if err != nil {
+			return err
+		}
+		return printDiscovery(result)
+	case "promote":
+		if len(args) != 3 && len(args) != 4 {
+			return errors.New(usage)
+		}
+		body := map[string]any{"mac_address": args[2]}
+		if len(args) == 4 {
+			body["name"] = args[3]
+		}
+		result, err := c.do(http.MethodPost, "/api/admin/discovery/"+url.PathEscape(args[1])+"/promote", body)
+		if err != nil || jsonOutput {
+			return err
+		}
+		target, _ := result["target"].(map[string]any)
+		fmt.Printf("created target %v\n", target["name"])
+		if warning, ok := result["warning"].(string); ok {
+			fmt.Println("warning:", warning)
+		}
+		return nil
+	default:
+		return errors.New(usage)
+	}
+}
+
+// 发现任务的主机，CANDIDATE 为 promote 时使用的建议名称
+func printDiscovery(result map[string]any) error {
+	job, _ := result["job"].(map[string]any)
+	if job["status"] == "failed" {
+		return fmt.Errorf("discovery %v failed: %v", job["id"], job["error"])
+	}
+	if jsonOutput {
+		return nil
+	}
+	hosts, _ := result["hosts"].([]any)
+	fmt.Printf("job %v on %v: %v, %d host(s)\n", job["id"], job["device_id"], job["status"], len(hosts))
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "IP\tMAC\tNAME\tVENDOR\tTARGET\tCANDIDATE")
+	for _, item := range hosts {
+		h, _ := item.(map[string]any)
+		target := h["target"]
+		if h["relay"] == true {
+			target = "(relay)"
+		}
+		candidate, _ := h["candidate"].(map[string]any)
+		cells := []any{h["ip"], h["mac_address"], h["name"], h["vendor"], target, candidate["name"]}
+		strs := make([]string, len(cells))
+		for i, cell := range cells {
+			strs[i] = formatCell(cell)
+		}
+		fmt.Fprintln(tw, strings.Join(strs, "\t"))
+	}
+	tw.Flush()
+	return nil
+}
+
+func printBulkRows(rows []any) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ROW\tMAC\tDEVICE\tTARGET\tSTATUS\tMESSAGE\tERROR")
+	for _, item := range rows {
+		row, _ := item.(map[string]any)
+		cells := []any{row["row"], row["target_mac"], row["device_id"], row["target"], row["status"], row["message_id"], row["error"]}
+		strs := make([]string, len(cells))
+		for i, cell := range cells {
+			strs[i] = formatCell(cell)
+		}
+		fmt.Fprintln(tw, strings.Join(strs, "\t"))
+	}
+	tw.Flush()
+}
+
+// 搜索消息，默认只取一页并提示下一页的游标，-all 取回全部结果
+func messagesCommand(c *client, args []string) error {
+	fs := flag.NewFlagSet("messages", flag.ExitOnError)
+	all := fs.Bool("all", false, "fetch every page")
+	fs.Parse(args)
+	q := url.Values{}
+	for _, arg := range fs.Args() {
+		k, v, ok := strings.Cut(arg, "=")
+		if !ok {
+			return errors.New("usage: wolctl messages [-all] [key=value...], e.g. status=failed since=7d")
+		}
+		q.Set(k, v)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	if !jsonOutput {
+		fmt.Fprintln(tw, "ID\tSTATUS\tTARGET\tTARGET MAC\tDEVICE\tSOURCE\tCREATED\tERROR")
+	}
+	for {
+		result, err := c.do(http.MethodGet, "/api/wol/messages/search?"+q.Encode(), nil)
+		if err != nil {
+			return err
+		}
+		if !jsonOutput {
+			messages, _ := result["messages"].([]any)
+			for _, item := range messages {
+				m, _ := item.(map[string]any)
+				cells := []any{m["id"], m["status"], firstCell(m["target"], m["type"]), m["target_mac"], m["device_id"], m["source"], m["created_at"], m["error"]}
+				strs := make([]string, len(cells))
+				for i, cell := range cells {
+					strs[i] = formatCell(cell)
+				}
+				fmt.Fprintln(tw, strings.Join(strs, "\t"))
+			}
+		}
+		cursor, _ := result["next_cursor"].(string)
+		if cursor == "" {
+			if !jsonOutput {
+				tw.Flush()
+				fmt.Printf("%v matching messages\n", result["total"])
+			}
+			return nil
+		}
+		q.Set("cursor", cursor)
+		if !*all {
+			if !jsonOutput {
+				tw.Flush()
+				fmt.Printf("%v matching messages, more with cursor=%s (or -all)\n", result["total"], cursor)
+			}
+			return nil
+		}
+	}
+}
+
+// 第一个非空的单元格
+func firstCell(values ...any) any {
+	for _, v := range values {
+		if v != nil && v != "" {
+			return v
+		}
+	}
+	return nil
+}
+
+// 按目标、设备或请求者统计唤醒次数和成功率
+func statsCommand(c *client, args []string) error {
+	if len(args) > 0 && args[0] == "energy" {
+		return energyStatsCommand(c, args[1:])
+	}
+	if len(args) > 0 && args[0] == "latency" {
+		return latencyStatsCommand(c, args[1:])
+	}
+	if len(args) > 2 {
+		return errors.New("usage: wolctl stats [target|device|user] [range]")
+	}
+	q := url.Values{}
+	if len(args) > 0 {
+		q.Set("group_by", args[0])
+	}
+	if len(args) > 1 {
+		q.Set("range", args[1])
+	}
+	result, err := c.do(http.MethodGet, "/api/stats/wakes?"+q.Encode(), nil)
+	if err != nil || jsonOutput {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "%s\tWAKES\tACKED\tFAILED\tCANCELLED\tPENDING\tSUCCESS\tLAST\n", strings.ToUpper(fmt.Sprint(result["group_by"])))
+	groups, _ := result["groups"].([]any)
+	if total, ok := result["total"].(map[string]any); ok {
+		groups = append(groups, total)
+	}
+	for _, item := range groups {
+		g, _ := item.(map[string]any)
+		rate := "-"
+		if v, ok := g["success_rate"].(float64); ok {
+			rate = fmt.Sprintf("%.1f%%", v*100)
+		}
+		last := "-"
+		if v, ok := g["last_wake"].(string); ok {
+			if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+				last = t.Local().Format("2006-01-02 15:04")
+			}
+		}
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t%v\t%s\t%s\n", g["key"], g["total"], g["acked"], g["failed"], g["cancelled"], g["pending"], rate, last)
+	}
+	return tw.Flush()
+}
+
+// 估算的用电量和自动睡眠节省的电量
+func energyStatsCommand(c *client, args []string) error {
+	if len(args) > 1 {
+		return errors.New("usage: wolctl stats energy [range]")
+	}
+	q := url.Values{}
+	if len(args) > 0 {
+		q.Set("range", args[0])
+	}
+	result, err := c.do(http.MethodGet, "/api/stats/energy?"+q.Encode(), nil)
+	if err != nil || jsonOutput {
+		return err
+	}
+	hours := func(v any) string {
+		seconds, _ := v.(float64)
+		return fmt.Sprintf("%.1fh", seconds/3600)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "TARGET\tWATTS\tON\tOFF\tAUTO-OFF\tUSED kWh\tSAVED kWh\tCOST\tSAVED")
+	targets, _ := result["targets"].([]any)
+	if total, ok := result["total"].(map[string]any); ok {
+		targets = append(targets, total)
+	}
+	for _, item := range targets {
+		e, _ := item.(map[string]any)
+		watts := "-"
+		if v, ok := e["watts"].(float64); ok {
+			standby, _ := e["standby_watts"].(float64)
+			watts = fmt.Sprintf("%g/%g", v, standby)
+		}
+		fmt.Fprintf(tw, "%v\t%s\t%s\t%s\t%s\t%.3f\t%.3f\t%s\t%s\n", e["target"], watts, hours(e["on_seconds"]), hours(e["off_seconds"]), hours(e["saved_seconds"]),
+			e["used_kwh"], e["saved_kwh"], formatCell(e["cost"]), formatCell(e["saved_cost"]))
+	}
+	return tw.Flush()
+}
+
+// 唤醒各阶段耗时的中位数和 P95
+func latencyStatsCommand(c *client, args []string) error {
+	if len(args) > 2 {
+		return errors.New("usage: wolctl stats latency [target|device] [range]")
+	}
+	q := url.Values{}
+	if len(args) > 0 {
+		q.Set("group_by", args[0])
+	}
+	if len(args) > 1 {
+		q.Set("range", args[1])
+	}
+	result, err := c.do(http.MethodGet, "/api/stats/latency?"+q.Encode(), nil)
+	if err != nil || jsonOutput {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "%s\tWAKES\tPOLL p50/p95\tRELAY p50/p95\tBOOT p50/p95\tTOTAL p50/p95\n", strings.ToUpper(fmt.Sprint(result["group_by"])))
+	groups, _ := result["groups"].([]any)
+	if total, ok := result["total"].(map[string]any); ok {
+		groups = append(groups, total)
+	}
+	for _, item := range groups {
+		g, _ := item.(map[string]any)
+		stages, _ := g["stages"].(map[string]any)
+		cells := []any{g["key"], g["wakes"]}
+		for _, stage := range []string{"poll", "relay", "boot", "total"} {
+			cell := "-"
+			if s, ok := stages[stage].(map[string]any); ok {
+				cell = fmt.Sprintf("%.1fs / %.1fs", s["p50"], s["p95"])
+			}
+			cells = append(cells, cell)
+		}
+		fmt.Fprintf(tw, "%v\t%v\t%s\t%s\t%s\t%s\n", cells...)
+	}
+	return tw.Flush()
+}
+
+// 显示试运行的结果，有请求会被拒绝时返回错误
+func printDryRun(result map[string]any) error {
+	if !jsonOutput {
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "TARGET\tDEVICE\tMAC\tACTION\tONLINE\tQUEUE\tPOWER\tNOTE")
+		wakes, _ := result["wakes"].([]any)
+		for _, item := range wakes {
+			p, _ := item.(map[string]any)
+			row := []any{p["target"], p["device_id"], p["target_mac"], p["action"], p["device_online"], p["queue_depth"], p["power"], firstCell(p["error"], p["warning"])}
+			for i, v := range row {
+				if v == nil || v == "" {
+					row[i] = "-"
+				}
+			}
+			fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\n", row...)
+		}
+		tw.Flush()
+		if skipped, _ := result["skipped"].([]any); len(skipped) > 0 {
+			fmt.Printf("skipped (already on): %v\n", skipped)
+		}
+		fmt.Println(result["message"])
+	}
+	if msg, ok := result["quota_error"].(string); ok {
+		return errors.New(msg)
+	}
+	if result["success"] != true {
+		return errors.New("the request would be rejected")
+	}
+	return nil
+}
+
+func versionCommand(c *client, args []string) error {
+	if len(args) != 0 {
+		return errors.New("usage: wolctl version")
+	}
+	info, err := c.do(http.MethodGet, "/api/version", nil)
+	if err != nil || jsonOutput {
+		return err
+	}
+	fmt.Printf("server:     %s %v\n", c.server, info["version"])
+	for _, f := range []struct{ label, key string }{
+		{"commit", "commit"},
+		{"built", "build_date"},
+		{"go", "go_version"},
+		{"platform", "platform"},
+		{"started", "started_at"},
+	} {
+		if v, ok := info[f.key].(string); ok && v != "" {
+			fmt.Printf("%-11s %s\n", f.label+":", v)
+		}
+	}
+	return nil
+}
+
+func maintenanceCommand(c *client, args []string) error {
+	const usage = "usage: wolctl maintenance [on [reason] [retry=N] | off]"
+	var result map[string]any
+	var err error
+	switch {
+	case len(args) == 0:
+		result, err = c.do(http.MethodGet, "/api/admin/maintenance", nil)
+	case args[0] == "off" && len(args) == 1:
+		result, err = c.do(http.MethodPut, "/api/admin/maintenance", map[string]any{"enabled": false})
+	case args[0] == "on":
+		body := map[string]any{"enabled": true}
+		var reason []string
+		for _, arg := range args[1:] {
+			if v, ok := strings.CutPrefix(arg, "retry="); ok {
+				n, convErr := strconv.Atoi(v)
+				if convErr != nil {
+					return fmt.Errorf("invalid retry %q: %v", v, convErr)
+				}
+				body["retry_after"] = n
+				continue
+			}
+			reason = append(reason, arg)
+		}
+		body["reason"] = strings.Join(reason, " ")
+		result, err = c.do(http.MethodPut, "/api/admin/maintenance", body)
+	default:
+		return errors.New(usage)
+	}
+	if err != nil || jsonOutput {
+		return err
+	}
+	m, _ := result["maintenance"].(map[string]any)
+	if m == nil {
+		fmt.Println("maintenance mode: off")
+		return nil
+	}
+	fmt.Printf("maintenance mode: on since %v by %v (retry after %vs)\n", m["since"], m["by"], m["retry_after"])
+	if reason, _ := m["reason"].(string); reason != "" {
+		fmt.Printf("reason: %s\n", reason)
+	}
+	return nil
+}
+
+func statusCommand(c *client, args []string) error {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	wait := fs.Duration("wait", 0, "wait up to this long for the message to be acknowledged")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: wolctl status [-wait 30s] <message-id>")
+	}
+	if *wait > 0 {
+		return waitMessage(c, fs.Arg(0), *wait)
+	}
+
+	result, err := c.do(http.MethodGet, "/api/wol/messages/"+fs.Arg(0), nil)
+	if err != nil || jsonOutput {
+		return err
+	}
+	msg, _ := result["message"].(map[string]any)
+	latency, _ := result["latency"].(map[string]any)
+	printMessage(msg, latency)
+	return nil
+}
+
+func getMessage(c *client, id string) (map[string]any, error) {
+	result, err := c.do(http.MethodGet, "/api/wol/messages/"+id, nil)
+	if err != nil {
+		return nil, err
+	}
+	msg, _ := result["message"].(map[string]any)
+	return msg, nil
+}
+
+func printMessage(msg, latency map[string]any) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, k := range []string{"id", "type", "status", "target", "target_mac", "device_id", "created_at", "queued_at", "delivered_at", "handled_at", "acked_at", "up_at", "error"} {
+		if v, ok := msg[k]; ok && v != "" {
+			fmt.Fprintf(tw, "%s:\t%s\n", k, formatCell(v))
+		}
+	}
+	// 各阶段耗时：轮询等待、中继、目标开机
+	var stages []string
+	for _, stage := range []string{"poll", "relay", "boot", "total"} {
+		if v, ok := latency[stage].(float64); ok {
+			stages = append(stages, fmt.Sprintf("%s %.1fs", stage, v))
+		}
+	}
+	if len(stages) > 0 {
+		fmt.Fprintf(tw, "latency:\t%s\n", strings.Join(stages, ", "))
+	}
+	tw.Flush()
+}
+
+// 等待消息被设备确认；失败或超时返回错误，便于脚本判断
+func waitMessage(c *client, id string, timeout time.Duration) error {
+	quiet := jsonOutput
+	jsonOutput = false
+	defer func() { jsonOutput = quiet }()
+
+	deadline := time.Now().Add(timeout)
+	for {
+		msg, err := getMessage(c, id)
+		if err != nil {
+			return err
+		}
+		switch status := msg["status"]; status {
+		case "acked":
+			if !quiet {
+				fmt.Printf("%s: acked\n", id)
+			}
+			return nil
+		case "failed":
+			return fmt.Errorf("%s: failed: %v", id, msg["error"])
+		default:
+			if time.Now().After(deadline) {
+				return fmt.Errorf("%s: still %v after %s", id, status, timeout)
+			}
+		}
+		time.Sleep(time.Second)
+	}
+}
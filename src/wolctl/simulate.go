@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// 负载模拟：模拟大量 ESP32 中继注册、长轮询并确认消息，用于在大规模设备下验证
+// 服务器改动对协程数、内存和延迟的影响。可按固定速率发送唤醒请求以测量下发延迟
+
+// 模拟设备使用本地管理的MAC地址段，不会与真实设备冲突
+const simMACPrefix = "02:57:4f"
+
+// 唤醒请求中使用的目标MAC，模拟设备只确认不发包
+const simTargetMAC = "02:57:4f:ff:ff:ff"
+
+type simulator struct {
+	c            *client // 管理请求（唤醒、统计、清理）
+	relay        *client // 模拟设备的请求，超时需长于服务器的长轮询
+	pollInterval time.Duration
+	failRate     float64
+	ackDelay     time.Duration
+
+	registered, polls, empty, delivered, acked, wakes, errs atomic.Int64
+
+	mu         sync.Mutex
+	ids        []string             // 已注册的模拟设备
+	sentAt     map[string]time.Time // message_id -> 发送时间
+	receivedAt map[string]time.Time // 发送响应返回前已被设备收到的消息
+	delivery   []time.Duration      // 发送唤醒到设备收到的延迟（本周期）
+	ackLatency []time.Duration      // 确认请求的耗时（本周期）
+	allDeliver []time.Duration
+	allAck     []time.Duration
+
+	// 上次报告时服务器的累计分配次数和客户端请求数，用于计算每个请求的分配次数
+	lastAllocs   float64
+	lastRequests int64
+}
+
+func simulateCommand(c *client, args []string) error {
+	fs := flag.NewFlagSet("simulate", flag.ExitOnError)
+	devices := fs.Int("devices", 100, "number of simulated relays")
+	pollInterval := fs.Duration("poll-interval", 5*time.Second, "pause between polls, like POLL_INTERVAL in the firmware")
+	ramp := fs.Duration("ramp", 10*time.Second, "spread device start-up over this period")
+	wakeRate := fs.Float64("wake-rate", 0, "wake requests per second sent to random simulated relays (0 = none)")
+	ackDelay := fs.Duration("ack-delay", 0, "delay between receiving a message and acknowledging it")
+	failRate := fs.Float64("fail-rate", 0, "fraction of messages acknowledged as failed (0-1)")
+	duration := fs.Duration("duration", 0, "stop after this long (0 = until interrupted)")
+	report := fs.Duration("report", 10*time.Second, "progress report interval")
+	cleanup := fs.Bool("cleanup", true, "delete the simulated devices when finished")
+	fs.Parse(args)
+	if fs.NArg() != 0 || *devices < 1 || *devices > 1<<24 || *pollInterval < 0 || *report <= 0 || *failRate < 0 || *failRate > 1 {
+		return errors.New("usage: wolctl simulate [-devices N] [-poll-interval 5s] [-ramp 10s] [-wake-rate R] [-ack-delay D] [-fail-rate F] [-duration D] [-report 10s] [-cleanup=false]")
+	}
+	jsonOutput = false
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if *duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *duration)
+		defer cancel()
+	}
+
+	s := &simulator{
+		c: c,
+		relay: &client{
+			server: c.server,
+			apiKey: c.apiKey,
+			http: &http.Client{
+				Timeout:   150 * time.Second,
+				Transport: &http.Transport{MaxIdleConnsPerHost: *devices, IdleConnTimeout: time.Minute},
+			},
+		},
+		pollInterval: *pollInterval,
+		failRate:     *failRate,
+		ackDelay:     *ackDelay,
+		sentAt:       make(map[string]time.Time),
+		receivedAt:   make(map[string]time.Time),
+	}
+
+	fmt.Printf("simulating %d relays against %s (poll interval %s, wake rate %g/s), Ctrl-C to stop\n", *devices, c.server, *pollInterval, *wakeRate)
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < *devices; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			delay := time.Duration(int64(*ramp) * int64(i) / int64(*devices))
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return
+			}
+			s.runDevice(ctx, i)
+		}(i)
+	}
+	if *wakeRate > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.sendWakes(ctx, *wakeRate)
+		}()
+	}
+
+	ticker := time.NewTicker(*report)
+	defer ticker.Stop()
+loop:
+	for {
+		select {
+		case <-ticker.C:
+			s.report(time.Since(start), *devices)
+		case <-ctx.Done():
+			break loop
+		}
+	}
+	wg.Wait()
+	s.summary(time.Since(start))
+
+	if *cleanup {
+		s.mu.Lock()
+		ids := s.ids
+		s.mu.Unlock()
+		failed := 0
+		for _, id := range ids {
+			if _, err := c.do(http.MethodDelete, "/api/admin/devices/"+url.PathEscape(id), nil); err != nil {
+				failed++
+			}
+		}
+		if failed > 0 {
+			return fmt.Errorf("could not delete %d of %d simulated devices", failed, len(ids))
+		}
+		fmt.Printf("deleted %d simulated devices\n", len(ids))
+	}
+	return nil
+}
+
+// 模拟一个中继：注册后循环长轮询，收到消息后逐条确认
+func (s *simulator) runDevice(ctx context.Context, index int) {
+	id := fmt.Sprintf("%s:%02x:%02x:%02x", simMACPrefix, index>>16&0xff, index>>8&0xff, index&0xff)
+	for {
+		_, err := s.relay.doContext(ctx, http.MethodPost, "/api/devices/register", map[string]string{
+			"name":        fmt.Sprintf("sim-%d", index),
+			"mac_address": id,
+			"description": "wolctl simulate",
+			"version":     "simulator",
+		})
+		if err == nil {
+			break
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		s.errs.Add(1)
+		if !sleepContext(ctx, s.pollInterval+time.Second) {
+			return
+		}
+	}
+	s.registered.Add(1)
+	s.mu.Lock()
+	s.ids = append(s.ids, id)
+	s.mu.Unlock()
+
+	path := "/api/wol/poll?device_id=" + url.QueryEscape(id)
+	for {
+		result, err := s.relay.doContext(ctx, http.MethodGet, path, nil)
+		if ctx.Err() != nil {
+			return
+		}
+		s.polls.Add(1)
+		if err != nil {
+			s.errs.Add(1)
+		} else {
+			messages, _ := result["messages"].([]any)
+			if len(messages) == 0 {
+				s.empty.Add(1)
+			}
+			for _, m := range messages {
+				msg, _ := m.(map[string]any)
+				messageID, _ := msg["id"].(string)
+				s.received(messageID, time.Now())
+				if s.ackDelay > 0 && !sleepContext(ctx, s.ackDelay) {
+					return
+				}
+				s.ack(ctx, id, messageID)
+			}
+		}
+		if !sleepContext(ctx, s.pollInterval) {
+			return
+		}
+	}
+}
+
+func (s *simulator) ack(ctx context.Context, deviceID, messageID string) {
+	body := map[string]any{"device_id": deviceID, "message_id": messageID, "success": true}
+	if s.failRate > 0 && rand.Float64() < s.failRate {
+		body["success"] = false
+		body["error"] = "simulated failure"
+	}
+	start := time.Now()
+	if _, err := s.relay.doContext(ctx, http.MethodPost, "/api/wol/ack", body); err != nil {
+		if ctx.Err() == nil {
+			s.errs.Add(1)
+		}
+		return
+	}
+	s.acked.Add(1)
+	s.mu.Lock()
+	s.ackLatency = append(s.ackLatency, time.Since(start))
+	s.mu.Unlock()
+}
+
+// 按固定速率向随机的已注册模拟设备发送唤醒请求
+func (s *simulator) sendWakes(ctx context.Context, rate float64) {
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / rate))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		s.mu.Lock()
+		if len(s.ids) == 0 {
+			s.mu.Unlock()
+			continue
+		}
+		deviceID := s.ids[rand.Intn(len(s.ids))]
+		s.mu.Unlock()
+
+		go func() {
+			sent := time.Now()
+			result, err := s.c.doContext(ctx, http.MethodPost, "/api/wol/send", map[string]string{"device_id": deviceID, "target_mac": simTargetMAC})
+			if err != nil {
+				if ctx.Err() == nil {
+					s.errs.Add(1)
+				}
+				return
+			}
+			s.wakes.Add(1)
+			if messageID, ok := result["message_id"].(string); ok {
+				s.sent(messageID, sent)
+			}
+		}()
+	}
+}
+
+// 记录发送时间；设备可能在发送响应返回前就收到消息，此时直接计算延迟
+func (s *simulator) sent(messageID string, at time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if received, ok := s.receivedAt[messageID]; ok {
+		delete(s.receivedAt, messageID)
+		s.delivery = append(s.delivery, received.Sub(at))
+		return
+	}
+	s.sentAt[messageID] = at
+}
+
+func (s *simulator) received(messageID string, at time.Time) {
+	s.delivered.Add(1)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sent, ok := s.sentAt[messageID]; ok {
+		delete(s.sentAt, messageID)
+		s.delivery = append(s.delivery, at.Sub(sent))
+		return
+	}
+	s.receivedAt[messageID] = at
+}
+
+// 输出一行进度：客户端计数、本周期延迟和服务器状态
+func (s *simulator) report(elapsed time.Duration, devices int) {
+	s.mu.Lock()
+	delivery, ackLatency := s.delivery, s.ackLatency
+	s.allDeliver = append(s.allDeliver, delivery...)
+	s.allAck = append(s.allAck, ackLatency...)
+	s.delivery, s.ackLatency = nil, nil
+	s.mu.Unlock()
+
+	line := fmt.Sprintf("%6s  relays %d/%d  polls %d  wakes %d  delivered %d  acked %d  errors %d  delivery %s  ack %s",
+		elapsed.Round(time.Second), s.registered.Load(), devices, s.polls.Load(), s.wakes.Load(),
+		s.delivered.Load(), s.acked.Load(), s.errs.Load(), percentiles(delivery), percentiles(ackLatency))
+	if stats, err := s.c.do(http.MethodGet, "/api/stats", nil); err == nil {
+		heap, _ := stats["heap_bytes"].(float64)
+		line += fmt.Sprintf("  server: goroutines %v  heap %.1fMB  long polls %v  pending %v",
+			stats["goroutines"], heap/(1<<20), stats["active_long_polls"], stats["pending_total"])
+		// 服务器在两次报告之间的内存分配次数除以模拟设备发出的请求数，包含后台任务的分配，
+		// 用于比较改动前后轮询路径的开销
+		allocs, _ := stats["allocs"].(float64)
+		requests := s.registered.Load() + s.polls.Load() + s.acked.Load() + s.wakes.Load()
+		if s.lastAllocs > 0 && requests > s.lastRequests {
+			line += fmt.Sprintf("  allocs/req %.0f", (allocs-s.lastAllocs)/float64(requests-s.lastRequests))
+		}
+		s.lastAllocs, s.lastRequests = allocs, requests
+	}
+	fmt.Println(line)
+}
+
+func (s *simulator) summary(elapsed time.Duration) {
+	s.mu.Lock()
+	s.allDeliver = append(s.allDeliver, s.delivery...)
+	s.allAck = append(s.allAck, s.ackLatency...)
+	s.mu.Unlock()
+	fmt.Printf("\nran %s: %d relays registered, %d polls (%d empty), %d wakes, %d delivered, %d acked, %d errors\n",
+		elapsed.Round(time.Second), s.registered.Load(), s.polls.Load(), s.empty.Load(), s.wakes.Load(),
+		s.delivered.Load(), s.acked.Load(), s.errs.Load())
+	fmt.Printf("delivery latency %s\nack latency      %s\n", percentiles(s.allDeliver), percentiles(s.allAck))
+}
+
+// p50/p90/p99/max，没有样本时输出 "-"
+func percentiles(samples []time.Duration) string {
+	if len(samples) == 0 {
+		return "-"
+	}
+	sorted := append([]time.Duration(nil), samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	at := func(p float64) time.Duration {
+		return sorted[int(p*float64(len(sorted)-1))].Round(time.Millisecond)
+	}
+	return fmt.Sprintf("p50=%s p90=%s p99=%s max=%s", at(0.5), at(0.9), at(0.99), at(1))
+}
+
+// 等待指定时间，期间被取消时返回 false
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+)
+
+// 交互式终端界面：目标、设备和消息三个面板，方向键选择，w 唤醒，c 取消，a 批准设备。
+// 通过事件流（/api/admin/events）实时更新。使用 stty 切换终端模式，仅支持类 Unix 系统
+
+const (
+	paneTargets = iota
+	paneMessages
+	paneDevices
+	paneCount
+)
+
+var paneNames = [paneCount]string{"Targets", "Messages", "Devices"}
+
+// TUI 中跟踪的消息
+type tuiMessage struct {
+	ID       string
+	Target   string
+	DeviceID string
+	Status   string
+	Error    string
+	Updated  time.Time
+}
+
+type tui struct {
+	c        *client
+	pane     int
+	sel      [paneCount]int
+	targets  []map[string]any
+	devices  []map[string]any
+	messages []*tuiMessage // 最新的在前
+	status   string
+	live     bool
+	width    int
+	height   int
+}
+
+// 服务器推送的事件（只解析需要的字段）
+type tuiEvent struct {
+	Type      string         `json:"type"`
+	DeviceID  string         `json:"device_id"`
+	MessageID string         `json:"message_id"`
+	Time      time.Time      `json:"time"`
+	Data      map[string]any `json:"data"`
+}
+
+func tuiCommand(c *client, args []string) error {
+	if len(args) != 0 {
+		return errors.New("usage: wolctl tui")
+	}
+	if fi, err := os.Stdin.Stat(); err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+		return errors.New("tui needs an interactive terminal")
+	}
+
+	saved, err := stty("-g")
+	if err != nil {
+		return fmt.Errorf("cannot configure terminal (stty): %w", err)
+	}
+	if _, err := stty("raw", "-echo"); err != nil {
+		return fmt.Errorf("cannot configure terminal (stty): %w", err)
+	}
+	// 切换到备用屏幕并隐藏光标，退出时恢复
+	fmt.Print("\x1b[?1049h\x1b[?25l")
+	defer func() {
+		fmt.Print("\x1b[?25h\x1b[?1049l")
+		stty(strings.TrimSpace(saved))
+	}()
+
+	t := &tui{c: c}
+	keys := make(chan string)
+	go readKeys(keys)
+	evts := make(chan tuiEvent, 64)
+	liveState := make(chan bool, 1)
+	go t.streamEvents(evts, liveState)
+
+	t.refresh()
+	t.render()
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case key, ok := <-keys:
+			if !ok || !t.handleKey(key) {
+				return nil
+			}
+		case e := <-evts:
+			t.applyEvent(e)
+		case t.live = <-liveState:
+		case <-ticker.C:
+			t.refresh()
+		}
+		t.render()
+	}
+}
+
+func stty(args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	out, err := cmd.Output()
+	return string(out), err
+}
+
+// 读取按键，方向键转换为 up/down/left/right
+func readKeys(keys chan<- string) {
+	defer close(keys)
+	r := bufio.NewReader(os.Stdin)
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return
+		}
+		if b != 0x1b {
+			keys <- string(b)
+			continue
+		}
+		// ESC [ A 等转义序列；单独的 ESC 按退出处理
+		if r.Buffered() == 0 {
+			keys <- "esc"
+			continue
+		}
+		if next, _ := r.ReadByte(); next != '[' && next != 'O' {
+			continue
+		}
+		switch code, _ := r.ReadByte(); code {
+		case 'A':
+			keys <- "up"
+		case 'B':
+			keys <- "down"
+		case 'C':
+			keys <- "right"
+		case 'D':
+			keys <- "left"
+		}
+	}
+}
+
+// 处理按键，返回 false 表示退出
+func (t *tui) handleKey(key string) bool {
+	switch key {
+	case "q", "esc", "\x03":
+		return false
+	case "\t", "right":
+		t.pane = (t.pane + 1) % paneCount
+	case "left":
+		t.pane = (t.pane + paneCount - 1) % paneCount
+	case "up", "k":
+		if t.sel[t.pane] > 0 {
+			t.sel[t.pane]--
+		}
+	case "down", "j":
+		if t.sel[t.pane] < t.paneLen(t.pane)-1 {
+			t.sel[t.pane]++
+		}
+	case "r":
+		t.refresh()
+	case "w", "\r":
+		if t.pane == paneTargets {
+			t.wakeSelected()
+		}
+	case "c":
+		if t.pane == paneMessages {
+			t.cancelSelected()
+		}
+	case "a":
+		if t.pane == paneDevices {
+			t.approveSelected()
+		}
+	}
+	return true
+}
+
+func (t *tui) paneLen(pane int) int {
+	switch pane {
+	case paneTargets:
+		return len(t.targets)
+	case paneMessages:
+		return len(t.messages)
+	default:
+		return len(t.devices)
+	}
+}
+
+func (t *tui) refresh() {
+	result, err := t.c.do(http.MethodGet, "/api/admin/targets", nil)
+	if err != nil {
+		t.status = err.Error()
+		return
+	}
+	t.targets = items(result, "targets")
+	result, err = t.c.do(http.MethodGet, "/api/admin/devices", nil)
+	if err != nil {
+		t.status = err.Error()
+		return
+	}
+	t.devices = items(result, "devices")
+	for pane := range t.sel {
+		if n := t.paneLen(pane); t.sel[pane] >= n {
+			t.sel[pane] = max(n-1, 0)
+		}
+	}
+}
+
+func items(result map[string]any, key string) []map[string]any {
+	list, _ := result[key].([]any)
+	out := make([]map[string]any, 0, len(list))
+	for _, item := range list {
+		if m, ok := item.(map[string]any); ok {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+func (t *tui) wakeSelected() {
+	if len(t.targets) == 0 {
+		return
+	}
+	name := fmt.Sprint(t.targets[t.sel[paneTargets]]["name"])
+	result, err := t.c.do(http.MethodPost, "/api/wol/send", map[string]string{"target": name})
+	if err != nil {
+		t.status = err.Error()
+		return
+	}
+	id, _ := result["message_id"].(string)
+	t.trackMessage(id, func(m *tuiMessage) {
+		m.Target = name
+		if m.Status == "" {
+			m.Status = "queued"
+		}
+	})
+	t.status = "wake sent to " + name + " (" + id + ")"
+}
+
+func (t *tui) cancelSelected() {
+	if len(t.messages) == 0 {
+		return
+	}
+	m := t.messages[t.sel[paneMessages]]
+	if _, err := t.c.do(http.MethodDelete, "/api/wol/messages/"+m.ID, nil); err != nil {
+		t.status = err.Error()
+		return
+	}
+	m.Status = "cancelled"
+	t.status = "cancelled " + m.ID
+}
+
+func (t *tui) approveSelected() {
+	if len(t.devices) == 0 {
+		return
+	}
+	id := fmt.Sprint(t.devices[t.sel[paneDevices]]["id"])
+	if _, err := t.c.do(http.MethodPost, "/api/admin/devices/"+id+"/approve", nil); err != nil {
+		t.status = err.Error()
+		return
+	}
+	t.status = "approved " + id
+	t.refresh()
+}
+
+// 查找或新建消息记录并应用更新
+func (t *tui) trackMessage(id string, update func(m *tuiMessage)) {
+	if id == "" {
+		return
+	}
+	for _, m := range t.messages {
+		if m.ID == id {
+			update(m)
+			m.Updated = time.Now()
+			return
+		}
+	}
+	m := &tuiMessage{ID: id, Updated: time.Now()}
+	update(m)
+	t.messages = append([]*tuiMessage{m}, t.messages...)
+	if len(t.messages) > 100 {
+		t.messages = t.messages[:100]
+	}
+	// 新消息插入顶部，保持当前选中的消息不变
+	if t.pane == paneMessages && len(t.messages) > 1 {
+		t.sel[paneMessages] = min(t.sel[paneMessages]+1, len(t.messages)-1)
+	}
+}
+
+func (t *tui) applyEvent(e tuiEvent) {
+	switch {
+	case strings.HasPrefix(e.Type, "message."):
+		t.trackMessage(e.MessageID, func(m *tuiMessage) {
+			m.Status = strings.TrimPrefix(e.Type, "message.")
+			m.DeviceID = e.DeviceID
+			if target, _ := e.Data["target"].(string); target != "" {
+				m.Target = target
+			} else if kind, _ := e.Data["type"].(string); kind != "" {
+				m.Target = kind
+			} else if m.Target == "" {
+				m.Target, _ = e.Data["target_mac"].(string)
+			}
+			if msg, _ := e.Data["error"].(string); msg != "" {
+				m.Error = msg
+			}
+		})
+		sort.SliceStable(t.messages, func(i, j int) bool { return t.messages[i].ID > t.messages[j].ID })
+	case strings.HasPrefix(e.Type, "device."):
+		t.refresh()
+	}
+}
+
+// 订阅服务器事件流，断开后自动重连
+func (t *tui) streamEvents(out chan<- tuiEvent, liveState chan<- bool) {
+	stream := &http.Client{} // 事件流是长连接，不设置超时
+	for {
+		// 连接失败或断开时稍后重连，状态栏显示 offline
+		func() error {
+			req, err := http.NewRequest(http.MethodGet, t.c.server+"/api/admin/events", nil)
+			if err != nil {
+				return err
+			}
+			req.Header.Set("X-API-Key", t.c.apiKey)
+			resp, err := stream.Do(req)
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				return errors.New(resp.Status)
+			}
+			liveState <- true
+			scanner := bufio.NewScanner(resp.Body)
+			for scanner.Scan() {
+				data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+				if !ok {
+					continue
+				}
+				var e tuiEvent
+				if json.Unmarshal([]byte(data), &e) == nil {
+					out <- e
+				}
+			}
+			return scanner.Err()
+		}()
+		liveState <- false
+		time.Sleep(3 * time.Second)
+	}
+}
+
+func (t *tui) render() {
+	// 无法获取终端大小时（例如部分串口终端报告 0 0）使用默认值
+	t.width, t.height = 100, 30
+	if size, err := stty("size"); err == nil {
+		var h, w int
+		if fmt.Sscan(size, &h, &w); h > 0 && w > 0 {
+			t.height, t.width = h, w
+		}
+	}
+
+	var b strings.Builder
+	line := func(s string) {
+		if len([]rune(s)) > t.width {
+			s = string([]rune(s)[:t.width])
+		}
+		b.WriteString(s + "\x1b[K\r\n")
+	}
+	b.WriteString("\x1b[H")
+
+	live := "\x1b[31m● offline\x1b[0m"
+	if t.live {
+		live = "\x1b[32m● live\x1b[0m"
+	}
+	line(fmt.Sprintf("\x1b[1mwolctl\x1b[0m  %s  %s", t.c.server, live))
+	var tabs []string
+	for i, name := range paneNames {
+		if i == t.pane {
+			tabs = append(tabs, "\x1b[7m "+name+" \x1b[0m")
+		} else {
+			tabs = append(tabs, " "+name+" ")
+		}
+	}
+	line(strings.Join(tabs, " "))
+	line("")
+
+	rows := t.height - 6
+	var lines []string
+	switch t.pane {
+	case paneTargets:
+		for _, tg := range t.targets {
+			lines = append(lines, fmt.Sprintf("%-20s %-17s relay %-17s %s", cell(tg["name"]), cell(tg["mac_address"]), cell(tg["device_id"]), cell(tg["description"])))
+		}
+	case paneMessages:
+		for _, m := range t.messages {
+			status := m.Status
+			switch status {
+			case "acked":
+				status = "\x1b[32m" + status + "\x1b[0m"
+			case "failed":
+				status = "\x1b[31m" + status + "\x1b[0m"
+			}
+			lines = append(lines, fmt.Sprintf("%-8s %-24s %-20s %-17s %s %s", m.Updated.Format("15:04:05"), m.ID, m.Target, m.DeviceID, status, m.Error))
+		}
+	case paneDevices:
+		for _, d := range t.devices {
+			state := "\x1b[90moffline\x1b[0m"
+			if d["online"] == true {
+				state = "\x1b[32monline \x1b[0m"
+			}
+			if d["approved"] == false {
+				state += " \x1b[33mpending approval\x1b[0m"
+			}
+			lines = append(lines, fmt.Sprintf("%-17s %-24s %s  pending %v", cell(d["id"]), cell(d["name"]), state, d["pending"]))
+		}
+	}
+	if len(lines) == 0 {
+		lines = append(lines, "  (empty)")
+	}
+	// 选中行保持在可见范围内
+	offset := 0
+	if sel := t.sel[t.pane]; sel >= rows {
+		offset = sel - rows + 1
+	}
+	for i := offset; i < len(lines) && i < offset+rows; i++ {
+		prefix := "  "
+		if i == t.sel[t.pane] && t.paneLen(t.pane) > 0 {
+			prefix = "\x1b[1m> "
+		}
+		line(prefix + lines[i] + "\x1b[0m")
+	}
+	b.WriteString("\x1b[J")
+	fmt.Fprintf(&b, "\x1b[%d;1H", t.height-1)
+	line(t.status)
+	b.WriteString("\x1b[2m←/→ tab: pane  ↑/↓: select  w/enter: wake  c: cancel message  a: approve device  r: refresh  q: quit\x1b[0m\x1b[K")
+	fmt.Print(b.String())
+}
+
+func cell(v any) string {
+	if v == nil {
+		return "-"
+	}
+	s := fmt.Sprint(v)
+	if s == "" {
+		return "-"
+	}
+	return s
+}